@@ -2,19 +2,326 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	com "github.com/sqlitebrowser/dbhub.io/common"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Sends an error response from the admin API.
+func apiError(w http.ResponseWriter, httpCode int, msg string) {
+	com.NoteError(w, msg)
+	apiResponse(w, httpCode, map[string]string{"error": msg})
+}
+
+// Wraps an admin API handler, checking the request method and API key.  If no API key is configured, the API is
+// turned off, as otherwise anything able to reach the admin server could call it.
+func apiHandler(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := com.AdminAPIKey()
+		if key == "" {
+			apiError(w, http.StatusForbidden, "The admin API is turned off, as no API key has been configured")
+			return
+		}
+		if r.Method != method {
+			apiError(w, http.StatusMethodNotAllowed, fmt.Sprintf("This API call needs to use %s", method))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+key)) != 1 {
+			apiError(w, http.StatusUnauthorized, "Missing or incorrect API key")
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Admin API call used by standby instances for replication.  Lists the database versions added after the given
+// cursor, oldest first, along with the cursor to ask from next time.
+func apiReplicationChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	var err error
+	if s := r.FormValue("since"); s != "" {
+		since, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || since < 0 {
+			apiError(w, http.StatusBadRequest, "The cursor needs to be a positive number")
+			return
+		}
+	}
+	limit := com.ReplicationBatchSize
+	if l := r.FormValue("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 1000 {
+			apiError(w, http.StatusBadRequest, "The limit needs to be a number between 1 and 1000")
+			return
+		}
+	}
+	changes, err := com.ReplicationChanges(since, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "Couldn't retrieve list of changes")
+		return
+	}
+	list := com.ReplicationChangeList{Changes: changes, Cursor: since}
+	if list.Changes == nil {
+		list.Changes = []com.ReplicationChange{}
+	}
+	if n := len(changes); n > 0 {
+		list.Cursor = changes[n-1].Cursor
+	}
+	apiResponse(w, http.StatusOK, list)
+}
+
+// Admin API call used by standby instances for replication.  Sends the database with the given SHA256.
+func apiReplicationObjectHandler(w http.ResponseWriter, r *http.Request) {
+	sha := r.FormValue("sha256")
+	if len(sha) != 64 {
+		apiError(w, http.StatusBadRequest, "Missing or invalid SHA256")
+		return
+	}
+	ver, found, err := com.StoredDBVersionBySHA256(sha)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, "No database with that SHA256")
+		return
+	}
+	userDB, err := com.MinioHandle(r.Context(), ver.MinioBkt, ver.MinioID)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "Couldn't retrieve the database")
+		return
+	}
+	defer com.MinioHandleClose(userDB)
+
+	w.Header().Set("Content-Type", "application/x-sqlite3")
+	w.Header().Set("Content-Length", strconv.FormatInt(ver.Size, 10))
+	_, err = io.Copy(w, userDB)
+	if err != nil {
+		log.Printf("Error sending database '%s' for replication: %v\n", sha, err)
+	}
+}
+
+// Sends a JSON response from the admin API.
+func apiResponse(w http.ResponseWriter, httpCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpCode)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Printf("Error returning admin API response: %v\n", err)
+	}
+}
+
+// Returns the user an admin API request is for, checking it exists.  If there's a problem, an error response is sent
+// and the returned user name is empty.
+func apiUser(w http.ResponseWriter, r *http.Request) string {
+	u, err := com.GetFormUsername(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return ""
+	}
+	userName := strings.ToLower(u)
+	exists, err := com.CheckUserExists(userName)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "Database query failed")
+		return ""
+	}
+	if !exists {
+		apiError(w, http.StatusNotFound, fmt.Sprintf("Unknown user '%s'", userName))
+		return ""
+	}
+	return userName
+}
+
+// Admin API call to delete a user, along with all of their databases.
+func apiUserDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	userName := apiUser(w, r)
+	if userName == "" {
+		return
+	}
+	err := deleteUser(userName)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: User deleted: %v\n", userName)
+	apiResponse(w, http.StatusOK, map[string]string{"username": userName, "status": "deleted"})
+}
+
+// Admin API call to disable a user.  They're no longer able to log in, or use their existing web sessions, client
+// certificate or OAuth access tokens.
+func apiUserDisableHandler(w http.ResponseWriter, r *http.Request) {
+	userName := apiUser(w, r)
+	if userName == "" {
+		return
+	}
+	err := com.SetUserDisabled(userName, true)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: User disabled: %v\n", userName)
+	apiResponse(w, http.StatusOK, map[string]string{"username": userName, "status": "disabled"})
+}
+
+// Admin API call to re-enable a previously disabled user.
+func apiUserEnableHandler(w http.ResponseWriter, r *http.Request) {
+	userName := apiUser(w, r)
+	if userName == "" {
+		return
+	}
+	err := com.SetUserDisabled(userName, false)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: User enabled: %v\n", userName)
+	apiResponse(w, http.StatusOK, map[string]string{"username": userName, "status": "enabled"})
+}
+
+// Admin API call to list all users, along with their status and storage use.
+func apiUserListHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := com.UserAccounts()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "Couldn't retrieve list of users")
+		return
+	}
+	if list == nil {
+		list = []com.UserAccount{}
+	}
+	apiResponse(w, http.StatusOK, list)
+}
+
+// Admin API call to set the storage quota for a user, in bytes.  A quota of zero means unlimited.
+func apiUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	userName := apiUser(w, r)
+	if userName == "" {
+		return
+	}
+	quota, err := strconv.ParseInt(r.PostFormValue("quota"), 10, 64)
+	if err != nil || quota < 0 {
+		apiError(w, http.StatusBadRequest, "The quota needs to be a number of bytes, or 0 for unlimited")
+		return
+	}
+	err = com.SetUserStorageQuota(userName, quota)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: Storage quota for '%v' set to %d bytes\n", userName, quota)
+	apiResponse(w, http.StatusOK, map[string]interface{}{"username": userName, "storage_quota": quota})
+}
+
+// Admin API call to generate a new client certificate for a user.  Their previous certificates stop working.
+func apiUserResetCertHandler(w http.ResponseWriter, r *http.Request) {
+	userName := apiUser(w, r)
+	if userName == "" {
+		return
+	}
+	newCert, err := resetClientCert(userName)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, fmt.Sprintf("Error generating client certificate: %v", err))
+		return
+	}
+	log.Printf("Admin API: Client certificate reset for user: %v\n", userName)
+	apiResponse(w, http.StatusOK, map[string]string{"username": userName, "certificate": string(newCert)})
+}
+
+// Handler to schedule and remove the announcement banners shown at the top of every webUI page.
+func bannersHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Announcement banners page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "banners.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Add or remove a banner, if requested
+	if r.Method == "POST" {
+		switch r.PostFormValue("action") {
+		case "add":
+			a := com.Announcement{
+				Level:   r.PostFormValue("level"),
+				Message: strings.TrimSpace(r.PostFormValue("message")),
+			}
+			if a.Message == "" {
+				http.Error(w, "The banner message can't be empty", http.StatusBadRequest)
+				return
+			}
+			if a.Level != com.AnnouncementInfo && a.Level != com.AnnouncementWarning &&
+				a.Level != com.AnnouncementDanger {
+				http.Error(w, "Unknown banner level", http.StatusBadRequest)
+				return
+			}
+			a.Starts, err = time.Parse("2006-01-02T15:04", r.PostFormValue("starts"))
+			if err != nil {
+				http.Error(w, "Invalid start time", http.StatusBadRequest)
+				return
+			}
+			a.Ends, err = time.Parse("2006-01-02T15:04", r.PostFormValue("ends"))
+			if err != nil || !a.Ends.After(a.Starts) {
+				http.Error(w, "Invalid end time", http.StatusBadRequest)
+				return
+			}
+			id, err := com.AddAnnouncement(a)
+			if err != nil {
+				http.Error(w, "Couldn't add the banner", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Added announcement banner %d\n", pageName, id)
+		case "remove":
+			id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid banner ID", http.StatusBadRequest)
+				return
+			}
+			err = com.RemoveAnnouncement(id)
+			if err != nil {
+				http.Error(w, "Couldn't remove the banner", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Removed announcement banner %d\n", pageName, id)
+		}
+		http.Redirect(w, r, "/banners", http.StatusSeeOther)
+		return
+	}
+
+	// Gather the list of banners
+	var tempRows struct {
+		Banners     []com.Announcement
+		DefaultEnds string
+		DefaultFrom string
+	}
+	now := time.Now().UTC()
+	tempRows.DefaultFrom = now.Format("2006-01-02T15:04")
+	tempRows.DefaultEnds = now.Add(7 * 24 * time.Hour).Format("2006-01-02T15:04")
+	tempRows.Banners, err = com.Announcements()
+	if err != nil {
+		http.Error(w, "Couldn't retrieve list of banners", http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func certDownloadHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the username
 	u, err := com.GetFormUsername(r)
@@ -52,9 +359,8 @@ func certGenerateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	userName := strings.ToLower(u)
 
-	// Generate a new certificate
-	// TODO: Use 14 days for now.  Extend this when things work properly.
-	newCert, err := com.GenerateClientCert(userName, 14)
+	// Generate and store a new certificate
+	_, err = resetClientCert(userName)
 	if err != nil {
 		log.Printf("%s: Error generating client certificate for user '%s': %s!\n", pageName, userName, err)
 		http.Error(w, fmt.Sprintf("Error generating client certificate for user '%s': %s!\n", userName, err),
@@ -62,14 +368,6 @@ func certGenerateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Store the new certificate in the database
-	err = com.SetClientCert(newCert, userName)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Updating client certificate failed: %v", err),
-			http.StatusInternalServerError)
-		return
-	}
-
 	// Generate succeeded, so bounce back to the user modification page
 	http.Redirect(w, r, fmt.Sprintf("/usermod?username=%s", userName), http.StatusSeeOther)
 }
@@ -103,13 +401,21 @@ func certUploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update the user certificate
-	err = com.SetClientCert(certBuffer.Bytes(), userName)
+	// Update the user certificate, replacing their existing ones
+	err = com.RevokeClientCerts(userName)
+	if err == nil {
+		err = com.SetClientCert(certBuffer.Bytes(), userName)
+	}
+	if err == nil {
+		err = com.RegisterClientCert(userName, "Uploaded by an administrator", certBuffer.Bytes())
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Updating client certificate failed: %v", err),
 			http.StatusInternalServerError)
 		return
 	}
+	com.SecurityNotice(userName, "A new DB4S client certificate was uploaded for your account by an "+
+		"administrator.  Your previous certificates no longer work.")
 
 	// Log the successful certificate upload
 	log.Printf("%s: Username: %v, new certificate uploaded, %v bytes\n", pageName, userName, nBytes)
@@ -118,6 +424,39 @@ func certUploadHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/usermod?username=%s", userName), http.StatusSeeOther)
 }
 
+// Handler to cross check PostgreSQL database version details against the objects stored in Minio.  Mismatches are
+// only repaired when the form is submitted with repair=true.
+func consistencyHandler(w http.ResponseWriter, r *http.Request) {
+	repair := r.PostFormValue("repair") == "true"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "consistency.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Run the consistency check
+	var tempRows struct {
+		Problems []com.ConsistencyProblem
+		Repair   bool
+	}
+	tempRows.Repair = repair
+	tempRows.Problems, err = com.CheckStorageConsistency(repair)
+	if err != nil {
+		http.Error(w, "Couldn't run the consistency check", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Storage consistency check found %d problem(s). Repair: %v\n", len(tempRows.Problems), repair)
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func dbDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the form data
 	dbOwner, dbName, dbVersion, err := com.GetFormUDV(r)
@@ -126,10 +465,14 @@ func dbDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Extract folder name from form data too
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Retrieve the Minio bucket and id
-	bucket, id, err := com.MinioBucketID(dbOwner, dbName, dbVersion, dbOwner)
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, dbOwner)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -143,15 +486,14 @@ func dbDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Remove the database version entry from PostgreSQL
-	// TODO: Update this to handle folder names properly
-	err = com.RemoveDBVersion(dbOwner, "/", dbName, dbVersion)
+	err = com.RemoveDBVersion(dbOwner, dbFolder, dbName, dbVersion)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Log the successful database removal
-	log.Printf("Database entry removed for '%s/%s' version %v\n", dbOwner, dbName, dbVersion)
+	log.Printf("Database entry removed for '%s%s%s' version %v\n", dbOwner, dbFolder, dbName, dbVersion)
 
 	// Success, so bounce back to the database management page
 	http.Redirect(w, r, fmt.Sprintf("/dbmanage?username=%s", dbOwner), http.StatusSeeOther)
@@ -167,15 +509,21 @@ func dbDownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Retrieve the Minio bucket and id
-	bucket, id, err := com.MinioBucketID(dbOwner, dbName, dbVersion, "")
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Get a handle from Minio for the database object
-	userDB, err := com.MinioHandle(bucket, id)
+	userDB, err := com.MinioHandle(r.Context(), bucket, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -374,8 +722,8 @@ func dbUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Store the database file in Minio
-	// TODO: Is there a potential security problem here from using handler.Header[] directly?  Maybe needs validation
-	bytesWritten, err := com.StoreMinioObject(bucket, minioID, &tempBuf, handler.Header["Content-Type"][0])
+	dbSize := tempBuf.Len()
+	storedSize, err := com.StoreMinioObject(r.Context(), bucket, minioID, &tempBuf)
 	if err != nil {
 		log.Printf("%s: Storing file in Minio failed: %v\n", pageName, err)
 		http.Error(w, fmt.Sprintf("Storing file in Minio failed: %v\n", err), http.StatusInternalServerError)
@@ -383,7 +731,7 @@ func dbUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add the new database details to the PG database
-	err = com.AddDatabase(userName, folder, dbName, ver, shaSum[:], bytesWritten, public, bucket, minioID)
+	err = com.AddDatabase(userName, folder, dbName, ver, shaSum[:], dbSize, storedSize, public, bucket, minioID, "", "", "", "", "")
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Adding database to PostgreSQL failed: %v\n", err),
 			http.StatusInternalServerError)
@@ -392,12 +740,172 @@ func dbUploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Log the successful database upload
 	log.Printf("%s: Username: %v, database '%v' uploaded as '%v', bytes: %v\n", pageName, userName, dbName,
-		minioID, bytesWritten)
+		minioID, dbSize)
 
 	// Database upload succeeded, so bounce back to the database management page
 	http.Redirect(w, r, fmt.Sprintf("/dbmanage?username=%s", userName), http.StatusSeeOther)
 }
 
+// Removes a user, along with their Minio bucket and all of the databases in it.
+func deleteUser(userName string) error {
+	// Retrieve the Minio bucket for the user
+	bucket, err := com.MinioUserBucket(userName)
+	if err != nil {
+		return err
+	}
+
+	// Check if a Minio bucket for the user exists
+	found, err := com.MinioBucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if found {
+		// Remove the bucket and all files inside it
+		err = com.RemoveMinioBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove the user from PostgreSQL
+	return com.UserDelete(userName)
+}
+
+// Sends the email digests which are due, on a timer.
+func digestLoop() {
+	for {
+		sent, err := com.SendDigests()
+		if err != nil {
+			log.Printf("Error when sending email digests: %v\n", err)
+		}
+		if sent > 0 {
+			log.Printf("Sent %d email digest(s)\n", sent)
+		}
+		time.Sleep(com.DigestInterval)
+	}
+}
+
+// Handler to export the metadata for this instance, for importing into another one
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := com.ExportMetadata()
+	if err != nil {
+		http.Error(w, "Couldn't export instance metadata", http.StatusInternalServerError)
+		return
+	}
+
+	// Send the export to the user
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=dbhub-metadata-%s.json",
+		data.Exported.Format("20060102-150405")))
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Printf("Error returning metadata export: %v\n", err)
+		return
+	}
+	log.Printf("Instance metadata exported\n")
+}
+
+func featuresHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Feature flags page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "features.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Override a feature flag, or go back to its default, if requested
+	if r.Method == "POST" {
+		name := r.PostFormValue("name")
+		switch r.PostFormValue("action") {
+		case "set":
+			f := com.FeatureFlag{
+				Beta:    r.PostFormValue("beta") == "true",
+				Enabled: r.PostFormValue("enabled") == "true",
+				Name:    name,
+			}
+			if p := strings.TrimSpace(r.PostFormValue("percent")); p != "" {
+				f.RolloutPercent, err = strconv.Atoi(p)
+				if err != nil {
+					http.Error(w, "Invalid rollout percentage", http.StatusBadRequest)
+					return
+				}
+			}
+			f.Users = strings.FieldsFunc(r.PostFormValue("users"), func(c rune) bool {
+				return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+			})
+			err = com.SetFeatureFlag(f)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("%s: Overrode feature flag '%s'\n", pageName, name)
+		case "remove":
+			err = com.RemoveFeatureFlag(name)
+			if err != nil {
+				http.Error(w, "Couldn't remove the feature flag override", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Removed override of feature flag '%s'\n", pageName, name)
+		}
+		http.Redirect(w, r, "/features", http.StatusSeeOther)
+		return
+	}
+
+	// Gather the list of feature flags
+	var tempRows struct {
+		Features []com.FeatureFlag
+	}
+	tempRows.Features, err = com.FeatureFlags()
+	if err != nil {
+		http.Error(w, "Couldn't retrieve list of feature flags", http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Handler to import instance metadata exported from another server.  The database files need to be copied across
+// to Minio separately.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Metadata import page"
+
+	// Grab the uploaded export file
+	r.ParseMultipartForm(32 << 20) // 64MB of ram max
+	tempFile, _, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("%s: Uploading file failed: %v\n", pageName, err)
+		http.Error(w, fmt.Sprintf("Uploading file failed: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	defer tempFile.Close()
+
+	var data com.InstanceMetadata
+	err = json.NewDecoder(tempFile).Decode(&data)
+	if err != nil {
+		log.Printf("%s: Decoding metadata export failed: %v\n", pageName, err)
+		http.Error(w, fmt.Sprintf("Decoding metadata export failed: %v\n", err), http.StatusBadRequest)
+		return
+	}
+
+	// Import the data
+	err = com.ImportMetadata(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Importing metadata failed: %v\n", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s: Imported metadata exported from '%s' at %v\n", pageName, data.Server, data.Exported)
+
+	// Success, so bounce back to the front page
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 func main() {
 	// Read server configuration
 	var err error
@@ -417,30 +925,313 @@ func main() {
 		log.Fatalf(err.Error())
 	}
 
+	// Set up tracing
+	err = com.ConnectTracing("admin")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	defer com.DisconnectTracing()
+
+	// Periodically remove orphaned Minio objects
+	go minioGC()
+
+	// Send the email digests as they fall due
+	if com.EmailServer() != "" {
+		go digestLoop()
+	}
+
+	// Send the database webhook deliveries as they fall due
+	go webhookLoop()
+
+	// Count the rows changed by new database versions, for the contributor statistics
+	go rowStatsLoop()
+
+	// On a standby instance, keep copying new database versions from the primary
+	if com.ReplicationSource() != "" {
+		go com.ReplicationLoop()
+	}
+
 	// URL handlers
 	http.HandleFunc("/", rootHandler)
+	http.HandleFunc("/api/replication/changes", apiHandler("GET", apiReplicationChangesHandler))
+	http.HandleFunc("/api/replication/object", apiHandler("GET", apiReplicationObjectHandler))
+	http.HandleFunc("/api/users", apiHandler("GET", apiUserListHandler))
+	http.HandleFunc("/api/users/delete", apiHandler("POST", apiUserDeleteHandler))
+	http.HandleFunc("/api/users/disable", apiHandler("POST", apiUserDisableHandler))
+	http.HandleFunc("/api/users/enable", apiHandler("POST", apiUserEnableHandler))
+	http.HandleFunc("/api/users/quota", apiHandler("POST", apiUserQuotaHandler))
+	http.HandleFunc("/api/users/resetcert", apiHandler("POST", apiUserResetCertHandler))
+	http.HandleFunc("/banners", bannersHandler)
 	http.HandleFunc("/certdownload", certDownloadHandler)
 	http.HandleFunc("/certgenerate", certGenerateHandler)
 	http.HandleFunc("/certupload", certUploadHandler)
+	http.HandleFunc("/consistency", consistencyHandler)
 	http.HandleFunc("/dbdel", dbDeleteHandler)
 	http.HandleFunc("/dbdownload", dbDownloadHandler)
 	http.HandleFunc("/dbmanage", dbManageHandler)
 	http.HandleFunc("/dbupload", dbUploadHandler)
+	http.HandleFunc("/export", exportHandler)
+	http.HandleFunc("/features", featuresHandler)
+	http.HandleFunc("/import", importHandler)
+	http.HandleFunc("/notify", notifyHandler)
+	http.HandleFunc("/oauthclients", oauthClientsHandler)
+	http.HandleFunc("/orphans", orphansHandler)
+	http.HandleFunc("/rescan", rescanHandler)
+	http.HandleFunc("/takedowns", takedownsHandler)
+	http.HandleFunc("/terms", termsHandler)
 	http.HandleFunc("/userdel", userDelHandler)
 	http.HandleFunc("/usermod", userModFormHandler)
 	http.HandleFunc("/usermodaction", userModActionHandler)
 
 	// Start server
+	handler := com.ReportErrors("admin", com.TraceHandler(http.DefaultServeMux))
 	if com.AdminServerHTTPS() {
 		log.Printf("Starting DBHub admin server on https://%s\n", com.AdminServerAddress())
 		log.Fatal(http.ListenAndServeTLS(com.AdminServerAddress(), com.AdminServerCert(),
-			com.AdminServerCertKey(), nil))
+			com.AdminServerCertKey(), handler))
 	} else {
 		log.Printf("Starting DataGen admin server on http://%s\n", com.AdminServerAddress())
-		log.Fatal(http.ListenAndServe(com.AdminServerAddress(), nil))
+		log.Fatal(http.ListenAndServe(com.AdminServerAddress(), handler))
 	}
 }
 
+// Purges deleted database versions past their restore window, then removes orphaned Minio objects and expired
+// cached CSV downloads, on a timer.
+func minioGC() {
+	for {
+		// Deleted database versions past their restore window are purged first, so their objects are collected too
+		purged, err := com.PurgeDeletedVersions(com.WebDeletedVersionDays())
+		if err != nil {
+			log.Printf("Error when purging deleted database versions: %v\n", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted database version(s)\n", purged)
+		}
+		removed, err := com.RemoveOrphanedMinioObjects(com.MinioGCSafetyWindow)
+		if err != nil {
+			log.Printf("Error when removing orphaned Minio objects: %v\n", err)
+		}
+		if len(removed) > 0 {
+			log.Printf("Removed %d orphaned Minio object(s)\n", len(removed))
+		}
+		expired, err := com.RemoveExpiredCSVCache(com.CSVCacheLifetime)
+		if err != nil {
+			log.Printf("Error when removing expired cached CSV downloads: %v\n", err)
+		}
+		if expired > 0 {
+			log.Printf("Removed %d expired cached CSV download(s)\n", expired)
+		}
+		time.Sleep(com.MinioGCInterval)
+	}
+}
+
+// Handler to send admin notifications, either to a single user or to everyone.
+func notifyHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Send notification page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "notify.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var tempRows struct {
+		Sent string
+	}
+	if r.Method == "POST" {
+		message := strings.TrimSpace(r.PostFormValue("message"))
+		if message == "" {
+			http.Error(w, "The notification message can't be empty", http.StatusBadRequest)
+			return
+		}
+		link := strings.TrimSpace(r.PostFormValue("link"))
+		userName := strings.ToLower(strings.TrimSpace(r.PostFormValue("username")))
+		if userName == "" {
+			err = com.BroadcastNotification(com.NotifyAdmin, message, link)
+			if err != nil {
+				http.Error(w, "Couldn't send the notification", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Sent notification to all users\n", pageName)
+			tempRows.Sent = "all users"
+		} else {
+			exists, err := com.CheckUserExists(userName)
+			if err != nil {
+				http.Error(w, "Couldn't check if the user exists", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Unknown user", http.StatusBadRequest)
+				return
+			}
+			err = com.Notify([]string{userName}, com.NotifyAdmin, message, link)
+			if err != nil {
+				http.Error(w, "Couldn't send the notification", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Sent notification to '%s'\n", pageName, userName)
+			tempRows.Sent = userName
+		}
+	}
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Handler to manage the third party applications which can request access to user accounts through OAuth.  New
+// clients are shown with their secret, as it isn't stored and can't be displayed again.
+func oauthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "OAuth clients page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "oauthclients.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var tempRows struct {
+		Clients   []com.OAuthClient
+		NewClient com.OAuthClient
+		NewSecret string
+	}
+
+	// Add or remove a client, if requested
+	if r.Method == "POST" {
+		switch r.PostFormValue("action") {
+		case "add":
+			name := r.PostFormValue("name")
+			redirectURI := r.PostFormValue("redirect_uri")
+			if name == "" || redirectURI == "" {
+				http.Error(w, "Both a name and redirect URI are needed", http.StatusBadRequest)
+				return
+			}
+			tempRows.NewClient.Name = name
+			tempRows.NewClient.ClientID, tempRows.NewSecret, err = com.AddOAuthClient(name, redirectURI)
+			if err != nil {
+				http.Error(w, "Couldn't add OAuth client", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Added OAuth client '%s' (%s)\n", pageName, name, tempRows.NewClient.ClientID)
+		case "remove":
+			err = com.RemoveOAuthClient(r.PostFormValue("client_id"))
+			if err != nil {
+				http.Error(w, "Couldn't remove OAuth client", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s: Removed OAuth client '%s'\n", pageName, r.PostFormValue("client_id"))
+		}
+	}
+
+	// Gather the list of registered clients
+	tempRows.Clients, err = com.OAuthClients()
+	if err != nil {
+		http.Error(w, "Couldn't retrieve list of OAuth clients", http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Handler to display the orphaned Minio objects which will be removed on the next garbage collection run.  Nothing
+// is removed by this page.
+func orphansHandler(w http.ResponseWriter, _ *http.Request) {
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "orphans.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Gather the list of orphaned objects
+	var tempRows struct {
+		Orphans      []com.MinioObject
+		SafetyWindow time.Duration
+	}
+	tempRows.SafetyWindow = com.MinioGCSafetyWindow
+	tempRows.Orphans, err = com.OrphanedMinioObjects(com.MinioGCSafetyWindow)
+	if err != nil {
+		http.Error(w, "Couldn't retrieve list of orphaned Minio objects", http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Displays the content flagged by the virus scanner, and lets admins clear the cached scanner verdicts and re-scan
+// the stored databases (eg after a signature update).
+func rescanHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Virus scanner page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "rescan.html")
+	t, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var tempRows struct {
+		Flagged []com.ScanVerdict
+		Running bool
+		Scanner string
+		Started bool
+	}
+	if r.Method == "POST" {
+		if com.ScannerCommand() == "" {
+			http.Error(w, "No virus scanner is configured", http.StatusBadRequest)
+			return
+		}
+		tempRows.Started = com.RescanStoredDatabases(context.Background())
+		if tempRows.Started {
+			log.Printf("%s: Started re-scan of stored databases\n", pageName)
+		}
+	}
+	tempRows.Flagged, err = com.FlaggedScanVerdicts()
+	if err != nil {
+		http.Error(w, "Couldn't retrieve the flagged scan verdicts", http.StatusInternalServerError)
+		return
+	}
+	tempRows.Running = com.RescanRunning()
+	tempRows.Scanner = com.ScannerCommand()
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Generates a new client certificate for a user and stores it, revoking their existing ones.
+func resetClientCert(userName string) ([]byte, error) {
+	err := com.RevokeClientCerts(userName)
+	if err != nil {
+		return nil, err
+	}
+	newCert, err := com.IssueClientCert(userName, "Generated by an administrator", com.SigningCertDefaultDays())
+	if err != nil {
+		return nil, err
+	}
+	com.SecurityNotice(userName, "A new DB4S client certificate was generated for your account by an "+
+		"administrator.  Your previous certificates no longer work.")
+	return newCert, nil
+}
+
 // Handler to generate the front page
 func rootHandler(w http.ResponseWriter, _ *http.Request) {
 	// Parse the template file
@@ -465,42 +1256,146 @@ func rootHandler(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-// Handler to delete a DBHub.io user
-func userDelHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "User delete page"
+// Counts the rows changed by database versions which haven't been counted yet, on a timer.  Versions are done in
+// batches, carrying straight on while there are more waiting (eg the whole history, the first time this runs).
+func rowStatsLoop() {
+	for {
+		counted, err := com.CountRowsChanged(context.Background(), 100)
+		if err != nil {
+			log.Printf("Error when counting rows changed by database versions: %v\n", err)
+		}
+		if counted == 100 {
+			continue
+		}
+		time.Sleep(com.RowStatsInterval)
+	}
+}
 
-	// Extract the username
-	u, err := com.GetFormUsername(r)
+// Handler to review takedown requests, moving them through the takedown process.
+func takedownsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Takedown requests page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "takedowns.html")
+	t, err := template.ParseFiles(templateFile)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	userName := strings.ToLower(u)
 
-	// Retrieve the Minio bucket for the user
-	bucket, err := com.MinioUserBucket(userName)
+	// Update the status of a request, if requested
+	if r.Method == "POST" {
+		id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid takedown request ID", http.StatusBadRequest)
+			return
+		}
+		status := r.PostFormValue("status")
+		err = com.SetTakedownStatus(id, status, r.PostFormValue("notes"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("%s: Takedown request %d is now '%s'\n", pageName, id, status)
+		http.Redirect(w, r, "/takedowns", http.StatusSeeOther)
+		return
+	}
+
+	// Gather the list of takedown requests, along with the states each can move to
+	type takedownRow struct {
+		com.Takedown
+		NextStates []string
+	}
+	var tempRows []takedownRow
+	list, err := com.TakedownRequests()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Couldn't retrieve list of takedown requests", http.StatusInternalServerError)
 		return
 	}
+	for _, j := range list {
+		tempRows = append(tempRows, takedownRow{Takedown: j, NextStates: com.TakedownNextStates(j.Status)})
+	}
 
-	// Check if a Minio bucket for the user exists
-	found, err := com.MinioBucketExists(bucket)
+	// Execute the template
+	err = t.Execute(w, tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Handler to publish new versions of the terms of service and privacy policy, and review who has accepted them.
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Terms page"
+
+	// Parse the template file
+	templateFile := filepath.Join("admin", "templates", "terms.html")
+	t, err := template.ParseFiles(templateFile)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if found {
-		// Remove the bucket and all files inside it
-		err = com.RemoveMinioBucket(bucket)
+
+	// Publish a new version, if requested.  All users will need to accept it
+	if r.Method == "POST" {
+		terms := r.PostFormValue("terms")
+		privacy := r.PostFormValue("privacy")
+		if strings.TrimSpace(terms) == "" || strings.TrimSpace(privacy) == "" {
+			http.Error(w, "Both the terms of service and privacy policy are needed", http.StatusBadRequest)
+			return
+		}
+		version, err := com.AddTermsVersion(terms, privacy)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Couldn't publish the new terms", http.StatusInternalServerError)
 			return
 		}
+		log.Printf("%s: Published terms version %d\n", pageName, version)
+		http.Redirect(w, r, "/terms", http.StatusSeeOther)
+		return
 	}
 
-	// Remove the user from PostgreSQL
-	err = com.UserDelete(userName)
+	// Gather the published versions and acceptance history
+	var tempRows struct {
+		Acceptances []com.TermsAcceptance
+		Current     com.TermsVersion
+		Username    string
+		Versions    []com.TermsVersion
+	}
+	tempRows.Username = strings.ToLower(r.FormValue("username"))
+	tempRows.Versions, err = com.TermsVersions()
+	if err != nil {
+		http.Error(w, "Couldn't retrieve list of terms versions", http.StatusInternalServerError)
+		return
+	}
+	if len(tempRows.Versions) > 0 {
+		tempRows.Current = tempRows.Versions[0]
+	}
+	tempRows.Acceptances, err = com.TermsAcceptances(tempRows.Username, 500)
+	if err != nil {
+		http.Error(w, "Couldn't retrieve terms acceptance history", http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	err = t.Execute(w, &tempRows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Handler to delete a DBHub.io user
+func userDelHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "User delete page"
+
+	// Extract the username
+	u, err := com.GetFormUsername(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userName := strings.ToLower(u)
+
+	// Remove the user, and their databases
+	err = deleteUser(userName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -557,6 +1452,13 @@ func userModActionHandler(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: Add code to handle changes for the other fields
 
+	// Remember the existing email address, so the user can be told if it changes
+	oldUser, err := com.User(userName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Handle whether the user password does/doesn't need to be changed
 	var pHash []byte
 	if pass != "" {
@@ -584,6 +1486,9 @@ func userModActionHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Log the successful user modification
 	log.Printf("%s: User modified: %v\n", pageName, userName)
+	if oldUser.Email != email {
+		com.SecurityEmailChange(userName, oldUser.Email, email)
+	}
 
 	// User modification succeeded, so bounce back to the front page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -636,3 +1541,21 @@ func userModFormHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// Sends the database webhook deliveries which are due, and trims the delivery log, on a timer.
+func webhookLoop() {
+	for {
+		sent, err := com.SendDBWebhooks()
+		if err != nil {
+			log.Printf("Error when sending webhook deliveries: %v\n", err)
+		}
+		if sent > 0 {
+			log.Printf("Sent %d webhook delivery(s)\n", sent)
+		}
+		_, err = com.PurgeWebhookDeliveries()
+		if err != nil {
+			log.Printf("Error when purging old webhook deliveries: %v\n", err)
+		}
+		time.Sleep(com.WebhookInterval)
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Database owners can attach images and other files to their database READMEs.  Attachments are stored in the
+// owner's Minio bucket, and can be seen by anyone who can see the database they're attached to.
+
+// The largest attachment which can be uploaded, in bytes
+const AttachmentMaxSize = 5 * 1024 * 1024
+
+// The kinds of file which can be attached.  The type is worked out from the file contents rather than trusting the
+// browser, and types which browsers can run scripts from (eg HTML and SVG) aren't allowed
+var attachmentTypes = map[string]bool{
+	"application/pdf":           true,
+	"image/gif":                 true,
+	"image/jpeg":                true,
+	"image/png":                 true,
+	"image/webp":                true,
+	"text/plain; charset=utf-8": true,
+}
+
+// Returns the markdown for linking to an attachment from a README.  Images are shown inline.
+func AttachmentMarkdown(a Attachment) string {
+	link := fmt.Sprintf("[%s](/x/attachment/%s)", strings.NewReplacer("[", "", "]", "").Replace(a.FileName), a.ID)
+	if strings.HasPrefix(a.ContentType, "image/") {
+		return "!" + link
+	}
+	return link
+}
+
+// Stores a new attachment for a database.  Returns an error if the database doesn't exist, or the file is too big or
+// not an allowed type.
+func StoreAttachment(ctx context.Context, dbOwner string, dbFolder string, dbName string, uploader string, fileName string, r io.Reader) (a Attachment, err error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, AttachmentMaxSize+1))
+	if err != nil {
+		return a, err
+	}
+	if len(data) > AttachmentMaxSize {
+		return a, fmt.Errorf("Attachments can be at most %d MB", AttachmentMaxSize/1024/1024)
+	}
+	if len(data) == 0 {
+		return a, fmt.Errorf("The attachment is empty")
+	}
+	contentType := http.DetectContentType(data)
+	if !attachmentTypes[contentType] {
+		return a, fmt.Errorf("Files of type '%s' can't be attached", contentType)
+	}
+
+	bucket, err := MinioUserBucket(dbOwner)
+	if err != nil {
+		return a, err
+	}
+	a = Attachment{
+		ContentType: contentType,
+		DBName:      dbName,
+		FileName:    filepath.Base(fileName),
+		Folder:      dbFolder,
+		ID:          RandomString(16),
+		MinioBkt:    bucket,
+		MinioID:     "attach-" + RandomString(8),
+		Owner:       dbOwner,
+		Size:        int64(len(data)),
+		Uploader:    uploader,
+	}
+	_, err = StoreMinioObject(ctx, a.MinioBkt, a.MinioID, bytes.NewReader(data))
+	if err != nil {
+		return a, err
+	}
+	err = AddAttachment(a)
+	if err != nil {
+		// The Minio object is left for the orphaned object collection to clean up
+		return a, err
+	}
+	return a, nil
+}
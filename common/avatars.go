@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Users can upload an image to use as their avatar, which is stored in their own Minio bucket.  Users who haven't
+// uploaded one are shown with their Gravatar instead, which falls back to a generated pattern when they don't have one
+// there either.
+
+// The largest avatar image which can be uploaded, in bytes
+const AvatarMaxSize = 1024 * 1024
+
+// The kinds of image which can be used as avatars.  As with attachments the type is worked out from the file contents,
+// and SVG isn't allowed as browsers can run scripts from it
+var avatarTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// Returns the content type of an avatar image, or an error if it can't be used as one.
+func AvatarContentType(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		return "", fmt.Errorf("Avatars need to be GIF, JPEG, PNG, or WebP images")
+	}
+	return contentType, nil
+}
+
+// Stores a new avatar image for a user, replacing their existing one.
+func StoreAvatar(ctx context.Context, userName string, r io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, AvatarMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > AvatarMaxSize {
+		return fmt.Errorf("Avatars can be at most %d MB", AvatarMaxSize/1024/1024)
+	}
+	_, err = AvatarContentType(data)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := MinioUserBucket(userName)
+	if err != nil {
+		return err
+	}
+	minioID := "avatar-" + RandomString(8)
+	_, err = StoreMinioObject(ctx, bucket, minioID, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return SetUserAvatar(userName, minioID)
+}
+
+// Returns the address to show a user's avatar from.  Uploaded avatars include their Minio ID, so browsers don't keep
+// showing an old one after it's changed.  Gravatar uses a hash of the email address, or of the user name for accounts
+// without one (eg organisations).
+func avatarURL(userName string, email string, minioID string) string {
+	if minioID != "" {
+		return "/x/avatar/" + url.PathEscape(userName) + "?v=" + url.QueryEscape(minioID)
+	}
+	id := strings.ToLower(strings.TrimSpace(email))
+	if id == "" {
+		id = userName
+	}
+	tempArr := md5.Sum([]byte(id))
+	return "https://www.gravatar.com/avatar/" + hex.EncodeToString(tempArr[:]) + "?d=identicon&s=160"
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Works out which version last inserted or updated each row of a table, by comparing each version in the history
+// leading up to the requested one with its parent.  Rows are matched up the same way as for diffs, so if a table's
+// primary key changes between versions its rows are treated as all being replaced.  When key values are given, only
+// the row with that key is returned.
+func BlameTable(ctx context.Context, loggedInUser string, dbOwner string, dbFolder string, dbName string,
+	dbTable string, commits []CommitJSON, dbVersion int, key []string, offset int, maxRows int) (blame TableBlame,
+	err error) {
+	blame.Table = dbTable
+	blame.Version = dbVersion
+	blame.Offset = offset
+	blame.Rows = []BlameRow{}
+
+	// Walk back through the history of the requested version.  Versions from before commits were recorded don't
+	// have a parent commit, so the previous version number is used for them instead
+	byID := make(map[string]CommitJSON)
+	byVersion := make(map[int]CommitJSON)
+	for _, c := range commits {
+		if c.CommitID != "" {
+			byID[c.CommitID] = c
+		}
+		byVersion[c.Version] = c
+	}
+	c, ok := byVersion[dbVersion]
+	if !ok {
+		return blame, errors.New("The requested database version doesn't exist")
+	}
+	var history []CommitJSON
+	for ok {
+		if len(history) == BlameMaxVersions {
+			blame.Partial = true
+			break
+		}
+		history = append(history, c)
+		switch {
+		case c.Parent != "":
+			c, ok = byID[c.Parent]
+		case c.CommitID == "":
+			var prev CommitJSON
+			ok = false
+			for _, p := range commits {
+				if p.Version < c.Version && (!ok || p.Version > prev.Version) {
+					prev, ok = p, true
+				}
+			}
+			c = prev
+		default:
+			ok = false
+		}
+	}
+
+	// Step through the history from the oldest version, keeping track of the last change to each row
+	type lastChange struct {
+		commit CommitJSON
+		key    []interface{}
+	}
+	rows := make(map[string]lastChange)
+	var oldDB *sqlite.Conn
+	defer func() { ReleaseSQLiteHandle(oldDB) }()
+	for i := len(history) - 1; i >= 0; i-- {
+		c := history[i]
+		bkt, id, err := MinioBucketID(dbOwner, dbFolder, dbName, c.Version, loggedInUser)
+		if err != nil {
+			return blame, err
+		}
+		if id == "" {
+			return blame, errors.New("Database not found")
+		}
+		newDB, err := OpenMinioObject(ctx, bkt, id)
+		if err != nil {
+			return blame, err
+		}
+		oldCmp, err := blameTableConn(oldDB, dbTable)
+		if err != nil {
+			ReleaseSQLiteHandle(newDB)
+			return blame, err
+		}
+		newCmp, err := blameTableConn(newDB, dbTable)
+		if err != nil {
+			ReleaseSQLiteHandle(newDB)
+			return blame, err
+		}
+		var keyCols []string
+		if oldCmp != nil || newCmp != nil {
+			_, keyCols, err = compareTableRows(oldCmp, newCmp, dbTable,
+				func(action string, rowKey []interface{}, oldVals []interface{}, newVals []interface{}) {
+					k := fmt.Sprintf("%#v", rowKey)
+					if action == "delete" {
+						delete(rows, k)
+						return
+					}
+					rows[k] = lastChange{commit: c, key: rowKey}
+				})
+		}
+		ReleaseSQLiteHandle(oldDB)
+		oldDB = newDB
+		if err != nil {
+			return blame, err
+		}
+		blame.KeyColumns = nil
+		if newCmp != nil {
+			blame.KeyColumns = keyCols
+		}
+	}
+	if blame.KeyColumns == nil {
+		return blame, errors.New("Requested table does not exist in this version")
+	}
+
+	// Return the requested page of rows, in key order
+	var list []lastChange
+	for _, r := range rows {
+		if len(key) > 0 && !blameKeyMatches(r.key, key) {
+			continue
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		for n := range list[i].key {
+			if cmp := compareDiffValues(list[i].key[n], list[j].key[n]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	blame.TotalRows = len(list)
+	for i := offset; i < len(list) && i < offset+maxRows; i++ {
+		r := list[i]
+		blame.Rows = append(blame.Rows, BlameRow{
+			Author:      r.commit.Author,
+			CommitID:    r.commit.CommitID,
+			DateChanged: r.commit.DateCreated,
+			Key:         diffRowValues(r.key),
+			Version:     r.commit.Version,
+		})
+	}
+	return blame, nil
+}
+
+// Returns true if a row's key matches the key values given by the user.  BLOB values are given base64 encoded.
+func blameKeyMatches(rowKey []interface{}, key []string) bool {
+	if len(rowKey) != len(key) {
+		return false
+	}
+	for i, v := range rowKey {
+		var s string
+		switch val := v.(type) {
+		case nil:
+		case []byte:
+			s = base64.StdEncoding.EncodeToString(val)
+		default:
+			s = fmt.Sprint(val)
+		}
+		if s != key[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the connection to compare a table's rows with, or nil if the table isn't in that database.
+func blameTableConn(sdb *sqlite.Conn, dbTable string) (*sqlite.Conn, error) {
+	if sdb == nil {
+		return nil, nil
+	}
+	tables, err := userTables(sdb)
+	if err != nil {
+		return nil, errors.New("Error retrieving table names")
+	}
+	for _, t := range tables {
+		if t == dbTable {
+			return sdb, nil
+		}
+	}
+	return nil, nil
+}
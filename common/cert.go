@@ -11,9 +11,71 @@ import (
 	"io/ioutil"
 	"log"
 	"math/big"
+	"strings"
 	"time"
 )
 
+// Returns the serial number of a client certificate, in the form it's stored in the database.
+func ClientCertSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// Returns the user a verified client certificate belongs to.  The certificate must be for this server, and must be
+// on the user's list of certificates without having been revoked.  Certificates for disabled users are rejected.
+func ClientCertUser(cert *x509.Certificate) (string, error) {
+	// Extract the account name and associated server from the certificate
+	s := strings.Split(cert.Subject.CommonName, "@")
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", fmt.Errorf("Missing information in client certificate")
+	}
+	userName, certServer := s[0], s[1]
+	if certServer != DB4SServer() {
+		return "", fmt.Errorf("Server name in certificate '%s' doesn't match running server '%s'", certServer,
+			DB4SServer())
+	}
+
+	// Make sure the certificate was issued to the user, and hasn't been revoked
+	owner, revoked, err := clientCertOwner(ClientCertSerial(cert))
+	if err != nil {
+		return "", err
+	}
+	if owner == "" {
+		// Certificates issued before the list of certificates was kept aren't on it, so the one stored for the user
+		// is added the first time it's used
+		user, err := User(userName)
+		if err != nil {
+			return "", err
+		}
+		certPEM, _ := pem.Decode(user.ClientCert)
+		if certPEM == nil || !bytes.Equal(certPEM.Bytes, cert.Raw) {
+			return "", fmt.Errorf("Client certificate for '%s' isn't known", userName)
+		}
+		err = RegisterClientCert(userName, "DB4S certificate", user.ClientCert)
+		if err != nil {
+			return "", err
+		}
+		owner = userName
+	}
+	if owner != userName {
+		return "", fmt.Errorf("Client certificate wasn't issued to '%s'", userName)
+	}
+	if revoked {
+		return "", fmt.Errorf("Client certificate for '%s' has been revoked", userName)
+	}
+
+	// Disabled users can't use their certificate
+	disabled, err := UserDisabled(userName)
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return "", fmt.Errorf("The account for '%s' has been disabled", userName)
+	}
+	return userName, nil
+}
+
+// Generates a new client certificate and key for a user, valid for the given number of days.  The certificate isn't
+// stored, so it can't be used until it's registered.
 func GenerateClientCert(userName string, daysValid int) (_ []byte, err error) {
 	pageName := "Add user:generateClientCert()"
 
@@ -116,3 +178,35 @@ func GenerateClientCert(userName string, daysValid int) (_ []byte, err error) {
 
 	return buf.Bytes(), nil
 }
+
+// Generates a new client certificate for a user and adds it to their list of certificates.  It's also stored as
+// their latest certificate, which is the one the "Download DB4S certificate" button gives them.
+func IssueClientCert(userName string, name string, daysValid int) ([]byte, error) {
+	newCert, err := GenerateClientCert(userName, daysValid)
+	if err != nil {
+		return nil, err
+	}
+	err = SetClientCert(newCert, userName)
+	if err != nil {
+		return nil, err
+	}
+	err = RegisterClientCert(userName, name, newCert)
+	if err != nil {
+		return nil, err
+	}
+	return newCert, nil
+}
+
+// Adds a PEM encoded client certificate to a user's list of certificates, so it can be used to connect.  Any private
+// key following the certificate is ignored.
+func RegisterClientCert(userName string, name string, certData []byte) error {
+	certPEM, _ := pem.Decode(certData)
+	if certPEM == nil || certPEM.Type != "CERTIFICATE" {
+		return fmt.Errorf("No certificate found in the PEM data")
+	}
+	cert, err := x509.ParseCertificate(certPEM.Bytes)
+	if err != nil {
+		return err
+	}
+	return AddClientCert(userName, name, ClientCertSerial(cert), cert.NotAfter)
+}
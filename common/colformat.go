@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// So the front end can display values sensibly, the table data includes each column's affinity along with the format
+// its values seem to be in.  Formats are worked out from the declared column type where that's clear, otherwise from
+// a sample of the values in the column.  As database versions never change, the results are cached by version SHA256
+// and table name.
+
+// Formats which can be detected for a column
+const (
+	ColFormatBoolean  = "boolean"
+	ColFormatCurrency = "currency"
+	ColFormatDate     = "date"
+	ColFormatDateTime = "datetime"
+)
+
+// Number of rows looked at when working out the format of a column
+const colFormatSampleRows = 100
+
+var (
+	regexBoolean  = regexp.MustCompile(`(?i)^(true|false|yes|no)$`)
+	regexCurrency = regexp.MustCompile(`^-?[$€£¥]\s?-?[0-9]{1,3}(,?[0-9]{3})*(\.[0-9]{1,2})?$`)
+	regexDate     = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+	regexDateTime = regexp.MustCompile(
+		`^[0-9]{4}-[0-9]{2}-[0-9]{2}[ T][0-9]{2}:[0-9]{2}(:[0-9]{2}(\.[0-9]+)?)?(Z|[+-][0-9]{2}:?[0-9]{2})?$`)
+)
+
+// Returns the affinity SQLite gives a column with the given declared type, following the rules in section 3.1 of
+// https://www.sqlite.org/datatype3.html
+func columnAffinity(declType string) string {
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return "INTEGER"
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "TEXT"
+	case t == "", strings.Contains(t, "BLOB"):
+		return "BLOB"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "REAL"
+	}
+	return "NUMERIC"
+}
+
+func columnFormatsCacheKey(sha string, table string) string {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("colformats/%s/%s", sha, table)))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Returns the affinity and detected format of each column in a table, using the cached results for the database
+// version if there are any.
+func ColumnFormats(ctx context.Context, sdb *sqlite.Conn, sha string, table string) ([]ColumnFormat, error) {
+	var formats []ColumnFormat
+	cacheKey := columnFormatsCacheKey(sha, table)
+	ok, err := GetCachedData(ctx, cacheKey, &formats)
+	if err != nil {
+		log.Printf("Error retrieving column formats from cache: %v\n", err)
+	}
+	if ok {
+		return formats, nil
+	}
+
+	formats, err = detectColumnFormats(sdb, table)
+	if err != nil {
+		return nil, err
+	}
+	err = CacheData(ctx, cacheKey, formats, CacheTime)
+	if err != nil {
+		log.Printf("Error when caching column formats: %v\n", err)
+	}
+	return formats, nil
+}
+
+// Works out the affinity and format of each column in a table.
+func detectColumnFormats(sdb *sqlite.Conn, table string) ([]ColumnFormat, error) {
+	cols, err := sdb.Columns("", table)
+	if err != nil {
+		log.Printf("Error when reading column names for table '%s': %v\n", table, err)
+		return nil, err
+	}
+	formats := make([]ColumnFormat, len(cols))
+	for i, c := range cols {
+		formats[i] = ColumnFormat{Affinity: columnAffinity(c.DataType), Name: c.Name}
+		t := strings.ToUpper(c.DataType)
+		switch {
+		case strings.Contains(t, "BOOL"):
+			formats[i].Format = ColFormatBoolean
+		case strings.Contains(t, "DATETIME"), strings.Contains(t, "TIMESTAMP"):
+			formats[i].Format = ColFormatDateTime
+		case strings.Contains(t, "DATE"):
+			formats[i].Format = ColFormatDate
+		}
+	}
+
+	// Look at a sample of the values for the remaining columns.  A format is only used if every non-NULL value in the
+	// sample matches it
+	seen := make([]bool, len(cols))
+	matches := make([]map[string]bool, len(cols))
+	for i := range matches {
+		matches[i] = map[string]bool{ColFormatBoolean: true, ColFormatCurrency: true, ColFormatDate: true,
+			ColFormatDateTime: true}
+	}
+	dbQuery := sqlite.Mprintf(`SELECT * FROM "%w"`, table) + fmt.Sprintf(" LIMIT %d", colFormatSampleRows)
+	err = sdb.Select(dbQuery, func(s *sqlite.Stmt) error {
+		for i := 0; i < s.DataCount() && i < len(cols); i++ {
+			if formats[i].Format != "" || s.ColumnType(i) == sqlite.Null {
+				continue
+			}
+			seen[i] = true
+			m := matches[i]
+			if s.ColumnType(i) != sqlite.Text {
+				// Numbers and BLOBs in the column rule out all of the text formats
+				for f := range m {
+					m[f] = false
+				}
+				continue
+			}
+			val, _ := s.ScanText(i)
+			m[ColFormatBoolean] = m[ColFormatBoolean] && regexBoolean.MatchString(val)
+			m[ColFormatCurrency] = m[ColFormatCurrency] && regexCurrency.MatchString(val)
+			m[ColFormatDate] = m[ColFormatDate] && regexDate.MatchString(val)
+			m[ColFormatDateTime] = m[ColFormatDateTime] && regexDateTime.MatchString(val)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error when sampling values of table '%s': %v\n", table, err)
+		return nil, err
+	}
+	for i := range formats {
+		if formats[i].Format != "" || !seen[i] {
+			continue
+		}
+		for _, f := range []string{ColFormatBoolean, ColFormatCurrency, ColFormatDate, ColFormatDateTime} {
+			if matches[i][f] {
+				formats[i].Format = f
+				break
+			}
+		}
+	}
+	return formats, nil
+}
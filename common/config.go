@@ -1,10 +1,13 @@
 package common
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/jackc/pgx"
@@ -15,10 +18,25 @@ var (
 	// Our configuration info
 	conf TomlConfig
 
+	// Command line flag for validating and displaying the configuration, instead of starting the server
+	checkConfig = flag.Bool("check-config", false, "Validate the configuration, display it, then exit")
+
+	// Environment variable names from before all settings could be overridden, which are still honoured
+	legacyEnvNames = map[string]string{
+		"pg.database": "PG_DBNAME",
+		"pg.password": "PG_PASS",
+		"pg.username": "PG_USER",
+	}
+
 	// PostgreSQL configuration info
 	pgConfig = new(pgx.ConnConfig)
 )
 
+// Return the key needed for using the admin server API.  Empty if the API doesn't need a key.
+func AdminAPIKey() string {
+	return conf.Admin.APIKey
+}
+
 // Return the admin server certificate path.
 func AdminServerCert() string {
 	return conf.Admin.Certificate
@@ -54,6 +72,60 @@ func Auth0Domain() string {
 	return conf.Auth0.Domain
 }
 
+// Calls fn for each individual setting in the configuration, passing its name (eg "minio.access_key") and value.
+// Settings which aren't strings, booleans, or integers (eg the list of PostgreSQL read replicas) can only be set in
+// the configuration file, so are skipped.
+func configFields(fn func(name string, field reflect.Value)) {
+	sections := reflect.ValueOf(&conf).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := settingName(sections.Type().Field(i))
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Field(j)
+			switch field.Kind() {
+			case reflect.String, reflect.Bool, reflect.Int:
+				fn(sectionName+"."+settingName(section.Type().Field(j)), field)
+			}
+		}
+	}
+}
+
+// Applies environment variable and command line flag overrides to the settings read from the configuration file.
+// Environment variables are named after the setting, so "minio.access_key" is MINIO_ACCESS_KEY, and flags use the
+// setting name directly (eg --minio.access_key).  Flags take priority over environment variables.
+func configOverrides() error {
+	// Register a flag for each setting, so they show up in --help
+	flagValues := make(map[string]*string)
+	configFields(func(name string, field reflect.Value) {
+		if flag.Lookup(name) == nil {
+			flagValues[name] = flag.String(name, "", fmt.Sprintf("Override the %s setting", name))
+		}
+	})
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+
+	// Apply the overrides
+	var err error
+	configFields(func(name string, field reflect.Value) {
+		if err != nil {
+			return
+		}
+		envName := strings.ToUpper(strings.Replace(name, ".", "_", -1))
+		if val := os.Getenv(envName); val != "" {
+			err = setConfigValue(field, val, envName)
+		} else if legacy, ok := legacyEnvNames[name]; ok && os.Getenv(legacy) != "" {
+			err = setConfigValue(field, os.Getenv(legacy), legacy)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if err == nil && f.Name == name && flagValues[name] != nil {
+				err = setConfigValue(field, *flagValues[name], "--"+name)
+			}
+		})
+	})
+	return err
+}
+
 // Return the path to the DB4S CA Chain file.
 func DB4SCAChain() string {
 	return conf.DB4S.CAChain
@@ -79,11 +151,49 @@ func DB4SServerPort() int {
 	return conf.DB4S.Port
 }
 
+// Return the address emails are sent from.
+func EmailFrom() string {
+	return conf.Email.From
+}
+
+// Return the password for the outgoing mail server.
+func EmailPassword() string {
+	return conf.Email.Password
+}
+
+// Return the outgoing mail server host:port.  Empty if email sending isn't set up.
+func EmailServer() string {
+	return conf.Email.Server
+}
+
+// Return the username for the outgoing mail server.
+func EmailUsername() string {
+	return conf.Email.Username
+}
+
+// Return the directory live database files are kept in.  Empty if live databases aren't available on this server.
+func LiveDataDir() string {
+	return conf.Live.DataDir
+}
+
+// Return the number of seconds between snapshots of changed live databases.  Defaults to hourly.
+func LiveSnapshotInterval() int {
+	if conf.Live.SnapshotInterval <= 0 {
+		return 3600
+	}
+	return conf.Live.SnapshotInterval
+}
+
 // Return the Minio server access key.
 func MinioAccessKey() string {
 	return conf.Minio.AccessKey
 }
 
+// Return the Minio bucket used for caching generated CSV downloads.  Empty if they aren't cached.
+func MinioCSVCacheBucket() string {
+	return conf.Minio.CSVCacheBucket
+}
+
 // Should we connect to the Minio server using HTTPS?
 func MinioHTTPS() bool {
 	return conf.Minio.HTTPS
@@ -99,6 +209,19 @@ func MinioServer() string {
 	return conf.Minio.Server
 }
 
+// Return the number of seconds between syncs from the mirror source.  Defaults to hourly.
+func MirrorInterval() int {
+	if conf.Mirror.Interval <= 0 {
+		return 3600
+	}
+	return conf.Mirror.Interval
+}
+
+// Return the base URL of the DBHub instance this server mirrors.  Empty if the server isn't a mirror.
+func MirrorSource() string {
+	return strings.TrimSuffix(conf.Mirror.Source, "/")
+}
+
 // Read the server configuration file.
 func ReadConfig() error {
 	// Reads the server configuration from disk
@@ -113,49 +236,10 @@ func ReadConfig() error {
 		return fmt.Errorf("Config file couldn't be parsed: %v\n", err)
 	}
 
-	// Override config file via environment variables
-	tempString := os.Getenv("MINIO_SERVER")
-	if tempString != "" {
-		conf.Minio.Server = tempString
-	}
-	tempString = os.Getenv("MINIO_ACCESS_KEY")
-	if tempString != "" {
-		conf.Minio.AccessKey = tempString
-	}
-	tempString = os.Getenv("MINIO_SECRET")
-	if tempString != "" {
-		conf.Minio.Secret = tempString
-	}
-	tempString = os.Getenv("MINIO_HTTPS")
-	if tempString != "" {
-		conf.Minio.HTTPS, err = strconv.ParseBool(tempString)
-		if err != nil {
-			return fmt.Errorf("Failed to parse MINIO_HTTPS: %v\n", err)
-		}
-	}
-	tempString = os.Getenv("PG_SERVER")
-	if tempString != "" {
-		conf.Pg.Server = tempString
-	}
-	tempString = os.Getenv("PG_PORT")
-	if tempString != "" {
-		tempInt, err := strconv.ParseInt(tempString, 10, 0)
-		if err != nil {
-			return fmt.Errorf("Failed to parse PG_PORT: %v\n", err)
-		}
-		conf.Pg.Port = int(tempInt)
-	}
-	tempString = os.Getenv("PG_USER")
-	if tempString != "" {
-		conf.Pg.Username = tempString
-	}
-	tempString = os.Getenv("PG_PASS")
-	if tempString != "" {
-		conf.Pg.Password = tempString
-	}
-	tempString = os.Getenv("PG_DBNAME")
-	if tempString != "" {
-		conf.Pg.Database = tempString
+	// Override config file settings via environment variables, then command line flags
+	err = configOverrides()
+	if err != nil {
+		return err
 	}
 
 	// Verify we have the needed configuration information
@@ -203,28 +287,196 @@ func ReadConfig() error {
 	pgConfig.Database = conf.Pg.Database
 	pgConfig.TLSConfig = nil
 
-	// TODO: Add environment variable overrides for memcached
+	// pgx reports finished queries through its logger, which turns them into trace spans
+	pgConfig.Logger = pgTracer{}
+	pgConfig.LogLevel = pgx.LogLevelInfo
+
+	// If requested, display the effective configuration then exit
+	if *checkConfig {
+		fmt.Println("Configuration is valid.  Effective settings:")
+		configFields(func(name string, field reflect.Value) {
+			value := fmt.Sprint(field.Interface())
+			if secretSetting(name) && value != "" {
+				value = "********"
+			}
+			fmt.Printf("  %s = %s\n", name, value)
+		})
+		os.Exit(0)
+	}
 
 	// The configuration file seems good
 	return nil
 }
 
+// Return the API key used to authenticate with the replication source.
+func ReplicationAPIKey() string {
+	return conf.Replication.APIKey
+}
+
+// Return how many seconds to wait between replication runs.  Defaults to 10 seconds.
+func ReplicationInterval() int {
+	if conf.Replication.Interval <= 0 {
+		return 10
+	}
+	return conf.Replication.Interval
+}
+
+// Return the base URL of the admin server this instance replicates from.  Empty if the instance isn't a standby.
+func ReplicationSource() string {
+	return strings.TrimSuffix(conf.Replication.Source, "/")
+}
+
+// Return the command used to run the virus scanner over uploaded databases.  Empty if there's no scanner.
+func ScannerCommand() string {
+	return conf.Scanner.Command
+}
+
+// Returns true if the named setting should be hidden when displaying the configuration
+func secretSetting(name string) bool {
+	return strings.Contains(name, "secret") || strings.Contains(name, "password") ||
+		strings.HasSuffix(name, "access_key") || strings.HasSuffix(name, "api_key") || strings.HasSuffix(name, "signing_key")
+}
+
+// Sets a configuration value from its string form
+func setConfigValue(field reflect.Value, val string, source string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Failed to parse %s: %v\n", source, err)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(val, 10, 0)
+		if err != nil {
+			return fmt.Errorf("Failed to parse %s: %v\n", source, err)
+		}
+		field.SetInt(n)
+	}
+	return nil
+}
+
+// Returns the name of a configuration section or setting, as used in the configuration file
+func settingName(f reflect.StructField) string {
+	if tag := f.Tag.Get("toml"); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
 // Return the path to the certificate used to sign DB4S client certs.
 func SigningCert() string {
 	return conf.Sign.IntermediateCert
 }
 
+// Return the number of days new DB4S client certificates are valid for, when the user doesn't choose something else.
+func SigningCertDefaultDays() int {
+	if conf.Sign.DefaultCertDays <= 0 {
+		return 90
+	}
+	if conf.Sign.DefaultCertDays > SigningCertMaxDays() {
+		return SigningCertMaxDays()
+	}
+	return conf.Sign.DefaultCertDays
+}
+
 // Return the path to the key for the certificate used to sign DB4S client certs.
 func SigningCertKey() string {
 	return conf.Sign.IntermediateKey
 }
 
+// Return the longest number of days a DB4S client certificate can be valid for.
+func SigningCertMaxDays() int {
+	if conf.Sign.MaxCertDays <= 0 {
+		return 365
+	}
+	return conf.Sign.MaxCertDays
+}
+
+// Return the directory holding the webui templates and static files.  When not set, paths are relative to the
+// current working directory.
+func WebBaseDir() string {
+	return conf.Web.BaseDir
+}
+
+// Return the base URL of the CDN used for public database downloads.  Empty if no CDN is in use.
+func WebCDNBaseURL() string {
+	return conf.Web.CDNBaseURL
+}
+
+// Return the key used to sign CDN download links.
+func WebCDNSigningKey() string {
+	return conf.Web.CDNSigningKey
+}
+
+// Return the number of days deleted database versions can be restored for, before they're purged.
+func WebDeletedVersionDays() int {
+	if conf.Web.DeletedVersionDays <= 0 {
+		return DefaultDeletedVersionDays
+	}
+	return conf.Web.DeletedVersionDays
+}
+
+// Return the number of rows to display for users who haven't chosen their own.
+func WebDisplayRows() int {
+	if conf.Web.DisplayRows <= 0 {
+		return DefaultNumDisplayRows
+	}
+	if conf.Web.DisplayRows > WebMaxDisplayRows() {
+		return WebMaxDisplayRows()
+	}
+	return conf.Web.DisplayRows
+}
+
+// Return the origins allowed to frame the embed paths.  Empty means any site can.
+func WebEmbedAncestors() []string {
+	return conf.Web.EmbedAncestors
+}
+
+// Return the path prefixes of pages other sites are allowed to frame, for embedding databases in them.
+func WebEmbedPaths() []string {
+	return conf.Web.EmbedPaths
+}
+
+// Return the curated list of databases to feature on the front page, as "owner/database" strings.
+func WebFeaturedDBs() []string {
+	return conf.Web.Featured
+}
+
+// Return the largest number of rows API callers can request in one go.  This is never less than the preference limit.
+func WebMaxAPIRows() int {
+	if conf.Web.MaxAPIRows < WebMaxDisplayRows() {
+		return WebMaxDisplayRows()
+	}
+	return conf.Web.MaxAPIRows
+}
+
+// Return the largest number of rows users can choose to display in their preferences.
+func WebMaxDisplayRows() int {
+	if conf.Web.MaxDisplayRows <= 0 {
+		return DefaultMaxDisplayRows
+	}
+	return conf.Web.MaxDisplayRows
+}
+
+// Return the path to the RSA private key OpenID Connect ID tokens are signed with.
+func WebOIDCKey() string {
+	return conf.Web.OIDCKey
+}
+
+// Return the port for client certificate logins to the web UI.  Zero means certificate logins are disabled.
+func WebCertLoginPort() int {
+	return conf.Web.CertLoginPort
+}
+
 // Return the address the server listens on.
 func WebBindAddress() string {
 	return conf.Web.BindAddress
 }
 
-// Return the path to the Web server request log.
+// Return the path to the Web server request log.  An empty string or "-" means log requests to stdout.
 func WebRequestLog() string {
 	return conf.Web.RequestLog
 }
@@ -243,3 +495,8 @@ func WebServerCert() string {
 func WebServerCertKey() string {
 	return conf.Web.CertificateKey
 }
+
+// Return the path to the SpatiaLite extension loaded for viewing and querying databases.  Empty if it's not used.
+func WebSpatiaLiteExtension() string {
+	return conf.Web.SpatiaLite
+}
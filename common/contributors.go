@@ -0,0 +1,90 @@
+package common
+
+import (
+	"context"
+	"log"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The contributor statistics of a database count the versions each user added, and how many rows those versions
+// changed.  Counting the rows means comparing each version against its parent, which is too slow to do when a version
+// is added, so the admin server does it in the background with CountRowsChanged().
+
+// A database version whose changed rows haven't been counted yet
+type uncountedVersion struct {
+	Bucket   string
+	DBName   string
+	Folder   string
+	ID       int64
+	MinioID  string
+	Owner    string
+	ParentID string
+	Version  int
+}
+
+// Counts the rows inserted, updated, and deleted by up to limit database versions which haven't been counted yet,
+// returning how many were done.  Versions which can't be compared (eg because they're damaged) are recorded as
+// changing no rows, so they aren't tried again every time.
+func CountRowsChanged(ctx context.Context, limit int) (counted int, err error) {
+	list, err := uncountedVersions(limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range list {
+		newDB, err := OpenMinioObject(ctx, v.Bucket, v.MinioID)
+		if err != nil {
+			return counted, err
+		}
+		var oldDB *sqlite.Conn
+		if v.ParentID != "" {
+			oldDB, err = OpenMinioObject(ctx, v.Bucket, v.ParentID)
+			if err != nil {
+				ReleaseSQLiteHandle(newDB)
+				return counted, err
+			}
+		}
+		rows, err := rowsChanged(oldDB, newDB)
+		if err != nil {
+			log.Printf("Couldn't count the rows changed by version %d of '%s%s%s': %v\n", v.Version, v.Owner,
+				v.Folder, v.DBName, err)
+		}
+		ReleaseSQLiteHandle(oldDB)
+		ReleaseSQLiteHandle(newDB)
+		err = setRowsChanged(v.ID, rows)
+		if err != nil {
+			return counted, err
+		}
+		counted++
+	}
+	return counted, nil
+}
+
+// Returns the number of rows inserted, updated, and deleted between two versions of a database.  When there's no
+// older version, every row of the new one counts as inserted.
+func rowsChanged(oldDB *sqlite.Conn, newDB *sqlite.Conn) (rows int64, err error) {
+	var tables []DBDiffTable
+	if oldDB != nil {
+		diff, err := DiffSQLiteDBs(oldDB, newDB, "", 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		tables = diff.Tables
+	} else {
+		names, err := userTables(newDB)
+		if err != nil {
+			return 0, err
+		}
+		for _, t := range names {
+			tblDiff, err := diffTable(nil, newDB, t, 0, 0)
+			if err != nil {
+				return 0, err
+			}
+			tables = append(tables, tblDiff)
+		}
+	}
+	for _, t := range tables {
+		rows += int64(t.Inserts + t.Updates + t.Deletes)
+	}
+	return rows, nil
+}
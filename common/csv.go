@@ -0,0 +1,174 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// CSV downloads can be tailored for picky downstream tools.  The defaults match what the CSV download has always
+// produced: comma separated, only quoting fields which need it, no header row, and no byte order mark.
+//
+// As database versions never change, a generated CSV file can be kept and sent again for later requests of the same
+// table, version, and options.  These are stored in the Minio bucket given by the csv_cache_bucket setting (caching
+// is off if there isn't one), and removed once they're older than CSVCacheLifetime.
+
+// Options for a CSV download
+type CSVOptions struct {
+	BOM       bool
+	Delimiter rune
+	Header    bool
+	QuoteAll  bool
+}
+
+// Returns a reader for a cached CSV download, if there is one.  The reader needs to be closed with
+// MinioHandleClose().
+func CachedCSV(ctx context.Context, key string) (r io.ReadCloser, ok bool, err error) {
+	bucket := MinioCSVCacheBucket()
+	if bucket == "" {
+		return nil, false, nil
+	}
+	if _, err = minioClient.StatObject(bucket, key); err != nil {
+		// Not cached yet
+		return nil, false, nil
+	}
+	r, err = MinioHandle(ctx, bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+// Returns the cache key for a CSV download of a table.  It's based on the SHA256 of the database version rather than
+// its owner and name, so it stays valid when the database is renamed or forked.
+func CSVCacheKey(sha string, table string, opts CSVOptions) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%q/%q/%v/%v/%v", sha, table, opts.Delimiter, opts.QuoteAll,
+		opts.Header, opts.BOM)))
+	return "csv-" + hex.EncodeToString(h[:])
+}
+
+// Parses and validates the CSV download options given as query parameters.  Empty values use the defaults.
+func CSVExportOptions(delimiter string, quote string, header string, bom string) (opts CSVOptions, err error) {
+	switch strings.ToLower(delimiter) {
+	case "", "comma":
+		opts.Delimiter = ','
+	case "semicolon":
+		opts.Delimiter = ';'
+	case "tab":
+		opts.Delimiter = '\t'
+	default:
+		return opts, errors.New("Unknown delimiter.  It should be comma, semicolon, or tab")
+	}
+
+	switch strings.ToLower(quote) {
+	case "", "minimal":
+		opts.QuoteAll = false
+	case "all":
+		opts.QuoteAll = true
+	default:
+		return opts, errors.New("Unknown quote style.  It should be minimal or all")
+	}
+
+	opts.Header, err = csvBoolOption("header", header)
+	if err != nil {
+		return
+	}
+	opts.BOM, err = csvBoolOption("bom", bom)
+	return
+}
+
+// Parses an on/off CSV download option.
+func csvBoolOption(name string, value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "0", "false", "no", "off":
+		return false, nil
+	case "1", "true", "yes", "on":
+		return true, nil
+	}
+	return false, fmt.Errorf("Unknown value for %s.  It should be true or false", name)
+}
+
+// Removes cached CSV downloads older than the given age, returning how many were removed.
+func RemoveExpiredCSVCache(maxAge time.Duration) (removed int, err error) {
+	bucket := MinioCSVCacheBucket()
+	if bucket == "" {
+		return 0, nil
+	}
+	cutOff := time.Now().Add(-maxAge)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range minioClient.ListObjects(bucket, "csv-", true, doneCh) {
+		if object.Err != nil {
+			log.Printf("Error when listing objects in bucket '%s': %v\n", bucket, object.Err)
+			return removed, object.Err
+		}
+		if object.LastModified.After(cutOff) {
+			continue
+		}
+		err = RemoveMinioFile(bucket, object.Key)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Stores a generated CSV download in the cache.  The cache bucket is created the first time it's needed.
+func StoreCachedCSV(ctx context.Context, key string, r io.Reader) error {
+	bucket := MinioCSVCacheBucket()
+	if bucket == "" {
+		return nil
+	}
+	exists, err := MinioBucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = CreateMinioBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = StoreMinioObject(ctx, bucket, key, r)
+	return err
+}
+
+// Writes rows of data as CSV, using the given options.
+func WriteCSV(w io.Writer, opts CSVOptions, rows [][]string) error {
+	if opts.BOM {
+		if _, err := io.WriteString(w, "\xEF\xBB\xBF"); err != nil {
+			return err
+		}
+	}
+
+	// The standard library writer only quotes the fields which need it
+	if !opts.QuoteAll {
+		csvFile := csv.NewWriter(w)
+		csvFile.Comma = opts.Delimiter
+		return csvFile.WriteAll(rows)
+	}
+
+	bw := bufio.NewWriter(w)
+	quoter := strings.NewReplacer(`"`, `""`)
+	for _, row := range rows {
+		for i, field := range row {
+			if i > 0 {
+				bw.WriteRune(opts.Delimiter)
+			}
+			bw.WriteByte('"')
+			quoter.WriteString(bw, field)
+			bw.WriteByte('"')
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
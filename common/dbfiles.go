@@ -0,0 +1,166 @@
+package common
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// SQLite database files retrieved from Minio are kept in a local cache, along with a pool of read-only handles for
+// each one.  Database versions never change once stored, so files are keyed by their SHA256, which also lets forks of
+// the same version share a file.  The least recently used files are removed once the cache grows past its size cap.
+// Note - the cache directory shouldn't be shared with other running servers, as leftover files are removed at startup.
+
+// A database file in the local cache
+type dbFile struct {
+	elem  *list.Element
+	idle  []*sqlite.Conn
+	inUse int
+	path  string
+	size  int64
+}
+
+var (
+	dbFiles      = make(map[string]*dbFile) // Keyed by SHA256
+	dbFileHandle = make(map[*sqlite.Conn]*dbFile)
+	dbFileLRU    = list.New() // Most recently used at the front
+	dbFileMutex  sync.Mutex
+	dbFileOnce   sync.Once
+	dbFileTotal  int64
+)
+
+// Adds a newly retrieved database file to the cache, and returns a handle for it.  If another request added the same
+// file in the meantime, that one is used instead.
+func addDBFile(sha string, path string, size int64) (*sqlite.Conn, error) {
+	dbFileMutex.Lock()
+	defer dbFileMutex.Unlock()
+	f, ok := dbFiles[sha]
+	if ok {
+		os.Remove(path)
+	} else {
+		f = &dbFile{path: path, size: size}
+		f.elem = dbFileLRU.PushFront(sha)
+		dbFiles[sha] = f
+		dbFileTotal += size
+	}
+	sdb, err := dbFileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	evictDBFiles()
+	return sdb, nil
+}
+
+// Returns a read-only handle for a cached database file, reusing an idle one if possible.  The mutex must be held.
+func dbFileConn(f *dbFile) (*sqlite.Conn, error) {
+	dbFileLRU.MoveToFront(f.elem)
+	var sdb *sqlite.Conn
+	if n := len(f.idle); n > 0 {
+		sdb = f.idle[n-1]
+		f.idle = f.idle[:n-1]
+	} else {
+		var err error
+		sdb, err = sqlite.Open(f.path, sqlite.OpenReadOnly)
+		if err != nil {
+			log.Printf("Couldn't open database: %s", err)
+			return nil, err
+		}
+		loadSpatiaLite(sdb)
+	}
+	f.inUse++
+	dbFileHandle[sdb] = f
+	return sdb, nil
+}
+
+// Returns the directory used for the local cache of database files, creating it (and clearing out any files left
+// over from a previous run) the first time it's called.
+func dbFileDir() string {
+	dir := conf.Cache.DBFileDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "dbhub-dbfiles")
+	}
+	dbFileOnce.Do(func() {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Printf("Error creating database file cache directory '%s': %v\n", dir, err)
+			return
+		}
+		leftovers, err := filepath.Glob(filepath.Join(dir, "dbfile-*"))
+		if err != nil {
+			log.Printf("Error listing database file cache directory '%s': %v\n", dir, err)
+			return
+		}
+		for _, l := range leftovers {
+			os.Remove(l)
+		}
+	})
+	return dir
+}
+
+// Removes the least recently used database files until the cache is back under its size cap.  Files with handles in
+// use are skipped, so the cap can be exceeded temporarily when lots of databases are being used at once.  The mutex
+// must be held.
+func evictDBFiles() {
+	maxSize := int64(conf.Cache.DBFileSize)
+	if maxSize == 0 {
+		maxSize = DefaultDBFileCacheSize
+	}
+	maxSize *= 1024 * 1024
+	for e := dbFileLRU.Back(); e != nil && dbFileTotal > maxSize; {
+		prev := e.Prev()
+		sha := e.Value.(string)
+		f := dbFiles[sha]
+		if f.inUse == 0 {
+			for _, sdb := range f.idle {
+				sdb.Close()
+			}
+			err := os.Remove(f.path)
+			if err != nil {
+				log.Printf("Error removing cached database file '%s': %v\n", f.path, err)
+			}
+			dbFileLRU.Remove(e)
+			delete(dbFiles, sha)
+			dbFileTotal -= f.size
+		}
+		e = prev
+	}
+}
+
+// Returns a handle for a database file which is already in the local cache.
+func pooledDBFileConn(sha string) (sdb *sqlite.Conn, ok bool, err error) {
+	dbFileMutex.Lock()
+	defer dbFileMutex.Unlock()
+	f, ok := dbFiles[sha]
+	if !ok {
+		return nil, false, nil
+	}
+	sdb, err = dbFileConn(f)
+	return sdb, true, err
+}
+
+// Hands a database handle from OpenMinioObject() back to the pool.  This needs to be called instead of Close() once
+// the handle is no longer needed.
+func ReleaseSQLiteHandle(sdb *sqlite.Conn) {
+	if sdb == nil {
+		return
+	}
+	dbFileMutex.Lock()
+	defer dbFileMutex.Unlock()
+	f, ok := dbFileHandle[sdb]
+	if !ok {
+		sdb.Close()
+		return
+	}
+	delete(dbFileHandle, sdb)
+	f.inUse--
+	if len(f.idle) < SQLiteIdleHandles {
+		f.idle = append(f.idle, sdb)
+	} else {
+		sdb.Close()
+	}
+	evictDBFiles()
+}
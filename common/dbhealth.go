@@ -0,0 +1,171 @@
+package common
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The tables which virtual table modules create to hold their data, by module name.  SQLite names them after the
+// virtual table, with these suffixes added
+var shadowTableSuffixes = map[string][]string{
+	"fts3":      {"_content", "_segments", "_segdir", "_docsize", "_stat"},
+	"fts4":      {"_content", "_segments", "_segdir", "_docsize", "_stat"},
+	"fts5":      {"_config", "_content", "_data", "_docsize", "_idx"},
+	"rtree":     {"_node", "_parent", "_rowid"},
+	"rtree_i32": {"_node", "_parent", "_rowid"},
+}
+
+// Builds the health report for a database, giving the row count and size of each table, and the size of each index.
+// The shadow tables of R-Tree and FTS virtual tables are counted towards the index they belong to, as are R-Tree
+// tables themselves (such as SpatiaLite's spatial indexes), as they only hold index data.
+func DBHealthReport(sdb *sqlite.Conn) (health DBHealth, err error) {
+	vtabs, shadows, err := virtualTables(sdb)
+	if err != nil {
+		return
+	}
+
+	// The dbstat virtual table isn't included in all SQLite builds, so the sizes are left out when it's missing
+	sizes := make(map[string]int64)
+	err = sdb.Select(`SELECT name, sum(pgsize) FROM dbstat GROUP BY name`, func(s *sqlite.Stmt) error {
+		name, _ := s.ScanText(0)
+		size, _ := s.ScanInt64(1)
+		sizes[strings.ToLower(name)] = size
+		return nil
+	})
+	if err == nil {
+		health.SizesAvailable = true
+	}
+
+	// Virtual table indexes are gathered up first, so the sizes of their shadow tables can be added to them
+	indexes := make(map[string]*DBHealthIndex)
+	for name, module := range vtabs {
+		if _, ok := shadowTableSuffixes[module]; ok {
+			indexes[name] = &DBHealthIndex{Kind: module}
+		}
+	}
+	err = sdb.Select(`SELECT type, name, tbl_name FROM sqlite_master WHERE type IN ('table', 'index') ORDER BY name`,
+		func(s *sqlite.Stmt) error {
+			objType, _ := s.ScanText(0)
+			name, _ := s.ScanText(1)
+			tblName, _ := s.ScanText(2)
+			lower := strings.ToLower(name)
+			if objType == "index" {
+				health.Indexes = append(health.Indexes, DBHealthIndex{Kind: "index", Name: name, Size: sizes[lower],
+					Table: tblName})
+				return nil
+			}
+			if owner, ok := shadows[lower]; ok {
+				indexes[owner].Size += sizes[lower]
+				return nil
+			}
+			if idx, ok := indexes[lower]; ok {
+				idx.Name = name
+				if strings.HasPrefix(idx.Kind, "fts") {
+					// Full text search tables hold searchable text as well as their index, so are listed as both
+					health.Tables = append(health.Tables, DBHealthTable{Name: name})
+				}
+				return nil
+			}
+			if isMetadataTable(name) || strings.HasPrefix(lower, "sqlite_") {
+				return nil
+			}
+			health.Tables = append(health.Tables, DBHealthTable{Name: name, Size: sizes[lower]})
+			return nil
+		})
+	if err != nil {
+		log.Printf("Error when reading the tables and indexes of a database: %v\n", err)
+		return
+	}
+	for _, idx := range indexes {
+		health.Indexes = append(health.Indexes, *idx)
+	}
+	sort.Slice(health.Indexes, func(i, j int) bool { return health.Indexes[i].Name < health.Indexes[j].Name })
+
+	// Add up the totals
+	for i, t := range health.Tables {
+		var rows int
+		rows, err = GetSQLiteRowCount(sdb, t.Name)
+		if err != nil {
+			return
+		}
+		health.Tables[i].Rows = int64(rows)
+		health.TotalRows += int64(rows)
+		health.TotalTableSize += t.Size
+	}
+	for _, idx := range health.Indexes {
+		health.TotalIndexSize += idx.Size
+	}
+	return
+}
+
+// Returns true if the given table only holds index data, either as the shadow table of a virtual table or as an
+// R-Tree.
+func isIndexTable(table string, vtabs map[string]string, shadows map[string]string) bool {
+	lower := strings.ToLower(table)
+	if _, ok := shadows[lower]; ok {
+		return true
+	}
+	return strings.HasPrefix(vtabs[lower], "rtree")
+}
+
+// Returns the tables in a database which hold user data, leaving out SQLite's internal tables, the metadata table,
+// and the tables used for R-Tree and FTS indexes.
+func userTables(sdb *sqlite.Conn) ([]string, error) {
+	tables, err := sdb.Tables("")
+	if err != nil {
+		return nil, err
+	}
+	vtabs, shadows, err := virtualTables(sdb)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, t := range tables {
+		if isMetadataTable(t) || strings.HasPrefix(t, "sqlite_") || isIndexTable(t, vtabs, shadows) {
+			continue
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// Returns the module names of the virtual tables in a database, and the shadow tables which belong to each of them.
+// Both are keyed by lower case table name, and the shadow tables map to the name of their virtual table.
+func virtualTables(sdb *sqlite.Conn) (vtabs map[string]string, shadows map[string]string, err error) {
+	vtabs = make(map[string]string)
+	shadows = make(map[string]string)
+	err = sdb.Select(`SELECT name, sql FROM sqlite_master WHERE type = 'table' AND sql LIKE 'CREATE VIRTUAL TABLE%'`,
+		func(s *sqlite.Stmt) error {
+			name, _ := s.ScanText(0)
+			sql, _ := s.ScanText(1)
+			vtabs[strings.ToLower(name)] = virtualTableModule(sql)
+			return nil
+		})
+	if err != nil {
+		log.Printf("Error when reading the virtual tables of a database: %v\n", err)
+		return
+	}
+	for name, module := range vtabs {
+		for _, suffix := range shadowTableSuffixes[module] {
+			shadows[name+suffix] = name
+		}
+	}
+	return
+}
+
+// Returns the lower case module name from a CREATE VIRTUAL TABLE statement, or an empty string if there isn't one.
+func virtualTableModule(sql string) string {
+	upper := strings.ToUpper(sql)
+	pos := strings.Index(upper, " USING ")
+	if pos == -1 {
+		return ""
+	}
+	module := strings.TrimSpace(sql[pos+len(" USING "):])
+	if end := strings.IndexAny(module, "( \t\r\n;"); end != -1 {
+		module = module[:end]
+	}
+	return strings.ToLower(strings.Trim(module, "\"`[]"))
+}
@@ -0,0 +1,427 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Compares two versions of a SQLite database, returning the changes to their schema along with the rows inserted,
+// updated, and deleted in each table.  Rows are matched up using their primary key, or their rowid when the table
+// doesn't have one.  If a table name is given only that table's rows are compared, and for large diffs the row changes
+// of each table are paged using the offset and maximum row count.
+func DiffSQLiteDBs(oldDB *sqlite.Conn, newDB *sqlite.Conn, dbTable string, offset int, maxRows int) (diff DBDiff, err error) {
+	diff.Schema, err = diffSchema(oldDB, newDB)
+	if err != nil {
+		return
+	}
+
+	// Work out which tables to compare
+	oldTables, err := userTables(oldDB)
+	if err != nil {
+		log.Printf("Error retrieving table names when diffing databases: %v\n", err)
+		return diff, errors.New("Error retrieving table names")
+	}
+	newTables, err := userTables(newDB)
+	if err != nil {
+		log.Printf("Error retrieving table names when diffing databases: %v\n", err)
+		return diff, errors.New("Error retrieving table names")
+	}
+	inOld := make(map[string]bool)
+	inNew := make(map[string]bool)
+	var tables []string
+	for _, t := range oldTables {
+		inOld[t] = true
+		tables = append(tables, t)
+	}
+	for _, t := range newTables {
+		inNew[t] = true
+		if !inOld[t] {
+			tables = append(tables, t)
+		}
+	}
+	sort.Strings(tables)
+	if dbTable != "" {
+		if !inOld[dbTable] && !inNew[dbTable] {
+			return diff, errors.New("Requested table does not exist in either version")
+		}
+		tables = []string{dbTable}
+	}
+
+	for _, t := range tables {
+		var tblDiff DBDiffTable
+		switch {
+		case !inOld[t]:
+			tblDiff, err = diffTable(nil, newDB, t, offset, maxRows)
+		case !inNew[t]:
+			tblDiff, err = diffTable(oldDB, nil, t, offset, maxRows)
+		default:
+			tblDiff, err = diffTable(oldDB, newDB, t, offset, maxRows)
+		}
+		if err != nil {
+			return
+		}
+		if tblDiff.Action != "" {
+			diff.Tables = append(diff.Tables, tblDiff)
+		}
+	}
+	return
+}
+
+// Orders two values the same way SQLite does with the BINARY collation.  NULLs come first, then numbers, text, and
+// BLOBs.
+func compareDiffValues(a interface{}, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		fa, fb := diffNumber(x), diffNumber(b)
+		if ia, ok := x.(int64); ok {
+			if ib, ok := b.(int64); ok {
+				// Compare integers directly, as large ones lose precision as floats
+				switch {
+				case ia < ib:
+					return -1
+				case ia > ib:
+					return 1
+				}
+				return 0
+			}
+		}
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, b.(string))
+	}
+	return bytes.Compare(a.([]byte), b.([]byte))
+}
+
+// Steps through the rows of a table in two versions of a database, calling change for each row which was inserted,
+// updated, or deleted.  The callback is given the row's key, along with its values in each version using the column
+// order returned.  Rows are matched up on the primary key, or the rowid if there isn't one, and the names of the key
+// columns are returned too.
+func compareTableRows(oldDB *sqlite.Conn, newDB *sqlite.Conn, dbTable string,
+	change func(action string, key []interface{}, oldVals []interface{}, newVals []interface{})) (columns []string,
+	keyCols []string, err error) {
+	// The row values are returned using the column order of the newer version, if the table is in it
+	var oldCols, newCols []sqlite.Column
+	if oldDB != nil {
+		oldCols, err = oldDB.Columns("", dbTable)
+		if err != nil {
+			log.Printf("Error retrieving columns for table '%s' when diffing databases: %v\n", dbTable, err)
+			return nil, nil, errors.New("Error retrieving column names")
+		}
+	}
+	if newDB != nil {
+		newCols, err = newDB.Columns("", dbTable)
+		if err != nil {
+			log.Printf("Error retrieving columns for table '%s' when diffing databases: %v\n", dbTable, err)
+			return nil, nil, errors.New("Error retrieving column names")
+		}
+	}
+	cols := newCols
+	if newDB == nil {
+		cols = oldCols
+	}
+	for _, c := range cols {
+		columns = append(columns, c.Name)
+	}
+
+	// Rows are matched up on the primary key, as long as both versions have all of its columns
+	inOld := make(map[string]bool)
+	for _, c := range oldCols {
+		inOld[c.Name] = true
+	}
+	var pk []sqlite.Column
+	for _, c := range cols {
+		if c.Pk > 0 {
+			pk = append(pk, c)
+		}
+	}
+	sort.Slice(pk, func(i, j int) bool { return pk[i].Pk < pk[j].Pk })
+	var keys []string
+	for _, c := range pk {
+		if oldDB != nil && !inOld[c.Name] {
+			keys, keyCols = nil, nil
+			break
+		}
+		keys = append(keys, sqlite.Mprintf(`"%w"`, c.Name))
+		keyCols = append(keyCols, c.Name)
+	}
+	if len(keys) == 0 {
+		keys, keyCols = []string{"rowid"}, []string{"rowid"}
+	}
+
+	// Columns which aren't in the older version are read from it as NULLs, and don't count as updates
+	query := func(fromOld bool) string {
+		var exprs, order []string
+		for _, k := range keys {
+			exprs = append(exprs, k)
+			order = append(order, k+" COLLATE BINARY")
+		}
+		for _, c := range cols {
+			if fromOld && !inOld[c.Name] {
+				exprs = append(exprs, "NULL")
+				continue
+			}
+			exprs = append(exprs, sqlite.Mprintf(`"%w"`, c.Name))
+		}
+		return `SELECT ` + strings.Join(exprs, ", ") + sqlite.Mprintf(` FROM "%w"`, dbTable) + ` ORDER BY ` +
+			strings.Join(order, ", ")
+	}
+	var oldStmt, newStmt *sqlite.Stmt
+	if oldDB != nil {
+		oldStmt, err = oldDB.Prepare(query(true))
+		if err != nil {
+			log.Printf("Error when preparing statement for diff of table '%s': %v\n", dbTable, err)
+			return nil, nil, fmt.Errorf("Rows of the table '%s' can't be compared", dbTable)
+		}
+		defer oldStmt.Finalize()
+	}
+	if newDB != nil {
+		newStmt, err = newDB.Prepare(query(false))
+		if err != nil {
+			log.Printf("Error when preparing statement for diff of table '%s': %v\n", dbTable, err)
+			return nil, nil, fmt.Errorf("Rows of the table '%s' can't be compared", dbTable)
+		}
+		defer newStmt.Finalize()
+	}
+
+	// Step through both tables in key order, in the same way as a merge join
+	numKeys := len(keys)
+	numVals := numKeys + len(cols)
+	next := func(stmt *sqlite.Stmt) ([]interface{}, error) {
+		if stmt == nil {
+			return nil, nil
+		}
+		ok, err := stmt.Next()
+		if err != nil || !ok {
+			return nil, err
+		}
+		return scanDiffRow(stmt, numVals), nil
+	}
+	addChange := func(action string, oldRow []interface{}, newRow []interface{}) {
+		var key, oldVals, newVals []interface{}
+		if oldRow != nil {
+			key, oldVals = oldRow[:numKeys], oldRow[numKeys:]
+		}
+		if newRow != nil {
+			key, newVals = newRow[:numKeys], newRow[numKeys:]
+		}
+		change(action, key, oldVals, newVals)
+	}
+	oldRow, err := next(oldStmt)
+	if err != nil {
+		log.Printf("Error when reading rows for diff of table '%s': %v\n", dbTable, err)
+		return nil, nil, errors.New("Error when reading data from the SQLite database")
+	}
+	newRow, err := next(newStmt)
+	if err != nil {
+		log.Printf("Error when reading rows for diff of table '%s': %v\n", dbTable, err)
+		return nil, nil, errors.New("Error when reading data from the SQLite database")
+	}
+	for oldRow != nil || newRow != nil {
+		cmp := 0
+		switch {
+		case oldRow == nil:
+			cmp = 1
+		case newRow == nil:
+			cmp = -1
+		default:
+			for i := 0; i < numKeys && cmp == 0; i++ {
+				cmp = compareDiffValues(oldRow[i], newRow[i])
+			}
+		}
+		switch {
+		case cmp < 0:
+			addChange("delete", oldRow, nil)
+			oldRow, err = next(oldStmt)
+		case cmp > 0:
+			addChange("insert", nil, newRow)
+			newRow, err = next(newStmt)
+		default:
+			for i, c := range cols {
+				if inOld[c.Name] && compareDiffValues(oldRow[numKeys+i], newRow[numKeys+i]) != 0 {
+					addChange("update", oldRow, newRow)
+					break
+				}
+			}
+			oldRow, err = next(oldStmt)
+			if err == nil {
+				newRow, err = next(newStmt)
+			}
+		}
+		if err != nil {
+			log.Printf("Error when reading rows for diff of table '%s': %v\n", dbTable, err)
+			return nil, nil, errors.New("Error when reading data from the SQLite database")
+		}
+	}
+
+	return columns, keyCols, nil
+}
+
+func diffNumber(v interface{}) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+// Returns the differences between the schema of two databases, leaving out the tables SQLite and virtual table
+// modules create for themselves.
+func diffSchema(oldDB *sqlite.Conn, newDB *sqlite.Conn) ([]DBDiffSchema, error) {
+	read := func(sdb *sqlite.Conn) (map[string][2]string, error) {
+		_, shadows, err := virtualTables(sdb)
+		if err != nil {
+			return nil, err
+		}
+		objects := make(map[string][2]string)
+		err = sdb.Select(`SELECT type, name, coalesce(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'`,
+			func(s *sqlite.Stmt) error {
+				objType, _ := s.ScanText(0)
+				name, _ := s.ScanText(1)
+				sql, _ := s.ScanText(2)
+				if _, ok := shadows[strings.ToLower(name)]; !ok {
+					objects[name] = [2]string{objType, sql}
+				}
+				return nil
+			})
+		if err != nil {
+			log.Printf("Error when reading database schema for diff: %v\n", err)
+			return nil, errors.New("Error when reading the database schema")
+		}
+		return objects, nil
+	}
+	oldObjects, err := read(oldDB)
+	if err != nil {
+		return nil, err
+	}
+	newObjects, err := read(newDB)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []DBDiffSchema{}
+	for name, o := range oldObjects {
+		n, ok := newObjects[name]
+		switch {
+		case !ok:
+			changes = append(changes, DBDiffSchema{Action: "removed", Name: name, OldSQL: o[1], Type: o[0]})
+		case n != o:
+			changes = append(changes, DBDiffSchema{Action: "modified", Name: name, NewSQL: n[1], OldSQL: o[1],
+				Type: n[0]})
+		}
+	}
+	for name, n := range newObjects {
+		if _, ok := oldObjects[name]; !ok {
+			changes = append(changes, DBDiffSchema{Action: "added", Name: name, NewSQL: n[1], Type: n[0]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes, nil
+}
+
+// Compares the rows of a table in two databases.  When the table only exists in one of them, the other connection is
+// nil and its rows are all inserts or deletes.
+func diffTable(oldDB *sqlite.Conn, newDB *sqlite.Conn, dbTable string, offset int, maxRows int) (tblDiff DBDiffTable, err error) {
+	tblDiff.Name = dbTable
+	tblDiff.Offset = offset
+	tblDiff.Rows = []DBDiffRow{}
+	change := func(action string, key []interface{}, oldVals []interface{}, newVals []interface{}) {
+		num := tblDiff.Deletes + tblDiff.Inserts + tblDiff.Updates
+		switch action {
+		case "delete":
+			tblDiff.Deletes++
+		case "insert":
+			tblDiff.Inserts++
+		case "update":
+			tblDiff.Updates++
+		}
+		if num < offset || num >= offset+maxRows {
+			return
+		}
+		row := DBDiffRow{Action: action}
+		if oldVals != nil {
+			row.Old = diffRowValues(oldVals)
+		}
+		if newVals != nil {
+			row.New = diffRowValues(newVals)
+		}
+		tblDiff.Rows = append(tblDiff.Rows, row)
+	}
+	tblDiff.Columns, _, err = compareTableRows(oldDB, newDB, dbTable, change)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case oldDB == nil:
+		tblDiff.Action = "added"
+	case newDB == nil:
+		tblDiff.Action = "removed"
+	case tblDiff.Deletes+tblDiff.Inserts+tblDiff.Updates > 0:
+		tblDiff.Action = "modified"
+	}
+	return
+}
+
+// Converts the values of a row read by scanDiffRow for returning to the user, with BLOBs encoded the same way as for
+// typed table data.
+func diffRowValues(vals []interface{}) []interface{} {
+	row := make([]interface{}, len(vals))
+	for i, v := range vals {
+		if b, ok := v.([]byte); ok {
+			row[i] = TypedBlob{Base64: base64.StdEncoding.EncodeToString(b)}
+			continue
+		}
+		row[i] = v
+	}
+	return row
+}
+
+// Reads the values of the current row of a statement, as int64, float64, string, []byte, or nil.
+func scanDiffRow(s *sqlite.Stmt, numVals int) []interface{} {
+	row := make([]interface{}, numVals)
+	for i := range row {
+		switch s.ColumnType(i) {
+		case sqlite.Integer:
+			row[i], _ = s.ScanInt64(i)
+		case sqlite.Float:
+			row[i], _, _ = s.ScanDouble(i)
+		case sqlite.Text:
+			row[i], _ = s.ScanText(i)
+		case sqlite.Blob:
+			val, _ := s.ScanBlob(i)
+			if val == nil {
+				val = []byte{}
+			}
+			row[i] = val
+		}
+	}
+	return row
+}
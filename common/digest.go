@@ -0,0 +1,56 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Users can ask for a daily or weekly email listing the new versions of the databases they've starred.  The admin
+// server checks for digests which are due every DigestInterval, and sends them through the configured mail server.
+
+// Sends the email digests which are due, returning how many were sent.  Users without any new versions to tell them
+// about aren't sent anything, but are still counted as done until their next digest is due.
+func SendDigests() (sent int, err error) {
+	users, err := DigestsDue()
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		now := time.Now().UTC()
+		entries, err := DigestVersions(u.UserName, u.LastDigest)
+		if err != nil {
+			return sent, err
+		}
+		if len(entries) > 0 {
+			err = SendEmail(u.Email, fmt.Sprintf("Your %s DBHub.io digest", u.Frequency),
+				digestBody(u, entries))
+			if err != nil {
+				log.Printf("Sending email digest to user '%s' failed: %v\n", u.UserName, err)
+				continue
+			}
+			sent++
+		}
+		err = SetDigestSent(u.UserName, now)
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Returns the text of an email digest.
+func digestBody(u DigestUser, entries []DigestEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\nThese databases you've starred have new versions since %s:\n\n", u.UserName,
+		u.LastDigest.Format("2 January 2006"))
+	for _, e := range entries {
+		fmt.Fprintf(&b, "  %s%s%s version %d (%s)\n    https://%s/%s%s%s?version=%d\n", e.Owner, e.Folder,
+			e.DBName, e.Version, e.DateCreated.Format("2 Jan 2006 15:04 MST"), WebServer(), e.Owner, e.Folder,
+			e.DBName, e.Version)
+	}
+	fmt.Fprintf(&b, "\nYou can change how often you get these emails on your preferences page:\n    https://%s/pref\n",
+		WebServer())
+	return b.String()
+}
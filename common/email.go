@@ -0,0 +1,36 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Sends a plain text email through the configured mail server.
+func SendEmail(to string, subject string, body string) error {
+	if EmailServer() == "" {
+		return fmt.Errorf("No outgoing mail server is configured")
+	}
+	var auth smtp.Auth
+	if EmailUsername() != "" {
+		host, _, err := net.SplitHostPort(EmailServer())
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", EmailUsername(), EmailPassword(), host)
+	}
+
+	// Header values can't contain line breaks, else extra headers could be slipped in
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", clean.Replace(EmailFrom()))
+	fmt.Fprintf(&msg, "To: %s\r\n", clean.Replace(to))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", clean.Replace(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(EmailServer(), auth, EmailFrom(), []string{to}, []byte(msg.String()))
+}
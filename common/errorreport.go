@@ -0,0 +1,174 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/icza/session"
+)
+
+// Query parameters which are never sent to the error reporting service, or written to the request logs
+var scrubbedParams = map[string]bool{
+	"code":     true,
+	"password": true,
+	"secret":   true,
+	"share":    true,
+	"sig":      true,
+	"state":    true,
+	"token":    true,
+}
+
+// HTTP client used for sending error reports.  Reports are sent in the background, so a short timeout is fine
+var errorReportClient = &http.Client{Timeout: 10 * time.Second}
+
+// Records the status code and error message (if any) of a response, for error reporting
+type errorRecorder struct {
+	http.ResponseWriter
+	msg    string
+	status int
+}
+
+func (e *errorRecorder) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+func (e *errorRecorder) WriteHeader(code int) {
+	e.status = code
+	e.ResponseWriter.WriteHeader(code)
+}
+
+// Returns the database owner and name from a request path, if they're present.  Handles both the "/owner/database"
+// style pages, and the "/x/action/owner/database" style ones
+func dbFromPath(urlPath string) (dbOwner string, dbName string) {
+	pathParts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(pathParts) > 0 && pathParts[0] == "x" {
+		pathParts = pathParts[1:]
+		if len(pathParts) > 0 {
+			pathParts = pathParts[1:]
+		}
+	}
+	if len(pathParts) != 2 {
+		return "", ""
+	}
+	return pathParts[0], pathParts[1]
+}
+
+// Attaches an error message to a response, so it's included if the error gets reported.
+func NoteError(w http.ResponseWriter, msg string) {
+	for {
+		switch rw := w.(type) {
+		case *errorRecorder:
+			rw.msg = msg
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+// Wraps a request multiplexer so panics and 5xx responses from handlers are sent to the error reporting service
+// configured for this instance.  When no service is configured, errors are only logged as usual.
+func ReportErrors(serviceName string, h http.Handler) http.Handler {
+	if conf.ErrorReporting.URL == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &errorRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("Panic when handling request for '%s': %v\n", r.URL.Path, p)
+				if rec.status == http.StatusOK {
+					http.Error(rec, "Internal server error", http.StatusInternalServerError)
+				}
+				sendErrorReport(serviceName, r, rec.Header().Get(RequestIDHeader), http.StatusInternalServerError,
+					fmt.Sprint(p), string(debug.Stack()))
+				return
+			}
+			if rec.status >= 500 {
+				sendErrorReport(serviceName, r, rec.Header().Get(RequestIDHeader), rec.status, rec.msg, "")
+			}
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
+
+// Returns the request URL with the values of any secrets in its query parameters replaced, so it's safe to write to
+// the request logs.
+func ScrubbedURL(u *url.URL) string {
+	query, scrubbed := scrubQuery(u.Query())
+	if !scrubbed {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = query
+	return c.String()
+}
+
+// Returns the encoded query parameters with the values of secrets replaced, and whether any were.
+func scrubQuery(query url.Values) (string, bool) {
+	params := url.Values{}
+	scrubbed := false
+	for k, v := range query {
+		if scrubbedParams[strings.ToLower(k)] {
+			params[k] = []string{"[scrubbed]"}
+			scrubbed = true
+		} else {
+			params[k] = v
+		}
+	}
+	return params.Encode(), scrubbed
+}
+
+// Sends an error report in the background.  Only the request path and scrubbed query parameters are included, not
+// headers or form data, so credentials and cookies are never sent.
+func sendErrorReport(serviceName string, r *http.Request, requestID string, status int, msg string, stack string) {
+	report := ErrorReport{
+		Message:   msg,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RequestID: requestID,
+		Service:   serviceName,
+		Stack:     stack,
+		Status:    status,
+		Time:      time.Now().UTC(),
+	}
+	report.Server, _ = os.Hostname()
+	report.DBOwner, report.DBName = dbFromPath(r.URL.Path)
+
+	// Scrub secrets from the query parameters
+	report.Query, _ = scrubQuery(r.URL.Query())
+
+	// Include the user name, if the request came from a logged in user
+	if sess := session.Get(r); sess != nil {
+		if u, ok := sess.CAttr("UserName").(string); ok {
+			report.User = u
+		}
+	}
+
+	go func() {
+		data, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("Error when encoding error report: %v\n", err)
+			return
+		}
+		resp, err := errorReportClient.Post(conf.ErrorReporting.URL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Error when sending error report: %v\n", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Error reporting service returned status %d\n", resp.StatusCode)
+		}
+	}()
+}
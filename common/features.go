@@ -0,0 +1,141 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Feature flags let big features be switched on progressively.  Each feature has a default built into the code, which
+// the [features] section of the configuration file can change for the whole instance.  Admins can then override that
+// from the admin server, either for everyone, or for a cohort of users.  Features can also be opened to users who've
+// opted into experimental features in their preferences, so they can try things out ahead of a wider rollout.
+
+// The features which can be switched on and off, with whether they're on when nothing says otherwise.  Features which
+// existed before the flags did default to on, so upgrading an instance doesn't take them away
+var knownFeatures = map[string]bool{
+	FeatureLiveDBs:  false,
+	FeatureQueryAPI: true,
+	FeatureWebhooks: true,
+}
+
+// Returns true if a feature is turned on for the given user.  Use an empty string for anonymous visitors, who only get
+// features which are turned on for everyone.
+func FeatureEnabled(feature string, userName string) bool {
+	overrides, err := featureFlagOverrides()
+	if err != nil {
+		// Fall back to the configured default, rather than failing the request
+		return featureDefault(feature)
+	}
+	f, ok := overrides[feature]
+	if !ok {
+		if featureDefault(feature) {
+			return true
+		}
+		return userName != "" && featureBetaDefault(feature) && PrefUserBeta(userName)
+	}
+	if f.Enabled {
+		return true
+	}
+	if userName == "" {
+		return false
+	}
+	for _, u := range f.Users {
+		if u == userName {
+			return true
+		}
+	}
+	if f.Beta && PrefUserBeta(userName) {
+		return true
+	}
+	return featureCohort(feature, userName) < f.RolloutPercent
+}
+
+// Returns whether the configuration file opens a feature to beta testers, when no admin has overridden it.
+func featureBetaDefault(feature string) bool {
+	for _, f := range conf.Features.Beta {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns which of 100 buckets a user falls into for a feature.  Each feature uses its own buckets, so the same users
+// aren't always the first to get new features.
+func featureCohort(feature string, userName string) int {
+	return int(crc32.ChecksumIEEE([]byte(feature+"/"+userName)) % 100)
+}
+
+// Returns whether a feature is on when no admin has overridden it, from the built in default and the configuration
+// file.
+func featureDefault(feature string) bool {
+	enabled := knownFeatures[feature]
+	for _, f := range conf.Features.Enabled {
+		if f == feature {
+			enabled = true
+		}
+	}
+	for _, f := range conf.Features.Disabled {
+		if f == feature {
+			enabled = false
+		}
+	}
+	return enabled
+}
+
+func featureFlagCacheKey() string {
+	tempArr := md5.Sum([]byte("featureflags"))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Returns the state of all the known feature flags, for the admin server.
+func FeatureFlags() ([]FeatureFlag, error) {
+	overrides, err := featureFlagOverrides()
+	if err != nil {
+		return nil, err
+	}
+	var list []FeatureFlag
+	for name := range knownFeatures {
+		f, ok := overrides[name]
+		if !ok {
+			f = FeatureFlag{Beta: featureBetaDefault(name), Enabled: featureDefault(name), Name: name}
+		}
+		f.Default = featureDefault(name)
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Clears the cached feature flag overrides, after an admin has changed them.
+func invalidateFeatureFlags() error {
+	err := memCache.Delete(featureFlagCacheKey())
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Printf("Error when invalidating cached feature flags: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Checks a feature flag override is usable, before it's saved.
+func validateFeatureFlag(f FeatureFlag) error {
+	if _, ok := knownFeatures[f.Name]; !ok {
+		return fmt.Errorf("Unknown feature '%s'", f.Name)
+	}
+	if f.RolloutPercent < 0 || f.RolloutPercent > 100 {
+		return fmt.Errorf("The rollout percentage needs to be between 0 and 100")
+	}
+	for _, u := range f.Users {
+		err := ValidateUser(u)
+		if err != nil {
+			return fmt.Errorf("Invalid user name '%s'", u)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Tables holding locations can be shown on a map.  Locations are either SpatiaLite geometry columns (as listed in its
+// geometry_columns table), or a pair of latitude and longitude columns picked out by name.  The rows are returned as
+// GeoJSON (RFC 7946), with the other columns as the properties of each feature.
+
+// Column names recognised as holding latitudes and longitudes
+var (
+	latitudeColNames  = map[string]bool{"lat": true, "latitude": true}
+	longitudeColNames = map[string]bool{"lng": true, "lon": true, "long": true, "longitude": true}
+)
+
+// Longest WKT preview of a geometry shown in place of its BLOB
+const maxWKTPreview = 200
+
+// SpatiaLite geometry class types.  Types with Z and / or M values add 1000, 2000, or 3000 to these
+const (
+	spatiaLitePoint           = 1
+	spatiaLiteLineString      = 2
+	spatiaLitePolygon         = 3
+	spatiaLiteMultiPoint      = 4
+	spatiaLiteMultiLineString = 5
+	spatiaLiteMultiPolygon    = 6
+)
+
+// GeoJSON is cached, so gob needs to know about the coordinate types of the different geometries
+func init() {
+	gob.Register([][]float64{})
+	gob.Register([][][]float64{})
+	gob.Register([]interface{}{})
+}
+
+// Reads the geometry from a SpatiaLite BLOB, as described at https://www.gaia-gis.it/gaia-sins/BLOB-Geometry.html
+// Only the X and Y values of each point are kept, as GeoJSON readers don't do much with the others.
+func parseSpatiaLiteGeometry(blob []byte) (*GeoJSONGeometry, error) {
+	if len(blob) < 44 || blob[0] != 0x00 || blob[38] != 0x7C || blob[len(blob)-1] != 0xFE {
+		return nil, errors.New("Not a SpatiaLite geometry")
+	}
+	g := spatiaLiteReader{buf: blob[:len(blob)-1], pos: 39, order: binary.BigEndian}
+	if blob[1] == 0x01 {
+		g.order = binary.LittleEndian
+	}
+	geom := g.geometry(int(g.uint32()), false)
+	if g.err != nil {
+		return nil, g.err
+	}
+	return geom, nil
+}
+
+// Works through the data in a SpatiaLite geometry BLOB.  The first error encountered is kept, with the values read
+// after it being zero.
+type spatiaLiteReader struct {
+	buf   []byte
+	err   error
+	order binary.ByteOrder
+	pos   int
+}
+
+func (g *spatiaLiteReader) float64() float64 {
+	if g.err != nil || g.pos+8 > len(g.buf) {
+		g.fail()
+		return 0
+	}
+	v := math.Float64frombits(g.order.Uint64(g.buf[g.pos:]))
+	g.pos += 8
+	return v
+}
+
+func (g *spatiaLiteReader) fail() {
+	if g.err == nil {
+		g.err = errors.New("Truncated SpatiaLite geometry")
+	}
+}
+
+// Reads a geometry of the given class type.  The entities inside the multi types each have their own marker and class
+// type.
+func (g *spatiaLiteReader) geometry(classType int, entity bool) *GeoJSONGeometry {
+	if entity {
+		if g.err != nil || g.pos >= len(g.buf) || g.buf[g.pos] != 0x69 {
+			g.fail()
+			return nil
+		}
+		g.pos++
+		classType = int(g.uint32())
+	}
+	if classType >= 1000000 {
+		g.err = errors.New("Compressed SpatiaLite geometries aren't supported")
+		return nil
+	}
+	dims := 2
+	switch classType / 1000 {
+	case 1, 2:
+		dims = 3
+	case 3:
+		dims = 4
+	}
+
+	switch classType % 1000 {
+	case spatiaLitePoint:
+		return &GeoJSONGeometry{Type: "Point", Coordinates: g.points(1, dims)[0]}
+	case spatiaLiteLineString:
+		return &GeoJSONGeometry{Type: "LineString", Coordinates: g.points(int(g.uint32()), dims)}
+	case spatiaLitePolygon:
+		return &GeoJSONGeometry{Type: "Polygon", Coordinates: g.rings(dims)}
+	case spatiaLiteMultiPoint, spatiaLiteMultiLineString, spatiaLiteMultiPolygon:
+		n := int(g.uint32())
+		var coords []interface{}
+		for i := 0; i < n && g.err == nil; i++ {
+			if e := g.geometry(0, true); e != nil {
+				coords = append(coords, e.Coordinates)
+			}
+		}
+		types := map[int]string{spatiaLiteMultiPoint: "MultiPoint", spatiaLiteMultiLineString: "MultiLineString",
+			spatiaLiteMultiPolygon: "MultiPolygon"}
+		return &GeoJSONGeometry{Type: types[classType%1000], Coordinates: coords}
+	}
+	g.err = fmt.Errorf("Unsupported SpatiaLite geometry type %d", classType)
+	return nil
+}
+
+// Reads a list of points, returning their X and Y values.
+func (g *spatiaLiteReader) points(n int, dims int) [][]float64 {
+	if n < 0 || n > len(g.buf) {
+		g.fail()
+		return [][]float64{nil}
+	}
+	pts := make([][]float64, n)
+	for i := range pts {
+		pts[i] = []float64{g.float64(), g.float64()}
+		for j := 2; j < dims; j++ {
+			g.float64()
+		}
+	}
+	return pts
+}
+
+// Reads the rings of a polygon.
+func (g *spatiaLiteReader) rings(dims int) [][][]float64 {
+	n := int(g.uint32())
+	var rings [][][]float64
+	for i := 0; i < n && g.err == nil; i++ {
+		rings = append(rings, g.points(int(g.uint32()), dims))
+	}
+	return rings
+}
+
+func (g *spatiaLiteReader) uint32() uint32 {
+	if g.err != nil || g.pos+4 > len(g.buf) {
+		g.fail()
+		return 0
+	}
+	v := g.order.Uint32(g.buf[g.pos:])
+	g.pos += 4
+	return v
+}
+
+// Loads the SpatiaLite extension into a database handle, if one is configured, so spatial SQL functions can be used.
+// Loading extensions is switched off again afterwards, so queries can't load any others.  If the extension can't be
+// loaded the handle still works, just without the spatial functions.
+func loadSpatiaLite(sdb *sqlite.Conn) {
+	ext := WebSpatiaLiteExtension()
+	if ext == "" {
+		return
+	}
+	err := sdb.EnableLoadExtension(true)
+	if err != nil {
+		log.Printf("Couldn't enable extension loading: %v\n", err)
+		return
+	}
+	defer sdb.EnableLoadExtension(false)
+	err = sdb.LoadExtension(ext)
+	if err != nil {
+		log.Printf("Couldn't load the SpatiaLite extension '%s': %v\n", ext, err)
+	}
+}
+
+// Returns the number value of a latitude or longitude field, which may have been stored as text.
+func geoCoordinate(s *sqlite.Stmt, i int) (float64, bool) {
+	switch s.ColumnType(i) {
+	case sqlite.Integer, sqlite.Float:
+		val, isNull, err := s.ScanDouble(i)
+		return val, err == nil && !isNull
+	case sqlite.Text:
+		val, _ := s.ScanText(i)
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Returns the rows of a table as GeoJSON features, using the given location columns.  Rows without a usable location
+// are skipped.  No more than maxRows rows are read from the table.
+func ReadGeoJSON(sdb *sqlite.Conn, dbTable string, cols SpatialColumns, maxRows int) (GeoJSON, error) {
+	collection := GeoJSON{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	dbQuery := sqlite.Mprintf(`SELECT * FROM "%w"`, dbTable) + fmt.Sprintf(" LIMIT %d", maxRows)
+	stmt, err := sdb.Prepare(dbQuery)
+	if err != nil {
+		log.Printf("Error when preparing statement for database: %s\n", err)
+		return collection, errors.New("Error when reading data from the SQLite database")
+	}
+	defer stmt.Finalize()
+	colNames := stmt.ColumnNames()
+
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		f := GeoJSONFeature{Type: "Feature", Properties: make(map[string]interface{})}
+		var lat, lon float64
+		var haveLat, haveLon bool
+		for i := 0; i < s.DataCount() && i < len(colNames); i++ {
+			name := colNames[i]
+			switch name {
+			case cols.Geometry:
+				blob, isNull := s.ScanBlob(i)
+				if isNull {
+					continue
+				}
+				if geom, err := parseSpatiaLiteGeometry(blob); err == nil {
+					f.Geometry = geom
+				}
+				continue
+			case cols.Latitude:
+				lat, haveLat = geoCoordinate(s, i)
+			case cols.Longitude:
+				lon, haveLon = geoCoordinate(s, i)
+			}
+
+			// Everything else becomes a property of the feature.  BLOBs are left out, as there's no sensible way to
+			// show them on a map
+			switch s.ColumnType(i) {
+			case sqlite.Integer:
+				val, _ := s.ScanInt64(i)
+				f.Properties[name] = val
+			case sqlite.Float:
+				val, _, _ := s.ScanDouble(i)
+				f.Properties[name] = val
+			case sqlite.Text:
+				val, _ := s.ScanText(i)
+				f.Properties[name] = val
+			case sqlite.Null:
+				f.Properties[name] = nil
+			}
+		}
+		if cols.Geometry == "" && haveLat && haveLon && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+			// GeoJSON positions are longitude first
+			f.Geometry = &GeoJSONGeometry{Type: "Point", Coordinates: []float64{lon, lat}}
+		}
+		if f.Geometry != nil {
+			collection.Features = append(collection.Features, f)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error when retrieving select data from database: %s\n", err)
+		return collection, errors.New("Error when reading data from the SQLite database")
+	}
+	return collection, nil
+}
+
+// Returns the columns of a table which hold locations.  If the table doesn't have any, the returned columns are all
+// blank.
+func SpatialCols(sdb *sqlite.Conn, dbTable string) (cols SpatialColumns, err error) {
+	// SpatiaLite databases list their geometry columns in the geometry_columns table
+	tables, err := sdb.Tables("")
+	if err != nil {
+		log.Printf("Error retrieving table names: %s", err)
+		return
+	}
+	for _, t := range tables {
+		if t != "geometry_columns" {
+			continue
+		}
+		err = sdb.Select(`SELECT f_geometry_column FROM geometry_columns WHERE lower(f_table_name) = lower(?)`,
+			func(s *sqlite.Stmt) error {
+				if cols.Geometry == "" {
+					cols.Geometry, _ = s.ScanText(0)
+				}
+				return nil
+			}, dbTable)
+		if err != nil {
+			log.Printf("Error when reading SpatiaLite geometry columns for table '%s': %v\n", dbTable, err)
+			return
+		}
+	}
+
+	// SpatiaLite keeps the column names in lower case, so use the name as it's written in the table
+	colList, err := sdb.Columns("", dbTable)
+	if err != nil {
+		log.Printf("Error when reading column names for table '%s': %v\n", dbTable, err)
+		return
+	}
+	geom := cols.Geometry
+	cols.Geometry = ""
+	for _, c := range colList {
+		switch name := strings.ToLower(c.Name); {
+		case geom != "" && name == strings.ToLower(geom):
+			cols.Geometry = c.Name
+		case latitudeColNames[name] && cols.Latitude == "":
+			cols.Latitude = c.Name
+		case longitudeColNames[name] && cols.Longitude == "":
+			cols.Longitude = c.Name
+		}
+	}
+
+	// A latitude column is no use without a longitude one, and the other way around
+	if cols.Latitude == "" || cols.Longitude == "" {
+		cols.Latitude, cols.Longitude = "", ""
+	}
+	return
+}
+
+// Returns a WKT preview of a SpatiaLite geometry, for showing in place of the raw BLOB.  Long geometries are cut
+// short.  Returns false if the BLOB isn't a geometry which can be read.
+func spatiaLiteWKT(blob []byte) (string, bool) {
+	geom, err := parseSpatiaLiteGeometry(blob)
+	if err != nil {
+		return "", false
+	}
+	coords := wktCoordinates(geom.Coordinates)
+	if geom.Type == "Point" {
+		coords = "(" + coords + ")"
+	}
+	wkt := strings.ToUpper(geom.Type) + coords
+	if len(wkt) > maxWKTPreview {
+		wkt = wkt[:maxWKTPreview] + "…"
+	}
+	return wkt, true
+}
+
+// Returns the WKT text for the coordinates of a geometry.
+func wktCoordinates(coords interface{}) string {
+	var parts []string
+	switch c := coords.(type) {
+	case []float64:
+		for _, v := range c {
+			parts = append(parts, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		return strings.Join(parts, " ")
+	case [][]float64:
+		for _, p := range c {
+			parts = append(parts, wktCoordinates(p))
+		}
+	case [][][]float64:
+		for _, r := range c {
+			parts = append(parts, wktCoordinates(r))
+		}
+	case []interface{}:
+		for _, e := range c {
+			parts = append(parts, wktCoordinates(e))
+		}
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Pages on the web UI show markdown and data provided by users, so every response gets a Content Security Policy
+// limiting where scripts, styles and other resources can be loaded from, along with the other usual security
+// headers.  Pages aren't allowed to be framed by other sites, except for the embed paths given in the configuration
+// file, which can be framed by the origins listed there.
+
+// How long browsers should only use HTTPS for this site, in seconds
+const hstsMaxAge = 365 * 24 * 60 * 60
+
+// Returns the Content Security Policy used for the web UI pages, allowing the given frame ancestors.  The templates
+// use inline scripts and AngularJS, so 'unsafe-inline' and 'unsafe-eval' are still needed for scripts.
+func contentSecurityPolicy(frameAncestors string) string {
+	auth0 := ""
+	if Auth0Domain() != "" {
+		auth0 = " https://" + Auth0Domain()
+	}
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self' 'unsafe-inline' 'unsafe-eval' https://ajax.googleapis.com https://angular-ui.github.io " +
+			"https://cdn.auth0.com https://unpkg.com",
+		"style-src 'self' 'unsafe-inline' https://netdna.bootstrapcdn.com https://opensource.keycdn.com " +
+			"https://unpkg.com",
+		"font-src 'self' https://netdna.bootstrapcdn.com https://opensource.keycdn.com",
+		"img-src 'self' data: https:",
+		"connect-src 'self'" + auth0,
+		"frame-src 'self'" + auth0,
+		"form-action 'self'" + auth0,
+		"object-src 'none'",
+		"base-uri 'self'",
+		"frame-ancestors " + frameAncestors,
+	}, "; ")
+}
+
+// Wraps a request multiplexer so every response gets the security headers.  Handlers can still override them, such
+// as the stricter policy used when serving attachments.
+func SecurityHeaders(h http.Handler) http.Handler {
+	csp := contentSecurityPolicy("'none'")
+	embedAncestors := "*"
+	if len(WebEmbedAncestors()) > 0 {
+		embedAncestors = strings.Join(WebEmbedAncestors(), " ")
+	}
+	embedCSP := contentSecurityPolicy(embedAncestors)
+	hsts := fmt.Sprintf("max-age=%d", hstsMaxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		hdr.Set("Strict-Transport-Security", hsts)
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		if embedPath(r.URL.Path) {
+			hdr.Set("Content-Security-Policy", embedCSP)
+		} else {
+			hdr.Set("Content-Security-Policy", csp)
+			hdr.Set("X-Frame-Options", "DENY")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Returns true if the given path is one of the embed paths from the configuration file, which other sites are
+// allowed to frame.
+func embedPath(path string) bool {
+	for _, p := range WebEmbedPaths() {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Import webhooks let external systems (eg ETL jobs) push new versions of a database, by posting a database file or
+// the URL of one to /x/import/<token> along with the webhook's secret.  The import goes through the same checks and
+// storage as a normal upload.
+
+// Downloads a database file an import webhook was given the URL of, to a temporary file, checking it has the SHA256
+// the caller gave along with the URL.  Only https URLs on public servers are accepted, and redirects aren't followed.
+// The caller needs to remove the temporary file when it's finished with it.
+func DownloadImportURL(ctx context.Context, rawURL string, wantSHA string) (tempDBName string, dbSize int64, shaSum []byte, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", 0, nil, fmt.Errorf("The URL needs to be a https:// link")
+	}
+	if wantSHA == "" {
+		return "", 0, nil, fmt.Errorf("The SHA256 of the database needs to be given along with its URL")
+	}
+	err = CheckPublicHost(u.Hostname())
+	if err != nil {
+		return "", 0, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+	defer cancel()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	resp, err := publicHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, nil, fmt.Errorf("Unexpected status downloading the database: %s", resp.Status)
+	}
+	tempDBName, dbSize, shaSum, err = saveRemoteDB(io.LimitReader(resp.Body, ImportURLMaxSize+1), wantSHA)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if dbSize > ImportURLMaxSize {
+		os.Remove(tempDBName)
+		return "", 0, nil, fmt.Errorf("The database is larger than %d bytes", int64(ImportURLMaxSize))
+	}
+	return tempDBName, dbSize, shaSum, nil
+}
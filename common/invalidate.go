@@ -0,0 +1,132 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Everything cached for a database (its metadata, table pages, row counts, and so on) has the database's generation
+// number as part of its cache key.  Bumping the generation is a single atomic memcached operation, which invalidates
+// all of those entries at once without needing to know which keys were used.  User pages and the front page lists
+// work the same way, with their own generation numbers.
+
+// Returns the current generation number for a database.
+func dbGeneration(dbOwner string, dbFolder string, dbName string) uint64 {
+	return generation(dbGenerationCacheKey(dbOwner, dbFolder, dbName),
+		fmt.Sprintf("database '%s%s%s'", dbOwner, dbFolder, dbName))
+}
+
+func dbGenerationCacheKey(dbOwner string, dbFolder string, dbName string) string {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("generation/%s/%s/%s", dbOwner, dbFolder, dbName)))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Returns the current generation number for the front page database lists.
+func frontPageGeneration() uint64 {
+	return generation(frontPageGenerationCacheKey(), "the front page")
+}
+
+func frontPageGenerationCacheKey() string {
+	tempArr := md5.Sum([]byte("generation/frontpage"))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Returns the generation number stored under a cache key.  When there isn't one yet (or it's been evicted from
+// memcached), a new one is started from the current time, so keys from before the eviction aren't reused.
+func generation(cacheKey string, what string) uint64 {
+	for i := 0; i < 2; i++ {
+		item, err := memCache.Get(cacheKey)
+		if err == nil {
+			gen, err := strconv.ParseUint(string(item.Value), 10, 64)
+			if err == nil {
+				return gen
+			}
+			log.Printf("Invalid cache generation for %s: %v\n", what, err)
+		} else if err != memcache.ErrCacheMiss {
+			log.Printf("Error retrieving cache generation for %s: %v\n", what, err)
+			return 0
+		}
+
+		// Start a new generation.  If another server got in first, use theirs instead
+		gen := uint64(time.Now().UnixNano())
+		err = memCache.Add(&memcache.Item{Key: cacheKey, Value: []byte(strconv.FormatUint(gen, 10))})
+		if err == nil {
+			return gen
+		}
+		if err != memcache.ErrNotStored {
+			log.Printf("Error storing cache generation for %s: %v\n", what, err)
+			return 0
+		}
+	}
+	return 0
+}
+
+// Bumps the generation number stored under a cache key, invalidating everything cached using it.
+func incrementGeneration(cacheKey string, what string) error {
+	_, err := memCache.Increment(cacheKey, 1)
+	if err != nil && err != memcache.ErrCacheMiss {
+		// A cache miss means there's no current generation, so nothing cached using it can be used anyway
+		log.Printf("Error when invalidating cache entries for %s: %v\n", what, err)
+		return err
+	}
+	return nil
+}
+
+// Invalidates everything cached for a database, for all of its versions.  As the database may be listed on its
+// owner's user page and the front page, those are invalidated too.  This needs to be called after any change to the
+// database has been written to PostgreSQL.
+func InvalidateDBCache(dbOwner string, dbFolder string, dbName string) error {
+	err := incrementGeneration(dbGenerationCacheKey(dbOwner, dbFolder, dbName),
+		fmt.Sprintf("database '%s%s%s'", dbOwner, dbFolder, dbName))
+	if err != nil {
+		return err
+	}
+	err = InvalidateUserCache(dbOwner)
+	if err != nil {
+		return err
+	}
+	return invalidateFrontPageCache()
+}
+
+// Invalidates the cached front page database lists.
+func invalidateFrontPageCache() error {
+	return incrementGeneration(frontPageGenerationCacheKey(), "the front page")
+}
+
+// Invalidates everything cached for a database and all other databases in its fork tree.  Used for changes which
+// show up on every database in the tree, such as the fork count.
+func InvalidateForkTreeCache(dbOwner string, dbFolder string, dbName string) error {
+	dbList, err := forkTreeDBs(dbOwner, dbFolder, dbName)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbList {
+		err = InvalidateDBCache(db.Owner, db.Folder, db.DBName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Invalidates the cached details shown on a user's page.  This needs to be called after changes to the user's
+// profile or followers, as well as their databases.
+func InvalidateUserCache(userName string) error {
+	return incrementGeneration(userGenerationCacheKey(userName), fmt.Sprintf("user '%s'", userName))
+}
+
+// Returns the current generation number for a user's page.
+func userGeneration(userName string) uint64 {
+	return generation(userGenerationCacheKey(userName), fmt.Sprintf("user '%s'", userName))
+}
+
+func userGenerationCacheKey(userName string) string {
+	tempArr := md5.Sum([]byte("generation/user/" + userName))
+	return hex.EncodeToString(tempArr[:])
+}
@@ -0,0 +1,494 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Live databases are kept as files in the live data directory, rather than as immutable versions in Minio, so they
+// can be changed with INSERT, UPDATE, and DELETE statements through the write API.  Every statement is journaled in
+// PostgreSQL, and changed databases are stored back into their version history every LiveSnapshotInterval() seconds.
+// As the files are on local disk, only one web UI server should have live databases enabled.
+
+// Statements run against the same live database one at a time, and snapshots wait for them to finish
+var liveLocks sync.Map
+
+// Returns the lock for a live database.
+func liveLock(dbID int64) *sync.Mutex {
+	l, _ := liveLocks.LoadOrStore(dbID, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// Returns the path of a live database's file.
+func liveDBPath(dbID int64) string {
+	return filepath.Join(LiveDataDir(), fmt.Sprintf("%d.db", dbID))
+}
+
+// Appends rows of CSV data to a table in a live database, returning the number of rows added.  The first row of the
+// CSV data names the columns the values are for, which need to exist in the table, and has to include any NOT NULL
+// columns without a default value.  Values are checked against the affinity of their column, with empty values
+// treated as NULL for columns which aren't text.  Rows are added in transactions of LiveCSVBatchSize rows, so when a
+// row is rejected the batches before it are kept.
+func AppendLiveCSV(ctx context.Context, db LiveDB, userName string, table string, data io.Reader) (int64, error) {
+	lock := liveLock(db.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	_, live, err := DBLive(db.Owner, db.Folder, db.DBName)
+	if err != nil {
+		return 0, err
+	}
+	if !live {
+		return 0, errors.New("That isn't a live database")
+	}
+	sdb, err := sqlite.Open(liveDBPath(db.ID), sqlite.OpenReadWrite)
+	if err != nil {
+		log.Printf("Couldn't open live database '%s%s%s': %v\n", db.Owner, db.Folder, db.DBName, err)
+		return 0, errors.New("Couldn't open the live database")
+	}
+	defer sdb.Close()
+
+	// Make sure the table exists, and work out which of its columns the CSV data has values for
+	tables, err := sdb.Tables("")
+	if err != nil {
+		return 0, err
+	}
+	found := false
+	for _, t := range tables {
+		if t == table {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("The table '%s' doesn't exist", table)
+	}
+	cols, err := sdb.Columns("", table)
+	if err != nil {
+		return 0, err
+	}
+	r := csv.NewReader(data)
+	header, err := r.Read()
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't read the CSV header row: %s", err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\uFEFF")
+	}
+	affinities := make([]string, len(header))
+	quoted := make([]string, len(header))
+	given := make(map[string]bool)
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		header[i] = h
+		if given[h] {
+			return 0, fmt.Errorf("The column '%s' is in the CSV header more than once", h)
+		}
+		for _, c := range cols {
+			if c.Name == h {
+				affinities[i] = columnAffinity(c.DataType)
+				break
+			}
+		}
+		if affinities[i] == "" {
+			return 0, fmt.Errorf("The table '%s' doesn't have a column called '%s'", table, h)
+		}
+		given[h] = true
+		quoted[i] = sqlite.Mprintf(`"%w"`, h)
+	}
+	for _, c := range cols {
+		if c.NotNull && c.DfltValue == "" && c.Pk == 0 && !given[c.Name] {
+			return 0, fmt.Errorf("The CSV data needs a value for the '%s' column", c.Name)
+		}
+	}
+	insert := sqlite.Mprintf(`INSERT INTO "%w"`, table) + ` (` + strings.Join(quoted, ", ") + `) VALUES (` +
+		strings.TrimSuffix(strings.Repeat("?, ", len(header)), ", ") + `)`
+	stmt, err := sdb.Prepare(insert)
+	if err != nil {
+		return 0, fmt.Errorf("Error when preparing to add rows: %s", err)
+	}
+	defer stmt.Finalize()
+
+	// Add the rows in batches, journaling each batch once it's committed
+	var added, batch int64
+	commit := func() error {
+		if batch == 0 {
+			return nil
+		}
+		err := sdb.Commit()
+		if err != nil {
+			return err
+		}
+		added += batch
+		jerr := RecordLiveStatement(db.ID, userName, fmt.Sprintf("-- %d rows appended from CSV\n%s", batch, insert),
+			batch)
+		if jerr != nil {
+			log.Printf("CSV rows appended to live database '%s%s%s' by '%s' weren't journaled\n", db.Owner,
+				db.Folder, db.DBName, userName)
+		}
+		batch = 0
+		return nil
+	}
+	args := make([]interface{}, len(header))
+	for rowNum := 1; ; rowNum++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			err = csvRowArgs(record, header, affinities, args)
+		}
+		if err == nil {
+			if batch == 0 {
+				err = sdb.Begin()
+			}
+			if err == nil {
+				err = stmt.Exec(args...)
+			}
+		}
+		if err != nil {
+			if batch > 0 {
+				sdb.Rollback()
+			}
+			return added, fmt.Errorf("Row %d: %s.  %d rows were appended before it", rowNum, err, added)
+		}
+		batch++
+		if batch == LiveCSVBatchSize {
+			err = commit()
+			if err != nil {
+				sdb.Rollback()
+				return added, fmt.Errorf("Row %d: %s.  %d rows were appended before it", rowNum, err, added)
+			}
+		}
+	}
+	err = commit()
+	if err != nil {
+		sdb.Rollback()
+		return added, err
+	}
+	return added, nil
+}
+
+// Converts the values in a row of CSV data to the types of the columns they're for, checking they match.
+func csvRowArgs(record []string, header []string, affinities []string, args []interface{}) error {
+	for i, v := range record {
+		if v == "" && affinities[i] != "TEXT" {
+			args[i] = nil
+			continue
+		}
+		switch affinities[i] {
+		case "INTEGER":
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("'%s' isn't a whole number, as the '%s' column needs", v, header[i])
+			}
+			args[i] = n
+		case "REAL":
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return fmt.Errorf("'%s' isn't a number, as the '%s' column needs", v, header[i])
+			}
+			args[i] = f
+		default:
+			args[i] = v
+		}
+	}
+	return nil
+}
+
+// Runs a statement which changes a live database, returning the number of rows it changed.  Only a single INSERT,
+// UPDATE, DELETE, or REPLACE statement is accepted, and it's interrupted if it runs for longer than QueryTimeout.
+func ExecLiveDB(ctx context.Context, db LiveDB, userName string, statement string) (int64, error) {
+	switch queryKeyword(statement) {
+	case "DELETE", "INSERT", "REPLACE", "UPDATE":
+	default:
+		return 0, errors.New("Only INSERT, UPDATE, DELETE, and REPLACE statements can be run")
+	}
+
+	// Check the database is still live once it's locked, as it may have been turned back into a normal one while
+	// waiting
+	lock := liveLock(db.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	_, live, err := DBLive(db.Owner, db.Folder, db.DBName)
+	if err != nil {
+		return 0, err
+	}
+	if !live {
+		return 0, errors.New("That isn't a live database")
+	}
+	sdb, err := sqlite.Open(liveDBPath(db.ID), sqlite.OpenReadWrite)
+	if err != nil {
+		log.Printf("Couldn't open live database '%s%s%s': %v\n", db.Owner, db.Folder, db.DBName, err)
+		return 0, errors.New("Couldn't open the live database")
+	}
+	defer sdb.Close()
+
+	// Anything after the first statement is rejected rather than silently ignored
+	stmt, err := sdb.Prepare(statement)
+	if err != nil {
+		return 0, fmt.Errorf("Error in statement: %s", err)
+	}
+	defer stmt.Finalize()
+	if strings.TrimSpace(stmt.Tail()) != "" {
+		return 0, errors.New("Only a single SQL statement can be run at a time")
+	}
+
+	// Interrupt the statement if it takes too long
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			sdb.Interrupt()
+		case <-done:
+		}
+	}()
+	err = stmt.Exec()
+	close(done)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, fmt.Errorf("Statement took longer than %v, so was stopped", QueryTimeout)
+		}
+		return 0, fmt.Errorf("Error when running statement: %s", err)
+	}
+	rows := int64(sdb.Changes())
+
+	// The statement has been applied, so a journaling failure is only logged
+	err = RecordLiveStatement(db.ID, userName, statement, rows)
+	if err != nil {
+		log.Printf("Statement run against live database '%s%s%s' by '%s' wasn't journaled: %s\n", db.Owner,
+			db.Folder, db.DBName, userName, statement)
+	}
+	return rows, nil
+}
+
+// Turns a database into a live one, starting from the latest version on its main branch.
+func MakeDBLive(ctx context.Context, dbOwner string, dbFolder string, dbName string) error {
+	if LiveDataDir() == "" {
+		return errors.New("Live databases aren't available on this server")
+	}
+	db, live, err := DBLive(dbOwner, dbFolder, dbName)
+	if err != nil {
+		return err
+	}
+	if db.ID == 0 {
+		return errors.New("The requested database doesn't exist")
+	}
+	if live {
+		return nil
+	}
+
+	// Live changes are stored as new versions on the main branch, which isn't allowed when it's protected
+	protected, err := BranchProtected(dbOwner, dbFolder, dbName, DefaultBranch)
+	if err != nil {
+		return err
+	}
+	if protected {
+		return errors.New("The main branch of the database is protected, so it can't be made live")
+	}
+
+	// Copy the latest version into the live data directory.  It's written to a temporary file first, so a partly
+	// written file is never mistaken for the live database
+	var info SQLiteDBinfo
+	err = DBDetails(ctx, &info, dbOwner, dbOwner, dbFolder, dbName, 0)
+	if err != nil {
+		return err
+	}
+	obj, err := MinioHandle(ctx, info.MinioBkt, info.MinioId)
+	if err != nil {
+		return err
+	}
+	defer MinioHandleClose(obj)
+	err = os.MkdirAll(LiveDataDir(), 0700)
+	if err != nil {
+		return err
+	}
+	tempDB, err := ioutil.TempFile(LiveDataDir(), "new-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempDB, obj)
+	if cerr := tempDB.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tempDB.Name())
+		return err
+	}
+	err = os.Rename(tempDB.Name(), liveDBPath(db.ID))
+	if err != nil {
+		os.Remove(tempDB.Name())
+		return err
+	}
+	return SetDBLive(dbOwner, dbFolder, dbName, true)
+}
+
+// Stores a copy of a live database as a new version, returning its version number.  If the copy is the same as the
+// latest version, no new version is added and 0 is returned.  The database is only locked while it's being copied,
+// and is flagged as changed again if storing the copy fails.  Scheduled snapshots have no author, so they're
+// credited to the database owner.
+//
+// Snapshots need to pass the database's validation rules, the same as uploaded versions.  A copy breaking any of them
+// isn't stored, and the rules it breaks are returned.  The live database keeps its changes and stays flagged as
+// changed, so snapshots carry on being tried until the data passes the rules again.
+func SnapshotLiveDB(ctx context.Context, db LiveDB, author string, commitMsg string) (ver int, violations []RuleViolation, err error) {
+	ctx, span := StartSpan(ctx, "live.snapshot")
+	defer span.End()
+
+	if commitMsg == "" {
+		commitMsg = "Snapshot of live database changes"
+	}
+
+	// Snapshots are added to the main branch, so none are taken while it's protected.  The live changes are kept
+	// until it isn't
+	protected, err := BranchProtected(db.Owner, db.Folder, db.DBName, DefaultBranch)
+	if err != nil {
+		return 0, nil, err
+	}
+	if protected {
+		return 0, nil, errors.New("The main branch of the database is protected, so snapshots can't be added " +
+			"to it")
+	}
+	tempDB, err := ioutil.TempFile(LiveDataDir(), "snapshot-")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(tempDB.Name())
+	defer func() {
+		if err != nil {
+			SetLiveChanged(db.ID, true)
+		}
+	}()
+
+	lock := liveLock(db.ID)
+	lock.Lock()
+	err = SetLiveChanged(db.ID, false)
+	if err != nil {
+		lock.Unlock()
+		tempDB.Close()
+		return 0, nil, err
+	}
+	h := sha256.New()
+	var dbSize int64
+	src, err := os.Open(liveDBPath(db.ID))
+	if err == nil {
+		dbSize, err = io.Copy(io.MultiWriter(tempDB, h), src)
+		src.Close()
+	}
+	lock.Unlock()
+	if cerr := tempDB.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Store the copy as the next version of the database
+	highVer, err := HighestDBVersion(db.Owner, db.DBName, db.Folder, db.Owner)
+	if err != nil {
+		return 0, nil, err
+	}
+	latestSHA, _, err := DBVersionSHA256(db.Owner, db.Folder, db.DBName, highVer)
+	if err != nil {
+		return 0, nil, err
+	}
+	if latestSHA == hex.EncodeToString(h.Sum(nil)) {
+		return 0, nil, nil
+	}
+	violations, err = CheckValidationRules(ctx, db.Owner, db.Folder, db.DBName, tempDB.Name())
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(violations) > 0 {
+		err = ViolationsError(violations)
+		return 0, violations, err
+	}
+	bucket, minioID, storedSize, err := storeRemoteDB(ctx, db.Owner, tempDB.Name())
+	if err != nil {
+		return 0, nil, err
+	}
+	ver = highVer + 1
+	err = AddDatabase(db.Owner, db.Folder, db.DBName, ver, h.Sum(nil), int(dbSize), storedSize, false, bucket,
+		minioID, "", "", commitMsg, author, "")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// The snapshot is a normal version from here on, so it shows up in the activity feeds and webhooks like uploads do
+	if author == "" {
+		author = db.Owner
+	}
+	aerr := RecordActivity(author, FeedVersion, db.Owner, db.Folder, db.DBName, ver, "")
+	if aerr != nil {
+		log.Printf("Error recording activity for '%s%s%s': %v\n", db.Owner, db.Folder, db.DBName, aerr)
+	}
+	aerr = DBEvent(db.Owner, db.Folder, db.DBName, WebhookUpload, author, map[string]interface{}{
+		"version":        ver,
+		"commit_message": commitMsg,
+		"snapshot":       true,
+	})
+	if aerr != nil {
+		log.Printf("Error queueing webhooks for '%s%s%s': %v\n", db.Owner, db.Folder, db.DBName, aerr)
+	}
+	return ver, nil, nil
+}
+
+// Snapshots the live databases which have changed every LiveSnapshotInterval() seconds, until the program exits.
+func LiveSnapshotLoop() {
+	for {
+		time.Sleep(time.Duration(LiveSnapshotInterval()) * time.Second)
+		list, err := ChangedLiveDBs()
+		if err != nil {
+			continue
+		}
+		for _, db := range list {
+			_, _, err = SnapshotLiveDB(context.Background(), db, "", "")
+			if err != nil {
+				log.Printf("Snapshot of live database '%s%s%s' failed: %v\n", db.Owner, db.Folder, db.DBName, err)
+			}
+		}
+	}
+}
+
+// Turns a live database back into a normal one, after storing any changes which haven't been snapshotted yet.  If
+// the final snapshot fails, the database stays live.
+func StopDBLive(ctx context.Context, dbOwner string, dbFolder string, dbName string) error {
+	db, live, err := DBLive(dbOwner, dbFolder, dbName)
+	if err != nil || !live {
+		return err
+	}
+
+	// Statements waiting for the lock see the database isn't live any more, so nothing changes after this
+	lock := liveLock(db.ID)
+	lock.Lock()
+	err = SetDBLive(dbOwner, dbFolder, dbName, false)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	_, _, err = SnapshotLiveDB(ctx, db, "", "")
+	if err != nil {
+		SetDBLive(dbOwner, dbFolder, dbName, true)
+		return err
+	}
+	return os.Remove(liveDBPath(db.ID))
+}
@@ -0,0 +1,217 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Users log in through an external OAuth provider, with their DBHub.io account linked to the identity it returns.
+// Auth0 is one such provider, and GitHub, GitLab, and Google can also be used directly without going through Auth0.
+
+// Returns the display name of a login provider.
+func LoginProviderName(provider string) string {
+	switch provider {
+	case LoginAuth0:
+		return "Auth0"
+	case LoginGitHub:
+		return "GitHub"
+	case LoginGitLab:
+		return "GitLab"
+	case LoginGoogle:
+		return "Google"
+	}
+	return provider
+}
+
+// Returns the login providers turned on for this server, in the order they're shown to users.
+func LoginProviders() (list []string) {
+	if conf.Auth0.ClientID != "" {
+		list = append(list, LoginAuth0)
+	}
+	if conf.Login.GitHubClientID != "" {
+		list = append(list, LoginGitHub)
+	}
+	if conf.Login.GitLabClientID != "" {
+		list = append(list, LoginGitLab)
+	}
+	if conf.Login.GoogleClientID != "" {
+		list = append(list, LoginGoogle)
+	}
+	return
+}
+
+// Returns the address users are sent to, to log in with one of the (non Auth0) providers.  Auth0 logins go through
+// its Lock widget instead.
+func LoginURL(provider string, state string) (string, error) {
+	c, err := loginConfig(provider)
+	if err != nil {
+		return "", err
+	}
+	return c.AuthCodeURL(state), nil
+}
+
+// Completes a login, exchanging the code the provider sent back for the details of the user's account with it.
+func LoginUser(ctx context.Context, provider string, code string) (ident LoginIdentity, err error) {
+	c, err := loginConfig(provider)
+	if err != nil {
+		return
+	}
+	token, err := c.Exchange(ctx, code)
+	if err != nil {
+		log.Printf("Login failure with %s: %v\n", provider, err)
+		return
+	}
+	client := c.Client(ctx, token)
+	ident.Provider = provider
+	ident.EmailVerified = true
+	switch provider {
+	case LoginAuth0:
+		var profile struct {
+			Email         string `json:"email"`
+			EmailVerified *bool  `json:"email_verified"`
+			Nickname      string `json:"nickname"`
+			UserID        string `json:"user_id"`
+		}
+		err = loginProfile(client, "https://"+conf.Auth0.Domain+"/userinfo", &profile)
+		if err != nil {
+			return
+		}
+		ident.ProviderID, ident.Email, ident.Nickname = profile.UserID, profile.Email, profile.Nickname
+		if profile.EmailVerified != nil {
+			ident.EmailVerified = *profile.EmailVerified
+		}
+	case LoginGitHub:
+		var profile struct {
+			ID    int64  `json:"id"`
+			Login string `json:"login"`
+		}
+		err = loginProfile(client, "https://api.github.com/user", &profile)
+		if err != nil {
+			return
+		}
+		ident.ProviderID, ident.Nickname = strconv.FormatInt(profile.ID, 10), profile.Login
+
+		// The profile only has the user's public email address (if any), so their primary one is looked up instead.
+		// Only verified addresses are used
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		err = loginProfile(client, "https://api.github.com/user/emails", &emails)
+		if err != nil {
+			return
+		}
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				ident.Email = e.Email
+			}
+		}
+	case LoginGitLab:
+		var profile struct {
+			Email    string `json:"email"`
+			ID       int64  `json:"id"`
+			Username string `json:"username"`
+		}
+		err = loginProfile(client, gitLabURL()+"/api/v4/user", &profile)
+		if err != nil {
+			return
+		}
+		ident.ProviderID, ident.Email, ident.Nickname = strconv.FormatInt(profile.ID, 10), profile.Email,
+			profile.Username
+	case LoginGoogle:
+		var profile struct {
+			Email         string `json:"email"`
+			EmailVerified bool   `json:"email_verified"`
+			Sub           string `json:"sub"`
+		}
+		err = loginProfile(client, "https://openidconnect.googleapis.com/v1/userinfo", &profile)
+		if err != nil {
+			return
+		}
+		ident.ProviderID, ident.Email, ident.EmailVerified = profile.Sub, profile.Email, profile.EmailVerified
+		ident.Nickname = strings.SplitN(profile.Email, "@", 2)[0]
+	}
+	if ident.ProviderID == "" || ident.ProviderID == "0" {
+		log.Printf("Login error: %s returned no user ID. Email: %s\n", provider, ident.Email)
+		err = fmt.Errorf("%s didn't return a user ID", LoginProviderName(provider))
+	}
+	return
+}
+
+// Returns the base address of the GitLab server users log in through.
+func gitLabURL() string {
+	if conf.Login.GitLabURL == "" {
+		return "https://gitlab.com"
+	}
+	return strings.TrimSuffix(conf.Login.GitLabURL, "/")
+}
+
+// Returns the OAuth settings for logging in with a provider, or an error if it isn't turned on.
+func loginConfig(provider string) (*oauth2.Config, error) {
+	c := &oauth2.Config{RedirectURL: "https://" + conf.Web.ServerName + "/x/callback/" + provider}
+	switch provider {
+	case LoginAuth0:
+		// Auth0 applications are already set up to send users back to /x/callback, so that's kept as is
+		c.ClientID, c.ClientSecret = conf.Auth0.ClientID, conf.Auth0.ClientSecret
+		c.RedirectURL = "https://" + conf.Web.ServerName + "/x/callback"
+		c.Scopes = []string{"openid", "profile"}
+		c.Endpoint = oauth2.Endpoint{
+			AuthURL:  "https://" + conf.Auth0.Domain + "/authorize",
+			TokenURL: "https://" + conf.Auth0.Domain + "/oauth/token",
+		}
+	case LoginGitHub:
+		c.ClientID, c.ClientSecret = conf.Login.GitHubClientID, conf.Login.GitHubClientSecret
+		c.Scopes = []string{"read:user", "user:email"}
+		c.Endpoint = oauth2.Endpoint{
+			AuthURL:  "https://github.com/login/oauth/authorize",
+			TokenURL: "https://github.com/login/oauth/access_token",
+		}
+	case LoginGitLab:
+		c.ClientID, c.ClientSecret = conf.Login.GitLabClientID, conf.Login.GitLabClientSecret
+		c.Scopes = []string{"read_user"}
+		c.Endpoint = oauth2.Endpoint{
+			AuthURL:  gitLabURL() + "/oauth/authorize",
+			TokenURL: gitLabURL() + "/oauth/token",
+		}
+	case LoginGoogle:
+		c.ClientID, c.ClientSecret = conf.Login.GoogleClientID, conf.Login.GoogleClientSecret
+		c.Scopes = []string{"openid", "email"}
+		c.Endpoint = oauth2.Endpoint{
+			AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL: "https://oauth2.googleapis.com/token",
+		}
+	}
+	if c.ClientID == "" {
+		return nil, errors.New("Unknown login provider")
+	}
+	return c, nil
+}
+
+// Retrieves a JSON document from a login provider's API, using the user's access token.
+func loginProfile(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Printf("Error retrieving login profile from '%s': %v\n", url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error retrieving login profile from '%s': status %d\n", url, resp.StatusCode)
+		return fmt.Errorf("Retrieving the login profile failed")
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+	if err != nil {
+		log.Printf("Error decoding login profile from '%s': %v\n", url, err)
+	}
+	return err
+}
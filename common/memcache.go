@@ -2,6 +2,7 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/gob"
 	"encoding/hex"
@@ -9,33 +10,40 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
 	// Connection handles
 	memCache *memcache.Client
+
+	// IDs of the upload jobs this server is part way through.  A heartbeat is kept in Memcached for each of them, so
+	// if the server stops the jobs can be marked as failed instead of being left queued forever
+	activeUploadJobs      = make(map[string]bool)
+	activeUploadJobsMu    sync.Mutex
+	uploadHeartbeatsStart sync.Once
 )
 
-// Caches data in Memcached
-func CacheData(cacheKey string, cacheData interface{}, cacheSeconds int32) error {
-	// Encode the data
-	var encodedData bytes.Buffer
-	enc := gob.NewEncoder(&encodedData)
-	err := enc.Encode(cacheData)
-	if err != nil {
-		return err
-	}
+// Retrieves the details of a prepared archive of a user's databases from Memcached
+func ArchiveJobDetails(jobID string) (job ArchiveJob, ok bool, err error) {
+	ok, err = fetchFromCache(archiveJobCacheKey(jobID), &job)
+	return job, ok, err
+}
 
-	// Send the data to memcached
-	cachedData := memcache.Item{Key: cacheKey, Value: encodedData.Bytes(), Expiration: cacheSeconds}
-	err = memCache.Set(&cachedData)
-	if err != nil {
-		return err
-	}
+func archiveJobCacheKey(jobID string) string {
+	tempArr := md5.Sum([]byte("archivejob/" + jobID))
+	return hex.EncodeToString(tempArr[:])
+}
 
-	return nil
+// Caches data in Memcached
+func CacheData(ctx context.Context, cacheKey string, cacheData interface{}, cacheSeconds int32) error {
+	_, span := StartSpan(ctx, "memcached.set")
+	defer span.End()
+	return storeInCache(cacheKey, cacheData, cacheSeconds)
 }
 
 func ConnectCache() error {
@@ -55,8 +63,8 @@ func ConnectCache() error {
 	return nil
 }
 
-// Retrieves cached data from Memcached
-func GetCachedData(cacheKey string, cacheData interface{}) (bool, error) {
+// Retrieves cached data from Memcached, without tracing
+func fetchFromCache(cacheKey string, cacheData interface{}) (bool, error) {
 	cacheItem, err := memCache.Get(cacheKey)
 	if err != nil {
 		if err == memcache.ErrCacheMiss {
@@ -78,86 +86,190 @@ func GetCachedData(cacheKey string, cacheData interface{}) (bool, error) {
 	return false, nil
 }
 
-// Invalidate memcache data for a database version or versions
-func InvalidateCacheEntry(loggedInUser string, dbOwner string, dbFolder string, dbName string, dbVersion int) error {
+// Retrieves cached data from Memcached
+func GetCachedData(ctx context.Context, cacheKey string, cacheData interface{}) (bool, error) {
+	_, span := StartSpan(ctx, "memcached.get")
+	defer span.End()
+	ok, err := fetchFromCache(cacheKey, cacheData)
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+	return ok, err
+}
 
-	// If dbVersion is 0, that means "for all versions".  Otherwise, just invalidate the data for the requested one
-	var versionList []int
-	if dbVersion == 0 {
-		// Get the list of all versions for the given database
-		var err error
-		versionList, err = DBVersions(loggedInUser, dbOwner, dbFolder, dbName)
-		versionList = append(versionList, 0) // Need to clear "0" version entries too
-		if err != nil {
-			return err
-		}
+// Generate a predictable cache key for metadata information.  The key includes the generation number of the
+// database, so it's invalidated along with everything else for the database by InvalidateDBCache()
+func MetadataCacheKey(prefix string, loggedInUser string, dbOwner string, dbFolder string, dbName string, dbVersion int) string {
+	gen := dbGeneration(dbOwner, dbFolder, dbName)
+	var cacheString string
+	if loggedInUser == dbOwner {
+		cacheString = fmt.Sprintf("%s/%d/%s/%s/%s/%d", prefix, gen, dbOwner, dbFolder, dbName, dbVersion)
 	} else {
-		// Only one version needs invalidation
-		versionList = append(versionList, dbVersion)
+		// Requests for other users databases are cached separately from users own database requests
+		cacheString = fmt.Sprintf("%s/%d/pub/%s/%s/%s/%d", prefix, gen, dbOwner, dbFolder, dbName, dbVersion)
 	}
 
-	// Loop around, invalidating the now outdated entries
-	for _, ver := range versionList {
-		// Invalidate the meta info
-		cacheKey := MetadataCacheKey("meta", loggedInUser, dbOwner, dbFolder, dbName, ver)
-		err := memCache.Delete(cacheKey)
-		if err != nil {
-			if err != memcache.ErrCacheMiss {
-				// Cache miss is not an error we care about
-				return err
-			}
-		}
+	tempArr := md5.Sum([]byte(cacheString))
+	return hex.EncodeToString(tempArr[:])
+}
 
-		// Invalidate the download page data, for private database versions
-		cacheKey = MetadataCacheKey("dwndb-meta", dbOwner, dbOwner, dbFolder, dbName, ver)
-		err = memCache.Delete(cacheKey)
-		if err != nil {
-			if err != memcache.ErrCacheMiss {
-				// Cache miss is not an error we care about
-				return err
-			}
-		}
+// Generate a predictable cache key for the results of a query.  As database versions are immutable, the key is
+// based on the SHA256 of the version rather than its owner and name
+func QueryCacheKey(sha string, query string, maxRows int) string {
+	cacheString := fmt.Sprintf("query/%s/%d/%s", sha, maxRows, NormaliseQuery(query))
+	tempArr := md5.Sum([]byte(cacheString))
+	return hex.EncodeToString(tempArr[:])
+}
 
-		// Invalidate the download page data for public database versions
-		cacheKey = MetadataCacheKey("dwndb-meta", "", dbOwner, dbFolder, dbName, ver)
-		err = memCache.Delete(cacheKey)
-		if err != nil {
-			if err != memcache.ErrCacheMiss {
-				// Cache miss is not an error we care about
-				return err
-			}
-		}
+// Stores the details of a prepared archive in Memcached, so it can be downloaded from any server until it expires
+func SetArchiveJob(job ArchiveJob) error {
+	return storeInCache(archiveJobCacheKey(job.ID), job, BulkArchiveLifetime)
+}
+
+// Stores the status of an upload job in Memcached, so it can be polled from any server
+func SetUploadJobStatus(job UploadJob) error {
+	err := storeInCache(uploadJobCacheKey(job.ID), job, UploadStatusCacheTime)
+	if err != nil {
+		return err
 	}
+	return trackUploadJob(job)
+}
 
-	return nil
+// Stores the progress of a web form upload in Memcached, so it can be polled from any server
+func SetUploadProgress(token string, progress UploadProgress) error {
+	return storeInCache(uploadProgressCacheKey(token), progress, UploadStatusCacheTime)
 }
 
-// Generate a predictable cache key for metadata information
-func MetadataCacheKey(prefix string, loggedInUser string, dbOwner string, dbFolder string, dbName string, dbVersion int) string {
-	var cacheString string
-	if loggedInUser == dbOwner {
-		cacheString = fmt.Sprintf("%s/%s/%s/%s/%d", prefix, dbOwner, dbFolder, dbName, dbVersion)
-	} else {
-		// Requests for other users databases are cached separately from users own database requests
-		cacheString = fmt.Sprintf("%s/pub/%s/%s/%s/%d", prefix, dbOwner, dbFolder, dbName, dbVersion)
+// Caches data in Memcached, without tracing.  Used for things not associated with any particular request
+func storeInCache(cacheKey string, cacheData interface{}, cacheSeconds int32) error {
+	// Encode the data
+	var encodedData bytes.Buffer
+	enc := gob.NewEncoder(&encodedData)
+	err := enc.Encode(cacheData)
+	if err != nil {
+		return err
 	}
 
-	tempArr := md5.Sum([]byte(cacheString))
-	return hex.EncodeToString(tempArr[:])
+	// Send the data to memcached
+	cachedData := memcache.Item{Key: cacheKey, Value: encodedData.Bytes(), Expiration: cacheSeconds}
+	err = memCache.Set(&cachedData)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-// Generate a predictable cache key for SQLite row data
+// Generate a predictable cache key for SQLite row data.  Like metadata keys, this includes the generation number of
+// the database
 func TableRowsCacheKey(prefix string, loggedInUser string, dbOwner string, dbFolder string, dbName string, dbVersion int, dbTable string, rows int) string {
+	gen := dbGeneration(dbOwner, dbFolder, dbName)
 	var cacheString string
 	if loggedInUser == dbOwner {
-		cacheString = fmt.Sprintf("%s/%s/%s/%s/%d/%s/%d", prefix, dbOwner, dbFolder, dbName, dbVersion,
-			dbTable, rows)
+		cacheString = fmt.Sprintf("%s/%d/%s/%s/%s/%d/%s/%d", prefix, gen, dbOwner, dbFolder, dbName,
+			dbVersion, dbTable, rows)
 	} else {
 		// Requests for other users databases are cached separately from users own database requests
-		cacheString = fmt.Sprintf("%s/pub/%s/%s/%s/%d/%s/%d", prefix, dbOwner, dbFolder, dbName,
+		cacheString = fmt.Sprintf("%s/%d/pub/%s/%s/%s/%d/%s/%d", prefix, gen, dbOwner, dbFolder, dbName,
 			dbVersion, dbTable, rows)
 	}
 
 	tempArr := md5.Sum([]byte(cacheString))
 	return hex.EncodeToString(tempArr[:])
 }
+
+// Keeps track of the upload jobs this server is part way through, starting and stopping their heartbeats.
+func trackUploadJob(job UploadJob) error {
+	uploadHeartbeatsStart.Do(func() {
+		go uploadHeartbeatLoop()
+	})
+	activeUploadJobsMu.Lock()
+	defer activeUploadJobsMu.Unlock()
+	if uploadJobFinished(job.Status) {
+		if !activeUploadJobs[job.ID] {
+			return nil
+		}
+		delete(activeUploadJobs, job.ID)
+		err := memCache.Delete(uploadHeartbeatCacheKey(job.ID))
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	}
+	if activeUploadJobs[job.ID] {
+		return nil
+	}
+	activeUploadJobs[job.ID] = true
+	return storeInCache(uploadHeartbeatCacheKey(job.ID), time.Now().Unix(), UploadHeartbeatTimeout)
+}
+
+// Refreshes the heartbeats of the upload jobs this server is part way through every UploadHeartbeatInterval seconds,
+// until the program exits.
+func uploadHeartbeatLoop() {
+	for {
+		time.Sleep(UploadHeartbeatInterval * time.Second)
+		activeUploadJobsMu.Lock()
+		for id := range activeUploadJobs {
+			err := storeInCache(uploadHeartbeatCacheKey(id), time.Now().Unix(), UploadHeartbeatTimeout)
+			if err != nil {
+				log.Printf("Error refreshing heartbeat of upload job '%s': %v\n", id, err)
+			}
+		}
+		activeUploadJobsMu.Unlock()
+	}
+}
+
+// Generate a predictable cache key for the heartbeat of an upload job
+func uploadHeartbeatCacheKey(jobID string) string {
+	tempArr := md5.Sum([]byte("uploadheartbeat/" + jobID))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Generate a predictable cache key for upload job status
+func uploadJobCacheKey(jobID string) string {
+	tempArr := md5.Sum([]byte("uploadjob/" + jobID))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Returns true if an upload job with the given status has finished, whether or not it worked
+func uploadJobFinished(status string) bool {
+	return status == UploadComplete || status == UploadFailed || status == UploadUnchanged
+}
+
+// Retrieves the status of an upload job from Memcached.  When the heartbeat of an unfinished job is missing, the
+// server processing it may have stopped (eg by being restarted), or Memcached may just have evicted the heartbeat.
+// Its status is reported as unknown until it's past UploadJobDeadline, after which it's marked as failed.
+func UploadJobStatus(jobID string) (job UploadJob, ok bool, err error) {
+	ok, err = fetchFromCache(uploadJobCacheKey(jobID), &job)
+	if err != nil || !ok || uploadJobFinished(job.Status) {
+		return job, ok, err
+	}
+	var lastBeat int64
+	alive, err := fetchFromCache(uploadHeartbeatCacheKey(jobID), &lastBeat)
+	if err != nil || alive {
+		return job, ok, err
+	}
+	if time.Since(job.Started) < UploadJobDeadline*time.Second {
+		job.Status = UploadUnknown
+		return job, ok, nil
+	}
+	job.Error = "The server processing the upload stopped before it finished"
+	job.Status = UploadFailed
+	err = storeInCache(uploadJobCacheKey(job.ID), job, UploadStatusCacheTime)
+	if err != nil {
+		return job, ok, err
+	}
+	log.Printf("Upload job '%s' for '%s%s%s' was interrupted, so has been marked as failed\n", job.ID, job.Owner,
+		job.Folder, job.DBName)
+	return job, ok, nil
+}
+
+// Generate a predictable cache key for the progress of a web form upload
+func uploadProgressCacheKey(token string) string {
+	tempArr := md5.Sum([]byte("uploadprogress/" + token))
+	return hex.EncodeToString(tempArr[:])
+}
+
+// Retrieves the progress of a web form upload from Memcached
+func UploadProgressStatus(token string) (progress UploadProgress, ok bool, err error) {
+	ok, err = fetchFromCache(uploadProgressCacheKey(token), &progress)
+	return progress, ok, err
+}
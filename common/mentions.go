@@ -0,0 +1,115 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Users are mentioned in READMEs by putting an @ in front of their name.  Mentions of existing users are linked to
+// their user page when the markdown is rendered, and newly mentioned users are sent a notification (unless they've
+// opted out) when the README of a public database is saved.
+
+var (
+	// The character before the @ is captured, so email addresses and the like aren't treated as mentions
+	regexMention = regexp.MustCompile(`(^|[^a-zA-Z0-9_.@/\-])@([a-zA-Z0-9_.\-]+)`)
+
+	// Used for splitting rendered HTML into tags and text
+	regexHTMLTag = regexp.MustCompile(`<[^>]*>`)
+)
+
+// Links the @mentions of existing users in rendered markdown to their user pages.  Mentions inside links and code
+// are left alone.
+func LinkMentions(renderedHTML string) string {
+	names := Mentions(renderedHTML)
+	if len(names) == 0 {
+		return renderedHTML
+	}
+	users, err := ExistingUsers(names)
+	if err != nil || len(users) == 0 {
+		return renderedHTML
+	}
+
+	// Only change the text between tags, and not when it's inside an <a>, <code> or <pre> element
+	var out strings.Builder
+	pos, skip := 0, 0
+	for _, loc := range regexHTMLTag.FindAllStringIndex(renderedHTML, -1) {
+		text := renderedHTML[pos:loc[0]]
+		if skip == 0 {
+			text = linkMentionText(text, users)
+		}
+		out.WriteString(text)
+		tag := renderedHTML[loc[0]:loc[1]]
+		out.WriteString(tag)
+		pos = loc[1]
+
+		name := strings.ToLower(strings.Trim(tag, "</>"))
+		if i := strings.IndexAny(name, " \t\n"); i != -1 {
+			name = name[:i]
+		}
+		if name != "a" && name != "code" && name != "pre" {
+			continue
+		}
+		if strings.HasPrefix(tag, "</") {
+			if skip > 0 {
+				skip--
+			}
+		} else if !strings.HasSuffix(tag, "/>") {
+			skip++
+		}
+	}
+	text := renderedHTML[pos:]
+	if skip == 0 {
+		text = linkMentionText(text, users)
+	}
+	out.WriteString(text)
+	return out.String()
+}
+
+// Replaces the @mentions of the given users in a piece of text with links to their user pages.
+func linkMentionText(text string, users map[string]bool) string {
+	return regexMention.ReplaceAllStringFunc(text, func(m string) string {
+		parts := regexMention.FindStringSubmatch(m)
+		name := strings.TrimRight(parts[2], ".")
+		if !users[strings.ToLower(name)] {
+			return m
+		}
+		return fmt.Sprintf(`%s<a href="/%s">@%s</a>%s`, parts[1], strings.ToLower(name), name,
+			parts[2][len(name):])
+	})
+}
+
+// Returns the (lower case) names of the users @mentioned in a piece of text, without duplicates.  The names aren't
+// checked to see if the users exist.
+func Mentions(text string) (names []string) {
+	seen := make(map[string]bool)
+	for _, m := range regexMention.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(strings.TrimRight(m[2], "."))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return
+}
+
+// Sends a notification to each user @mentioned in the new README of a database who wasn't mentioned in the old one.
+// The author doesn't get notified of their own mentions.
+func NotifyMentions(author string, dbOwner string, dbFolder string, dbName string, oldReadme string, newReadme string) error {
+	oldNames := make(map[string]bool)
+	for _, n := range Mentions(oldReadme) {
+		oldNames[n] = true
+	}
+	var names []string
+	for _, n := range Mentions(newReadme) {
+		if !oldNames[n] && n != strings.ToLower(author) {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s mentioned you in the README of %s%s%s", author, dbOwner, dbFolder, dbName)
+	return Notify(names, NotifyMention, msg, fmt.Sprintf("/%s%s%s", dbOwner, dbFolder, dbName))
+}
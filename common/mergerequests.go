@@ -0,0 +1,67 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Merge requests let the changes made on a branch of a database be reviewed before they're added to another branch,
+// usually the main one.  Protected branches can only be changed this way.  As each database version is a complete
+// copy of the database, merging adds the latest version on the source branch as a new version on the target branch.
+
+// Returns the reasons a merge request can't be merged yet, or nothing if it can be.  The commit ID is the one which
+// would be merged, at the head of the source branch.
+func MergeBlockers(dbOwner string, dbFolder string, dbName string, mr MergeRequest, commitID string) (
+	reasons []string, err error) {
+	if mr.State != MergeRequestOpen {
+		return []string{"It isn't open"}, nil
+	}
+
+	// The approvals need to meet the review policy of the database
+	approvals, err := MergeRequestApprovals(mr.ID)
+	if err != nil {
+		return nil, err
+	}
+	var approvers []string
+	for _, a := range approvals {
+		approvers = append(approvers, a.UserName)
+	}
+	reasons, err = CheckReviewPolicy(dbOwner, dbFolder, dbName, mr.CreatedBy, approvers)
+	if err != nil {
+		return nil, err
+	}
+
+	// So do the status checks posted for the commit being merged
+	waiting, err := CheckRequiredStatuses(dbOwner, dbFolder, dbName, commitID)
+	if err != nil {
+		return nil, err
+	}
+	return append(reasons, waiting...), nil
+}
+
+// Tells the people taking part in a merge request about something happening to it.  That's the database owner, the
+// user who opened the merge request, and everyone who has approved it, apart from the user who did the thing.
+func NotifyMergeRequestUsers(dbOwner string, dbFolder string, dbName string, mr MergeRequest, actedBy string,
+	message string) error {
+	approvals, err := MergeRequestApprovals(mr.ID)
+	if err != nil {
+		return err
+	}
+	candidates := []string{dbOwner, mr.CreatedBy}
+	for _, a := range approvals {
+		candidates = append(candidates, a.UserName)
+	}
+	seen := map[string]bool{actedBy: true}
+	var names []string
+	for _, c := range candidates {
+		if !seen[c] {
+			seen[c] = true
+			names = append(names, c)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	link := fmt.Sprintf("/mergerequests/%s/%s?id=%d&folder=%s", dbOwner, dbName, mr.ID, url.QueryEscape(dbFolder))
+	return Notify(names, NotifyMergeRequest, message, link)
+}
@@ -1,22 +1,104 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	sqlite "github.com/gwenn/gosqlite"
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
 	// Minio connection handle
 	minioClient *minio.Client
+
+	// Stored objects starting with this are zstd compressed
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
 )
 
+// Reads a database object from Minio, decompressing it if needed
+type minioDBReader struct {
+	dec *zstd.Decoder
+	obj *minio.Object
+	r   io.Reader
+}
+
+func (m *minioDBReader) Close() error {
+	if m.dec != nil {
+		m.dec.Close()
+	}
+	return m.obj.Close()
+}
+
+func (m *minioDBReader) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+// Cross checks the database versions recorded in PostgreSQL against the objects stored in Minio, returning any
+// mismatches.  When repair is true, size mismatches for objects whose SHA256 is still correct have the recorded
+// size updated.  Missing objects and SHA256 mismatches can't be repaired automatically, so are only reported.
+func CheckStorageConsistency(repair bool) (problems []ConsistencyProblem, err error) {
+	versions, err := AllDBVersions()
+	if err != nil {
+		return nil, err
+	}
+	for _, ver := range versions {
+		// Make sure the object exists
+		_, err := minioClient.StatObject(ver.MinioBkt, ver.MinioID)
+		if err != nil {
+			problems = append(problems, ConsistencyProblem{DB: ver, Problem: "Object missing from Minio"})
+			continue
+		}
+		obj, err := MinioHandle(context.Background(), ver.MinioBkt, ver.MinioID)
+		if err != nil {
+			problems = append(problems, ConsistencyProblem{DB: ver, Problem: "Couldn't retrieve object"})
+			continue
+		}
+
+		// Generate the SHA256 of the stored database.  For compressed objects this is after decompression, which
+		// also gives the original size
+		h := sha256.New()
+		dbSize, err := io.Copy(h, obj)
+		MinioHandleClose(obj)
+		if err != nil {
+			problems = append(problems, ConsistencyProblem{DB: ver, Problem: "Couldn't read object"})
+			continue
+		}
+		shaSum := hex.EncodeToString(h.Sum(nil))
+		if shaSum != ver.SHA256 {
+			problems = append(problems, ConsistencyProblem{DB: ver,
+				Problem: fmt.Sprintf("SHA256 mismatch. Stored object is %s", shaSum)})
+			continue
+		}
+
+		// Check the size
+		if dbSize != ver.Size {
+			p := ConsistencyProblem{DB: ver,
+				Problem: fmt.Sprintf("Size mismatch. Stored database is %d bytes", dbSize)}
+			if repair {
+				err = SetDBVersionSize(ver.ID, dbSize)
+				if err == nil {
+					p.Repaired = true
+				}
+			}
+			problems = append(problems, p)
+		}
+	}
+	return problems, nil
+}
+
 // Parse the Minio configuration, to ensure it seems workable.
 // Note - this doesn't actually open a connection to the Minio server.
 func ConnectMinio() (err error) {
@@ -53,19 +135,41 @@ func MinioBucketExists(bucket string) (bool, error) {
 	return found, nil
 }
 
-// Get a handle from Minio for a SQLite database object.
-func MinioHandle(bucket string, id string) (*minio.Object, error) {
+// Get a handle from Minio for a SQLite database object.  Objects stored with zstd compression are decompressed as
+// they're read, so the handle always returns the original database file.
+func MinioHandle(ctx context.Context, bucket string, id string) (io.ReadCloser, error) {
+	_, span := StartSpan(ctx, "minio.get", attribute.String("minio.bucket", bucket),
+		attribute.String("minio.object", id))
+	defer span.End()
+
 	userDB, err := minioClient.GetObject(bucket, id)
 	if err != nil {
 		log.Printf("Error retrieving DB from Minio: %v\n", err)
 		return nil, errors.New("Error retrieving database from internal storage")
 	}
 
-	return userDB, nil
+	// Objects stored before compression was added are plain SQLite files, so check which this is
+	buf := bufio.NewReader(userDB)
+	magic, err := buf.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		userDB.Close()
+		log.Printf("Error reading DB from Minio: %v\n", err)
+		return nil, errors.New("Error retrieving database from internal storage")
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return &minioDBReader{obj: userDB, r: buf}, nil
+	}
+	dec, err := zstd.NewReader(buf)
+	if err != nil {
+		userDB.Close()
+		log.Printf("Error decompressing DB from Minio: %v\n", err)
+		return nil, errors.New("Error retrieving database from internal storage")
+	}
+	return &minioDBReader{dec: dec, obj: userDB, r: dec}, nil
 }
 
 // Close a Minio object handle.  Probably most useful for calling with defer().
-func MinioHandleClose(userDB *minio.Object) (err error) {
+func MinioHandleClose(userDB io.ReadCloser) (err error) {
 	err = userDB.Close()
 	if err != nil {
 		log.Printf("Error closing object handle: %v\n", err)
@@ -87,10 +191,25 @@ func MinioObjCopy(sourceBucket string, sourceID string, destBucket string) (stri
 	return destID, nil
 }
 
-// Retrieves a SQLite database from Minio, opens it, returns the connection handle.
-func OpenMinioObject(bucket string, id string) (*sqlite.Conn, error) {
+// Retrieves a SQLite database from Minio, opens it, returns the connection handle.  The database file is kept in a
+// local cache, so later requests for the same database version don't need to retrieve it again.  The handle needs to
+// be returned with ReleaseSQLiteHandle() rather than closed.
+func OpenMinioObject(ctx context.Context, bucket string, id string) (*sqlite.Conn, error) {
+	// Use the locally cached copy of the database, if there is one
+	sha, err := MinioObjectSHA(bucket, id)
+	if err != nil {
+		return nil, errors.New("Internal server error")
+	}
+	sdb, ok, err := pooledDBFileConn(sha)
+	if err != nil {
+		return nil, errors.New("Internal server error")
+	}
+	if ok {
+		return sdb, nil
+	}
+
 	// Get a handle from Minio for the database object
-	userDB, err := MinioHandle(bucket, id)
+	userDB, err := MinioHandle(ctx, bucket, id)
 	if err != nil {
 		return nil, err
 	}
@@ -100,35 +219,72 @@ func OpenMinioObject(bucket string, id string) (*sqlite.Conn, error) {
 		MinioHandleClose(userDB)
 	}()
 
-	// Save the database locally to a temporary file
-	tempfileHandle, err := ioutil.TempFile("", "databaseViewHandler-")
+	// Save the database to the local cache directory
+	fileHandle, err := ioutil.TempFile(dbFileDir(), "dbfile-")
 	if err != nil {
 		log.Printf("Error creating tempfile: %v\n", err)
 		return nil, errors.New("Internal server error")
 	}
-	tempfile := tempfileHandle.Name()
-	bytesWritten, err := io.Copy(tempfileHandle, userDB)
+	localFile := fileHandle.Name()
+	bytesWritten, err := io.Copy(fileHandle, userDB)
+	fileHandle.Close()
 	if err != nil {
 		log.Printf("Error writing database to temporary file: %v\n", err)
+		os.Remove(localFile)
 		return nil, errors.New("Internal server error")
 	}
 	if bytesWritten == 0 {
 		log.Printf("0 bytes written to the SQLite temporary file. Minio object: %s/%s\n", bucket, id)
+		os.Remove(localFile)
 		return nil, errors.New("Internal server error")
 	}
-	tempfileHandle.Close()
-	defer os.Remove(tempfile) // Delete the temporary file when this function finishes
 
-	// Open database
-	sdb, err := sqlite.Open(tempfile, sqlite.OpenReadOnly)
+	// Add it to the cache and open it
+	sdb, err = addDBFile(sha, localFile, bytesWritten)
 	if err != nil {
-		log.Printf("Couldn't open database: %s", err)
 		return nil, errors.New("Internal server error")
 	}
-
 	return sdb, nil
 }
 
+// Returns the Minio objects in user buckets which have no corresponding database version in PostgreSQL.  Objects
+// newer than the safety window are skipped, as they may belong to an upload which is still being processed.
+func OrphanedMinioObjects(safetyWindow time.Duration) (orphans []MinioObject, err error) {
+	buckets, err := MinioUserBuckets()
+	if err != nil {
+		return nil, err
+	}
+	cutOff := time.Now().Add(-safetyWindow)
+	for _, bkt := range buckets {
+		// Retrieve the objects PostgreSQL knows about for this bucket
+		known, err := MinioBucketObjectIDs(bkt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Compare them against the objects actually in the bucket
+		doneCh := make(chan struct{})
+		for object := range minioClient.ListObjects(bkt, "", true, doneCh) {
+			if object.Err != nil {
+				log.Printf("Error when listing objects in bucket '%s': %v\n", bkt, object.Err)
+				close(doneCh)
+				return nil, object.Err
+			}
+			if known[object.Key] || object.LastModified.After(cutOff) {
+				continue
+			}
+			orphans = append(orphans, MinioObject{
+				Bucket:       bkt,
+				ID:           object.Key,
+				LastModified: object.LastModified,
+				Size:         object.Size,
+			})
+		}
+		close(doneCh)
+	}
+	return orphans, nil
+}
+
 // Removes a Minio bucket, and all files inside it.
 func RemoveMinioBucket(bucket string) error {
 	// Remove the users files
@@ -169,13 +325,53 @@ func RemoveMinioFile(bucket string, id string) error {
 	return nil
 }
 
-// Store a file in Minio.
-func StoreMinioObject(bucket string, id string, reader io.Reader, contentType string) (int, error) {
-	dbSize, err := minioClient.PutObject(bucket, id, reader, contentType)
+// Removes orphaned Minio objects older than the safety window, returning the list of objects removed.
+func RemoveOrphanedMinioObjects(safetyWindow time.Duration) ([]MinioObject, error) {
+	orphans, err := OrphanedMinioObjects(safetyWindow)
+	if err != nil {
+		return nil, err
+	}
+	var removed []MinioObject
+	for _, obj := range orphans {
+		err = RemoveMinioFile(obj.Bucket, obj.ID)
+		if err != nil {
+			return removed, err
+		}
+		log.Printf("Removed orphaned Minio object '%s/%s', bytes: %v\n", obj.Bucket, obj.ID, obj.Size)
+		removed = append(removed, obj)
+	}
+	return removed, nil
+}
+
+// Store a file in Minio, compressing it with zstd on the way.  Returns the compressed size of the stored object.
+func StoreMinioObject(ctx context.Context, bucket string, id string, reader io.Reader) (int, error) {
+	_, span := StartSpan(ctx, "minio.put", attribute.String("minio.bucket", bucket),
+		attribute.String("minio.object", id))
+	defer span.End()
+
+	// Compress the data as it's sent to Minio
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := zstd.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(enc, reader)
+		if err != nil {
+			enc.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(enc.Close())
+	}()
+
+	storedSize, err := minioClient.PutObject(bucket, id, pr, "application/zstd")
+	pr.CloseWithError(err) // Stops the compression if the upload failed part way through
 	if err != nil {
 		log.Printf("Storing file in Minio failed: %v\n", err)
 		return -1, err
 	}
 
-	return int(dbSize), nil
+	return int(storedSize), nil
 }
@@ -0,0 +1,228 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// A server can run as a read-only mirror of another DBHub instance.  The public databases of the source instance are
+// copied across on a schedule, using its /x/mirrorlist listing and normal downloads.  Databases removed from the
+// source (or made private) are left in place on the mirror.  Users can also fork single public databases from other
+// instances, which uses the same download code.
+
+// Downloads a version of a public database from another DBHub instance to a temporary file, checking it arrives
+// intact.  The instance is user supplied, so the download only goes to public addresses, doesn't follow redirects,
+// and is limited to RemoteDBMaxSize bytes.  The caller needs to remove the temporary file when it's finished with it.
+func DownloadRemoteDB(ctx context.Context, baseURL string, dbOwner string, dbFolder string, dbName string, ver MirrorDBVersion) (tempDBName string, dbSize int64, shaSum []byte, err error) {
+	return downloadRemoteDB(ctx, publicHTTPClient, RemoteDBMaxSize, baseURL, dbOwner, dbFolder, dbName, ver)
+}
+
+// Downloads a version of a database from another DBHub instance using the given HTTP client, refusing databases
+// larger than maxSize bytes (when it's not 0).  The mirror source is configured by the admin, so mirroring uses the
+// default client, which can reach it on an internal network, and no size limit.
+func downloadRemoteDB(ctx context.Context, client *http.Client, maxSize int64, baseURL string, dbOwner string, dbFolder string, dbName string, ver MirrorDBVersion) (tempDBName string, dbSize int64, shaSum []byte, err error) {
+	dlURL := fmt.Sprintf("%s/x/download/%s/%s?version=%d&folder=%s", baseURL, url.PathEscape(dbOwner),
+		url.PathEscape(dbName), ver.Version, url.QueryEscape(dbFolder))
+	req, err := http.NewRequest("GET", dlURL, nil)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, nil, fmt.Errorf("Unexpected status downloading version %d: %s", ver.Version, resp.Status)
+	}
+	if maxSize == 0 {
+		return saveRemoteDB(resp.Body, ver.SHA256)
+	}
+	if ver.Size > maxSize {
+		return "", 0, nil, fmt.Errorf("The database is larger than %d bytes", maxSize)
+	}
+	tempDBName, dbSize, shaSum, err = saveRemoteDB(io.LimitReader(resp.Body, maxSize+1), ver.SHA256)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if dbSize > maxSize {
+		os.Remove(tempDBName)
+		return "", 0, nil, fmt.Errorf("The database is larger than %d bytes", maxSize)
+	}
+	return tempDBName, dbSize, shaSum, nil
+}
+
+// Copies the public databases from the mirror source every MirrorInterval() seconds, until the program exits.
+func MirrorSyncLoop() {
+	for {
+		err := MirrorSync(context.Background())
+		if err != nil {
+			log.Printf("Mirror sync from '%s' failed: %v\n", MirrorSource(), err)
+		}
+		time.Sleep(time.Duration(MirrorInterval()) * time.Second)
+	}
+}
+
+// Copies any new public databases and versions from the mirror source, and updates the details of the existing ones.
+func MirrorSync(ctx context.Context) error {
+	ctx, span := StartSpan(ctx, "mirror.sync")
+	defer span.End()
+
+	req, err := http.NewRequest("GET", MirrorSource()+"/x/mirrorlist", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status retrieving database list: %s", resp.Status)
+	}
+	var list []MirrorDB
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	var added int
+	for _, db := range list {
+		err = ValidateUserDB(db.Owner, db.Name)
+		if err != nil {
+			log.Printf("Skipping mirror of '%s/%s': %v\n", db.Owner, db.Name, err)
+			continue
+		}
+		n, err := mirrorDB(ctx, db)
+		added += n
+		if err != nil {
+			log.Printf("Mirroring '%s%s%s' failed: %v\n", db.Owner, db.Folder, db.Name, err)
+		}
+	}
+	log.Printf("Mirror sync from '%s' finished. %d databases listed, %d new versions copied\n", MirrorSource(),
+		len(list), added)
+	return nil
+}
+
+// Retrieves the details of a public database on another DBHub instance, including its versions.  As with
+// DownloadRemoteDB(), only public addresses are contacted and redirects aren't followed.
+func RemotePublicDB(ctx context.Context, baseURL string, dbOwner string, dbFolder string, dbName string) (db MirrorDB, err error) {
+	infoURL := fmt.Sprintf("%s/x/publicdb/%s/%s?folder=%s", baseURL, url.PathEscape(dbOwner), url.PathEscape(dbName),
+		url.QueryEscape(dbFolder))
+	req, err := http.NewRequest("GET", infoURL, nil)
+	if err != nil {
+		return db, err
+	}
+	resp, err := publicHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return db, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return db, fmt.Errorf("Unexpected status retrieving database details: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&db)
+	if err == nil && len(db.Versions) == 0 {
+		err = fmt.Errorf("The remote database has no versions")
+	}
+	return db, err
+}
+
+// Copies the versions of a database the mirror doesn't have yet, returning how many were copied.
+func mirrorDB(ctx context.Context, db MirrorDB) (added int, err error) {
+	exists, err := CheckUserExists(db.Owner)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		err = AddMirrorUser(db.Owner)
+		if err != nil {
+			return 0, err
+		}
+	}
+	highVer, err := HighestDBVersion(db.Owner, db.Name, db.Folder, db.Owner)
+	if err != nil {
+		return 0, err
+	}
+	for _, ver := range db.Versions {
+		if ver.Version <= highVer {
+			continue
+		}
+		err = mirrorDBVersion(ctx, db, ver)
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, SetMirroredDBDetails(db.Owner, db.Folder, db.Name, db.Description, db.Readme, db.DefaultTable)
+}
+
+// Downloads one version of a database from the mirror source, checks it arrived intact, and stores it.
+func mirrorDBVersion(ctx context.Context, db MirrorDB, ver MirrorDBVersion) error {
+	tempDBName, dbSize, shaSum, err := downloadRemoteDB(ctx, http.DefaultClient, 0, MirrorSource(), db.Owner, db.Folder, db.Name, ver)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempDBName)
+	bucket, minioID, storedSize, err := storeRemoteDB(ctx, db.Owner, tempDBName)
+	if err != nil {
+		return err
+	}
+	return AddDatabase(db.Owner, db.Folder, db.Name, ver.Version, shaSum, int(dbSize), storedSize, true, bucket,
+		minioID, db.Description, db.Readme, "", "", "")
+}
+
+// Saves a database being downloaded from another server to a temporary file, checking it has the expected SHA256.
+func saveRemoteDB(body io.Reader, wantSHA string) (tempDBName string, dbSize int64, shaSum []byte, err error) {
+	tempDB, err := ioutil.TempFile("", "dbhub-remote-")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	h := sha256.New()
+	dbSize, err = io.Copy(io.MultiWriter(tempDB, h), body)
+	tempDB.Close()
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != wantSHA {
+		err = fmt.Errorf("SHA256 mismatch, expected '%s'", wantSHA)
+	}
+	if err != nil {
+		os.Remove(tempDB.Name())
+		return "", 0, nil, err
+	}
+	return tempDB.Name(), dbSize, h.Sum(nil), nil
+}
+
+// Stores a downloaded database in a user's Minio bucket, under a newly generated object id.
+func storeRemoteDB(ctx context.Context, dbOwner string, tempDBName string) (bucket string, minioID string, storedSize int, err error) {
+	tempDB, err := os.Open(tempDBName)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer tempDB.Close()
+
+	bucket, err = MinioUserBucket(dbOwner)
+	if err != nil {
+		return "", "", 0, err
+	}
+	for okID := false; okID == false; {
+		minioID = RandomString(8) + ".db"
+		okID, err = CheckMinioIDAvail(dbOwner, minioID)
+		if err != nil {
+			return "", "", 0, err
+		}
+	}
+	storedSize, err = StoreMinioObject(ctx, bucket, minioID, tempDB)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return bucket, minioID, storedSize, nil
+}
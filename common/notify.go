@@ -0,0 +1,146 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Notifications are delivered through the channels each user has chosen for that kind of notification.  Unless
+// they've said otherwise, users only get notifications in their notification inbox on the website.
+
+var (
+	// The channels notifications can be delivered through, in the order shown on the preferences page
+	NotificationChannels = []string{ChannelWeb, ChannelEmail, ChannelWebhook}
+
+	// The kinds of notification users can set preferences for, in the order shown on the preferences page
+	NotificationKinds = []NotificationKind{
+		{Kind: NotifyMention, Label: "I'm @mentioned in a README"},
+		{Kind: NotifyWatch, Label: "A database I'm watching changes"},
+		{Kind: NotifyMergeRequest, Label: "Merge request activity"},
+		{Kind: NotifyArchive, Label: "A database archive I asked for is ready"},
+		{Kind: NotifySecurity, Label: "Something happens that may affect my account's security"},
+		{Kind: NotifyAdmin, Label: "Messages from the DBHub.io team"},
+	}
+
+	// Used for sending notifications to webhooks.  Redirects aren't followed, as they could lead to internal addresses
+	webhookClient = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       10 * time.Second,
+	}
+)
+
+// Sends a notification to each of the given users, through the channels they've chosen for its kind.  Unknown users
+// are skipped.  A failed email or webhook delivery is logged, but doesn't stop the others.
+func Notify(userNames []string, kind string, message string, link string) error {
+	targets, err := NotificationTargets(userNames, kind)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if t.Web {
+			err = AddNotification(t.UserName, kind, message, link)
+			if err != nil {
+				return err
+			}
+		}
+		if t.Email != "" && EmailServer() != "" {
+			body := message + "\n"
+			if link != "" {
+				body += fmt.Sprintf("\nhttps://%s%s\n", WebServer(), link)
+			}
+			err = SendEmail(t.Email, "DBHub.io notification", body)
+			if err != nil {
+				log.Printf("Emailing notification to user '%s' failed: %v\n", t.UserName, err)
+			}
+		}
+		if t.Webhook != "" && FeatureEnabled(FeatureWebhooks, t.UserName) {
+			err = sendNotificationWebhook(t.Webhook, t.UserName, kind, message, link)
+			if err != nil {
+				log.Printf("Sending notification webhook for user '%s' failed: %v\n", t.UserName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Tells the users watching a database about a change to it.  The user who made the change isn't told about it.
+func NotifyWatchers(dbOwner string, dbFolder string, dbName string, changedBy string, message string) error {
+	watchers, err := dbWatchers(dbOwner, dbFolder, dbName)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, w := range watchers {
+		if w != changedBy {
+			names = append(names, w)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return Notify(names, NotifyWatch, message, fmt.Sprintf("/%s%s%s", dbOwner, dbFolder, dbName))
+}
+
+// Returns whether notifications of a kind are delivered through a channel when the user hasn't said otherwise.
+// Security notifications are emailed too, as they're no use if the account has been taken over.
+func notificationDefault(kind string, channel string) bool {
+	return channel == ChannelWeb || (kind == NotifySecurity && channel == ChannelEmail)
+}
+
+// Warns a user when a client certificate or access token is used again after not being used for a long time, as
+// that may mean it has been stolen.
+func notifyDormantUse(userName string, credential string, lastUsed time.Time, ip string, link string) {
+	if lastUsed.IsZero() || time.Since(lastUsed) < CredentialDormantTime {
+		return
+	}
+	msg := fmt.Sprintf("Your %s was used from %s, after not being used since %s.  If this wasn't you, replace "+
+		"or revoke it.", credential, ip, lastUsed.Format("2 January 2006"))
+	err := Notify([]string{userName}, NotifySecurity, msg, link)
+	if err != nil {
+		log.Printf("Warning user '%s' about use of a dormant %s failed: %v\n", userName, credential, err)
+	}
+}
+
+// Posts a notification to a user's webhook as JSON.
+func sendNotificationWebhook(webhookURL string, userName string, kind string, message string, link string) error {
+	err := ValidateNotifyWebhook(webhookURL)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{
+		"username": userName,
+		"kind":     kind,
+		"message":  message,
+	}
+	if link != "" {
+		payload["link"] = fmt.Sprintf("https://%s%s", WebServer(), link)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// Checks a user supplied notification webhook URL is usable.  Only http and https URLs pointing at public addresses
+// are allowed.
+func ValidateNotifyWebhook(webhookURL string) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("The webhook needs to be an http or https URL")
+	}
+	return CheckPublicHost(u.Hostname())
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"sync"
+)
+
+// Third party applications can also use OpenID Connect to log their users in with their DBHub.io accounts.  When they
+// ask for the openid scope, the token endpoint includes an ID token saying who the user is, signed using the RSA key
+// given in the web server config.  The public half of the key is published as a JSON Web Key Set, so applications can
+// check the signature.
+
+var (
+	oidcKey     *rsa.PrivateKey
+	oidcKeyErr  error
+	oidcKeyOnce sync.Once
+)
+
+// Loads the key ID tokens are signed with.  It's only read from disk the first time it's needed.
+func loadOIDCKey() (*rsa.PrivateKey, error) {
+	oidcKeyOnce.Do(func() {
+		if WebOIDCKey() == "" {
+			oidcKeyErr = errors.New("No OpenID Connect signing key has been configured")
+			return
+		}
+		var keyFile []byte
+		keyFile, oidcKeyErr = ioutil.ReadFile(WebOIDCKey())
+		if oidcKeyErr != nil {
+			log.Printf("Error opening OpenID Connect signing key: %v\n", oidcKeyErr)
+			return
+		}
+		keyPEM, _ := pem.Decode(keyFile)
+		if keyPEM == nil {
+			oidcKeyErr = errors.New("Error when PEM decoding the OpenID Connect signing key")
+			log.Println(oidcKeyErr)
+			return
+		}
+
+		// Both the older PKCS #1 format and the PKCS #8 one (which openssl genpkey writes) are accepted
+		oidcKey, oidcKeyErr = x509.ParsePKCS1PrivateKey(keyPEM.Bytes)
+		if oidcKeyErr == nil {
+			return
+		}
+		var key interface{}
+		key, oidcKeyErr = x509.ParsePKCS8PrivateKey(keyPEM.Bytes)
+		if oidcKeyErr != nil {
+			log.Printf("Error when parsing OpenID Connect signing key: %v\n", oidcKeyErr)
+			return
+		}
+		var ok bool
+		oidcKey, ok = key.(*rsa.PrivateKey)
+		if !ok {
+			oidcKeyErr = errors.New("The OpenID Connect signing key needs to be an RSA key")
+			log.Println(oidcKeyErr)
+		}
+	})
+	return oidcKey, oidcKeyErr
+}
+
+// Returns the ID of the key ID tokens are signed with, so applications can tell when it's been changed.
+func oidcKeyID(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(key.N.Bytes())
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// Returns whether this server has been set up to issue ID tokens.
+func OIDCEnabled() bool {
+	return WebOIDCKey() != ""
+}
+
+// Returns the public key ID tokens are signed with, as a JSON Web Key Set (RFC 7517).
+func OIDCKeySet() (map[string]interface{}, error) {
+	key, err := loadOIDCKey()
+	if err != nil {
+		return nil, err
+	}
+	jwk := map[string]string{
+		"alg": "RS256",
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		"kid": oidcKeyID(&key.PublicKey),
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"use": "sig",
+	}
+	return map[string]interface{}{"keys": []map[string]string{jwk}}, nil
+}
+
+// Creates an ID token holding the given claims, signed using RS256 (RFC 7519).
+func SignIDToken(claims map[string]interface{}) (string, error) {
+	key, err := loadOIDCKey()
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": oidcKeyID(&key.PublicKey), "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		log.Printf("Error when signing ID token: %v\n", err)
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -1,10 +1,15 @@
 package common
 
 import (
+	"context"
+	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -14,1185 +19,6280 @@ import (
 var (
 	// PostgreSQL connection pool handle
 	pdb *pgx.ConnPool
-)
 
-// Add a user to the system.
-func AddUser(auth0ID string, userName string, password string, email string) error {
-	// Hash the user's password
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Failed to hash user password. User: '%v', error: %v.\n", userName, err)
-		return err
+	// Connection pool handles for the PostgreSQL read replicas (if any), and a counter used to spread read queries
+	// between them
+	pdbReplicas    []*pgx.ConnPool
+	replicaCounter uint32
+
+	// Tables included in instance metadata exports, in the order they need importing.  The sequence (if any) used
+	// for each table's serial column is also given, so it can be moved past the imported values
+	metadataTables = []struct {
+		Name     string
+		Sequence string
+	}{
+		{"users", ""},
+		{"user_logins", ""},
+		{"client_certs", "client_certs_cert_id_seq"},
+		{"user_identities", ""},
+		{"sqlite_databases", "sqlite_databases_idnum_seq"},
+		{"live_journal", "live_journal_journal_id_seq"},
+		{"replication_cursors", ""},
+		{"query_history", "query_history_idnum_seq"},
+		{"activity", "activity_activity_id_seq"},
+		{"database_downloads", ""},
+		{"database_versions", "database_versions_idnum_seq"},
+		{"column_docs", ""},
+		{"database_stars", ""},
+		{"saved_queries", "saved_queries_idnum_seq"},
+		{"oauth_clients", ""},
+		{"oauth_codes", ""},
+		{"oauth_tokens", ""},
+		{"api_tokens", "api_tokens_token_id_seq"},
+		{"takedown_requests", "takedown_requests_idnum_seq"},
+		{"terms_versions", "terms_versions_idnum_seq"},
+		{"terms_acceptances", ""},
+		{"announcements", "announcements_idnum_seq"},
+		{"announcement_dismissals", ""},
+		{"user_follows", ""},
+		{"organisation_members", ""},
+		{"notifications", "notifications_idnum_seq"},
+		{"notification_prefs", ""},
+		{"attachments", ""},
+		{"scan_verdicts", ""},
+		{"deleted_versions", "deleted_versions_idnum_seq"},
+		{"database_shares", ""},
+		{"feature_flags", ""},
+		{"database_webhooks", "database_webhooks_webhook_id_seq"},
+		{"webhook_deliveries", "webhook_deliveries_delivery_id_seq"},
+		{"database_watches", ""},
+		{"import_hooks", "import_hooks_hook_id_seq"},
+		{"protected_branches", ""},
+		{"status_checks", ""},
+		{"required_status_checks", ""},
+		{"share_links", "share_links_link_id_seq"},
+		{"validation_rules", "validation_rules_rule_id_seq"},
+		{"merge_requests", "merge_requests_mr_id_seq"},
+		{"merge_request_approvals", ""},
 	}
+)
 
-	// Generate a unique bucket name for the user
-	var bucket string
-	newBucket := true
-	for newBucket == true {
-		bucket = RandomString(16) + ".bkt"
-		newBucket, err = MinioBucketExists(bucket) // Drops out of the loop when the name hasn't been used yet
-		if err != nil {
-			log.Printf("Error when checking if Minio bucket already exists: %v\n", err)
-			return err
-		}
+// Merges an open merge request, by adding the latest version on its source branch as a new version on its target
+// branch.  The merge request is marked as merged first, so it can't be merged twice at the same time.
+func AcceptMergeRequest(dbOwner string, dbFolder string, dbName string, mr MergeRequest, head BranchHead,
+	mergedBy string) (newVer int, err error) {
+	shaSum, err := hex.DecodeString(head.SHA256)
+	if err != nil {
+		log.Printf("Invalid SHA256 for version %d of '%s%s%s': %v\n", head.Version, dbOwner, dbFolder, dbName, err)
+		return 0, err
 	}
-
-	// Generate a new HTTPS client certificate for the user
-	cert, err := GenerateClientCert(userName, 14) // 14 days validity while developing
+	highVer, err := HighestDBVersion(dbOwner, dbName, dbFolder, dbOwner)
 	if err != nil {
-		log.Printf("Error when generating client certificate for '%s': %v\n", userName, err)
-		return err
+		return 0, err
 	}
+	newVer = highVer + 1
 
-	// Add the new user to the database
-	insertQuery := `
-		INSERT INTO users (auth0id, username, email, password_hash, client_certificate, minio_bucket)
-		VALUES ($1, $2, $3, $4, $5, $6)`
-	commandTag, err := pdb.Exec(insertQuery, auth0ID, userName, email, hash, cert, bucket)
+	dbQuery := `
+		UPDATE merge_requests
+		SET state = $5, closed_by = $6, date_closed = timezone('utc'::text, now()), merged_version = $7
+		WHERE mr_id = $4
+			AND state = $8
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, mr.ID, MergeRequestMerged, mergedBy, newVer,
+		MergeRequestOpen)
 	if err != nil {
-		log.Printf("Adding user to database failed: %v\n", err)
-		return err
+		log.Printf("Marking merge request %d of '%s%s%s' as merged failed: %v\n", mr.ID, dbOwner, dbFolder, dbName,
+			err)
+		return 0, err
 	}
 	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong number of rows affected when creating user: %v, username: %v\n", numRows, userName)
+		return 0, errors.New("That merge request isn't open")
 	}
 
-	// Create a new bucket for the user in Minio
-	err = CreateMinioBucket(bucket)
+	msg := fmt.Sprintf("Merge request #%d from %s: %s", mr.ID, mr.SourceBranch, mr.Title)
+	err = AddDatabase(dbOwner, dbFolder, dbName, newVer, shaSum, head.Size, head.StoredSize, false, "", head.MinioID,
+		"", "", msg, mergedBy, mr.TargetBranch)
 	if err != nil {
-		log.Printf("Error creating new bucket: %v\n", err)
-		return err
+		// Put the merge request back the way it was, so the merge can be tried again
+		dbQuery = `
+			UPDATE merge_requests
+			SET state = $2, closed_by = NULL, date_closed = NULL, merged_version = NULL
+			WHERE mr_id = $1`
+		_, err2 := pdb.Exec(dbQuery, mr.ID, MergeRequestOpen)
+		if err2 != nil {
+			log.Printf("Reopening merge request %d after a failed merge failed: %v\n", mr.ID, err2)
+		}
+		return 0, err
 	}
+	return newVer, updateMergeRequestCount(dbOwner, dbFolder, dbName)
+}
 
-	// Log the user registration
-	log.Printf("User registered: '%s' Email: '%s'\n", userName, email)
-
+// Records a user accepting a version of the terms of service and privacy policy.
+func AcceptTerms(userName string, version int) error {
+	dbQuery := `
+		INSERT INTO terms_acceptances (username, version)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+	_, err := pdb.Exec(dbQuery, userName, version)
+	if err != nil {
+		log.Printf("Recording acceptance of terms version %d by user '%s' failed: %v\n", version, userName, err)
+		return err
+	}
 	return nil
 }
 
-// Add a new SQLite database for a user.
-func AddDatabase(dbOwner string, dbFolder string, dbName string, dbVer int, shaSum []byte, dbSize int, public bool, bucket string, id string, descrip string, readme string) error {
-	// Check for values which should be NULL
-	var nullableDescrip, nullableReadme pgx.NullString
-	if descrip == "" {
-		nullableDescrip.Valid = false
-	} else {
-		nullableDescrip.String = descrip
-		nullableDescrip.Valid = true
+// Returns the announcements which are currently scheduled to be shown, leaving out any the user has dismissed.
+func ActiveAnnouncements(userName string) (list []Announcement, err error) {
+	dbQuery := `
+		SELECT idnum, message, level, starts, ends
+		FROM announcements AS a
+		WHERE starts <= now()
+			AND ends > now()
+			AND NOT EXISTS (
+				SELECT 1
+				FROM announcement_dismissals AS d
+				WHERE d.announcement_id = a.idnum
+					AND d.username = $1
+			)
+		ORDER BY starts`
+	rows, err := readDB().Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
 	}
-	if readme == "" {
-		nullableReadme.Valid = false
-	} else {
-		nullableReadme.String = readme
-		nullableReadme.Valid = true
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow Announcement
+		err = rows.Scan(&oneRow.ID, &oneRow.Message, &oneRow.Level, &oneRow.Starts, &oneRow.Ends)
+		if err != nil {
+			log.Printf("Error retrieving active announcements: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
 	}
+	return list, nil
+}
 
-	// If it's a new database, add its details to the main PG sqlite_databases table
-	var dbQuery string
-	if dbVer == 1 {
-		dbQuery = `
-			WITH root_db_value AS (
-				SELECT nextval('sqlite_databases_idnum_seq')
-			)
-			INSERT INTO sqlite_databases (username, folder, dbname, public, idnum, minio_bucket, root_database, description, readme)
-			VALUES ($1, $2, $3, $4, (SELECT nextval FROM root_db_value), $5, (SELECT nextval FROM root_db_value), $6, $7)`
-		commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, public, bucket, nullableDescrip,
-			nullableReadme)
-		if err != nil {
-			log.Printf("Adding database to PostgreSQL failed: %v\n", err)
-			return err
+// Returns the takedown request currently in effect for a database, if any.  If there isn't one, the returned ID is 0.
+func ActiveTakedown(dbOwner string, dbFolder string, dbName string) (t Takedown, err error) {
+	dbQuery := `
+		SELECT idnum, db_owner, db_folder, db_name, complainant_name, complainant_email, description, status,
+			admin_notes, counter_notice, date_created, date_updated
+		FROM takedown_requests
+		WHERE db_owner = $1
+			AND db_folder = $2
+			AND db_name = $3
+			AND status IN ($4, $5)
+		ORDER BY date_created DESC
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, TakedownAccepted, TakedownCountered).Scan(&t.ID,
+		&t.DBOwner, &t.DBFolder, &t.DBName, &t.ComplainantName, &t.ComplainantEmail, &t.Description, &t.Status,
+		&t.AdminNotes, &t.CounterNotice, &t.DateCreated, &t.DateUpdated)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Takedown{}, nil
 		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("Wrong number of rows (%v) affected when creating initial sqlite_databases "+
-				"entry for '%s%s/%s'\n", numRows, dbOwner, dbFolder, dbName)
+		log.Printf("Error checking for takedown of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return Takedown{}, err
+	}
+	return t, nil
+}
+
+// Returns the recent activity on public databases, newest first.  If a user name is given, only what that user did
+// is returned.  Pages after the first are retrieved by passing the ID of the last entry already shown as before, or
+// zero for the first page.
+func Activity(userName string, before int64, limit int) (list []FeedEntry, err error) {
+	dbQuery := `
+		SELECT act.activity_id, act.action, act.username, db.username, db.folder, db.dbname, act.version,
+			act.detail, act.date_created
+		FROM activity AS act, sqlite_databases AS db
+		WHERE act.db = db.idnum
+			AND db.public = true
+			AND ($1 = '' OR act.username = $1)
+			AND ($2 = 0 OR act.activity_id < $2)
+		ORDER BY act.activity_id DESC
+		LIMIT $3`
+	rows, err := readDB().Query(dbQuery, userName, before, limit)
+	if err != nil {
+		log.Printf("Retrieving activity feed failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow FeedEntry
+		err = rows.Scan(&oneRow.ID, &oneRow.Action, &oneRow.User, &oneRow.DBOwner, &oneRow.DBFolder,
+			&oneRow.DBName, &oneRow.Version, &oneRow.Detail, &oneRow.Date)
+		if err != nil {
+			log.Printf("Error retrieving activity feed: %v\n", err)
+			return nil, err
 		}
+		list = append(list, oneRow)
 	}
+	return list, nil
+}
 
-	// Add the database to database_versions
-	dbQuery = `
-		WITH databaseid AS (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-				AND dbname = $2)
-		INSERT INTO database_versions (db, size, version, sha256, minioid)
-		SELECT idnum, $3, $4, $5, $6 FROM databaseid`
-	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbName, dbSize, dbVer, hex.EncodeToString(shaSum[:]), id)
+// Schedules a new announcement banner, to be shown on every page between its start and end times.
+func AddAnnouncement(a Announcement) (id int64, err error) {
+	dbQuery := `
+		INSERT INTO announcements (message, level, starts, ends)
+		VALUES ($1, $2, $3, $4)
+		RETURNING idnum`
+	err = pdb.QueryRow(dbQuery, a.Message, a.Level, a.Starts, a.Ends).Scan(&id)
 	if err != nil {
-		log.Printf("Adding version info to PostgreSQL failed: %v\n", err)
-		return err
+		log.Printf("Adding announcement failed: %v\n", err)
+		return 0, err
 	}
+	return id, nil
+}
 
-	// Update the last_modified date for the database in sqlite_databases
-	dbQuery = `
-		UPDATE sqlite_databases
-		SET last_modified = (
-			SELECT last_modified
-			FROM database_versions
-			WHERE db = (
-				SELECT idnum
-				FROM sqlite_databases
-				WHERE username = $1
-					AND dbname = $2)
-				AND version = $3)
+// Records a new attachment for a database.  Returns an error if the database doesn't exist.
+func AddAttachment(a Attachment) error {
+	dbQuery := `
+		INSERT INTO attachments (id, db, uploader, file_name, content_type, size, minio_bucket, minio_id)
+		SELECT $4, idnum, $5, $6, $7, $8, $9, $10
+		FROM sqlite_databases
 		WHERE username = $1
-			AND dbname = $2`
-	commandTag, err = pdb.Exec(dbQuery, dbOwner, dbName, dbVer)
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, a.Owner, a.Folder, a.DBName, a.ID, a.Uploader, a.FileName, a.ContentType,
+		a.Size, a.MinioBkt, a.MinioID)
 	if err != nil {
-		log.Printf("Updating last_modified date in PostgreSQL failed: %v\n", err)
+		log.Printf("Adding attachment to '%s%s%s' failed: %v\n", a.Owner, a.Folder, a.DBName, err)
 		return err
 	}
 	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong number of rows affected: %v, user: %s, database: %v\n", numRows, dbOwner, dbName)
+		return fmt.Errorf("Unknown database '%s%s%s'", a.Owner, a.Folder, a.DBName)
 	}
+	return nil
+}
 
+// Adds a client certificate to the list of certificates issued to a user.  Adding a certificate which is already on
+// the list does nothing.
+func AddClientCert(userName string, name string, serial string, expiry time.Time) error {
+	dbQuery := `
+		INSERT INTO client_certs (username, name, serial, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (serial) DO NOTHING`
+	_, err := pdb.Exec(dbQuery, userName, name, serial, expiry)
+	if err != nil {
+		log.Printf("Adding client certificate '%s' for user '%s' failed: %v\n", serial, userName, err)
+		return err
+	}
 	return nil
 }
 
-// Check if a database has been starred by a given user.  The boolean return value is only valid when err is nil.
-func CheckDBStarred(loggedInUser string, dbOwner string, dbFolder string, dbName string) (bool, error) {
+// Records a counter notice from a database owner, in response to an accepted takedown request.
+func AddCounterNotice(takedownID int64, dbOwner string, notice string) error {
 	dbQuery := `
-		SELECT count(db)
-		FROM database_stars
-		WHERE database_stars.username = $1
-		AND database_stars.db = (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $2
-				AND folder = $3
-				AND dbname = $4)`
-	var starCount int
-	err := pdb.QueryRow(dbQuery, loggedInUser, dbOwner, dbFolder, dbName).Scan(&starCount)
+		UPDATE takedown_requests
+		SET counter_notice = $3, status = $4, date_updated = now()
+		WHERE idnum = $1
+			AND db_owner = $2
+			AND status = $5`
+	commandTag, err := pdb.Exec(dbQuery, takedownID, dbOwner, notice, TakedownCountered, TakedownAccepted)
 	if err != nil {
-		log.Printf("Error looking up star count for database. User: '%s' DB: '%s/%s'. Error: %v\n",
-			loggedInUser, dbOwner, dbName, err)
-		return true, err
+		log.Printf("Adding counter notice to takedown request %d failed: %v\n", takedownID, err)
+		return err
 	}
-	if starCount == 0 {
-		// Database hasn't been starred by the user
-		return false, nil
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("No takedown request awaiting a counter notice was found")
 	}
-
-	// Database HAS been starred by the user
-	return true, nil
+	return nil
 }
 
-// Check if an email address already exists in our system. Returns true if the email is already in the system, false
-// if not.  If an error occurred, the true/false value should be ignored, as only the error value is valid.
-func CheckEmailExists(email string) (bool, error) {
-	// Check if the email address is already in our system
+// Registers a webhook for a database, which is sent the given events.  A random secret is created for signing its
+// deliveries.
+func AddDBWebhook(dbOwner string, dbFolder string, dbName string, webhookURL string, events []string) error {
+	secret, err := RandomToken()
+	if err != nil {
+		return err
+	}
 	dbQuery := `
-		SELECT count(username)
-		FROM users
-		WHERE email = $1`
-	var emailCount int
-	err := pdb.QueryRow(dbQuery, email).Scan(&emailCount)
+		INSERT INTO database_webhooks (db, url, secret, events)
+		SELECT idnum, $4, $5, $6
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, webhookURL, secret, events)
 	if err != nil {
-		log.Printf("Database query failed: %v\n", err)
-		return true, err
+		log.Printf("Adding webhook to database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
 	}
-	if emailCount == 0 {
-		// Email address isn't yet in our system
-		return false, nil
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when adding webhook to '%s%s%s'\n", numRows,
+			dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
 	}
-
-	// Email address IS already in our system
-	return true, nil
-
+	return nil
 }
 
-// Checks if a given MinioID string is available for use by a user. Returns true if available, false if not.  Only
-// if err returns a non-nil value.
-func CheckMinioIDAvail(userName string, id string) (bool, error) {
-	// Check if an existing database for the user already uses the given MinioID
-	var dbVer int
+// Adds an import webhook to a database.  Versions it imports are recorded as uploaded by the user who created it.
+func AddImportHook(dbOwner string, dbFolder string, dbName string, createdBy string, branch string) error {
+	token, err := RandomToken()
+	if err != nil {
+		return err
+	}
+	secret, err := RandomToken()
+	if err != nil {
+		return err
+	}
 	dbQuery := `
-		WITH user_databases AS (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1)
-		SELECT ver.version
-		FROM database_versions AS ver, user_databases AS db
-		WHERE ver.db = db.idnum
-			AND ver.minioid = $2`
-	err := pdb.QueryRow(dbQuery, userName, id).Scan(&dbVer)
+		INSERT INTO import_hooks (db, token, secret, branch, created_by)
+		SELECT idnum, $4, $5, NULLIF($6, ''), $7
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, token, secret, branch, createdBy)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			// Not a real error, there just wasn't a matching row
-			return true, nil
-		}
-
-		// A real database error occurred
-		log.Printf("Error checking if a MinioID is already taken: %v\n", err)
-		return false, err
+		log.Printf("Adding import webhook to database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
 	}
-
-	if dbVer == 0 {
-		// Nothing already using the MinioID, so it's available for use
-		return true, nil
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when adding import webhook to '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
 	}
+	return nil
+}
 
-	// The MinioID is already in use
-	return false, nil
+// Opens a merge request for a database, returning its ID.
+func AddMergeRequest(dbOwner string, dbFolder string, dbName string, mr MergeRequest) (id int64, err error) {
+	dbQuery := `
+		INSERT INTO merge_requests (db, source_branch, target_branch, title, description, created_by)
+		SELECT idnum, $4, $5, $6, nullif($7, ''), $8
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		RETURNING mr_id`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, mr.SourceBranch, mr.TargetBranch, mr.Title,
+		mr.Description, mr.CreatedBy).Scan(&id)
+	if err != nil {
+		log.Printf("Adding merge request to database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return 0, err
+	}
+	return id, updateMergeRequestCount(dbOwner, dbFolder, dbName)
 }
 
-// Check if a user has access to a specific version of a database.
-func CheckUserDBVAccess(dbOwner string, dbFolder string, dbName string, dbVer int, loggedInUser string) (bool, error) {
+// Records a user approving a merge request.  Approving a merge request more than once doesn't change anything.
+func AddMergeRequestApproval(id int64, userName string) error {
 	dbQuery := `
-		SELECT version
-		FROM database_versions
-		WHERE db = (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-				AND folder = $2
-				AND dbname = $3`
-	if dbOwner != loggedInUser {
-		dbQuery += ` AND public = true `
-	}
-	dbQuery += `
-			)
-			AND version = $4`
-	var numRows int
-	err := pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, dbVer).Scan(&numRows)
+		INSERT INTO merge_request_approvals (mr_id, username)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+	_, err := pdb.Exec(dbQuery, id, userName)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			// The requested database version isn't available to the given user
-			return false, nil
+		log.Printf("Adding approval of merge request %d by user '%s' failed: %v\n", id, userName, err)
+		return err
+	}
+	return nil
+}
+
+// Adds a user account for the owner of a mirrored database.  Nobody can log in to a mirror, so the account has no
+// password, email address, or client certificate.
+func AddMirrorUser(userName string) error {
+	// Generate a unique bucket name for the user
+	var bucket string
+	var err error
+	newBucket := true
+	for newBucket == true {
+		bucket = RandomString(16) + ".bkt"
+		newBucket, err = MinioBucketExists(bucket)
+		if err != nil {
+			log.Printf("Error when checking if Minio bucket already exists: %v\n", err)
+			return err
 		}
-		log.Printf("Error when checking user's access to database '%s%s%s'. User: '%s' Error: %v\n",
-			dbOwner, dbFolder, dbName, loggedInUser, err.Error())
-		return false, err
 	}
 
-	// A row was returned, so the requested database IS available to the given user
-	return true, nil
+	insertQuery := `
+		INSERT INTO users (username, password_hash, client_certificate, minio_bucket)
+		VALUES ($1, '', ''::bytea, $2)`
+	_, err = pdb.Exec(insertQuery, userName, bucket)
+	if err != nil {
+		log.Printf("Adding mirrored user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	return CreateMinioBucket(bucket)
 }
 
-// Check if a username already exists in our system.  Returns true if the username is already taken, false if not.
-// If an error occurred, the true/false value should be ignored, and only the error return code used.
-func CheckUserExists(userName string) (bool, error) {
+// Adds a notification to a user's notification inbox.
+func AddNotification(userName string, kind string, message string, link string) error {
 	dbQuery := `
-		SELECT count(username)
-		FROM users
-		WHERE username = $1`
-	var userCount int
-	err := pdb.QueryRow(dbQuery, userName).Scan(&userCount)
+		INSERT INTO notifications (username, kind, message, link)
+		VALUES ($1, $2, $3, $4)`
+	commandTag, err := pdb.Exec(dbQuery, userName, kind, message, link)
 	if err != nil {
-		log.Printf("Database query failed: %v\n", err)
-		return true, err
+		log.Printf("Adding notification for user '%s' failed: %v\n", userName, err)
+		return err
 	}
-	if userCount == 0 {
-		// Username isn't in system
-		return false, nil
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when adding notification for user '%s'\n", numRows,
+			userName)
 	}
-	// Username IS in system
-	return true, nil
+	return nil
 }
 
-// Returns the certificate for a given user.
-func ClientCert(userName string) ([]byte, error) {
-	var cert []byte
-	err := pdb.QueryRow(`
-		SELECT client_certificate
-		FROM users
-		WHERE username = $1`, userName).Scan(&cert)
+// Registers a third party application which can request access to user accounts through OAuth.  The returned client
+// secret isn't stored, so needs to be passed on to the application developer straight away.
+func AddOAuthClient(name string, redirectURI string) (clientID string, secret string, err error) {
+	clientID, err = RandomToken()
 	if err != nil {
-		log.Printf("Retrieving client cert for '%s' from database failed: %v\n", userName, err)
-		return nil, err
+		return "", "", err
 	}
-
-	return cert, nil
-}
-
-// Creates a connection pool to the PostgreSQL server.
-func ConnectPostgreSQL() (err error) {
-	pgPoolConfig := pgx.ConnPoolConfig{*pgConfig, PGConnections, nil, 2 * time.Second}
-	pdb, err = pgx.NewConnPool(pgPoolConfig)
+	clientID = clientID[:24]
+	secret, err = RandomToken()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Couldn't connect to PostgreSQL server: %v\n", err))
+		return "", "", err
 	}
-
-	// Log successful connection message
-	log.Printf("Connected to PostgreSQL server: %v:%v\n", conf.Pg.Server, uint16(conf.Pg.Port))
-
-	return nil
-}
-
-// Returns the ID number for a given user's database.
-func databaseID(dbOwner string, dbName string) (dbID int, err error) {
-	// Retrieve the database id
-	dbQuery := `
-		SELECT idnum
-		FROM sqlite_databases
-		WHERE username = $1
-			AND dbname = $2`
-	err = pdb.QueryRow(dbQuery, dbOwner, dbName).Scan(&dbID)
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("Error looking up database id. Owner: '%s', Database: '%s'. Error: %v\n", dbOwner, dbName,
-			err)
+		log.Printf("Failed to hash OAuth client secret: %v\n", err)
+		return "", "", err
 	}
-	return
-}
 
-// Return a list of 1) users with public databases, 2) along with the logged in user's most recently modified database,
-// including their private one(s).
-func DB4SDefaultList(loggedInUser string) ([]UserInfo, error) {
 	dbQuery := `
-		WITH user_db_list AS (
-			SELECT DISTINCT ON (idnum) idnum, last_modified
-			FROM sqlite_databases
-			WHERE username = $1
-		), most_recent_user_db AS (
-			SELECT idnum, last_modified
-			FROM user_db_list
-			ORDER BY last_modified DESC
-			LIMIT 1
-		), public_dbs AS (
-			SELECT idnum, last_modified
-			FROM sqlite_databases
-			WHERE public = true
-			ORDER BY last_modified DESC
-		), public_users AS (
-			SELECT DISTINCT ON (db.username) db.username, db.last_modified
-			FROM public_dbs as pub, sqlite_databases AS db, most_recent_user_db AS usr
-			WHERE db.idnum = pub.idnum OR db.idnum = usr.idnum
-			ORDER BY db.username, db.last_modified DESC
-		)
-		SELECT username, last_modified FROM public_users
-		ORDER BY last_modified DESC`
-	rows, err := pdb.Query(dbQuery, loggedInUser)
+		INSERT INTO oauth_clients (client_id, client_secret_hash, client_name, redirect_uri)
+		VALUES ($1, $2, $3, $4)`
+	commandTag, err := pdb.Exec(dbQuery, clientID, secretHash, name, redirectURI)
 	if err != nil {
-		log.Printf("Database query failed: %v\n", err)
-		return nil, err
+		log.Printf("Adding OAuth client '%s' failed: %v\n", name, err)
+		return "", "", err
 	}
-	defer rows.Close()
-	var list []UserInfo
-	for rows.Next() {
-		var oneRow UserInfo
-		err = rows.Scan(&oneRow.Username, &oneRow.LastModified)
-		if err != nil {
-			log.Printf("Error retrieving database list for user: %v\n", err)
-			return nil, err
-		}
-		list = append(list, oneRow)
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when adding OAuth client '%s'\n", numRows, name)
 	}
-
-	return list, nil
+	return clientID, secret, nil
 }
 
-// Retrieve the details for a specific database
-func DBDetails(DB *SQLiteDBinfo, loggedInUser string, dbOwner string, dbFolder string, dbName string, dbVersion int) error {
+// Records the approval of an OAuth authorisation request by a user, returning the authorisation code to give to the
+// application.  The nonce is the one sent by OpenID Connect applications, which goes back to them in the ID token.
+func AddOAuthCode(clientID string, userName string, scope string, redirectURI string, nonce string) (string,
+	error) {
+	code, err := RandomToken()
+	if err != nil {
+		return "", err
+	}
 	dbQuery := `
-		SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
-			db.discussions, db.pull_requests, db.updates, db.branches, db.releases, db.contributors,
-			db.description, db.readme, db.minio_bucket, db.default_table, db.public
-		FROM sqlite_databases AS db, database_versions AS ver
-		WHERE db.username = $1
-			AND db.folder = $2
-			AND db.dbname = $3
-			AND db.idnum = ver.db`
-	if loggedInUser != dbOwner {
-		// * The request is for another users database, so it needs to be a public one *
-		dbQuery += `
-			AND db.public = true`
+		INSERT INTO oauth_codes (code_hash, client_id, username, scope, redirect_uri, nonce, expiry)
+		VALUES ($1, $2, $3, $4, $5, nullif($6, ''), $7)`
+	commandTag, err := pdb.Exec(dbQuery, tokenHash(code), clientID, userName, scope, redirectURI, nonce,
+		time.Now().Add(OAuthCodeLifetime))
+	if err != nil {
+		log.Printf("Adding OAuth authorisation code for user '%s' failed: %v\n", userName, err)
+		return "", err
 	}
-	if dbVersion == 0 {
-		// No specific database version was requested, so use the highest available
-		dbQuery += `
-			ORDER BY version DESC
-			LIMIT 1`
-	} else {
-		dbQuery += `
-			AND ver.version = $4`
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when adding OAuth authorisation code for user '%s'\n",
+			numRows, userName)
 	}
+	return code, nil
+}
 
-	// Generate a predictable cache key for this functions' metadata.  Probably not sharable with other functions
-	// cached metadata
-	mdataCacheKey := MetadataCacheKey("meta", loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
+// Creates a new organisation, with the user creating it as its owner.  Organisations are stored as users which can't
+// log in, so they can own databases the same way users do.
+func AddOrganisation(orgName string, creator string) error {
+	// Generate a unique bucket name for the organisation
+	var bucket string
+	var err error
+	newBucket := true
+	for newBucket == true {
+		bucket = RandomString(16) + ".bkt"
+		newBucket, err = MinioBucketExists(bucket) // Drops out of the loop when the name hasn't been used yet
+		if err != nil {
+			log.Printf("Error when checking if Minio bucket already exists: %v\n", err)
+			return err
+		}
+	}
 
-	// Use a cached version of the query response if it exists
-	ok, err := GetCachedData(mdataCacheKey, &DB)
+	tx, err := pdb.Begin()
 	if err != nil {
-		log.Printf("Error retrieving data from cache: %v\n", err)
-	}
-	if ok {
-		// Data was in cache, so we use that
-		return nil
+		log.Printf("Couldn't start transaction for adding organisation '%s': %v\n", orgName, err)
+		return err
 	}
+	defer tx.Rollback()
 
-	// Retrieve the requested database details
-	var Desc, Readme, defTable pgx.NullString
-	if dbVersion == 0 {
-		err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&DB.MinioId, &DB.Info.DateCreated,
-			&DB.Info.LastModified, &DB.Info.Size, &DB.Info.Version, &DB.Info.Watchers, &DB.Info.Stars,
-			&DB.Info.Discussions, &DB.Info.MRs, &DB.Info.Updates, &DB.Info.Branches, &DB.Info.Releases,
-			&DB.Info.Contributors, &Desc, &Readme, &DB.MinioBkt, &defTable, &DB.Info.Public)
-	} else {
-		err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, dbVersion).Scan(&DB.MinioId,
-			&DB.Info.DateCreated, &DB.Info.LastModified, &DB.Info.Size, &DB.Info.Version,
-			&DB.Info.Watchers, &DB.Info.Stars, &DB.Info.Discussions, &DB.Info.MRs, &DB.Info.Updates,
-			&DB.Info.Branches, &DB.Info.Releases, &DB.Info.Contributors, &Desc, &Readme, &DB.MinioBkt,
-			&defTable, &DB.Info.Public)
-	}
+	// Organisations don't have a password or client certificate, so nobody can log in as one
+	_, err = tx.Exec(`
+		INSERT INTO users (username, password_hash, client_certificate, minio_bucket, is_org)
+		VALUES ($1, '', $2, $3, true)`, orgName, []byte{}, bucket)
 	if err != nil {
-		return errors.New("The requested database doesn't exist")
-	}
-	if !Desc.Valid {
-		DB.Info.Description = "No description"
-	} else {
-		DB.Info.Description = Desc.String
-	}
-	if !Readme.Valid {
-		DB.Info.Readme = "No full description"
-	} else {
-		DB.Info.Readme = Readme.String
+		log.Printf("Adding organisation '%s' to database failed: %v\n", orgName, err)
+		return err
 	}
-	if !defTable.Valid {
-		DB.Info.DefaultTable = ""
-	} else {
-		DB.Info.DefaultTable = defTable.String
+	_, err = tx.Exec(`
+		INSERT INTO organisation_members (org, username, role)
+		VALUES ($1, $2, $3)`, orgName, creator, OrgRoleOwner)
+	if err != nil {
+		log.Printf("Adding owner '%s' to organisation '%s' failed: %v\n", creator, orgName, err)
+		return err
 	}
-
-	// Fill out the fields we already have data for
-	DB.Info.Database = dbName
-	DB.Info.Folder = dbFolder
-
-	// Retrieve latest fork count
-	// TODO: This can probably be folded into the above SQL query as a subselect, as a minor optimisation
-	dbQuery = `
-		SELECT forks
-		FROM sqlite_databases
-		WHERE idnum = (
-			SELECT root_database
-			FROM sqlite_databases
-			WHERE username = $1
-			AND folder = $2
-			AND dbname = $3)`
-	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&DB.Info.Forks)
+	err = tx.Commit()
 	if err != nil {
-		log.Printf("Error retrieving fork count for '%s%s': %v\n", dbOwner, dbName, err)
+		log.Printf("Couldn't commit new organisation '%s': %v\n", orgName, err)
 		return err
 	}
 
-	// Cache the database details
-	err = CacheData(mdataCacheKey, DB, 120)
+	// Create a new bucket for the organisation in Minio
+	err = CreateMinioBucket(bucket)
 	if err != nil {
-		log.Printf("Error when caching page data: %v\n", err)
+		log.Printf("Error creating new bucket: %v\n", err)
+		return err
 	}
 
+	log.Printf("Organisation created: '%s' by '%s'\n", orgName, creator)
 	return nil
 }
 
-// Returns the star count for a given database.
-func DBStars(dbOwner string, dbName string) (starCount int, err error) {
-	// Get the ID number of the database
-	dbID, err := databaseID(dbOwner, dbName)
+// Record a query executed by a user, for their query history.
+func AddQueryHistory(userName string, dbOwner string, dbFolder string, dbName string, dbVersion int, query string,
+	duration time.Duration, rowCount int, cached bool) error {
+	dbQuery := `
+		INSERT INTO query_history (username, db_owner, db_folder, db_name, db_version, query, duration_ms, row_count,
+			cached)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	commandTag, err := pdb.Exec(dbQuery, userName, dbOwner, dbFolder, dbName, dbVersion, query,
+		int64(duration/time.Millisecond), rowCount, cached)
 	if err != nil {
-		return -1, err
+		log.Printf("Adding query history entry for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when adding query history for user '%s'\n", numRows,
+			userName)
 	}
+	return nil
+}
 
-	// Retrieve the updated star count
+// Adds a status check context which needs to pass before merge requests to a database can be accepted.
+func AddRequiredStatusCheck(dbOwner string, dbFolder string, dbName string, checkContext string,
+	userName string) error {
 	dbQuery := `
-		SELECT stars
+		INSERT INTO required_status_checks (db, context, added_by)
+		SELECT idnum, $4, $5
 		FROM sqlite_databases
-		WHERE idnum = $1`
-	err = pdb.QueryRow(dbQuery, dbID).Scan(&starCount)
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		ON CONFLICT (db, context) DO NOTHING`
+	_, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, checkContext, userName)
 	if err != nil {
-		log.Printf("Error looking up star count for database '%s/%s'. Error: %v\n", dbOwner, dbName, err)
-		return -1, err
+		log.Printf("Adding required status check '%s' to database '%s%s%s' failed: %v\n", checkContext, dbOwner,
+			dbFolder, dbName, err)
+		return err
 	}
-	return starCount, nil
+	return nil
 }
 
-// Returns the list of all database versions available to the requesting user
-func DBVersions(loggedInUser string, dbOwner string, dbFolder string, dbName string) ([]int, error) {
+// Records a new takedown request for a database, which then waits for admin review.
+func AddTakedownRequest(t Takedown) (id int64, err error) {
 	dbQuery := `
-		SELECT version
-		FROM database_versions
-		WHERE db = (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-				AND folder = $2
-				AND dbname = $3`
-	if loggedInUser != dbOwner {
-		// The request is for another users database, so only return public versions
-		dbQuery += `
-				AND public is true`
-	}
-	dbQuery += `
-			)
-		ORDER BY version DESC`
-	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+		INSERT INTO takedown_requests (db_owner, db_folder, db_name, complainant_name, complainant_email,
+			description, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING idnum`
+	err = pdb.QueryRow(dbQuery, t.DBOwner, t.DBFolder, t.DBName, t.ComplainantName, t.ComplainantEmail,
+		t.Description, TakedownPending).Scan(&id)
 	if err != nil {
-		log.Printf("Database query failed: %v\n", err)
-		return nil, err
+		log.Printf("Adding takedown request for '%s%s%s' failed: %v\n", t.DBOwner, t.DBFolder, t.DBName, err)
+		return 0, err
 	}
-	defer rows.Close()
-	var verList []int
-	for rows.Next() {
-		var ver int
-		err = rows.Scan(&ver)
+	return id, nil
+}
+
+// Publishes a new version of the terms of service and privacy policy.  Users need to accept it before they can carry
+// on using the site.
+func AddTermsVersion(terms string, privacy string) (version int, err error) {
+	dbQuery := `
+		INSERT INTO terms_versions (terms, privacy)
+		VALUES ($1, $2)
+		RETURNING idnum`
+	err = pdb.QueryRow(dbQuery, terms, privacy).Scan(&version)
+	if err != nil {
+		log.Printf("Adding new terms version failed: %v\n", err)
+		return 0, err
+	}
+	return version, nil
+}
+
+// Add a user to the system, linked to the login provider identity they registered with.
+func AddUser(ident LoginIdentity, userName string, password string) error {
+	// Hash the user's password
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Failed to hash user password. User: '%v', error: %v.\n", userName, err)
+		return err
+	}
+
+	// Generate a unique bucket name for the user
+	var bucket string
+	newBucket := true
+	for newBucket == true {
+		bucket = RandomString(16) + ".bkt"
+		newBucket, err = MinioBucketExists(bucket) // Drops out of the loop when the name hasn't been used yet
 		if err != nil {
-			log.Printf("Error retrieving version list for '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
-				err)
-			return nil, err
+			log.Printf("Error when checking if Minio bucket already exists: %v\n", err)
+			return err
 		}
-		verList = append(verList, ver)
 	}
 
-	// Safety checks
-	numResults := len(verList)
-	if numResults == 0 {
-		return nil, errors.New("Empty list returned instead of version list.  This shouldn't happen")
+	// Generate a new HTTPS client certificate for the user
+	cert, err := GenerateClientCert(userName, SigningCertDefaultDays())
+	if err != nil {
+		log.Printf("Error when generating client certificate for '%s': %v\n", userName, err)
+		return err
 	}
 
-	return verList, nil
+	// Add the new user to the database
+	insertQuery := `
+		INSERT INTO users (username, email, password_hash, client_certificate, minio_bucket)
+		VALUES ($1, $2, $3, $4, $5)`
+	commandTag, err := pdb.Exec(insertQuery, userName, ident.Email, hash, cert, bucket)
+	if err != nil {
+		log.Printf("Adding user to database failed: %v\n", err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected when creating user: %v, username: %v\n", numRows, userName)
+	}
+	err = RegisterClientCert(userName, "DB4S certificate", cert)
+	if err != nil {
+		return err
+	}
+	err = LinkIdentity(userName, ident)
+	if err != nil {
+		return err
+	}
+
+	// Create a new bucket for the user in Minio
+	err = CreateMinioBucket(bucket)
+	if err != nil {
+		log.Printf("Error creating new bucket: %v\n", err)
+		return err
+	}
+
+	// Log the user registration
+	log.Printf("User registered: '%s' Email: '%s' Provider: '%s'\n", userName, ident.Email, ident.Provider)
+
+	return nil
 }
 
-// Disconnects the PostgreSQL database connection.
-func DisconnectPostgreSQL() {
-	pdb.Close()
+// Add a new SQLite database for a user.  The author of the new version defaults to the owner if not given, and the
+// branch defaults to the main one.
+func AddDatabase(dbOwner string, dbFolder string, dbName string, dbVer int, shaSum []byte, dbSize int, storedSize int, public bool, bucket string, id string, descrip string, readme string, commitMsg string, author string, branch string) error {
+	return addDatabase(dbOwner, dbFolder, dbName, dbVer, shaSum, dbSize, storedSize, public, bucket, id, descrip, readme,
+		commitMsg, author, branch, nil)
 }
 
-// Fork the PostgreSQL entry for a SQLite database from one user to another
-func ForkDatabase(srcOwner string, srcFolder string, dbName string, srcVer int, dstOwner string,
-	dstFolder string, dstMinioID string) (int, error) {
+// Adds a new version of a database, creating the database first if it's the first version.  The new version is
+// linked into the lineage chain and commit history, unless the links are given.
+func addDatabase(dbOwner string, dbFolder string, dbName string, dbVer int, shaSum []byte, dbSize int, storedSize int, public bool, bucket string, id string, descrip string, readme string, commitMsg string, author string, branch string, lineage *versionLineage) error {
+	// Check for values which should be NULL
+	var nullableDescrip, nullableReadme pgx.NullString
+	if descrip == "" {
+		nullableDescrip.Valid = false
+	} else {
+		nullableDescrip.String = descrip
+		nullableDescrip.Valid = true
+	}
+	if readme == "" {
+		nullableReadme.Valid = false
+	} else {
+		nullableReadme.String = readme
+		nullableReadme.Valid = true
+	}
 
-	// Retrieve the Minio bucket for the owner
-	dstBucket, err := MinioUserBucket(dstOwner)
-	if err != nil {
-		log.Printf("Error looking up Minio bucket for user '%s': %v\n", dstOwner, err.Error())
-		return 0, err
+	// If it's a new database, add its details to the main PG sqlite_databases table
+	var dbQuery string
+	if dbVer == 1 {
+		dbQuery = `
+			WITH root_db_value AS (
+				SELECT nextval('sqlite_databases_idnum_seq')
+			)
+			INSERT INTO sqlite_databases (username, folder, dbname, public, idnum, minio_bucket, root_database, description, readme)
+			VALUES ($1, $2, $3, $4, (SELECT nextval FROM root_db_value), $5, (SELECT nextval FROM root_db_value), $6, $7)`
+		commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, public, bucket, nullableDescrip,
+			nullableReadme)
+		if err != nil {
+			log.Printf("Adding database to PostgreSQL failed: %v\n", err)
+			return err
+		}
+		if numRows := commandTag.RowsAffected(); numRows != 1 {
+			log.Printf("Wrong number of rows (%v) affected when creating initial sqlite_databases "+
+				"entry for '%s%s/%s'\n", numRows, dbOwner, dbFolder, dbName)
+		}
+
+		// Let anyone @mentioned in the README of a new public database know about it
+		if public {
+			NotifyMentions(dbOwner, dbOwner, dbFolder, dbName, "", readme)
+		}
 	}
 
-	// Copy the main database entry
-	dbQuery := `
-		INSERT INTO sqlite_databases (username, folder, dbname, public, forks, description, readme, minio_bucket, root_database, forked_from)
-		SELECT $1, $2, dbname, public, forks, description, readme, $3, root_database, idnum
-		FROM sqlite_databases
-		WHERE username = $4
-			AND folder = $5
-			AND dbname = $6`
-	commandTag, err := pdb.Exec(dbQuery, dstOwner, dstFolder, dstBucket, srcOwner, srcFolder, dbName)
-	if err != nil {
-		log.Printf("Forking database '%s%s/%s' version %d entry in PostgreSQL failed: %v\n",
-			srcOwner, srcFolder, dbName, srcVer, err)
-		return 0, err
+	if branch == "" {
+		branch = DefaultBranch
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong number of rows affected (%d) when forking main database entry: "+
-			"'%s%s%s' version %d to '%s%s%s'\n", numRows, srcOwner, srcFolder, dbName, srcVer, dstOwner,
-			dstFolder, dbName)
+	if author == "" {
+		author = dbOwner
+	}
+	sha := hex.EncodeToString(shaSum[:])
+	if lineage == nil {
+		var err error
+		lineage, err = newVersionLineage(dbOwner, dbFolder, dbName, dbVer, sha, author, commitMsg, branch)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Add a new database version entry
+	// Add the database to database_versions
 	dbQuery = `
-		WITH new_db AS (
+		WITH databaseid AS (
 			SELECT idnum
 			FROM sqlite_databases
 			WHERE username = $1
 				AND folder = $2
-				AND dbname = $3
-		)
-		INSERT INTO database_versions (db, size, version, sha256, minioid)
-		SELECT new_db.idnum, ver.size, 1, ver.sha256, $4
-		FROM new_db, database_versions AS ver
-		WHERE db = (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $5
-				AND folder = $6
-				AND dbname = $3
-			)
-			AND version = $7`
-	commandTag, err = pdb.Exec(dbQuery, dstOwner, dstFolder, dbName, dstMinioID, srcOwner, srcFolder, srcVer)
+				AND dbname = $3)
+		INSERT INTO database_versions (db, size, version, sha256, minioid, compressed_size, date_created,
+			last_modified, prev_hash, chain_hash, commit_id, parent_commit, author, message, branch)
+		SELECT idnum, $4, $5, $6, $7, $8, $9, $9, nullif($10, ''), $11, $12, nullif($13, ''), $15, nullif($14, ''),
+			$16
+		FROM databaseid`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, dbSize, dbVer, sha, id, storedSize,
+		lineage.Created, lineage.PrevHash, lineage.ChainHash, lineage.CommitID, lineage.ParentCommit, commitMsg, author,
+		branch)
 	if err != nil {
-		log.Printf("Forking database entry in PostgreSQL failed: %v\n", err)
-		return 0, err
-	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong number of rows affected (%d) when forking database version entry: "+
-			"'%s%s%s' version %d to '%s%s%s'\n", numRows, srcOwner, srcFolder, dbName, srcVer, dstOwner,
-			dstFolder, dbName)
+		log.Printf("Adding version info to PostgreSQL failed: %v\n", err)
+		return err
 	}
 
-	// Increment the forks count for the root database
+	// Update the last_modified date, branch count, and contributor count for the database in sqlite_databases
 	dbQuery = `
 		UPDATE sqlite_databases
-		SET forks = forks + 1
-		WHERE idnum = (
-			SELECT root_database
-			FROM sqlite_databases
-			WHERE username = $1
-				AND folder = $2
-				AND dbname = $3
-			)
-		RETURNING forks`
-	var newForks int
-	err = pdb.QueryRow(dbQuery, dstOwner, dstFolder, dbName).Scan(&newForks)
+		SET last_modified = (
+			SELECT last_modified
+			FROM database_versions
+			WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)
+				AND version = $4),
+			branches = (
+				SELECT count(DISTINCT branch)
+				FROM database_versions
+				WHERE db = sqlite_databases.idnum),
+			contributors = (
+				SELECT count(DISTINCT coalesce(author, sqlite_databases.username))
+				FROM database_versions
+				WHERE db = sqlite_databases.idnum)
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err = pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, dbVer)
 	if err != nil {
-		log.Printf("Updating fork count in PostgreSQL failed: %v\n", err)
-		return 0, err
+		log.Printf("Updating last_modified date in PostgreSQL failed: %v\n", err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected: %v, user: %s, database: %v\n", numRows, dbOwner, dbName)
 	}
 
-	return newForks, nil
+	// Invalidate the cached data for any previous versions of the database
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
 }
 
-// Checks if the given database was forked from another, and if so returns that one's owner, folder and database name
-func ForkedFrom(dbOwner string, dbFolder string, dbName string) (forkOwn string, forkFol string, forkDB string,
-	err error) {
-	// Check if the database was forked from another
-	var idnum, forkedFrom pgx.NullInt32
+// Adds a database version copied from a replication source.  The version keeps the creation date, commit ID and
+// lineage hashes it has on the source, so commit links, status checks and lineage heads carry across to the standby.
+func AddReplicatedDatabase(c ReplicationChange, shaSum []byte, dbSize int, storedSize int, bucket string, id string) error {
+	lineage := &versionLineage{
+		ChainHash:    c.ChainHash,
+		CommitID:     c.CommitID,
+		Created:      c.DateCreated,
+		ParentCommit: c.ParentCommit,
+		PrevHash:     c.PrevHash,
+	}
+	return addDatabase(c.Owner, c.Folder, c.Name, c.Version, shaSum, dbSize, storedSize, c.Public, bucket, id,
+		c.Description, c.Readme, c.Message, c.Author, c.Branch, lineage)
+}
+
+// Adds a validation rule to a database.
+func AddValidationRule(dbOwner string, dbFolder string, dbName string, rule ValidationRule) error {
 	dbQuery := `
-		SELECT idnum, forked_from
+		INSERT INTO validation_rules (db, name, kind, table_name, column_name, min_value, max_value, query,
+			created_by)
+		SELECT idnum, $4, $5, nullif($6, ''), nullif($7, ''), $8, $9, nullif($10, ''), $11
 		FROM sqlite_databases
 		WHERE username = $1
 			AND folder = $2
 			AND dbname = $3`
-	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&idnum, &forkedFrom)
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, rule.Name, rule.Kind, rule.Table, rule.Column,
+		rule.Min, rule.Max, rule.Query, rule.CreatedBy)
 	if err != nil {
-		log.Printf("Error checking if database was forked from another '%s%s%s'. Error: %v\n", dbOwner,
-			dbFolder, dbName, err)
-		return "", "", "", err
+		log.Printf("Adding validation rule to database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
 	}
-	if !forkedFrom.Valid {
-		// The database wasn't forked, so return empty strings
-		return "", "", "", nil
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when adding validation rule to '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
 	}
+	return nil
+}
 
-	// Return the details of the database this one was forked from
-	dbQuery = `
-		SELECT username, folder, dbname
-		FROM sqlite_databases
-		WHERE idnum = $1`
-	err = pdb.QueryRow(dbQuery, forkedFrom).Scan(&forkOwn, &forkFol, &forkDB)
+// Returns the storage details for every database version on the system.
+func AllDBVersions() (list []StoredDBVersion, err error) {
+	dbQuery := `
+		SELECT ver.idnum, db.username, db.folder, db.dbname, ver.version, db.minio_bucket, ver.minioid, ver.size,
+			ver.sha256
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+		ORDER BY db.username, db.folder, db.dbname, ver.version`
+	rows, err := pdb.Query(dbQuery)
 	if err != nil {
-		log.Printf("Error retrieving forked database information for '%s%s%s'. Error: %v\n", dbOwner,
-			dbFolder, dbName, err)
-		return "", "", "", err
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
 	}
-	return forkOwn, forkFol, forkDB, nil
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow StoredDBVersion
+		err = rows.Scan(&oneRow.ID, &oneRow.Owner, &oneRow.Folder, &oneRow.DBName, &oneRow.Version,
+			&oneRow.MinioBkt, &oneRow.MinioID, &oneRow.Size, &oneRow.SHA256)
+		if err != nil {
+			log.Printf("Error retrieving database version list: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
 }
 
-// Return the complete fork tree for a given database
-func ForkTree(loggedInUser string, dbOwner string, dbFolder string, dbName string) (outputList []ForkEntry, err error) {
+// Returns all announcements, including past and future ones, newest first.
+func Announcements() (list []Announcement, err error) {
 	dbQuery := `
-		SELECT username, folder, dbname, public, idnum, forked_from
-		FROM sqlite_databases
-		WHERE root_database = (
-				SELECT root_database
-				FROM sqlite_databases
-				WHERE username = $1
-					AND folder = $2
-					AND dbname = $3
-				)
-		ORDER BY forked_from NULLS FIRST`
-	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+		SELECT idnum, message, level, starts, ends
+		FROM announcements
+		ORDER BY starts DESC`
+	rows, err := pdb.Query(dbQuery)
 	if err != nil {
 		log.Printf("Database query failed: %v\n", err)
 		return nil, err
 	}
 	defer rows.Close()
-	var dbList []ForkEntry
 	for rows.Next() {
-		var frk pgx.NullInt32
-		var oneRow ForkEntry
-		err = rows.Scan(&oneRow.Owner, &oneRow.Folder, &oneRow.DBName, &oneRow.Public, &oneRow.ID, &frk)
+		var oneRow Announcement
+		err = rows.Scan(&oneRow.ID, &oneRow.Message, &oneRow.Level, &oneRow.Starts, &oneRow.Ends)
 		if err != nil {
-			log.Printf("Error retrieving fork list for '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
-				err)
+			log.Printf("Error retrieving announcements: %v\n", err)
 			return nil, err
 		}
-		if frk.Valid {
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the personal API tokens a user has created which haven't expired, newest first.
+func APITokens(userName string) (list []APIToken, err error) {
+	dbQuery := `
+		SELECT token_id, name, scope, date_created, expiry, last_used, last_used_ip, last_used_endpoint
+		FROM api_tokens
+		WHERE username = $1
+			AND (expiry IS NULL OR expiry > now())
+		ORDER BY date_created DESC`
+	rows, err := pdb.Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow APIToken
+		var expiry, lastUsed pgx.NullTime
+		var ip, endpoint pgx.NullString
+		err = rows.Scan(&oneRow.ID, &oneRow.Name, &oneRow.Scope, &oneRow.DateCreated, &expiry, &lastUsed, &ip,
+			&endpoint)
+		if err != nil {
+			log.Printf("Error retrieving API tokens for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		if expiry.Valid {
+			oneRow.Expiry = &expiry.Time
+		}
+		if lastUsed.Valid {
+			oneRow.LastUse = CredentialUse{Endpoint: endpoint.String, IP: ip.String, LastUsed: lastUsed.Time}
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the user and scope a personal API token was created for.  If the token is unknown or has expired, or the
+// user has been disabled, the returned user name is empty.
+func APITokenUser(token string) (userName string, scope string, err error) {
+	dbQuery := `
+		SELECT t.username, t.scope
+		FROM api_tokens AS t, users AS u
+		WHERE t.username = u.username
+			AND t.token_hash = $1
+			AND (t.expiry IS NULL OR t.expiry > now())
+			AND u.disabled = false`
+	err = pdb.QueryRow(dbQuery, tokenHash(token)).Scan(&userName, &scope)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", "", nil
+		}
+		log.Printf("Error retrieving API token details: %v\n", err)
+		return "", "", err
+	}
+	return userName, scope, nil
+}
+
+// Returns the details of an attachment, along with whether the database it's attached to is public.
+func AttachmentDetails(id string) (a Attachment, found bool, err error) {
+	dbQuery := `
+		SELECT att.id, db.username, db.folder, db.dbname, db.public, att.uploader, att.file_name,
+			att.content_type, att.size, att.minio_bucket, att.minio_id, att.date_created
+		FROM attachments AS att, sqlite_databases AS db
+		WHERE att.db = db.idnum
+			AND att.id = $1`
+	err = readDB().QueryRow(dbQuery, id).Scan(&a.ID, &a.Owner, &a.Folder, &a.DBName, &a.Public, &a.Uploader,
+		&a.FileName, &a.ContentType, &a.Size, &a.MinioBkt, &a.MinioID, &a.DateCreated)
+	if err == pgx.ErrNoRows {
+		return a, false, nil
+	}
+	if err != nil {
+		log.Printf("Error retrieving attachment '%s': %v\n", id, err)
+		return a, false, err
+	}
+	return a, true, nil
+}
+
+// Returns the latest version on a branch of a database.
+func BranchHead(dbOwner string, dbFolder string, dbName string, branch string) (head BranchHead, found bool,
+	err error) {
+	dbQuery := `
+		SELECT ver.branch, coalesce(ver.commit_id, ''), ver.minioid, ver.sha256, ver.size,
+			coalesce(ver.compressed_size, ver.size), ver.version
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.branch = $4
+		ORDER BY ver.version DESC
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, branch).Scan(&head.Branch, &head.CommitID,
+		&head.MinioID, &head.SHA256, &head.Size, &head.StoredSize, &head.Version)
+	if err == pgx.ErrNoRows {
+		return BranchHead{}, false, nil
+	}
+	if err != nil {
+		log.Printf("Error retrieving latest version on branch '%s' of '%s%s%s': %v\n", branch, dbOwner, dbFolder,
+			dbName, err)
+		return BranchHead{}, false, err
+	}
+	return head, true, nil
+}
+
+// Returns the latest version on each branch of a database, ordered by branch name.
+func BranchHeads(dbOwner string, dbFolder string, dbName string) (list []BranchHead, err error) {
+	dbQuery := `
+		SELECT DISTINCT ON (ver.branch) ver.branch, coalesce(ver.commit_id, ''), ver.minioid, ver.sha256, ver.size,
+			coalesce(ver.compressed_size, ver.size), ver.version
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY ver.branch, ver.version DESC`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h BranchHead
+		err = rows.Scan(&h.Branch, &h.CommitID, &h.MinioID, &h.SHA256, &h.Size, &h.StoredSize, &h.Version)
+		if err != nil {
+			log.Printf("Error retrieving branches of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+// Returns true if a branch of a database is protected.  The main branch is used when no branch is given, the same as
+// for uploads.
+func BranchProtected(dbOwner string, dbFolder string, dbName string, branch string) (protected bool, err error) {
+	if branch == "" {
+		branch = DefaultBranch
+	}
+	dbQuery := `
+		SELECT count(*) > 0
+		FROM protected_branches AS pro, sqlite_databases AS db
+		WHERE pro.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND pro.branch = $4`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, branch).Scan(&protected)
+	if err != nil {
+		log.Printf("Error checking if branch '%s' of database '%s%s%s' is protected: %v\n", branch, dbOwner,
+			dbFolder, dbName, err)
+		return false, err
+	}
+	return protected, nil
+}
+
+// Adds a notification to the notification inbox of every user.
+func BroadcastNotification(kind string, message string, link string) error {
+	dbQuery := `
+		INSERT INTO notifications (username, kind, message, link)
+		SELECT username, $1, $2, $3
+		FROM users`
+	commandTag, err := pdb.Exec(dbQuery, kind, message, link)
+	if err != nil {
+		log.Printf("Broadcasting notification failed: %v\n", err)
+		return err
+	}
+	log.Printf("Notification sent to %d user(s)\n", commandTag.RowsAffected())
+	return nil
+}
+
+// Returns the cached virus scanner verdict for some database content, if there is one.
+func CachedScanVerdict(sha string) (verdict ScanVerdict, found bool, err error) {
+	dbQuery := `
+		SELECT sha256, clean, detail, date_scanned
+		FROM scan_verdicts
+		WHERE sha256 = $1`
+	err = pdb.QueryRow(dbQuery, sha).Scan(&verdict.SHA256, &verdict.Clean, &verdict.Detail, &verdict.DateScanned)
+	if err == pgx.ErrNoRows {
+		return verdict, false, nil
+	}
+	if err != nil {
+		log.Printf("Error retrieving scan verdict for '%s': %v\n", sha, err)
+		return verdict, false, err
+	}
+	return verdict, true, nil
+}
+
+// Returns true if a user can manage the databases of an owner, changing their settings and sharing them.  Users can
+// manage their own databases, and those of organisations they're an owner or admin of.
+func CanManageDBs(dbOwner string, userName string) (bool, error) {
+	if dbOwner == userName {
+		return true, nil
+	}
+	role, err := OrgRole(dbOwner, userName)
+	if err != nil {
+		return false, err
+	}
+	return role == OrgRoleOwner || role == OrgRoleAdmin, nil
+}
+
+// Returns the live databases which have been changed since their last snapshot.  Archived databases are left out, so
+// they aren't snapshotted until they're unarchived.
+func ChangedLiveDBs() (list []LiveDB, err error) {
+	dbQuery := `
+		SELECT idnum, username, folder, dbname
+		FROM sqlite_databases
+		WHERE live = true
+			AND live_changed = true
+			AND archived = false
+		ORDER BY idnum`
+	rows, err := pdb.Query(dbQuery)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow LiveDB
+		err = rows.Scan(&oneRow.ID, &oneRow.Owner, &oneRow.Folder, &oneRow.DBName)
+		if err != nil {
+			log.Printf("Error retrieving changed live databases: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Check if a database has been starred by a given user.  The boolean return value is only valid when err is nil.
+func CheckDBStarred(loggedInUser string, dbOwner string, dbFolder string, dbName string) (bool, error) {
+	dbQuery := `
+		SELECT count(db)
+		FROM database_stars
+		WHERE database_stars.username = $1
+		AND database_stars.db = (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $2
+				AND folder = $3
+				AND dbname = $4)`
+	var starCount int
+	err := pdb.QueryRow(dbQuery, loggedInUser, dbOwner, dbFolder, dbName).Scan(&starCount)
+	if err != nil {
+		log.Printf("Error looking up star count for database. User: '%s' DB: '%s/%s'. Error: %v\n",
+			loggedInUser, dbOwner, dbName, err)
+		return true, err
+	}
+	if starCount == 0 {
+		// Database hasn't been starred by the user
+		return false, nil
+	}
+
+	// Database HAS been starred by the user
+	return true, nil
+}
+
+// Returns true if the user is watching the given database.
+func CheckDBWatched(loggedInUser string, dbOwner string, dbFolder string, dbName string) (bool, error) {
+	dbQuery := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM database_watches AS w, sqlite_databases AS db
+			WHERE w.db = db.idnum
+				AND w.username = $1
+				AND db.username = $2
+				AND db.folder = $3
+				AND db.dbname = $4)`
+	var watching bool
+	err := pdb.QueryRow(dbQuery, loggedInUser, dbOwner, dbFolder, dbName).Scan(&watching)
+	if err != nil {
+		log.Printf("Error checking if user '%s' watches '%s%s%s': %v\n", loggedInUser, dbOwner, dbFolder, dbName,
+			err)
+		return false, err
+	}
+	return watching, nil
+}
+
+// Check if an email address already exists in our system. Returns true if the email is already in the system, false
+// if not.  If an error occurred, the true/false value should be ignored, as only the error value is valid.
+func CheckEmailExists(email string) (bool, error) {
+	// Check if the email address is already in our system
+	dbQuery := `
+		SELECT count(username)
+		FROM users
+		WHERE email = $1`
+	var emailCount int
+	err := pdb.QueryRow(dbQuery, email).Scan(&emailCount)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return true, err
+	}
+	if emailCount == 0 {
+		// Email address isn't yet in our system
+		return false, nil
+	}
+
+	// Email address IS already in our system
+	return true, nil
+
+}
+
+// Checks if a given MinioID string is available for use by a user. Returns true if available, false if not.  Only
+// if err returns a non-nil value.
+func CheckMinioIDAvail(userName string, id string) (bool, error) {
+	// Check if an existing database for the user already uses the given MinioID
+	var dbVer int
+	dbQuery := `
+		WITH user_databases AS (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1)
+		SELECT ver.version
+		FROM database_versions AS ver, user_databases AS db
+		WHERE ver.db = db.idnum
+			AND ver.minioid = $2`
+	err := pdb.QueryRow(dbQuery, userName, id).Scan(&dbVer)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// Not a real error, there just wasn't a matching row
+			return true, nil
+		}
+
+		// A real database error occurred
+		log.Printf("Error checking if a MinioID is already taken: %v\n", err)
+		return false, err
+	}
+
+	if dbVer == 0 {
+		// Nothing already using the MinioID, so it's available for use
+		return true, nil
+	}
+
+	// The MinioID is already in use
+	return false, nil
+}
+
+// Checks the secret given by an OAuth client application is correct.
+func CheckOAuthClientSecret(clientID string, secret string) (bool, error) {
+	var secretHash []byte
+	dbQuery := `
+		SELECT client_secret_hash
+		FROM oauth_clients
+		WHERE client_id = $1`
+	err := pdb.QueryRow(dbQuery, clientID).Scan(&secretHash)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		log.Printf("Error retrieving secret for OAuth client '%s': %v\n", clientID, err)
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword(secretHash, []byte(secret)) == nil, nil
+}
+
+// Check if a user has access to a specific version of a database.
+func CheckUserDBVAccess(dbOwner string, dbFolder string, dbName string, dbVer int, loggedInUser string) (bool, error) {
+	dbQuery := `
+		SELECT version
+		FROM database_versions
+		WHERE db = (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND folder = $2
+				AND dbname = $3`
+	args := []interface{}{dbOwner, dbFolder, dbName, dbVer}
+	if dbOwner != loggedInUser {
+		// Other users can only access public databases, and private ones which have been shared with them
+		dbQuery += `
+				AND (public = true OR idnum IN (SELECT db FROM database_access WHERE username = $5))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+			)
+			AND version = $4`
+	var numRows int
+	err := pdb.QueryRow(dbQuery, args...).Scan(&numRows)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// The requested database version isn't available to the given user
+			return false, nil
+		}
+		log.Printf("Error when checking user's access to database '%s%s%s'. User: '%s' Error: %v\n",
+			dbOwner, dbFolder, dbName, loggedInUser, err.Error())
+		return false, err
+	}
+
+	// A row was returned, so the requested database IS available to the given user
+	return true, nil
+}
+
+// Check if a username already exists in our system.  Returns true if the username is already taken, false if not.
+// If an error occurred, the true/false value should be ignored, and only the error return code used.
+func CheckUserExists(userName string) (bool, error) {
+	dbQuery := `
+		SELECT count(username)
+		FROM users
+		WHERE username = $1`
+	var userCount int
+	err := pdb.QueryRow(dbQuery, userName).Scan(&userCount)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return true, err
+	}
+	if userCount == 0 {
+		// Username isn't in system
+		return false, nil
+	}
+	// Username IS in system
+	return true, nil
+}
+
+// Removes all of the cached virus scanner verdicts, returning how many there were.
+func ClearScanVerdicts() (int64, error) {
+	commandTag, err := pdb.Exec(`DELETE FROM scan_verdicts`)
+	if err != nil {
+		log.Printf("Clearing scan verdicts failed: %v\n", err)
+		return 0, err
+	}
+	return commandTag.RowsAffected(), nil
+}
+
+// Returns the certificate for a given user.
+func ClientCert(userName string) ([]byte, error) {
+	var cert []byte
+	err := pdb.QueryRow(`
+		SELECT client_certificate
+		FROM users
+		WHERE username = $1`, userName).Scan(&cert)
+	if err != nil {
+		log.Printf("Retrieving client cert for '%s' from database failed: %v\n", userName, err)
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// Returns the user a client certificate was issued to, and whether it's been revoked, given its serial number.  If
+// the certificate isn't known, the returned user name is empty.
+func clientCertOwner(serial string) (userName string, revoked bool, err error) {
+	dbQuery := `
+		SELECT username, revoked IS NOT NULL
+		FROM client_certs
+		WHERE serial = $1`
+	err = pdb.QueryRow(dbQuery, serial).Scan(&userName, &revoked)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", false, nil
+		}
+		log.Printf("Error looking up client certificate '%s': %v\n", serial, err)
+		return "", false, err
+	}
+	return userName, revoked, nil
+}
+
+// Returns the client certificates issued to a user, including revoked and expired ones, newest first.
+func ClientCerts(userName string) (list []ClientCertificate, err error) {
+	dbQuery := `
+		SELECT cert_id, name, serial, date_created, expiry, expiry <= now(), revoked, last_used, last_used_ip,
+			last_used_endpoint
+		FROM client_certs
+		WHERE username = $1
+		ORDER BY date_created DESC`
+	rows, err := pdb.Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow ClientCertificate
+		var revoked, lastUsed pgx.NullTime
+		var ip, endpoint pgx.NullString
+		err = rows.Scan(&oneRow.ID, &oneRow.Name, &oneRow.Serial, &oneRow.DateCreated, &oneRow.Expiry,
+			&oneRow.Expired, &revoked, &lastUsed, &ip, &endpoint)
+		if err != nil {
+			log.Printf("Error retrieving client certificates for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		if revoked.Valid {
+			oneRow.Revoked = &revoked.Time
+		}
+		if lastUsed.Valid {
+			oneRow.LastUse = CredentialUse{Endpoint: endpoint.String, IP: ip.String, LastUsed: lastUsed.Time}
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Closes an open merge request without merging it.
+func CloseMergeRequest(dbOwner string, dbFolder string, dbName string, id int64, userName string) error {
+	dbQuery := `
+		UPDATE merge_requests
+		SET state = $5, closed_by = $6, date_closed = timezone('utc'::text, now())
+		WHERE mr_id = $4
+			AND state = $7
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, id, MergeRequestClosed, userName,
+		MergeRequestOpen)
+	if err != nil {
+		log.Printf("Closing merge request %d of '%s%s%s' failed: %v\n", id, dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("That merge request isn't open")
+	}
+	return updateMergeRequestCount(dbOwner, dbFolder, dbName)
+}
+
+// Returns the column documentation for a database, keyed by table then column.
+func ColumnDocs(dbOwner string, dbFolder string, dbName string) (map[string]map[string]string, error) {
+	dbQuery := `
+		SELECT doc.table_name, doc.column_name, doc.description
+		FROM column_docs AS doc, sqlite_databases AS db
+		WHERE doc.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3`
+	rows, err := readDB().Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Retrieving column docs for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	docs := make(map[string]map[string]string)
+	for rows.Next() {
+		var table, column, descrip string
+		err = rows.Scan(&table, &column, &descrip)
+		if err != nil {
+			log.Printf("Error retrieving column docs: %v\n", err)
+			return nil, err
+		}
+		if docs[table] == nil {
+			docs[table] = make(map[string]string)
+		}
+		docs[table][column] = descrip
+	}
+	return docs, nil
+}
+
+// Creates a connection pool to the PostgreSQL server.
+func ConnectPostgreSQL() (err error) {
+	pgPoolConfig := pgx.ConnPoolConfig{*pgConfig, PGConnections, nil, 2 * time.Second}
+	pdb, err = pgx.NewConnPool(pgPoolConfig)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't connect to PostgreSQL server: %v\n", err))
+	}
+
+	// Log successful connection message
+	log.Printf("Connected to PostgreSQL server: %v:%v\n", conf.Pg.Server, uint16(conf.Pg.Port))
+
+	// Connect to the read replicas.  They use the same credentials and database name as the primary server
+	for _, replica := range conf.Pg.Replicas {
+		replicaConfig := *pgConfig
+		replicaConfig.Host = replica.Server
+		replicaConfig.Port = uint16(replica.Port)
+		replicaPoolConfig := pgx.ConnPoolConfig{ConnConfig: replicaConfig, MaxConnections: PGConnections,
+			AcquireTimeout: 2 * time.Second}
+		replicaPool, err := pgx.NewConnPool(replicaPoolConfig)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Couldn't connect to PostgreSQL read replica: %v\n", err))
+		}
+		pdbReplicas = append(pdbReplicas, replicaPool)
+		log.Printf("Connected to PostgreSQL read replica: %v:%v\n", replica.Server, uint16(replica.Port))
+	}
+
+	return nil
+}
+
+// Creates a personal API token for a user, returning its ID and the token.  Tokens without an expiry time last until
+// they're revoked.
+func CreateAPIToken(userName string, name string, scope string, expiry *time.Time) (id int64, token string, err error) {
+	token, err = RandomToken()
+	if err != nil {
+		return 0, "", err
+	}
+	token = APITokenPrefix + token
+	dbQuery := `
+		INSERT INTO api_tokens (username, name, token_hash, scope, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING token_id`
+	err = pdb.QueryRow(dbQuery, userName, name, tokenHash(token), scope, expiry).Scan(&id)
+	if err != nil {
+		log.Printf("Adding API token for user '%s' failed: %v\n", userName, err)
+		return 0, "", err
+	}
+	return id, token, nil
+}
+
+// Creates a share link for a private database, which gives read-only access to it until the link expires or is
+// revoked.  Returns the link's token, which is only available now as just its hash is stored.
+func CreateShareLink(dbOwner string, dbFolder string, dbName string, name string, createdBy string,
+	expiry time.Time) (id int64, token string, err error) {
+	token, err = RandomToken()
+	if err != nil {
+		return 0, "", err
+	}
+	dbQuery := `
+		INSERT INTO share_links (db, name, token_hash, created_by, expiry)
+		SELECT idnum, $4, $5, $6, $7
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+			AND public = false
+		RETURNING link_id`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, name, tokenHash(token), createdBy, expiry).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return 0, "", errors.New("Share links can only be created for private databases")
+	}
+	if err != nil {
+		log.Printf("Adding share link for database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return 0, "", errors.New("Couldn't create the share link")
+	}
+	return id, token, nil
+}
+
+// Returns the current version of the terms of service and privacy policy.  If none have been published, the returned
+// version number is 0.
+func CurrentTerms() (t TermsVersion, err error) {
+	dbQuery := `
+		SELECT idnum, terms, privacy, date_published
+		FROM terms_versions
+		ORDER BY idnum DESC
+		LIMIT 1`
+	err = readDB().QueryRow(dbQuery).Scan(&t.Version, &t.Terms, &t.Privacy, &t.DatePublished)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return TermsVersion{}, nil
+		}
+		log.Printf("Error retrieving current terms version: %v\n", err)
+		return TermsVersion{}, err
+	}
+	return t, nil
+}
+
+// Returns the ID number for a given user's database.
+func databaseID(dbOwner string, dbFolder string, dbName string) (dbID int, err error) {
+	// Retrieve the database id
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&dbID)
+	if err != nil {
+		log.Printf("Error looking up database id. Owner: '%s', Folder: '%s', Database: '%s'. Error: %v\n",
+			dbOwner, dbFolder, dbName, err)
+	}
+	return
+}
+
+// Return a list of 1) users with public databases, 2) along with the logged in user's most recently modified database,
+// including their private one(s).
+func DB4SDefaultList(loggedInUser string) ([]UserInfo, error) {
+	dbQuery := `
+		WITH user_db_list AS (
+			SELECT DISTINCT ON (idnum) idnum, last_modified
+			FROM sqlite_databases
+			WHERE username = $1
+		), most_recent_user_db AS (
+			SELECT idnum, last_modified
+			FROM user_db_list
+			ORDER BY last_modified DESC
+			LIMIT 1
+		), public_dbs AS (
+			SELECT idnum, last_modified
+			FROM sqlite_databases
+			WHERE public = true
+			ORDER BY last_modified DESC
+		), public_users AS (
+			SELECT DISTINCT ON (db.username) db.username, db.last_modified
+			FROM public_dbs as pub, sqlite_databases AS db, most_recent_user_db AS usr
+			WHERE db.idnum = pub.idnum OR db.idnum = usr.idnum
+			ORDER BY db.username, db.last_modified DESC
+		)
+		SELECT username, last_modified FROM public_users
+		ORDER BY last_modified DESC`
+	rows, err := pdb.Query(dbQuery, loggedInUser)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var list []UserInfo
+	for rows.Next() {
+		var oneRow UserInfo
+		err = rows.Scan(&oneRow.Username, &oneRow.LastModified)
+		if err != nil {
+			log.Printf("Error retrieving database list for user: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+
+	return list, nil
+}
+
+// Returns whether a database has been archived by its owner.  Archived databases are read-only.
+func DBArchived(dbOwner string, dbFolder string, dbName string) (bool, error) {
+	dbQuery := `
+		SELECT archived
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	var archived bool
+	err := pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&archived)
+	if err == pgx.ErrNoRows {
+		// The database doesn't exist yet, so it can't be archived
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Error checking if database '%s%s%s' is archived: %v\n", dbOwner, dbFolder, dbName, err)
+		return false, err
+	}
+	return archived, nil
+}
+
+// Returns the commit history of a database, newest commit first.
+func DBCommits(loggedInUser string, dbOwner string, dbFolder string, dbName string) (list []CommitJSON, err error) {
+	dbQuery := `
+		SELECT coalesce(ver.commit_id, ''), coalesce(ver.parent_commit, ''), coalesce(ver.author, db.username),
+			coalesce(ver.message, ''), ver.version, ver.date_created, ver.size, ver.sha256
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3`
+	args := []interface{}{dbOwner, dbFolder, dbName}
+	if loggedInUser != dbOwner {
+		// The request is for another users database, so only return commits of public or shared ones
+		dbQuery += `
+			AND (db.public is true OR db.idnum IN (SELECT db FROM database_access WHERE username = $4))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+		ORDER BY ver.version DESC`
+	rows, err := readDB().Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CommitJSON
+		err = rows.Scan(&c.CommitID, &c.Parent, &c.Author, &c.Message, &c.Version, &c.DateCreated, &c.Size,
+			&c.SHA256)
+		if err != nil {
+			log.Printf("Error retrieving commit history for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// Returns how much each user has contributed to a database, with the most active contributors first.
+func DBContributors(loggedInUser string, dbOwner string, dbFolder string, dbName string) (list []ContributorStats, err error) {
+	dbQuery := `
+		SELECT coalesce(ver.author, db.username) AS contributor, count(*), coalesce(sum(ver.rows_changed), 0),
+			min(ver.date_created), max(ver.date_created)
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3`
+	args := []interface{}{dbOwner, dbFolder, dbName}
+	if loggedInUser != dbOwner {
+		// The request is for another users database, so it needs to be a public one, or shared with the user
+		dbQuery += `
+			AND (db.public is true OR db.idnum IN (SELECT db FROM database_access WHERE username = $4))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+		GROUP BY contributor
+		ORDER BY count(*) DESC, contributor`
+	rows, err := readDB().Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c ContributorStats
+		err = rows.Scan(&c.UserName, &c.Versions, &c.RowsChanged, &c.FirstContribution, &c.LastContribution)
+		if err != nil {
+			log.Printf("Error retrieving contributors of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// Retrieve the details for a specific database
+func DBDetails(ctx context.Context, DB *SQLiteDBinfo, loggedInUser string, dbOwner string, dbFolder string,
+	dbName string, dbVersion int) error {
+	dbQuery := `
+		SELECT ver.minioid, db.date_created, db.last_modified, ver.size, ver.version, db.watchers, db.stars,
+			db.discussions, db.pull_requests, db.updates, db.branches, db.releases, db.contributors,
+			db.description, db.readme, db.minio_bucket, db.default_table, db.public, db.noindex, ver.sha256,
+			db.archived, db.landing_tab, db.title, db.license, db.remote_origin, ver.branch, db.live
+		FROM sqlite_databases AS db, database_versions AS ver
+		WHERE db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND db.idnum = ver.db`
+	args := []interface{}{dbOwner, dbFolder, dbName}
+	if loggedInUser != dbOwner {
+		// * The request is for another users database, so it needs to be a public one, or shared with the user *
+		args = append(args, loggedInUser)
+		dbQuery += fmt.Sprintf(`
+			AND (db.public = true OR db.idnum IN (SELECT db FROM database_access WHERE username = $%d))`, len(args))
+	}
+	if dbVersion == 0 {
+		// No specific database version was requested, so use the highest available on the main branch
+		args = append(args, DefaultBranch)
+		dbQuery += fmt.Sprintf(`
+			AND ver.branch = $%d
+			ORDER BY version DESC
+			LIMIT 1`, len(args))
+	} else {
+		args = append(args, dbVersion)
+		dbQuery += fmt.Sprintf(`
+			AND ver.version = $%d`, len(args))
+	}
+
+	// Generate a predictable cache key for this functions' metadata.  Probably not sharable with other functions
+	// cached metadata
+	mdataCacheKey := MetadataCacheKey("meta", loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
+
+	// Use a cached version of the query response if it exists
+	ok, err := GetCachedData(ctx, mdataCacheKey, &DB)
+	if err != nil {
+		log.Printf("Error retrieving data from cache: %v\n", err)
+	}
+	if ok {
+		// Data was in cache, so we use that
+		return nil
+	}
+
+	// Retrieve the requested database details
+	var Desc, Readme, defTable, title, license, origin pgx.NullString
+	err = readDB().QueryRow(TraceSQL(ctx, dbQuery), args...).Scan(&DB.MinioId, &DB.Info.DateCreated, &DB.Info.LastModified,
+		&DB.Info.Size, &DB.Info.Version, &DB.Info.Watchers, &DB.Info.Stars, &DB.Info.Discussions, &DB.Info.MRs,
+		&DB.Info.Updates, &DB.Info.Branches, &DB.Info.Releases, &DB.Info.Contributors, &Desc, &Readme,
+		&DB.MinioBkt, &defTable, &DB.Info.Public, &DB.Info.NoIndex, &DB.Info.SHA256, &DB.Info.Archived,
+		&DB.Info.LandingTab, &title, &license, &origin, &DB.Info.Branch, &DB.Info.Live)
+	if err != nil {
+		return errors.New("The requested database doesn't exist")
+	}
+	if !Desc.Valid {
+		DB.Info.Description = "No description"
+	} else {
+		DB.Info.Description = Desc.String
+	}
+	if !Readme.Valid {
+		DB.Info.Readme = "No full description"
+	} else {
+		DB.Info.Readme = Readme.String
+	}
+	if !defTable.Valid {
+		DB.Info.DefaultTable = ""
+	} else {
+		DB.Info.DefaultTable = defTable.String
+	}
+	DB.Info.Title = title.String
+	DB.Info.LicenseName = license.String
+	DB.Info.RemoteOrigin = origin.String
+
+	// Fill out the fields we already have data for
+	DB.Info.Database = dbName
+	DB.Info.Folder = dbFolder
+
+	// Retrieve latest fork count
+	// TODO: This can probably be folded into the above SQL query as a subselect, as a minor optimisation
+	dbQuery = `
+		SELECT forks
+		FROM sqlite_databases
+		WHERE idnum = (
+			SELECT root_database
+			FROM sqlite_databases
+			WHERE username = $1
+			AND folder = $2
+			AND dbname = $3)`
+	err = readDB().QueryRow(TraceSQL(ctx, dbQuery), dbOwner, dbFolder, dbName).Scan(&DB.Info.Forks)
+	if err != nil {
+		log.Printf("Error retrieving fork count for '%s%s': %v\n", dbOwner, dbName, err)
+		return err
+	}
+
+	// Cache the database details.  Other users' requests share the same cache entry, which is read before their
+	// access is checked, so private databases shared with the user aren't cached
+	if DB.Info.Public || loggedInUser == dbOwner {
+		err = CacheData(ctx, mdataCacheKey, DB, 120)
+		if err != nil {
+			log.Printf("Error when caching page data: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the total number of times a database has been downloaded.
+func DBDownloads(dbOwner string, dbFolder string, dbName string) (downloads int64, err error) {
+	dbQuery := `
+		SELECT coalesce(sum(dl.downloads), 0)
+		FROM database_downloads AS dl, sqlite_databases AS db
+		WHERE db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND dl.db = db.idnum`
+	err = readDB().QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&downloads)
+	if err != nil {
+		log.Printf("Error looking up download count for database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return 0, err
+	}
+	return downloads, nil
+}
+
+// Returns the ID of a database, and whether it's a live one.  The ID is zero if the database doesn't exist.
+func DBLive(dbOwner string, dbFolder string, dbName string) (db LiveDB, live bool, err error) {
+	dbQuery := `
+		SELECT idnum, live
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&db.ID, &live)
+	if err == pgx.ErrNoRows {
+		return db, false, nil
+	}
+	if err != nil {
+		log.Printf("Error checking if database '%s%s%s' is live: %v\n", dbOwner, dbFolder, dbName, err)
+		return db, false, err
+	}
+	db.DBName = dbName
+	db.Folder = dbFolder
+	db.Owner = dbOwner
+	return db, live, nil
+}
+
+// Returns the review policy merge requests to a database need to meet before they can be accepted.
+func DBReviewPolicy(dbOwner string, dbFolder string, dbName string) (p ReviewPolicy, err error) {
+	dbQuery := `
+		SELECT review_min_approvals, review_owner_approval
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&p.MinApprovals, &p.OwnerApproval)
+	if err != nil {
+		log.Printf("Error retrieving review policy of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return p, err
+	}
+	return p, nil
+}
+
+// Returns the access level a user has to another user's database, or an empty string if they don't have any.  Members
+// of the organisation owning a database have read-write access to it, the same as if it had been shared with them.
+func DBShareAccess(dbOwner string, dbFolder string, dbName string, userName string) (access string, err error) {
+	dbQuery := `
+		SELECT share.access
+		FROM database_access AS share, sqlite_databases AS db
+		WHERE share.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND share.username = $4
+		ORDER BY share.access DESC
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, userName).Scan(&access)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		log.Printf("Error looking up access of '%s' to database '%s%s%s': %v\n", userName, dbOwner, dbFolder,
+			dbName, err)
+		return "", err
+	}
+	return access, nil
+}
+
+// Returns the users a database has been shared with, in alphabetical order.
+func DBShares(dbOwner string, dbFolder string, dbName string) (list []DBShare, err error) {
+	dbQuery := `
+		SELECT share.username, share.access, share.date_created
+		FROM database_shares AS share, sqlite_databases AS db
+		WHERE share.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY share.username`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s DBShare
+		err = rows.Scan(&s.UserName, &s.Access, &s.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving shares of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// Returns the star count for a given database.
+func DBStars(dbOwner string, dbFolder string, dbName string) (starCount int, err error) {
+	// Get the ID number of the database
+	dbID, err := databaseID(dbOwner, dbFolder, dbName)
+	if err != nil {
+		return -1, err
+	}
+
+	// Retrieve the updated star count
+	dbQuery := `
+		SELECT stars
+		FROM sqlite_databases
+		WHERE idnum = $1`
+	err = pdb.QueryRow(dbQuery, dbID).Scan(&starCount)
+	if err != nil {
+		log.Printf("Error looking up star count for database '%s/%s'. Error: %v\n", dbOwner, dbName, err)
+		return -1, err
+	}
+	return starCount, nil
+}
+
+// Returns the version number of the database commit with the given ID.  Commit IDs can be shortened, as long as the
+// start of the ID only matches one commit.  Returns 0 if no matching commit is available to the user.
+func DBVersionByCommit(loggedInUser string, dbOwner string, dbFolder string, dbName string, commit string) (int, error) {
+	dbQuery := `
+		SELECT ver.version
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.commit_id LIKE $4 || '%'`
+	args := []interface{}{dbOwner, dbFolder, dbName, commit}
+	if loggedInUser != dbOwner {
+		// The request is for another users database, so only look at commits of public or shared ones
+		dbQuery += `
+			AND (db.public is true OR db.idnum IN (SELECT db FROM database_access WHERE username = $5))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+		LIMIT 2`
+	rows, err := readDB().Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return 0, err
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		err = rows.Scan(&v)
+		if err != nil {
+			log.Printf("Error looking up commit '%s' of '%s%s%s': %v\n", commit, dbOwner, dbFolder, dbName, err)
+			return 0, err
+		}
+		versions = append(versions, v)
+	}
+	if len(versions) > 1 {
+		return 0, fmt.Errorf("More than one commit starts with '%s'", commit)
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[0], nil
+}
+
+// Finds the version of a user's database with the given SHA256, preferring the named database over any others of
+// theirs with the same content.  That way permalinks keep working after a database is renamed.  A version number of
+// 0 is returned if there's no match the logged in user has access to.
+func DBVersionBySHA256(loggedInUser string, dbOwner string, dbFolder string, dbName string, sha string) (name string, version int, err error) {
+	dbQuery := `
+		SELECT db.dbname, ver.version
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND ver.sha256 = $4`
+	args := []interface{}{dbOwner, dbFolder, dbName, sha}
+	if loggedInUser != dbOwner {
+		dbQuery += `
+			AND (db.public = true OR db.idnum IN (SELECT db FROM database_access WHERE username = $5))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+		ORDER BY db.dbname = $3 DESC, ver.version DESC
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, args...).Scan(&name, &version)
+	if err == pgx.ErrNoRows {
+		return "", 0, nil
+	}
+	if err != nil {
+		log.Printf("Error looking up SHA256 '%s' for user '%s': %v\n", sha, dbOwner, err)
+		return "", 0, err
+	}
+	return name, version, nil
+}
+
+// Returns the details of each database version available to the requesting user, newest first.
+func DBVersionDetails(loggedInUser string, dbOwner string, dbFolder string, dbName string) (list []DBVersionJSON, err error) {
+	dbQuery := `
+		SELECT ver.version, ver.date_created, ver.size, ver.sha256, ver.branch
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3`
+	args := []interface{}{dbOwner, dbFolder, dbName}
+	if loggedInUser != dbOwner {
+		// The request is for another users database, so only return versions of public or shared ones
+		dbQuery += `
+			AND (db.public is true OR db.idnum IN (SELECT db FROM database_access WHERE username = $4))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+		ORDER BY ver.version DESC`
+	rows, err := readDB().Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v DBVersionJSON
+		err = rows.Scan(&v.Version, &v.DateCreated, &v.Size, &v.SHA256, &v.Branch)
+		if err != nil {
+			log.Printf("Error retrieving version details for '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+				err)
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// Returns the list of all database versions available to the requesting user
+func DBVersions(loggedInUser string, dbOwner string, dbFolder string, dbName string) ([]int, error) {
+	dbQuery := `
+		SELECT version
+		FROM database_versions
+		WHERE db = (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND folder = $2
+				AND dbname = $3`
+	args := []interface{}{dbOwner, dbFolder, dbName}
+	if loggedInUser != dbOwner {
+		// The request is for another users database, so only return versions of public or shared ones
+		dbQuery += `
+				AND (public is true OR idnum IN (SELECT db FROM database_access WHERE username = $4))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+			)
+		ORDER BY version DESC`
+	rows, err := pdb.Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var verList []int
+	for rows.Next() {
+		var ver int
+		err = rows.Scan(&ver)
+		if err != nil {
+			log.Printf("Error retrieving version list for '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+				err)
+			return nil, err
+		}
+		verList = append(verList, ver)
+	}
+
+	// Safety checks
+	numResults := len(verList)
+	if numResults == 0 {
+		return nil, errors.New("Empty list returned instead of version list.  This shouldn't happen")
+	}
+
+	return verList, nil
+}
+
+// Returns the SHA256 of a database version, along with whether the database is public.
+func DBVersionSHA256(dbOwner string, dbFolder string, dbName string, dbVersion int) (sha string, public bool, err error) {
+	dbQuery := `
+		SELECT ver.sha256, db.public
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.version = $4`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, dbVersion).Scan(&sha, &public)
+	if err != nil {
+		log.Printf("Error looking up SHA256 for database '%s%s%s' version %d: %v\n", dbOwner, dbFolder,
+			dbName, dbVersion, err)
+		return "", false, err
+	}
+	return sha, public, nil
+}
+
+// Returns the users watching a database who can still see it.  Watchers of a private database lose out if it's no
+// longer shared with them.
+func dbWatchers(dbOwner string, dbFolder string, dbName string) (list []string, err error) {
+	dbQuery := `
+		SELECT w.username
+		FROM database_watches AS w, sqlite_databases AS db
+		WHERE w.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND (db.public = true
+				OR w.username = db.username
+				OR w.username IN (SELECT username FROM database_access WHERE db = db.idnum))`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userName string
+		err = rows.Scan(&userName)
+		if err != nil {
+			log.Printf("Error retrieving watchers of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, userName)
+	}
+	return list, nil
+}
+
+// Returns the most recent webhook deliveries for a database, newest first.
+func DBWebhookDeliveries(dbOwner string, dbFolder string, dbName string, limit int) (list []WebhookDelivery, err error) {
+	dbQuery := `
+		SELECT del.delivery_id, hook.url, del.event, del.status, del.attempts, coalesce(del.response_status, 0),
+			coalesce(del.last_error, ''), del.next_attempt, del.date_created
+		FROM webhook_deliveries AS del, database_webhooks AS hook, sqlite_databases AS db
+		WHERE del.webhook_id = hook.webhook_id
+			AND hook.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY del.date_created DESC, del.delivery_id DESC
+		LIMIT $4`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName, limit)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d WebhookDelivery
+		err = rows.Scan(&d.ID, &d.URL, &d.Event, &d.Status, &d.Attempts, &d.ResponseStatus, &d.Error,
+			&d.NextAttempt, &d.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving webhook deliveries for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// Returns the webhooks registered for a database.
+func DBWebhooks(dbOwner string, dbFolder string, dbName string) (list []DBWebhook, err error) {
+	dbQuery := `
+		SELECT hook.webhook_id, hook.url, hook.secret, hook.events, hook.date_created
+		FROM database_webhooks AS hook, sqlite_databases AS db
+		WHERE hook.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY hook.date_created`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h DBWebhook
+		err = rows.Scan(&h.ID, &h.URL, &h.Secret, &h.Events, &h.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving webhooks of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+// Deletes a database, along with all of its versions.  Databases which have been forked can't be deleted, as the forks
+// would be removed with them.  Neither can databases using the same Minio objects as another user's database.  The
+// Minio objects themselves are left for the admin server's garbage collection to remove, once nothing uses them.
+func DeleteDatabase(dbOwner string, dbFolder string, dbName string) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for deleting a database: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the database entry, so it can't be forked while it's being deleted
+	var dbID, rootID int
+	dbQuery := `
+		SELECT idnum, root_database
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		FOR UPDATE`
+	err = tx.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&dbID, &rootID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("Unknown database '%s%s%s'", dbOwner, dbFolder, dbName)
+		}
+		log.Printf("Error retrieving database ID for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+
+	// Forks reference the database they came from with ON DELETE CASCADE, so would be deleted too
+	var numForks int
+	dbQuery = `
+		SELECT count(*)
+		FROM sqlite_databases
+		WHERE (forked_from = $1 OR root_database = $1)
+			AND idnum != $1`
+	err = tx.QueryRow(dbQuery, dbID).Scan(&numForks)
+	if err != nil {
+		log.Printf("Error counting forks of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numForks > 0 {
+		return errors.New("This database has been forked, so it can't be deleted")
+	}
+	var numShared int
+	dbQuery = `
+		SELECT count(*)
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username != $2
+			AND (db.minio_bucket, ver.minioid) IN (
+				SELECT owner.minio_bucket, own_ver.minioid
+				FROM database_versions AS own_ver, sqlite_databases AS owner
+				WHERE own_ver.db = owner.idnum
+					AND owner.idnum = $1
+			)`
+	err = tx.QueryRow(dbQuery, dbID, dbOwner).Scan(&numShared)
+	if err != nil {
+		log.Printf("Error checking for shared objects of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	if numShared > 0 {
+		return errors.New("Other users' databases are using this database's files, so it can't be deleted")
+	}
+
+	// The versions, stars, deleted versions, and so on are removed by their ON DELETE CASCADE constraints
+	commandTag, err := tx.Exec(`DELETE FROM sqlite_databases WHERE idnum = $1`, dbID)
+	if err != nil {
+		log.Printf("Deleting database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when deleting database '%s%s%s'\n", numRows, dbOwner,
+			dbFolder, dbName)
+	}
+
+	// If the database was a fork, the root database has one less fork now
+	var rootOwner, rootFolder, rootName string
+	if rootID != dbID {
+		dbQuery = `
+			UPDATE sqlite_databases
+			SET forks = forks - 1
+			WHERE idnum = $1
+				AND forks > 0
+			RETURNING username, folder, dbname`
+		err = tx.QueryRow(dbQuery, rootID).Scan(&rootOwner, &rootFolder, &rootName)
+		if err != nil && err != pgx.ErrNoRows {
+			log.Printf("Updating fork count in PostgreSQL failed: %v\n", err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Couldn't commit database deletion: %v\n", err)
+		return err
+	}
+
+	err = InvalidateDBCache(dbOwner, dbFolder, dbName)
+	if err != nil {
+		return err
+	}
+	if rootName != "" {
+		return InvalidateForkTreeCache(rootOwner, rootFolder, rootName)
+	}
+	return nil
+}
+
+// Deletes a database version, keeping its details in the deleted versions table so the owner can restore it until
+// it's purged.  The only remaining version on the main branch of a database can't be deleted this way.
+func DeleteDBVersion(dbOwner string, dbFolder string, dbName string, dbVersion int, deletedBy string) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for deleting a database version: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the database entry, so two versions can't be deleted at once leaving none behind
+	var dbID, numVersions int
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		FOR UPDATE`
+	err = tx.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&dbID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("Unknown database '%s%s%s'", dbOwner, dbFolder, dbName)
+		}
+		log.Printf("Error retrieving database ID for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+
+	// Versions on a protected branch can't be deleted
+	var branch string
+	var protected bool
+	dbQuery = `
+		SELECT ver.branch, EXISTS (
+			SELECT 1
+			FROM protected_branches AS pro
+			WHERE pro.db = ver.db
+				AND pro.branch = ver.branch)
+		FROM database_versions AS ver
+		WHERE ver.db = $1
+			AND ver.version = $2`
+	err = tx.QueryRow(dbQuery, dbID, dbVersion).Scan(&branch, &protected)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("Unknown version %d of database '%s%s%s'", dbVersion, dbOwner, dbFolder, dbName)
+		}
+		log.Printf("Error retrieving branch of version %d of '%s%s%s': %v\n", dbVersion, dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	if protected {
+		return fmt.Errorf("Version %d is on the protected branch '%s', so it can't be deleted", dbVersion, branch)
+	}
+
+	// The database page shows the latest version on the main branch, so that always keeps at least one version.  Other
+	// branches can be emptied, as the main branch remains
+	if branch == DefaultBranch {
+		dbQuery = `
+			SELECT count(*)
+			FROM database_versions
+			WHERE db = $1
+				AND branch = $2`
+		err = tx.QueryRow(dbQuery, dbID, branch).Scan(&numVersions)
+		if err != nil {
+			log.Printf("Error counting versions of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return err
+		}
+		if numVersions < 2 {
+			return errors.New("The only version on the main branch of a database can't be deleted")
+		}
+	}
+
+	// An earlier deleted version with the same number is replaced
+	_, err = tx.Exec(`DELETE FROM deleted_versions WHERE db = $1 AND version = $2`, dbID, dbVersion)
+	if err != nil {
+		log.Printf("Removing old deleted version %d of '%s%s%s' failed: %v\n", dbVersion, dbOwner, dbFolder,
+			dbName, err)
+		return err
+	}
+	dbQuery = `
+		INSERT INTO deleted_versions (db, version, size, sha256, minioid, date_created, last_modified,
+			compressed_size, prev_hash, chain_hash, commit_id, parent_commit, author, message, branch, deleted_by)
+		SELECT db, version, size, sha256, minioid, date_created, last_modified, compressed_size, prev_hash,
+			chain_hash, commit_id, parent_commit, author, message, branch, $3
+		FROM database_versions
+		WHERE db = $1
+			AND version = $2`
+	commandTag, err := tx.Exec(dbQuery, dbID, dbVersion, deletedBy)
+	if err != nil {
+		log.Printf("Saving deleted version %d of '%s%s%s' failed: %v\n", dbVersion, dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Unknown version %d of database '%s%s%s'", dbVersion, dbOwner, dbFolder, dbName)
+	}
+	_, err = tx.Exec(`DELETE FROM database_versions WHERE db = $1 AND version = $2`, dbID, dbVersion)
+	if err != nil {
+		log.Printf("Deleting version %d of '%s%s%s' failed: %v\n", dbVersion, dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Couldn't commit database version deletion: %v\n", err)
+		return err
+	}
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Returns the deleted versions of a database which can still be restored, newest first.
+func DeletedDBVersions(dbOwner string, dbFolder string, dbName string) (list []DeletedVersion, err error) {
+	dbQuery := `
+		SELECT del.version, del.size, del.date_created, del.deleted_by, del.date_deleted
+		FROM deleted_versions AS del, sqlite_databases AS db
+		WHERE del.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY del.version DESC`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Retrieving deleted versions of '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow DeletedVersion
+		err = rows.Scan(&oneRow.Version, &oneRow.Size, &oneRow.DateCreated, &oneRow.DeletedBy, &oneRow.DateDeleted)
+		if err != nil {
+			log.Printf("Error retrieving deleted versions of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		oneRow.PurgeDate = oneRow.DateDeleted.AddDate(0, 0, WebDeletedVersionDays())
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the users whose email digest is due.  Users who haven't been sent one before get a digest covering the
+// last day or week.
+func DigestsDue() (list []DigestUser, err error) {
+	dbQuery := `
+		SELECT username, email, pref_digest, coalesce(last_digest, timezone('utc'::text, now()) - period)
+		FROM (
+			SELECT username, email, pref_digest, last_digest,
+				CASE pref_digest WHEN '` + DigestDaily + `' THEN interval '1 day' ELSE interval '7 days' END AS period
+			FROM users
+			WHERE pref_digest IN ('` + DigestDaily + `', '` + DigestWeekly + `')
+				AND coalesce(email, '') <> ''
+				AND disabled = false
+		) AS u
+		WHERE last_digest IS NULL
+			OR last_digest <= timezone('utc'::text, now()) - period
+		ORDER BY username`
+	rows, err := pdb.Query(dbQuery)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u DigestUser
+		err = rows.Scan(&u.UserName, &u.Email, &u.Frequency, &u.LastDigest)
+		if err != nil {
+			log.Printf("Error retrieving list of due email digests: %v\n", err)
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, nil
+}
+
+// Returns the versions added since the given time to the public databases a user has starred.  The user's own
+// databases are left out.
+func DigestVersions(userName string, since time.Time) (list []DigestEntry, err error) {
+	dbQuery := `
+		SELECT db.username, db.folder, db.dbname, ver.version, ver.date_created
+		FROM database_stars AS star, sqlite_databases AS db, database_versions AS ver
+		WHERE star.username = $1
+			AND star.db = db.idnum
+			AND ver.db = db.idnum
+			AND ver.date_created > $2
+			AND db.public = true
+			AND db.username <> $1
+		ORDER BY db.username, db.folder, db.dbname, ver.version`
+	rows, err := pdb.Query(dbQuery, userName, since)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e DigestEntry
+		err = rows.Scan(&e.Owner, &e.Folder, &e.DBName, &e.Version, &e.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving email digest entries for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// Disconnects the PostgreSQL database connection.
+func DisconnectPostgreSQL() {
+	pdb.Close()
+	for _, replica := range pdbReplicas {
+		replica.Close()
+	}
+}
+
+// Records a user dismissing an announcement, so it's no longer shown to them.
+func DismissAnnouncement(userName string, id int64) error {
+	dbQuery := `
+		INSERT INTO announcement_dismissals (username, announcement_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+	_, err := pdb.Exec(dbQuery, userName, id)
+	if err != nil {
+		log.Printf("Dismissing announcement %d for user '%s' failed: %v\n", id, userName, err)
+		return err
+	}
+	return nil
+}
+
+// Returns the webhook deliveries which are due to be sent, oldest first.
+func DueWebhookDeliveries(limit int) (list []WebhookDelivery, err error) {
+	dbQuery := `
+		SELECT del.delivery_id, hook.url, hook.secret, del.event, del.payload, del.attempts, del.date_created
+		FROM webhook_deliveries AS del, database_webhooks AS hook
+		WHERE del.webhook_id = hook.webhook_id
+			AND del.status = 'pending'
+			AND del.next_attempt <= timezone('utc'::text, now())
+		ORDER BY del.next_attempt, del.delivery_id
+		LIMIT $1`
+	rows, err := pdb.Query(dbQuery, limit)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := WebhookDelivery{Status: DeliveryPending}
+		err = rows.Scan(&d.ID, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.Attempts, &d.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving due webhook deliveries: %v\n", err)
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// Exchanges an OAuth authorisation code for an access token.  Codes can only be used once.  If the code is unknown,
+// has expired, or wasn't issued for the given client and redirect URI, an empty token is returned.  Along with the
+// token, the user and scope it's for are returned, and the OpenID Connect nonce given when the code was requested.
+func ExchangeOAuthCode(clientID string, code string, redirectURI string) (token string, userName string, scope string,
+	nonce string, err error) {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for OAuth code exchange: %v\n", err)
+		return "", "", "", "", err
+	}
+	defer tx.Rollback()
+
+	// Remove the code, so it can't be used again
+	var codeClient, codeRedirect string
+	var codeNonce pgx.NullString
+	var expiry time.Time
+	dbQuery := `
+		DELETE FROM oauth_codes
+		WHERE code_hash = $1
+		RETURNING client_id, username, scope, redirect_uri, nonce, expiry`
+	err = tx.QueryRow(dbQuery, tokenHash(code)).Scan(&codeClient, &userName, &scope, &codeRedirect, &codeNonce,
+		&expiry)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", "", "", "", nil
+		}
+		log.Printf("Error retrieving OAuth authorisation code: %v\n", err)
+		return "", "", "", "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Couldn't commit OAuth code removal: %v\n", err)
+		return "", "", "", "", err
+	}
+	if codeClient != clientID || codeRedirect != redirectURI || time.Now().After(expiry) {
+		return "", "", "", "", nil
+	}
+	nonce = codeNonce.String
+
+	// Issue the access token
+	token, err = RandomToken()
+	if err != nil {
+		return "", "", "", "", err
+	}
+	dbQuery = `
+		INSERT INTO oauth_tokens (token_hash, client_id, username, scope, expiry)
+		VALUES ($1, $2, $3, $4, $5)`
+	commandTag, err := pdb.Exec(dbQuery, tokenHash(token), clientID, userName, scope,
+		time.Now().Add(OAuthTokenLifetime))
+	if err != nil {
+		log.Printf("Adding OAuth access token for user '%s' failed: %v\n", userName, err)
+		return "", "", "", "", err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when adding OAuth access token for user '%s'\n", numRows,
+			userName)
+	}
+	return token, userName, scope, nonce, nil
+}
+
+// Returns which of the given user names belong to existing users.
+func ExistingUsers(userNames []string) (map[string]bool, error) {
+	dbQuery := `
+		SELECT username
+		FROM users
+		WHERE username = ANY($1)`
+	rows, err := readDB().Query(dbQuery, userNames)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[string]bool)
+	for rows.Next() {
+		var u string
+		err = rows.Scan(&u)
+		if err != nil {
+			log.Printf("Error retrieving user list: %v\n", err)
+			return nil, err
+		}
+		users[u] = true
+	}
+	return users, nil
+}
+
+// Exports the metadata for all users and databases on this instance.  The database files themselves (in Minio)
+// aren't included, and need to be copied across separately.
+func ExportMetadata() (data InstanceMetadata, err error) {
+	data.Exported = time.Now().UTC()
+	data.Server = WebServer()
+	data.Tables = make(map[string]json.RawMessage)
+	for _, tbl := range metadataTables {
+		var tblData []byte
+		dbQuery := fmt.Sprintf(`
+			SELECT coalesce(json_agg(t), '[]')
+			FROM %s AS t`, tbl.Name)
+		err = pdb.QueryRow(dbQuery).Scan(&tblData)
+		if err != nil {
+			log.Printf("Error exporting metadata for table '%s': %v\n", tbl.Name, err)
+			return InstanceMetadata{}, err
+		}
+		data.Tables[tbl.Name] = json.RawMessage(tblData)
+	}
+	return data, nil
+}
+
+// Returns the curated databases featured on the front page, in the order given.  Entries are "owner/database"
+// strings, and ones which aren't public (or don't exist) are skipped.
+func FeaturedDBs(names []string) ([]DBSummary, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	dbList, err := frontPageDBs("featured", `AND (db.username || '/' || db.dbname) = ANY($1)`, "db.dbname", 0,
+		names)
+	if err != nil {
+		return nil, err
+	}
+
+	// Put the databases in the configured order
+	var list []DBSummary
+	for _, n := range names {
+		for _, db := range dbList {
+			if db.Owner+"/"+db.DBName == n {
+				list = append(list, db)
+			}
+		}
+	}
+	return list, nil
+}
+
+// Returns the feature flags an admin has overridden, keyed by feature name.  They're consulted on lots of requests, so
+// are cached for a short time.
+func featureFlagOverrides() (map[string]FeatureFlag, error) {
+	overrides := make(map[string]FeatureFlag)
+	ok, err := fetchFromCache(featureFlagCacheKey(), &overrides)
+	if err != nil {
+		log.Printf("Error retrieving data from cache: %v\n", err)
+	}
+	if ok {
+		return overrides, nil
+	}
+
+	dbQuery := `
+		SELECT name, enabled, rollout_percent, users, beta, date_updated
+		FROM feature_flags`
+	rows, err := readDB().Query(dbQuery)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := FeatureFlag{Overridden: true}
+		err = rows.Scan(&f.Name, &f.Enabled, &f.RolloutPercent, &f.Users, &f.Beta, &f.DateUpdated)
+		if err != nil {
+			log.Printf("Error retrieving feature flags: %v\n", err)
+			return nil, err
+		}
+		overrides[f.Name] = f
+	}
+
+	err = storeInCache(featureFlagCacheKey(), overrides, FeatureFlagCacheTime)
+	if err != nil {
+		log.Printf("Error when caching feature flags: %v\n", err)
+	}
+	return overrides, nil
+}
+
+// Returns the cached virus scanner verdicts which flagged content as infected, newest first.
+func FlaggedScanVerdicts() (list []ScanVerdict, err error) {
+	dbQuery := `
+		SELECT sha256, clean, detail, date_scanned
+		FROM scan_verdicts
+		WHERE clean = false
+		ORDER BY date_scanned DESC`
+	rows, err := pdb.Query(dbQuery)
+	if err != nil {
+		log.Printf("Retrieving flagged scan verdicts failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v ScanVerdict
+		err = rows.Scan(&v.SHA256, &v.Clean, &v.Detail, &v.DateScanned)
+		if err != nil {
+			log.Printf("Error retrieving flagged scan verdicts: %v\n", err)
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// Returns the users following the given user, most recent first.
+func Followers(userName string) (list []Follow, err error) {
+	dbQuery := `
+		SELECT follower, date_followed
+		FROM user_follows
+		WHERE followed = $1
+		ORDER BY date_followed DESC`
+	rows, err := readDB().Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Retrieving followers of user '%s' failed: %v\n", userName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow Follow
+		err = rows.Scan(&oneRow.Username, &oneRow.DateFollowed)
+		if err != nil {
+			log.Printf("Error retrieving followers of user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the recent public activity of the users someone follows, newest first.  This is the new database versions
+// they've uploaded, and the databases they've starred.
+func FollowFeed(userName string, maxEntries int) (list []FeedEntry, err error) {
+	dbQuery := `
+		WITH followed AS (
+			SELECT followed
+			FROM user_follows
+			WHERE follower = $1
+		)
+		SELECT $2::text AS action, db.username, db.username, db.dbname, ver.version, ver.date_created
+		FROM database_versions AS ver, sqlite_databases AS db, followed
+		WHERE ver.db = db.idnum
+			AND db.username = followed.followed
+			AND db.public = true
+		UNION ALL
+		SELECT $3::text, stars.username, db.username, db.dbname, 0, stars.date_starred
+		FROM database_stars AS stars, sqlite_databases AS db, followed
+		WHERE stars.db = db.idnum
+			AND stars.username = followed.followed
+			AND db.public = true
+		ORDER BY date_created DESC
+		LIMIT $4`
+	rows, err := readDB().Query(dbQuery, userName, FeedVersion, FeedStar, maxEntries)
+	if err != nil {
+		log.Printf("Retrieving activity feed for user '%s' failed: %v\n", userName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow FeedEntry
+		err = rows.Scan(&oneRow.Action, &oneRow.User, &oneRow.DBOwner, &oneRow.DBName, &oneRow.Version,
+			&oneRow.Date)
+		if err != nil {
+			log.Printf("Error retrieving activity feed for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the users the given user is following, most recent first.
+func Following(userName string) (list []Follow, err error) {
+	dbQuery := `
+		SELECT followed, date_followed
+		FROM user_follows
+		WHERE follower = $1
+		ORDER BY date_followed DESC`
+	rows, err := readDB().Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Retrieving users followed by '%s' failed: %v\n", userName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow Follow
+		err = rows.Scan(&oneRow.Username, &oneRow.DateFollowed)
+		if err != nil {
+			log.Printf("Error retrieving users followed by '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Fork the PostgreSQL entry for a SQLite database from one user to another
+func ForkDatabase(srcOwner string, srcFolder string, dbName string, srcVer int, dstOwner string,
+	dstFolder string, dstMinioID string) (int, error) {
+
+	// Retrieve the Minio bucket for the owner
+	dstBucket, err := MinioUserBucket(dstOwner)
+	if err != nil {
+		log.Printf("Error looking up Minio bucket for user '%s': %v\n", dstOwner, err.Error())
+		return 0, err
+	}
+
+	// Copy the main database entry
+	dbQuery := `
+		INSERT INTO sqlite_databases (username, folder, dbname, public, forks, description, readme, minio_bucket, root_database, forked_from)
+		SELECT $1, $2, dbname, public, forks, description, readme, $3, root_database, idnum
+		FROM sqlite_databases
+		WHERE username = $4
+			AND folder = $5
+			AND dbname = $6`
+	commandTag, err := pdb.Exec(dbQuery, dstOwner, dstFolder, dstBucket, srcOwner, srcFolder, dbName)
+	if err != nil {
+		log.Printf("Forking database '%s%s/%s' version %d entry in PostgreSQL failed: %v\n",
+			srcOwner, srcFolder, dbName, srcVer, err)
+		return 0, err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%d) when forking main database entry: "+
+			"'%s%s%s' version %d to '%s%s%s'\n", numRows, srcOwner, srcFolder, dbName, srcVer, dstOwner,
+			dstFolder, dbName)
+	}
+
+	// The lineage chain of the fork carries on from the version it was forked from
+	var srcSHA, prevHash string
+	dbQuery = `
+		SELECT ver.sha256, coalesce(ver.chain_hash, '')
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.version = $4`
+	err = pdb.QueryRow(dbQuery, srcOwner, srcFolder, dbName, srcVer).Scan(&srcSHA, &prevHash)
+	if err != nil {
+		log.Printf("Retrieving lineage details of '%s%s%s' version %d failed: %v\n", srcOwner, srcFolder, dbName,
+			srcVer, err)
+		return 0, err
+	}
+	created := time.Now().UTC().Truncate(time.Microsecond)
+	chainHash := lineageHash(prevHash, 1, srcSHA, created)
+
+	// Add a new database version entry
+	dbQuery = `
+		WITH new_db AS (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND folder = $2
+				AND dbname = $3
+		)
+		INSERT INTO database_versions (db, size, version, sha256, minioid, compressed_size, date_created,
+			last_modified, prev_hash, chain_hash, commit_id, parent_commit, author, message)
+		SELECT new_db.idnum, ver.size, 1, ver.sha256, $4, ver.compressed_size, $8, $8, nullif($9, ''), $10,
+			ver.commit_id, ver.parent_commit, ver.author, ver.message
+		FROM new_db, database_versions AS ver
+		WHERE db = (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $5
+				AND folder = $6
+				AND dbname = $3
+			)
+			AND version = $7`
+	commandTag, err = pdb.Exec(dbQuery, dstOwner, dstFolder, dbName, dstMinioID, srcOwner, srcFolder, srcVer,
+		created, prevHash, chainHash)
+	if err != nil {
+		log.Printf("Forking database entry in PostgreSQL failed: %v\n", err)
+		return 0, err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%d) when forking database version entry: "+
+			"'%s%s%s' version %d to '%s%s%s'\n", numRows, srcOwner, srcFolder, dbName, srcVer, dstOwner,
+			dstFolder, dbName)
+	}
+
+	// Increment the forks count for the root database
+	dbQuery = `
+		UPDATE sqlite_databases
+		SET forks = forks + 1
+		WHERE idnum = (
+			SELECT root_database
+			FROM sqlite_databases
+			WHERE username = $1
+				AND folder = $2
+				AND dbname = $3
+			)
+		RETURNING forks`
+	var newForks int
+	err = pdb.QueryRow(dbQuery, dstOwner, dstFolder, dbName).Scan(&newForks)
+	if err != nil {
+		log.Printf("Updating fork count in PostgreSQL failed: %v\n", err)
+		return 0, err
+	}
+
+	// The new fork count shows up on every database in the fork tree, so invalidate the cached data for them all
+	err = InvalidateForkTreeCache(dstOwner, dstFolder, dbName)
+	if err != nil {
+		return 0, err
+	}
+
+	return newForks, nil
+}
+
+// Checks if the given database was forked from another, and if so returns that one's owner, folder and database name
+func ForkedFrom(dbOwner string, dbFolder string, dbName string) (forkOwn string, forkFol string, forkDB string,
+	err error) {
+	// Check if the database was forked from another
+	var idnum, forkedFrom pgx.NullInt32
+	dbQuery := `
+		SELECT idnum, forked_from
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	err = readDB().QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&idnum, &forkedFrom)
+	if err != nil {
+		log.Printf("Error checking if database was forked from another '%s%s%s'. Error: %v\n", dbOwner,
+			dbFolder, dbName, err)
+		return "", "", "", err
+	}
+	if !forkedFrom.Valid {
+		// The database wasn't forked, so return empty strings
+		return "", "", "", nil
+	}
+
+	// Return the details of the database this one was forked from
+	dbQuery = `
+		SELECT username, folder, dbname
+		FROM sqlite_databases
+		WHERE idnum = $1`
+	err = readDB().QueryRow(dbQuery, forkedFrom).Scan(&forkOwn, &forkFol, &forkDB)
+	if err != nil {
+		log.Printf("Error retrieving forked database information for '%s%s%s'. Error: %v\n", dbOwner,
+			dbFolder, dbName, err)
+		return "", "", "", err
+	}
+	return forkOwn, forkFol, forkDB, nil
+}
+
+// Return the complete fork tree for a given database
+func ForkTree(loggedInUser string, dbOwner string, dbFolder string, dbName string) (outputList []ForkEntry, err error) {
+	dbQuery := `
+		SELECT username, folder, dbname, public, idnum, forked_from
+		FROM sqlite_databases
+		WHERE root_database = (
+				SELECT root_database
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3
+				)
+		ORDER BY forked_from NULLS FIRST`
+	rows, err := readDB().Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var dbList []ForkEntry
+	for rows.Next() {
+		var frk pgx.NullInt32
+		var oneRow ForkEntry
+		err = rows.Scan(&oneRow.Owner, &oneRow.Folder, &oneRow.DBName, &oneRow.Public, &oneRow.ID, &frk)
+		if err != nil {
+			log.Printf("Error retrieving fork list for '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+				err)
+			return nil, err
+		}
+		if frk.Valid {
 			oneRow.ForkedFrom = int(frk.Int32)
 		}
-		dbList = append(dbList, oneRow)
+		dbList = append(dbList, oneRow)
+	}
+
+	// Safety checks
+	numResults := len(dbList)
+	if numResults == 0 {
+		return nil, errors.New("Empty list returned instead of fork tree.  This shouldn't happen")
+	}
+	if dbList[0].ForkedFrom != 0 {
+		// The first entry has a non-zero forked_from field, indicating it's not the root entry.  That
+		// shouldn't happen, so return an error.
+		return nil, errors.New("Incorrect root entry data in retrieved database list")
+	}
+
+	// * Process the root entry *
+
+	var iconDepth int
+	var forkTrail []int
+
+	// Set the root database ID
+	rootID := dbList[0].ID
+
+	// Set the icon list for display in the browser
+	dbList[0].IconList = append(dbList[0].IconList, ROOT)
+
+	// If the root database is no longer public, then use placeholder details instead
+	if !dbList[0].Public {
+		dbList[0].DBName = "private database"
+	}
+
+	// Append this completed database line to the output list
+	outputList = append(outputList, dbList[0])
+
+	// Append the root database ID to the fork trail
+	forkTrail = append(forkTrail, rootID)
+
+	// Mark the root database entry as processed
+	dbList[0].Processed = true
+
+	// Increment the icon depth
+	iconDepth = 1
+
+	// * Sort the remaining entries for correct display *
+	numUnprocessedEntries := numResults - 1
+	for numUnprocessedEntries > 0 {
+		var forkFound bool
+		outputList, forkTrail, forkFound = nextChild(loggedInUser, &dbList, &outputList, &forkTrail, iconDepth)
+		if forkFound {
+			numUnprocessedEntries--
+			iconDepth++
+
+			// Add stems and branches to the output icon list
+			numOutput := len(outputList)
+
+			myID := outputList[numOutput-1].ID
+			myForkedFrom := outputList[numOutput-1].ForkedFrom
+
+			// Scan through the earlier output list for any sibling entries
+			var siblingFound bool
+			for i := numOutput; i > 0 && siblingFound == false; i-- {
+				thisID := outputList[i-1].ID
+				thisForkedFrom := outputList[i-1].ForkedFrom
+
+				if thisForkedFrom == myForkedFrom && thisID != myID {
+					// Sibling entry found
+					siblingFound = true
+					sibling := outputList[i-1]
+
+					// Change the last sibling icon to a branch icon
+					sibling.IconList[iconDepth-1] = BRANCH
+
+					// Change appropriate spaces to stems in the output icon list
+					for l := numOutput - 1; l > i; l-- {
+						thisEntry := outputList[l-1]
+						if thisEntry.IconList[iconDepth-1] == SPACE {
+							thisEntry.IconList[iconDepth-1] = STEM
+						}
+					}
+				}
+			}
+		} else {
+			// No child was found, so remove an entry from the fork trail then continue looping
+			forkTrail = forkTrail[:len(forkTrail)-1]
+
+			iconDepth--
+		}
+	}
+
+	return outputList, nil
+}
+
+// Returns the databases in the same fork tree as the given one, including the database itself.
+func forkTreeDBs(dbOwner string, dbFolder string, dbName string) ([]DBEntry, error) {
+	dbQuery := `
+		SELECT username, folder, dbname
+		FROM sqlite_databases
+		WHERE root_database = (
+			SELECT root_database
+			FROM sqlite_databases
+			WHERE username = $1
+				AND folder = $2
+				AND dbname = $3
+			)`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Retrieving fork tree of database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var list []DBEntry
+	for rows.Next() {
+		var oneRow DBEntry
+		err = rows.Scan(&oneRow.Owner, &oneRow.Folder, &oneRow.DBName)
+		if err != nil {
+			log.Printf("Error retrieving fork tree of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns public databases for the front page lists, caching them for a short time.  Databases whose owners have
+// discouraged search engines from indexing them aren't promoted, and neither are ones which have been taken down.
+// Archived databases are listed after all the others.
+func frontPageDBs(listName string, where string, orderBy string, limit int, args ...interface{}) ([]DBSummary,
+	error) {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("frontpage/%d/%s", frontPageGeneration(), listName)))
+	cacheKey := hex.EncodeToString(tempArr[:])
+	var list []DBSummary
+	ok, err := fetchFromCache(cacheKey, &list)
+	if err != nil {
+		log.Printf("Error retrieving data from cache: %v\n", err)
+	}
+	if ok {
+		return list, nil
+	}
+
+	dbQuery := `
+		SELECT db.username, db.dbname, db.description, db.last_modified, db.stars
+		FROM sqlite_databases AS db
+		WHERE db.public = true
+			AND db.noindex = false
+			AND NOT EXISTS (
+				SELECT 1
+				FROM takedown_requests AS td
+				WHERE td.db_owner = db.username
+					AND td.db_folder = db.folder
+					AND td.db_name = db.dbname
+					AND td.status IN ('` + TakedownAccepted + `', '` + TakedownCountered + `')
+			)
+			` + where + `
+		ORDER BY db.archived, ` + orderBy
+	if limit > 0 {
+		dbQuery += fmt.Sprintf(`
+		LIMIT %d`, limit)
+	}
+	rows, err := readDB().Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow DBSummary
+		var desc pgx.NullString
+		err = rows.Scan(&oneRow.Owner, &oneRow.DBName, &desc, &oneRow.LastModified, &oneRow.Stars)
+		if err != nil {
+			log.Printf("Error retrieving front page database list '%s': %v\n", listName, err)
+			return nil, err
+		}
+		if desc.Valid {
+			oneRow.Description = desc.String
+		}
+		list = append(list, oneRow)
+	}
+
+	err = storeInCache(cacheKey, list, FrontPageCacheTime)
+	if err != nil {
+		log.Printf("Error when caching front page database list '%s': %v\n", listName, err)
+	}
+	return list, nil
+}
+
+// Retrieve the highest version number of a database (if any), available to a given user.
+// Use the empty string "" to retrieve the highest available public version.
+func HighestDBVersion(dbOwner string, dbName string, dbFolder string, loggedInUser string) (ver int, err error) {
+	dbQuery := `
+		SELECT version
+		FROM database_versions
+		WHERE db = (
+			SELECT idnum
+			FROM sqlite_databases
+			WHERE username = $1
+				AND dbname = $2
+				AND folder = $3`
+	args := []interface{}{dbOwner, dbName, dbFolder}
+	if dbOwner != loggedInUser {
+		dbQuery += `
+				AND (public = true OR idnum IN (SELECT db FROM database_access WHERE username = $4))`
+		args = append(args, loggedInUser)
+	}
+	dbQuery += `
+			)
+		ORDER BY version DESC
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, args...).Scan(&ver)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error when retrieving highest database version # for '%s/%s'. Error: %v\n", dbOwner,
+			dbName, err)
+		return -1, err
+	}
+	if err == pgx.ErrNoRows {
+		// No database versions seem to be present
+		return 0, nil
+	}
+	return ver, nil
+}
+
+// Returns the import webhook with the given token, along with the database it imports into.
+func ImportHookByToken(token string) (h ImportHook, found bool, err error) {
+	dbQuery := `
+		SELECT hook.hook_id, hook.token, hook.secret, coalesce(hook.branch, ''), hook.created_by, hook.date_created,
+			db.username, db.folder, db.dbname
+		FROM import_hooks AS hook, sqlite_databases AS db
+		WHERE hook.db = db.idnum
+			AND hook.token = $1`
+	err = pdb.QueryRow(dbQuery, token).Scan(&h.ID, &h.Token, &h.Secret, &h.Branch, &h.CreatedBy, &h.DateCreated,
+		&h.Owner, &h.Folder, &h.DBName)
+	if err == pgx.ErrNoRows {
+		return ImportHook{}, false, nil
+	}
+	if err != nil {
+		log.Printf("Error retrieving import webhook: %v\n", err)
+		return ImportHook{}, false, err
+	}
+	return h, true, nil
+}
+
+// Returns the import webhooks of a database, oldest first.
+func ImportHooks(dbOwner string, dbFolder string, dbName string) (list []ImportHook, err error) {
+	dbQuery := `
+		SELECT hook.hook_id, hook.token, hook.secret, coalesce(hook.branch, ''), hook.created_by, hook.date_created,
+			hook.last_used, coalesce(hook.last_status, '')
+		FROM import_hooks AS hook, sqlite_databases AS db
+		WHERE hook.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY hook.date_created`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		h := ImportHook{DBName: dbName, Folder: dbFolder, Owner: dbOwner}
+		var lastUsed pgx.NullTime
+		err = rows.Scan(&h.ID, &h.Token, &h.Secret, &h.Branch, &h.CreatedBy, &h.DateCreated, &lastUsed,
+			&h.LastStatus)
+		if err != nil {
+			log.Printf("Error retrieving import webhooks of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+				err)
+			return nil, err
+		}
+		if lastUsed.Valid {
+			h.LastUsed = &lastUsed.Time
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+// Imports previously exported instance metadata.  Everything is imported in a single transaction, and the target
+// tables need to be empty.
+func ImportMetadata(data InstanceMetadata) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for metadata import: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, tbl := range metadataTables {
+		// Refuse to merge into existing data
+		var existing int
+		dbQuery := fmt.Sprintf(`
+			SELECT count(*)
+			FROM %s`, tbl.Name)
+		err = tx.QueryRow(dbQuery).Scan(&existing)
+		if err != nil {
+			log.Printf("Error checking table '%s' before metadata import: %v\n", tbl.Name, err)
+			return err
+		}
+		if existing != 0 {
+			return fmt.Errorf("Table '%s' isn't empty", tbl.Name)
+		}
+
+		tblData, ok := data.Tables[tbl.Name]
+		if !ok {
+			continue
+		}
+		dbQuery = fmt.Sprintf(`
+			INSERT INTO %[1]s
+			SELECT *
+			FROM json_populate_recordset(NULL::%[1]s, $1)`, tbl.Name)
+		commandTag, err := tx.Exec(dbQuery, string(tblData))
+		if err != nil {
+			log.Printf("Error importing metadata for table '%s': %v\n", tbl.Name, err)
+			return err
+		}
+		log.Printf("Imported %v row(s) into table '%s'\n", commandTag.RowsAffected(), tbl.Name)
+
+		// Transaction IDs from the exporting instance mean nothing here, so the imported versions are recorded as
+		// being added by the import.  Standbys replicating from this instance then pick them up once it's committed
+		if tbl.Name == "database_versions" {
+			_, err = tx.Exec(`UPDATE database_versions SET txid = txid_current()`)
+			if err != nil {
+				log.Printf("Error resetting version transaction IDs after metadata import: %v\n", err)
+				return err
+			}
+		}
+
+		// Make sure new rows don't collide with the imported ones.  Serial column sequences are named
+		// <table>_<column>_seq, so the column comes from that
+		if tbl.Sequence != "" {
+			idCol := strings.TrimSuffix(strings.TrimPrefix(tbl.Sequence, tbl.Name+"_"), "_seq")
+			dbQuery = fmt.Sprintf(`
+				SELECT setval('%s', coalesce(max(%s), 0) + 1, false)
+				FROM %s`, tbl.Sequence, idCol, tbl.Name)
+			_, err = tx.Exec(dbQuery)
+			if err != nil {
+				log.Printf("Error updating sequence '%s' after metadata import: %v\n", tbl.Sequence, err)
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Couldn't commit metadata import: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Returns the aggregate usage numbers for this instance, for the public stats page.  They're cached for a while, as
+// they're not worth recalculating on every page load.
+func InstanceUsageStats() (stats InstanceStats, err error) {
+	cacheKey := "instancestats"
+	ok, err := fetchFromCache(cacheKey, &stats)
+	if err != nil {
+		log.Printf("Error retrieving data from cache: %v\n", err)
+	}
+	if ok {
+		return stats, nil
+	}
+
+	dbQuery := `
+		SELECT (
+				SELECT count(*)
+				FROM sqlite_databases AS db
+				WHERE db.public = true
+					AND NOT EXISTS (
+						SELECT 1
+						FROM takedown_requests AS td
+						WHERE td.db_owner = db.username
+							AND td.db_folder = db.folder
+							AND td.db_name = db.dbname
+							AND td.status IN ('` + TakedownAccepted + `', '` + TakedownCountered + `')
+					)
+			), (
+				SELECT count(*)
+				FROM users
+				WHERE disabled = false
+			), (
+				SELECT coalesce(sum(downloads), 0)
+				FROM database_downloads
+				WHERE day >= date_trunc('month', timezone('utc'::text, now()))::date
+			), timezone('utc'::text, now())`
+	err = readDB().QueryRow(dbQuery).Scan(&stats.PublicDatabases, &stats.Users, &stats.DownloadsThisMonth,
+		&stats.Generated)
+	if err != nil {
+		log.Printf("Error retrieving instance statistics: %v\n", err)
+		return InstanceStats{}, err
+	}
+
+	err = storeInCache(cacheKey, stats, InstanceStatsCacheTime)
+	if err != nil {
+		log.Printf("Error when caching instance statistics: %v\n", err)
+	}
+	return stats, nil
+}
+
+// Check if a user is following another user.
+func IsFollowing(follower string, followed string) (bool, error) {
+	dbQuery := `
+		SELECT count(*)
+		FROM user_follows
+		WHERE follower = $1
+			AND followed = $2`
+	var n int
+	err := pdb.QueryRow(dbQuery, follower, followed).Scan(&n)
+	if err != nil {
+		log.Printf("Error checking if user '%s' follows '%s': %v\n", follower, followed, err)
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Returns true if the given user name belongs to an organisation, rather than a person.
+func IsOrganisation(userName string) (isOrg bool, err error) {
+	err = pdb.QueryRow(`
+		SELECT is_org
+		FROM users
+		WHERE username = $1`, userName).Scan(&isOrg)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Error checking if '%s' is an organisation: %v\n", userName, err)
+		return false, err
+	}
+	return isOrg, nil
+}
+
+// Returns the storage details for the latest version of each of a user's public databases, leaving out any which
+// have been taken down.
+func LatestPublicDBVersions(userName string) (list []StoredDBVersion, err error) {
+	dbQuery := `
+		SELECT DISTINCT ON (db.dbname) ver.idnum, db.username, db.folder, db.dbname, ver.version, db.minio_bucket,
+			ver.minioid, ver.size, ver.sha256
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.public = true
+			AND NOT EXISTS (
+				SELECT 1
+				FROM takedown_requests AS td
+				WHERE td.db_owner = db.username
+					AND td.db_folder = db.folder
+					AND td.db_name = db.dbname
+					AND td.status IN ('` + TakedownAccepted + `', '` + TakedownCountered + `')
+			)
+		ORDER BY db.dbname, ver.version DESC`
+	rows, err := readDB().Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow StoredDBVersion
+		err = rows.Scan(&oneRow.ID, &oneRow.Owner, &oneRow.Folder, &oneRow.DBName, &oneRow.Version,
+			&oneRow.MinioBkt, &oneRow.MinioID, &oneRow.Size, &oneRow.SHA256)
+		if err != nil {
+			log.Printf("Error retrieving public database list for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Links an external login identity to a user, so they can log in with it.  Linking an identity which is already
+// linked to the same user does nothing, but one belonging to a different user is an error.
+func LinkIdentity(userName string, ident LoginIdentity) error {
+	dbQuery := `
+		INSERT INTO user_identities (provider, provider_id, username, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, provider_id) DO NOTHING`
+	_, err := pdb.Exec(dbQuery, ident.Provider, ident.ProviderID, userName, ident.Email)
+	if err != nil {
+		log.Printf("Linking %s identity '%s' to user '%s' failed: %v\n", ident.Provider, ident.ProviderID,
+			userName, err)
+		return err
+	}
+	owner, err := UserNameFromIdentity(ident.Provider, ident.ProviderID)
+	if err != nil {
+		return err
+	}
+	if owner != userName {
+		return fmt.Errorf("That %s account is already linked to a different user", LoginProviderName(ident.Provider))
+	}
+	return nil
+}
+
+// Returns the statements recorded in a live database's audit log, newest first.  When before is non zero, only
+// statements older than that journal entry are returned, so the log can be paged through.  A limit of zero returns
+// all of them.
+func LiveStatements(dbID int64, before int64, limit int) (list []LiveStatement, err error) {
+	dbQuery := `
+		SELECT journal_id, username, statement, rows_affected, date_executed
+		FROM live_journal
+		WHERE db = $1
+			AND ($2 = 0 OR journal_id < $2)
+		ORDER BY journal_id DESC
+		LIMIT NULLIF($3, 0)`
+	rows, err := pdb.Query(dbQuery, dbID, before, limit)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow LiveStatement
+		err = rows.Scan(&oneRow.ID, &oneRow.UserName, &oneRow.Statement, &oneRow.RowsAffected, &oneRow.DateExecuted)
+		if err != nil {
+			log.Printf("Error retrieving audit log for live database %d: %v\n", dbID, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Marks all of a user's notifications as read.
+func MarkAllNotificationsRead(userName string) error {
+	dbQuery := `
+		UPDATE notifications
+		SET read = true
+		WHERE username = $1
+			AND read = false`
+	_, err := pdb.Exec(dbQuery, userName)
+	if err != nil {
+		log.Printf("Marking notifications read for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	return nil
+}
+
+// Marks one of a user's notifications as read.
+func MarkNotificationRead(userName string, id int64) error {
+	dbQuery := `
+		UPDATE notifications
+		SET read = true
+		WHERE username = $1
+			AND idnum = $2`
+	commandTag, err := pdb.Exec(dbQuery, userName, id)
+	if err != nil {
+		log.Printf("Marking notification %d read for user '%s' failed: %v\n", id, userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Unknown notification %d", id)
+	}
+	return nil
+}
+
+// Returns a merge request of a database.
+func MergeRequest(dbOwner string, dbFolder string, dbName string, id int64) (mr MergeRequest, found bool,
+	err error) {
+	dbQuery := `
+		SELECT mr.mr_id, mr.source_branch, mr.target_branch, mr.title, coalesce(mr.description, ''), mr.state,
+			mr.created_by, mr.date_created, coalesce(mr.closed_by, ''), mr.date_closed,
+			coalesce(mr.merged_version, 0)
+		FROM merge_requests AS mr, sqlite_databases AS db
+		WHERE mr.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND mr.mr_id = $4`
+	var closed pgx.NullTime
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, id).Scan(&mr.ID, &mr.SourceBranch, &mr.TargetBranch,
+		&mr.Title, &mr.Description, &mr.State, &mr.CreatedBy, &mr.DateCreated, &mr.ClosedBy, &closed,
+		&mr.MergedVersion)
+	if err == pgx.ErrNoRows {
+		return MergeRequest{}, false, nil
+	}
+	if err != nil {
+		log.Printf("Error retrieving merge request %d of '%s%s%s': %v\n", id, dbOwner, dbFolder, dbName, err)
+		return MergeRequest{}, false, err
+	}
+	if closed.Valid {
+		mr.DateClosed = closed.Time
+	}
+	return mr, true, nil
+}
+
+// Returns the approvals a merge request has been given, oldest first.
+func MergeRequestApprovals(id int64) (list []MergeRequestEvent, err error) {
+	dbQuery := `
+		SELECT username, date_approved
+		FROM merge_request_approvals
+		WHERE mr_id = $1
+		ORDER BY date_approved`
+	rows, err := pdb.Query(dbQuery, id)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := MergeRequestEvent{Kind: MergeEventApproved}
+		err = rows.Scan(&e.UserName, &e.Date)
+		if err != nil {
+			log.Printf("Error retrieving approvals of merge request %d: %v\n", id, err)
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// Returns the merge requests of a database, newest first.
+func MergeRequests(dbOwner string, dbFolder string, dbName string) (list []MergeRequest, err error) {
+	dbQuery := `
+		SELECT mr.mr_id, mr.source_branch, mr.target_branch, mr.title, mr.state, mr.created_by, mr.date_created
+		FROM merge_requests AS mr, sqlite_databases AS db
+		WHERE mr.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY mr.mr_id DESC`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mr MergeRequest
+		err = rows.Scan(&mr.ID, &mr.SourceBranch, &mr.TargetBranch, &mr.Title, &mr.State, &mr.CreatedBy,
+			&mr.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving merge requests of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, mr)
+	}
+	return list, nil
+}
+
+// Returns the Minio IDs of all database versions (including deleted ones which can still be restored), attachments, and
+// user avatars stored in a given bucket.
+func MinioBucketObjectIDs(bucket string) (map[string]bool, error) {
+	dbQuery := `
+		SELECT ver.minioid
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.minio_bucket = $1
+		UNION
+		SELECT del.minioid
+		FROM deleted_versions AS del, sqlite_databases AS db
+		WHERE del.db = db.idnum
+			AND db.minio_bucket = $1
+		UNION
+		SELECT minio_id
+		FROM attachments
+		WHERE minio_bucket = $1
+		UNION
+		SELECT avatar_minio_id
+		FROM users
+		WHERE minio_bucket = $1
+			AND avatar_minio_id IS NOT NULL`
+	rows, err := pdb.Query(dbQuery, bucket)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			log.Printf("Error retrieving Minio IDs for bucket '%s': %v\n", bucket, err)
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// Returns the SHA256 of the database version stored in the given Minio object.
+func MinioObjectSHA(bucket string, id string) (sha string, err error) {
+	dbQuery := `
+		SELECT ver.sha256
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.minio_bucket = $1
+			AND ver.minioid = $2
+		LIMIT 1`
+	err = readDB().QueryRow(dbQuery, bucket, id).Scan(&sha)
+	if err != nil {
+		log.Printf("Error retrieving SHA256 of Minio object '%s/%s': %v\n", bucket, id, err)
+		return "", err
+	}
+	return sha, nil
+}
+
+// Return the Minio bucket name for a given user.
+func MinioUserBucket(userName string) (string, error) {
+	var minioBucket string
+	err := pdb.QueryRow(`
+		SELECT minio_bucket
+		FROM users
+		WHERE username = $1`, userName).Scan(&minioBucket)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			log.Printf("No known Minio bucket for user '%s'\n", userName)
+			return "", errors.New("No known Minio bucket for that user")
+		} else {
+			log.Printf("Error when looking up Minio bucket name for user '%v': %v\n", userName, err)
+			return "", err
+		}
+	}
+
+	return minioBucket, nil
+}
+
+// Return the Minio bucket and ID for a given database. dbOwner, dbFolder & dbName identify the database,
+// loggedInUser is the name for the currently logged in user, for access permission check.  Use an empty string ("")
+// as the loggedInUser parameter if the true value isn't set or known.  If the requested database doesn't exist, or
+// the loggedInUser doesn't have access to it, then an error will be returned.
+func MinioBucketID(dbOwner string, dbFolder string, dbName string, dbVersion int, loggedInUser string) (bkt string, id string, err error) {
+	dbQuery := `
+		SELECT db.minio_bucket, ver.minioid
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.version = $4`
+	args := []interface{}{dbOwner, dbFolder, dbName, dbVersion}
+	if loggedInUser != dbOwner {
+		// The request is for another users database, so it needs to be a public one, or shared with the user
+		dbQuery += `
+			AND (db.public = true OR db.idnum IN (SELECT db FROM database_access WHERE username = $5))`
+		args = append(args, loggedInUser)
+	}
+	err = pdb.QueryRow(dbQuery, args...).Scan(&bkt, &id)
+	if err != nil {
+		log.Printf("Error retrieving MinioID for %s%s%s version %v: %v\n", dbOwner, dbFolder, dbName, dbVersion,
+			err)
+		return "", "", err
+	}
+
+	if bkt == "" || id == "" {
+		// The requested database doesn't exist, or the logged in user doesn't have access to it
+		return "", "", errors.New("The requested database wasn't found")
+	}
+
+	return bkt, id, nil
+}
+
+// Returns the list of Minio buckets assigned to users.
+func MinioUserBuckets() ([]string, error) {
+	dbQuery := `
+		SELECT minio_bucket
+		FROM users
+		WHERE minio_bucket IS NOT NULL
+		ORDER BY minio_bucket`
+	rows, err := pdb.Query(dbQuery)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var buckets []string
+	for rows.Next() {
+		var bkt string
+		err = rows.Scan(&bkt)
+		if err != nil {
+			log.Printf("Error retrieving Minio bucket list: %v\n", err)
+			return nil, err
+		}
+		buckets = append(buckets, bkt)
+	}
+	return buckets, nil
+}
+
+// Works out the lineage chain and commit history links of a new database version.  The version follows on from the
+// latest existing version in the lineage chain, whichever branch that's on.  Its parent commit is the latest version
+// on the same branch, with the first version on a new branch following on from the latest one on the main branch.
+func newVersionLineage(dbOwner string, dbFolder string, dbName string, dbVer int, sha string, author string, commitMsg string, branch string) (*versionLineage, error) {
+	var l versionLineage
+	dbQuery := `
+		SELECT coalesce(ver.chain_hash, '')
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.version < $4
+		ORDER BY ver.version DESC
+		LIMIT 1`
+	err := pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, dbVer).Scan(&l.PrevHash)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Retrieving previous lineage hash for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return nil, err
+	}
+	dbQuery = `
+		SELECT coalesce(ver.commit_id, '')
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ver.version < $4
+			AND ver.branch IN ($5, $6)
+		ORDER BY ver.branch = $5 DESC, ver.version DESC
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, dbVer, branch, DefaultBranch).Scan(&l.ParentCommit)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Retrieving parent commit for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return nil, err
+	}
+	l.Created = time.Now().UTC().Truncate(time.Microsecond)
+	l.ChainHash = lineageHash(l.PrevHash, dbVer, sha, l.Created)
+	l.CommitID = commitID(l.ParentCommit, sha, author, commitMsg, l.Created)
+	return &l, nil
+}
+
+// Returns a user's notification preferences, as a map of notification kind to channel to whether it's turned on.
+// Every kind and channel is included, with the defaults filled in for any the user hasn't set.
+func NotificationPrefs(userName string) (prefs map[string]map[string]bool, err error) {
+	prefs = make(map[string]map[string]bool)
+	for _, k := range NotificationKinds {
+		prefs[k.Kind] = make(map[string]bool)
+		for _, c := range NotificationChannels {
+			prefs[k.Kind][c] = notificationDefault(k.Kind, c)
+		}
+	}
+	dbQuery := `
+		SELECT kind, channel, enabled
+		FROM notification_prefs
+		WHERE username = $1`
+	rows, err := pdb.Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, channel string
+		var enabled bool
+		err = rows.Scan(&kind, &channel, &enabled)
+		if err != nil {
+			log.Printf("Error retrieving notification preferences for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		if _, ok := prefs[kind]; ok {
+			prefs[kind][channel] = enabled
+		}
+	}
+	return prefs, nil
+}
+
+// Returns the most recent notifications for a user, newest first, along with the number which haven't been read.
+func Notifications(userName string, maxEntries int) (list []Notification, unread int, err error) {
+	dbQuery := `
+		SELECT count(*)
+		FROM notifications
+		WHERE username = $1
+			AND read = false`
+	err = pdb.QueryRow(dbQuery, userName).Scan(&unread)
+	if err != nil {
+		log.Printf("Error counting unread notifications for user '%s': %v\n", userName, err)
+		return nil, 0, err
+	}
+
+	dbQuery = `
+		SELECT idnum, kind, message, link, read, date_created
+		FROM notifications
+		WHERE username = $1
+		ORDER BY date_created DESC
+		LIMIT $2`
+	rows, err := pdb.Query(dbQuery, userName, maxEntries)
+	if err != nil {
+		log.Printf("Retrieving notifications for user '%s' failed: %v\n", userName, err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n Notification
+		err = rows.Scan(&n.ID, &n.Kind, &n.Message, &n.Link, &n.Read, &n.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving notifications for user '%s': %v\n", userName, err)
+			return nil, 0, err
+		}
+		list = append(list, n)
+	}
+	return list, unread, nil
+}
+
+// Returns where to deliver a notification of the given kind for each of the given users.  Unknown users are left out.
+func NotificationTargets(userNames []string, kind string) (list []NotificationTarget, err error) {
+	dbQuery := `
+		SELECT u.username, coalesce(web.enabled, $3),
+			CASE WHEN coalesce(em.enabled, $4) THEN coalesce(u.email, '') ELSE '' END,
+			CASE WHEN coalesce(wh.enabled, $5) THEN coalesce(u.notify_webhook, '') ELSE '' END
+		FROM users AS u
+			LEFT JOIN notification_prefs AS web
+				ON web.username = u.username AND web.kind = $2 AND web.channel = '` + ChannelWeb + `'
+			LEFT JOIN notification_prefs AS em
+				ON em.username = u.username AND em.kind = $2 AND em.channel = '` + ChannelEmail + `'
+			LEFT JOIN notification_prefs AS wh
+				ON wh.username = u.username AND wh.kind = $2 AND wh.channel = '` + ChannelWebhook + `'
+		WHERE u.username = ANY($1)`
+	rows, err := pdb.Query(dbQuery, userNames, kind, notificationDefault(kind, ChannelWeb),
+		notificationDefault(kind, ChannelEmail), notificationDefault(kind, ChannelWebhook))
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t NotificationTarget
+		err = rows.Scan(&t.UserName, &t.Web, &t.Email, &t.Webhook)
+		if err != nil {
+			log.Printf("Error retrieving notification targets: %v\n", err)
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// Returns the details of a registered OAuth client application.  If the client doesn't exist, the returned ClientID
+// is empty.
+func OAuthClientDetails(clientID string) (client OAuthClient, err error) {
+	dbQuery := `
+		SELECT client_id, client_name, redirect_uri, date_created
+		FROM oauth_clients
+		WHERE client_id = $1`
+	err = pdb.QueryRow(dbQuery, clientID).Scan(&client.ClientID, &client.Name, &client.RedirectURI,
+		&client.DateCreated)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return client, nil
+		}
+		log.Printf("Error retrieving details for OAuth client '%s': %v\n", clientID, err)
+		return client, err
+	}
+	return client, nil
+}
+
+// Returns the list of registered OAuth client applications.
+func OAuthClients() (list []OAuthClient, err error) {
+	dbQuery := `
+		SELECT client_id, client_name, redirect_uri, date_created
+		FROM oauth_clients
+		ORDER BY client_name`
+	rows, err := pdb.Query(dbQuery)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow OAuthClient
+		err = rows.Scan(&oneRow.ClientID, &oneRow.Name, &oneRow.RedirectURI, &oneRow.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving list of OAuth clients: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the third party applications a user has granted access to, which still have an unexpired access token.
+func OAuthGrants(userName string) (list []OAuthGrant, err error) {
+	dbQuery := `
+		SELECT c.client_id, c.client_name, t.scope, t.date_created, t.expiry, t.last_used, t.last_used_ip,
+			t.last_used_endpoint
+		FROM oauth_tokens AS t, oauth_clients AS c
+		WHERE t.client_id = c.client_id
+			AND t.username = $1
+			AND t.expiry > now()
+		ORDER BY t.date_created DESC`
+	rows, err := pdb.Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow OAuthGrant
+		var lastUsed pgx.NullTime
+		var ip, endpoint pgx.NullString
+		err = rows.Scan(&oneRow.ClientID, &oneRow.ClientName, &oneRow.Scope, &oneRow.DateCreated, &oneRow.Expiry,
+			&lastUsed, &ip, &endpoint)
+		if err != nil {
+			log.Printf("Error retrieving authorised applications for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		if lastUsed.Valid {
+			oneRow.LastUse = CredentialUse{Endpoint: endpoint.String, IP: ip.String, LastUsed: lastUsed.Time}
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns the user and scope an OAuth access token was issued for.  If the token is unknown or has expired, or the user
+// has been disabled, the returned user name is empty.
+func OAuthTokenUser(token string) (userName string, scope string, err error) {
+	dbQuery := `
+		SELECT t.username, t.scope
+		FROM oauth_tokens AS t, users AS u
+		WHERE t.username = u.username
+			AND t.token_hash = $1
+			AND t.expiry > now()
+			AND u.disabled = false`
+	err = pdb.QueryRow(dbQuery, tokenHash(token)).Scan(&userName, &scope)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", "", nil
+		}
+		log.Printf("Error retrieving OAuth access token details: %v\n", err)
+		return "", "", err
+	}
+	return userName, scope, nil
+}
+
+// Returns the members of an organisation, owners first.
+func OrgMembers(orgName string) (list []OrgMember, err error) {
+	dbQuery := `
+		SELECT username, role, date_joined
+		FROM organisation_members
+		WHERE org = $1
+		ORDER BY CASE role WHEN 'owner' THEN 1 WHEN 'admin' THEN 2 ELSE 3 END, username`
+	rows, err := readDB().Query(dbQuery, orgName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m OrgMember
+		err = rows.Scan(&m.UserName, &m.Role, &m.DateJoined)
+		if err != nil {
+			log.Printf("Error retrieving members of organisation '%s': %v\n", orgName, err)
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+// Returns the role a user has in an organisation, or an empty string if they're not a member of it.
+func OrgRole(orgName string, userName string) (role string, err error) {
+	err = pdb.QueryRow(`
+		SELECT role
+		FROM organisation_members
+		WHERE org = $1
+			AND username = $2`, orgName, userName).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		log.Printf("Error looking up role of '%s' in organisation '%s': %v\n", userName, orgName, err)
+		return "", err
+	}
+	return role, nil
+}
+
+// Returns the most starred public databases.
+func PopularDBs(limit int) ([]DBSummary, error) {
+	return frontPageDBs("popular", "", "db.stars DESC, db.last_modified DESC", limit)
+}
+
+// Returns true if the user has opted into experimental features.
+func PrefUserBeta(loggedInUser string) bool {
+	dbQuery := `
+		SELECT pref_beta
+		FROM users
+		WHERE username = $1`
+	var beta bool
+	err := pdb.QueryRow(dbQuery, loggedInUser).Scan(&beta)
+	if err != nil {
+		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
+		return false
+	}
+	return beta
+}
+
+// Returns how often a user wants an email digest of their starred databases.
+func PrefUserDigest(loggedInUser string) string {
+	dbQuery := `
+		SELECT pref_digest
+		FROM users
+		WHERE username = $1`
+	var digest string
+	err := pdb.QueryRow(dbQuery, loggedInUser).Scan(&digest)
+	if err != nil {
+		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
+		return DigestNone // Use the default value
+	}
+	return digest
+}
+
+// Return the user's preference for maximum number of SQLite rows to display.  Users who haven't chosen a value get
+// the instance default, and values above the instance limit (which may have been lowered since) are capped to it.
+func PrefUserMaxRows(loggedInUser string) int {
+	// Retrieve the user preference data
+	dbQuery := `
+		SELECT pref_max_rows
+		FROM users
+		WHERE username = $1`
+	var maxRows pgx.NullInt32
+	err := pdb.QueryRow(dbQuery, loggedInUser).Scan(&maxRows)
+	if err != nil {
+		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
+		return WebDisplayRows() // Use the default value
+	}
+	if !maxRows.Valid || maxRows.Int32 < 1 {
+		return WebDisplayRows()
+	}
+	if int(maxRows.Int32) > WebMaxDisplayRows() {
+		return WebMaxDisplayRows()
+	}
+	return int(maxRows.Int32)
+}
+
+// Returns the URL a user wants webhook notifications sent to.  Empty if they haven't given one.
+func PrefUserNotifyWebhook(loggedInUser string) string {
+	dbQuery := `
+		SELECT coalesce(notify_webhook, '')
+		FROM users
+		WHERE username = $1`
+	var webhook string
+	err := pdb.QueryRow(dbQuery, loggedInUser).Scan(&webhook)
+	if err != nil {
+		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
+		return ""
+	}
+	return webhook
+}
+
+// Marks a branch of a database as protected.  Protecting a branch which already is does nothing.
+func ProtectBranch(dbOwner string, dbFolder string, dbName string, branch string, userName string) error {
+	dbQuery := `
+		INSERT INTO protected_branches (db, branch, protected_by)
+		SELECT idnum, $4, $5
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		ON CONFLICT (db, branch) DO NOTHING`
+	_, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, branch, userName)
+	if err != nil {
+		log.Printf("Protecting branch '%s' of database '%s%s%s' failed: %v\n", branch, dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	return nil
+}
+
+// Returns the protected branches of a database.
+func ProtectedBranches(dbOwner string, dbFolder string, dbName string) (list []ProtectedBranch, err error) {
+	dbQuery := `
+		SELECT pro.branch, pro.date_protected, pro.protected_by
+		FROM protected_branches AS pro, sqlite_databases AS db
+		WHERE pro.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY pro.branch`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b ProtectedBranch
+		err = rows.Scan(&b.Branch, &b.DateProtected, &b.ProtectedBy)
+		if err != nil {
+			log.Printf("Error retrieving protected branches of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+				err)
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, nil
+}
+
+// Returns the details of a public database (unless it's been taken down), along with its versions.
+func PublicDB(dbOwner string, dbFolder string, dbName string) (db MirrorDB, found bool, err error) {
+	list, err := publicDBs(`
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3`, dbOwner, dbFolder, dbName)
+	if err != nil || len(list) == 0 {
+		return db, false, err
+	}
+	return list[0], true, nil
+}
+
+// Returns the public databases (except ones which have been taken down) along with their versions, for mirrors to
+// copy.
+func PublicDBList() ([]MirrorDB, error) {
+	return publicDBs("")
+}
+
+// Returns public databases along with their versions, restricted by the given extra WHERE clause conditions.
+func publicDBs(where string, args ...interface{}) (list []MirrorDB, err error) {
+	dbQuery := `
+		SELECT db.username, db.folder, db.dbname, coalesce(db.description, ''), coalesce(db.readme, ''),
+			coalesce(db.default_table, ''), ver.version, ver.sha256, ver.size
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.public = true
+			AND NOT EXISTS (
+				SELECT 1
+				FROM takedown_requests AS td
+				WHERE td.db_owner = db.username
+					AND td.db_folder = db.folder
+					AND td.db_name = db.dbname
+					AND td.status IN ('` + TakedownAccepted + `', '` + TakedownCountered + `')
+			)` + where + `
+		ORDER BY db.username, db.folder, db.dbname, ver.version`
+	rows, err := readDB().Query(dbQuery, args...)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var db MirrorDB
+		var ver MirrorDBVersion
+		err = rows.Scan(&db.Owner, &db.Folder, &db.Name, &db.Description, &db.Readme, &db.DefaultTable,
+			&ver.Version, &ver.SHA256, &ver.Size)
+		if err != nil {
+			log.Printf("Error retrieving public database list: %v\n", err)
+			return nil, err
+		}
+		if n := len(list); n > 0 && list[n-1].Owner == db.Owner && list[n-1].Folder == db.Folder &&
+			list[n-1].Name == db.Name {
+			list[n-1].Versions = append(list[n-1].Versions, ver)
+			continue
+		}
+		db.Versions = []MirrorDBVersion{ver}
+		list = append(list, db)
+	}
+	return list, nil
+}
+
+// Purges deleted database versions which were deleted more than the given number of days ago, returning how many
+// were purged.  Their Minio objects are then removed by the orphaned object collection.
+func PurgeDeletedVersions(days int) (int64, error) {
+	dbQuery := `
+		DELETE FROM deleted_versions
+		WHERE date_deleted < now() - ($1::integer * interval '1 day')`
+	commandTag, err := pdb.Exec(dbQuery, days)
+	if err != nil {
+		log.Printf("Purging deleted database versions failed: %v\n", err)
+		return 0, err
+	}
+	return commandTag.RowsAffected(), nil
+}
+
+// Removes webhook deliveries older than WebhookLogDays from the delivery log.  Deliveries still being retried are
+// kept.
+func PurgeWebhookDeliveries() (int64, error) {
+	dbQuery := `
+		DELETE FROM webhook_deliveries
+		WHERE status <> 'pending'
+			AND date_created < timezone('utc'::text, now()) - $1 * interval '1 day'`
+	commandTag, err := pdb.Exec(dbQuery, WebhookLogDays)
+	if err != nil {
+		log.Printf("Purging old webhook deliveries failed: %v\n", err)
+		return 0, err
+	}
+	return commandTag.RowsAffected(), nil
+}
+
+// Returns the most recent queries executed by a user, newest first.
+func QueryHistory(userName string, maxEntries int) (list []QueryHistoryEntry, err error) {
+	dbQuery := `
+		SELECT idnum, db_owner, db_folder, db_name, db_version, query, duration_ms, row_count, cached, date_executed
+		FROM query_history
+		WHERE username = $1
+		ORDER BY date_executed DESC
+		LIMIT $2`
+	rows, err := pdb.Query(dbQuery, userName, maxEntries)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow QueryHistoryEntry
+		err = rows.Scan(&oneRow.ID, &oneRow.DBOwner, &oneRow.DBFolder, &oneRow.DBName, &oneRow.DBVersion,
+			&oneRow.Query, &oneRow.Duration, &oneRow.RowCount, &oneRow.Cached, &oneRow.DateExecuted)
+		if err != nil {
+			log.Printf("Error retrieving query history for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+
+	return list, nil
+}
+
+// Returns a single entry from a user's query history.
+func QueryHistoryItem(userName string, id int64) (entry QueryHistoryEntry, err error) {
+	dbQuery := `
+		SELECT idnum, db_owner, db_folder, db_name, db_version, query, duration_ms, row_count, cached, date_executed
+		FROM query_history
+		WHERE username = $1
+			AND idnum = $2`
+	err = pdb.QueryRow(dbQuery, userName, id).Scan(&entry.ID, &entry.DBOwner, &entry.DBFolder, &entry.DBName,
+		&entry.DBVersion, &entry.Query, &entry.Duration, &entry.RowCount, &entry.Cached, &entry.DateExecuted)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return entry, errors.New("Unknown query history entry")
+		}
+		log.Printf("Error retrieving query history entry %d for user '%s': %v\n", id, userName, err)
+		return entry, err
+	}
+	return entry, nil
+}
+
+// Adds a delivery of an event to each of a database's webhooks which want it.
+func queueWebhookDeliveries(dbOwner string, dbFolder string, dbName string, event string, payload string) error {
+	dbQuery := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT hook.webhook_id, $4, $5
+		FROM database_webhooks AS hook, sqlite_databases AS db
+		WHERE hook.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND $4 = ANY (hook.events)`
+	_, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, event, payload)
+	if err != nil {
+		log.Printf("Queueing '%s' webhook deliveries for '%s%s%s' failed: %v\n", event, dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	return nil
+}
+
+// Returns the connection pool to use for read only queries.  Read replicas are used in turn when configured,
+// otherwise the primary server is used.  Replicas can lag slightly behind the primary, so queries whose results
+// need to reflect a write which has just happened should use pdb directly.
+func readDB() *pgx.ConnPool {
+	if len(pdbReplicas) == 0 {
+		return pdb
+	}
+	n := atomic.AddUint32(&replicaCounter, 1)
+	return pdbReplicas[n%uint32(len(pdbReplicas))]
+}
+
+// Returns the most recently updated public databases.
+func RecentDBs(limit int) ([]DBSummary, error) {
+	return frontPageDBs("recent", "", "db.last_modified DESC", limit)
+}
+
+// Records something a user did to a database, for the activity feeds.
+func RecordActivity(userName string, action string, dbOwner string, dbFolder string, dbName string, version int,
+	detail string) error {
+	dbQuery := `
+		INSERT INTO activity (username, action, db, version, detail)
+		SELECT $1, $2, idnum, $6, $7
+		FROM sqlite_databases
+		WHERE username = $3
+			AND folder = $4
+			AND dbname = $5`
+	_, err := pdb.Exec(dbQuery, userName, action, dbOwner, dbFolder, dbName, version, detail)
+	if err != nil {
+		log.Printf("Recording '%s' activity by '%s' on '%s%s%s' failed: %v\n", action, userName, dbOwner, dbFolder,
+			dbName, err)
+		return err
+	}
+	return nil
+}
+
+// Records the use of a personal API token.  If the token hadn't been used for a long time, its user is warned.
+func RecordAPITokenUse(token string, ip string, endpoint string) error {
+	dbQuery := `
+		UPDATE api_tokens AS t
+		SET last_used = timezone('utc'::text, now()), last_used_ip = $2, last_used_endpoint = $3
+		FROM (
+			SELECT token_hash, last_used
+			FROM api_tokens
+			WHERE token_hash = $1
+			FOR UPDATE) AS prev
+		WHERE t.token_hash = prev.token_hash
+		RETURNING t.username, t.name, prev.last_used`
+	var userName, name string
+	var lastUsed pgx.NullTime
+	err := pdb.QueryRow(dbQuery, tokenHash(token), ip, endpoint).Scan(&userName, &name, &lastUsed)
+	if err != nil {
+		log.Printf("Recording API token use failed: %v\n", err)
+		return err
+	}
+	if lastUsed.Valid {
+		notifyDormantUse(userName, fmt.Sprintf("API token '%s'", name), lastUsed.Time, ip, "/pref")
+	}
+	return nil
+}
+
+// Records the use of a client certificate, given its serial number.  If the certificate hadn't been used for a long
+// time, its user is warned.
+func RecordCertUse(serial string, ip string, endpoint string) error {
+	dbQuery := `
+		UPDATE client_certs AS c
+		SET last_used = timezone('utc'::text, now()), last_used_ip = $2, last_used_endpoint = $3
+		FROM (
+			SELECT serial, last_used
+			FROM client_certs
+			WHERE serial = $1
+			FOR UPDATE) AS prev
+		WHERE c.serial = prev.serial
+		RETURNING c.username, c.name, prev.last_used`
+	var userName, name string
+	var lastUsed pgx.NullTime
+	err := pdb.QueryRow(dbQuery, serial, ip, endpoint).Scan(&userName, &name, &lastUsed)
+	if err != nil {
+		log.Printf("Recording use of client certificate '%s' failed: %v\n", serial, err)
+		return err
+	}
+	if lastUsed.Valid {
+		notifyDormantUse(userName, fmt.Sprintf("DB4S client certificate '%s'", name), lastUsed.Time, ip,
+			"/certificates")
+	}
+	return nil
+}
+
+// Adds one to today's download count for a database.
+func RecordDownload(dbOwner string, dbFolder string, dbName string) error {
+	dbQuery := `
+		INSERT INTO database_downloads (db, downloads)
+		SELECT idnum, 1
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		ON CONFLICT (db, day)
+			DO UPDATE SET downloads = database_downloads.downloads + 1`
+	_, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Recording download of database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	return nil
+}
+
+// Journals a statement run against a live database, and flags the database as needing a snapshot.
+func RecordLiveStatement(dbID int64, userName string, statement string, rowsAffected int64) error {
+	dbQuery := `
+		WITH journal AS (
+			INSERT INTO live_journal (db, username, statement, rows_affected)
+			VALUES ($1, $2, $3, $4)
+		)
+		UPDATE sqlite_databases
+		SET live_changed = true
+		WHERE idnum = $1`
+	_, err := pdb.Exec(dbQuery, dbID, userName, statement, rowsAffected)
+	if err != nil {
+		log.Printf("Journaling statement for live database %d failed: %v\n", dbID, err)
+		return err
+	}
+	return nil
+}
+
+// Records a user logging in from an IP address and browser.  Returns whether they've logged in from that combination
+// before, and whether this is the first login recorded for them at all.
+func RecordLogin(userName string, ip string, userAgent string) (seen bool, firstLogin bool, err error) {
+	dbQuery := `
+		SELECT EXISTS (
+				SELECT 1
+				FROM user_logins
+				WHERE username = $1
+					AND ip = $2
+					AND user_agent = $3),
+			NOT EXISTS (
+				SELECT 1
+				FROM user_logins
+				WHERE username = $1)`
+	err = pdb.QueryRow(dbQuery, userName, ip, userAgent).Scan(&seen, &firstLogin)
+	if err != nil {
+		log.Printf("Error checking previous logins of user '%s': %v\n", userName, err)
+		return false, false, err
+	}
+	dbQuery = `
+		INSERT INTO user_logins (username, ip, user_agent)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username, ip, user_agent)
+			DO UPDATE SET last_seen = timezone('utc'::text, now())`
+	_, err = pdb.Exec(dbQuery, userName, ip, userAgent)
+	if err != nil {
+		log.Printf("Recording login of user '%s' failed: %v\n", userName, err)
+		return false, false, err
+	}
+	return seen, firstLogin, nil
+}
+
+// Records the use of an OAuth access token.  If the token hadn't been used for a long time, its user is warned.
+func RecordTokenUse(token string, ip string, endpoint string) error {
+	dbQuery := `
+		UPDATE oauth_tokens AS t
+		SET last_used = timezone('utc'::text, now()), last_used_ip = $2, last_used_endpoint = $3
+		FROM (
+			SELECT token_hash, last_used
+			FROM oauth_tokens
+			WHERE token_hash = $1
+			FOR UPDATE) AS prev
+		WHERE t.token_hash = prev.token_hash
+		RETURNING t.username, prev.last_used, (
+			SELECT client_name
+			FROM oauth_clients
+			WHERE client_id = t.client_id)`
+	var userName, clientName string
+	var lastUsed pgx.NullTime
+	err := pdb.QueryRow(dbQuery, tokenHash(token), ip, endpoint).Scan(&userName, &lastUsed, &clientName)
+	if err != nil {
+		log.Printf("Recording OAuth access token use failed: %v\n", err)
+		return err
+	}
+	if lastUsed.Valid {
+		notifyDormantUse(userName, fmt.Sprintf("access token for '%s'", clientName), lastUsed.Time, ip, "/pref")
+	}
+	return nil
+}
+
+// Returns public databases similar to the given one, most similar first.  Databases in the same fork tree score
+// highest, followed by those starred by the same users, with archived databases last.  The list is cached per
+// database for a while, as working out the co-starring is fairly expensive.
+func RelatedDBs(dbOwner string, dbFolder string, dbName string, limit int) ([]DBSummary, error) {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("related/%s/%s/%s/%d/%d", dbOwner, dbFolder, dbName,
+		dbGeneration(dbOwner, dbFolder, dbName), limit)))
+	cacheKey := hex.EncodeToString(tempArr[:])
+	var list []DBSummary
+	ok, err := fetchFromCache(cacheKey, &list)
+	if err != nil {
+		log.Printf("Error retrieving data from cache: %v\n", err)
+	}
+	if ok {
+		return list, nil
+	}
+
+	dbQuery := `
+		WITH target AS (
+			SELECT idnum, root_database
+			FROM sqlite_databases
+			WHERE username = $1
+				AND folder = $2
+				AND dbname = $3
+		), scores AS (
+			SELECT db.idnum, $5::bigint AS score
+			FROM sqlite_databases AS db, target
+			WHERE db.root_database = target.root_database
+				AND db.idnum != target.idnum
+			UNION ALL
+			SELECT other.db, 1
+			FROM database_stars AS mine, database_stars AS other, target
+			WHERE mine.db = target.idnum
+				AND other.username = mine.username
+				AND other.db != target.idnum
+		)
+		SELECT db.username, db.dbname, db.description, db.last_modified, db.stars
+		FROM (
+			SELECT idnum, sum(score) AS score
+			FROM scores
+			GROUP BY idnum
+		) AS s, sqlite_databases AS db
+		WHERE db.idnum = s.idnum
+			AND db.public = true
+			AND db.noindex = false
+			AND NOT EXISTS (
+				SELECT 1
+				FROM takedown_requests AS td
+				WHERE td.db_owner = db.username
+					AND td.db_folder = db.folder
+					AND td.db_name = db.dbname
+					AND td.status IN ('` + TakedownAccepted + `', '` + TakedownCountered + `')
+			)
+		ORDER BY db.archived, s.score DESC, db.stars DESC, db.last_modified DESC
+		LIMIT $4`
+	rows, err := readDB().Query(dbQuery, dbOwner, dbFolder, dbName, limit, RelatedForkScore)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow DBSummary
+		var desc pgx.NullString
+		err = rows.Scan(&oneRow.Owner, &oneRow.DBName, &desc, &oneRow.LastModified, &oneRow.Stars)
+		if err != nil {
+			log.Printf("Error retrieving related databases for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		if desc.Valid {
+			oneRow.Description = desc.String
+		}
+		list = append(list, oneRow)
+	}
+
+	err = storeInCache(cacheKey, list, RelatedDBsCacheTime)
+	if err != nil {
+		log.Printf("Error when caching related databases for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+	}
+	return list, nil
+}
+
+// Removes an announcement.
+func RemoveAnnouncement(id int64) error {
+	dbQuery := `
+		DELETE FROM announcements
+		WHERE idnum = $1`
+	commandTag, err := pdb.Exec(dbQuery, id)
+	if err != nil {
+		log.Printf("Removing announcement %d failed: %v\n", id, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when removing announcement %d\n", numRows, id)
+	}
+	return nil
+}
+
+// Stops sharing a database with a user.
+func RemoveDBShare(dbOwner string, dbFolder string, dbName string, userName string) error {
+	dbQuery := `
+		DELETE FROM database_shares
+		WHERE db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)
+			AND username = $4`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, userName)
+	if err != nil {
+		log.Printf("Removing share of database '%s%s%s' with '%s' failed: %v\n", dbOwner, dbFolder, dbName,
+			userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when removing share of '%s%s%s' with '%s'\n", numRows,
+			dbOwner, dbFolder, dbName, userName)
+	}
+
+	// Cached pages for the database were generated while the user still had access
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Remove a database version from PostgreSQL.
+func RemoveDBVersion(dbOwner string, folder string, dbName string, dbVersion int) error {
+	dbQuery := `
+		DELETE from database_versions
+		WHERE db  = (	SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)
+			AND version = $4`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, folder, dbName, dbVersion)
+	if err != nil {
+		log.Printf("%s: Removing database entry '%s' / '%s' / '%s' version %v failed: %v\n",
+			dbOwner, folder, dbName, dbVersion, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when removing database entry for '%s' / '%s' / '%s' version %v\n",
+			numRows, dbOwner, folder, dbName, dbVersion)
+		return nil
+	}
+
+	// Check if other versions of the database still exist
+	dbQuery = `
+		SELECT count(*) FROM database_versions
+		WHERE db  = (	SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	var numDBs int
+	err = pdb.QueryRow(dbQuery, dbOwner, folder, dbName).Scan(&numDBs)
+	if err != nil {
+		// A real database error occurred
+		log.Printf("Error checking if any further versions of database exist: %v\n", err)
+		return err
+	}
+
+	// Invalidate the cached data for the removed version
+	err = InvalidateDBCache(dbOwner, folder, dbName)
+	if err != nil {
+		return err
+	}
+
+	// The database still has other versions, so there's nothing further to do
+	if numDBs != 0 {
+		return nil
+	}
+
+	// We removed the last version of the database, so now clean up the entry in the sqlite_databases table
+	dbQuery = `
+		DELETE FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err = pdb.Exec(dbQuery, dbOwner, folder, dbName)
+	if err != nil {
+		log.Printf("%s: Removing main entry for '%s' / '%s' / '%s' failed: %v\n", dbOwner, folder,
+			dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when removing main database entry for '%s' / '%s' / '%s'\n",
+			numRows, dbOwner, folder, dbName)
+	}
+
+	return nil
+}
+
+// Removes a webhook from a database, along with its delivery log.
+func RemoveDBWebhook(dbOwner string, dbFolder string, dbName string, webhookID int64) error {
+	dbQuery := `
+		DELETE FROM database_webhooks
+		WHERE webhook_id = $4
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, webhookID)
+	if err != nil {
+		log.Printf("Removing webhook %d from database '%s%s%s' failed: %v\n", webhookID, dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("Unknown webhook")
+	}
+	return nil
+}
+
+// Removes an admin override of a feature flag, so the default from the configuration file applies again.
+func RemoveFeatureFlag(name string) error {
+	_, err := pdb.Exec(`
+		DELETE FROM feature_flags
+		WHERE name = $1`, name)
+	if err != nil {
+		log.Printf("Removing override of feature flag '%s' failed: %v\n", name, err)
+		return err
+	}
+	return invalidateFeatureFlags()
+}
+
+// Removes an import webhook from a database.
+func RemoveImportHook(dbOwner string, dbFolder string, dbName string, hookID int64) error {
+	dbQuery := `
+		DELETE FROM import_hooks
+		WHERE hook_id = $4
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, hookID)
+	if err != nil {
+		log.Printf("Removing import webhook %d from database '%s%s%s' failed: %v\n", hookID, dbOwner, dbFolder,
+			dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("Unknown import webhook")
+	}
+	return nil
+}
+
+// Removes a registered OAuth client application, along with any access tokens issued to it.
+func RemoveOAuthClient(clientID string) error {
+	dbQuery := `
+		DELETE FROM oauth_clients
+		WHERE client_id = $1`
+	commandTag, err := pdb.Exec(dbQuery, clientID)
+	if err != nil {
+		log.Printf("Removing OAuth client '%s' failed: %v\n", clientID, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when removing OAuth client '%s'\n", numRows, clientID)
+	}
+	return nil
+}
+
+// Removes a member from an organisation.  The last owner can't be removed, as then nobody could manage it.
+func RemoveOrgMember(orgName string, userName string) error {
+	dbQuery := `
+		DELETE FROM organisation_members
+		WHERE org = $1
+			AND username = $2
+			AND (role <> $3 OR (
+				SELECT count(*)
+				FROM organisation_members
+				WHERE org = $1
+					AND role = $3) > 1)`
+	commandTag, err := pdb.Exec(dbQuery, orgName, userName, OrgRoleOwner)
+	if err != nil {
+		log.Printf("Removing '%s' from organisation '%s' failed: %v\n", userName, orgName, err)
+		return err
+	}
+	if commandTag.RowsAffected() != 1 {
+		return errors.New("That user isn't a member, or is the organisation's only owner")
+	}
+
+	// The member list is shown on the organisation's page
+	return InvalidateUserCache(orgName)
+}
+
+// Stops a status check context from being required for a database.
+func RemoveRequiredStatusCheck(dbOwner string, dbFolder string, dbName string, checkContext string) error {
+	dbQuery := `
+		DELETE FROM required_status_checks
+		WHERE context = $4
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, checkContext)
+	if err != nil {
+		log.Printf("Removing required status check '%s' from database '%s%s%s' failed: %v\n", checkContext,
+			dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("That status check isn't required")
+	}
+	return nil
+}
+
+// Removes a saved query belonging to a user.
+func RemoveSavedQuery(userName string, id int64) error {
+	dbQuery := `
+		DELETE FROM saved_queries
+		WHERE username = $1
+			AND idnum = $2`
+	commandTag, err := pdb.Exec(dbQuery, userName, id)
+	if err != nil {
+		log.Printf("Removing saved query %d for user '%s' failed: %v\n", id, userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows affected (%v) when removing saved query %d for user '%s'\n", numRows,
+			id, userName)
+	}
+	return nil
+}
+
+// Removes a validation rule from a database.
+func RemoveValidationRule(dbOwner string, dbFolder string, dbName string, ruleID int64) error {
+	dbQuery := `
+		DELETE FROM validation_rules
+		WHERE rule_id = $4
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, ruleID)
+	if err != nil {
+		log.Printf("Removing validation rule %d from database '%s%s%s' failed: %v\n", ruleID, dbOwner, dbFolder,
+			dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("That validation rule doesn't exist")
+	}
+	return nil
+}
+
+// Rename a SQLite daatabase.
+func RenameDatabase(userName string, dbFolder string, dbName string, newName string) error {
+	// Save the database settings
+	SQLQuery := `
+		UPDATE sqlite_databases
+		SET dbname = $4
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(SQLQuery, userName, dbFolder, dbName, newName)
+	if err != nil {
+		log.Printf("Renaming database '%s%s%s' failed: %v\n", userName, dbFolder,
+			dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when renaming '%s%s%s' to '%s%s%s'\n",
+			numRows, userName, dbFolder, dbName, userName, dbFolder, newName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+
+	// Log the rename
+	log.Printf("Database renamed from '%s%s%s' to '%s%s%s'\n", userName, dbFolder, dbName, userName,
+		dbFolder, newName)
+
+	// Invalidate the cached data under both names, as a previously removed database may have used the new one
+	err = InvalidateDBCache(userName, dbFolder, dbName)
+	if err != nil {
+		return err
+	}
+	return InvalidateDBCache(userName, dbFolder, newName)
+}
+
+// Returns the database versions added after the given replication cursor, oldest first.  Every database is included,
+// public or not, as the list is for keeping a standby instance in sync.  The cursor is the ID of the transaction
+// which added each version.  Only versions added by transactions older than the oldest one still running are listed,
+// as a version being added by a running transaction could otherwise show up later on with an earlier cursor than
+// one the standby has already moved past.  The most transactions listed at once is given by maxChanges, and their
+// versions are never split between lists.
+func ReplicationChanges(since int64, maxChanges int) (list []ReplicationChange, err error) {
+	dbQuery := `
+		SELECT ver.txid, db.username, db.folder, db.dbname, db.public, coalesce(db.description, ''),
+			coalesce(db.readme, ''), coalesce(db.default_table, ''), ver.version, ver.sha256, ver.size,
+			ver.date_created, coalesce(ver.message, ''), coalesce(ver.author, db.username), ver.branch,
+			coalesce(ver.prev_hash, ''), coalesce(ver.chain_hash, ''), coalesce(ver.commit_id, ''),
+			coalesce(ver.parent_commit, '')
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND ver.txid IN (
+				SELECT DISTINCT txid
+				FROM database_versions
+				WHERE txid > $1
+					AND txid < txid_snapshot_xmin(txid_current_snapshot())
+				ORDER BY txid
+				LIMIT $2)
+		ORDER BY ver.txid, ver.idnum`
+	rows, err := pdb.Query(dbQuery, since, maxChanges)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c ReplicationChange
+		err = rows.Scan(&c.Cursor, &c.Owner, &c.Folder, &c.Name, &c.Public, &c.Description, &c.Readme,
+			&c.DefaultTable, &c.Version, &c.SHA256, &c.Size, &c.DateCreated, &c.Message, &c.Author, &c.Branch,
+			&c.PrevHash, &c.ChainHash, &c.CommitID, &c.ParentCommit)
+		if err != nil {
+			log.Printf("Error retrieving replication changes: %v\n", err)
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// Returns the last replication cursor applied from the given source.  Zero if nothing has been replicated from it yet.
+func ReplicationCursor(source string) (cursor int64, err error) {
+	dbQuery := `
+		SELECT coalesce(max(cursor), 0)
+		FROM replication_cursors
+		WHERE source = $1`
+	err = pdb.QueryRow(dbQuery, source).Scan(&cursor)
+	if err != nil {
+		log.Printf("Error retrieving replication cursor for '%s': %v\n", source, err)
+		return 0, err
+	}
+	return cursor, nil
+}
+
+// Returns the status check contexts which need to pass before merge requests to a database can be accepted.
+func RequiredStatusChecks(dbOwner string, dbFolder string, dbName string) (list []string, err error) {
+	dbQuery := `
+		SELECT req.context
+		FROM required_status_checks AS req, sqlite_databases AS db
+		WHERE req.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY req.context`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c string
+		err = rows.Scan(&c)
+		if err != nil {
+			log.Printf("Error retrieving required status checks of database '%s%s%s': %v\n", dbOwner, dbFolder,
+				dbName, err)
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// Restores a deleted database version.  If a newer upload has taken the version number in the meantime, the deleted
+// version can't be restored.
+func RestoreDBVersion(dbOwner string, dbFolder string, dbName string, dbVersion int) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for restoring a database version: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var dbID, taken int
+	dbQuery := `
+		SELECT idnum
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		FOR UPDATE`
+	err = tx.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&dbID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("Unknown database '%s%s%s'", dbOwner, dbFolder, dbName)
+		}
+		log.Printf("Error retrieving database ID for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	dbQuery = `
+		SELECT count(*)
+		FROM database_versions
+		WHERE db = $1
+			AND version = $2`
+	err = tx.QueryRow(dbQuery, dbID, dbVersion).Scan(&taken)
+	if err != nil {
+		log.Printf("Error checking for version %d of '%s%s%s': %v\n", dbVersion, dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if taken != 0 {
+		return fmt.Errorf("A newer upload is now version %d, so the deleted version can't be restored", dbVersion)
+	}
+	dbQuery = `
+		INSERT INTO database_versions (db, version, size, sha256, minioid, date_created, last_modified,
+			compressed_size, prev_hash, chain_hash, commit_id, parent_commit, author, message, branch)
+		SELECT db, version, size, sha256, minioid, date_created, last_modified, compressed_size, prev_hash,
+			chain_hash, commit_id, parent_commit, author, message, branch
+		FROM deleted_versions
+		WHERE db = $1
+			AND version = $2`
+	commandTag, err := tx.Exec(dbQuery, dbID, dbVersion)
+	if err != nil {
+		log.Printf("Restoring version %d of '%s%s%s' failed: %v\n", dbVersion, dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Version %d of database '%s%s%s' isn't a deleted version which can be restored",
+			dbVersion, dbOwner, dbFolder, dbName)
+	}
+	_, err = tx.Exec(`DELETE FROM deleted_versions WHERE db = $1 AND version = $2`, dbID, dbVersion)
+	if err != nil {
+		log.Printf("Removing restored version %d of '%s%s%s' from the deleted versions failed: %v\n", dbVersion,
+			dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Couldn't commit database version restore: %v\n", err)
+		return err
+	}
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Revokes one of a user's personal API tokens.
+func RevokeAPIToken(userName string, tokenID int64) error {
+	dbQuery := `
+		DELETE FROM api_tokens
+		WHERE username = $1
+			AND token_id = $2`
+	_, err := pdb.Exec(dbQuery, userName, tokenID)
+	if err != nil {
+		log.Printf("Revoking API token %d for user '%s' failed: %v\n", tokenID, userName, err)
+		return err
+	}
+	return nil
+}
+
+// Revokes one of a user's client certificates, so it can't be used any more.
+func RevokeClientCert(userName string, certID int64) error {
+	dbQuery := `
+		UPDATE client_certs
+		SET revoked = timezone('utc'::text, now())
+		WHERE username = $1
+			AND cert_id = $2
+			AND revoked IS NULL`
+	_, err := pdb.Exec(dbQuery, userName, certID)
+	if err != nil {
+		log.Printf("Revoking client certificate %d for user '%s' failed: %v\n", certID, userName, err)
+		return err
+	}
+	return nil
+}
+
+// Revokes all of a user's client certificates.
+func RevokeClientCerts(userName string) error {
+	dbQuery := `
+		UPDATE client_certs
+		SET revoked = timezone('utc'::text, now())
+		WHERE username = $1
+			AND revoked IS NULL`
+	_, err := pdb.Exec(dbQuery, userName)
+	if err != nil {
+		log.Printf("Revoking client certificates for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	return nil
+}
+
+// Revokes the access a user has granted to a third party application.
+func RevokeOAuthGrant(userName string, clientID string) error {
+	dbQuery := `
+		DELETE FROM oauth_tokens
+		WHERE username = $1
+			AND client_id = $2`
+	_, err := pdb.Exec(dbQuery, userName, clientID)
+	if err != nil {
+		log.Printf("Revoking access for OAuth client '%s' by user '%s' failed: %v\n", clientID, userName, err)
+		return err
+	}
+	return nil
+}
+
+// Revokes a share link for a database.
+func RevokeShareLink(dbOwner string, dbFolder string, dbName string, linkID int64) error {
+	dbQuery := `
+		DELETE FROM share_links
+		WHERE link_id = $4
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, linkID)
+	if err != nil {
+		log.Printf("Revoking share link %d for database '%s%s%s' failed: %v\n", linkID, dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return errors.New("That share link doesn't exist")
+	}
+	return nil
+}
+
+// Saves updated database settings to PostgreSQL.
+func SaveDBSettings(userName string, dbFolder string, dbName string, descrip string, readme string, defTable string, landingTab string, public bool, noIndex bool) error {
+	// Check for values which should be NULL
+	var nullableDescrip, nullableReadme pgx.NullString
+	if descrip == "" {
+		nullableDescrip.Valid = false
+	} else {
+		nullableDescrip.String = descrip
+		nullableDescrip.Valid = true
+	}
+	if readme == "" {
+		nullableReadme.Valid = false
+	} else {
+		nullableReadme.String = readme
+		nullableReadme.Valid = true
+	}
+
+	// Grab the existing README, so only newly mentioned users are notified
+	var oldReadme pgx.NullString
+	dbQuery := `
+		SELECT readme
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	err := pdb.QueryRow(dbQuery, userName, dbFolder, dbName).Scan(&oldReadme)
+	if err != nil {
+		log.Printf("Retrieving README for database '%s%s%s' failed: %v\n", userName, dbFolder, dbName, err)
+		return err
+	}
+
+	// Save the database settings
+	SQLQuery := `
+		UPDATE sqlite_databases
+		SET description = $4, readme = $5, default_table = $6, public = $7, noindex = $8, landing_tab = $9
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(SQLQuery, userName, dbFolder, dbName, nullableDescrip, nullableReadme, defTable, public,
+		noIndex, landingTab)
+	if err != nil {
+		log.Printf("Updating description for database '%s%s%s' failed: %v\n", userName, dbFolder,
+			dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when updating description for '%s%s%s'\n",
+			numRows, userName, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+
+	// Let anyone newly @mentioned in the README of a public database know about it.  Failing to send the
+	// notifications doesn't stop the settings from being saved
+	if public {
+		NotifyMentions(userName, userName, dbFolder, dbName, oldReadme.String, readme)
+	}
+
+	// Invalidate the old memcached entries for the database
+	return InvalidateDBCache(userName, dbFolder, dbName)
+}
+
+// Returns the list of saved queries for a user.
+func SavedQueries(userName string) (list []SavedQuery, err error) {
+	dbQuery := `
+		SELECT idnum, query_name, db_owner, db_folder, db_name, query, date_created
+		FROM saved_queries
+		WHERE username = $1
+		ORDER BY query_name`
+	rows, err := pdb.Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow SavedQuery
+		err = rows.Scan(&oneRow.ID, &oneRow.Name, &oneRow.DBOwner, &oneRow.DBFolder, &oneRow.DBName,
+			&oneRow.Query, &oneRow.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving saved queries for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+
+	return list, nil
+}
+
+// Saves a user's notification preferences, along with the URL webhook notifications are sent to.
+func SaveNotificationPrefs(userName string, prefs map[string]map[string]bool, webhook string) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	dbQuery := `
+		INSERT INTO notification_prefs (username, kind, channel, enabled)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username, kind, channel)
+			DO UPDATE SET enabled = $4`
+	for kind, channels := range prefs {
+		for channel, enabled := range channels {
+			_, err = tx.Exec(dbQuery, userName, kind, channel, enabled)
+			if err != nil {
+				log.Printf("Saving notification preferences for user '%s' failed: %v\n", userName, err)
+				return err
+			}
+		}
+	}
+	dbQuery = `
+		UPDATE users
+		SET notify_webhook = nullif($2, '')
+		WHERE username = $1`
+	commandTag, err := tx.Exec(dbQuery, userName, webhook)
+	if err != nil {
+		log.Printf("Saving notification webhook for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when saving notification webhook. User: '%s'\n", numRows,
+			userName)
+	}
+	return tx.Commit()
+}
+
+// Promotes an entry from a user's query history to a named saved query.
+func SaveQueryFromHistory(userName string, historyID int64, queryName string) error {
+	dbQuery := `
+		INSERT INTO saved_queries (username, query_name, db_owner, db_folder, db_name, query)
+		SELECT username, $3, db_owner, db_folder, db_name, query
+		FROM query_history
+		WHERE username = $1
+			AND idnum = $2`
+	commandTag, err := pdb.Exec(dbQuery, userName, historyID, queryName)
+	if err != nil {
+		log.Printf("Saving query history entry %d for user '%s' failed: %v\n", historyID, userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when saving query history entry %d for "+
+			"user '%s'\n", numRows, historyID, userName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
+
+// Stores a certificate for a given client.
+func SetClientCert(newCert []byte, userName string) error {
+	SQLQuery := `
+		UPDATE users
+		SET client_certificate = $1
+		WHERE username = $2`
+	commandTag, err := pdb.Exec(SQLQuery, newCert, userName)
+	if err != nil {
+		log.Printf("Updating client certificate for '%s' failed: %v\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when storing client cert for '%s'\n",
+			numRows, userName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+
+	return nil
+}
+
+// Archives or unarchives a database.
+func SetDBArchived(dbOwner string, dbFolder string, dbName string, archived bool) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET archived = $4
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, archived)
+	if err != nil {
+		log.Printf("Changing archived status of database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when changing archived status of '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+
+	// Invalidate the old memcached entries for the database
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Turns live mode on or off for a database.
+func SetDBLive(dbOwner string, dbFolder string, dbName string, live bool) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET live = $4, live_changed = false
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, live)
+	if err != nil {
+		log.Printf("Changing live status of database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when changing live status of '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+
+	// Invalidate the old memcached entries for the database
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Records where a database forked from another DBHub instance came from.
+func SetDBRemoteOrigin(dbOwner string, dbFolder string, dbName string, origin string) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET remote_origin = $4
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, origin)
+	if err != nil {
+		log.Printf("Recording remote origin of database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when recording remote origin of '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
 	}
 
-	// Safety checks
-	numResults := len(dbList)
-	if numResults == 0 {
-		return nil, errors.New("Empty list returned instead of fork tree.  This shouldn't happen")
+	// Invalidate the old memcached entries for the database
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Saves the review policy of a database.
+func SetDBReviewPolicy(dbOwner string, dbFolder string, dbName string, p ReviewPolicy) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET review_min_approvals = $4, review_owner_approval = $5
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, p.MinApprovals, p.OwnerApproval)
+	if err != nil {
+		log.Printf("Updating review policy of database '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
 	}
-	if dbList[0].ForkedFrom != 0 {
-		// The first entry has a non-zero forked_from field, indicating it's not the root entry.  That
-		// shouldn't happen, so return an error.
-		return nil, errors.New("Incorrect root entry data in retrieved database list")
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when updating review policy of '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
 	}
+	return nil
+}
 
-	// * Process the root entry *
+// Shares a database with another user, or changes the access level of an existing share.
+func SetDBShare(dbOwner string, dbFolder string, dbName string, userName string, access string) error {
+	dbQuery := `
+		INSERT INTO database_shares (db, username, access)
+		SELECT idnum, $4, $5
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		ON CONFLICT (db, username)
+			DO UPDATE SET access = $5`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, userName, access)
+	if err != nil {
+		log.Printf("Sharing database '%s%s%s' with '%s' failed: %v\n", dbOwner, dbFolder, dbName, userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when sharing '%s%s%s' with '%s'\n", numRows,
+			dbOwner, dbFolder, dbName, userName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
 
-	var iconDepth int
-	var forkTrail []int
+// Updates the recorded size of a database version.
+func SetDBVersionSize(versionID int64, size int64) error {
+	dbQuery := `
+		UPDATE database_versions
+		SET size = $2
+		WHERE idnum = $1`
+	commandTag, err := pdb.Exec(dbQuery, versionID, size)
+	if err != nil {
+		log.Printf("Updating size of database version '%v' failed: %v\n", versionID, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows (%v) affected when updating size of database version '%v'\n", numRows,
+			versionID)
+	}
+	return nil
+}
 
-	// Set the root database ID
-	rootID := dbList[0].ID
+// Records when a user was last sent an email digest.
+func SetDigestSent(userName string, sent time.Time) error {
+	dbQuery := `
+		UPDATE users
+		SET last_digest = $2
+		WHERE username = $1`
+	commandTag, err := pdb.Exec(dbQuery, userName, sent)
+	if err != nil {
+		log.Printf("Recording email digest for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when recording email digest. User: '%s'\n", numRows, userName)
+	}
+	return nil
+}
 
-	// Set the icon list for display in the browser
-	dbList[0].IconList = append(dbList[0].IconList, ROOT)
+// Saves an admin override of a feature flag.
+func SetFeatureFlag(f FeatureFlag) error {
+	err := validateFeatureFlag(f)
+	if err != nil {
+		return err
+	}
+	if f.Users == nil {
+		f.Users = []string{}
+	}
+	dbQuery := `
+		INSERT INTO feature_flags (name, enabled, rollout_percent, users, beta)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name)
+			DO UPDATE SET enabled = $2, rollout_percent = $3, users = $4, beta = $5,
+				date_updated = timezone('utc'::text, now())`
+	_, err = pdb.Exec(dbQuery, f.Name, f.Enabled, f.RolloutPercent, f.Users, f.Beta)
+	if err != nil {
+		log.Printf("Saving override of feature flag '%s' failed: %v\n", f.Name, err)
+		return err
+	}
+	return invalidateFeatureFlags()
+}
 
-	// If the root database is no longer public, then use placeholder details instead
-	if !dbList[0].Public {
-		dbList[0].DBName = "private database"
+// Records when an import webhook was last used, and how the import went.
+func SetImportHookResult(hookID int64, status string) error {
+	dbQuery := `
+		UPDATE import_hooks
+		SET last_used = timezone('utc'::text, now()), last_status = $2
+		WHERE hook_id = $1`
+	_, err := pdb.Exec(dbQuery, hookID, status)
+	if err != nil {
+		log.Printf("Recording result of import webhook %d failed: %v\n", hookID, err)
+		return err
 	}
+	return nil
+}
 
-	// Append this completed database line to the output list
-	outputList = append(outputList, dbList[0])
+// Sets whether a live database has changes which haven't been snapshotted yet.
+func SetLiveChanged(dbID int64, changed bool) error {
+	_, err := pdb.Exec(`UPDATE sqlite_databases SET live_changed = $2 WHERE idnum = $1`, dbID, changed)
+	if err != nil {
+		log.Printf("Updating changed flag of live database %d failed: %v\n", dbID, err)
+		return err
+	}
+	return nil
+}
 
-	// Append the root database ID to the fork trail
-	forkTrail = append(forkTrail, rootID)
+// Updates the description, README, and default table of a mirrored database to match the source.
+func SetMirroredDBDetails(dbOwner string, dbFolder string, dbName string, descrip string, readme string, defTable string) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET description = nullif($4, ''), readme = nullif($5, ''), default_table = nullif($6, '')
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+			AND (coalesce(description, ''), coalesce(readme, ''), coalesce(default_table, '')) <> ($4, $5, $6)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, descrip, readme, defTable)
+	if err != nil {
+		log.Printf("Updating mirrored database details for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return nil
+	}
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
 
-	// Mark the root database entry as processed
-	dbList[0].Processed = true
+// Adds a user to an organisation, or changes the role they have in it.  The last owner can't be demoted, as then
+// nobody could manage the organisation.
+func SetOrgMember(orgName string, userName string, role string) error {
+	if role != OrgRoleOwner && role != OrgRoleAdmin && role != OrgRoleMember {
+		return fmt.Errorf("Unknown organisation role '%s'", role)
+	}
+	isOrg, err := IsOrganisation(userName)
+	if err != nil {
+		return err
+	}
+	if isOrg {
+		return errors.New("Organisations can't be members of other organisations")
+	}
+	dbQuery := `
+		INSERT INTO organisation_members (org, username, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (org, username)
+			DO UPDATE SET role = $3
+			WHERE $3 = '` + OrgRoleOwner + `'
+				OR organisation_members.role <> '` + OrgRoleOwner + `'
+				OR (
+					SELECT count(*)
+					FROM organisation_members
+					WHERE org = $1
+						AND role = '` + OrgRoleOwner + `') > 1`
+	commandTag, err := pdb.Exec(dbQuery, orgName, userName, role)
+	if err != nil {
+		log.Printf("Setting role of '%s' in organisation '%s' failed: %v\n", userName, orgName, err)
+		return err
+	}
+	if commandTag.RowsAffected() != 1 {
+		return errors.New("The organisation's only owner can't be given another role")
+	}
+	return InvalidateUserCache(orgName)
+}
 
-	// Increment the icon depth
-	iconDepth = 1
+// Sets whether the user wants experimental features.
+func SetPrefUserBeta(userName string, beta bool) error {
+	dbQuery := `
+		UPDATE users
+		SET pref_beta = $1
+		WHERE username = $2`
+	commandTag, err := pdb.Exec(dbQuery, beta, userName)
+	if err != nil {
+		log.Printf("Updating user preferences failed for user '%s'. Error: '%v'\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when updating user preferences. User: '%s'\n", numRows,
+			userName)
+	}
+	return nil
+}
 
-	// * Sort the remaining entries for correct display *
-	numUnprocessedEntries := numResults - 1
-	for numUnprocessedEntries > 0 {
-		var forkFound bool
-		outputList, forkTrail, forkFound = nextChild(loggedInUser, &dbList, &outputList, &forkTrail, iconDepth)
-		if forkFound {
-			numUnprocessedEntries--
-			iconDepth++
+// Sets how often the user wants an email digest of their starred databases.
+func SetPrefUserDigest(userName string, digest string) error {
+	dbQuery := `
+		UPDATE users
+		SET pref_digest = $1
+		WHERE username = $2`
+	commandTag, err := pdb.Exec(dbQuery, digest, userName)
+	if err != nil {
+		log.Printf("Updating user preferences failed for user '%s'. Error: '%v'\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when updating user preferences. User: '%s'\n", numRows,
+			userName)
+	}
+	return nil
+}
 
-			// Add stems and branches to the output icon list
-			numOutput := len(outputList)
+// Sets the user's preference for maximum number of SQLite rows to display.
+func SetPrefUserMaxRows(userName string, maxRows int) error {
+	dbQuery := `
+		UPDATE users
+		SET pref_max_rows = $1
+		WHERE username = $2`
+	commandTag, err := pdb.Exec(dbQuery, maxRows, userName)
+	if err != nil {
+		log.Printf("Updating user preferences failed for user '%s'. Error: '%v'\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows (%v) affected when updating user preferences. User: '%s'\n", numRows,
+			userName)
+	}
+	return nil
+}
 
-			myID := outputList[numOutput-1].ID
-			myForkedFrom := outputList[numOutput-1].ForkedFrom
+// Updates the details of a replicated database to match the source.
+func SetReplicatedDBDetails(dbOwner string, dbFolder string, dbName string, public bool, descrip string, readme string, defTable string) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET public = $4, description = nullif($5, ''), readme = nullif($6, ''), default_table = nullif($7, '')
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+			AND (public, coalesce(description, ''), coalesce(readme, ''), coalesce(default_table, '')) <>
+				($4, $5, $6, $7)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, public, descrip, readme, defTable)
+	if err != nil {
+		log.Printf("Updating replicated database details for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName,
+			err)
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return nil
+	}
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
 
-			// Scan through the earlier output list for any sibling entries
-			var siblingFound bool
-			for i := numOutput; i > 0 && siblingFound == false; i-- {
-				thisID := outputList[i-1].ID
-				thisForkedFrom := outputList[i-1].ForkedFrom
+// Records the last replication cursor applied from the given source.
+func SetReplicationCursor(source string, cursor int64) error {
+	dbQuery := `
+		INSERT INTO replication_cursors (source, cursor)
+		VALUES ($1, $2)
+		ON CONFLICT (source)
+			DO UPDATE SET cursor = $2, last_updated = timezone('utc'::text, now())`
+	commandTag, err := pdb.Exec(dbQuery, source, cursor)
+	if err != nil {
+		log.Printf("Saving replication cursor for '%s' failed: %v\n", source, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows (%v) affected when saving replication cursor for '%s'\n", numRows,
+			source)
+	}
+	return nil
+}
 
-				if thisForkedFrom == myForkedFrom && thisID != myID {
-					// Sibling entry found
-					siblingFound = true
-					sibling := outputList[i-1]
+// Records the number of rows a database version changed compared to its parent.
+func setRowsChanged(versionID int64, rowsChanged int64) error {
+	dbQuery := `
+		UPDATE database_versions
+		SET rows_changed = $2
+		WHERE idnum = $1`
+	_, err := pdb.Exec(dbQuery, versionID, rowsChanged)
+	if err != nil {
+		log.Printf("Recording rows changed by database version %d failed: %v\n", versionID, err)
+		return err
+	}
+	return nil
+}
 
-					// Change the last sibling icon to a branch icon
-					sibling.IconList[iconDepth-1] = BRANCH
+// Saves the result of a status check against a database version, replacing any earlier result with the same context.
+func SetStatusCheck(dbOwner string, dbFolder string, dbName string, s StatusCheck) error {
+	dbQuery := `
+		INSERT INTO status_checks (db, commit_id, context, state, target_url, description, created_by)
+		SELECT idnum, $4, $5, $6, nullif($7, ''), nullif($8, ''), $9
+		FROM sqlite_databases
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		ON CONFLICT (db, commit_id, context)
+			DO UPDATE SET state = excluded.state, target_url = excluded.target_url,
+				description = excluded.description, created_by = excluded.created_by,
+				date_updated = timezone('utc'::text, now())`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, s.CommitID, s.Context, s.State, s.TargetURL,
+		s.Description, s.CreatedBy)
+	if err != nil {
+		log.Printf("Saving status check '%s' for commit '%s' of database '%s%s%s' failed: %v\n", s.Context,
+			s.CommitID, dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when saving status check for '%s%s%s'\n",
+			numRows, dbOwner, dbFolder, dbName)
+		log.Printf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
 
-					// Change appropriate spaces to stems in the output icon list
-					for l := numOutput - 1; l > i; l-- {
-						thisEntry := outputList[l-1]
-						if thisEntry.IconList[iconDepth-1] == SPACE {
-							thisEntry.IconList[iconDepth-1] = STEM
-						}
-					}
-				}
-			}
-		} else {
-			// No child was found, so remove an entry from the fork trail then continue looping
-			forkTrail = forkTrail[:len(forkTrail)-1]
+// Moves a takedown request to a new state, after checking the change is allowed.
+func SetTakedownStatus(takedownID int64, status string, adminNotes string) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for takedown status change: %v\n", err)
+		return err
+	}
+	defer tx.Rollback()
 
-			iconDepth--
+	// Check the change of state is allowed
+	var current string
+	dbQuery := `
+		SELECT status
+		FROM takedown_requests
+		WHERE idnum = $1
+		FOR UPDATE`
+	err = tx.QueryRow(dbQuery, takedownID).Scan(&current)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("Unknown takedown request %d", takedownID)
+		}
+		log.Printf("Error retrieving status of takedown request %d: %v\n", takedownID, err)
+		return err
+	}
+	allowed := false
+	for _, s := range TakedownNextStates(current) {
+		if s == status {
+			allowed = true
 		}
 	}
+	if !allowed {
+		return fmt.Errorf("Takedown requests can't go from '%s' to '%s'", current, status)
+	}
+
+	dbQuery = `
+		UPDATE takedown_requests
+		SET status = $2, admin_notes = $3, date_updated = now()
+		WHERE idnum = $1`
+	_, err = tx.Exec(dbQuery, takedownID, status, adminNotes)
+	if err != nil {
+		log.Printf("Updating status of takedown request %d failed: %v\n", takedownID, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Couldn't commit takedown status change: %v\n", err)
+		return err
+	}
 
-	return outputList, nil
+	// Taken down databases aren't shown in the front page lists
+	return invalidateFrontPageCache()
 }
 
-// Retrieve the highest version number of a database (if any), available to a given user.
-// Use the empty string "" to retrieve the highest available public version.
-func HighestDBVersion(dbOwner string, dbName string, dbFolder string, loggedInUser string) (ver int, err error) {
+// Sets the uploaded avatar of a user.  An empty Minio ID removes it, so their Gravatar is used again.  The previous
+// avatar (if any) is left for the orphaned object collection to clean up.
+func SetUserAvatar(userName string, minioID string) error {
 	dbQuery := `
-		SELECT version
-		FROM database_versions
-		WHERE db = (
-			SELECT idnum
-			FROM sqlite_databases
-			WHERE username = $1
-				AND dbname = $2
-				AND folder = $3`
-	if dbOwner != loggedInUser {
-		dbQuery += `
-				AND public = true`
+		UPDATE users
+		SET avatar_minio_id = NULLIF($2, '')
+		WHERE username = $1`
+	commandTag, err := pdb.Exec(dbQuery, userName, minioID)
+	if err != nil {
+		log.Printf("Updating avatar for user '%s' failed: %v\n", userName, err)
+		return err
 	}
-	dbQuery += `
-			)
-		ORDER BY version DESC
-		LIMIT 1`
-	err = pdb.QueryRow(dbQuery, dbOwner, dbName, dbFolder).Scan(&ver)
-	if err != nil && err != pgx.ErrNoRows {
-		log.Printf("Error when retrieving highest database version # for '%s/%s'. Error: %v\n", dbOwner,
-			dbName, err)
-		return -1, err
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows (%v) affected when updating avatar for user '%s'\n", numRows, userName)
 	}
-	if err == pgx.ErrNoRows {
-		// No database versions seem to be present
-		return 0, nil
+	return InvalidateUserCache(userName)
+}
+
+// Enables or disables a user account.  Disabled users can't log in, or use their client certificate or any OAuth
+// access tokens issued for them.
+func SetUserDisabled(userName string, disabled bool) error {
+	dbQuery := `
+		UPDATE users
+		SET disabled = $2
+		WHERE username = $1`
+	commandTag, err := pdb.Exec(dbQuery, userName, disabled)
+	if err != nil {
+		log.Printf("Updating disabled status for user '%s' failed: %v\n", userName, err)
+		return err
 	}
-	return ver, nil
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Unknown user '%s'", userName)
+	}
+	return nil
 }
 
-// Return the Minio bucket name for a given user.
-func MinioUserBucket(userName string) (string, error) {
-	var minioBucket string
-	err := pdb.QueryRow(`
-		SELECT minio_bucket
-		FROM users
-		WHERE username = $1`, userName).Scan(&minioBucket)
+// Set the email address for a user.
+func SetUserEmail(userName string, email string) error {
+	dbQuery := `
+		UPDATE users
+		SET email = $1
+		WHERE username = $2`
+	commandTag, err := pdb.Exec(dbQuery, email, userName)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			log.Printf("No known Minio bucket for user '%s'\n", userName)
-			return "", errors.New("No known Minio bucket for that user")
-		} else {
-			log.Printf("Error when looking up Minio bucket name for user '%v': %v\n", userName, err)
-			return "", err
-		}
+		log.Printf("Updating user email failed: %v\n", err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows affected (%v) when updating details for user '%v'\n", numRows, userName)
 	}
 
-	return minioBucket, nil
+	return nil
 }
 
-// Return the Minio bucket and ID for a given database. dbOwner & dbName are from owner/database URL fragment,
-// loggedInUser is the name for the currently logged in user, for access permission check.  Use an empty string ("")
-// as the loggedInUser parameter if the true value isn't set or known.  If the requested database doesn't exist, or
-// the loggedInUser doesn't have access to it, then an error will be returned.
-func MinioBucketID(dbOwner string, dbName string, dbVersion int, loggedInUser string) (bkt string, id string, err error) {
-	var dbQuery string
-	if loggedInUser != dbOwner {
-		// The request is for another users database, so it needs to be a public one
-		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
-			WHERE ver.db = db.idnum
-				AND db.username = $1
-				AND db.dbname = $2
-				AND ver.version = $3
-				AND db.public = true`
-	} else {
-		dbQuery = `
-			SELECT db.minio_bucket, ver.minioid
-			FROM database_versions AS ver, sqlite_databases AS db
-			WHERE ver.db = db.idnum
-				AND db.username = $1
-				AND db.dbname = $2
-				AND ver.version = $3`
-	}
-	err = pdb.QueryRow(dbQuery, dbOwner, dbName, dbVersion).Scan(&bkt, &id)
+// Set the email address and password hash for a user.
+func SetUserEmailPHash(userName string, email string, pHash []byte) error {
+	dbQuery := `
+		UPDATE users
+		SET email = $1, password_hash = $2
+		WHERE username = $3`
+	commandTag, err := pdb.Exec(dbQuery, email, pHash, userName)
 	if err != nil {
-		log.Printf("Error retrieving MinioID for %s/%s version %v: %v\n", dbOwner, dbName, dbVersion, err)
-		return "", "", err
+		log.Printf("Updating user email & password hash failed: %v\n", err)
+		return err
 	}
-
-	if bkt == "" || id == "" {
-		// The requested database doesn't exist, or the logged in user doesn't have access to it
-		return "", "", errors.New("The requested database wasn't found")
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows affected (%v) when updating details for user '%v'\n", numRows, userName)
 	}
 
-	return bkt, id, nil
+	return nil
 }
 
-// Return the user's preference for maximum number of SQLite rows to display.
-func PrefUserMaxRows(loggedInUser string) int {
-	// Retrieve the user preference data
+// Saves the profile fields of a user.  The avatar is changed separately, with SetUserAvatar().
+func SetUserProfile(userName string, p UserProfile) error {
 	dbQuery := `
-		SELECT pref_max_rows
-		FROM users
+		UPDATE users
+		SET display_name = NULLIF($2, ''), bio = NULLIF($3, ''), website = NULLIF($4, ''), location = NULLIF($5, '')
 		WHERE username = $1`
-	var maxRows int
-	err := pdb.QueryRow(dbQuery, loggedInUser).Scan(&maxRows)
+	commandTag, err := pdb.Exec(dbQuery, userName, p.DisplayName, p.Bio, p.Website, p.Location)
 	if err != nil {
-		log.Printf("Error retrieving user '%s' preference data: %v\n", loggedInUser, err)
-		return DefaultNumDisplayRows // Use the default value
+		log.Printf("Updating profile for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong number of rows (%v) affected when updating profile for user '%s'\n", numRows, userName)
 	}
+	return InvalidateUserCache(userName)
+}
 
-	return maxRows
+// Sets the maximum number of bytes of database storage a user can use.  Zero means unlimited.
+func SetUserStorageQuota(userName string, quota int64) error {
+	dbQuery := `
+		UPDATE users
+		SET storage_quota = $2
+		WHERE username = $1`
+	commandTag, err := pdb.Exec(dbQuery, userName, quota)
+	if err != nil {
+		log.Printf("Updating storage quota for user '%s' failed: %v\n", userName, err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return fmt.Errorf("Unknown user '%s'", userName)
+	}
+	return nil
 }
 
-// Return a list of users with public databases.
-func PublicUserDBs() ([]UserInfo, error) {
+// Records the outcome of an attempt to send a webhook delivery.
+func SetWebhookDeliveryResult(d WebhookDelivery) error {
 	dbQuery := `
-		WITH public_dbs AS (
-			SELECT DISTINCT ON (username) username, last_modified
-			FROM sqlite_databases
-			WHERE public = true
-			ORDER BY username, last_modified DESC
-		)
-		SELECT username, last_modified
-		FROM public_dbs
-		ORDER BY last_modified DESC`
-	rows, err := pdb.Query(dbQuery)
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, response_status = nullif($4, 0), last_error = nullif($5, ''),
+			next_attempt = $6
+		WHERE delivery_id = $1`
+	_, err := pdb.Exec(dbQuery, d.ID, d.Status, d.Attempts, d.ResponseStatus, d.Error, d.NextAttempt)
+	if err != nil {
+		log.Printf("Recording the result of webhook delivery %d failed: %v\n", d.ID, err)
+		return err
+	}
+	return nil
+}
+
+// Returns the share links for a database which haven't expired yet, newest first.
+func ShareLinks(dbOwner string, dbFolder string, dbName string) (list []ShareLink, err error) {
+	dbQuery := `
+		SELECT link.link_id, link.name, link.created_by, link.date_created, link.expiry, link.last_used
+		FROM share_links AS link, sqlite_databases AS db
+		WHERE link.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND link.expiry > now()
+		ORDER BY link.date_created DESC`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
 	if err != nil {
 		log.Printf("Database query failed: %v\n", err)
 		return nil, err
 	}
 	defer rows.Close()
-	var list []UserInfo
 	for rows.Next() {
-		var oneRow UserInfo
-		err = rows.Scan(&oneRow.Username, &oneRow.LastModified)
+		var l ShareLink
+		var lastUsed pgx.NullTime
+		err = rows.Scan(&l.ID, &l.Name, &l.CreatedBy, &l.DateCreated, &l.Expiry, &lastUsed)
 		if err != nil {
-			log.Printf("Error retrieving database list for user: %v\n", err)
+			log.Printf("Error retrieving share links for database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
 			return nil, err
 		}
-		list = append(list, oneRow)
+		if lastUsed.Valid {
+			l.LastUsed = &lastUsed.Time
+		}
+		list = append(list, l)
 	}
-
 	return list, nil
 }
 
-// Remove a database version from PostgreSQL.
-func RemoveDBVersion(dbOwner string, folder string, dbName string, dbVersion int) error {
+// Returns the public databases which should be listed in the sitemap.  Databases whose owners have asked search
+// engines not to index them, and ones which have been taken down, are left out.
+func SitemapDBs() ([]DBEntry, error) {
 	dbQuery := `
-		DELETE from database_versions
-		WHERE db  = (	SELECT idnum
-				FROM sqlite_databases
-				WHERE username = $1
-					AND folder = $2
-					AND dbname = $3)
-			AND version = $4`
-	commandTag, err := pdb.Exec(dbQuery, dbOwner, folder, dbName, dbVersion)
+		SELECT db.username, db.folder, db.dbname, db.last_modified
+		FROM sqlite_databases AS db
+		WHERE db.public = true
+			AND db.noindex = false
+			AND NOT EXISTS (
+				SELECT 1
+				FROM takedown_requests AS td
+				WHERE td.db_owner = db.username
+					AND td.db_folder = db.folder
+					AND td.db_name = db.dbname
+					AND td.status IN ($1, $2)
+			)
+		ORDER BY db.last_modified DESC
+		LIMIT 50000`
+	rows, err := readDB().Query(dbQuery, TakedownAccepted, TakedownCountered)
 	if err != nil {
-		log.Printf("%s: Removing database entry '%s' / '%s' / '%s' version %v failed: %v\n",
-			dbOwner, folder, dbName, dbVersion, err)
-		return err
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong # of rows (%v) affected when removing database entry for '%s' / '%s' / '%s' version %v\n",
-			numRows, dbOwner, folder, dbName, dbVersion)
-		return nil
+	defer rows.Close()
+	var list []DBEntry
+	for rows.Next() {
+		var oneRow DBEntry
+		err = rows.Scan(&oneRow.Owner, &oneRow.Folder, &oneRow.DBName, &oneRow.DateEntry)
+		if err != nil {
+			log.Printf("Error retrieving sitemap database list: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
 	}
+	return list, nil
+}
 
-	// Check if other versions of the database still exist
-	dbQuery = `
-		SELECT count(*) FROM database_versions
-		WHERE db  = (	SELECT idnum
-				FROM sqlite_databases
-				WHERE username = $1
-					AND folder = $2
-					AND dbname = $3)`
-	var numDBs int
-	err = pdb.QueryRow(dbQuery, dbOwner, folder, dbName).Scan(&numDBs)
-	if err != nil {
-		// A real database error occurred
-		log.Printf("Error checking if any further versions of database exist: %v\n", err)
-		return err
-	}
+// Retrieve the latest social stats for a given database.
+func SocialStats(dbOwner string, dbFolder string, dbName string) (wa int, st int, fo int, err error) {
 
-	// The database still has other versions, so there's nothing further to do
-	if numDBs != 0 {
-		return nil
-	}
+	// TODO: Implement caching of these stats
 
-	// We removed the last version of the database, so now clean up the entry in the sqlite_databases table
-	dbQuery = `
-		DELETE FROM sqlite_databases
+	// Retrieve latest star count
+	dbQuery := `
+		SELECT stars
+		FROM sqlite_databases
 		WHERE username = $1
 			AND folder = $2
 			AND dbname = $3`
-	commandTag, err = pdb.Exec(dbQuery, dbOwner, folder, dbName)
+	err = readDB().QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&st)
 	if err != nil {
-		log.Printf("%s: Removing main entry for '%s' / '%s' / '%s' failed: %v\n", dbOwner, folder,
+		log.Printf("Error retrieving star count for '%s%s%s': %v\n", dbOwner, dbFolder,
 			dbName, err)
-		return err
-	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong # of rows (%v) affected when removing main database entry for '%s' / '%s' / '%s'\n",
-			numRows, dbOwner, folder, dbName)
+		return -1, -1, -1, err
 	}
 
-	return nil
-}
+	// Retrieve latest fork count
+	dbQuery = `
+		SELECT forks
+		FROM sqlite_databases
+		WHERE idnum = (
+			SELECT root_database
+			FROM sqlite_databases
+			WHERE username = $1
+			AND folder = $2
+			AND dbname = $3)`
+	err = readDB().QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&fo)
+	if err != nil {
+		log.Printf("Error retrieving fork count for '%s%s%s': %v\n", dbOwner, dbFolder,
+			dbName, err)
+		return -1, -1, -1, err
+	}
 
-// Rename a SQLite daatabase.
-func RenameDatabase(userName string, dbFolder string, dbName string, newName string) error {
-	// Save the database settings
-	SQLQuery := `
-		UPDATE sqlite_databases
-		SET dbname = $4
+	// Retrieve latest watcher count
+	dbQuery = `
+		SELECT watchers
+		FROM sqlite_databases
 		WHERE username = $1
 			AND folder = $2
 			AND dbname = $3`
-	commandTag, err := pdb.Exec(SQLQuery, userName, dbFolder, dbName, newName)
+	err = readDB().QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&wa)
 	if err != nil {
-		log.Printf("Renaming database '%s%s%s' failed: %v\n", userName, dbFolder,
-			dbName, err)
-		return err
+		log.Printf("Error retrieving watcher count for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return -1, -1, -1, err
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when renaming '%s%s%s' to '%s%s%s'\n",
-			numRows, userName, dbFolder, dbName, userName, dbFolder, newName)
-		log.Printf(errMsg)
-		return errors.New(errMsg)
+	return wa, st, fo, nil
+}
+
+// Returns the status checks posted against a database version.  When no commit ID is given, the checks for every
+// version of the database are returned instead.
+func StatusChecks(dbOwner string, dbFolder string, dbName string, commitID string) (list []StatusCheck, err error) {
+	dbQuery := `
+		SELECT chk.commit_id, chk.context, chk.created_by, chk.date_updated, coalesce(chk.description, ''),
+			chk.state, coalesce(chk.target_url, '')
+		FROM status_checks AS chk, sqlite_databases AS db
+		WHERE chk.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+			AND ($4 = '' OR chk.commit_id = $4)
+		ORDER BY chk.commit_id, chk.context`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName, commitID)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s StatusCheck
+		err = rows.Scan(&s.CommitID, &s.Context, &s.CreatedBy, &s.DateUpdated, &s.Description, &s.State,
+			&s.TargetURL)
+		if err != nil {
+			log.Printf("Error retrieving status checks of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return nil, err
+		}
+		list = append(list, s)
 	}
+	return list, nil
+}
 
-	// Log the rename
-	log.Printf("Database renamed from '%s%s%s' to '%s%s%s'\n", userName, dbFolder, dbName, userName,
-		dbFolder, newName)
-
-	return nil
+// Checks whether storing a new database version of the given size would take a user over their storage quota.
+func StorageQuotaExceeded(userName string, newBytes int64) (bool, error) {
+	quota, used, err := StorageUsage(userName)
+	if err != nil {
+		return false, err
+	}
+	return quota > 0 && used+newBytes > quota, nil
 }
 
-// Saves updated database settings to PostgreSQL.
-func SaveDBSettings(userName string, dbFolder string, dbName string, descrip string, readme string, defTable string, public bool) error {
-	// Check for values which should be NULL
-	var nullableDescrip, nullableReadme pgx.NullString
-	if descrip == "" {
-		nullableDescrip.Valid = false
-	} else {
-		nullableDescrip.String = descrip
-		nullableDescrip.Valid = true
+// Returns the storage quota for a user, and how much of it they're using, in bytes.  A quota of zero means unlimited.
+func StorageUsage(userName string) (quota int64, used int64, err error) {
+	dbQuery := `
+		SELECT u.storage_quota, coalesce(sum(ver.size), 0)
+		FROM users AS u
+			LEFT JOIN sqlite_databases AS db ON db.username = u.username
+			LEFT JOIN database_versions AS ver ON ver.db = db.idnum
+		WHERE u.username = $1
+		GROUP BY u.storage_quota`
+	err = pdb.QueryRow(dbQuery, userName).Scan(&quota, &used)
+	if err != nil {
+		log.Printf("Error retrieving storage quota for user '%s': %v\n", userName, err)
+		return 0, 0, err
 	}
-	if readme == "" {
-		nullableReadme.Valid = false
-	} else {
-		nullableReadme.String = readme
-		nullableReadme.Valid = true
+	return quota, used, nil
+}
+
+// Stores the title, license, and column docs from the metadata table of an uploaded database.  Column docs replace
+// any existing ones for the database.
+func StoreDBMetadataTable(dbOwner string, dbFolder string, dbName string, meta DBMetadataTable) error {
+	tx, err := pdb.Begin()
+	if err != nil {
+		log.Printf("Couldn't start transaction for storing metadata table: %v\n", err)
+		return err
 	}
+	defer tx.Rollback()
 
-	// Save the database settings
-	SQLQuery := `
+	var dbID int
+	dbQuery := `
 		UPDATE sqlite_databases
-		SET description = $4, readme = $5, default_table = $6, public = $7
+		SET title = coalesce(nullif($4, ''), title), license = coalesce(nullif($5, ''), license)
 		WHERE username = $1
 			AND folder = $2
-			AND dbname = $3`
-	commandTag, err := pdb.Exec(SQLQuery, userName, dbFolder, dbName, nullableDescrip, nullableReadme, defTable, public)
+			AND dbname = $3
+		RETURNING idnum`
+	err = tx.QueryRow(dbQuery, dbOwner, dbFolder, dbName, meta.Title, meta.License).Scan(&dbID)
 	if err != nil {
-		log.Printf("Updating description for database '%s%s%s' failed: %v\n", userName, dbFolder,
-			dbName, err)
+		log.Printf("Storing metadata table details for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
 		return err
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when updating description for '%s%s%s'\n",
-			numRows, userName, dbFolder, dbName)
-		log.Printf(errMsg)
-		return errors.New(errMsg)
+
+	if len(meta.ColumnDocs) > 0 {
+		_, err = tx.Exec(`DELETE FROM column_docs WHERE db = $1`, dbID)
+		if err != nil {
+			log.Printf("Removing old column docs for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+			return err
+		}
+		dbQuery = `
+			INSERT INTO column_docs (db, table_name, column_name, description)
+			VALUES ($1, $2, $3, $4)`
+		for table, cols := range meta.ColumnDocs {
+			for col, descrip := range cols {
+				_, err = tx.Exec(dbQuery, dbID, table, col, descrip)
+				if err != nil {
+					log.Printf("Storing column docs for '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+					return err
+				}
+			}
+		}
 	}
 
-	// Invalidate the old memcached entry for the database
-	err = InvalidateCacheEntry(userName, userName, dbFolder, dbName, 0) // 0 indicates "for all versions"
+	err = tx.Commit()
 	if err != nil {
-		// Something went wrong when invalidating memcached entries for the database
-		log.Printf("Error when invalidating memcache entries: %s\n", err.Error())
+		log.Printf("Couldn't commit metadata table details: %v\n", err)
 		return err
 	}
 
-	return nil
+	// Invalidate the old memcached entries for the database
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
 }
 
-// Stores a certificate for a given client.
-func SetClientCert(newCert []byte, userName string) error {
-	SQLQuery := `
-		UPDATE users
-		SET client_certificate = $1
-		WHERE username = $2`
-	commandTag, err := pdb.Exec(SQLQuery, newCert, userName)
-	if err != nil {
-		log.Printf("Updating client certificate for '%s' failed: %v\n", userName, err)
-		return err
+// Returns the storage details of a database version with the given SHA256.  As stored objects are never changed, any
+// version with a matching SHA256 will do.
+func StoredDBVersionBySHA256(sha string) (ver StoredDBVersion, found bool, err error) {
+	dbQuery := `
+		SELECT ver.idnum, db.username, db.folder, db.dbname, ver.version, db.minio_bucket, ver.minioid, ver.size,
+			ver.sha256
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND ver.sha256 = $1
+		LIMIT 1`
+	err = pdb.QueryRow(dbQuery, sha).Scan(&ver.ID, &ver.Owner, &ver.Folder, &ver.DBName, &ver.Version,
+		&ver.MinioBkt, &ver.MinioID, &ver.Size, &ver.SHA256)
+	if err == pgx.ErrNoRows {
+		return ver, false, nil
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		errMsg := fmt.Sprintf("Wrong number of rows affected (%v) when storing client cert for '%s'\n",
-			numRows, userName)
-		log.Printf(errMsg)
-		return errors.New(errMsg)
+	if err != nil {
+		log.Printf("Error looking up stored database version for SHA256 '%s': %v\n", sha, err)
+		return ver, false, err
 	}
-
-	return nil
+	return ver, true, nil
 }
 
-// Sets the user's preference for maximum number of SQLite rows to display.
-func SetPrefUserMaxRows(userName string, maxRows int) error {
+// Records the virus scanner verdict for some database content.
+func StoreScanVerdict(sha string, clean bool, detail string) error {
 	dbQuery := `
-		UPDATE users
-		SET pref_max_rows = $1
-		WHERE username = $2`
-	commandTag, err := pdb.Exec(dbQuery, maxRows, userName)
+		INSERT INTO scan_verdicts (sha256, clean, detail)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (sha256)
+			DO UPDATE SET clean = $2, detail = $3, date_scanned = timezone('utc'::text, now())`
+	_, err := pdb.Exec(dbQuery, sha, clean, detail)
 	if err != nil {
-		log.Printf("Updating user preferences failed for user '%s'. Error: '%v'\n", userName, err)
+		log.Printf("Storing scan verdict for '%s' failed: %v\n", sha, err)
 		return err
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong # of rows (%v) affected when updating user preferences. User: '%s'\n", numRows,
-			userName)
-	}
 	return nil
 }
 
-// Set the email address for a user.
-func SetUserEmail(userName string, email string) error {
+// Returns all takedown requests, with the ones needing admin attention first.
+func TakedownRequests() (list []Takedown, err error) {
 	dbQuery := `
-		UPDATE users
-		SET email = $1
-		WHERE username = $2`
-	commandTag, err := pdb.Exec(dbQuery, email, userName)
+		SELECT idnum, db_owner, db_folder, db_name, complainant_name, complainant_email, description, status,
+			admin_notes, counter_notice, date_created, date_updated
+		FROM takedown_requests
+		ORDER BY status IN ($1, $2) DESC, date_updated DESC`
+	rows, err := pdb.Query(dbQuery, TakedownPending, TakedownCountered)
 	if err != nil {
-		log.Printf("Updating user email failed: %v\n", err)
-		return err
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong # of rows affected (%v) when updating details for user '%v'\n", numRows, userName)
+	defer rows.Close()
+	for rows.Next() {
+		var t Takedown
+		err = rows.Scan(&t.ID, &t.DBOwner, &t.DBFolder, &t.DBName, &t.ComplainantName, &t.ComplainantEmail,
+			&t.Description, &t.Status, &t.AdminNotes, &t.CounterNotice, &t.DateCreated, &t.DateUpdated)
+		if err != nil {
+			log.Printf("Error retrieving takedown requests: %v\n", err)
+			return nil, err
+		}
+		list = append(list, t)
 	}
-
-	return nil
+	return list, nil
 }
 
-// Set the email address and password hash for a user.
-func SetUserEmailPHash(userName string, email string, pHash []byte) error {
+// Returns the history of terms acceptances, newest first.  If a user name is given only their acceptances are
+// returned, otherwise the most recent ones for all users are.
+func TermsAcceptances(userName string, maxEntries int) (list []TermsAcceptance, err error) {
 	dbQuery := `
-		UPDATE users
-		SET email = $1, password_hash = $2
-		WHERE username = $3`
-	commandTag, err := pdb.Exec(dbQuery, email, pHash, userName)
+		SELECT username, version, date_accepted
+		FROM terms_acceptances
+		WHERE $1 = ''
+			OR username = $1
+		ORDER BY date_accepted DESC
+		LIMIT $2`
+	rows, err := pdb.Query(dbQuery, userName, maxEntries)
 	if err != nil {
-		log.Printf("Updating user email & password hash failed: %v\n", err)
-		return err
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
 	}
-	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong # of rows affected (%v) when updating details for user '%v'\n", numRows, userName)
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow TermsAcceptance
+		err = rows.Scan(&oneRow.Username, &oneRow.Version, &oneRow.DateAccepted)
+		if err != nil {
+			log.Printf("Error retrieving terms acceptance history: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
 	}
-
-	return nil
+	return list, nil
 }
 
-// Retrieve the latest social stats for a given database.
-func SocialStats(dbOwner string, dbFolder string, dbName string) (wa int, st int, fo int, err error) {
-
-	// TODO: Implement caching of these stats
-
-	// Retrieve latest star count
+// Returns true if the user has accepted the current version of the terms of service and privacy policy, or if none
+// have been published yet.
+func TermsAccepted(userName string) (bool, error) {
+	var accepted bool
 	dbQuery := `
-		SELECT stars
-		FROM sqlite_databases
-		WHERE username = $1
-			AND folder = $2
-			AND dbname = $3`
-	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&st)
+		SELECT coalesce(bool_or(a.username IS NOT NULL), true)
+		FROM (
+				SELECT idnum
+				FROM terms_versions
+				ORDER BY idnum DESC
+				LIMIT 1
+			) AS cur
+			LEFT JOIN terms_acceptances AS a ON a.version = cur.idnum AND a.username = $1`
+	err := pdb.QueryRow(dbQuery, userName).Scan(&accepted)
 	if err != nil {
-		log.Printf("Error retrieving star count for '%s%s%s': %v\n", dbOwner, dbFolder,
-			dbName, err)
-		return -1, -1, -1, err
+		log.Printf("Error checking terms acceptance for user '%s': %v\n", userName, err)
+		return false, err
 	}
+	return accepted, nil
+}
 
-	// Retrieve latest fork count
-	dbQuery = `
-		SELECT forks
-		FROM sqlite_databases
-		WHERE idnum = (
-			SELECT root_database
-			FROM sqlite_databases
-			WHERE username = $1
-			AND folder = $2
-			AND dbname = $3)`
-	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&fo)
+// Returns all published versions of the terms of service and privacy policy, newest first, along with how many users
+// have accepted each.
+func TermsVersions() (list []TermsVersion, err error) {
+	dbQuery := `
+		SELECT v.idnum, v.terms, v.privacy, v.date_published, count(a.username)
+		FROM terms_versions AS v
+			LEFT JOIN terms_acceptances AS a ON a.version = v.idnum
+		GROUP BY v.idnum
+		ORDER BY v.idnum DESC`
+	rows, err := pdb.Query(dbQuery)
 	if err != nil {
-		log.Printf("Error retrieving fork count for '%s%s%s': %v\n", dbOwner, dbFolder,
-			dbName, err)
-		return -1, -1, -1, err
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
 	}
-
-	// TODO: Implement watchers
-	return 0, st, fo, nil
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow TermsVersion
+		err = rows.Scan(&oneRow.Version, &oneRow.Terms, &oneRow.Privacy, &oneRow.DatePublished,
+			&oneRow.Acceptances)
+		if err != nil {
+			log.Printf("Error retrieving terms versions: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
 }
 
 // Toggle on or off the starring of a database by a user.
@@ -1204,7 +6304,7 @@ func ToggleDBStar(loggedInUser string, dbOwner string, dbFolder string, dbName s
 	}
 
 	// Get the ID number of the database
-	dbID, err := databaseID(dbOwner, dbName)
+	dbID, err := databaseID(dbOwner, dbFolder, dbName)
 	if err != nil {
 		return err
 	}
@@ -1233,35 +6333,262 @@ func ToggleDBStar(loggedInUser string, dbOwner string, dbFolder string, dbName s
 			AND username = $2`
 		commandTag, err := pdb.Exec(deleteQuery, dbID, loggedInUser)
 		if err != nil {
-			log.Printf("Removing star from database failed. Database ID: '%v' Username: '%s' Error: '%v'\n",
-				dbID, loggedInUser, err)
-			return err
+			log.Printf("Removing star from database failed. Database ID: '%v' Username: '%s' Error: '%v'\n",
+				dbID, loggedInUser, err)
+			return err
+		}
+		if numRows := commandTag.RowsAffected(); numRows != 1 {
+			log.Printf("Wrong # of rows (%v) affected when unstarring database ID: '%v' Username: '%s'\n",
+				numRows, dbID, loggedInUser)
+		}
+	}
+
+	// Refresh the main database table with the updated star count
+	updateQuery := `
+		UPDATE sqlite_databases
+		SET stars = (
+			SELECT count(db)
+			FROM database_stars
+			WHERE db = $1
+		) WHERE idnum = $1`
+	commandTag, err := pdb.Exec(updateQuery, dbID)
+	if err != nil {
+		log.Printf("Updating star count in database failed: %v\n", err)
+		return err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		log.Printf("Wrong # of rows affected (%v) when updating star count. Database ID: '%v'\n", numRows, dbID)
+	}
+
+	// Invalidate the cached data for the database, so the new star count is shown
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Toggles whether a user is watching a database.  Users can only start watching databases they can see.  Returns
+// whether the user is now watching the database, and its new watcher count.
+func ToggleDBWatch(loggedInUser string, dbOwner string, dbFolder string, dbName string) (watching bool, watchers int, err error) {
+	watching, err = CheckDBWatched(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		return false, -1, err
+	}
+	var dbQuery string
+	if watching {
+		dbQuery = `
+			DELETE FROM database_watches
+			WHERE username = $1
+				AND db = (
+					SELECT idnum
+					FROM sqlite_databases
+					WHERE username = $2
+						AND folder = $3
+						AND dbname = $4)`
+	} else {
+		dbQuery = `
+			INSERT INTO database_watches (db, username)
+			SELECT idnum, $1
+			FROM sqlite_databases
+			WHERE username = $2
+				AND folder = $3
+				AND dbname = $4
+				AND (public = true
+					OR username = $1
+					OR idnum IN (SELECT db FROM database_access WHERE username = $1))
+			ON CONFLICT DO NOTHING`
+	}
+	commandTag, err := pdb.Exec(dbQuery, loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Changing whether user '%s' watches '%s%s%s' failed: %v\n", loggedInUser, dbOwner, dbFolder,
+			dbName, err)
+		return false, -1, err
+	}
+	if numRows := commandTag.RowsAffected(); numRows != 1 {
+		return false, -1, fmt.Errorf("Unknown database")
+	}
+	watching = !watching
+
+	// Refresh the watcher count
+	dbQuery = `
+		UPDATE sqlite_databases AS db
+		SET watchers = (
+			SELECT count(*)
+			FROM database_watches
+			WHERE db = db.idnum)
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3
+		RETURNING watchers`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName).Scan(&watchers)
+	if err != nil {
+		log.Printf("Updating watcher count of '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return false, -1, err
+	}
+
+	// Invalidate the cached data for the database, so the new watcher count is shown
+	return watching, watchers, InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
+// Toggles whether a user is following another user.  Returns the new follower count of the followed user.
+func ToggleFollow(follower string, followed string) (followers int, err error) {
+	following, err := IsFollowing(follower, followed)
+	if err != nil {
+		return -1, err
+	}
+	var dbQuery string
+	if !following {
+		dbQuery = `
+			INSERT INTO user_follows (follower, followed)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`
+	} else {
+		dbQuery = `
+			DELETE FROM user_follows
+			WHERE follower = $1
+				AND followed = $2`
+	}
+	_, err = pdb.Exec(dbQuery, follower, followed)
+	if err != nil {
+		log.Printf("Toggling follow of user '%s' by '%s' failed: %v\n", followed, follower, err)
+		return -1, err
+	}
+
+	// Return the updated follower count
+	dbQuery = `
+		SELECT count(*)
+		FROM user_follows
+		WHERE followed = $1`
+	err = pdb.QueryRow(dbQuery, followed).Scan(&followers)
+	if err != nil {
+		log.Printf("Error retrieving follower count for user '%s': %v\n", followed, err)
+		return -1, err
+	}
+
+	// Both users' pages list who they follow and are followed by
+	err = InvalidateUserCache(follower)
+	if err != nil {
+		return -1, err
+	}
+	err = InvalidateUserCache(followed)
+	if err != nil {
+		return -1, err
+	}
+	return followers, nil
+}
+
+// Returns database versions whose changed rows haven't been counted yet, oldest first, along with the Minio object of
+// their parent version.  Versions from before commits were tracked use the previous version on their branch as the
+// parent.  The first version of a database has no parent, so its parent object ID is empty.
+func uncountedVersions(limit int) (list []uncountedVersion, err error) {
+	dbQuery := `
+		SELECT ver.idnum, db.username, db.folder, db.dbname, ver.version, db.minio_bucket, ver.minioid,
+			coalesce((
+				SELECT parent.minioid
+				FROM database_versions AS parent
+				WHERE parent.db = ver.db
+					AND parent.version < ver.version
+					AND (parent.commit_id = ver.parent_commit
+						OR (ver.commit_id IS NULL AND parent.branch = ver.branch))
+				ORDER BY parent.version DESC
+				LIMIT 1), '')
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND ver.rows_changed IS NULL
+		ORDER BY ver.idnum
+		LIMIT $1`
+	rows, err := pdb.Query(dbQuery, limit)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v uncountedVersion
+		err = rows.Scan(&v.ID, &v.Owner, &v.Folder, &v.DBName, &v.Version, &v.Bucket, &v.MinioID, &v.ParentID)
+		if err != nil {
+			log.Printf("Error retrieving uncounted database versions: %v\n", err)
+			return nil, err
 		}
-		if numRows := commandTag.RowsAffected(); numRows != 1 {
-			log.Printf("Wrong # of rows (%v) affected when unstarring database ID: '%v' Username: '%s'\n",
-				numRows, dbID, loggedInUser)
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// Removes one of a user's linked login identities.  The last identity can't be removed, as the user would have no way
+// to log in.
+func UnlinkIdentity(userName string, provider string, providerID string) error {
+	dbQuery := `
+		DELETE FROM user_identities
+		WHERE username = $1
+			AND provider = $2
+			AND provider_id = $3
+			AND (SELECT count(*) FROM user_identities WHERE username = $1) > 1`
+	commandTag, err := pdb.Exec(dbQuery, userName, provider, providerID)
+	if err != nil {
+		log.Printf("Unlinking %s identity '%s' from user '%s' failed: %v\n", provider, providerID, userName, err)
+		return err
+	}
+	if commandTag.RowsAffected() != 1 {
+		return errors.New("That login can't be removed.  Accounts need at least one linked login")
+	}
+
+	// Stop the Auth0 ID stored with older accounts from linking the identity again
+	if provider == LoginAuth0 {
+		dbQuery = `
+			UPDATE users
+			SET auth0id = NULL
+			WHERE username = $1
+				AND auth0id = $2`
+		_, err = pdb.Exec(dbQuery, userName, providerID)
+		if err != nil {
+			log.Printf("Clearing Auth0 ID for user '%s' failed: %v\n", userName, err)
+			return err
 		}
 	}
+	return nil
+}
 
-	// Refresh the main database table with the updated star count
-	updateQuery := `
-		UPDATE sqlite_databases
-		SET stars = (
-			SELECT count(db)
-			FROM database_stars
-			WHERE db = $1
-		) WHERE idnum = $1`
-	commandTag, err := pdb.Exec(updateQuery, dbID)
+// Removes the protection from a branch of a database.
+func UnprotectBranch(dbOwner string, dbFolder string, dbName string, branch string) error {
+	dbQuery := `
+		DELETE FROM protected_branches
+		WHERE branch = $4
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)`
+	commandTag, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, branch)
 	if err != nil {
-		log.Printf("Updating star count in database failed: %v\n", err)
+		log.Printf("Removing protection from branch '%s' of database '%s%s%s' failed: %v\n", branch, dbOwner,
+			dbFolder, dbName, err)
 		return err
 	}
 	if numRows := commandTag.RowsAffected(); numRows != 1 {
-		log.Printf("Wrong # of rows affected (%v) when updating star count. Database ID: '%v'\n", numRows, dbID)
+		return errors.New("That branch isn't protected")
 	}
 	return nil
 }
 
+// Updates the count of open merge requests shown for a database.
+func updateMergeRequestCount(dbOwner string, dbFolder string, dbName string) error {
+	dbQuery := `
+		UPDATE sqlite_databases
+		SET pull_requests = (
+			SELECT count(*)
+			FROM merge_requests
+			WHERE db = sqlite_databases.idnum
+				AND state = $4)
+		WHERE username = $1
+			AND folder = $2
+			AND dbname = $3`
+	_, err := pdb.Exec(dbQuery, dbOwner, dbFolder, dbName, MergeRequestOpen)
+	if err != nil {
+		log.Printf("Updating merge request count of '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return err
+	}
+	return InvalidateDBCache(dbOwner, dbFolder, dbName)
+}
+
 // Returns details for a user.
 func User(userName string) (user UserDetails, err error) {
 	dbQuery := `
@@ -1284,6 +6611,52 @@ func User(userName string) (user UserDetails, err error) {
 	return user, nil
 }
 
+// Returns the account details of all users, for the admin API.
+func UserAccounts() (list []UserAccount, err error) {
+	dbQuery := `
+		SELECT u.username, coalesce(u.email, ''), u.date_joined, u.disabled, u.storage_quota,
+			coalesce(sum(ver.size), 0)
+		FROM users AS u
+			LEFT JOIN sqlite_databases AS db ON db.username = u.username
+			LEFT JOIN database_versions AS ver ON ver.db = db.idnum
+		GROUP BY u.username
+		ORDER BY u.username ASC`
+	rows, err := pdb.Query(dbQuery)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow UserAccount
+		err = rows.Scan(&oneRow.Username, &oneRow.Email, &oneRow.DateJoined, &oneRow.Disabled,
+			&oneRow.StorageQuota, &oneRow.StorageUsed)
+		if err != nil {
+			log.Printf("Error retrieving user account list: %v\n", err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Returns where the uploaded avatar of a user is stored in Minio.  The ID is empty if they haven't uploaded one.
+func UserAvatar(userName string) (bucket string, minioID string, err error) {
+	dbQuery := `
+		SELECT coalesce(minio_bucket, ''), coalesce(avatar_minio_id, '')
+		FROM users
+		WHERE username = $1`
+	err = readDB().QueryRow(dbQuery, userName).Scan(&bucket, &minioID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", "", nil
+		}
+		log.Printf("Error retrieving avatar for user '%s': %v\n", userName, err)
+		return "", "", err
+	}
+	return bucket, minioID, nil
+}
+
 // Returns the list of databases for a user.
 func UserDBs(userName string, public AccessType) (list []DBInfo, err error) {
 	// Construct SQL query for retrieving the requested database list
@@ -1309,12 +6682,12 @@ func UserDBs(userName string, public AccessType) (list []DBInfo, err error) {
 		return nil, fmt.Errorf("Incorrect 'public' value '%v' passed to UserDBs() function.", public)
 	}
 	dbQuery += `
-		ORDER BY dbname, version DESC
+		ORDER BY dbname, folder, version DESC
 	), unique_dbs AS (
-		SELECT DISTINCT ON (dbname) * FROM dbs ORDER BY dbname
+		SELECT DISTINCT ON (dbname, folder) * FROM dbs ORDER BY dbname, folder, version DESC
 	)
 	SELECT * FROM unique_dbs ORDER BY last_modified DESC`
-	rows, err := pdb.Query(dbQuery, userName)
+	rows, err := readDB().Query(dbQuery, userName)
 	if err != nil {
 		log.Printf("Getting list of databases for user failed: %v\n", err)
 		return nil, err
@@ -1351,7 +6724,7 @@ func UserDBs(userName string, public AccessType) (list []DBInfo, err error) {
 			WHERE username = $1
 			AND folder = $2
 			AND dbname = $3)`
-		err = pdb.QueryRow(dbQuery, userName, j.Folder, j.Database).Scan(&list[i].Forks)
+		err = readDB().QueryRow(dbQuery, userName, j.Folder, j.Database).Scan(&list[i].Forks)
 		if err != nil {
 			log.Printf("Error retrieving fork count for '%s%s%s': %v\n", userName, j.Folder,
 				j.Database, err)
@@ -1378,7 +6751,55 @@ func UserDelete(userName string) error {
 		return err
 	}
 
-	return nil
+	// The user's databases may have been listed on the front page
+	err = InvalidateUserCache(userName)
+	if err != nil {
+		return err
+	}
+	return invalidateFrontPageCache()
+}
+
+// Returns true if the user account has been disabled by an administrator.
+func UserDisabled(userName string) (bool, error) {
+	var disabled bool
+	dbQuery := `
+		SELECT disabled
+		FROM users
+		WHERE username = $1`
+	err := pdb.QueryRow(dbQuery, userName).Scan(&disabled)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		log.Printf("Error checking if user '%s' is disabled: %v\n", userName, err)
+		return false, err
+	}
+	return disabled, nil
+}
+
+// Returns the external login identities linked to a user, oldest first.
+func UserIdentities(userName string) (list []LoginIdentity, err error) {
+	dbQuery := `
+		SELECT provider, provider_id, coalesce(email, ''), date_linked
+		FROM user_identities
+		WHERE username = $1
+		ORDER BY date_linked`
+	rows, err := pdb.Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow LoginIdentity
+		err = rows.Scan(&oneRow.Provider, &oneRow.ProviderID, &oneRow.Email, &oneRow.DateLinked)
+		if err != nil {
+			log.Printf("Error retrieving login identities for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
 }
 
 // Returns a list of all DBHub.io users.
@@ -1432,6 +6853,122 @@ func UserNameFromAuth0ID(auth0id string) (string, error) {
 	return userName, nil
 }
 
+// Returns the username linked to an external login identity, or an empty string if it isn't linked to anyone.
+// Accounts created before identities were tracked only have their Auth0 ID recorded in the users table, so those are
+// looked up there and linked on first use.
+func UserNameFromIdentity(provider string, providerID string) (string, error) {
+	dbQuery := `
+		SELECT username
+		FROM user_identities
+		WHERE provider = $1
+			AND provider_id = $2`
+	var userName string
+	err := pdb.QueryRow(dbQuery, provider, providerID).Scan(&userName)
+	if err == nil {
+		return userName, nil
+	}
+	if err != pgx.ErrNoRows {
+		log.Printf("Error looking up username in database: %v\n", err)
+		return "", err
+	}
+	if provider != LoginAuth0 {
+		return "", nil
+	}
+
+	// Fall back to the Auth0 ID stored with older accounts
+	userName, err = UserNameFromAuth0ID(providerID)
+	if err != nil || userName == "" {
+		return "", err
+	}
+	dbQuery = `
+		INSERT INTO user_identities (provider, provider_id, username, email)
+		SELECT $1, $2, username, email
+		FROM users
+		WHERE username = $3
+		ON CONFLICT (provider, provider_id) DO NOTHING`
+	_, err = pdb.Exec(dbQuery, provider, providerID, userName)
+	if err != nil {
+		log.Printf("Linking Auth0 identity '%s' to user '%s' failed: %v\n", providerID, userName, err)
+		return "", err
+	}
+	return userName, nil
+}
+
+// Returns the organisations a user is a member of, in alphabetical order.
+func UserOrgs(userName string) (orgs []string, err error) {
+	rows, err := readDB().Query(`
+		SELECT org
+		FROM organisation_members
+		WHERE username = $1
+		ORDER BY org`, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var org string
+		err = rows.Scan(&org)
+		if err != nil {
+			log.Printf("Error retrieving organisations of user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, nil
+}
+
+// Returns the details shown on a user's page, caching them until something on the page changes.  If the user
+// doesn't exist, exists is false.
+func UserPage(userName string) (details UserPageDetails, exists bool, err error) {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("userpage/%d/%s", userGeneration(userName), userName)))
+	cacheKey := hex.EncodeToString(tempArr[:])
+	ok, err := fetchFromCache(cacheKey, &details)
+	if err != nil {
+		log.Printf("Error retrieving data from cache: %v\n", err)
+	}
+	if ok {
+		return details, true, nil
+	}
+
+	exists, err = CheckUserExists(userName)
+	if err != nil || !exists {
+		return details, false, err
+	}
+	details.DBRows, err = UserDBs(userName, DB_PUBLIC)
+	if err != nil {
+		return details, true, err
+	}
+	details.Followers, err = Followers(userName)
+	if err != nil {
+		return details, true, err
+	}
+	details.Following, err = Following(userName)
+	if err != nil {
+		return details, true, err
+	}
+	details.IsOrg, err = IsOrganisation(userName)
+	if err != nil {
+		return details, true, err
+	}
+	if details.IsOrg {
+		details.Members, err = OrgMembers(userName)
+		if err != nil {
+			return details, true, err
+		}
+	}
+	details.Profile, err = UserProfileDetails(userName)
+	if err != nil {
+		return details, true, err
+	}
+
+	err = storeInCache(cacheKey, details, UserPageCacheTime)
+	if err != nil {
+		log.Printf("Error when caching user page details for '%s': %v\n", userName, err)
+	}
+	return details, true, nil
+}
+
 // Returns the password hash for a user.
 func UserPasswordHash(userName string) ([]byte, error) {
 	row := pdb.QueryRow("SELECT password_hash FROM public.users WHERE username = $1", userName)
@@ -1445,6 +6982,25 @@ func UserPasswordHash(userName string) ([]byte, error) {
 	return passHash, nil
 }
 
+// Returns the public profile of a user.
+func UserProfileDetails(userName string) (p UserProfile, err error) {
+	dbQuery := `
+		SELECT coalesce(display_name, ''), coalesce(bio, ''), coalesce(website, ''), coalesce(location, ''),
+			coalesce(email, ''), coalesce(avatar_minio_id, '')
+		FROM users
+		WHERE username = $1`
+	var email, minioID string
+	err = readDB().QueryRow(dbQuery, userName).Scan(&p.DisplayName, &p.Bio, &p.Website, &p.Location, &email,
+		&minioID)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error retrieving profile for user '%s': %v\n", userName, err)
+		return p, err
+	}
+	p.AvatarURL = avatarURL(userName, email, minioID)
+	p.HasAvatar = minioID != ""
+	return p, nil
+}
+
 // Returns the list of databases starred by a user.
 func UserStarredDBs(userName string) (list []DBEntry, err error) {
 	dbQuery := `
@@ -1457,7 +7013,7 @@ func UserStarredDBs(userName string) (list []DBEntry, err error) {
 		FROM sqlite_databases AS dbs, stars
 		WHERE dbs.idnum = stars.db
 		ORDER BY date_starred DESC`
-	rows, err := pdb.Query(dbQuery, userName)
+	rows, err := readDB().Query(dbQuery, userName)
 	if err != nil {
 		log.Printf("Database query failed: %v\n", err)
 		return nil, err
@@ -1477,7 +7033,7 @@ func UserStarredDBs(userName string) (list []DBEntry, err error) {
 }
 
 // Returns the list of users who starred a database.
-func UsersStarredDB(dbOwner string, dbName string) (list []DBEntry, err error) {
+func UsersStarredDB(dbOwner string, dbFolder string, dbName string) (list []DBEntry, err error) {
 	dbQuery := `
 		WITH star_users AS (
 			SELECT DISTINCT ON (username) username, date_starred
@@ -1486,14 +7042,15 @@ func UsersStarredDB(dbOwner string, dbName string) (list []DBEntry, err error) {
 				SELECT idnum
 				FROM sqlite_databases
 				WHERE username = $1
-					AND dbname = $2
+					AND folder = $2
+					AND dbname = $3
 				)
 			ORDER BY username DESC
 		)
 		SELECT username, date_starred
 		FROM star_users
 		ORDER BY date_starred DESC`
-	rows, err := pdb.Query(dbQuery, dbOwner, dbName)
+	rows, err := readDB().Query(dbQuery, dbOwner, dbFolder, dbName)
 	if err != nil {
 		log.Printf("Database query failed: %v\n", err)
 		return nil, err
@@ -1511,3 +7068,204 @@ func UsersStarredDB(dbOwner string, dbName string) (list []DBEntry, err error) {
 
 	return list, nil
 }
+
+// Returns the databases a user is watching, most recently watched first.
+func UserWatchedDBs(userName string) (list []DBEntry, err error) {
+	dbQuery := `
+		SELECT db.username, db.folder, db.dbname, w.date_watched
+		FROM database_watches AS w, sqlite_databases AS db
+		WHERE w.db = db.idnum
+			AND w.username = $1
+		ORDER BY w.date_watched DESC`
+	rows, err := readDB().Query(dbQuery, userName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oneRow DBEntry
+		err = rows.Scan(&oneRow.Owner, &oneRow.Folder, &oneRow.DBName, &oneRow.DateEntry)
+		if err != nil {
+			log.Printf("Error retrieving watched databases for user '%s': %v\n", userName, err)
+			return nil, err
+		}
+		list = append(list, oneRow)
+	}
+	return list, nil
+}
+
+// Checks a share link token is valid for a database, recording its use if it is.  Returns when the link expires, and
+// false if the token is unknown, for a different database, or has expired.
+func UseShareLink(dbOwner string, dbFolder string, dbName string, token string) (expiry time.Time, valid bool,
+	err error) {
+	dbQuery := `
+		UPDATE share_links
+		SET last_used = timezone('utc'::text, now())
+		WHERE token_hash = $4
+			AND expiry > now()
+			AND db = (
+				SELECT idnum
+				FROM sqlite_databases
+				WHERE username = $1
+					AND folder = $2
+					AND dbname = $3)
+		RETURNING expiry`
+	err = pdb.QueryRow(dbQuery, dbOwner, dbFolder, dbName, tokenHash(token)).Scan(&expiry)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return expiry, false, nil
+		}
+		log.Printf("Error checking share link for database '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		return expiry, false, err
+	}
+	return expiry, true, nil
+}
+
+// Returns the validation rules of a database, oldest first.
+func ValidationRules(dbOwner string, dbFolder string, dbName string) (list []ValidationRule, err error) {
+	dbQuery := `
+		SELECT rule.rule_id, rule.name, rule.kind, coalesce(rule.table_name, ''), coalesce(rule.column_name, ''),
+			rule.min_value, rule.max_value, coalesce(rule.query, ''), rule.created_by, rule.date_created
+		FROM validation_rules AS rule, sqlite_databases AS db
+		WHERE rule.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY rule.rule_id`
+	rows, err := pdb.Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Database query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r ValidationRule
+		var min, max pgx.NullFloat64
+		err = rows.Scan(&r.ID, &r.Name, &r.Kind, &r.Table, &r.Column, &min, &max, &r.Query, &r.CreatedBy,
+			&r.DateCreated)
+		if err != nil {
+			log.Printf("Error retrieving validation rules of database '%s%s%s': %v\n", dbOwner, dbFolder, dbName,
+				err)
+			return nil, err
+		}
+		if min.Valid {
+			r.Min = &min.Float64
+		}
+		if max.Valid {
+			r.Max = &max.Float64
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// Checks the lineage chain of a database's versions.  Each version record's chain hash is recalculated from its
+// details and the hash of the version before it, so changes to (or removal of) earlier version records are detected.
+// Versions recorded before lineage tracking started have no chain hash, and are reported as such.  Versions deleted
+// by the owner are kept in the chain until they're purged, so the versions after them still link up through them.
+func VerifyLineage(dbOwner string, dbFolder string, dbName string) (report LineageReport, err error) {
+	dbQuery := `
+		SELECT ver.version, ver.sha256, ver.date_created, coalesce(ver.prev_hash, ''),
+			coalesce(ver.chain_hash, ''), false
+		FROM database_versions AS ver, sqlite_databases AS db
+		WHERE ver.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		UNION ALL
+		SELECT del.version, del.sha256, del.date_created, coalesce(del.prev_hash, ''),
+			coalesce(del.chain_hash, ''), true
+		FROM deleted_versions AS del, sqlite_databases AS db
+		WHERE del.db = db.idnum
+			AND db.username = $1
+			AND db.folder = $2
+			AND db.dbname = $3
+		ORDER BY 1, 3`
+	rows, err := readDB().Query(dbQuery, dbOwner, dbFolder, dbName)
+	if err != nil {
+		log.Printf("Retrieving lineage of '%s%s%s' failed: %v\n", dbOwner, dbFolder, dbName, err)
+		return report, err
+	}
+	for rows.Next() {
+		var e LineageEntry
+		err = rows.Scan(&e.Version, &e.SHA256, &e.DateCreated, &e.PrevHash, &e.ChainHash, &e.Deleted)
+		if err != nil {
+			rows.Close()
+			log.Printf("Error retrieving lineage of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+			return report, err
+		}
+		report.Versions = append(report.Versions, e)
+	}
+	rows.Close()
+
+	deleted := make(map[string]LineageEntry)
+	for _, e := range report.Versions {
+		if e.Deleted && e.ChainHash != "" {
+			deleted[e.ChainHash] = e
+		}
+	}
+	report.Valid = true
+	var prev string
+	for i := range report.Versions {
+		e := &report.Versions[i]
+		if e.Deleted {
+			e.Problem = "Deleted by the owner"
+			if e.ChainHash != "" && e.ChainHash != lineageHash(e.PrevHash, e.Version, e.SHA256, e.DateCreated) {
+				e.Problem = "Deleted version record doesn't match its chain hash"
+				report.Valid = false
+			}
+			continue
+		}
+		switch {
+		case e.ChainHash == "":
+			if prev != "" {
+				e.Problem = "Chain hash missing"
+				report.Valid = false
+			} else {
+				e.Problem = "Recorded before lineage tracking started"
+			}
+		case e.ChainHash != lineageHash(e.PrevHash, e.Version, e.SHA256, e.DateCreated):
+			e.Problem = "Version record doesn't match its chain hash"
+			report.Valid = false
+		case prev != "" && !linksThroughDeleted(deleted, e.PrevHash, prev):
+			e.Problem = "Doesn't link to the previous version"
+			report.Valid = false
+		case prev == "" && e.PrevHash != "":
+			// The first chained version of a fork links to the version it was forked from, which may since have
+			// been deleted
+			var exists bool
+			dbQuery = `
+				SELECT exists(SELECT 1 FROM database_versions WHERE chain_hash = $1)
+					OR exists(SELECT 1 FROM deleted_versions WHERE chain_hash = $1)`
+			err = readDB().QueryRow(dbQuery, e.PrevHash).Scan(&exists)
+			if err != nil {
+				log.Printf("Error checking lineage of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+				return report, err
+			}
+			if !exists {
+				e.Problem = "Links to an unknown version"
+				report.Valid = false
+			}
+		}
+		prev = e.ChainHash
+	}
+	report.Head = prev
+	return report, nil
+}
+
+// Reports whether a lineage chain hash leads back to another, either directly or through versions which have been
+// deleted.
+func linksThroughDeleted(deleted map[string]LineageEntry, hash string, want string) bool {
+	for i := 0; i <= len(deleted); i++ {
+		if hash == want {
+			return true
+		}
+		e, ok := deleted[hash]
+		if !ok {
+			return false
+		}
+		hash = e.PrevHash
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"io/ioutil"
+	"regexp"
+	"testing"
+)
+
+func TestMetadataTablesMatchSchema(t *testing.T) {
+	schema, err := ioutil.ReadFile("../database/dbhub.sql")
+	if err != nil {
+		t.Fatalf("Couldn't read the database schema: %v", err)
+	}
+
+	// Every table in the schema needs exporting, and every exported table needs to exist
+	listed := make(map[string]int)
+	for i, tbl := range metadataTables {
+		if _, ok := listed[tbl.Name]; ok {
+			t.Errorf("Table '%s' is in metadataTables more than once", tbl.Name)
+		}
+		listed[tbl.Name] = i
+	}
+	tables := regexp.MustCompile(`(?m)^CREATE TABLE (\w+) \(((?s).*?)\n\);`).FindAllStringSubmatch(string(schema), -1)
+	if len(tables) == 0 {
+		t.Fatal("No tables were found in the database schema")
+	}
+	inSchema := make(map[string]bool)
+	refs := regexp.MustCompile(`REFERENCES (\w+)\(`)
+	for _, tbl := range tables {
+		name := tbl[1]
+		inSchema[name] = true
+		pos, ok := listed[name]
+		if !ok {
+			t.Errorf("Table '%s' is missing from metadataTables", name)
+			continue
+		}
+
+		// Tables need importing after the ones they reference
+		for _, ref := range refs.FindAllStringSubmatch(tbl[2], -1) {
+			if refPos, ok := listed[ref[1]]; ok && ref[1] != name && refPos > pos {
+				t.Errorf("Table '%s' is listed before '%s', which it references", name, ref[1])
+			}
+		}
+	}
+	for name := range listed {
+		if !inSchema[name] {
+			t.Errorf("Table '%s' is in metadataTables, but not in the database schema", name)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"io"
+	"log"
+)
+
+// Wraps the body of a web form upload, counting the bytes read through it and recording the progress in Memcached
+// as it goes.  The upload page polls the progress using the token it generated, to show an accurate progress bar.
+type UploadProgressReader struct {
+	body      io.ReadCloser
+	lastSaved int64
+	progress  UploadProgress
+	token     string
+}
+
+// Starts tracking the progress of an upload.  The total is the expected size of the request body, or -1 if unknown.
+func NewUploadProgressReader(body io.ReadCloser, token string, owner string, total int64) *UploadProgressReader {
+	p := &UploadProgressReader{
+		body:     body,
+		progress: UploadProgress{Owner: owner, Total: total},
+		token:    token,
+	}
+	p.save()
+	return p
+}
+
+func (p *UploadProgressReader) Close() error {
+	return p.body.Close()
+}
+
+// Records that the whole upload has been received.
+func (p *UploadProgressReader) Finish() {
+	p.progress.Done = true
+	p.save()
+}
+
+func (p *UploadProgressReader) Read(b []byte) (int, error) {
+	n, err := p.body.Read(b)
+	p.progress.Received += int64(n)
+	if p.progress.Received-p.lastSaved >= UploadProgressInterval {
+		p.save()
+	}
+	return n, err
+}
+
+// Stores the current progress in Memcached.  Failures only affect the progress bar, so are just logged.
+func (p *UploadProgressReader) save() {
+	p.lastSaved = p.progress.Received
+	err := SetUploadProgress(p.token, p.progress)
+	if err != nil {
+		log.Printf("Error when saving progress of upload '%s': %v\n", p.token, err)
+	}
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Rate limits count requests in fixed time windows, with the counts kept in memcached so they're shared between
+// webUI servers.  Table browsing by anonymous clients is limited softly.  Once a client goes over its allowance for
+// the current window, each further request is delayed a bit more than the one before, instead of being refused.
+
+// Returns how long to delay a table data request from an anonymous client.  Problems talking to memcached aren't
+// treated as a reason to slow anyone down.
+func AnonBrowseDelay(clientIP string) time.Duration {
+	count, err := rateLimitCount("anonbrowse", clientIP, AnonBrowseWindow)
+	if err != nil {
+		return 0
+	}
+	if count <= AnonBrowseAllowance {
+		return 0
+	}
+	delay := time.Duration(count-AnonBrowseAllowance) * AnonBrowseDelayStep
+	if delay > AnonBrowseMaxDelay {
+		delay = AnonBrowseMaxDelay
+	}
+	return delay
+}
+
+// Checks whether a client (a user name, or the IP address of an anonymous client) can download all of a user's public
+// databases at once, counting the attempt.
+func BulkDownloadAllowed(client string) bool {
+	count, err := rateLimitCount("bulkdownload", client, 3600)
+	if err != nil {
+		return true
+	}
+	return count <= BulkDownloadsPerHour
+}
+
+// Counts a request from a client against the given rate limit, returning the number of requests it's made in the
+// current window (including this one).
+func rateLimitCount(limitName string, client string, window int64) (uint64, error) {
+	tempArr := md5.Sum([]byte(fmt.Sprintf("ratelimit/%s/%s/%d", limitName, client, time.Now().Unix()/window)))
+	cacheKey := hex.EncodeToString(tempArr[:])
+	count, err := memCache.Increment(cacheKey, 1)
+	if err == memcache.ErrCacheMiss {
+		// First request in this window.  If another server got in first, count this request on top of theirs
+		err = memCache.Add(&memcache.Item{Key: cacheKey, Value: []byte("1"), Expiration: int32(window * 2)})
+		if err == memcache.ErrNotStored {
+			count, err = memCache.Increment(cacheKey, 1)
+		} else {
+			count = 1
+		}
+	}
+	if err != nil {
+		log.Printf("Error updating '%s' rate limit count for '%s': %v\n", limitName, client, err)
+		return 0, err
+	}
+	return count, nil
+}
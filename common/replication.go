@@ -0,0 +1,172 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Replication keeps a hot standby instance in sync with a primary one.  The primary's admin server lists the database
+// versions added since a cursor, and hands out the stored objects by SHA256.  As database versions never change once
+// added, applying a change is just copying a version the standby doesn't have yet, so changes can be safely applied
+// more than once.  Versions deleted on the primary aren't removed from the standby.  If the primary later reuses the
+// number of a deleted version, the standby reports the clash and skips the new version rather than overwriting
+// the one it has.
+
+// The most transactions whose changes are returned from a single replication change list request
+const ReplicationBatchSize = 100
+
+// A replicated version which the standby already has different contents for
+type replicationConflict struct {
+	standbySHA string
+}
+
+func (e replicationConflict) Error() string {
+	return fmt.Sprintf("The standby has different contents for this version (SHA256 '%s')", e.standbySHA)
+}
+
+// Copies new database versions from the replication source every ReplicationInterval() seconds, until the program
+// exits.
+func ReplicationLoop() {
+	for {
+		n, err := ReplicationSync(context.Background())
+		if err != nil {
+			log.Printf("Replication from '%s' failed: %v\n", ReplicationSource(), err)
+		} else if n > 0 {
+			log.Printf("Replication from '%s' applied %d changes\n", ReplicationSource(), n)
+		}
+		time.Sleep(time.Duration(ReplicationInterval()) * time.Second)
+	}
+}
+
+// Applies the changes made on the replication source since the last run, returning how many were applied.  The
+// cursor is saved after the changes of each source transaction, so an interrupted run carries on from where it
+// stopped.  Conflicting changes are logged and skipped.
+func ReplicationSync(ctx context.Context) (applied int, err error) {
+	ctx, span := StartSpan(ctx, "replication.sync")
+	defer span.End()
+
+	source := ReplicationSource()
+	cursor, err := ReplicationCursor(source)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var list ReplicationChangeList
+		err = replicationRequest(ctx, fmt.Sprintf("/api/replication/changes?since=%d&limit=%d", cursor,
+			ReplicationBatchSize), func(resp *http.Response) error {
+			return json.NewDecoder(resp.Body).Decode(&list)
+		})
+		if err != nil {
+			return applied, err
+		}
+		if len(list.Changes) == 0 {
+			return applied, nil
+		}
+		for i, c := range list.Changes {
+			err = applyReplicationChange(ctx, c)
+			if conflict, ok := err.(replicationConflict); ok {
+				log.Printf("Replication conflict skipped. Change %d ('%s%s%s' version %d) has SHA256 '%s': %v\n",
+					c.Cursor, c.Owner, c.Folder, c.Name, c.Version, c.SHA256, conflict)
+			} else if err != nil {
+				return applied, fmt.Errorf("Applying change %d ('%s%s%s' version %d) failed: %v", c.Cursor,
+					c.Owner, c.Folder, c.Name, c.Version, err)
+			} else {
+				applied++
+			}
+
+			// Changes made in the same source transaction share a cursor, so it's only moved on once they're all done
+			if i == len(list.Changes)-1 || list.Changes[i+1].Cursor != c.Cursor {
+				err = SetReplicationCursor(source, c.Cursor)
+				if err != nil {
+					return applied, err
+				}
+				cursor = c.Cursor
+			}
+		}
+	}
+}
+
+// Applies one change from the replication source.  Versions the standby already has are skipped, and a version with
+// different contents to the source is returned as a replicationConflict instead of being overwritten.  New versions
+// are stored exactly as they are on the source, including their creation date, commit ID and lineage hashes.
+func applyReplicationChange(ctx context.Context, c ReplicationChange) error {
+	err := ValidateUserDB(c.Owner, c.Name)
+	if err != nil {
+		return err
+	}
+	exists, err := CheckUserExists(c.Owner)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = AddMirrorUser(c.Owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	highVer, err := HighestDBVersion(c.Owner, c.Name, c.Folder, c.Owner)
+	if err != nil {
+		return err
+	}
+	if c.Version <= highVer {
+		sha, _, err := DBVersionSHA256(c.Owner, c.Folder, c.Name, c.Version)
+		if err != nil {
+			return err
+		}
+		if sha != c.SHA256 {
+			return replicationConflict{standbySHA: sha}
+		}
+		return SetReplicatedDBDetails(c.Owner, c.Folder, c.Name, c.Public, c.Description, c.Readme,
+			c.DefaultTable)
+	}
+
+	var tempDBName string
+	var dbSize int64
+	var shaSum []byte
+	err = replicationRequest(ctx, "/api/replication/object?sha256="+url.QueryEscape(c.SHA256),
+		func(resp *http.Response) (err error) {
+			tempDBName, dbSize, shaSum, err = saveRemoteDB(resp.Body, c.SHA256)
+			return
+		})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempDBName)
+	bucket, minioID, storedSize, err := storeRemoteDB(ctx, c.Owner, tempDBName)
+	if err != nil {
+		return err
+	}
+	err = AddReplicatedDatabase(c, shaSum, int(dbSize), storedSize, bucket, minioID)
+	if err != nil {
+		return err
+	}
+	return SetReplicatedDBDetails(c.Owner, c.Folder, c.Name, c.Public, c.Description, c.Readme, c.DefaultTable)
+}
+
+// Sends an authenticated request to the replication API of the source admin server, passing the response to the
+// given function if it succeeded.
+func replicationRequest(ctx context.Context, path string, fn func(resp *http.Response) error) error {
+	req, err := http.NewRequest("GET", ReplicationSource()+path, nil)
+	if err != nil {
+		return err
+	}
+	if key := ReplicationAPIKey(); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status from replication source: %s", resp.Status)
+	}
+	return fn(resp)
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+)
+
+// Each request to the webUI gets an ID, which is included in the request log, error pages, and error reports.  Users
+// can pass it on when reporting a problem, so operators can find the matching log entries.
+
+// The response header the request ID is sent in
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// Generates a new request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, err := crand.Read(b)
+	if err != nil {
+		return RandomString(16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns the ID of the request a context belongs to.  Empty if it doesn't have one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Returns a copy of the context carrying the given request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
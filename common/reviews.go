@@ -0,0 +1,45 @@
+package common
+
+import "fmt"
+
+// Database owners can set a review policy, which merge requests to the database need to meet before they can be
+// accepted.  The policy can ask for a minimum number of approvals, and for one of them to come from the owner.
+
+// Checks whether the users who've approved a merge request meet the review policy of the database it's for, returning
+// what's still needed if they don't.  Approvals from the author of the merge request don't count.
+func CheckReviewPolicy(dbOwner string, dbFolder string, dbName string, author string, approvers []string) (
+	missing []string, err error) {
+	p, err := DBReviewPolicy(dbOwner, dbFolder, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	ownerApproved := false
+	for _, a := range approvers {
+		if a == author || seen[a] {
+			continue
+		}
+		seen[a] = true
+		if !p.OwnerApproval || ownerApproved {
+			continue
+		}
+		if a == dbOwner {
+			ownerApproved = true
+			continue
+		}
+		role, err := OrgRole(dbOwner, a)
+		if err != nil {
+			return nil, err
+		}
+		ownerApproved = role == OrgRoleOwner || role == OrgRoleAdmin
+	}
+	if len(seen) < p.MinApprovals {
+		missing = append(missing, fmt.Sprintf("It needs %d approvals, but only has %d", p.MinApprovals,
+			len(seen)))
+	}
+	if p.OwnerApproval && !ownerApproved {
+		missing = append(missing, "It needs to be approved by the owner of the database")
+	}
+	return missing, nil
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+// Uploaded databases are checked with a virus scanner, if one is configured.  Scanning is slow for large files, so
+// verdicts are cached in PostgreSQL by the SHA256 of the content, and re-uploads (or forks) of content which has
+// already been scanned skip it.  After a signature update, an admin can clear the cached verdicts and have all of the
+// stored databases scanned again.
+
+// Set while a re-scan of the stored databases is running, so only one runs at a time
+var rescanRunning int32
+
+// Re-scans every stored database with the virus scanner, after clearing the cached verdicts.  This can take a long
+// time, so is meant to be run in the background.  Returns false if a re-scan is already running.
+func RescanStoredDatabases(ctx context.Context) bool {
+	if !atomic.CompareAndSwapInt32(&rescanRunning, 0, 1) {
+		return false
+	}
+	go func() {
+		defer atomic.StoreInt32(&rescanRunning, 0)
+		cleared, err := ClearScanVerdicts()
+		if err != nil {
+			return
+		}
+		log.Printf("Cleared %d cached scan verdicts, re-scanning stored databases\n", cleared)
+
+		versions, err := AllDBVersions()
+		if err != nil {
+			return
+		}
+		scanned := make(map[string]bool)
+		var flagged int
+		for _, ver := range versions {
+			if scanned[ver.SHA256] {
+				continue
+			}
+			scanned[ver.SHA256] = true
+			clean, detail, err := scanStoredDB(ctx, ver)
+			if err != nil {
+				log.Printf("Couldn't re-scan '%s%s%s' version %d: %v\n", ver.Owner, ver.Folder, ver.DBName,
+					ver.Version, err)
+				continue
+			}
+			if !clean {
+				flagged++
+				log.Printf("Virus scanner flagged '%s%s%s' version %d: %s\n", ver.Owner, ver.Folder,
+					ver.DBName, ver.Version, detail)
+			}
+		}
+		log.Printf("Re-scan finished. %d distinct databases scanned, %d flagged\n", len(scanned), flagged)
+	}()
+	return true
+}
+
+// Returns true while a re-scan of the stored databases is running.
+func RescanRunning() bool {
+	return atomic.LoadInt32(&rescanRunning) == 1
+}
+
+// Checks a database file with the virus scanner, using the cached verdict for its content if there is one.  When no
+// scanner is configured everything is treated as clean.
+func ScanDatabase(ctx context.Context, fileName string, sha string) (clean bool, detail string, err error) {
+	if ScannerCommand() == "" {
+		return true, "", nil
+	}
+	verdict, found, err := CachedScanVerdict(sha)
+	if err != nil {
+		return false, "", err
+	}
+	if found {
+		return verdict.Clean, verdict.Detail, nil
+	}
+
+	_, span := StartSpan(ctx, "scan.database")
+	clean, detail, err = runScanner(ctx, fileName)
+	span.End()
+	if err != nil {
+		return false, "", err
+	}
+	return clean, detail, StoreScanVerdict(sha, clean, detail)
+}
+
+// Runs the configured virus scanner over a file.
+func runScanner(ctx context.Context, fileName string) (clean bool, detail string, err error) {
+	args := strings.Fields(ScannerCommand())
+	out, err := exec.CommandContext(ctx, args[0], append(args[1:], fileName)...).CombinedOutput()
+	detail = strings.TrimSpace(string(out))
+	if err == nil {
+		return true, detail, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, detail, nil
+	}
+	log.Printf("Error running virus scanner on '%s': %v, output: %s\n", fileName, err, detail)
+	return false, "", err
+}
+
+// Copies a stored database version to a temporary file, and scans it.
+func scanStoredDB(ctx context.Context, ver StoredDBVersion) (clean bool, detail string, err error) {
+	obj, err := MinioHandle(ctx, ver.MinioBkt, ver.MinioID)
+	if err != nil {
+		return false, "", err
+	}
+	defer MinioHandleClose(obj)
+	tempDB, err := ioutil.TempFile("", "dbhub-rescan-")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.Remove(tempDB.Name())
+	_, err = io.Copy(tempDB, obj)
+	tempDB.Close()
+	if err != nil {
+		return false, "", err
+	}
+	return ScanDatabase(ctx, tempDB.Name(), ver.SHA256)
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"fmt"
+	"log"
+)
+
+// Security notifications tell users about things happening to their account, such as logins from new devices or new
+// client certificates, so they can react quickly if it wasn't them.  They're emailed as well as shown on the website
+// unless the user has said otherwise.
+
+// The most characters of a user agent string kept when recording logins
+const loginUserAgentLength = 200
+
+// Records a user logging in, and warns them if it's from an IP address and browser they haven't logged in from
+// before.  A user's first ever login isn't warned about.
+func SecurityLogin(userName string, ip string, userAgent string) {
+	if len(userAgent) > loginUserAgentLength {
+		userAgent = userAgent[:loginUserAgentLength]
+	}
+	seen, firstLogin, err := RecordLogin(userName, ip, userAgent)
+	if err != nil || seen || firstLogin {
+		return
+	}
+	device := userAgent
+	if device == "" {
+		device = "an unknown browser"
+	}
+	SecurityNotice(userName, fmt.Sprintf("There was a new login to your account from %s, using %s.", ip, device))
+}
+
+// Tells the user their email address has changed.  The old address is emailed directly too, as the user won't be
+// reading the new one if it was changed by someone else.
+func SecurityEmailChange(userName string, oldEmail string, newEmail string) {
+	msg := fmt.Sprintf("The email address for your account was changed from '%s' to '%s'.", oldEmail, newEmail)
+	if oldEmail == "" {
+		msg = fmt.Sprintf("The email address for your account was set to '%s'.", newEmail)
+	}
+	SecurityNotice(userName, msg)
+	if oldEmail == "" || EmailServer() == "" {
+		return
+	}
+	err := SendEmail(oldEmail, "DBHub.io notification", fmt.Sprintf("%s\n\nIf this wasn't you, please contact "+
+		"us straight away.\n", msg))
+	if err != nil {
+		log.Printf("Emailing user '%s' about their email address changing failed: %v\n", userName, err)
+	}
+}
+
+// Sends a security notification to a user, suggesting what to do if it wasn't them.  Failures are logged rather than
+// returned, as they shouldn't stop whatever the user was doing.
+func SecurityNotice(userName string, message string) {
+	err := Notify([]string{userName}, NotifySecurity, message+"  If this wasn't you, check your preferences "+
+		"and generate a new client certificate.", "/pref")
+	if err != nil {
+		log.Printf("Sending security notification to user '%s' failed: %v\n", userName, err)
+	}
+}
@@ -0,0 +1,174 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/icza/session"
+)
+
+// A session which can be serialised into Memcached, so it's available to every webui instance.  The fields are
+// exported only so gob can encode them.
+type cacheSession struct {
+	AccessedF time.Time
+	AttrsF    map[string]interface{}
+	CAttrsF   map[string]interface{}
+	CreatedF  time.Time
+	IDF       string
+	TimeoutF  time.Duration
+
+	mux sync.RWMutex
+}
+
+func (s *cacheSession) Access() {
+	s.mux.Lock()
+	s.AccessedF = time.Now()
+	s.mux.Unlock()
+}
+
+func (s *cacheSession) Accessed() time.Time {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.AccessedF
+}
+
+func (s *cacheSession) Attr(name string) interface{} {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.AttrsF[name]
+}
+
+func (s *cacheSession) Attrs() map[string]interface{} {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	m := make(map[string]interface{}, len(s.AttrsF))
+	for k, v := range s.AttrsF {
+		m[k] = v
+	}
+	return m
+}
+
+func (s *cacheSession) CAttr(name string) interface{} {
+	return s.CAttrsF[name]
+}
+
+func (s *cacheSession) Created() time.Time {
+	return s.CreatedF
+}
+
+func (s *cacheSession) ID() string {
+	return s.IDF
+}
+
+func (s *cacheSession) Mutex() *sync.RWMutex {
+	return &s.mux
+}
+
+func (s *cacheSession) New() bool {
+	return s.CreatedF.Equal(s.AccessedF)
+}
+
+func (s *cacheSession) SetAttr(name string, value interface{}) {
+	s.mux.Lock()
+	if value == nil {
+		delete(s.AttrsF, name)
+	} else {
+		s.AttrsF[name] = value
+	}
+	s.mux.Unlock()
+}
+
+func (s *cacheSession) Timeout() time.Duration {
+	return s.TimeoutF
+}
+
+// Session store which keeps sessions in Memcached rather than in the memory of a single server.
+type cacheSessionStore struct{}
+
+// Generate a predictable cache key for a session
+func sessionCacheKey(id string) string {
+	tempArr := md5.Sum([]byte("session/" + id))
+	return hex.EncodeToString(tempArr[:])
+}
+
+func (cacheSessionStore) Add(sess session.Session) {
+	s, ok := sess.(*cacheSession)
+	if !ok {
+		log.Printf("Session '%s' wasn't created with NewSession(), so can't be stored\n", sess.ID())
+		return
+	}
+	err := storeInCache(sessionCacheKey(s.IDF), s, int32(s.TimeoutF.Seconds()))
+	if err != nil {
+		log.Printf("Error when storing session data: %v\n", err)
+	}
+}
+
+func (cacheSessionStore) Close() {}
+
+func (st cacheSessionStore) Get(id string) session.Session {
+	var s cacheSession
+	ok, err := fetchFromCache(sessionCacheKey(id), &s)
+	if err != nil {
+		log.Printf("Error when retrieving session data: %v\n", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	// Sessions of users who've been disabled since logging in aren't valid any more
+	if u, ok := s.CAttrsF["UserName"].(string); ok {
+		disabled, err := UserDisabled(u)
+		if err != nil {
+			return nil
+		}
+		if disabled {
+			st.Remove(&s)
+			return nil
+		}
+	}
+
+	// Update the access time, which also pushes back the expiry time in Memcached
+	s.Access()
+	st.Add(&s)
+	return &s
+}
+
+func (cacheSessionStore) Remove(sess session.Session) {
+	err := memCache.Delete(sessionCacheKey(sess.ID()))
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Printf("Error when removing session data: %v\n", err)
+	}
+}
+
+// Returns a session store backed by Memcached, so sessions are shared between webui instances.
+func NewCacheSessionStore() session.Store {
+	return cacheSessionStore{}
+}
+
+// Creates a new session with the given constant attributes, which can be stored in the Memcached session store.  An
+// error is returned if a random session ID couldn't be generated, as a predictable one could be shared by several
+// users.
+func NewSession(cAttrs map[string]interface{}) (session.Session, error) {
+	idBytes := make([]byte, 18)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		log.Printf("Error when generating session ID: %v\n", err)
+		return nil, err
+	}
+	now := time.Now()
+	return &cacheSession{
+		AccessedF: now,
+		AttrsF:    make(map[string]interface{}),
+		CAttrsF:   cAttrs,
+		CreatedF:  now,
+		IDF:       base64.URLEncoding.EncodeToString(idBytes),
+		TimeoutF:  SessionTimeout,
+	}, nil
+}
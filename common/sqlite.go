@@ -1,15 +1,126 @@
 package common
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
 
 	sqlite "github.com/gwenn/gosqlite"
 )
 
+// Used internally to stop processing query results once the requested number of rows has been reached
+var errRowLimit = errors.New("Row limit reached")
+
+// Tables which uploaded databases can include to describe themselves.  Both have key and value columns
+var metadataTableNames = []string{"dbhub_metadata", "_dbhub_metadata"}
+
+// Derives a one line description for a database which was uploaded without one, so it isn't blank in listings.  A
+// description in its metadata table is used if present, otherwise the tables and their row counts are listed.  An
+// empty string is returned if nothing useful can be worked out.
+func AutoDescription(fileName string) string {
+	sdb, err := sqlite.Open(fileName, sqlite.OpenReadOnly)
+	if err != nil {
+		log.Printf("Couldn't open database when generating description: %s", err)
+		return ""
+	}
+	defer sdb.Close()
+
+	// Use the description from the metadata table, if there is one
+	descrip := ReadMetadataTable(sdb).Description
+	if descrip != "" {
+		if r := []rune(descrip); len(r) > 80 {
+			descrip = strings.TrimSpace(string(r[:77])) + "..."
+		}
+		return descrip
+	}
+
+	// Otherwise describe the tables, leaving out the metadata table and the internal and index ones
+	tables, err := userTables(sdb)
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	for _, t := range tables {
+		rows, err := GetSQLiteRowCount(sdb, t)
+		if err != nil {
+			return ""
+		}
+		parts = append(parts, fmt.Sprintf("%s (%d rows)", t, rows))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	descrip = fmt.Sprintf("%d tables: ", len(parts))
+	if len(parts) == 1 {
+		descrip = "1 table: "
+	}
+	for i, p := range parts {
+		more := ""
+		if i < len(parts)-1 {
+			more = fmt.Sprintf(", and %d more", len(parts)-i-1)
+		}
+		if len(descrip)+len(p)+len(more) > 80 {
+			if i == 0 {
+				return strings.TrimSuffix(descrip, ": ")
+			}
+			return strings.TrimSuffix(descrip, ", ") + fmt.Sprintf(", and %d more", len(parts)-i)
+		}
+		descrip += p + ", "
+	}
+	return strings.TrimSuffix(descrip, ", ")
+}
+
+// Generates a markdown skeleton README for a database, for its owner to fill in.  Each table is listed with its row
+// count and columns, using the column docs where there are some and placeholders where there aren't.
+func GenerateReadme(sdb *sqlite.Conn, dbName string, colDocs map[string]map[string]string, license string) (string, error) {
+	tables, err := userTables(sdb)
+	if err != nil {
+		log.Printf("Error retrieving table names when generating README: %s", err)
+		return "", errors.New("Error retrieving table names")
+	}
+
+	// Pipes in names would otherwise break up the markdown tables
+	cell := strings.NewReplacer("|", "\\|", "\n", " ").Replace
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n_Describe what this database contains, where the data came from, and how it's kept up to "+
+		"date._\n\n## Tables\n\n| Table | Rows |\n| --- | --- |\n", dbName)
+	for _, t := range tables {
+		rows, err := GetSQLiteRowCount(sdb, t)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "| %s | %d |\n", cell(t), rows)
+	}
+	for _, t := range tables {
+		cols, err := sdb.Columns("", t)
+		if err != nil {
+			log.Printf("Error retrieving column names for table '%s' when generating README: %s", t, err)
+			return "", errors.New("Error retrieving column names")
+		}
+		fmt.Fprintf(&b, "\n### %s\n\n_Describe this table._\n\n| Column | Type | Description |\n| --- | --- | --- |\n",
+			cell(t))
+		for _, c := range cols {
+			descrip := colDocs[t][c.Name]
+			if descrip == "" {
+				descrip = "_Describe this column._"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", cell(c.Name), cell(c.DataType), cell(descrip))
+		}
+	}
+	if license == "" {
+		license = "_No license has been chosen for this database yet._"
+	}
+	fmt.Fprintf(&b, "\n## License\n\n%s\n", license)
+	return b.String(), nil
+}
+
 // Returns the number of rows in a SQLite table.
 func GetSQLiteRowCount(sdb *sqlite.Conn, dbTable string) (int, error) {
 	dbQuery := `SELECT count(*) FROM "` + dbTable + `"`
@@ -22,14 +133,144 @@ func GetSQLiteRowCount(sdb *sqlite.Conn, dbTable string) (int, error) {
 	return rowCount, nil
 }
 
+// Imports the contents of an uploaded database's metadata table (if it has one) into the stored details for the
+// database.
+func ImportMetadataTable(fileName string, dbOwner string, dbFolder string, dbName string) error {
+	sdb, err := sqlite.Open(fileName, sqlite.OpenReadOnly)
+	if err != nil {
+		log.Printf("Couldn't open database when importing its metadata table: %s", err)
+		return err
+	}
+	defer sdb.Close()
+	meta := ReadMetadataTable(sdb)
+	if meta.Title == "" && meta.License == "" && len(meta.ColumnDocs) == 0 {
+		return nil
+	}
+	return StoreDBMetadataTable(dbOwner, dbFolder, dbName, meta)
+}
+
+// Typed values are cached along with the rest of the table data, so gob needs to know about BLOBs
+func init() {
+	gob.Register(TypedBlob{})
+}
+
+// Returns true if the given table name is one of the metadata table conventions.
+func isMetadataTable(table string) bool {
+	for _, n := range metadataTableNames {
+		if strings.EqualFold(table, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first keyword of an SQL statement in upper case, skipping any leading whitespace and comments.
+func queryKeyword(query string) string {
+	for {
+		query = strings.TrimSpace(query)
+		switch {
+		case strings.HasPrefix(query, "--"):
+			i := strings.Index(query, "\n")
+			if i == -1 {
+				return ""
+			}
+			query = query[i+1:]
+		case strings.HasPrefix(query, "/*"):
+			i := strings.Index(query, "*/")
+			if i == -1 {
+				return ""
+			}
+			query = query[i+2:]
+		default:
+			end := strings.IndexFunc(query, func(c rune) bool {
+				return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+			})
+			if end == -1 {
+				end = len(query)
+			}
+			return strings.ToUpper(query[:end])
+		}
+	}
+}
+
+// Reads the metadata table of a database, if it has one.  Its rows are key/value pairs, with the keys "title",
+// "description", and "license", plus "column:<table>.<column>" for documenting columns.  Unknown keys are ignored.
+func ReadMetadataTable(sdb *sqlite.Conn) (meta DBMetadataTable) {
+	tables, err := sdb.Tables("")
+	if err != nil {
+		return
+	}
+	var metaTable string
+	for _, t := range tables {
+		if isMetadataTable(t) {
+			metaTable = t
+			break
+		}
+	}
+	if metaTable == "" {
+		return
+	}
+
+	stmt, err := sdb.Prepare(sqlite.Mprintf(`SELECT key, value FROM "%w"`, metaTable))
+	if err != nil {
+		log.Printf("Error when reading metadata table '%s': %s\n", metaTable, err)
+		return
+	}
+	defer stmt.Finalize()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		key, _ := s.ScanText(0)
+		val, _ := s.ScanText(1)
+		val = strings.TrimSpace(val)
+		if val == "" {
+			return nil
+		}
+		key = strings.TrimSpace(key)
+		switch strings.ToLower(key) {
+		case "description":
+			meta.Description = val
+		case "license", "licence":
+			meta.License = val
+		case "title":
+			meta.Title = val
+		default:
+			if !strings.HasPrefix(strings.ToLower(key), "column:") {
+				return nil
+			}
+			parts := strings.SplitN(key[len("column:"):], ".", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil
+			}
+			if meta.ColumnDocs == nil {
+				meta.ColumnDocs = make(map[string]map[string]string)
+			}
+			if meta.ColumnDocs[parts[0]] == nil {
+				meta.ColumnDocs[parts[0]] = make(map[string]string)
+			}
+			meta.ColumnDocs[parts[0]][parts[1]] = val
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error when reading metadata table '%s': %s\n", metaTable, err)
+	}
+	return
+}
+
 // Reads up to maxRows number of rows from a given SQLite database table.  If maxRows < 0 (eg -1), then read all rows.
-func ReadSQLiteDB(db *sqlite.Conn, dbTable string, maxRows int, sortCol string, sortDir string, rowOffset int) (SQLiteRecordSet, error) {
-	return ReadSQLiteDBCols(db, dbTable, false, false, maxRows, sortCol, sortDir, rowOffset)
+func ReadSQLiteDB(db *sqlite.Conn, dbTable string, maxRows int, sortCol string, sortType string, sortDir string, rowOffset int) (SQLiteRecordSet, error) {
+	return ReadSQLiteDBCols(db, dbTable, nil, false, false, false, maxRows, sortCol, sortType, sortDir, rowOffset)
 }
 
-// Reads up to maxRows # of rows from a SQLite database.  Only returns the requested columns.
-func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignoreNull bool, maxRows int,
-	sortCol string, sortDir string, rowOffset int) (SQLiteRecordSet, error) {
+// Like ReadSQLiteDB(), but the values keep their SQLite types instead of being formatted for display.  Numbers stay
+// numbers, NULLs are nil, and BLOBs are base64 encoded in a TypedBlob so they can't be mistaken for text.
+func ReadSQLiteDBTyped(db *sqlite.Conn, dbTable string, maxRows int, sortCol string, sortType string, sortDir string, rowOffset int) (SQLiteRecordSet, error) {
+	return ReadSQLiteDBCols(db, dbTable, nil, false, false, true, maxRows, sortCol, sortType, sortDir, rowOffset)
+}
+
+// Reads up to maxRows # of rows from a SQLite database.  Only returns the requested columns, or all of them if cols is
+// empty.  The sort type (SortDefault, SortDate, or SortNumeric) says how the sort column's values are compared.
+func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, cols []string, ignoreBinary bool, ignoreNull bool, typed bool,
+	maxRows int, sortCol string, sortType string, sortDir string, rowOffset int) (SQLiteRecordSet, error) {
 	// Ugh, have to use string smashing for this, even though the SQL spec doesn't seem to say table names
 	// shouldn't be parameterised.  Limitation from SQLite's implementation? :(
 	var dataRows SQLiteRecordSet
@@ -40,12 +281,26 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 	dataRows.Tablename = dbTable
 
 	// Construct the main SQL query
-	dbQuery := sqlite.Mprintf(`SELECT * FROM "%w"`, dbTable)
+	colList := "*"
+	if len(cols) > 0 {
+		var quoted []string
+		for _, c := range cols {
+			quoted = append(quoted, sqlite.Mprintf(`"%w"`, c))
+		}
+		colList = strings.Join(quoted, ", ")
+	}
+	dbQuery := `SELECT ` + colList + sqlite.Mprintf(` FROM "%w"`, dbTable)
 
-	// If a sort column was given, include it
+	// If a sort column was given, include it.  Values which can't be converted to the requested type sort as NULLs
 	if sortCol != "" {
-		dbQuery += ` ORDER BY "%w"`
-		dbQuery = sqlite.Mprintf(dbQuery, sortCol)
+		switch sortType {
+		case SortDate:
+			dbQuery += sqlite.Mprintf(` ORDER BY julianday("%w")`, sortCol)
+		case SortNumeric:
+			dbQuery += sqlite.Mprintf(` ORDER BY CAST("%w" AS REAL)`, sortCol)
+		default:
+			dbQuery += sqlite.Mprintf(` ORDER BY "%w"`, sortCol)
+		}
 	}
 
 	// If a sort direction was given, include it
@@ -76,6 +331,9 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 	// Retrieve the field names
 	dataRows.ColNames = stmt.ColumnNames()
 	dataRows.ColCount = len(dataRows.ColNames)
+	if len(cols) == 0 {
+		dataRows.TotalCols = dataRows.ColCount
+	}
 
 	// Process each row
 	fieldCount := -1
@@ -103,9 +361,12 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 					break
 				}
 				if !isNull {
-					stringVal := fmt.Sprintf("%d", val)
+					var v interface{} = fmt.Sprintf("%d", val)
+					if typed {
+						v = val
+					}
 					row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Integer,
-						Value: stringVal})
+						Value: v})
 				}
 			case sqlite.Float:
 				var val float64
@@ -115,9 +376,12 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 					break
 				}
 				if !isNull {
-					stringVal := strconv.FormatFloat(val, 'f', 4, 64)
+					var v interface{} = strconv.FormatFloat(val, 'f', 4, 64)
+					if typed {
+						v = val
+					}
 					row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Float,
-						Value: stringVal})
+						Value: v})
 				}
 			case sqlite.Text:
 				var val string
@@ -129,10 +393,18 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 			case sqlite.Blob:
 				// BLOBs can be ignored (via flag to this function) for situations like the vis data
 				if !ignoreBinary {
-					_, isNull = s.ScanBlob(i)
+					var val []byte
+					val, isNull = s.ScanBlob(i)
 					if !isNull {
+						var v interface{} = "<i>BINARY DATA</i>"
+						if wkt, ok := spatiaLiteWKT(val); ok {
+							v = wkt
+						}
+						if typed {
+							v = TypedBlob{Base64: base64.StdEncoding.EncodeToString(val)}
+						}
 						row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Binary,
-							Value: "<i>BINARY DATA</i>"})
+							Value: v})
 					}
 				} else {
 					addRow = false
@@ -142,8 +414,12 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 			}
 			if isNull && !ignoreNull {
 				// NULLS can be ignored (via flag to this function) for situations like the vis data
+				var v interface{} = "<i>NULL</i>"
+				if typed {
+					v = nil
+				}
 				row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Null,
-					Value: "<i>NULL</i>"})
+					Value: v})
 			}
 			if isNull && ignoreNull {
 				addRow = false
@@ -169,17 +445,19 @@ func ReadSQLiteDBCols(sdb *sqlite.Conn, dbTable string, ignoreBinary bool, ignor
 	}
 	dataRows.RowCount = tmpCount
 
-	// Fill out the sort column, direction, and row offset
+	// Fill out the sort column, type, direction, and row offset
 	dataRows.SortCol = sortCol
 	dataRows.SortDir = sortDir
+	dataRows.SortType = sortType
 	dataRows.Offset = rowOffset
 
 	return dataRows, nil
 }
 
 // This is a specialised variation of the ReadSQLiteDB() function, just for our CSV exporting code. It'll probably
-// need to be merged with the above function at some point.
-func ReadSQLiteDBCSV(sdb *sqlite.Conn, dbTable string) ([][]string, error) {
+// need to be merged with the above function at some point.  If a header row is wanted, the column names are returned
+// as the first row.
+func ReadSQLiteDBCSV(sdb *sqlite.Conn, dbTable string, header bool) ([][]string, error) {
 	// Retrieve all of the data from the selected database table
 	stmt, err := sdb.Prepare(`SELECT * FROM "` + dbTable + `"`)
 	if err != nil {
@@ -190,6 +468,9 @@ func ReadSQLiteDBCSV(sdb *sqlite.Conn, dbTable string) ([][]string, error) {
 	// Process each row
 	fieldCount := -1
 	var resultSet [][]string
+	if header {
+		resultSet = append(resultSet, stmt.ColumnNames())
+	}
 	err = stmt.Select(func(s *sqlite.Stmt) error {
 
 		// Get the number of fields in the result
@@ -259,6 +540,128 @@ func ReadSQLiteDBCSV(sdb *sqlite.Conn, dbTable string) ([][]string, error) {
 	return resultSet, nil
 }
 
+// Runs a user supplied query against a SQLite database, returning up to maxRows rows of the result.  Only SELECT
+// statements are accepted, and the query is interrupted if it runs for longer than QueryTimeout or the context is
+// cancelled.
+func RunSQLiteQuery(ctx context.Context, sdb *sqlite.Conn, query string, maxRows int) (SQLiteRecordSet, error) {
+	var dataRows SQLiteRecordSet
+
+	// SQLite considers statements such as ATTACH and PRAGMA to be read-only too, but they can reach outside of the
+	// database or change the connection, which is reused for other requests
+	switch queryKeyword(query) {
+	case "SELECT", "VALUES", "WITH":
+	default:
+		return dataRows, errors.New("Only read-only (SELECT) queries are allowed")
+	}
+
+	// Prepare the statement.  Anything after the first statement is rejected rather than silently ignored
+	stmt, err := sdb.Prepare(query)
+	if err != nil {
+		log.Printf("Error when preparing user query: %s\n", err)
+		return dataRows, fmt.Errorf("Error in query: %s", err)
+	}
+	defer stmt.Finalize()
+	if strings.TrimSpace(stmt.Tail()) != "" {
+		return dataRows, errors.New("Only a single SQL statement can be run at a time")
+	}
+
+	// Make sure the statement doesn't modify the database
+	if !stmt.ReadOnly() {
+		return dataRows, errors.New("Only read-only (SELECT) queries are allowed")
+	}
+
+	// Retrieve the field names
+	dataRows.ColNames = stmt.ColumnNames()
+	dataRows.ColCount = len(dataRows.ColNames)
+
+	// Interrupt the query if it takes too long.  The handle is returned to the pool afterwards, so wait for the
+	// watcher to finish before returning, to be sure it can't interrupt whatever runs on the handle next
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	var watcher sync.WaitGroup
+	watcher.Add(1)
+	go func() {
+		defer watcher.Done()
+		select {
+		case <-ctx.Done():
+			sdb.Interrupt()
+		case <-done:
+		}
+	}()
+	defer watcher.Wait()
+	defer close(done)
+
+	// Process each row
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		// Stop once the row limit has been reached
+		if maxRows >= 0 && dataRows.RowCount >= maxRows {
+			return errRowLimit
+		}
+
+		var row []DataValue
+		for i := 0; i < s.DataCount(); i++ {
+			isNull := false
+			switch s.ColumnType(i) {
+			case sqlite.Integer:
+				var val int
+				val, isNull, err = s.ScanInt(i)
+				if err != nil {
+					return err
+				}
+				if !isNull {
+					row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Integer,
+						Value: fmt.Sprintf("%d", val)})
+				}
+			case sqlite.Float:
+				var val float64
+				val, isNull, err = s.ScanDouble(i)
+				if err != nil {
+					return err
+				}
+				if !isNull {
+					row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Float,
+						Value: strconv.FormatFloat(val, 'f', 4, 64)})
+				}
+			case sqlite.Text:
+				var val string
+				val, isNull = s.ScanText(i)
+				if !isNull {
+					row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Text, Value: val})
+				}
+			case sqlite.Blob:
+				var val []byte
+				val, isNull = s.ScanBlob(i)
+				if !isNull {
+					var v interface{} = "<i>BINARY DATA</i>"
+					if wkt, ok := spatiaLiteWKT(val); ok {
+						v = wkt
+					}
+					row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Binary, Value: v})
+				}
+			case sqlite.Null:
+				isNull = true
+			}
+			if isNull {
+				row = append(row, DataValue{Name: dataRows.ColNames[i], Type: Null, Value: "<i>NULL</i>"})
+			}
+		}
+		dataRows.Records = append(dataRows.Records, row)
+		dataRows.RowCount++
+		return nil
+	})
+	if err != nil && err != errRowLimit {
+		if ctx.Err() == context.DeadlineExceeded {
+			return dataRows, fmt.Errorf("Query took longer than %v, so was stopped", QueryTimeout)
+		}
+		log.Printf("Error when running user query: %s\n", err)
+		return dataRows, fmt.Errorf("Error when running query: %s", err)
+	}
+	dataRows.TotalRows = dataRows.RowCount
+
+	return dataRows, nil
+}
+
 // Performs basic sanity checks of an uploaded database.
 func SanityCheck(fileName string) error {
 	// Perform a read on the database, as a basic sanity check to ensure it's really a SQLite database
@@ -297,3 +700,32 @@ func Tables(sdb *sqlite.Conn, dbName string) ([]string, error) {
 
 	return tables, nil
 }
+
+// Returns the columns of each table in a SQLite database, keyed by table name.
+func TableSchema(sdb *sqlite.Conn) (map[string][]ColumnJSON, error) {
+	tables, err := sdb.Tables("")
+	if err != nil {
+		log.Printf("Error retrieving table names: %s", err)
+		return nil, err
+	}
+	schema := make(map[string][]ColumnJSON)
+	for _, t := range tables {
+		cols, err := sdb.Columns("", t)
+		if err != nil {
+			log.Printf("Error retrieving columns for table '%s': %s", t, err)
+			return nil, err
+		}
+		list := []ColumnJSON{}
+		for _, c := range cols {
+			list = append(list, ColumnJSON{
+				Default:    c.DfltValue,
+				Name:       c.Name,
+				NotNull:    c.NotNull,
+				PrimaryKey: c.Pk,
+				Type:       c.DataType,
+			})
+		}
+		schema[t] = list
+	}
+	return schema, nil
+}
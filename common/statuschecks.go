@@ -0,0 +1,65 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// External systems (eg CI servers) can post the results of checks they run against database versions.  Owners can
+// pick which of those checks need to pass before merge requests can be accepted.
+
+// Returns what's still needed before the required status checks of a database have all passed for one of its
+// versions, or nothing if they have.  Checks which haven't been posted yet count as not having passed.
+func CheckRequiredStatuses(dbOwner string, dbFolder string, dbName string, commitID string) (missing []string,
+	err error) {
+	required, err := RequiredStatusChecks(dbOwner, dbFolder, dbName)
+	if err != nil || len(required) == 0 {
+		return nil, err
+	}
+	states := make(map[string]string)
+	if commitID != "" {
+		checks, err := StatusChecks(dbOwner, dbFolder, dbName, commitID)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range checks {
+			states[c.Context] = c.State
+		}
+	}
+	var waiting []string
+	for _, r := range required {
+		if states[r] != StatusSuccess {
+			waiting = append(waiting, r)
+		}
+	}
+	if len(waiting) > 0 {
+		missing = append(missing, fmt.Sprintf("These required status checks haven't passed yet: %s",
+			strings.Join(waiting, ", ")))
+	}
+	return missing, nil
+}
+
+// Returns the full ID of the database commit a status check is being posted for.  As with other places commits are
+// looked up, shortened IDs are accepted as long as they only match one commit.
+func StatusCheckCommit(loggedInUser string, dbOwner string, dbFolder string, dbName string, commit string) (string,
+	error) {
+	commits, err := DBCommits(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		return "", err
+	}
+	var commitID string
+	for _, c := range commits {
+		if c.CommitID == "" || !strings.HasPrefix(c.CommitID, commit) {
+			continue
+		}
+		if commitID != "" {
+			return "", fmt.Errorf("More than one commit starts with '%s'", commit)
+		}
+		commitID = c.CommitID
+	}
+	if commitID == "" {
+		return "", errors.New("That commit doesn't exist")
+	}
+	return commitID, nil
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// OpenTelemetry trace provider.  Nil when tracing isn't configured
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// Turns the queries pgx reports through its logging interface into spans.  pgx only reports a query once it's finished,
+// so the spans are backdated to the query's start.  pgx doesn't know which request a query was run for either, so
+// queries which should be children of a request span carry its trace context in a comment, added by TraceSQL().
+// Queries without one get spans of their own.
+type pgTracer struct{}
+
+func (pgTracer) Log(level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if tracerProvider == nil || (msg != "Query" && msg != "Exec") {
+		return
+	}
+	end := time.Now()
+	start := end
+	if d, ok := data["time"].(time.Duration); ok {
+		start = end.Add(-d)
+	}
+	stmt, _ := data["sql"].(string)
+	ctx := context.Background()
+	if i := strings.LastIndex(stmt, "/*traceparent='"); i != -1 {
+		carrier := propagation.MapCarrier{"traceparent": strings.TrimSuffix(stmt[i+15:], "'*/")}
+		ctx = propagation.TraceContext{}.Extract(ctx, carrier)
+		stmt = strings.TrimSpace(stmt[:i])
+	}
+	_, span := otel.Tracer("github.com/sqlitebrowser/dbhub.io").Start(ctx, "PostgreSQL "+msg,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBStatementKey.String(stmt)))
+	if err, ok := data["err"].(error); ok {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// Records the status code of a response, so it can be added to the request span
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Sets up OpenTelemetry tracing, exporting spans to the OTLP endpoint given in the config file.  If no endpoint is
+// configured tracing is left disabled, and spans are discarded.
+func ConnectTracing(serviceName string) error {
+	if conf.Tracing.Endpoint == "" {
+		return nil
+	}
+
+	// Create the OTLP exporter
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Tracing.Endpoint)}
+	if conf.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("Couldn't create OTLP trace exporter: %v\n", err)
+	}
+
+	// Register it as the global trace provider
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{},
+		propagation.Baggage{}))
+
+	log.Printf("Sending traces to OTLP endpoint: %v\n", conf.Tracing.Endpoint)
+	return nil
+}
+
+// Flushes any outstanding spans, and shuts down tracing.
+func DisconnectTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	err := tracerProvider.Shutdown(context.Background())
+	if err != nil {
+		log.Printf("Error when shutting down tracing: %v\n", err)
+	}
+}
+
+// Starts a new span as a child of any span in the given context.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer("github.com/sqlitebrowser/dbhub.io").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Adds the trace context of any span in the given context to an SQL query, in the sqlcommenter format, so the span
+// for the query is made a child of it.  The trace ID also ends up in the PostgreSQL logs, for slow queries.
+func TraceSQL(ctx context.Context, dbQuery string) string {
+	if tracerProvider == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return dbQuery
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return dbQuery + " /*traceparent='" + carrier["traceparent"] + "'*/"
+}
+
+// Wraps a request multiplexer so each request gets its own span, named after the matching URL pattern.  Trace
+// context sent by the client is honoured, and the span is available to handlers through the request context.
+func TraceHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer("github.com/sqlitebrowser/dbhub.io").Start(ctx, r.Method+" "+pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPTargetKey.String(r.URL.Path)))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -57,32 +58,377 @@ const (
 	Float
 )
 
+// Kinds of entries in the activity feeds
+const (
+	FeedFork    = "fork"
+	FeedRename  = "rename"
+	FeedStar    = "star"
+	FeedVersion = "version"
+)
+
+// Number of entries to show in each page of an activity feed
+const FeedLength = 25
+
+// Number of table data requests an anonymous client can make in each rate limiting window before being slowed down
+const AnonBrowseAllowance = 60
+
+// Each table data request over the allowance is delayed this much more than the previous one, up to the maximum
+const (
+	AnonBrowseDelayStep = 250 * time.Millisecond
+	AnonBrowseMaxDelay  = 10 * time.Second
+)
+
+// Length (in seconds) of the rate limiting window for anonymous table browsing
+const AnonBrowseWindow = 60
+
+// Number of versions compared when working out which version last changed each row of a table.  Rows which haven't
+// changed within that many versions are credited to the oldest one compared
+const BlameMaxVersions = 50
+
+// Prepared archives of a user's public databases can be downloaded for this many seconds.  Archives are stored in
+// the requester's Minio bucket, where the orphaned object collection removes them some time later
+const BulkArchiveLifetime = 86400
+
+// Size limits (of the uncompressed databases) for downloading all of a user's public databases at once.  Archives up
+// to the streaming size are sent straight away, while bigger ones are prepared in the background
+const (
+	BulkDownloadMaxSize    = 4 * 1024 * 1024 * 1024
+	BulkDownloadStreamSize = 100 * 1024 * 1024
+)
+
+// Number of times an anonymous client or user can download all of a user's public databases each hour
+const BulkDownloadsPerHour = 5
+
 // Store cached data in memcache for 30 days days (as a first guess, which will probably need tuning)
 const CacheTime = 2592000
 
-// Number of rows to display by default on the database page
+// Announcement banner levels.  These match the Bootstrap alert styles used to display them
+const (
+	AnnouncementInfo    = "info"
+	AnnouncementWarning = "warning"
+	AnnouncementDanger  = "danger"
+)
+
+// Signed CDN download links are valid for this long
+const CDNLinkLifetime = 24 * time.Hour
+
+// Cached CSV downloads are removed once they're this old
+const CSVCacheLifetime = 30 * 24 * time.Hour
+
+// The branch database versions are on unless they were uploaded to another one.  Database pages show the latest
+// version on this branch by default
+const DefaultBranch = "main"
+
+// Default size cap (in MB) for the local cache of SQLite database files
+const DefaultDBFileCacheSize = 2048
+
+// Default number of days deleted database versions can be restored for, before they're purged
+const DefaultDeletedVersionDays = 30
+
+// Feature flags which can be switched on and off for the instance, or for a cohort of users
+const (
+	FeatureLiveDBs  = "live_dbs"
+	FeatureQueryAPI = "query_api"
+	FeatureWebhooks = "webhooks"
+)
+
+// Admin overrides of the feature flags are cached for this many seconds.  Changing them clears the cache straight away
+// for the server making the change, while others pick it up once it expires
+const FeatureFlagCacheTime = 60
+
+// Front page database lists are cached for this many seconds, so they don't need querying on every page load.  Changes
+// to databases invalidate them sooner
+const FrontPageCacheTime = 3600
+
+// Number of databases shown in each of the front page lists
+const FrontPageListLength = 10
+
+// The public usage statistics are cached for this many seconds
+const InstanceStatsCacheTime = 3600
+
+// Tabs on the database page which visitors can land on
+const (
+	LandingData   = "data"
+	LandingReadme = "readme"
+)
+
+// Kinds of notification shown in a user's notification inbox
+const (
+	NotifyAdmin        = "admin"
+	NotifyArchive      = "archive"
+	NotifyMention      = "mention"
+	NotifyMergeRequest = "merge_request"
+	NotifySecurity     = "security"
+	NotifyWatch        = "watch"
+)
+
+// Ways notifications can be delivered.  Users choose which channels to use for each kind of notification
+const (
+	ChannelEmail   = "email"
+	ChannelWeb     = "web"
+	ChannelWebhook = "webhook"
+)
+
+// Roles members can have in an organisation.  Members can see and upload to the organisation's databases, admins can
+// also change their settings, and owners can also delete them and manage who's in the organisation
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+	OrgRoleOwner  = "owner"
+)
+
+// Kinds of validation rule a database can have.  SQL rules are a query returning the rows which break the rule, which
+// is how referential checks are written
+const (
+	RuleNotNull = "not_null"
+	RuleRange   = "range"
+	RuleSQL     = "sql"
+)
+
+// States a merge request can be in
+const (
+	MergeRequestClosed = "closed"
+	MergeRequestMerged = "merged"
+	MergeRequestOpen   = "open"
+)
+
+// Kinds of event shown in the timeline of a merge request
+const (
+	MergeEventApproved = "approved"
+	MergeEventClosed   = "closed"
+	MergeEventMerged   = "merged"
+	MergeEventOpened   = "opened"
+)
+
+// States a status check posted against a database version can be in
+const (
+	StatusFailure = "failure"
+	StatusPending = "pending"
+	StatusSuccess = "success"
+)
+
+// How often users want an email digest of new versions of the databases they've starred
+const (
+	DigestDaily  = "daily"
+	DigestNone   = "none"
+	DigestWeekly = "weekly"
+)
+
+// How often the admin server checks for email digests which are due
+const DigestInterval = time.Hour
+
+// Number of notifications returned for the notification inbox
+const NotificationListLength = 50
+
+// Number of rows to display by default on the database page, unless the instance configures something else
 const DefaultNumDisplayRows = 25
 
+// Largest number of rows users can choose to display in their preferences, unless the instance configures something
+// else
+const DefaultMaxDisplayRows = 500
+
+// How often the admin server looks for orphaned Minio objects to remove
+const MinioGCInterval = 24 * time.Hour
+
+// Minio objects younger than this are never considered orphaned, as their upload may still be in progress
+const MinioGCSafetyWindow = 48 * time.Hour
+
+// OAuth authorisation codes need to be exchanged for an access token within this time
+const OAuthCodeLifetime = 10 * time.Minute
+
+// Lifetime of the OpenID Connect ID tokens given to third party applications along with their access token
+const OAuthIDTokenLifetime = time.Hour
+
+// Lifetime of OAuth access tokens issued to third party applications
+const OAuthTokenLifetime = 30 * 24 * time.Hour
+
+// Personal API tokens start with this, so they can be told apart from OAuth access tokens
+const APITokenPrefix = "dbh_"
+
+// External login providers, which DBHub.io accounts are linked to
+const (
+	LoginAuth0  = "auth0"
+	LoginGitHub = "github"
+	LoginGitLab = "gitlab"
+	LoginGoogle = "google"
+)
+
+// Users are warned when a client certificate or access token which hasn't been used for this long is used again
+const CredentialDormantTime = 14 * 24 * time.Hour
+
+// User supplied SQL queries are interrupted if they take longer than this
+const QueryTimeout = 10 * time.Second
+
+// CSV rows appended to a live database are added in transactions of this many rows
+const LiveCSVBatchSize = 1000
+
+// Largest amount of CSV data which can be appended to a live database in one request
+const LiveCSVMaxSize = 64 * 1024 * 1024
+
+// Largest database file which an import webhook will download from a URL
+const ImportURLMaxSize = 2 * 1024 * 1024 * 1024
+
+// Largest database file which will be downloaded when forking a database from another DBHub instance
+const RemoteDBMaxSize = 2 * 1024 * 1024 * 1024
+
+// Number of statements shown on each page of a live database's audit log
+const LiveAuditPageSize = 100
+
+// How the values of a column are compared when sorting table data
+const (
+	SortDefault = ""        // SQLite's normal ordering, which puts numbers stored as text after real numbers
+	SortDate    = "date"    // Dates and times in any format SQLite's date functions understand, such as ISO 8601
+	SortNumeric = "numeric" // Numbers, including numbers stored as text
+)
+
+// Scopes third party applications can request access to through OAuth
+const (
+	OAuthScopeOpenID  = "openid"  // An OpenID Connect ID token saying who the user is
+	OAuthScopeProfile = "profile" // The user name and email address of the user
+	OAuthScopeRead    = "read"    // Downloading and querying the databases the user can access, including private ones
+	OAuthScopeWrite   = "write"   // Changing the live databases the user has write access to
+)
+
 // Number of connections to PostgreSQL to use
 const PGConnections = 5
 
+// Maximum size (in bytes) of query results to store in memcache.  Memcached rejects items over 1MB by default
+const QueryCacheMaxSize = 512 * 1024
+
+// Number of entries to display on the query history page
+const QueryHistoryLength = 100
+
+// Share links for private databases can be valid for at most this many days
+const ShareLinkMaxDays = 365
+
+// Maximum number of idle read-only handles kept open for each cached SQLite database file
+const SQLiteIdleHandles = 4
+
+// Related database lists are cached for this many seconds.  They're also refreshed when the database itself changes
+const RelatedDBsCacheTime = 3600
+
+// Number of databases shown in the "similar databases" list
+const RelatedDBsLength = 5
+
+// The most approvals a database's review policy can require before a merge request is accepted
+const ReviewMaxApprovals = 10
+
+// How much being in the same fork tree counts towards two databases being related, compared to each user who has
+// starred both of them
+const RelatedForkScore = 3
+
+// Takedown request states.  Databases are hidden while a request is accepted or countered
+const (
+	TakedownPending   = "pending"
+	TakedownAccepted  = "accepted"
+	TakedownRejected  = "rejected"
+	TakedownCountered = "countered"
+	TakedownRestored  = "restored"
+)
+
+// Upload job states, as reported by the upload status API
+const (
+	UploadQueued    = "queued"
+	UploadChecking  = "checking"
+	UploadStoring   = "storing"
+	UploadComplete  = "complete"
+	UploadFailed    = "failed"
+	UploadUnchanged = "unchanged"
+	UploadUnknown   = "unknown" // Only reported, when the heartbeat of an unfinished job is missing
+)
+
+// Sessions expire after being unused for this long
+const SessionTimeout = 30 * time.Minute
+
+// Once a user has accepted the terms of service, their session skips checking again for this long.  Newly published
+// terms are picked up after it has passed
+const TermsCheckInterval = 10 * time.Minute
+
+// Access levels an owner can give other users to one of their databases
+const (
+	ShareRead      = "r"  // Viewing, querying, and downloading the database, even if it's private
+	ShareReadWrite = "rw" // Uploading new versions of the database as well
+)
+
+// The database events owners can send to webhooks
+const (
+	WebhookFork   = "fork"   // The database was forked
+	WebhookRename = "rename" // The database was renamed
+	WebhookStar   = "star"   // The database was starred or unstarred
+	WebhookUpload = "upload" // A new version of the database was uploaded
+)
+
+// The states of a webhook delivery
+const (
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryPending   = "pending"
+)
+
+// How often the admin server counts the rows changed by new database versions, for the contributor statistics
+const RowStatsInterval = 10 * time.Minute
+
+// How often the admin server sends the webhook deliveries which are due
+const WebhookInterval = 30 * time.Second
+
+// Webhook deliveries are tried this many times before being given up on
+const WebhookMaxAttempts = 8
+
+// Webhook deliveries are kept for the delivery log for this many days
+const WebhookLogDays = 30
+
+// Keep the status of upload jobs in memcache for a day
+const UploadStatusCacheTime = 86400
+
+// The server processing an upload job refreshes its heartbeat every UploadHeartbeatInterval seconds, and the heartbeat
+// expires from Memcached after UploadHeartbeatTimeout seconds.  As Memcached can also evict it early, a missing
+// heartbeat only means the job is failed once it was started more than UploadJobDeadline seconds ago
+const (
+	UploadHeartbeatInterval = 30
+	UploadHeartbeatTimeout  = 120
+	UploadJobDeadline       = 3600
+)
+
+// How often (in bytes received) the progress of a web form upload is recorded in Memcached
+const UploadProgressInterval = 1024 * 1024
+
+// User page details are cached for this many seconds.  Changes to the user's databases or followers invalidate them
+// sooner
+const UserPageCacheTime = 3600
+
+// The most database files which can be sent in a single web form upload
+const UploadMaxFiles = 20
+
+// Rows breaking a validation rule are counted up to this many
+const ValidationMaxViolations = 100
+
 // ************************
 // Configuration file types
 
 // Configuration file
 type TomlConfig struct {
-	Admin AdminInfo
-	Auth0 Auth0Info
-	Cache CacheInfo
-	DB4S  DB4SInfo
-	Minio MinioInfo
-	Pg    PGInfo
-	Sign  SigningInfo
-	Web   WebInfo
+	Admin          AdminInfo
+	Auth0          Auth0Info
+	Cache          CacheInfo
+	DB4S           DB4SInfo
+	Email          EmailInfo
+	ErrorReporting ErrorReportingInfo `toml:"error_reporting"`
+	Features       FeaturesInfo
+	Live           LiveInfo
+	Login          LoginInfo
+	Minio          MinioInfo
+	Mirror         MirrorInfo
+	Pg             PGInfo
+	Replication    ReplicationInfo
+	Scanner        ScannerInfo
+	Sign           SigningInfo
+	Tracing        TracingInfo
+	Web            WebInfo
 }
 
 // Config info for the admin server
 type AdminInfo struct {
+	APIKey         string `toml:"api_key"`
 	Certificate    string
 	CertificateKey string `toml:"certificate_key"`
 	HTTPS          bool
@@ -96,9 +442,11 @@ type Auth0Info struct {
 	Domain       string
 }
 
-// Memcached connection parameters
+// Memcached connection parameters, and the local cache of SQLite database files
 type CacheInfo struct {
-	Server string
+	DBFileDir  string `toml:"db_file_dir"`
+	DBFileSize int    `toml:"db_file_size"` // In MB
+	Server     string
 }
 
 // Configuration info for the DB4S end point
@@ -110,12 +458,35 @@ type DB4SInfo struct {
 	Server         string
 }
 
+// Outgoing mail server.  The server is given as host:port, and the username and password are only needed if it
+// requires authentication
+type EmailInfo struct {
+	From     string
+	Password string
+	Server   string
+	Username string
+}
+
+// Error reporting service.  Reports are sent as JSON to the given URL
+type ErrorReportingInfo struct {
+	URL string
+}
+
+// Feature flags to turn on or off for the whole instance, changing their built in defaults.  Admin overrides take
+// priority over these
+type FeaturesInfo struct {
+	Beta     []string
+	Disabled []string
+	Enabled  []string
+}
+
 // Minio connection parameters
 type MinioInfo struct {
-	AccessKey string `toml:"access_key"`
-	HTTPS     bool
-	Secret    string
-	Server    string
+	AccessKey      string `toml:"access_key"`
+	CSVCacheBucket string `toml:"csv_cache_bucket"`
+	HTTPS          bool
+	Secret         string
+	Server         string
 }
 
 // PostgreSQL connection parameters
@@ -123,33 +494,223 @@ type PGInfo struct {
 	Database string
 	Port     int
 	Password string
+	Replicas []PGReplicaInfo
 	Server   string
 	Username string
 }
 
-// Used for signing DB4S client certificates
+// PostgreSQL read replica connection parameters
+type PGReplicaInfo struct {
+	Port   int
+	Server string
+}
+
+// Used for signing DB4S client certificates.  Users can choose how long their certificates are valid for, up to
+// MaxCertDays
 type SigningInfo struct {
+	DefaultCertDays  int    `toml:"default_cert_days"`
 	IntermediateCert string `toml:"intermediate_cert"`
 	IntermediateKey  string `toml:"intermediate_key"`
+	MaxCertDays      int    `toml:"max_cert_days"`
+}
+
+// Live databases.  Their files are kept in the data directory, and changes made to them are stored as new versions
+// every snapshot interval seconds
+type LiveInfo struct {
+	DataDir          string `toml:"data_dir"`
+	SnapshotInterval int    `toml:"snapshot_interval"`
+}
+
+// Logging in directly through GitHub, GitLab, or Google, beside (or instead of) Auth0.  Each provider is turned on by
+// giving its OAuth client ID and secret.  GitLabURL is only needed for self-hosted GitLab servers
+type LoginInfo struct {
+	GitHubClientID     string `toml:"github_client_id"`
+	GitHubClientSecret string `toml:"github_client_secret"`
+	GitLabClientID     string `toml:"gitlab_client_id"`
+	GitLabClientSecret string `toml:"gitlab_client_secret"`
+	GitLabURL          string `toml:"gitlab_url"`
+	GoogleClientID     string `toml:"google_client_id"`
+	GoogleClientSecret string `toml:"google_client_secret"`
+}
+
+// Read-only mirror mode.  When a source instance is given, public databases are copied from it on a schedule (every
+// interval seconds), and logins and uploads are turned off
+type MirrorInfo struct {
+	Interval int
+	Source   string
+}
+
+// Hot standby replication.  When a source admin server is given, new database versions are copied from it every
+// interval seconds, using its replication API
+type ReplicationInfo struct {
+	APIKey   string `toml:"api_key"`
+	Interval int
+	Source   string
+}
+
+// Virus scanner used on uploaded databases.  The command is run with the path of the file to check appended, and
+// should exit with 0 for clean files and 1 for infected ones (as clamscan and clamdscan do)
+type ScannerInfo struct {
+	Command string
+}
+
+// OpenTelemetry trace exporter parameters
+type TracingInfo struct {
+	Endpoint string
+	Insecure bool
 }
 
 type WebInfo struct {
-	BindAddress    string `toml:"bind_address"`
-	Certificate    string
-	CertificateKey string `toml:"certificate_key"`
-	RequestLog     string `toml:"request_log"`
-	ServerName     string `toml:"server_name"`
+	BaseDir            string `toml:"base_dir"`
+	BindAddress        string `toml:"bind_address"`
+	CDNBaseURL         string `toml:"cdn_base_url"`
+	CDNSigningKey      string `toml:"cdn_signing_key"`
+	CertLoginPort      int    `toml:"cert_login_port"`
+	Certificate        string
+	CertificateKey     string   `toml:"certificate_key"`
+	DeletedVersionDays int      `toml:"deleted_version_days"`
+	DisplayRows        int      `toml:"display_rows"`
+	EmbedAncestors     []string `toml:"embed_ancestors"`
+	EmbedPaths         []string `toml:"embed_paths"`
+	Featured           []string
+	MaxAPIRows         int    `toml:"max_api_rows"`
+	MaxDisplayRows     int    `toml:"max_display_rows"`
+	OIDCKey            string `toml:"oidc_key"`
+	RequestLog         string `toml:"request_log"`
+	ServerName         string `toml:"server_name"`
+	SpatiaLite         string `toml:"spatialite_extension"`
 }
 
 // End of configuration file types
 // *******************************
 
+type Announcement struct {
+	Ends    time.Time
+	ID      int64
+	Level   string
+	Message string
+	Starts  time.Time
+}
+
+// A personal API token.  The token itself is only shown when it's created, as just its hash is stored
+type APIToken struct {
+	DateCreated time.Time
+	Expiry      *time.Time
+	ID          int64
+	LastUse     CredentialUse
+	Name        string
+	Scope       string
+}
+
+// A file attached to a database README
+type Attachment struct {
+	ContentType string
+	DateCreated time.Time
+	DBName      string
+	FileName    string
+	Folder      string
+	ID          string
+	MinioBkt    string
+	MinioID     string
+	Owner       string
+	Public      bool
+	Size        int64
+	Uploader    string
+}
+
+type ArchiveJob struct {
+	Bucket    string
+	Created   time.Time
+	ID        string
+	MinioID   string
+	Owner     string
+	Requester string
+}
+
 type Auth0Set struct {
 	CallbackURL string
 	ClientID    string
 	Domain      string
 }
 
+// The affinity of a table column, along with the format its values are in (one of the ColFormat constants) if that
+// could be detected
+// A DB4S client certificate issued to a user.  The certificate itself isn't included, just the details needed to
+// manage it
+// The version which last inserted or updated a row of a table, along with the row's key
+type BlameRow struct {
+	Author      string        `json:"author"`
+	CommitID    string        `json:"commit_id,omitempty"`
+	DateChanged time.Time     `json:"date_changed"`
+	Key         []interface{} `json:"key"`
+	Version     int           `json:"version"`
+}
+
+// The latest version on a branch of a database
+type BranchHead struct {
+	Branch     string
+	CommitID   string
+	MinioID    string
+	SHA256     string
+	Size       int
+	StoredSize int
+	Version    int
+}
+
+type ClientCertificate struct {
+	DateCreated time.Time
+	Expired     bool
+	Expiry      time.Time
+	ID          int64
+	LastUse     CredentialUse
+	Name        string
+	Revoked     *time.Time
+	Serial      string
+}
+
+type ColumnFormat struct {
+	Affinity string `json:"affinity"`
+	Format   string `json:"format,omitempty"`
+	Name     string `json:"name"`
+}
+
+// A table column, as returned by the API.  The primary key value is the column's position in the primary key, or 0
+// if it isn't part of it
+type ColumnJSON struct {
+	Default    string `json:"default,omitempty"`
+	Name       string `json:"name"`
+	NotNull    bool   `json:"not_null"`
+	PrimaryKey int    `json:"primary_key"`
+	Type       string `json:"type"`
+}
+
+type CommitJSON struct {
+	Author      string    `json:"author"`
+	CommitID    string    `json:"commit_id"`
+	DateCreated time.Time `json:"date_created"`
+	Message     string    `json:"message"`
+	Parent      string    `json:"parent,omitempty"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	Version     int       `json:"version"`
+}
+
+type ConsistencyProblem struct {
+	DB       StoredDBVersion
+	Problem  string
+	Repaired bool
+}
+
+// How much one user has contributed to a database.  The rows changed only include versions the admin server has
+// compared against their parent so far
+type ContributorStats struct {
+	FirstContribution time.Time `json:"first_contribution"`
+	LastContribution  time.Time `json:"last_contribution"`
+	RowsChanged       int64     `json:"rows_changed"`
+	UserName          string    `json:"username"`
+	Versions          int       `json:"versions"`
+}
+
 type DataValue struct {
 	Name  string
 	Type  ValType
@@ -157,6 +718,11 @@ type DataValue struct {
 }
 type DataRow []DataValue
 
+// A BLOB value in typed table output.  The base64 key marks the value as binary data rather than text
+type TypedBlob struct {
+	Base64 string `json:"base64"`
+}
+
 type DBEntry struct {
 	Folder    string
 	DateEntry time.Time
@@ -164,7 +730,69 @@ type DBEntry struct {
 	Owner     string
 }
 
+// The differences between two versions of a database
+type DBDiff struct {
+	Schema []DBDiffSchema `json:"schema"`
+	Tables []DBDiffTable  `json:"tables"`
+}
+
+// A changed row.  The old and new values are in the order of the table's columns, and are left out for inserted and
+// deleted rows respectively
+type DBDiffRow struct {
+	Action string        `json:"action"`
+	New    []interface{} `json:"new,omitempty"`
+	Old    []interface{} `json:"old,omitempty"`
+}
+
+type DBDiffSchema struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	NewSQL string `json:"new_sql,omitempty"`
+	OldSQL string `json:"old_sql,omitempty"`
+	Type   string `json:"type"`
+}
+
+// The row changes for a table.  The counts cover all of the changes, while the rows only include the requested page of
+// them
+type DBDiffTable struct {
+	Action  string      `json:"action"`
+	Columns []string    `json:"columns"`
+	Deletes int         `json:"deletes"`
+	Inserts int         `json:"inserts"`
+	Name    string      `json:"name"`
+	Offset  int         `json:"offset"`
+	Rows    []DBDiffRow `json:"rows"`
+	Updates int         `json:"updates"`
+}
+
+// Table and index statistics for a database.  Tables created internally by virtual table modules (such as R-Tree and
+// FTS) are counted towards the index they belong to rather than listed as tables, so their row counts don't inflate the
+// totals.  Sizes are only known when SQLite was built with the dbstat virtual table
+type DBHealth struct {
+	Indexes        []DBHealthIndex `json:"indexes"`
+	SizesAvailable bool            `json:"sizes_available"`
+	Tables         []DBHealthTable `json:"tables"`
+	TotalIndexSize int64           `json:"total_index_size"`
+	TotalRows      int64           `json:"total_rows"`
+	TotalTableSize int64           `json:"total_table_size"`
+}
+
+type DBHealthIndex struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Table string `json:"table,omitempty"`
+}
+
+type DBHealthTable struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+	Size int64  `json:"size"`
+}
+
 type DBInfo struct {
+	Archived     bool
+	Branch       string
 	Branches     int
 	Contributors int
 	Database     string
@@ -174,21 +802,169 @@ type DBInfo struct {
 	Discussions  int
 	Folder       string
 	Forks        int
+	LandingTab   string
 	LastModified time.Time
 	License      LicenseType
+	LicenseName  string
+	Live         bool
 	MRs          int
+	NoIndex      bool
 	Public       bool
 	Readme       string
 	Releases     int
+	RemoteOrigin string
 	SHA256       string
 	Size         int
 	Stars        int
 	Tables       []string
+	Title        string
 	Updates      int
 	Version      int
 	Watchers     int
 }
 
+// Where and when a client certificate or access token was last used
+type CredentialUse struct {
+	Endpoint string
+	IP       string
+	LastUsed time.Time
+}
+
+// Metadata read from the dbhub_metadata table of an uploaded database.  Column docs are keyed by table then column
+type DBMetadataTable struct {
+	ColumnDocs  map[string]map[string]string
+	Description string
+	License     string
+	Title       string
+}
+
+// A database in a user's database list, as returned by the API
+type DBListJSON struct {
+	Description  string    `json:"description"`
+	Folder       string    `json:"folder"`
+	Forks        int       `json:"forks"`
+	LastModified time.Time `json:"last_modified"`
+	Name         string    `json:"name"`
+	Public       bool      `json:"public"`
+	SHA256       string    `json:"sha256"`
+	Size         int       `json:"size"`
+	Stars        int       `json:"stars"`
+	Version      int       `json:"version"`
+	Watchers     int       `json:"watchers"`
+}
+
+// The details of a database returned when its page is requested as JSON
+type DBPageJSON struct {
+	ColumnDocs   map[string]map[string]string `json:"column_docs,omitempty"`
+	DateCreated  time.Time                    `json:"date_created"`
+	DefaultTable string                       `json:"default_table"`
+	Description  string                       `json:"description"`
+	DownloadURL  string                       `json:"download_url"`
+	Folder       string                       `json:"folder"`
+	ForkedFrom   string                       `json:"forked_from,omitempty"`
+	Forks        int                          `json:"forks"`
+	LastModified time.Time                    `json:"last_modified"`
+	License      string                       `json:"license"`
+	Name         string                       `json:"name"`
+	Owner        string                       `json:"owner"`
+	Public       bool                         `json:"public"`
+	Readme       string                       `json:"readme"`
+	SHA256       string                       `json:"sha256"`
+	Size         int                          `json:"size"`
+	Stars        int                          `json:"stars"`
+	Tables       []string                     `json:"tables"`
+	Title        string                       `json:"title,omitempty"`
+	Version      int                          `json:"version"`
+	Versions     []int                        `json:"versions"`
+	Watchers     int                          `json:"watchers"`
+}
+
+// A version of a database, as returned by the API
+type DBVersionJSON struct {
+	Branch      string    `json:"branch"`
+	DateCreated time.Time `json:"date_created"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	Version     int       `json:"version"`
+}
+
+// A user a database has been shared with
+type DBShare struct {
+	Access      string    `json:"access"`
+	DateCreated time.Time `json:"date_created"`
+	UserName    string    `json:"username"`
+}
+
+type DBSummary struct {
+	DBName       string
+	Description  string
+	LastModified time.Time
+	Owner        string
+	Stars        int
+}
+
+type DBWebhook struct {
+	DateCreated time.Time
+	Events      []string
+	ID          int64
+	Secret      string
+	URL         string
+}
+
+// The error envelope returned to clients which expect JSON
+type ErrorResponse struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type ErrorReport struct {
+	DBName    string    `json:"db_name,omitempty"`
+	DBOwner   string    `json:"db_owner,omitempty"`
+	Message   string    `json:"message"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Server    string    `json:"server"`
+	Service   string    `json:"service"`
+	Stack     string    `json:"stack,omitempty"`
+	Status    int       `json:"status"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+}
+
+// The state of a feature flag.  Default is what the code and configuration file give, which applies unless an admin
+// has overridden it.  An override turns the feature on for everyone, or just for a percentage of users (picked by
+// hashing their user name) plus any named users
+type FeatureFlag struct {
+	Beta           bool
+	Default        bool
+	DateUpdated    time.Time
+	Enabled        bool
+	Name           string
+	Overridden     bool
+	RolloutPercent int
+	Users          []string
+}
+
+type FeedEntry struct {
+	Action   string
+	Date     time.Time
+	DBFolder string
+	DBName   string
+	DBOwner  string
+	Detail   string
+	ID       int64
+	User     string
+	Version  int
+}
+
+type Follow struct {
+	DateFollowed time.Time
+	Username     string
+}
+
 type ForkEntry struct {
 	DBName     string
 	Folder     string
@@ -200,18 +976,195 @@ type ForkEntry struct {
 	Public     bool
 }
 
+// A GeoJSON feature collection (RFC 7946)
+type GeoJSON struct {
+	Features []GeoJSONFeature `json:"features"`
+	Type     string           `json:"type"`
+}
+
+type GeoJSONFeature struct {
+	Geometry   *GeoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+	Type       string                 `json:"type"`
+}
+
+type GeoJSONGeometry struct {
+	Coordinates interface{} `json:"coordinates"`
+	Type        string      `json:"type"`
+}
+
+// An inbound webhook, which imports a new version of a database when a file or URL is posted to it.  The token is
+// the public part of its address, and the secret needs to be sent along with each request
+type ImportHook struct {
+	Branch      string
+	CreatedBy   string
+	DateCreated time.Time
+	DBName      string
+	Folder      string
+	ID          int64
+	LastStatus  string
+	LastUsed    *time.Time
+	Owner       string
+	Secret      string
+	Token       string
+}
+
+type InstanceMetadata struct {
+	Exported time.Time
+	Server   string
+	Tables   map[string]json.RawMessage
+}
+
+type InstanceStats struct {
+	DownloadsThisMonth int64     `json:"downloads_this_month"`
+	Generated          time.Time `json:"generated"`
+	PublicDatabases    int64     `json:"public_databases"`
+	Users              int64     `json:"users"`
+}
+
+// A live database, which is changed in place rather than by uploading new versions
+type LiveDB struct {
+	DBName string
+	Folder string
+	ID     int64
+	Owner  string
+}
+
+// A write statement run against a live database, as recorded in its audit log
+type LiveStatement struct {
+	DateExecuted time.Time
+	ID           int64
+	RowsAffected int64
+	Statement    string
+	UserName     string
+}
+
+// An account with an external login provider.  EmailVerified is false when the provider says the email address
+// hasn't been confirmed yet
+type LoginIdentity struct {
+	DateLinked    time.Time
+	Email         string
+	EmailVerified bool
+	Nickname      string
+	Provider      string
+	ProviderID    string
+}
+
+// A request to merge the changes on one branch of a database into another.  Merging adds the latest version on the
+// source branch as a new version on the target branch
+type MergeRequest struct {
+	ClosedBy      string
+	CreatedBy     string
+	DateClosed    time.Time
+	DateCreated   time.Time
+	Description   string
+	ID            int64
+	MergedVersion int
+	SourceBranch  string
+	State         string
+	TargetBranch  string
+	Title         string
+}
+
+// Something which happened to a merge request, for showing in its timeline
+type MergeRequestEvent struct {
+	Date     time.Time
+	Kind     string
+	UserName string
+}
+
 type MetaInfo struct {
 	Database     string
+	FeedURL      string
 	ForkDatabase string
 	ForkFolder   string
+	Folder       string
 	ForkOwner    string
 	LoggedInUser string
+	NoIndex      bool
 	Owner        string
 	Protocol     string
 	Server       string
 	Title        string
 }
 
+type MinioObject struct {
+	Bucket       string
+	ID           string
+	LastModified time.Time
+	Size         int64
+}
+
+type Notification struct {
+	DateCreated time.Time `json:"date_created"`
+	ID          int64     `json:"id"`
+	Kind        string    `json:"kind"`
+	Link        string    `json:"link,omitempty"`
+	Message     string    `json:"message"`
+	Read        bool      `json:"read"`
+}
+
+type OAuthClient struct {
+	ClientID    string
+	DateCreated time.Time
+	Name        string
+	RedirectURI string
+}
+
+type OAuthGrant struct {
+	ClientID    string
+	ClientName  string
+	DateCreated time.Time
+	Expiry      time.Time
+	LastUse     CredentialUse
+	Scope       string
+}
+
+// A member of an organisation
+type OrgMember struct {
+	DateJoined time.Time `json:"date_joined"`
+	Role       string    `json:"role"`
+	UserName   string    `json:"username"`
+}
+
+// A branch of a database which can't have versions uploaded to it directly
+type ProtectedBranch struct {
+	Branch        string
+	DateProtected time.Time
+	ProtectedBy   string
+}
+
+type QueryHistoryEntry struct {
+	Cached       bool
+	DateExecuted time.Time
+	DBFolder     string
+	DBName       string
+	DBOwner      string
+	DBVersion    int
+	Duration     int64
+	ID           int64
+	Query        string
+	RowCount     int
+}
+
+type SavedQuery struct {
+	DateCreated time.Time
+	DBFolder    string
+	DBName      string
+	DBOwner     string
+	ID          int64
+	Name        string
+	Query       string
+}
+
+// The columns of a table holding locations.  Either Geometry (a SpatiaLite geometry column) or both Latitude and
+// Longitude are filled out
+type SpatialColumns struct {
+	Geometry  string
+	Latitude  string
+	Longitude string
+}
+
 type SQLiteDBinfo struct {
 	Info     DBInfo
 	MaxRows  int
@@ -220,15 +1173,33 @@ type SQLiteDBinfo struct {
 }
 
 type SQLiteRecordSet struct {
-	ColCount  int
-	ColNames  []string
-	Offset    int
-	Records   []DataRow
-	RowCount  int
-	SortCol   string
-	SortDir   string
-	Tablename string
-	TotalRows int
+	ColCount   int
+	ColFormats []ColumnFormat
+	ColNames   []string
+	ColOffset  int
+	Offset     int
+	Records    []DataRow
+	RowCount   int
+	SortCol    string
+	SortDir    string
+	SortType   string
+	Tablename  string
+	TotalCols  int
+	TotalRows  int
+}
+
+type WebhookDelivery struct {
+	Attempts       int
+	DateCreated    time.Time
+	Error          string
+	Event          string
+	ID             int64
+	NextAttempt    time.Time
+	Payload        string
+	ResponseStatus int
+	Secret         string
+	Status         string
+	URL            string
 }
 
 type WhereClause struct {
@@ -237,6 +1208,275 @@ type WhereClause struct {
 	Value  string
 }
 
+// A virus scanner verdict for some database content, keyed by its SHA256
+type ScanVerdict struct {
+	Clean       bool      `json:"clean"`
+	DateScanned time.Time `json:"date_scanned"`
+	Detail      string    `json:"detail"`
+	SHA256      string    `json:"sha256"`
+}
+
+// One database version in the lineage chain, as checked by VerifyLineage()
+// A kind of notification, along with the description shown on the preferences page
+type NotificationKind struct {
+	Kind  string
+	Label string
+}
+
+// Where to deliver a notification for one user.  The email address and webhook URL are empty when the user doesn't
+// want the notification sent that way
+type NotificationTarget struct {
+	Email    string
+	UserName string
+	Web      bool
+	Webhook  string
+}
+
+// A database version deleted by its owner, which can still be restored until its purge date
+type DeletedVersion struct {
+	DateCreated time.Time
+	DateDeleted time.Time
+	DeletedBy   string
+	PurgeDate   time.Time
+	Size        int64
+	Version     int
+}
+
+// A new database version listed in an email digest
+type DigestEntry struct {
+	DateCreated time.Time
+	DBName      string
+	Folder      string
+	Owner       string
+	Version     int
+}
+
+// A user whose email digest is due to be sent
+type DigestUser struct {
+	Email      string
+	Frequency  string
+	LastDigest time.Time
+	UserName   string
+}
+
+type LineageEntry struct {
+	ChainHash   string    `json:"chain_hash"`
+	DateCreated time.Time `json:"date_created"`
+	Deleted     bool      `json:"deleted,omitempty"`
+	PrevHash    string    `json:"prev_hash"`
+	Problem     string    `json:"problem,omitempty"`
+	SHA256      string    `json:"sha256"`
+	Version     int       `json:"version"`
+}
+
+// The result of verifying the lineage chain of a database.  Head is the chain hash of the latest version, which
+// users can keep a copy of to detect later changes to the history
+type LineageReport struct {
+	Head     string         `json:"head"`
+	Valid    bool           `json:"valid"`
+	Versions []LineageEntry `json:"versions"`
+}
+
+// A public database, as listed for mirrors to copy
+type MirrorDB struct {
+	DefaultTable string            `json:"default_table"`
+	Description  string            `json:"description"`
+	Folder       string            `json:"folder"`
+	Name         string            `json:"name"`
+	Owner        string            `json:"owner"`
+	Readme       string            `json:"readme"`
+	Versions     []MirrorDBVersion `json:"versions"`
+}
+
+type MirrorDBVersion struct {
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	Version int    `json:"version"`
+}
+
+// One database version in the replication change list.  The cursor is the ID of the transaction which added the
+// version, so a standby asks for the changes after the last cursor it applied.  Versions added in the same
+// transaction share a cursor, and are always listed together
+type ReplicationChange struct {
+	Author       string    `json:"author"`
+	Branch       string    `json:"branch,omitempty"`
+	ChainHash    string    `json:"chain_hash,omitempty"`
+	CommitID     string    `json:"commit_id,omitempty"`
+	Cursor       int64     `json:"cursor"`
+	DateCreated  time.Time `json:"date_created"`
+	DefaultTable string    `json:"default_table"`
+	Description  string    `json:"description"`
+	Folder       string    `json:"folder"`
+	Message      string    `json:"message"`
+	Name         string    `json:"name"`
+	Owner        string    `json:"owner"`
+	ParentCommit string    `json:"parent_commit,omitempty"`
+	PrevHash     string    `json:"prev_hash,omitempty"`
+	Public       bool      `json:"public"`
+	Readme       string    `json:"readme"`
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	Version      int       `json:"version"`
+}
+
+type ReplicationChangeList struct {
+	Changes []ReplicationChange `json:"changes"`
+	Cursor  int64               `json:"cursor"`
+}
+
+// What a database needs before merge requests to it can be accepted.  The owner approval can come from the owner
+// themselves, or an owner or admin of the organisation owning the database
+type ReviewPolicy struct {
+	MinApprovals  int
+	OwnerApproval bool
+}
+
+// A validation rule which new versions of a database break, along with how many of its rows break it
+type RuleViolation struct {
+	Message string
+	Rows    int
+	Rule    string
+}
+
+// A secret link giving read-only access to a private database, including to visitors without an account.  As with API
+// tokens, the link itself is only shown when it's created, as just the hash of its token is stored
+type ShareLink struct {
+	CreatedBy   string
+	DateCreated time.Time
+	Expiry      time.Time
+	ID          int64
+	LastUsed    *time.Time
+	Name        string
+}
+
+// The result of a check run by an external system (eg a CI server) against a database version.  Each system posts its
+// checks under its own context name, and posting again with the same context replaces the earlier result
+type StatusCheck struct {
+	CommitID    string    `json:"commit_id"`
+	Context     string    `json:"context"`
+	CreatedBy   string    `json:"created_by"`
+	DateUpdated time.Time `json:"date_updated"`
+	Description string    `json:"description"`
+	State       string    `json:"state"`
+	TargetURL   string    `json:"target_url"`
+}
+
+type StoredDBVersion struct {
+	DBName   string
+	Folder   string
+	ID       int64
+	MinioBkt string
+	MinioID  string
+	Owner    string
+	SHA256   string
+	Size     int64
+	Version  int
+}
+
+// Which version last changed each row of a table, as of a given version.  The rows are in key order, and only include
+// the requested page of them.  Partial is set when the history goes back further than was compared
+type TableBlame struct {
+	KeyColumns []string   `json:"key_columns"`
+	Offset     int        `json:"offset"`
+	Partial    bool       `json:"partial"`
+	Rows       []BlameRow `json:"rows"`
+	Table      string     `json:"table"`
+	TotalRows  int        `json:"total_rows"`
+	Version    int        `json:"version"`
+}
+
+type Takedown struct {
+	AdminNotes       string
+	ComplainantEmail string
+	ComplainantName  string
+	CounterNotice    string
+	DateCreated      time.Time
+	DateUpdated      time.Time
+	DBFolder         string
+	DBName           string
+	DBOwner          string
+	Description      string
+	ID               int64
+	Status           string
+}
+
+type TermsAcceptance struct {
+	DateAccepted time.Time
+	Username     string
+	Version      int
+}
+
+type TermsVersion struct {
+	Acceptances   int
+	DatePublished time.Time
+	Privacy       string
+	Terms         string
+	Version       int
+}
+
+// The result of checking whether a database file can be uploaded, before its data is sent.  The remaining quota is
+// -1 when the user has no storage quota
+type UploadCheck struct {
+	DBName         string `json:"database"`
+	Error          string `json:"error,omitempty"`
+	Exists         bool   `json:"exists"`
+	LatestVersion  int    `json:"latest_version,omitempty"`
+	OK             bool   `json:"ok"`
+	QuotaRemaining int64  `json:"quota_remaining"`
+}
+
+type UploadJob struct {
+	Branch   string    `json:"branch,omitempty"`
+	DBName   string    `json:"database"`
+	Error    string    `json:"error,omitempty"`
+	Folder   string    `json:"folder"`
+	ID       string    `json:"id"`
+	Owner    string    `json:"owner"`
+	Started  time.Time `json:"started"`
+	Status   string    `json:"status"`
+	Uploader string    `json:"uploader,omitempty"`
+	Version  int       `json:"version,omitempty"`
+}
+
+// How much of a web form upload has arrived so far.  The total is the Content-Length of the request, which includes
+// the other form fields as well as the database itself
+type UploadProgress struct {
+	Done     bool   `json:"done"`
+	Owner    string `json:"-"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+}
+
+type UserAccount struct {
+	DateJoined   time.Time `json:"date_joined"`
+	Disabled     bool      `json:"disabled"`
+	Email        string    `json:"email"`
+	StorageQuota int64     `json:"storage_quota"`
+	StorageUsed  int64     `json:"storage_used"`
+	Username     string    `json:"username"`
+}
+
+// The details shown on a user's page, cached together as they're all needed for each page view
+type UserPageDetails struct {
+	DBRows    []DBInfo
+	Followers []Follow
+	Following []Follow
+	IsOrg     bool
+	Members   []OrgMember
+	Profile   UserProfile
+}
+
+// The public profile of a user.  The avatar address points at the image they've uploaded, or their Gravatar if they
+// haven't uploaded one
+type UserProfile struct {
+	AvatarURL   string
+	Bio         string
+	DisplayName string
+	HasAvatar   bool
+	Location    string
+	Website     string
+}
+
 type UserInfo struct {
 	LastModified time.Time
 	Username     string
@@ -251,3 +1491,28 @@ type UserDetails struct {
 	PVerify    string
 	Username   string
 }
+
+// A validation rule new versions of a database need to pass before they're accepted.  Not null and range rules check
+// a column of a table, while SQL rules are a query returning the rows which break the rule.  Range rules can leave
+// out either end of the range
+type ValidationRule struct {
+	Column      string
+	CreatedBy   string
+	DateCreated time.Time
+	ID          int64
+	Kind        string
+	Max         *float64
+	Min         *float64
+	Name        string
+	Query       string
+	Table       string
+}
+
+// The lineage chain and commit history links of a database version
+type versionLineage struct {
+	ChainHash    string
+	CommitID     string
+	Created      time.Time
+	ParentCommit string
+	PrevHash     string
+}
@@ -47,6 +47,17 @@ func GetFormFolder(r *http.Request) (string, error) {
 	return folder, nil
 }
 
+// Returns the folder given in the request's "folder" value, from either the URL or form data.  The root folder is
+// returned if no folder was given.
+func GetFolder(r *http.Request) (string, error) {
+	folder, err := NormaliseFolder(r.FormValue("folder"))
+	if err != nil {
+		log.Printf("Validation failed for folder: '%s': %s", r.FormValue("folder"), err)
+		return "", errors.New("Invalid folder name")
+	}
+	return folder, nil
+}
+
 // Return the username, database, and version (if any) present in the form data.
 func GetFormUDV(r *http.Request) (string, string, int, error) {
 	// Extract the username
@@ -308,3 +319,23 @@ func GetTable(r *http.Request) (string, error) {
 	// Everything seems ok
 	return requestedTable, nil
 }
+
+// Returns a folder name in the form it's stored in PostgreSQL, starting and ending with a "/".  An empty folder name
+// is the root folder ("/").  Empty, "." and ".." path components aren't allowed.
+func NormaliseFolder(folder string) (string, error) {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return "/", nil
+	}
+	for _, p := range strings.Split(folder, "/") {
+		if p == "" || p == "." || p == ".." {
+			return "", fmt.Errorf("Invalid folder name '%s'", folder)
+		}
+	}
+	folder = "/" + folder + "/"
+	err := ValidateFolder(folder)
+	if err != nil {
+		return "", err
+	}
+	return folder, nil
+}
@@ -2,10 +2,131 @@
 package common
 
 import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
 )
 
+// The changes of state admins can make to takedown requests.  Admins accept or reject new requests.  The database
+// owner can then respond to an accepted one with a counter notice (see AddCounterNotice()), after which admins either
+// restore the database or uphold the takedown
+var takedownTransitions = map[string][]string{
+	TakedownPending:   {TakedownAccepted, TakedownRejected},
+	TakedownCountered: {TakedownRestored, TakedownAccepted},
+}
+
+// Downloads files from user supplied URLs.  Redirects aren't followed, and connections are only made to public
+// addresses (checked after DNS resolution, at dial time), so a public host can't bounce the request onto the internal
+// network either by redirecting it or by changing its DNS records after CheckPublicHost() has looked them up.
+var publicHTTPClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Control:   checkPublicDial,
+			KeepAlive: 30 * time.Second,
+			Timeout:   30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// Checks a host name only resolves to public addresses, so user supplied URLs can't be used to reach services on the
+// internal network.
+func CheckPublicHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return fmt.Errorf("'%s' isn't a public address", host)
+		}
+	}
+	return nil
+}
+
+// Refuses connections by publicHTTPClient to addresses which aren't public.  The address has already been resolved
+// when this is called, so it's the one actually being connected to.
+func checkPublicDial(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("'%s' isn't a public address", host)
+	}
+	return nil
+}
+
+// Reports whether an IP address is reachable from the public internet, rather than being a loopback, private or link
+// local one.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified())
+}
+
+// Generates the lineage chain hash for a database version.  Each version's hash covers the hash of the version
+// before it, so altering or removing any earlier version record breaks the chain from that point onwards
+func lineageHash(prevHash string, version int, sha string, created time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%s\n%s", prevHash, version, sha, created.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the ID of a database commit.  The ID covers the parent commit, so the IDs of later commits change if the
+// history before them does.
+func commitID(parent string, sha string, author string, message string, created time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s", parent, sha, author, created.UTC().Format(time.RFC3339Nano), message)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Generates the signature for a CDN download link
+func cdnSignature(dlPath string, dbVersion int, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(WebCDNSigningKey()))
+	fmt.Fprintf(mac, "%s\n%d\n%d", dlPath, dbVersion, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the link to use for downloading a database version.  Public databases are downloaded via the CDN when one
+// is configured, using a signed link if a signing key is set.  Private databases are always downloaded directly.
+func DownloadURL(dbOwner string, dbFolder string, dbName string, dbVersion int, public bool) string {
+	dlPath := downloadPath(dbOwner, dbName)
+	params := url.Values{}
+	params.Set("version", strconv.Itoa(dbVersion))
+	if dbFolder != "/" {
+		params.Set("folder", dbFolder)
+	}
+	if !public || WebCDNBaseURL() == "" {
+		return dlPath + "?" + params.Encode()
+	}
+	if WebCDNSigningKey() != "" {
+		expires := time.Now().Add(CDNLinkLifetime).Unix()
+		params.Set("expires", strconv.FormatInt(expires, 10))
+		params.Set("sig", cdnSignature(signedDownloadPath(dbOwner, dbFolder, dbName), dbVersion, expires))
+	}
+	return strings.TrimSuffix(WebCDNBaseURL(), "/") + dlPath + "?" + params.Encode()
+}
+
+// Returns the path used for downloading a database.  Databases in folders other than the root give their folder
+// as a parameter
+func downloadPath(dbOwner string, dbName string) string {
+	return fmt.Sprintf("/x/download/%s/%s", url.PathEscape(dbOwner), url.PathEscape(dbName))
+}
+
 // Look for the next child fork in a fork tree
 func nextChild(loggedInUser string, rawListPtr *[]ForkEntry, outputListPtr *[]ForkEntry, forkTrailPtr *[]int, iconDepth int) ([]ForkEntry, []int, bool) {
 	// TODO: This approach feels half arsed.  Maybe redo it as a recursive function instead?
@@ -56,6 +177,57 @@ func nextChild(loggedInUser string, rawListPtr *[]ForkEntry, outputListPtr *[]Fo
 	return outputList, forkTrail, false
 }
 
+// Normalise an SQL query for use in cache keys.  Comments outside of quoted strings and identifiers are removed, runs
+// of whitespace outside of them are collapsed to a single space, and leading/trailing whitespace and semicolons are
+// removed
+func NormaliseQuery(query string) string {
+	var buf bytes.Buffer
+	var quote rune
+	pendingSpace := false
+	q := []rune(query)
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		if quote == 0 {
+			// Comments are treated like whitespace.  "--" comments run to the end of the line, and "/*" comments to
+			// the next "*/" (or the end of the query)
+			if c == '-' && i+1 < len(q) && q[i+1] == '-' {
+				for i < len(q) && q[i] != '\n' {
+					i++
+				}
+				pendingSpace = true
+				continue
+			}
+			if c == '/' && i+1 < len(q) && q[i+1] == '*' {
+				i += 2
+				for i < len(q) && !(q[i] == '*' && i+1 < len(q) && q[i+1] == '/') {
+					i++
+				}
+				i++
+				pendingSpace = true
+				continue
+			}
+			if unicode.IsSpace(c) {
+				pendingSpace = true
+				continue
+			}
+		}
+		if pendingSpace {
+			buf.WriteRune(' ')
+			pendingSpace = false
+		}
+		switch {
+		case quote == 0 && (c == '\'' || c == '"' || c == '`'):
+			quote = c
+		case quote == 0 && c == '[':
+			quote = ']'
+		case c == quote:
+			quote = 0
+		}
+		buf.WriteRune(c)
+	}
+	return strings.Trim(buf.String(), " ;")
+}
+
 // Generate a random string
 func RandomString(length int) string {
 	rand.Seed(time.Now().UnixNano())
@@ -67,3 +239,44 @@ func RandomString(length int) string {
 
 	return string(randomString)
 }
+
+// Generate a random token, suitable for use as a secret.  Unlike RandomString(), this uses a cryptographically secure
+// random number generator.
+func RandomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Returns the download path covered by a CDN signature.  The folder is included for databases outside the root
+// folder, so a signature for one database can't be used for another of the same name.
+func signedDownloadPath(dbOwner string, dbFolder string, dbName string) string {
+	if dbFolder == "/" {
+		return downloadPath(dbOwner, dbName)
+	}
+	return downloadPath(dbOwner, dbName) + "\n" + dbFolder
+}
+
+// Returns the states an admin can move a takedown request to from its current one.
+func TakedownNextStates(status string) []string {
+	return takedownTransitions[status]
+}
+
+// Generates the hash of a token, for storing in the database.  Tokens are long and random, so a fast hash is fine
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Checks the signature of a signed CDN download link.  Returns true if the link is valid and hasn't expired.
+func ValidCDNSignature(dbOwner string, dbFolder string, dbName string, dbVersion int, expires string, sig string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(cdnSignature(signedDownloadPath(dbOwner, dbFolder, dbName), dbVersion,
+		exp)))
+}
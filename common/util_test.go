@@ -0,0 +1,32 @@
+package common
+
+import "testing"
+
+func TestNormaliseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT  a,\n\tb FROM t;", "SELECT a, b FROM t"},
+		{"  SELECT 1 ; ", "SELECT 1"},
+		{"SELECT 'a  b' FROM t", "SELECT 'a  b' FROM t"},
+		{"SELECT \"a  b\", [c  d] FROM t", "SELECT \"a  b\", [c  d] FROM t"},
+		{"SELECT a -- x\n, b FROM t", "SELECT a , b FROM t"},
+		{"SELECT a -- x , b FROM t", "SELECT a"},
+		{"SELECT a /* x\ny */ FROM t", "SELECT a FROM t"},
+		{"SELECT a /* unterminated", "SELECT a"},
+		{"SELECT '--', '/*' FROM t", "SELECT '--', '/*' FROM t"},
+		{"SELECT 1; -- trailing comment", "SELECT 1"},
+	}
+	for _, tt := range tests {
+		got := NormaliseQuery(tt.query)
+		if got != tt.want {
+			t.Errorf("NormaliseQuery(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// Queries which only differ in where a comment ends mustn't share a cache key
+	if NormaliseQuery("SELECT a -- x\n, b FROM t") == NormaliseQuery("SELECT a -- x , b FROM t") {
+		t.Error("Queries with different comment endings were normalised to the same text")
+	}
+}
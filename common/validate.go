@@ -2,12 +2,15 @@ package common
 
 import (
 	"fmt"
+	"math"
 	"regexp"
+	"strings"
 
 	valid "gopkg.in/go-playground/validator.v9"
 )
 
 var (
+	regexBranch    = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_,\/]+$`)
 	regexDBName    = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_,\ ]+$`)
 	regexFieldName = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_,\/,\(,\,\ )]+$`)
 	regexFolder    = regexp.MustCompile(`^[a-z,A-Z,0-9,\.,\-,\_,\/]+$`)
@@ -21,6 +24,7 @@ var (
 func init() {
 	// Load validation code
 	Validate = valid.New()
+	Validate.RegisterValidation("branchname", checkBranchName)
 	Validate.RegisterValidation("dbname", checkDBName)
 	Validate.RegisterValidation("fieldname", checkFieldName)
 	Validate.RegisterValidation("folder", checkFolder)
@@ -28,6 +32,12 @@ func init() {
 	Validate.RegisterValidation("username", checkUsername)
 }
 
+// Custom validation function for branch names.
+// At the moment it allows alphanumeric and ".-_/" chars, the same as folder names.
+func checkBranchName(fl valid.FieldLevel) bool {
+	return regexBranch.MatchString(fl.Field().String())
+}
+
 // Custom validation function for SQLite database names.
 // At the moment it just allows alphanumeric and ".-_ " chars, though it should probably be extended to cover any
 // valid file name
@@ -62,9 +72,9 @@ func checkUsername(fl valid.FieldLevel) bool {
 
 // Checks a username against the list of reserved ones.
 func ReservedUsernamesCheck(userName string) error {
-	reserved := []string{"about", "admin", "blog", "dbhub", "download", "downloadcsv", "forks", "legal", "login",
-		"logout", "mail", "news", "pref", "printer", "public", "reference", "register", "root", "star",
-		"stars", "system", "table", "upload", "uploaddata", "vis"}
+	reserved := []string{"about", "admin", "blog", "dbhub", "download", "downloadcsv", "forks", "history", "legal",
+		"login", "logout", "mail", "news", "oauth", "pref", "printer", "public", "reference", "register", "root",
+		"star", "stars", "system", "table", "takedown", "terms", "upload", "uploaddata", "vis"}
 	for _, word := range reserved {
 		if userName == word {
 			return fmt.Errorf("That username is not available: %s\n", userName)
@@ -74,6 +84,26 @@ func ReservedUsernamesCheck(userName string) error {
 	return nil
 }
 
+// Validate the provided commit ID.  Shortened IDs are allowed, down to 7 characters.
+func ValidateCommitID(id string) error {
+	err := Validate.Var(id, "required,hexadecimal,min=7,max=64")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Validate the provided commit message.
+func ValidateCommitMessage(msg string) error {
+	err := Validate.Var(msg, "max=1024")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Validate the SQLite field name
 func ValidateFieldName(fieldName string) error {
 	err := Validate.Var(fieldName, "required,fieldname,min=1,max=63") // 63 char limit seems reasonable
@@ -84,6 +114,16 @@ func ValidateFieldName(fieldName string) error {
 	return nil
 }
 
+// Validate the name of a database branch.
+func ValidateBranch(branch string) error {
+	err := Validate.Var(branch, "required,branchname,max=63")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Validate the database name.
 func ValidateDB(dbName string) error {
 	err := Validate.Var(dbName, "required,dbname,min=1,max=256") // 256 char limit seems reasonable
@@ -114,6 +154,32 @@ func ValidateFolder(folder string) error {
 	return nil
 }
 
+// Validate the name of a database page tab visitors can land on.
+func ValidateLandingTab(tab string) error {
+	switch tab {
+	case LandingData, LandingReadme:
+		return nil
+	}
+	return fmt.Errorf("Unknown database page tab: %s", tab)
+}
+
+// Validate a new merge request.  It needs a title, and the description is optional.
+func ValidateMergeRequest(mr MergeRequest) error {
+	err := ValidateBranch(mr.SourceBranch)
+	if err != nil {
+		return fmt.Errorf("Invalid branch name")
+	}
+	err = Validate.Var(mr.Title, "required,max=200")
+	if err != nil {
+		return fmt.Errorf("The title needs to be 1 to 200 characters")
+	}
+	err = Validate.Var(mr.Description, "max=4096")
+	if err != nil {
+		return fmt.Errorf("The description can be at most 4096 characters")
+	}
+	return nil
+}
+
 // Validate the provided PostgreSQL table name.
 func ValidatePGTable(table string) error {
 	// TODO: Improve this to work with all valid SQLite identifiers
@@ -129,6 +195,56 @@ func ValidatePGTable(table string) error {
 	return nil
 }
 
+// Validate the profile fields a user has entered.  They're all optional, and the website needs to be a http(s)
+// address.
+func ValidateProfile(p UserProfile) error {
+	err := Validate.Var(p.DisplayName, "max=80")
+	if err != nil {
+		return fmt.Errorf("The display name can be at most 80 characters")
+	}
+	err = Validate.Var(p.Bio, "max=1024")
+	if err != nil {
+		return fmt.Errorf("The bio can be at most 1024 characters")
+	}
+	err = Validate.Var(p.Location, "max=80")
+	if err != nil {
+		return fmt.Errorf("The location can be at most 80 characters")
+	}
+	if p.Website != "" {
+		err = Validate.Var(p.Website, "url,max=256")
+		if err != nil || !(strings.HasPrefix(p.Website, "https://") || strings.HasPrefix(p.Website, "http://")) {
+			return fmt.Errorf("The website needs to be a http:// or https:// address")
+		}
+	}
+	return nil
+}
+
+// Validate a status check posted against a database version.  Contexts use the same characters as branch names, so
+// systems can namespace them (eg "ci/build").
+func ValidateStatusCheck(s StatusCheck) error {
+	switch s.State {
+	case StatusFailure, StatusPending, StatusSuccess:
+	default:
+		return fmt.Errorf("The state needs to be one of '%s', '%s', or '%s'", StatusPending, StatusSuccess,
+			StatusFailure)
+	}
+	err := Validate.Var(s.Context, "required,branchname,max=100")
+	if err != nil {
+		return fmt.Errorf("The context needs to be 1 to 100 characters of letters, numbers, or '.-_/'")
+	}
+	err = Validate.Var(s.Description, "max=140")
+	if err != nil {
+		return fmt.Errorf("The description can be at most 140 characters")
+	}
+	if s.TargetURL != "" {
+		err = Validate.Var(s.TargetURL, "url,max=512")
+		if err != nil || !(strings.HasPrefix(s.TargetURL, "https://") || strings.HasPrefix(s.TargetURL, "http://")) {
+			return fmt.Errorf("The target URL needs to be a http:// or https:// address")
+		}
+	}
+	return nil
+}
+
 // Validate the provided username.
 func ValidateUser(user string) error {
 	err := Validate.Var(user, "required,username,min=2,max=63")
@@ -183,3 +299,45 @@ func ValidateUserEmail(user string, email string) error {
 
 	return nil
 }
+
+// Validate a validation rule for a database.  The table and column names are quoted when the rule is run, so they
+// aren't restricted beyond their length.
+func ValidateValidationRule(rule ValidationRule) error {
+	err := Validate.Var(rule.Name, "required,max=100")
+	if err != nil {
+		return fmt.Errorf("Validation rules need a name of up to 100 characters")
+	}
+	switch rule.Kind {
+	case RuleNotNull, RuleRange:
+		if rule.Table == "" || rule.Column == "" || len(rule.Table) > 256 || len(rule.Column) > 256 {
+			return fmt.Errorf("Validation rules need the table and column to check")
+		}
+		if rule.Kind == RuleNotNull {
+			return nil
+		}
+		if rule.Min == nil && rule.Max == nil {
+			return fmt.Errorf("Range rules need a minimum or maximum value")
+		}
+		for _, v := range []*float64{rule.Min, rule.Max} {
+			if v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0)) {
+				return fmt.Errorf("Range rules need numbers for the minimum and maximum values")
+			}
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("The minimum value can't be larger than the maximum value")
+		}
+	case RuleSQL:
+		err = Validate.Var(rule.Query, "required,max=4096")
+		if err != nil {
+			return fmt.Errorf("SQL rules need a query of up to 4096 characters")
+		}
+		switch queryKeyword(rule.Query) {
+		case "SELECT", "VALUES", "WITH":
+		default:
+			return fmt.Errorf("SQL rules need to be a SELECT query")
+		}
+	default:
+		return fmt.Errorf("Unknown kind of validation rule")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// Owners can give their databases validation rules, which new versions need to pass before they're accepted.  Each
+// rule is turned into a query returning the rows which break it, so rules are run the same way as user queries.
+
+// Runs the validation rules of a database against a new version of it, returning the rules the new version breaks.
+// Rules which can't be run against it (eg because a table has been removed) count as being broken too.
+func CheckValidationRules(ctx context.Context, dbOwner string, dbFolder string, dbName string,
+	fileName string) ([]RuleViolation, error) {
+	rules, err := ValidationRules(dbOwner, dbFolder, dbName)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	sdb, err := sqlite.Open(fileName, sqlite.OpenReadOnly)
+	if err != nil {
+		log.Printf("Couldn't open database when checking validation rules: %s\n", err)
+		return nil, errors.New("Internal error when checking validation rules")
+	}
+	defer sdb.Close()
+
+	var list []RuleViolation
+	for _, rule := range rules {
+		rs, err := RunSQLiteQuery(ctx, sdb, ruleQuery(rule), ValidationMaxViolations)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			list = append(list, RuleViolation{Message: err.Error(), Rule: rule.Name})
+			continue
+		}
+		if rs.RowCount == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("%d rows break this rule", rs.RowCount)
+		if rs.RowCount == 1 {
+			msg = "1 row breaks this rule"
+		} else if rs.RowCount >= ValidationMaxViolations {
+			msg = fmt.Sprintf("At least %d rows break this rule", ValidationMaxViolations)
+		}
+		list = append(list, RuleViolation{Message: msg, Rows: rs.RowCount, Rule: rule.Name})
+	}
+	return list, nil
+}
+
+// Returns the query for a validation rule, which returns the rows breaking it.
+func ruleQuery(rule ValidationRule) string {
+	switch rule.Kind {
+	case RuleNotNull:
+		return sqlite.Mprintf(`SELECT 1 FROM "%w"`, rule.Table) + sqlite.Mprintf(` WHERE "%w" IS NULL`, rule.Column)
+	case RuleRange:
+		col := sqlite.Mprintf(`"%w"`, rule.Column)
+		var conds []string
+		if rule.Min != nil {
+			conds = append(conds, col+" < "+strconv.FormatFloat(*rule.Min, 'g', -1, 64))
+		}
+		if rule.Max != nil {
+			conds = append(conds, col+" > "+strconv.FormatFloat(*rule.Max, 'g', -1, 64))
+		}
+		return sqlite.Mprintf(`SELECT 1 FROM "%w"`, rule.Table) + " WHERE " + strings.Join(conds, " OR ")
+	}
+	return rule.Query
+}
+
+// Returns an error listing the validation rules a new version of a database breaks, for showing to the uploader.
+func ViolationsError(list []RuleViolation) error {
+	var msgs []string
+	for _, v := range list {
+		msgs = append(msgs, fmt.Sprintf("'%s' (%s)", v.Rule, v.Message))
+	}
+	return fmt.Errorf("The database breaks these validation rules: %s", strings.Join(msgs, ", "))
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Database owners can register webhooks which are told about events on their databases, such as new versions being
+// uploaded.  Events are queued in PostgreSQL as deliveries, which the admin server sends every WebhookInterval.
+// Deliveries which fail are retried with exponential backoff, up to WebhookMaxAttempts times.  Each delivery is signed
+// with an HMAC-SHA256 of its body using the webhook's secret, so receivers can check it came from us.
+
+// The most webhook deliveries sent in one run of the admin server's delivery loop
+const webhookBatchSize = 100
+
+// The events a database webhook can ask for, in the order shown on the settings page
+var DBWebhookEvents = []string{WebhookUpload, WebhookFork, WebhookStar, WebhookRename}
+
+// Queues an event on a database for delivery to its webhooks which want it.  The payload is worked out now, so
+// retries send exactly the same thing.  Details specific to the event are passed in extra.
+func DBEvent(dbOwner string, dbFolder string, dbName string, event string, sender string,
+	extra map[string]interface{}) error {
+	if !FeatureEnabled(FeatureWebhooks, dbOwner) {
+		return nil
+	}
+	payload := map[string]interface{}{
+		"event": event,
+		"database": map[string]string{
+			"owner":  dbOwner,
+			"folder": dbFolder,
+			"name":   dbName,
+			"url":    fmt.Sprintf("https://%s/%s%s%s", WebServer(), dbOwner, dbFolder, dbName),
+		},
+		"sender": sender,
+		"date":   time.Now().UTC(),
+	}
+	for k, v := range extra {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return queueWebhookDeliveries(dbOwner, dbFolder, dbName, event, string(body))
+}
+
+// Sends the webhook deliveries which are due, returning how many were delivered.  Failed deliveries are scheduled
+// to be tried again later, unless they've run out of attempts.
+func SendDBWebhooks() (sent int, err error) {
+	list, err := DueWebhookDeliveries(webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range list {
+		d.Attempts++
+		d.NextAttempt = time.Now().UTC()
+		d.ResponseStatus, err = sendDBWebhook(d)
+		if err == nil {
+			d.Status = DeliveryDelivered
+			d.Error = ""
+			sent++
+		} else {
+			d.Error = err.Error()
+			if d.Attempts >= WebhookMaxAttempts {
+				d.Status = DeliveryFailed
+			} else {
+				d.NextAttempt = d.NextAttempt.Add(webhookBackoff(d.Attempts))
+			}
+		}
+		err = SetWebhookDeliveryResult(d)
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Returns how long to wait before trying a delivery again, after it has failed the given number of times.  The
+// wait doubles each time, starting from one minute.
+func webhookBackoff(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+// Posts a webhook delivery, returning the HTTP status of the response.
+func sendDBWebhook(d WebhookDelivery) (status int, err error) {
+	// The URL was checked when the webhook was added, but the address it points at may have changed since
+	err = ValidateNotifyWebhook(d.URL)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DBHub.io-Webhook")
+	req.Header.Set("X-DBHub-Delivery", fmt.Sprintf("%d", d.ID))
+	req.Header.Set("X-DBHub-Event", d.Event)
+	req.Header.Set("X-DBHub-Signature", "sha256="+webhookSignature(d.Secret, d.Payload))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Returns true if the given name is an event database webhooks can ask for.
+func ValidDBWebhookEvent(event string) bool {
+	for _, e := range DBWebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the hex encoded HMAC-SHA256 of a webhook payload, keyed with the webhook's secret.
+func webhookSignature(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -91,7 +91,17 @@ CREATE TABLE database_versions (
     sha256 text NOT NULL,
     minioid text NOT NULL,
     date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
-    last_modified timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+    last_modified timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    compressed_size bigint,
+    prev_hash text,
+    chain_hash text,
+    commit_id text,
+    parent_commit text,
+    author text,
+    message text,
+    branch text DEFAULT 'main'::text NOT NULL,
+    rows_changed bigint,
+    txid bigint DEFAULT txid_current() NOT NULL
 );
 
 
@@ -144,7 +154,17 @@ CREATE TABLE sqlite_databases (
     minio_bucket text NOT NULL,
     root_database integer,
     forked_from integer,
-    default_table text
+    default_table text,
+    noindex boolean DEFAULT false NOT NULL,
+    archived boolean DEFAULT false NOT NULL,
+    landing_tab text DEFAULT 'data'::text NOT NULL,
+    title text,
+    license text,
+    remote_origin text,
+    live boolean DEFAULT false NOT NULL,
+    live_changed boolean DEFAULT false NOT NULL,
+    review_min_approvals integer DEFAULT 0 NOT NULL,
+    review_owner_approval boolean DEFAULT false NOT NULL
 );
 
 
@@ -183,8 +203,20 @@ CREATE TABLE users (
     password_hash text NOT NULL,
     watchers bigint DEFAULT 0,
     minio_bucket text,
-    pref_max_rows integer DEFAULT 10 NOT NULL,
-    auth0id text
+    pref_max_rows integer,
+    auth0id text,
+    disabled boolean DEFAULT false NOT NULL,
+    storage_quota bigint DEFAULT 0 NOT NULL,
+    pref_digest text DEFAULT 'none'::text NOT NULL,
+    last_digest timestamp with time zone,
+    notify_webhook text,
+    is_org boolean DEFAULT false NOT NULL,
+    pref_beta boolean DEFAULT false NOT NULL,
+    display_name text,
+    bio text,
+    website text,
+    location text,
+    avatar_minio_id text
 );
 
 
@@ -273,6 +305,20 @@ CREATE INDEX database_stars_user_idx ON database_stars USING btree (username);
 CREATE INDEX database_versions_db_idx ON database_versions USING btree (db);
 
 
+--
+-- Name: database_versions_commit_id_idx; Type: INDEX; Schema: public; Owner: dbhub
+--
+
+CREATE INDEX database_versions_commit_id_idx ON database_versions USING btree (db, commit_id);
+
+
+--
+-- Name: database_versions_txid_idx; Type: INDEX; Schema: public; Owner: dbhub
+--
+
+CREATE INDEX database_versions_txid_idx ON database_versions USING btree (txid);
+
+
 --
 -- Name: dbname_idx; Type: INDEX; Schema: public; Owner: dbhub
 --
@@ -341,3 +387,755 @@ ALTER TABLE ONLY sqlite_databases
 ALTER TABLE ONLY sqlite_databases
     ADD CONSTRAINT sqlite_databases_username_fkey FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE;
 
+
+
+--
+-- Name: query_history; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE query_history (
+    idnum bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    db_owner text NOT NULL,
+    db_folder text NOT NULL,
+    db_name text NOT NULL,
+    db_version integer NOT NULL,
+    query text NOT NULL,
+    duration_ms bigint NOT NULL,
+    row_count integer NOT NULL,
+    cached boolean DEFAULT false NOT NULL,
+    date_executed timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE query_history OWNER TO dbhub;
+
+--
+-- Name: query_history_username_idx; Type: INDEX; Schema: public; Owner: dbhub
+--
+
+CREATE INDEX query_history_username_idx ON query_history USING btree (username, date_executed DESC);
+
+
+--
+-- Name: saved_queries; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE saved_queries (
+    idnum bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    query_name text NOT NULL,
+    db_owner text NOT NULL,
+    db_folder text NOT NULL,
+    db_name text NOT NULL,
+    query text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    UNIQUE (username, query_name)
+);
+
+
+ALTER TABLE saved_queries OWNER TO dbhub;
+
+
+--
+-- Name: oauth_clients; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE oauth_clients (
+    client_id text PRIMARY KEY,
+    client_secret_hash bytea NOT NULL,
+    client_name text NOT NULL,
+    redirect_uri text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE oauth_clients OWNER TO dbhub;
+
+--
+-- Name: oauth_codes; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE oauth_codes (
+    code_hash text PRIMARY KEY,
+    client_id text NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    scope text NOT NULL,
+    redirect_uri text NOT NULL,
+    nonce text,
+    expiry timestamp with time zone NOT NULL
+);
+
+
+ALTER TABLE oauth_codes OWNER TO dbhub;
+
+--
+-- Name: oauth_tokens; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE oauth_tokens (
+    token_hash text PRIMARY KEY,
+    client_id text NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    scope text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    expiry timestamp with time zone NOT NULL,
+    last_used timestamp with time zone,
+    last_used_ip text,
+    last_used_endpoint text
+);
+
+
+ALTER TABLE oauth_tokens OWNER TO dbhub;
+
+--
+-- Name: oauth_tokens_username_idx; Type: INDEX; Schema: public; Owner: dbhub
+--
+
+CREATE INDEX oauth_tokens_username_idx ON oauth_tokens USING btree (username);
+
+--
+-- Name: takedown_requests; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE takedown_requests (
+    idnum bigserial PRIMARY KEY,
+    db_owner text NOT NULL,
+    db_folder text NOT NULL,
+    db_name text NOT NULL,
+    complainant_name text NOT NULL,
+    complainant_email text NOT NULL,
+    description text NOT NULL,
+    status text DEFAULT 'pending' NOT NULL,
+    admin_notes text DEFAULT '' NOT NULL,
+    counter_notice text DEFAULT '' NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    date_updated timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE takedown_requests OWNER TO dbhub;
+
+--
+-- Name: takedown_requests_db_idx; Type: INDEX; Schema: public; Owner: dbhub
+--
+
+CREATE INDEX takedown_requests_db_idx ON takedown_requests USING btree (db_owner, db_folder, db_name);
+
+--
+-- Name: terms_versions; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE terms_versions (
+    idnum serial PRIMARY KEY,
+    terms text NOT NULL,
+    privacy text NOT NULL,
+    date_published timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE terms_versions OWNER TO dbhub;
+
+--
+-- Name: terms_acceptances; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE terms_acceptances (
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    version integer NOT NULL REFERENCES terms_versions(idnum),
+    date_accepted timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (username, version)
+);
+
+
+ALTER TABLE terms_acceptances OWNER TO dbhub;
+
+--
+-- Name: announcements; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE announcements (
+    idnum bigserial PRIMARY KEY,
+    message text NOT NULL,
+    level text DEFAULT 'info' NOT NULL,
+    starts timestamp with time zone NOT NULL,
+    ends timestamp with time zone NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE announcements OWNER TO dbhub;
+
+--
+-- Name: announcement_dismissals; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE announcement_dismissals (
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    announcement_id bigint NOT NULL REFERENCES announcements(idnum) ON DELETE CASCADE,
+    date_dismissed timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (username, announcement_id)
+);
+
+
+ALTER TABLE announcement_dismissals OWNER TO dbhub;
+
+--
+-- Name: organisation_members; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE organisation_members (
+    org text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    role text NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    date_joined timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (org, username)
+);
+
+
+ALTER TABLE organisation_members OWNER TO dbhub;
+
+CREATE INDEX organisation_members_username_idx ON organisation_members USING btree (username);
+
+--
+-- Name: database_access; Type: VIEW; Schema: public; Owner: dbhub
+--
+-- Everyone who can see a database besides its owner: the users it's been shared with, and the members of the
+-- organisation owning it.
+--
+
+CREATE VIEW database_access AS
+    SELECT db, username, access
+    FROM database_shares
+    UNION ALL
+    SELECT db.idnum, m.username, 'rw'::text
+    FROM sqlite_databases AS db
+        JOIN organisation_members AS m ON m.org = db.username;
+
+
+ALTER TABLE database_access OWNER TO dbhub;
+
+--
+-- Name: feature_flags; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE feature_flags (
+    name text PRIMARY KEY,
+    enabled boolean DEFAULT false NOT NULL,
+    rollout_percent integer DEFAULT 0 NOT NULL CHECK (rollout_percent BETWEEN 0 AND 100),
+    users text[] DEFAULT '{}'::text[] NOT NULL,
+    beta boolean DEFAULT false NOT NULL,
+    date_updated timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE feature_flags OWNER TO dbhub;
+
+--
+-- Name: user_logins; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE user_logins (
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    ip text NOT NULL,
+    user_agent text NOT NULL,
+    first_seen timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    last_seen timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (username, ip, user_agent)
+);
+
+
+ALTER TABLE user_logins OWNER TO dbhub;
+
+--
+-- Name: user_follows; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE user_follows (
+    follower text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    followed text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    date_followed timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (follower, followed)
+);
+
+
+ALTER TABLE user_follows OWNER TO dbhub;
+
+CREATE INDEX user_follows_followed_idx ON user_follows USING btree (followed);
+
+--
+-- Name: notifications; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE notifications (
+    idnum bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    kind text NOT NULL,
+    message text NOT NULL,
+    link text DEFAULT ''::text NOT NULL,
+    read boolean DEFAULT false NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE notifications OWNER TO dbhub;
+
+CREATE INDEX notifications_username_idx ON notifications USING btree (username, read);
+
+--
+-- Name: column_docs; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE column_docs (
+    db integer NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    table_name text NOT NULL,
+    column_name text NOT NULL,
+    description text NOT NULL,
+    PRIMARY KEY (db, table_name, column_name)
+);
+
+
+ALTER TABLE column_docs OWNER TO dbhub;
+
+--
+-- Name: scan_verdicts; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE scan_verdicts (
+    sha256 text PRIMARY KEY,
+    clean boolean NOT NULL,
+    detail text DEFAULT ''::text NOT NULL,
+    date_scanned timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE scan_verdicts OWNER TO dbhub;
+
+--
+-- Name: replication_cursors; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE replication_cursors (
+    source text PRIMARY KEY,
+    cursor bigint NOT NULL,
+    last_updated timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE replication_cursors OWNER TO dbhub;
+
+--
+-- Name: notification_prefs; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE notification_prefs (
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    kind text NOT NULL,
+    channel text NOT NULL,
+    enabled boolean NOT NULL,
+    PRIMARY KEY (username, kind, channel)
+);
+
+
+ALTER TABLE notification_prefs OWNER TO dbhub;
+
+--
+-- Name: attachments; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE attachments (
+    id text PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    uploader text NOT NULL,
+    file_name text NOT NULL,
+    content_type text NOT NULL,
+    size bigint NOT NULL,
+    minio_bucket text NOT NULL,
+    minio_id text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE attachments OWNER TO dbhub;
+
+--
+-- Name: deleted_versions; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE deleted_versions (
+    idnum bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    version integer NOT NULL,
+    size bigint NOT NULL,
+    sha256 text NOT NULL,
+    minioid text NOT NULL,
+    date_created timestamp with time zone NOT NULL,
+    last_modified timestamp with time zone NOT NULL,
+    compressed_size bigint,
+    prev_hash text,
+    chain_hash text,
+    commit_id text,
+    parent_commit text,
+    author text,
+    message text,
+    branch text DEFAULT 'main'::text NOT NULL,
+    deleted_by text NOT NULL,
+    date_deleted timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    UNIQUE (db, version)
+);
+
+
+ALTER TABLE deleted_versions OWNER TO dbhub;
+
+--
+-- Name: activity; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE activity (
+    activity_id bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    action text NOT NULL,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    version integer DEFAULT 0 NOT NULL,
+    detail text DEFAULT ''::text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE activity OWNER TO dbhub;
+
+CREATE INDEX activity_username_idx ON activity USING btree (username, activity_id);
+
+--
+-- Name: database_downloads; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE database_downloads (
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    day date DEFAULT timezone('utc'::text, now())::date NOT NULL,
+    downloads bigint DEFAULT 0 NOT NULL,
+    PRIMARY KEY (db, day)
+);
+
+
+ALTER TABLE database_downloads OWNER TO dbhub;
+
+--
+-- Name: database_shares; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE database_shares (
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    access text NOT NULL CHECK (access IN ('r', 'rw')),
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (db, username)
+);
+
+
+ALTER TABLE database_shares OWNER TO dbhub;
+
+CREATE INDEX database_shares_username_idx ON database_shares USING btree (username);
+
+--
+-- Name: database_watches; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE database_watches (
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    date_watched timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (db, username)
+);
+
+
+ALTER TABLE database_watches OWNER TO dbhub;
+
+CREATE INDEX database_watches_username_idx ON database_watches USING btree (username);
+
+--
+-- Name: database_webhooks; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE database_webhooks (
+    webhook_id bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text[] NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE database_webhooks OWNER TO dbhub;
+
+CREATE INDEX database_webhooks_db_idx ON database_webhooks USING btree (db);
+
+--
+-- Name: webhook_deliveries; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE webhook_deliveries (
+    delivery_id bigserial PRIMARY KEY,
+    webhook_id bigint NOT NULL REFERENCES database_webhooks(webhook_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    event text NOT NULL,
+    payload text NOT NULL,
+    status text DEFAULT 'pending'::text NOT NULL CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts integer DEFAULT 0 NOT NULL,
+    response_status integer,
+    last_error text,
+    next_attempt timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE webhook_deliveries OWNER TO dbhub;
+
+CREATE INDEX webhook_deliveries_webhook_id_idx ON webhook_deliveries USING btree (webhook_id);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries USING btree (next_attempt) WHERE status = 'pending';
+
+--
+-- Name: live_journal; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE live_journal (
+    journal_id bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    username text NOT NULL,
+    statement text NOT NULL,
+    rows_affected bigint DEFAULT 0 NOT NULL,
+    date_executed timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE live_journal OWNER TO dbhub;
+
+CREATE INDEX live_journal_db_idx ON live_journal USING btree (db, journal_id);
+
+--
+-- Name: api_tokens; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE api_tokens (
+    token_id bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    name text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    scope text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    expiry timestamp with time zone,
+    last_used timestamp with time zone,
+    last_used_ip text,
+    last_used_endpoint text
+);
+
+
+ALTER TABLE api_tokens OWNER TO dbhub;
+
+CREATE INDEX api_tokens_username_idx ON api_tokens USING btree (username);
+
+--
+-- Name: client_certs; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE client_certs (
+    cert_id bigserial PRIMARY KEY,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    name text NOT NULL,
+    serial text NOT NULL UNIQUE,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    expiry timestamp with time zone NOT NULL,
+    revoked timestamp with time zone,
+    last_used timestamp with time zone,
+    last_used_ip text,
+    last_used_endpoint text
+);
+
+
+ALTER TABLE client_certs OWNER TO dbhub;
+
+CREATE INDEX client_certs_username_idx ON client_certs USING btree (username);
+
+--
+-- Name: user_identities; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE user_identities (
+    provider text NOT NULL,
+    provider_id text NOT NULL,
+    username text NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    email text,
+    date_linked timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (provider, provider_id)
+);
+
+
+ALTER TABLE user_identities OWNER TO dbhub;
+
+CREATE INDEX user_identities_username_idx ON user_identities USING btree (username);
+
+--
+-- Name: import_hooks; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE import_hooks (
+    hook_id bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    token text NOT NULL UNIQUE,
+    secret text NOT NULL,
+    branch text,
+    created_by text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    last_used timestamp with time zone,
+    last_status text
+);
+
+
+ALTER TABLE import_hooks OWNER TO dbhub;
+
+CREATE INDEX import_hooks_db_idx ON import_hooks USING btree (db);
+
+
+
+--
+-- Name: protected_branches; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE protected_branches (
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    branch text NOT NULL,
+    protected_by text NOT NULL,
+    date_protected timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (db, branch)
+);
+
+
+ALTER TABLE protected_branches OWNER TO dbhub;
+
+
+
+--
+-- Name: status_checks; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE status_checks (
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    commit_id text NOT NULL,
+    context text NOT NULL,
+    state text NOT NULL,
+    target_url text,
+    description text,
+    created_by text NOT NULL,
+    date_updated timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (db, commit_id, context)
+);
+
+
+ALTER TABLE status_checks OWNER TO dbhub;
+
+
+
+--
+-- Name: required_status_checks; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE required_status_checks (
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    context text NOT NULL,
+    added_by text NOT NULL,
+    date_added timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (db, context)
+);
+
+
+ALTER TABLE required_status_checks OWNER TO dbhub;
+
+
+
+--
+-- Name: share_links; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE share_links (
+    link_id bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    name text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    created_by text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    expiry timestamp with time zone NOT NULL,
+    last_used timestamp with time zone
+);
+
+
+ALTER TABLE share_links OWNER TO dbhub;
+
+CREATE INDEX share_links_db_idx ON share_links USING btree (db);
+
+
+
+--
+-- Name: validation_rules; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE validation_rules (
+    rule_id bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    name text NOT NULL,
+    kind text NOT NULL,
+    table_name text,
+    column_name text,
+    min_value double precision,
+    max_value double precision,
+    query text,
+    created_by text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL
+);
+
+
+ALTER TABLE validation_rules OWNER TO dbhub;
+
+CREATE INDEX validation_rules_db_idx ON validation_rules USING btree (db);
+
+
+
+--
+-- Name: merge_requests; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE merge_requests (
+    mr_id bigserial PRIMARY KEY,
+    db bigint NOT NULL REFERENCES sqlite_databases(idnum) ON UPDATE CASCADE ON DELETE CASCADE,
+    source_branch text NOT NULL,
+    target_branch text DEFAULT 'main'::text NOT NULL,
+    title text NOT NULL,
+    description text,
+    state text DEFAULT 'open'::text NOT NULL,
+    created_by text NOT NULL,
+    date_created timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    closed_by text,
+    date_closed timestamp with time zone,
+    merged_version integer
+);
+
+
+ALTER TABLE merge_requests OWNER TO dbhub;
+
+CREATE INDEX merge_requests_db_idx ON merge_requests USING btree (db);
+
+
+
+--
+-- Name: merge_request_approvals; Type: TABLE; Schema: public; Owner: dbhub
+--
+
+CREATE TABLE merge_request_approvals (
+    mr_id bigint NOT NULL REFERENCES merge_requests(mr_id) ON UPDATE CASCADE ON DELETE CASCADE,
+    username text NOT NULL,
+    date_approved timestamp with time zone DEFAULT timezone('utc'::text, now()) NOT NULL,
+    PRIMARY KEY (mr_id, username)
+);
+
+
+ALTER TABLE merge_request_approvals OWNER TO dbhub;
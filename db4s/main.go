@@ -5,11 +5,13 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -99,8 +101,6 @@ func generateDefaultList(pageName string, userAcc string) (defaultList []byte, e
 func getHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 	pageName := "GET request handler"
 
-	// TODO: Update this function to handle folder names
-
 	// Split the request URL into path components
 	pathStrings := strings.Split(r.URL.Path, "/")
 
@@ -143,9 +143,15 @@ func getHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		return
 	}
 
-	// Use easily understandable variable names
+	// Use easily understandable variable names.  Databases in a folder have the folder components between the
+	// user and database name
 	dbOwner := pathStrings[1]
-	dbName := pathStrings[2]
+	dbName := pathStrings[numPieces-1]
+	dbFolder, err := com.NormaliseFolder(strings.Join(pathStrings[2:numPieces-1], "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Extract the requested version number from the form data
 	dbVersion, err := com.GetFormVersion(r)
@@ -156,15 +162,27 @@ func getHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 
 	// If no version number was given, we need to determine the highest available to the requesting user
 	if dbVersion == 0 {
-		dbVersion, err = com.HighestDBVersion(dbOwner, dbName, "/", userAcc)
+		dbVersion, err = com.HighestDBVersion(dbOwner, dbName, dbFolder, userAcc)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
+	// Databases which have been taken down can't be downloaded
+	takedown, err := com.ActiveTakedown(dbOwner, dbFolder, dbName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if takedown.ID != 0 {
+		http.Error(w, "This database has been taken down in response to a legal complaint",
+			http.StatusUnavailableForLegalReasons)
+		return
+	}
+
 	// A specific database was requested, so send it to the user
-	err = retrieveDatabase(w, pageName, userAcc, dbOwner, dbName, dbVersion)
+	err = retrieveDatabase(w, r, pageName, userAcc, dbOwner, dbFolder, dbName, dbVersion)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -189,6 +207,13 @@ func main() {
 		log.Fatalf(err.Error())
 	}
 
+	// Set up tracing
+	err = com.ConnectTracing("db4s")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	defer com.DisconnectTracing()
+
 	// Load our self signed CA chain
 	ourCAPool = x509.NewCertPool()
 	certFile, err := ioutil.ReadFile(com.DB4SCAChain())
@@ -216,7 +241,7 @@ func main() {
 	}
 	newServer := &http.Server{
 		Addr:         com.DB4SServer() + ":" + fmt.Sprint(com.DB4SServerPort()),
-		Handler:      mux,
+		Handler:      com.ReportErrors("db4s", com.TraceHandler(mux)),
 		TLSConfig:    newTLSConfig,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
@@ -246,10 +271,14 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		return
 	}
 	targetUser := pathStrings[1]
-	targetDB := pathStrings[2]
+	targetDB := pathStrings[len(pathStrings)-1]
+	targetFolder, err := com.NormaliseFolder(strings.Join(pathStrings[2:len(pathStrings)-1], "/"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid folder name: %s", err), http.StatusBadRequest)
+		return
+	}
 
 	// Get public/private setting for the database
-	var err error
 	var public bool
 	val := r.Header.Get("public")
 	if val == "" {
@@ -264,6 +293,14 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		}
 	}
 
+	// Get the commit message describing the changes in this upload, if one was given
+	commitMsg := r.Header.Get("commitmsg")
+	err = com.ValidateCommitMessage(commitMsg)
+	if err != nil {
+		http.Error(w, "Commit message is too long", http.StatusBadRequest)
+		return
+	}
+
 	// Validate the database name
 	err = com.ValidateDB(targetDB)
 	if err != nil {
@@ -281,6 +318,40 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		return
 	}
 
+	// New versions can't be added to archived databases
+	archived, err := com.DBArchived(userAcc, targetFolder, targetDB)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Database query failure: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if archived {
+		http.Error(w, "That database is archived, so new versions can't be uploaded", http.StatusForbidden)
+		return
+	}
+
+	// Live databases are changed with the write API instead
+	_, live, err := com.DBLive(userAcc, targetFolder, targetDB)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Database query failure: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if live {
+		http.Error(w, "That's a live database, so new versions can't be uploaded", http.StatusForbidden)
+		return
+	}
+
+	// DB4S uploads go onto the main branch, which can be protected so it only changes through merge requests
+	protected, err := com.BranchProtected(userAcc, targetFolder, targetDB, com.DefaultBranch)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Database query failure: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if protected {
+		http.Error(w, "That branch is protected, so new versions can't be uploaded to it directly",
+			http.StatusForbidden)
+		return
+	}
+
 	// Copy the file into a local buffer
 	var tempBuf bytes.Buffer
 	nBytes, err := io.Copy(&tempBuf, r.Body)
@@ -295,6 +366,17 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		return
 	}
 
+	// Make sure the user has enough storage quota left
+	exceeded, err := com.StorageQuotaExceeded(userAcc, nBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Database query failure: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if exceeded {
+		http.Error(w, "Storing this database would exceed your storage quota", http.StatusForbidden)
+		return
+	}
+
 	// Write the temporary file locally, so we can sanity check it
 	tempDB, err := ioutil.TempFile("", "dbhub-upload-")
 	if err != nil {
@@ -325,8 +407,46 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 	// Generate sha256 of the uploaded file
 	shaSum := sha256.Sum256(tempBuf.Bytes())
 
+	// Check it with the virus scanner.  Content which has been scanned before uses the cached verdict
+	clean, _, err := com.ScanDatabase(r.Context(), tempDBName, hex.EncodeToString(shaSum[:]))
+	if err != nil {
+		http.Error(w, "Couldn't scan the database for viruses", http.StatusInternalServerError)
+		return
+	}
+	if !clean {
+		log.Printf("%s: Virus scanner flagged upload of '%s' by '%s'\n", pageName, targetDB, userAcc)
+		http.Error(w, "The database was flagged by the virus scanner", http.StatusForbidden)
+		return
+	}
+
+	// New versions of an existing database need to pass its validation rules
+	violations, err := com.CheckValidationRules(r.Context(), userAcc, targetFolder, targetDB, tempDBName)
+	if err != nil {
+		http.Error(w, "Couldn't check the database's validation rules", http.StatusInternalServerError)
+		return
+	}
+	if len(violations) > 0 {
+		http.Error(w, com.ViolationsError(violations).Error(), http.StatusConflict)
+		return
+	}
+
+	// Don't create a new version identical to an existing one, unless asked to
+	if force, _ := strconv.ParseBool(r.Header.Get("force")); !force {
+		name, existing, err := com.DBVersionBySHA256(userAcc, userAcc, targetFolder, targetDB,
+			hex.EncodeToString(shaSum[:]))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Database query failure: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if existing != 0 && name == targetDB {
+			http.Error(w, fmt.Sprintf("No changes detected: this is identical to version %d of %s", existing,
+				r.URL.Path), http.StatusOK)
+			return
+		}
+	}
+
 	// Check if the database already exists
-	ver, err := com.HighestDBVersion(userAcc, targetDB, "/", userAcc)
+	ver, err := com.HighestDBVersion(userAcc, targetDB, targetFolder, userAcc)
 	if err != nil {
 		// No database with that folder/name exists yet
 		http.Error(w, fmt.Sprintf("Database query failure: %v", err), http.StatusInternalServerError)
@@ -350,7 +470,8 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 	}
 
 	// Store the database file in Minio
-	dbSize, err := com.StoreMinioObject(bucket, minioID, &tempBuf, "application/x-sqlite3")
+	dbSize := tempBuf.Len()
+	storedSize, err := com.StoreMinioObject(r.Context(), bucket, minioID, &tempBuf)
 	if err != nil {
 		log.Printf("%s: Storing file in Minio failed: %v\n", pageName, err)
 		http.Error(w, fmt.Sprintf("Storing file in Minio failed: %v\n", err),
@@ -358,8 +479,15 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		return
 	}
 
+	// New databases get a description worked out from their contents, as DB4S doesn't send one
+	var descrip string
+	if ver == 1 {
+		descrip = com.AutoDescription(tempDBName)
+	}
+
 	// Add the new database details to the PG database
-	err = com.AddDatabase(userAcc, "/", targetDB, ver, shaSum[:], dbSize, public, bucket, minioID, "", "")
+	err = com.AddDatabase(userAcc, targetFolder, targetDB, ver, shaSum[:], dbSize, storedSize, public, bucket, minioID,
+		descrip, "", commitMsg, "", "")
 	// TODO: Should we add support for setting the 1-liner and full description via DB4S too?
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Adding database to PostgreSQL failed: %v\n", err),
@@ -367,6 +495,32 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 		return
 	}
 
+	// Pick up the title, license, and column docs from the database's own metadata table, if it has one
+	err = com.ImportMetadataTable(tempDBName, userAcc, targetFolder, targetDB)
+	if err != nil {
+		log.Printf("%s: Error importing metadata table for '%s/%s': %v\n", pageName, userAcc, targetDB, err)
+	}
+
+	// Add the new version to the activity feeds, and let the database's webhooks know about it
+	err = com.RecordActivity(userAcc, com.FeedVersion, userAcc, targetFolder, targetDB, ver, "")
+	if err != nil {
+		log.Printf("%s: Error recording activity for '%s/%s': %v\n", pageName, userAcc, targetDB, err)
+	}
+	err = com.DBEvent(userAcc, targetFolder, targetDB, com.WebhookUpload, userAcc, map[string]interface{}{
+		"version":        ver,
+		"commit_message": commitMsg,
+	})
+	if err != nil {
+		log.Printf("%s: Error queueing webhooks for '%s/%s': %v\n", pageName, userAcc, targetDB, err)
+	}
+
+	// Let the users watching the database know too
+	err = com.NotifyWatchers(userAcc, targetFolder, targetDB, userAcc, fmt.Sprintf("Version %d of %s/%s was uploaded "+
+		"by %s", ver, userAcc, targetDB, userAcc))
+	if err != nil {
+		log.Printf("%s: Error notifying watchers of '%s/%s': %v\n", pageName, userAcc, targetDB, err)
+	}
+
 	// Log the successful database upload
 	log.Printf("Database uploaded: '%v'/'%v' version '%v', bytes: %v\n", userAcc, targetDB, ver, dbSize)
 
@@ -374,19 +528,19 @@ func putHandler(w http.ResponseWriter, r *http.Request, userAcc string) {
 	http.Error(w, fmt.Sprintf("Database created: %s", r.URL.Path), http.StatusCreated)
 }
 
-func retrieveDatabase(w http.ResponseWriter, pageName string, userAcc string, user string, database string,
-	version int) (err error) {
+func retrieveDatabase(w http.ResponseWriter, r *http.Request, pageName string, userAcc string, user string,
+	folder string, database string, version int) (err error) {
 	pageName += ":retrieveDatabase()"
 
 	// Retrieve the Minio bucket and id
-	bucket, id, err := com.MinioBucketID(user, database, version, userAcc)
+	bucket, id, err := com.MinioBucketID(user, folder, database, version, userAcc)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Get a handle from Minio for the database object
-	userDB, err := com.MinioHandle(bucket, id)
+	userDB, err := com.MinioHandle(r.Context(), bucket, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -412,40 +566,29 @@ func retrieveDatabase(w http.ResponseWriter, pageName string, userAcc string, us
 
 	// Log the transfer
 	log.Printf("%s: '%v' downloaded by user '%v', %v bytes", pageName, database, user, bytesWritten)
+
+	// Count the download for the usage statistics
+	com.RecordDownload(user, folder, database)
 	return nil
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	pageName := "Main page"
 
-	// Extract the account name and associated server from the validated client certificate
-	var certServer string
-	cn := r.TLS.PeerCertificates[0].Subject.CommonName
-	if cn == "" {
-		// Common name is empty
-		http.Error(w, "Common name is blank in client certificate", http.StatusBadRequest)
-		return
-	}
-	s := strings.Split(cn, "@")
-	if len(s) < 2 {
-		http.Error(w, "Missing information in client certificate", http.StatusBadRequest)
-		return
-	}
-	userAcc := s[0]
-	certServer = s[1]
-	if userAcc == "" || certServer == "" {
-		// Missing details in common name field
-		http.Error(w, "Missing information in client certificate", http.StatusBadRequest)
+	// Work out which user the validated client certificate belongs to, making sure it hasn't been revoked
+	cert := r.TLS.PeerCertificates[0]
+	userAcc, err := com.ClientCertUser(cert)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	// Verify the running server matches the one in the certificate
-	runningServer := com.DB4SServer()
-	if certServer != runningServer {
-		http.Error(w, fmt.Sprintf("Server name in certificate '%s' doesn't match running server '%s'\n",
-			certServer, runningServer), http.StatusBadRequest)
-		return
+	// Keep track of where the certificate is being used from, so the user can spot it being misused
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
 	}
+	com.RecordCertUse(com.ClientCertSerial(cert), ip, r.Method+" "+r.URL.Path)
 
 	// ** By this point we have a validated user, and know their username (in userAcc) **
 	reqType := r.Method
@@ -506,9 +649,8 @@ func userDatabaseList(pageName string, userAcc string, user string) (dbList []by
 			tempRow.URL = fmt.Sprintf("%s/%s/%s?version=%v", server, user,
 				url.PathEscape(j.Database), j.Version)
 		} else {
-			tempRow.Name = fmt.Sprintf("%s/%s", strings.TrimPrefix(j.Folder, "/"),
-				j.Database)
-			tempRow.URL = fmt.Sprintf("%s/%s%s/%s?version=%v", server, user, j.Folder,
+			tempRow.Name = strings.TrimPrefix(j.Folder, "/") + j.Database
+			tempRow.URL = fmt.Sprintf("%s/%s%s%s?version=%v", server, user, j.Folder,
 				url.PathEscape(j.Database), j.Version)
 		}
 		tempRow.Size = j.Size
@@ -1,19 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"archive/zip"
+	"context"
 	"crypto/sha256"
-	"encoding/csv"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
@@ -21,9 +28,12 @@ import (
 	"github.com/icza/session"
 	"github.com/rhinoman/go-commonmark"
 	com "github.com/sqlitebrowser/dbhub.io/common"
-	"golang.org/x/oauth2"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Name of the cookie holding the token of the last share link a visitor used
+const shareLinkCookie = "dbhub-share"
+
 var (
 	// Log file for incoming HTTPS requests
 	reqLog *os.File
@@ -32,810 +42,6883 @@ var (
 	tmpl *template.Template
 )
 
-// auth0CallbackHandler is called at the end of the Auth0 authentication process, whether successful or not.
-// If the authentication process was successful:
-//  * if the user already has an account on our system then this function creates a login session for them.
-//  * if the user doesn't yet have an account on our system, they're bounced to the username selection page.
-// If the authentication process wasn't successful, an error message is displayed.
-func auth0CallbackHandler(w http.ResponseWriter, r *http.Request) {
-	// Auth0 login part, mostly copied from https://github.com/auth0-samples/auth0-golang-web-app (MIT License)
-	conf := &oauth2.Config{
-		ClientID:     com.Auth0ClientID(),
-		ClientSecret: com.Auth0ClientSecret(),
-		RedirectURL:  "https://" + com.WebServer() + "/x/callback",
-		Scopes:       []string{"openid", "profile"},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://" + com.Auth0Domain() + "/authorize",
-			TokenURL: "https://" + com.Auth0Domain() + "/oauth/token",
-		},
+// Records the logged in user accepting the current terms of service and privacy policy.
+func acceptTermsHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
 	}
-	code := r.URL.Query().Get("code")
-	token, err := conf.Exchange(oauth2.NoContext, code)
-	if err != nil {
-		log.Printf("Login failure: %s\n", err.Error())
-		errorPage(w, r, http.StatusInternalServerError, "Login failed")
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "The terms need to be accepted using POST")
 		return
 	}
 
-	// Retrieve the user info (JSON format)
-	conn := conf.Client(oauth2.NoContext, token)
-	userInfo, err := conn.Get("https://" + com.Auth0Domain() + "/userinfo")
+	// Make sure the user is accepting the current version, in case a new one was published while they were reading
+	version, err := strconv.Atoi(r.PostFormValue("version"))
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, "Invalid terms version")
 		return
 	}
-	raw, err := ioutil.ReadAll(userInfo.Body)
-	defer userInfo.Body.Close()
+	current, err := com.CurrentTerms()
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
 	}
-
-	// Convert the JSON into something usable
-	var profile map[string]interface{}
-	if err = json.Unmarshal(raw, &profile); err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+	if version != current.Version {
+		http.Redirect(w, r, "/terms?next="+url.QueryEscape(r.PostFormValue("next")), http.StatusSeeOther)
 		return
 	}
-
-	// Extract the information we need
-	var auth0ID, email, nickName string
-	em := profile["email"]
-	if em != nil {
-		email = em.(string)
-	}
-	au := profile["user_id"]
-	if au != nil {
-		auth0ID = au.(string)
-	}
-	if auth0ID == "" {
-		log.Printf("Auth0 callback error: Auth0 ID string was empty. Email: %s\n", email)
-		errorPage(w, r, http.StatusInternalServerError, "Error: Auth0 ID string was empty")
+	err = com.AcceptTerms(loggedInUser, version)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't record acceptance of the terms")
 		return
 	}
-	ni := profile["nickname"]
-	if ni != nil {
-		nickName = ni.(string)
-	}
 
-	// If the user has an unverified email address, tell them to verify it before proceeding
-	ve := profile["email_verified"]
-	if ve != nil && ve.(bool) != true {
-		// TODO: Create a nicer notice page for this, as errorPage() doesn't look friendly
-		errorPage(w, r, http.StatusUnauthorized, "Please check your email.  You need to verify your "+
-			"email address before logging in will work.")
-		return
+	// Carry on to where the user was going.  Only local paths are allowed, so this can't be used as an open redirect
+	next := r.PostFormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/" + loggedInUser
 	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
 
-	// Determine the DBHub.io username matching the given Auth0 ID
-	userName, err := com.UserNameFromAuth0ID(auth0ID)
+// Returns a page of the recent activity on public databases as JSON, either across the whole site or for one user.
+// The next page is retrieved by passing the ID of the last entry received as "before".
+func activityHandler(w http.ResponseWriter, r *http.Request) {
+	userName := r.FormValue("user")
+	if userName != "" {
+		err := com.ValidateUser(userName)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+			return
+		}
+	}
+	var before int64
+	if b := r.FormValue("before"); b != "" {
+		var err error
+		before, err = strconv.ParseInt(b, 10, 64)
+		if err != nil || before < 0 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid activity ID")
+			return
+		}
+	}
+	list, err := com.Activity(userName, before, com.FeedLength)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-
-	// If the user doesn't already exist, we need to create an account for them
-	if userName == "" {
-		if email != "" {
-			// Check if the email address is already in our system
-			exists, err := com.CheckEmailExists(email)
-			if err != nil {
-				errorPage(w, r, http.StatusInternalServerError, "Email check failed")
-				return
-			}
-			if exists {
-				errorPage(w, r, http.StatusConflict,
-					"Can't create new account: Your email address is already associated "+
-						"with a different account in our system.")
-				return
-			}
-		}
-		// Create a special session cookie, purely for the registration page
-		sess := session.NewSessionOptions(&session.SessOptions{
-			CAttrs: map[string]interface{}{
-				"registrationinprogress": true,
-				"auth0id":                auth0ID,
-				"email":                  email,
-				"nickname":               nickName},
-		})
-		session.Add(sess, w)
-
-		// Bounce to a new page, for the user to select their preferred username
-		http.Redirect(w, r, "/selectusername", http.StatusTemporaryRedirect)
+	if list == nil {
+		list = []com.FeedEntry{}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
 
-	// Create session cookie for the user
-	sess := session.NewSessionOptions(&session.SessOptions{
-		CAttrs: map[string]interface{}{"UserName": userName},
-	})
-	session.Add(sess, w)
-
-	// Login completed, so bounce to the users' profile page
-	http.Redirect(w, r, "/"+userName, http.StatusTemporaryRedirect)
+// Returns a short description of an activity feed entry, such as "justinclift starred justinclift/Marine Litter".
+func activityTitle(e com.FeedEntry) string {
+	db := fmt.Sprintf("%s/%s", e.DBOwner, e.DBName)
+	switch e.Action {
+	case com.FeedVersion:
+		return fmt.Sprintf("%s uploaded version %d of %s", e.User, e.Version, db)
+	case com.FeedStar:
+		return fmt.Sprintf("%s starred %s", e.User, db)
+	case com.FeedFork:
+		return fmt.Sprintf("%s forked %s to %s", e.User, db, e.Detail)
+	case com.FeedRename:
+		return fmt.Sprintf("%s renamed %s to %s", e.User, e.Detail, db)
+	}
+	return fmt.Sprintf("%s updated %s", e.User, db)
 }
 
-func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	// Make sure this user creation session is valid
-	sess := session.Get(r)
-	if sess == nil {
-		// This isn't a valid username selection session, so abort
-		errorPage(w, r, http.StatusBadRequest, "Invalid user creation session")
-		return
-	}
+// Returns the commit history of a database as JSON.  Requests are in the form /api/v1/commits/<owner>/<database>.
+func apiCommitsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API commit list"
 
-	validRegSession := false
-	va := sess.CAttr("registrationinprogress")
-	if va == nil {
-		// This isn't a valid username selection session, so abort
-		errorPage(w, r, http.StatusBadRequest, "Invalid user creation session")
+	dbOwner, dbName, err := com.GetOD(3, r) // 3 = Ignore "/api/v1/commits/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	validRegSession = va.(bool)
-
-	if validRegSession != true {
-		// This isn't a valid username selection session, so abort
-		errorPage(w, r, http.StatusBadRequest, "Invalid user creation session")
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Retrieve the registration data
-	var auth0ID, email string
-	au := sess.CAttr("auth0id")
-	if au != nil {
-		auth0ID = au.(string)
-	} else {
-		errorPage(w, r, http.StatusBadRequest, "Invalid user creation id")
+	loggedInUser, err := apiUser(w, r)
+	if err != nil {
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
-	em := sess.CAttr("email")
-	if em != nil {
-		email = em.(string)
-	} else {
-		errorPage(w, r, http.StatusBadRequest, "Invalid user creation email")
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
 		return
 	}
-
-	// Gather submitted form data (if any)
-	err := r.ParseForm()
+	list, err := com.DBCommits(loggedInUser, dbOwner, dbFolder, dbName)
 	if err != nil {
-		log.Printf("Error when parsing user creation data: %s\n", err)
-		errorPage(w, r, http.StatusBadRequest, "Error when parsing user creation data")
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
 	}
-	userName := r.PostFormValue("username")
-
-	// Ensure username was given
-	if userName == "" {
-		// No, so render the username selection page
-		selectUsernamePage(w, r)
+	if len(list) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
 		return
 	}
+	writeJSON(w, r, pageName, list)
+}
 
-	// Validate the user supplied username
-	err = com.ValidateUser(userName)
+// Returns the contributor statistics of a database as JSON.  Requests are in the form
+// /api/v1/contributors/<owner>/<database>.
+func apiContributorsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API contributor list"
+
+	dbOwner, dbName, err := com.GetOD(3, r) // 3 = Ignore "/api/v1/contributors/" at the start of the URL
 	if err != nil {
-		log.Printf("Username failed validation: %s", err)
-		session.Remove(sess, w)
-		errorPage(w, r, http.StatusBadRequest, "Username failed validation")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Ensure the username isn't a reserved one
-	err = com.ReservedUsernamesCheck(userName)
+	dbFolder, err := com.GetFolder(r)
 	if err != nil {
-		log.Println(err)
-		session.Remove(sess, w)
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Check if the username is already in our system
-	exists, err := com.CheckUserExists(userName)
+	loggedInUser, err := apiUser(w, r)
 	if err != nil {
-		session.Remove(sess, w)
-		errorPage(w, r, http.StatusInternalServerError, "Username check failed")
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
-	if exists {
-		session.Remove(sess, w)
-		errorPage(w, r, http.StatusConflict, "That username is already taken")
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
 		return
 	}
-
-	// Add the user to the system
-	// NOTE: We generate a random password here (for now).  We may remove the password field itself from the
-	// database at some point, depending on whether we continue to support local database users
-	err = com.AddUser(auth0ID, userName, com.RandomString(32), email)
+	list, err := com.DBContributors(loggedInUser, dbOwner, dbFolder, dbName)
 	if err != nil {
-		session.Remove(sess, w)
-		errorPage(w, r, http.StatusInternalServerError, "Something went wrong during user creation")
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
 	}
-
-	// Remove the temporary username selection session data
-	session.Remove(sess, w)
-
-	// Create normal session cookie for the user
-	// TODO: This will probably leak a small amount of memory, but it's "good enough" for now while getting things
-	// working
-	sess = session.NewSessionOptions(&session.SessOptions{
-		CAttrs: map[string]interface{}{"UserName": userName},
-	})
-	session.Add(sess, w)
-
-	// User creation completed, so bounce to the user's profile page
-	http.Redirect(w, r, "/"+userName, http.StatusTemporaryRedirect)
+	if len(list) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+	writeJSON(w, r, pageName, list)
 }
 
-// This is called from the username selection page, to check if a name is available.
-func checkNameHandler(w http.ResponseWriter, r *http.Request) {
-	// Retrieve the potential username from the URL
-	err := r.ParseForm()
-	userName := r.FormValue("name")
-
-	// Validate the user supplied username
-	err = com.ValidateUser(userName)
+// Returns the details of a database as JSON.  Requests are in the form /api/v1/database/<owner>/<database>, with an
+// optional version number.
+func apiDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	dbOwner, dbName, dbVersion, err := com.GetODV(3, r) // 3 = Ignore "/api/v1/database/" at the start of the URL
 	if err != nil {
-		fmt.Fprint(w, "n")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Ensure the username isn't a reserved one
-	err = com.ReservedUsernamesCheck(userName)
+	dbFolder, err := com.GetFolder(r)
 	if err != nil {
-		fmt.Fprint(w, "n")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	databaseJSON(w, r, dbOwner, dbFolder, dbName, dbVersion)
+}
 
-	// Check if the username is already in our system
-	exists, err := com.CheckUserExists(userName)
+// Returns the list of databases belonging to a user as JSON.  Private databases are only included when the user is
+// the one asking.
+func apiDatabasesHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API database list"
+
+	userName := strings.TrimPrefix(r.URL.Path, "/api/v1/databases/")
+	err := com.ValidateUser(userName)
 	if err != nil {
-		fmt.Fprint(w, "n")
+		errorPage(w, r, http.StatusBadRequest, "Invalid user name")
 		return
 	}
-	if exists {
-		fmt.Fprint(w, "n")
+	loggedInUser, err := apiUser(w, r)
+	if err != nil {
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
-
-	// The username is available
-	fmt.Fprint(w, "y")
-	return
-}
-
-func downloadCertHandler(w http.ResponseWriter, r *http.Request) {
-	// Retrieve session data (if any)
-	var loggedInUser string
-	validSession := false
-	sess := session.Get(r)
-	if sess != nil {
-		u := sess.CAttr("UserName")
-		if u != nil {
-			loggedInUser = u.(string)
-			validSession = true
-		} else {
-			session.Remove(sess, w)
-		}
+	exists, err := com.CheckUserExists(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
 	}
-
-	// Ensure we have a valid logged in user
-	if validSession != true {
-		// No logged in user, so error out
-		errorPage(w, r, http.StatusBadRequest, "Not logged in")
+	if !exists {
+		errorPage(w, r, http.StatusNotFound, "Unknown user")
 		return
 	}
 
-	// Retrieve the client certificate from the PG database
-	cert, err := com.ClientCert(loggedInUser)
+	access := com.DB_PUBLIC
+	if loggedInUser == userName {
+		access = com.DB_BOTH
+	}
+	dbList, err := com.UserDBs(userName, access)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, fmt.Sprintf("Retrieving client cert from "+
-			"database failed for user: %v", loggedInUser))
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
 	}
-
-	// Send the client certificate to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
-		loggedInUser+".cert.pem"))
-	// Note, don't use "application/x-x509-user-cert", otherwise the browser may try to install it!
-	// Useful reference info: https://pki-tutorial.readthedocs.io/en/latest/mime.html
-	w.Header().Set("Content-Type", "application/x-pem-file")
-	w.Write(cert)
-	return
+	list := []com.DBListJSON{}
+	for _, db := range dbList {
+		list = append(list, com.DBListJSON{
+			Description:  strings.TrimPrefix(db.Description, ": "),
+			Folder:       db.Folder,
+			Forks:        db.Forks,
+			LastModified: db.LastModified,
+			Name:         db.Database,
+			Public:       db.Public,
+			SHA256:       db.SHA256,
+			Size:         db.Size,
+			Stars:        db.Stars,
+			Version:      db.Version,
+			Watchers:     db.Watchers,
+		})
+	}
+	writeJSON(w, r, pageName, list)
 }
 
-func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Download CSV"
-
-	// Extract the username, database, table, and version requested
-	dbOwner, dbName, dbTable, dbVersion, err := com.GetODTV(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+// Works out which database version an API request is for, and checks the user has access to it.  Returns the Minio
+// bucket and ID of the version, or false if an error has already been sent.
+func apiDBVersion(w http.ResponseWriter, r *http.Request) (bucket string, id string, ok bool) {
+	dbOwner, dbName, dbVersion, err := com.GetODV(3, r) // 3 = Ignore "/api/v1/<endpoint>/" at the start of the URL
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Abort if no table name was given
-	if dbTable == "" {
-		log.Printf("%s: No table name given\n", pageName)
-		errorPage(w, r, http.StatusBadRequest, "No table name given")
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		u := sess.CAttr("UserName")
-		if u != nil {
-			loggedInUser = u.(string)
-		} else {
-			session.Remove(sess, w)
-		}
-	}
-
-	// Verify the given database exists and is ok to be downloaded (and get the Minio bucket + id while at it)
-	bucket, id, err := com.MinioBucketID(dbOwner, dbName, int(dbVersion), loggedInUser)
+	loggedInUser, err := apiUser(w, r)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
-
-	// Get a handle from Minio for the database object
-	sdb, err := com.OpenMinioObject(bucket, id)
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+	dbVersion, err = commitVersion(r, loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
 	if err != nil {
-		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		errorPage(w, r, http.StatusNotFound, err.Error())
 		return
 	}
 
-	// Read the table data from the database object
-	resultSet, err := com.ReadSQLiteDBCSV(sdb, dbTable)
-
-	// Convert resultSet into CSV and send to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", url.QueryEscape(dbTable)))
-	w.Header().Set("Content-Type", "text/csv")
-	csvFile := csv.NewWriter(w)
-	err = csvFile.WriteAll(resultSet)
-	if err != nil {
-		log.Printf("%s: Error when generating CSV: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Error when generating CSV")
+	// If no version number was given, use the highest one available to the user
+	if dbVersion == 0 {
+		dbVersion, err = com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+	}
+	if dbVersion != 0 {
+		bucket, id, err = com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if id == "" {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
 		return
 	}
+	return bucket, id, true
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Download Handler"
+// Returns the columns of each table in a database version as JSON.  Requests are in the form
+// /api/v1/schema/<owner>/<database>, with an optional version number.
+func apiSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API schema"
 
-	dbOwner, dbName, dbVersion, err := com.GetODV(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+	bucket, id, ok := apiDBVersion(w, r)
+	if !ok {
+		return
+	}
+	sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Retrieve session data (if any)
-	var loggedInUser string
-	sess := session.Get(r)
-	if sess != nil {
-		u := sess.CAttr("UserName")
-		if u != nil {
-			loggedInUser = u.(string)
-		} else {
-			session.Remove(sess, w)
-		}
+	defer com.ReleaseSQLiteHandle(sdb)
+	schema, err := com.TableSchema(sdb)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
+		return
 	}
+	writeJSON(w, r, pageName, schema)
+}
 
-	// Verify the given database exists and is ok to be downloaded (and get the Minio bucket + id while at it)
-	bucket, id, err := com.MinioBucketID(dbOwner, dbName, dbVersion, loggedInUser)
+// Returns the status checks posted against a database version as JSON, or posts a new one.  Requests are in the form
+// /api/v1/statuses/<owner>/<database>?commit=<commit id>.  New checks are sent using POST, with the state, context,
+// target_url, and description form fields, and need write access to the database.
+func apiStatusesHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API status checks"
+
+	dbOwner, dbName, err := com.GetOD(3, r) // 3 = Ignore "/api/v1/statuses/" at the start of the URL
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Get a handle from Minio for the database object
-	userDB, err := com.MinioHandle(bucket, id)
+	dbFolder, err := com.GetFolder(r)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	commit := r.URL.Query().Get("commit")
+	err = com.ValidateCommitID(commit)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid commit ID")
 		return
 	}
 
-	// Close the object handle when this function finishes
-	defer func() {
-		com.MinioHandleClose(userDB)
-	}()
-
-	// Send the database to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(dbName)))
-	w.Header().Set("Content-Type", "application/x-sqlite3")
-	bytesWritten, err := io.Copy(w, userDB)
+	// Work out who's making the request.  Posting a check needs write access, while reading them only needs the
+	// database to be visible to the user
+	var loggedInUser string
+	if r.Method == "POST" {
+		var ok bool
+		loggedInUser, ok = writeAccess(w, r, dbOwner, dbFolder, dbName)
+		if !ok {
+			return
+		}
+	} else {
+		loggedInUser, err = apiUser(w, r)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if takenDown(w, r, dbOwner, dbFolder, dbName) {
+			return
+		}
+	}
+	commitID, err := com.StatusCheckCommit(loggedInUser, dbOwner, dbFolder, dbName, commit)
 	if err != nil {
-		log.Printf("%s: Error returning DB file: %v\n", pageName, err)
-		fmt.Fprintf(w, "%s: Error returning DB file: %v\n", pageName, err)
+		errorPage(w, r, http.StatusNotFound, err.Error())
 		return
 	}
 
-	// Log the number of bytes written
-	log.Printf("%s: '%s/%s' downloaded. %d bytes", pageName, dbOwner, dbName, bytesWritten)
+	if r.Method == "POST" {
+		s := com.StatusCheck{
+			CommitID:    commitID,
+			Context:     strings.TrimSpace(r.PostFormValue("context")),
+			CreatedBy:   loggedInUser,
+			Description: strings.TrimSpace(r.PostFormValue("description")),
+			State:       r.PostFormValue("state"),
+			TargetURL:   strings.TrimSpace(r.PostFormValue("target_url")),
+		}
+		err = com.ValidateStatusCheck(s)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = com.SetStatusCheck(dbOwner, dbFolder, dbName, s)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when saving the status check")
+			return
+		}
+	}
+	list, err := com.StatusChecks(dbOwner, dbFolder, dbName, commitID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if list == nil {
+		list = []com.StatusCheck{}
+	}
+	writeJSON(w, r, pageName, list)
 }
 
-// Forks a database for the logged in user.
-func forkDBHandler(w http.ResponseWriter, r *http.Request) {
-
-	// TODO: This function will need updating to support folders
+// Returns the list of tables in a database version as JSON.  Requests are in the form
+// /api/v1/tables/<owner>/<database>, with an optional version number.
+func apiTablesHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API table list"
 
-	// Retrieve user and database name
-	dbOwner, dbName, dbVer, err := com.GetODV(2, r) // 2 = Ignore "/x/forkdb/" at the start of the URL
+	bucket, id, ok := apiDBVersion(w, r)
+	if !ok {
+		return
+	}
+	sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Make sure a version number was given
-	if dbVer == 0 {
-		errorPage(w, r, http.StatusBadRequest, "No database version number given")
+	defer com.ReleaseSQLiteHandle(sdb)
+	tables, err := com.Tables(sdb, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
 		return
 	}
+	if tables == nil {
+		tables = []string{}
+	}
+	writeJSON(w, r, pageName, tables)
+}
 
-	// Retrieve session data (if any)
+// Creates a personal API token for the logged in user, returning it as JSON.  This is the only time the token itself
+// is available, as only its hash is stored.
+func apiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API token handler"
+
+	// Ensure we have a valid logged in user
 	var loggedInUser string
-	validSession := false
 	sess := session.Get(r)
 	if sess != nil {
 		u := sess.CAttr("UserName")
 		if u != nil {
 			loggedInUser = u.(string)
-			validSession = true
 		} else {
 			session.Remove(sess, w)
 		}
 	}
-
-	// Ensure we have a valid logged in user
-	if validSession != true {
-		// No logged in username, so nothing to update
-		errorPage(w, r, http.StatusBadRequest, "To fork a database, you need to be logged in")
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "API tokens need to be created using POST")
 		return
 	}
 
-	// Check the user has access to the specific version of the source database requested
-	allowed, err := com.CheckUserDBVAccess(dbOwner, "/", dbName, dbVer, loggedInUser)
-	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+	// Validate the token details
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" || len(name) > 100 {
+		errorPage(w, r, http.StatusBadRequest, "API tokens need a name of up to 100 characters")
 		return
 	}
-	if !allowed {
-		errorPage(w, r, http.StatusBadRequest, "You don't have access to the requested database version")
+	var scopes []string
+	for _, s := range strings.Fields(r.PostFormValue("scope")) {
+		if s != com.OAuthScopeRead && s != com.OAuthScopeWrite {
+			errorPage(w, r, http.StatusBadRequest, "Unknown scope")
+			return
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		errorPage(w, r, http.StatusBadRequest, "API tokens need at least one scope")
 		return
 	}
+	var expiry *time.Time
+	if days := r.PostFormValue("expiry"); days != "" && days != "never" {
+		d, err := strconv.Atoi(days)
+		if err != nil || d < 1 || d > 365 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid expiry time")
+			return
+		}
+		e := time.Now().Add(time.Duration(d) * 24 * time.Hour)
+		expiry = &e
+	}
 
-	// Make sure the source and destination owners are different
-	if loggedInUser == dbOwner {
-		errorPage(w, r, http.StatusBadRequest, "Forking your own database in-place doesn't make sense")
+	id, token, err := com.CreateAPIToken(loggedInUser, name, strings.Join(scopes, " "), expiry)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't create the API token")
 		return
 	}
+	writeJSON(w, r, pageName, map[string]interface{}{
+		"expiry": expiry,
+		"id":     id,
+		"name":   name,
+		"scope":  strings.Join(scopes, " "),
+		"token":  token,
+	})
+}
+
+// Returns the user making an API request, from either their session or an OAuth access token.  An empty string means
+// the request is anonymous.
+func apiUser(w http.ResponseWriter, r *http.Request) (string, error) {
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			return u.(string), nil
+		}
+		session.Remove(sess, w)
+	}
+	return oauthUser(r, com.OAuthScopeRead)
+}
 
-	// Make sure the user doesn't have a database of the same name already
-	v, err := com.HighestDBVersion(loggedInUser, dbName, "/", loggedInUser)
+// Returns the versions of a database available to the user as JSON, newest first.  Requests are in the form
+// /api/v1/versions/<owner>/<database>?folder=<folder>.
+func apiVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "API version list"
+
+	dbOwner, dbName, err := com.GetOD(3, r) // 3 = Ignore "/api/v1/versions/" at the start of the URL
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	if v != 0 {
-		// Database of the same name already exists
-		errorPage(w, r, http.StatusBadRequest, "You already have a database of this name")
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Get the Minio bucket and id for the database being forked (the source)
-	sourceBucket, sourceID, err := com.MinioBucketID(dbOwner, dbName, dbVer, loggedInUser)
+	loggedInUser, err := apiUser(w, r)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
 		return
 	}
-
-	// Get the Minio bucket for the logged in user (the destination)
-	destBucket, err := com.MinioUserBucket(loggedInUser)
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+	list, err := com.DBVersionDetails(loggedInUser, dbOwner, dbFolder, dbName)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if len(list) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
 		return
 	}
+	writeJSON(w, r, pageName, list)
+}
 
-	// Copy the Minio object to the destination bucket
-	destMinioID, err := com.MinioObjCopy(sourceBucket, sourceID, destBucket)
+// Appends the rows of CSV data sent in the request body to a table of a live database, returning the number of rows
+// added as JSON.  Requests are in the form /x/appendcsv/<owner>/<database>?table=<table>, and the first CSV row
+// names the columns the values are for.
+func appendCSVHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Append CSV handler"
+
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/appendcsv/" at the start of the URL
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Add the forked database info to PostgreSQL
-	_, err = com.ForkDatabase(dbOwner, "/", dbName, dbVer, loggedInUser, "/", destMinioID)
+	dbFolder, err := com.GetFolder(r)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "CSV data needs to be sent using POST")
+		return
+	}
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		errorPage(w, r, http.StatusBadRequest, "No table given")
 		return
 	}
 
-	// Invalidate the old memcached entry for the database
-	err = com.InvalidateCacheEntry(loggedInUser, dbOwner, "/", dbName, 0) // 0 indicates "for all versions"
+	loggedInUser, db, ok := liveWriteAccess(w, r, dbOwner, dbFolder, dbName)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, com.LiveCSVMaxSize)
+	rows, err := com.AppendLiveCSV(r.Context(), db, loggedInUser, table, r.Body)
 	if err != nil {
-		// Something went wrong when invalidating memcached entries for the database
-		log.Printf("Error when invalidating memcache entries: %s\n", err.Error())
+		log.Printf("%s: Appending CSV rows to '%s%s%s' failed after %d rows: %v\n", pageName, dbOwner, dbFolder,
+			dbName, rows, err)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	// Log the database fork
-	log.Printf("Database '%s/%s' forked to user '%s'\n", dbOwner, dbName, loggedInUser)
-
-	// Bounce to the page of the forked database
-	http.Redirect(w, r, "/"+loggedInUser+"/"+dbName, http.StatusTemporaryRedirect)
+	writeJSON(w, r, pageName, map[string]int64{"rows_appended": rows})
 }
 
-// Present the forks page to the user
-func forksHandler(w http.ResponseWriter, r *http.Request) {
-	// Retrieve user and database name
-	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/forks/" at the start of the URL
+// Archives or unarchives a database belonging to the logged in user.  Archived databases are read-only, but can
+// still be viewed, downloaded and forked.
+func archiveDBHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Databases need to be archived using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	archive, err := strconv.ParseBool(r.PostFormValue("archive"))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid archive value")
+		return
+	}
 
-	// Render the forks page
-	forksPage(w, r, dbOwner, "/", dbName)
+	// Only the owner (or an admin of the owning organisation) can archive a database
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	err = com.SetDBArchived(dbOwner, dbFolder, dbName, archive)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when changing the archived status of the database")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/%s%s%s", dbOwner, dbFolder, dbName), http.StatusSeeOther)
 }
 
-// Generates a client certificate for the user and gives it to the browser.
-func generateCertHandler(w http.ResponseWriter, r *http.Request) {
+// Sends a file attached to a database README.  Attachments can be seen by anyone who can see the database.
+func attachmentHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve session data (if any)
 	var loggedInUser string
-	validSession := false
 	sess := session.Get(r)
 	if sess != nil {
 		u := sess.CAttr("UserName")
 		if u != nil {
 			loggedInUser = u.(string)
-			validSession = true
 		} else {
 			session.Remove(sess, w)
 		}
 	}
 
-	// Ensure we have a valid logged in user
-	if validSession != true {
-		// No logged in user, so error out
-		errorPage(w, r, http.StatusBadRequest, "Not logged in")
+	id := strings.TrimPrefix(r.URL.Path, "/x/attachment/")
+	a, found, err := com.AttachmentDetails(id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-
-	// Generate a new certificate
-	// TODO: Use 14 days for now.  Extend this when things work properly.
-	newCert, err := com.GenerateClientCert(loggedInUser, 14)
-	if err != nil {
-		log.Printf("Error generating client certificate for user '%s': %s!\n", loggedInUser, err)
-		http.Error(w, fmt.Sprintf("Error generating client certificate for user '%s': %s!\n",
-			loggedInUser, err), http.StatusInternalServerError)
+	if !found {
+		errorPage(w, r, http.StatusNotFound, "Unknown attachment")
+		return
+	}
+	if !a.Public && strings.ToLower(loggedInUser) != strings.ToLower(a.Owner) {
+		// Private databases can also be seen by the users they've been shared with
+		access := ""
+		if loggedInUser != "" {
+			access, err = com.DBShareAccess(a.Owner, a.Folder, a.DBName, loggedInUser)
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+				return
+			}
+		}
+		if access == "" {
+			errorPage(w, r, http.StatusNotFound, "Unknown attachment")
+			return
+		}
+	}
+	if takenDown(w, r, a.Owner, a.Folder, a.DBName) {
 		return
 	}
 
-	// Store the new certificate in the database
-	err = com.SetClientCert(newCert, loggedInUser)
+	obj, err := com.MinioHandle(r.Context(), a.MinioBkt, a.MinioID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Updating client certificate failed: %v", err),
-			http.StatusInternalServerError)
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve the attachment")
 		return
 	}
+	defer com.MinioHandleClose(obj)
 
-	// Send the client certificate to the user
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
-		loggedInUser+".cert.pem"))
-	// Note, don't use "application/x-x509-user-cert", otherwise the browser may try to install it!
-	// Useful reference info: https://pki-tutorial.readthedocs.io/en/latest/mime.html
-	w.Header().Set("Content-Type", "application/x-pem-file")
-	w.Write(newCert)
-	return
+	// Only images are shown in the browser, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(a.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, a.FileName))
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !a.Public {
+		w.Header().Set("Cache-Control", "private")
+	}
+	_, err = io.Copy(w, obj)
+	if err != nil {
+		log.Printf("Error sending attachment '%s': %v\n", id, err)
+	}
 }
 
-// Removes the logged in users session information.
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Remove session info
-	sess := session.Get(r)
-	if sess != nil {
-		// Session data was present, so remove it
-		session.Remove(sess, w)
+// Sends the uploaded avatar of a user, or redirects to their Gravatar if they haven't uploaded one.  Requests are in
+// the form /x/avatar/<user>.
+func avatarHandler(w http.ResponseWriter, r *http.Request) {
+	userName := strings.TrimPrefix(r.URL.Path, "/x/avatar/")
+	err := com.ValidateUser(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+		return
+	}
+	bucket, minioID, err := com.UserAvatar(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if minioID == "" {
+		profile, err := com.UserProfileDetails(userName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		http.Redirect(w, r, profile.AvatarURL, http.StatusFound)
+		return
 	}
 
-	// Bounce to the front page
-	// TODO: This should probably reload the existing page instead
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	obj, err := com.MinioHandle(r.Context(), bucket, minioID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve the avatar")
+		return
+	}
+	defer com.MinioHandleClose(obj)
+	data, err := ioutil.ReadAll(io.LimitReader(obj, com.AvatarMaxSize))
+	if err != nil {
+		log.Printf("Error reading avatar of user '%s': %v\n", userName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve the avatar")
+		return
+	}
+	contentType, err := com.AvatarContentType(data)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve the avatar")
+		return
+	}
+
+	// The address of an avatar changes along with it, so it can be cached for a long time
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
 }
 
-// Wrapper function to log incoming https requests.
-func logReq(fn http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Check if user is logged in
-		var loggedInUser string
-		sess := session.Get(r)
-		if sess != nil {
-			u := sess.CAttr("UserName")
-			if u != nil {
-				loggedInUser = u.(string)
-			} else {
-				loggedInUser = "-"
-			}
-		} else {
-			loggedInUser = "-"
-		}
+// Returns a small SVG badge for a public database, showing its star count, latest version, or download count, for
+// embedding in README files elsewhere.  eg /x/badge/justinclift/Marine%20Litter%20Survey.sqlite.svg?type=stars
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the owner and database name, with the ".svg" suffix removed
+	pathStrings := strings.Split(strings.TrimSuffix(r.URL.Path, ".svg"), "/")
+	if len(pathStrings) != 5 || !strings.HasSuffix(r.URL.Path, ".svg") {
+		errorPage(w, r, http.StatusBadRequest, "Invalid URL")
+		return
+	}
+	dbOwner, dbName := pathStrings[3], pathStrings[4]
+	err := com.ValidateUserDB(dbOwner, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid owner or database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	badgeType := r.FormValue("type")
+	if badgeType == "" {
+		badgeType = "version"
+	}
+	if badgeType != "downloads" && badgeType != "stars" && badgeType != "version" {
+		errorPage(w, r, http.StatusBadRequest, "Unknown badge type")
+		return
+	}
 
-		// Write request details to the request log
-		fmt.Fprintf(reqLog, "%v - %s [%s] \"%s %s %s\" \"-\" \"-\" \"%s\" \"%s\"\n", r.RemoteAddr,
-			loggedInUser, time.Now().Format(time.RFC3339Nano), r.Method, r.URL, r.Proto,
-			r.Referer(), r.Header.Get("User-Agent"))
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
 
-		// Call the original function
-		fn(w, r)
+	// Badges are displayed by other sites, so they're only available for public databases.  A badge is still
+	// returned when the database can't be found, so the embedding page shows something sensible
+	var db com.SQLiteDBinfo
+	err = com.DBDetails(r.Context(), &db, "", dbOwner, dbFolder, dbName, 0)
+	if err != nil {
+		writeBadge(w, http.StatusNotFound, badgeType, "not found", "#9f9f9f")
+		return
 	}
+	var value string
+	switch badgeType {
+	case "downloads":
+		downloads, err := com.DBDownloads(dbOwner, dbFolder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		value = fmt.Sprintf("%d", downloads)
+	case "stars":
+		value = fmt.Sprintf("%d", db.Info.Stars)
+	case "version":
+		value = fmt.Sprintf("v%d", db.Info.Version)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeBadge(w, http.StatusOK, badgeType, value, "#007ec6")
 }
 
-func main() {
-	// Read server configuration
-	var err error
-	if err = com.ReadConfig(); err != nil {
-		log.Fatalf("Configuration file problem\n\n%v", err)
+// Returns the announcement banners to display to a user.  This is called by the page header template, so it can't
+// return an error, and instead just logs it.
+func banners(loggedInUser string) []com.Announcement {
+	list, err := com.ActiveAnnouncements(loggedInUser)
+	if err != nil {
+		log.Printf("Error retrieving announcement banners: %v\n", err)
+		return nil
 	}
+	return list
+}
+
+// Shows which version last changed each row of a table.  Requests are in the form
+// /blame/<owner>/<database>?table=<table>, optionally with the version to start from and the key of the row to show.
+func blameHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Blame handler"
 
-	// Open the request log for writing
-	reqLog, err = os.OpenFile(com.WebRequestLog(), os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0750)
+	// Retrieve user, folder, database, and table name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/blame/" at the start of the URL
 	if err != nil {
-		log.Fatalf("Error when opening request log: %s\n", err)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
-	defer reqLog.Close()
-	log.Printf("Request log opened: %s\n", com.WebRequestLog())
-
-	// Setup session storage
-	session.Global.Close()
-	session.Global = session.NewCookieManagerOptions(session.NewInMemStore(),
-		&session.CookieMngrOptions{AllowHTTP: false})
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbTable, err := com.GetTable(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if dbTable == "" {
+		errorPage(w, r, http.StatusBadRequest, "No table name given")
+		return
+	}
+	key := r.Form["key"]
 
-	// Parse our template files
-	tmpl = template.Must(template.New("templates").Delims("[[", "]]").ParseGlob("webui/templates/*.html"))
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
 
-	// Connect to Minio server
-	err = com.ConnectMinio()
+	// The rows are paged, using the same number of rows as the table view
+	maxRows, err := requestedRows(r, loggedInUser)
 	if err != nil {
-		log.Fatalf(err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var rowOffset int
+	if r.FormValue("offset") != "" {
+		rowOffset, err = strconv.Atoi(r.FormValue("offset"))
+		if err != nil || rowOffset < 0 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid row offset")
+			return
+		}
 	}
 
-	// Connect to PostgreSQL server
-	err = com.ConnectPostgreSQL()
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// The version defaults to the latest one
+	commits, err := com.DBCommits(loggedInUser, dbOwner, dbFolder, dbName)
 	if err != nil {
-		log.Fatalf(err.Error())
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if len(commits) == 0 {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+	dbVersion := commits[0].Version
+	if r.FormValue("version") != "" {
+		dbVersion, err = strconv.Atoi(r.FormValue("version"))
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+			return
+		}
 	}
 
-	// Connect to cache server
-	err = com.ConnectCache()
+	// Working out the blame means comparing every version in the history, so the result is cached in memcache
+	dataCacheKey := com.TableRowsCacheKey(fmt.Sprintf("blame/%d/%q", rowOffset, key), loggedInUser, dbOwner,
+		dbFolder, dbName, dbVersion, dbTable, maxRows)
+	var blame com.TableBlame
+	ok, err := com.GetCachedData(r.Context(), dataCacheKey, &blame)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Printf("%s: Error retrieving blame from cache: %v\n", pageName, err)
 	}
+	if !ok {
+		blame, err = com.BlameTable(r.Context(), loggedInUser, dbOwner, dbFolder, dbName, dbTable, commits,
+			dbVersion, key, rowOffset, maxRows)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
 
-	// Our pages
-	http.HandleFunc("/", logReq(mainHandler))
-	http.HandleFunc("/about", logReq(aboutPage))
-	http.HandleFunc("/forks/", logReq(forksHandler))
-	http.HandleFunc("/logout", logReq(logoutHandler))
-	http.HandleFunc("/pref", logReq(prefHandler))
-	http.HandleFunc("/register", logReq(createUserHandler))
-	http.HandleFunc("/selectusername", logReq(selectUsernamePage))
-	http.HandleFunc("/settings/", logReq(settingsPage))
-	http.HandleFunc("/stars/", logReq(starsHandler))
-	http.HandleFunc("/upload/", logReq(uploadFormHandler))
-	http.HandleFunc("/x/callback", logReq(auth0CallbackHandler))
-	http.HandleFunc("/x/checkname", logReq(checkNameHandler))
-	http.HandleFunc("/x/download/", logReq(downloadHandler))
-	http.HandleFunc("/x/downloadcert", logReq(downloadCertHandler))
-	http.HandleFunc("/x/downloadcsv/", logReq(downloadCSVHandler))
-	http.HandleFunc("/x/forkdb/", logReq(forkDBHandler))
-	http.HandleFunc("/x/gencert", logReq(generateCertHandler))
-	http.HandleFunc("/x/markdownpreview/", logReq(markdownPreview))
-	http.HandleFunc("/x/savesettings", logReq(saveSettingsHandler))
-	http.HandleFunc("/x/star/", logReq(starToggleHandler))
-	http.HandleFunc("/x/table/", logReq(tableViewHandler))
-	http.HandleFunc("/x/uploaddata/", logReq(uploadDataHandler))
+		// Cache the blame in memcache
+		err = com.CacheData(r.Context(), dataCacheKey, blame, com.CacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching blame: %v\n", pageName, err)
+		}
+	}
 
-	// Static files
-	http.HandleFunc("/images/auth0.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join("webui", "images", "auth0.svg"))
-	}))
-	http.HandleFunc("/images/rackspace.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join("webui", "images", "rackspace.svg"))
-	}))
-	http.HandleFunc("/images/sqlitebrowser.svg", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join("webui", "images", "sqlitebrowser.svg"))
-	}))
-	http.HandleFunc("/favicon.ico", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join("webui", "favicon.ico"))
-	}))
-	http.HandleFunc("/robots.txt", logReq(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, filepath.Join("webui", "robots.txt"))
-	}))
+	if wantsJSON(r) {
+		writeJSON(w, r, pageName, blame)
+		return
+	}
 
-	// Start server
-	log.Printf("DBHub server starting on https://%s\n", com.WebServer())
-	err = http.ListenAndServeTLS(com.WebBindAddress(), com.WebServerCert(), com.WebServerCertKey(), nil)
+	// Render the blame page
+	blamePage(w, r, loggedInUser, dbOwner, dbFolder, dbName, commits, key, maxRows, blame)
+}
 
-	// Shut down nicely
-	com.DisconnectPostgreSQL()
+// Logs in a user presenting a valid DBHub.io client certificate, without going through Auth0.
+func certLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		errorPage(w, r, http.StatusUnauthorized, "No client certificate was provided")
+		return
+	}
+	userName, err := com.ClientCertUser(r.TLS.PeerCertificates[0])
+	if err != nil {
+		log.Printf("Client certificate login failed: %v\n", err)
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+	com.RecordCertUse(com.ClientCertSerial(r.TLS.PeerCertificates[0]), clientIP(r), r.Method+" "+r.URL.Path)
 
+	// Create session cookie for the user.  Cookies aren't port specific, so the session is also valid on the
+	// main server
+	sess, err := com.NewSession(map[string]interface{}{"UserName": userName})
 	if err != nil {
-		log.Fatal(err)
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't create a login session")
+		return
 	}
+	session.Add(sess, w)
+	com.SecurityLogin(userName, clientIP(r), r.UserAgent())
+
+	// Login completed, so bounce to the users' profile page on the main server
+	http.Redirect(w, r, fmt.Sprintf("https://%s/%s", com.WebServer(), userName), http.StatusTemporaryRedirect)
 }
 
-func mainHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Main handler"
+// Runs a separate HTTPS server which requires client certificates, for logging in without Auth0.  Useful for
+// installations which can't reach Auth0, such as air-gapped ones.
+func certLoginServer() {
+	// Load our self signed CA chain, which client certificates are verified against
+	ourCAPool := x509.NewCertPool()
+	certFile, err := ioutil.ReadFile(com.DB4SCAChain())
+	if err != nil {
+		log.Fatalf("Error opening Certificate Authority chain file: %v\n", err)
+	}
+	if ok := ourCAPool.AppendCertsFromPEM(certFile); !ok {
+		log.Fatalf("Error appending certificate file\n")
+	}
 
-	// Split the request URL into path components
-	pathStrings := strings.Split(r.URL.Path, "/")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/x/certlogin", logReq(certLoginHandler))
+	newServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", com.WebCertLoginPort()),
+		Handler: com.ReportErrors("webui", com.SecurityHeaders(com.TraceHandler(mux))),
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  ourCAPool,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	log.Printf("Client certificate login available on https://%s:%d/x/certlogin\n", com.WebServer(),
+		com.WebCertLoginPort())
+	log.Fatal(newServer.ListenAndServeTLS(com.WebServerCert(), com.WebServerCertKey()))
+}
 
-	// numPieces will be 2 if the request was for the root directory (https://server/), or if
-	// the request included only a single path component (https://server/someuser/)
-	numPieces := len(pathStrings)
-	if numPieces == 2 {
-		userName := pathStrings[1]
-		// Check if the request was for the root directory
-		if pathStrings[1] == "" {
-			// Yep, root directory request
-			frontPage(w, r)
-			return
-		}
+// Displays the commit history of a database.
+func commitsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user, folder, and database name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/commits/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-		// The request was for a user page
-		userPage(w, r, userName)
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
 		return
 	}
 
-	userName := pathStrings[1]
-	dbName := pathStrings[2]
+	// Render the commits page
+	commitsPage(w, r, dbOwner, dbFolder, dbName)
+}
 
-	// Validate the user supplied user and database name
-	err := com.ValidateUserDB(userName, dbName)
+// Returns the database version a request is for.  Requests can give a commit ID instead of a version number, in which
+// case the version is looked up from the commit.
+func commitVersion(r *http.Request, loggedInUser string, dbOwner string, dbFolder string, dbName string,
+	dbVersion int) (int, error) {
+	commit := r.FormValue("commit")
+	if commit == "" {
+		return dbVersion, nil
+	}
+	err := com.ValidateCommitID(commit)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+		return 0, fmt.Errorf("Invalid commit ID")
+	}
+	ver, err := com.DBVersionByCommit(loggedInUser, dbOwner, dbFolder, dbName, strings.ToLower(commit))
+	if err != nil {
+		return 0, err
+	}
+	if ver == 0 {
+		return 0, fmt.Errorf("The requested commit doesn't exist")
+	}
+	return ver, nil
+}
+
+// Displays the contributor statistics of a database.
+func contributorsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user, folder, and database name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/contributors/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// This catches the case where a "/" is on the end of a user page URL
-	// TODO: Refactor this and the above identical code.  Doing it this way is non-optimal
-	if pathStrings[2] == "" {
-		// The request was for a user page
-		userPage(w, r, userName)
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
 		return
 	}
 
-	// * A specific database was requested *
+	// Render the contributors page
+	contributorsPage(w, r, dbOwner, dbFolder, dbName)
+}
 
-	// Check if a version number was also requested
-	dbVersion, err := com.GetFormVersion(r)
+// Records a counter notice from a database owner, disputing a takedown of their database.
+func counterNoticeHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Counter notice handler"
+
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Counter notices need to be submitted using POST")
+		return
+	}
+
+	// Validate the submitted form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	takedownID, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid takedown request ID")
+		return
+	}
+	notice := strings.TrimSpace(r.PostFormValue("notice"))
+	if notice == "" {
+		errorPage(w, r, http.StatusBadRequest, "The counter notice can't be empty")
 		return
 	}
 
-	// Check if a table name was also requested
-	err = r.ParseForm()
+	// Record the counter notice.  This only succeeds if the takedown is for one of the users' own databases
+	err = com.AddCounterNotice(takedownID, loggedInUser, notice)
 	if err != nil {
-		log.Printf("%s: Error with ParseForm() in main handler: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
-	dbTable := r.FormValue("table")
+	log.Printf("%s: Counter notice submitted by '%s' for takedown request %d\n", pageName, loggedInUser,
+		takedownID)
+
+	// Bounce back to the database page, which shows the updated takedown status
+	http.Redirect(w, r, fmt.Sprintf("/%s/%s", loggedInUser, url.PathEscape(dbName)), http.StatusSeeOther)
+}
+
+// Creates an organisation, with the logged in user as its owner.  Organisation names share the same namespace as user
+// names, as they're used in database URLs the same way.
+func createOrgHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Organisations need to be created using POST")
+		return
+	}
+
+	// Validate the organisation name
+	orgName := strings.TrimSpace(r.PostFormValue("name"))
+	err := com.ValidateUser(orgName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid organisation name")
+		return
+	}
+	err = com.ReservedUsernamesCheck(orgName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	exists, err := com.CheckUserExists(orgName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Username check failed")
+		return
+	}
+	if exists {
+		errorPage(w, r, http.StatusConflict, "That name is already taken")
+		return
+	}
+
+	err = com.AddOrganisation(orgName, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Something went wrong when creating the organisation")
+		return
+	}
+	http.Redirect(w, r, "/"+orgName, http.StatusSeeOther)
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Make sure this user creation session is valid
+	sess := session.Get(r)
+	if sess == nil {
+		// This isn't a valid username selection session, so abort
+		errorPage(w, r, http.StatusBadRequest, "Invalid user creation session")
+		return
+	}
+
+	validRegSession := false
+	va := sess.CAttr("registrationinprogress")
+	if va == nil {
+		// This isn't a valid username selection session, so abort
+		errorPage(w, r, http.StatusBadRequest, "Invalid user creation session")
+		return
+	}
+	validRegSession = va.(bool)
+
+	if validRegSession != true {
+		// This isn't a valid username selection session, so abort
+		errorPage(w, r, http.StatusBadRequest, "Invalid user creation session")
+		return
+	}
+
+	// Retrieve the registration data
+	var ident com.LoginIdentity
+	pr, prOK := sess.CAttr("provider").(string)
+	id, idOK := sess.CAttr("providerid").(string)
+	if prOK && idOK {
+		ident.Provider, ident.ProviderID = pr, id
+	} else {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user creation id")
+		return
+	}
+	em := sess.CAttr("email")
+	if em != nil {
+		ident.Email = em.(string)
+	} else {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user creation email")
+		return
+	}
+
+	// Gather submitted form data (if any)
+	err := r.ParseForm()
+	if err != nil {
+		log.Printf("Error when parsing user creation data: %s\n", err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing user creation data")
+		return
+	}
+	userName := r.PostFormValue("username")
+
+	// Ensure username was given
+	if userName == "" {
+		// No, so render the username selection page
+		selectUsernamePage(w, r)
+		return
+	}
+
+	// Validate the user supplied username
+	err = com.ValidateUser(userName)
+	if err != nil {
+		log.Printf("Username failed validation: %s", err)
+		session.Remove(sess, w)
+		errorPage(w, r, http.StatusBadRequest, "Username failed validation")
+		return
+	}
+
+	// Ensure the username isn't a reserved one
+	err = com.ReservedUsernamesCheck(userName)
+	if err != nil {
+		log.Println(err)
+		session.Remove(sess, w)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Check if the username is already in our system
+	exists, err := com.CheckUserExists(userName)
+	if err != nil {
+		session.Remove(sess, w)
+		errorPage(w, r, http.StatusInternalServerError, "Username check failed")
+		return
+	}
+	if exists {
+		session.Remove(sess, w)
+		errorPage(w, r, http.StatusConflict, "That username is already taken")
+		return
+	}
+
+	// Add the user to the system
+	// NOTE: We generate a random password here (for now).  We may remove the password field itself from the
+	// database at some point, depending on whether we continue to support local database users
+	err = com.AddUser(ident, userName, com.RandomString(32))
+	if err != nil {
+		session.Remove(sess, w)
+		errorPage(w, r, http.StatusInternalServerError, "Something went wrong during user creation")
+		return
+	}
+
+	// Remove the temporary username selection session data
+	session.Remove(sess, w)
+
+	// Create normal session cookie for the user
+	sess, err = com.NewSession(map[string]interface{}{"UserName": userName})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't create a login session")
+		return
+	}
+	session.Add(sess, w)
+	com.SecurityLogin(userName, clientIP(r), r.UserAgent())
+
+	// User creation completed, so bounce to the user's profile page
+	http.Redirect(w, r, "/"+userName, http.StatusTemporaryRedirect)
+}
+
+// This is called from the username selection page, to check if a name is available.
+func checkNameHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the potential username from the URL
+	err := r.ParseForm()
+	userName := r.FormValue("name")
+
+	// Validate the user supplied username
+	err = com.ValidateUser(userName)
+	if err != nil {
+		fmt.Fprint(w, "n")
+		return
+	}
+
+	// Ensure the username isn't a reserved one
+	err = com.ReservedUsernamesCheck(userName)
+	if err != nil {
+		fmt.Fprint(w, "n")
+		return
+	}
+
+	// Check if the username is already in our system
+	exists, err := com.CheckUserExists(userName)
+	if err != nil {
+		fmt.Fprint(w, "n")
+		return
+	}
+	if exists {
+		fmt.Fprint(w, "n")
+		return
+	}
+
+	// The username is available
+	fmt.Fprint(w, "y")
+	return
+}
+
+// Returns the IP address a request came from.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// Sends the details shown on a database page as JSON, for scripts which would otherwise need to scrape the HTML.
+func databaseJSON(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string,
+	dbVersion int) {
+	pageName := "Database JSON"
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Third party applications authorised through OAuth send an access token instead
+	var err error
+	if loggedInUser == "" {
+		loggedInUser, err = oauthUser(r, com.OAuthScopeRead)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Check if the user has access to the requested database (and get its details if available)
+	var DB com.SQLiteDBinfo
+	err = com.DBDetails(r.Context(), &DB, loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Retrieve the list of tables in the database
+	sdb, err := com.OpenMinioObject(r.Context(), DB.MinioBkt, DB.MinioId)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer com.ReleaseSQLiteHandle(sdb)
+	tables, err := com.Tables(sdb, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	versions, err := com.DBVersions(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	frkOwn, frkFol, frkDB, err := com.ForkedFrom(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	colDocs, err := com.ColumnDocs(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+
+	info := DB.Info
+	details := com.DBPageJSON{
+		ColumnDocs:   colDocs,
+		DateCreated:  info.DateCreated,
+		DefaultTable: info.DefaultTable,
+		Description:  info.Description,
+		DownloadURL:  com.DownloadURL(dbOwner, dbFolder, dbName, info.Version, info.Public),
+		Folder:       dbFolder,
+		Forks:        info.Forks,
+		LastModified: info.LastModified,
+		License:      info.LicenseName,
+		Name:         dbName,
+		Owner:        dbOwner,
+		Public:       info.Public,
+		Readme:       info.Readme,
+		SHA256:       info.SHA256,
+		Size:         info.Size,
+		Stars:        info.Stars,
+		Tables:       tables,
+		Title:        info.Title,
+		Version:      info.Version,
+		Versions:     versions,
+		Watchers:     info.Watchers,
+	}
+	if frkOwn != "" {
+		details.ForkedFrom = fmt.Sprintf("%s%s%s", frkOwn, frkFol, frkDB)
+	}
+	if details.Tables == nil {
+		details.Tables = []string{}
+	}
+
+	jsonResponse, err := json.MarshalIndent(details, "", " ")
+	if err != nil {
+		log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Serves an Atom feed of the versions of a public database, so people can follow its updates in a feed reader.
+func dbFeedHandler(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) {
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Feed readers don't log in, so only public databases have feeds
+	versions, err := com.DBVersionDetails("", dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(versions) == 0 {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+	if len(versions) > com.FeedLength {
+		versions = versions[:com.FeedLength]
+	}
+
+	dbURL := fmt.Sprintf("https://%s/%s%s%s", com.WebServer(), url.PathEscape(dbOwner), dbFolder,
+		url.PathEscape(dbName))
+	feed := atomFeed{
+		ID:      dbURL,
+		Links:   []atomLink{{Href: dbURL}, {Href: dbURL + ".atom", Rel: "self"}},
+		Title:   fmt.Sprintf("%s / %s", dbOwner, dbName),
+		Updated: versions[0].DateCreated.UTC().Format(time.RFC3339),
+	}
+	for _, v := range versions {
+		verURL := fmt.Sprintf("%s?version=%d", dbURL, v.Version)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Author:  atomAuthor{Name: dbOwner},
+			ID:      verURL,
+			Links:   []atomLink{{Href: verURL}},
+			Summary: fmt.Sprintf("%d bytes, SHA256 %s", v.Size, v.SHA256),
+			Title:   fmt.Sprintf("Version %d", v.Version),
+			Updated: v.DateCreated.UTC().Format(time.RFC3339),
+		})
+	}
+	writeAtomFeed(w, feed)
+}
+
+// Adds or removes a webhook for a database.
+func dbWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Webhooks need to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change the webhooks of a database
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	if !com.FeatureEnabled(com.FeatureWebhooks, dbOwner) {
+		errorPage(w, r, http.StatusNotFound, "Webhooks aren't available")
+		return
+	}
+	switch r.PostFormValue("action") {
+	case "add":
+		webhookURL := strings.TrimSpace(r.PostFormValue("url"))
+		err = com.ValidateNotifyWebhook(webhookURL)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("The webhook can't be used: %v", err))
+			return
+		}
+		events := r.PostForm["events"]
+		if len(events) == 0 {
+			errorPage(w, r, http.StatusBadRequest, "Choose at least one event to send to the webhook")
+			return
+		}
+		for _, e := range events {
+			if !com.ValidDBWebhookEvent(e) {
+				errorPage(w, r, http.StatusBadRequest, "Unknown webhook event")
+				return
+			}
+		}
+		err = com.AddDBWebhook(dbOwner, dbFolder, dbName, webhookURL, events)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when adding the webhook")
+			return
+		}
+	case "remove":
+		webhookID, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid webhook ID")
+			return
+		}
+		err = com.RemoveDBWebhook(dbOwner, dbFolder, dbName, webhookID)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Error when removing the webhook")
+			return
+		}
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown webhook action")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Deletes a database belonging to the logged in user, or to an organisation they own.  Requests are in the form
+// /x/deletedb/<owner>/<database>, and need to include the database name again as confirmation.
+func deleteDBHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Databases need to be deleted using POST")
+		return
+	}
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/x/deletedb/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if dbOwner != loggedInUser {
+		// Organisation databases can be deleted by the organisation's owners
+		role, err := com.OrgRole(dbOwner, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if role != com.OrgRoleOwner {
+			errorPage(w, r, http.StatusForbidden, "Only the owner of a database can delete it")
+			return
+		}
+	}
+	if r.PostFormValue("confirm") != dbName {
+		errorPage(w, r, http.StatusBadRequest, "The database name needs to be entered to confirm the deletion")
+		return
+	}
+
+	// Databases which have been taken down are kept until the complaint is resolved
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+	err = com.DeleteDatabase(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("Database '%s%s%s' deleted by '%s'\n", dbOwner, dbFolder, dbName, loggedInUser)
+
+	// Bounce back to the owner's page
+	http.Redirect(w, r, "/"+dbOwner, http.StatusSeeOther)
+}
+
+// Deletes a version of a database belonging to the logged in user.  The version can be restored from the settings
+// page until it's purged.
+func deleteVersionHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Database versions need to be deleted using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil || dbVersion < 1 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can delete versions of a database
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	archived, err := com.DBArchived(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so its versions can't be deleted")
+		return
+	}
+	err = com.DeleteDBVersion(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Version %d of database '%s%s%s' deleted by '%s'\n", dbVersion, dbOwner, dbFolder, dbName,
+		loggedInUser)
+
+	// Bounce back to the settings page for the latest remaining version
+	highVer, err := com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, highVer,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Compares two versions of a database, showing the schema changes and the rows inserted, updated, and deleted in each
+// table.  JSON is returned instead of HTML if the client asks for it.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Diff handler"
+
+	// Retrieve user, folder, database, and table name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/diff/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbTable, err := com.GetTable(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Large diffs are paged, using the same number of rows as the table view
+	maxRows, err := requestedRows(r, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	var rowOffset int
+	if r.FormValue("offset") != "" {
+		rowOffset, err = strconv.Atoi(r.FormValue("offset"))
+		if err != nil || rowOffset < 0 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid row offset")
+			return
+		}
+	}
+
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// The versions to compare default to the latest one and the one before it
+	commits, err := com.DBCommits(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if len(commits) == 0 {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+	toVer := commits[0].Version
+	if r.FormValue("to") != "" {
+		toVer, err = strconv.Atoi(r.FormValue("to"))
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+			return
+		}
+	}
+	fromVer := 0
+	if r.FormValue("from") != "" {
+		fromVer, err = strconv.Atoi(r.FormValue("from"))
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+			return
+		}
+	} else {
+		for _, c := range commits {
+			if c.Version < toVer {
+				fromVer = c.Version
+				break
+			}
+		}
+		if fromVer == 0 {
+			errorPage(w, r, http.StatusBadRequest, "There's no earlier version to compare against")
+			return
+		}
+	}
+	fromOK, toOK := false, false
+	for _, c := range commits {
+		fromOK = fromOK || c.Version == fromVer
+		toOK = toOK || c.Version == toVer
+	}
+	if !fromOK || !toOK {
+		errorPage(w, r, http.StatusNotFound, "The requested database version doesn't exist")
+		return
+	}
+
+	// If the diff is available from memcached, use that instead of comparing the databases again
+	dataCacheKey := com.TableRowsCacheKey(fmt.Sprintf("diff/%d/%d", fromVer, rowOffset), loggedInUser, dbOwner,
+		dbFolder, dbName, toVer, dbTable, maxRows)
+	var diff com.DBDiff
+	ok, err := com.GetCachedData(r.Context(), dataCacheKey, &diff)
+	if err != nil {
+		log.Printf("%s: Error retrieving diff from cache: %v\n", pageName, err)
+	}
+	if !ok {
+		fromBucket, fromID, err := com.MinioBucketID(dbOwner, dbFolder, dbName, fromVer, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		toBucket, toID, err := com.MinioBucketID(dbOwner, dbFolder, dbName, toVer, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if fromID == "" || toID == "" {
+			errorPage(w, r, http.StatusNotFound, "Database not found")
+			return
+		}
+		oldDB, err := com.OpenMinioObject(r.Context(), fromBucket, fromID)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.ReleaseSQLiteHandle(oldDB)
+		newDB, err := com.OpenMinioObject(r.Context(), toBucket, toID)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.ReleaseSQLiteHandle(newDB)
+
+		diff, err = com.DiffSQLiteDBs(oldDB, newDB, dbTable, rowOffset, maxRows)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Cache the diff in memcache
+		err = com.CacheData(r.Context(), dataCacheKey, diff, com.CacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching diff: %v\n", pageName, err)
+		}
+	}
+
+	if wantsJSON(r) {
+		jsonResponse, err := json.Marshal(diff)
+		if err != nil {
+			log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", jsonResponse)
+		return
+	}
+
+	// Render the diff page
+	diffPage(w, r, loggedInUser, dbOwner, dbFolder, dbName, commits, fromVer, toVer, dbTable, rowOffset, maxRows,
+		diff)
+}
+
+// Dismisses an announcement banner for the logged in user, so it's no longer shown to them.
+func dismissBannerHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Banners need to be dismissed using POST")
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid announcement ID")
+		return
+	}
+	err = com.DismissAnnouncement(loggedInUser, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't dismiss the announcement")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Downloads all of a user's public databases as a single zip archive.  Smaller archives are sent straight away,
+// while bigger ones are prepared in the background, with a notification sent once they're ready to download.
+func downloadAllHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Download all handler"
+
+	// Extract the name of the user whose databases are wanted
+	userName := strings.TrimPrefix(r.URL.Path, "/x/downloadall/")
+	err := com.ValidateUser(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Prepared archives can only be downloaded by the user who asked for them
+	if archiveID := r.FormValue("archive"); archiveID != "" {
+		job, ok, err := com.ArchiveJobDetails(archiveID)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when retrieving archive details")
+			return
+		}
+		if !ok || job.Requester != loggedInUser || job.Owner != userName {
+			errorPage(w, r, http.StatusNotFound, "That archive doesn't exist, or has expired")
+			return
+		}
+		userDB, err := com.MinioHandle(r.Context(), job.Bucket, job.MinioID)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.MinioHandleClose(userDB)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
+			url.QueryEscape(userName+"-databases.zip")))
+		w.Header().Set("Content-Type", "application/zip")
+		bytesWritten, err := io.Copy(w, userDB)
+		if err != nil {
+			log.Printf("%s: Error returning archive: %v\n", pageName, err)
+			return
+		}
+		log.Printf("%s: Archive of '%s' databases downloaded. %d bytes", pageName, userName, bytesWritten)
+		return
+	}
+
+	// Bulk downloads are rate limited, by user name for logged in users and by IP address for everyone else
+	client := loggedInUser
+	if client == "" {
+		client = clientIP(r)
+	}
+	if !com.BulkDownloadAllowed(client) {
+		errorPage(w, r, http.StatusTooManyRequests, "Too many bulk downloads.  Please try again later")
+		return
+	}
+
+	// Retrieve the list of databases to include
+	dbList, err := com.LatestPublicDBVersions(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(dbList) == 0 {
+		errorPage(w, r, http.StatusNotFound, "That user doesn't have any public databases")
+		return
+	}
+	var totalSize int64
+	for _, db := range dbList {
+		totalSize += db.Size
+	}
+	if totalSize > com.BulkDownloadMaxSize {
+		errorPage(w, r, http.StatusForbidden, "Those databases are too large to download all at once.  Please "+
+			"download them individually instead")
+		return
+	}
+
+	// Smaller archives are sent straight away
+	if totalSize <= com.BulkDownloadStreamSize {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
+			url.QueryEscape(userName+"-databases.zip")))
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeDBArchive(r.Context(), w, dbList)
+		if err != nil {
+			// The response has already started, so there's no way to show an error page
+			log.Printf("%s: Error when sending archive of '%s' databases: %v\n", pageName, userName, err)
+			return
+		}
+		log.Printf("%s: Archive of '%s' databases downloaded. %d databases", pageName, userName, len(dbList))
+		return
+	}
+
+	// Bigger ones are prepared in the background, so the user needs to be logged in to be told when it's ready
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusForbidden, "Please log in to download this many databases at once")
+		return
+	}
+	bucket, err := com.MinioUserBucket(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	job := com.ArchiveJob{
+		Bucket:    bucket,
+		Created:   time.Now(),
+		ID:        com.RandomString(16),
+		MinioID:   "archive-" + com.RandomString(8) + ".zip",
+		Owner:     userName,
+		Requester: loggedInUser,
+	}
+	// The background job outlives the request, so it gets a fresh context which continues the request's trace
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	go prepareArchive(ctx, job, dbList)
+	errorPage(w, r, http.StatusAccepted, "The archive is being prepared.  You'll get a notification when it's "+
+		"ready to download")
+}
+
+func downloadCertHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		// No logged in user, so error out
+		errorPage(w, r, http.StatusBadRequest, "Not logged in")
+		return
+	}
+
+	// Retrieve the client certificate from the PG database
+	cert, err := com.ClientCert(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, fmt.Sprintf("Retrieving client cert from "+
+			"database failed for user: %v", loggedInUser))
+		return
+	}
+
+	// Send the client certificate to the user
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
+		loggedInUser+".cert.pem"))
+	// Note, don't use "application/x-x509-user-cert", otherwise the browser may try to install it!
+	// Useful reference info: https://pki-tutorial.readthedocs.io/en/latest/mime.html
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(cert)
+	return
+}
+
+func downloadCSVHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Download CSV"
+
+	// Extract the username, database, table, and version requested
+	dbOwner, dbName, dbTable, dbVersion, err := com.GetODTV(2, r) // 2 = Ignore "/x/downloadcsv/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Abort if no table name was given
+	if dbTable == "" {
+		log.Printf("%s: No table name given\n", pageName)
+		errorPage(w, r, http.StatusBadRequest, "No table name given")
+		return
+	}
+
+	// Check the requested output format options
+	opts, err := com.CSVExportOptions(r.FormValue("delimiter"), r.FormValue("quote"), r.FormValue("header"),
+		r.FormValue("bom"))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Third party applications authorised through OAuth send an access token instead
+	if loggedInUser == "" {
+		loggedInUser, err = oauthUser(r, com.OAuthScopeRead)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Databases which have been taken down can't be downloaded or queried
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Visitors with a share link for a private database can download it without having access themselves
+	loggedInUser, allowed := shareLinkUser(w, r, loggedInUser, dbOwner, dbFolder, dbName)
+	if !allowed {
+		return
+	}
+
+	// If no version was given, use the latest one the user can see
+	if dbVersion == 0 {
+		dbVersion, err = com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+
+	// Verify the given database version exists and is ok to be downloaded (and get the Minio bucket + id while at it)
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Version %d of that database wasn't found", dbVersion))
+		return
+	}
+	sha, err := com.MinioObjectSHA(bucket, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Tab separated output gets its own file extension and type
+	ext, contentType := "csv", "text/csv"
+	if opts.Delimiter == '\t' {
+		ext, contentType = "tsv", "text/tab-separated-values"
+	}
+	setHeaders := func() {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", url.QueryEscape(dbTable),
+			ext))
+		w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	}
+
+	// Database versions never change, so if this CSV has been generated before the cached copy can be sent
+	cacheKey := com.CSVCacheKey(sha, dbTable, opts)
+	cached, ok, err := com.CachedCSV(r.Context(), cacheKey)
+	if err != nil {
+		log.Printf("%s: Error retrieving cached CSV: %v\n", pageName, err)
+	}
+	if ok {
+		defer com.MinioHandleClose(cached)
+		setHeaders()
+		_, err = io.Copy(w, cached)
+		if err != nil {
+			log.Printf("%s: Error when sending cached CSV: %v\n", pageName, err)
+		}
+		return
+	}
+
+	// Get a handle from Minio for the database object
+	sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
+	if err != nil {
+		log.Printf("%s: Error retrieving DB from Minio: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	defer com.ReleaseSQLiteHandle(sdb)
+
+	// Read the table data from the database object
+	resultSet, err := com.ReadSQLiteDBCSV(sdb, dbTable, opts.Header)
+	if err != nil {
+		log.Printf("%s: Error reading table data: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error reading table data")
+		return
+	}
+
+	// Convert resultSet into CSV in a temporary file, so it can be cached as well as sent to the user
+	tempCSV, err := ioutil.TempFile("", "dbhub-csv-")
+	if err != nil {
+		log.Printf("%s: Error creating temporary file: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	defer os.Remove(tempCSV.Name())
+	defer tempCSV.Close()
+	err = com.WriteCSV(tempCSV, opts, resultSet)
+	if err == nil {
+		_, err = tempCSV.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("%s: Error when generating CSV: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Error when generating CSV")
+		return
+	}
+	setHeaders()
+	_, err = io.Copy(w, tempCSV)
+	if err != nil {
+		log.Printf("%s: Error when sending CSV: %v\n", pageName, err)
+		return
+	}
+	_, err = tempCSV.Seek(0, io.SeekStart)
+	if err == nil {
+		err = com.StoreCachedCSV(r.Context(), cacheKey, tempCSV)
+	}
+	if err != nil {
+		log.Printf("%s: Error when caching CSV: %v\n", pageName, err)
+	}
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Download Handler"
+
+	dbOwner, dbName, dbVersion, err := com.GetODV(2, r) // 2 = Ignore "/x/download/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Third party applications authorised through OAuth send an access token instead
+	if loggedInUser == "" {
+		loggedInUser, err = oauthUser(r, com.OAuthScopeRead)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Databases which have been taken down can't be downloaded or queried
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Visitors with a share link for a private database can download it without having access themselves
+	loggedInUser, allowed := shareLinkUser(w, r, loggedInUser, dbOwner, dbFolder, dbName)
+	if !allowed {
+		return
+	}
+
+	// Downloads can be for a specific commit
+	dbVersion, err = commitVersion(r, loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// If this is a signed CDN link, make sure it's valid
+	if sig := r.FormValue("sig"); sig != "" {
+		if !com.ValidCDNSignature(dbOwner, dbFolder, dbName, dbVersion, r.FormValue("expires"), sig) {
+			errorPage(w, r, http.StatusForbidden, "Invalid or expired download link")
+			return
+		}
+	}
+
+	sendDatabase(w, r, pageName, loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
+}
+
+// Runs a statement which changes a live database, returning the number of rows it changed as JSON.  Callers need an
+// access token with the write scope.
+func execLiveHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user, database, and the statement to run
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/exec/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Statements need to be sent using POST")
+		return
+	}
+	statement := r.PostFormValue("sql")
+	if strings.TrimSpace(statement) == "" {
+		errorPage(w, r, http.StatusBadRequest, "No statement given")
+		return
+	}
+
+	loggedInUser, db, ok := liveWriteAccess(w, r, dbOwner, dbFolder, dbName)
+	if !ok {
+		return
+	}
+	rows, err := com.ExecLiveDB(r.Context(), db, loggedInUser, statement)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"rows_affected": rows})
+}
+
+// Handles JSON requests from the front end to toggle following a user.
+func followToggleHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the name of the user to follow
+	userName := strings.TrimPrefix(r.URL.Path, "/x/follow/")
+	err := com.ValidateUser(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user, who isn't trying to follow themselves
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in to follow people")
+		return
+	}
+	if loggedInUser == userName {
+		errorPage(w, r, http.StatusBadRequest, "You can't follow yourself")
+		return
+	}
+
+	// Check the user exists
+	userExists, err := com.CheckUserExists(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !userExists {
+		errorPage(w, r, http.StatusNotFound, "Unknown user")
+		return
+	}
+
+	// Toggle following the user, and return their updated follower count
+	followers, err := com.ToggleFollow(loggedInUser, userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't update the list of people you follow")
+		return
+	}
+	fmt.Fprint(w, followers)
+}
+
+// Forks a database for the logged in user.
+func forkDBHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Retrieve user, folder, and database name
+	dbOwner, dbName, dbVer, err := com.GetODV(2, r) // 2 = Ignore "/x/forkdb/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Make sure a version number was given
+	if dbVer == 0 {
+		errorPage(w, r, http.StatusBadRequest, "No database version number given")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		// No logged in username, so nothing to update
+		errorPage(w, r, http.StatusBadRequest, "To fork a database, you need to be logged in")
+		return
+	}
+
+	// Check the user has access to the specific version of the source database requested
+	allowed, err := com.CheckUserDBVAccess(dbOwner, dbFolder, dbName, dbVer, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !allowed {
+		errorPage(w, r, http.StatusBadRequest, "You don't have access to the requested database version")
+		return
+	}
+
+	// Databases which have been taken down can't be forked
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Databases can be forked into an organisation the user is a member of, instead of to the user themselves
+	destOwner := loggedInUser
+	if owner := strings.ToLower(r.FormValue("owner")); owner != "" && owner != loggedInUser {
+		err = com.ValidateUser(owner)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid destination owner")
+			return
+		}
+		role, err := com.OrgRole(owner, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if role == "" {
+			errorPage(w, r, http.StatusForbidden, "You can only fork databases into organisations you're a member of")
+			return
+		}
+		destOwner = owner
+	}
+
+	// Make sure the source and destination owners are different
+	if destOwner == dbOwner {
+		errorPage(w, r, http.StatusBadRequest, "Forking a database in-place doesn't make sense")
+		return
+	}
+
+	// Make sure the destination doesn't have a database of the same name already
+	v, err := com.HighestDBVersion(destOwner, dbName, dbFolder, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if v != 0 {
+		// Database of the same name already exists
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("%s already has a database of this name", destOwner))
+		return
+	}
+
+	// Get the Minio bucket and id for the database being forked (the source)
+	sourceBucket, sourceID, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVer, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Get the Minio bucket for the destination owner
+	destBucket, err := com.MinioUserBucket(destOwner)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Copy the Minio object to the destination bucket
+	destMinioID, err := com.MinioObjCopy(sourceBucket, sourceID, destBucket)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Add the forked database info to PostgreSQL
+	_, err = com.ForkDatabase(dbOwner, dbFolder, dbName, dbVer, destOwner, dbFolder, destMinioID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Log the database fork
+	log.Printf("Database '%s%s%s' forked to '%s' by '%s'\n", dbOwner, dbFolder, dbName, destOwner, loggedInUser)
+
+	// Add the fork to the activity feeds, and let the source database's webhooks know about it
+	err = com.RecordActivity(loggedInUser, com.FeedFork, dbOwner, dbFolder, dbName, 0, destOwner)
+	if err != nil {
+		log.Printf("Error recording activity for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+	}
+	err = com.DBEvent(dbOwner, dbFolder, dbName, com.WebhookFork, loggedInUser, map[string]interface{}{
+		"fork": map[string]string{
+			"owner":  destOwner,
+			"folder": dbFolder,
+			"name":   dbName,
+			"url":    fmt.Sprintf("https://%s/%s%s%s", com.WebServer(), destOwner, dbFolder, dbName),
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing webhooks for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+	}
+
+	// Bounce to the page of the forked database
+	http.Redirect(w, r, "/"+destOwner+dbFolder+dbName, http.StatusTemporaryRedirect)
+}
+
+// Present the forks page to the user
+func forksHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/forks/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the forks page
+	forksPage(w, r, dbOwner, dbFolder, dbName)
+}
+
+// Returns the owner of the database a form is about.  That's the logged in user, unless the form names an organisation
+// they're an owner or admin of.  If the owner isn't usable an error page is sent, and false returned.
+func formDBOwner(w http.ResponseWriter, r *http.Request, loggedInUser string) (string, bool) {
+	dbOwner := strings.ToLower(r.FormValue("owner"))
+	if dbOwner == "" || dbOwner == loggedInUser {
+		return loggedInUser, true
+	}
+	err := com.ValidateUser(dbOwner)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database owner")
+		return "", false
+	}
+	allowed, err := com.CanManageDBs(dbOwner, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return "", false
+	}
+	if !allowed {
+		errorPage(w, r, http.StatusForbidden, "You can only manage your own databases, or those of organisations "+
+			"you're an owner or admin of")
+		return "", false
+	}
+	return dbOwner, true
+}
+
+// Generates a new client certificate for the user and gives it to the browser.  The user's other certificates keep
+// working, until they're revoked or expire.
+func generateCertHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		// No logged in user, so error out
+		errorPage(w, r, http.StatusBadRequest, "Not logged in")
+		return
+	}
+
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Certificates need to be generated using POST")
+		return
+	}
+
+	// Validate the certificate details
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" || len(name) > 100 {
+		errorPage(w, r, http.StatusBadRequest, "Certificates need a name of up to 100 characters")
+		return
+	}
+	days := com.SigningCertDefaultDays()
+	if d := r.PostFormValue("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 1 || days > com.SigningCertMaxDays() {
+			errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Certificates can be valid for between 1 and %d "+
+				"days", com.SigningCertMaxDays()))
+			return
+		}
+	}
+
+	// Generate the new certificate, and add it to the user's list of certificates
+	newCert, err := com.IssueClientCert(loggedInUser, name, days)
+	if err != nil {
+		log.Printf("Error generating client certificate for user '%s': %s!\n", loggedInUser, err)
+		http.Error(w, fmt.Sprintf("Error generating client certificate for user '%s': %s!\n",
+			loggedInUser, err), http.StatusInternalServerError)
+		return
+	}
+	com.SecurityNotice(loggedInUser, fmt.Sprintf("A new DB4S client certificate '%s' was generated for your "+
+		"account from %s.", name, clientIP(r)))
+
+	// Send the client certificate to the user
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
+		loggedInUser+".cert.pem"))
+	// Note, don't use "application/x-x509-user-cert", otherwise the browser may try to install it!
+	// Useful reference info: https://pki-tutorial.readthedocs.io/en/latest/mime.html
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(newCert)
+	return
+}
+
+// Generates a skeleton README for a database from its schema, returned as JSON.  Nothing is saved, as the owner edits
+// the result and saves it through the settings page as usual.
+func generateReadmeHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Generate README handler"
+
+	// Ensure user is logged in
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if validSession != true {
+		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
+		return
+	}
+
+	u, dbFolder, dbName, err := com.GetFormUFD(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if dbFolder == "" {
+		dbFolder = "/"
+	}
+
+	// Only the owner of a database (or an admin of the owning organisation) can generate a README for it
+	dbOwner := strings.ToLower(u)
+	allowed, err := com.CanManageDBs(dbOwner, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if !allowed {
+		errorPage(w, r, http.StatusForbidden, "You can only generate READMEs for your own databases")
+		return
+	}
+
+	// The README describes the latest version of the database
+	var DB com.SQLiteDBinfo
+	err = com.DBDetails(r.Context(), &DB, loggedInUser, dbOwner, dbFolder, dbName, 0)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	colDocs, err := com.ColumnDocs(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	sdb, err := com.OpenMinioObject(r.Context(), DB.MinioBkt, DB.MinioId)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer com.ReleaseSQLiteHandle(sdb)
+	readme, err := com.GenerateReadme(sdb, dbName, colDocs, DB.Info.LicenseName)
+	if err != nil {
+		log.Printf("%s: Generating README for '%s%s%s' failed: %v\n", pageName, dbOwner, dbFolder, dbName, err)
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jsonResponse, err := json.Marshal(map[string]string{"readme": readme})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Returns the rows of a database table holding locations as GeoJSON, for showing on a map.  The locations come from a
+// SpatiaLite geometry column, or from a pair of latitude and longitude columns.
+func geoJSONHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "GeoJSON handler"
+
+	// Retrieve user, database, and table name
+	dbOwner, dbName, requestedTable, dbVersion, err := com.GetODTV(2, r) // 2 = Ignore "/x/geojson/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Maps show as many locations as the API allows, unless fewer are asked for
+	maxRows := com.WebMaxAPIRows()
+	if r.FormValue("rows") != "" {
+		maxRows, err = requestedRows(r, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Check if the user has access to the requested database
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if id == "" {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+
+	// If the data is available from memcached, use that instead of reading from the SQLite database itself
+	dataCacheKey := com.TableRowsCacheKey("geojson", loggedInUser, dbOwner, dbFolder, dbName, dbVersion,
+		requestedTable, maxRows)
+	var geo com.GeoJSON
+	ok, err := com.GetCachedData(r.Context(), dataCacheKey, &geo)
+	if err != nil {
+		log.Printf("%s: Error retrieving GeoJSON from cache: %v\n", pageName, err)
+	}
+	if !ok {
+		sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.ReleaseSQLiteHandle(sdb)
+
+		// Check the requested table exists, using the first one if none was given
+		tables, err := com.Tables(sdb, dbName)
+		if err != nil || len(tables) == 0 {
+			errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
+			return
+		}
+		if requestedTable == "" {
+			requestedTable = tables[0]
+		}
+		tablePresent := false
+		for _, t := range tables {
+			if t == requestedTable {
+				tablePresent = true
+			}
+		}
+		if !tablePresent {
+			errorPage(w, r, http.StatusBadRequest, "Requested table does not exist")
+			return
+		}
+
+		cols, err := com.SpatialCols(sdb, requestedTable)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
+			return
+		}
+		if cols.Geometry == "" && cols.Latitude == "" {
+			errorPage(w, r, http.StatusBadRequest, "The table doesn't have any location columns")
+			return
+		}
+		geo, err = com.ReadGeoJSON(sdb, requestedTable, cols, maxRows)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Cache the data in memcache
+		err = com.CacheData(r.Context(), dataCacheKey, geo, com.CacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching GeoJSON: %v\n", pageName, err)
+		}
+	}
+
+	jsonResponse, err := json.Marshal(geo)
+	if err != nil {
+		log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Returns the health report for a database, giving its table row counts along with the sizes of its indexes.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Health handler"
+
+	// Retrieve user, database, and version
+	dbOwner, dbName, dbVersion, err := com.GetODV(2, r) // 2 = Ignore "/x/health/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Check if the user has access to the requested database
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if id == "" {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+
+	// Counting the rows of every table can take a while for large databases, so the report is cached
+	dataCacheKey := com.TableRowsCacheKey("health", loggedInUser, dbOwner, dbFolder, dbName, dbVersion, "", 0)
+	var health com.DBHealth
+	ok, err := com.GetCachedData(r.Context(), dataCacheKey, &health)
+	if err != nil {
+		log.Printf("%s: Error retrieving health report from cache: %v\n", pageName, err)
+	}
+	if !ok {
+		sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.ReleaseSQLiteHandle(sdb)
+
+		health, err = com.DBHealthReport(sdb)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
+			return
+		}
+
+		err = com.CacheData(r.Context(), dataCacheKey, health, com.CacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching health report: %v\n", pageName, err)
+		}
+	}
+
+	jsonResponse, err := json.Marshal(health)
+	if err != nil {
+		log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Present the query history page to the logged in user.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Render the history page
+	historyPage(w, r, loggedInUser)
+}
+
+// Imports a new version of a database through one of its import webhooks (eg /x/import/<token>), for external systems
+// which push their data to DBHub.io.  The webhook's secret needs to be given in the X-DBHub-Secret header.  The
+// request is either a multipart form holding the database in a "file" field, or gives the https:// address of one in
+// a "url" field.  An optional "commitmsg" field sets the commit message.  The import happens in the background, with
+// its result shown on the database's settings page.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Import webhook handler"
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Imports need to be POST requests")
+		return
+	}
+
+	// Look up the webhook, and check the secret
+	token := strings.TrimPrefix(r.URL.Path, "/x/import/")
+	if token == "" || strings.Contains(token, "/") {
+		errorPage(w, r, http.StatusNotFound, "Unknown import webhook")
+		return
+	}
+	hook, found, err := com.ImportHookByToken(token)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !found {
+		errorPage(w, r, http.StatusNotFound, "Unknown import webhook")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-DBHub-Secret")), []byte(hook.Secret)) != 1 {
+		errorPage(w, r, http.StatusUnauthorized, "Incorrect import webhook secret")
+		return
+	}
+
+	// The user who created the webhook needs to still be able to manage the database
+	allowed, err := com.CanManageDBs(hook.Owner, hook.CreatedBy)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !allowed || !com.FeatureEnabled(com.FeatureWebhooks, hook.Owner) {
+		errorPage(w, r, http.StatusForbidden, "This import webhook can't be used any more")
+		return
+	}
+	archived, err := com.DBArchived(hook.Owner, hook.Folder, hook.DBName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if archived {
+		errorPage(w, r, http.StatusConflict, "That database is archived, so new versions can't be imported")
+		return
+	}
+	_, live, err := com.DBLive(hook.Owner, hook.Folder, hook.DBName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if live {
+		errorPage(w, r, http.StatusConflict, "That's a live database, so new versions can't be imported")
+		return
+	}
+	protected, err := com.BranchProtected(hook.Owner, hook.Folder, hook.DBName, hook.Branch)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if protected {
+		errorPage(w, r, http.StatusConflict, "That branch is protected, so new versions can't be imported to it")
+		return
+	}
+
+	// Save the posted database file to a temporary file, or note the address to download it from
+	var tempDBName, importSHA, importURL string
+	var dbSize int64
+	var shaSum []byte
+	queued := false
+	defer func() {
+		// The temporary file is removed by processUpload() once it's been handed over to it
+		if tempDBName != "" && !queued {
+			os.Remove(tempDBName)
+		}
+	}()
+	file, _, err := r.FormFile("file")
+	if err == nil {
+		defer file.Close()
+		tempDB, err := ioutil.TempFile("", "dbhub-import-")
+		if err != nil {
+			log.Printf("%s: Error creating temporary file: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		tempDBName = tempDB.Name()
+		hash := sha256.New()
+		dbSize, err = io.Copy(io.MultiWriter(tempDB, hash), file)
+		tempDB.Close()
+		if err != nil {
+			log.Printf("%s: Error when writing the imported db to a temp file: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		shaSum = hash.Sum(nil)
+		if dbSize == 0 {
+			errorPage(w, r, http.StatusBadRequest, "Database file is 0 length?")
+			return
+		}
+	} else {
+		importURL = strings.TrimSpace(r.FormValue("url"))
+		if importURL == "" {
+			errorPage(w, r, http.StatusBadRequest, "Either a database file or a URL needs to be given")
+			return
+		}
+		importSHA = strings.ToLower(strings.TrimSpace(r.FormValue("sha256")))
+		shaBytes, err := hex.DecodeString(importSHA)
+		if err != nil || len(shaBytes) != sha256.Size {
+			errorPage(w, r, http.StatusBadRequest, "The SHA256 of the database needs to be given in the sha256 field")
+			return
+		}
+	}
+	commitMsg := r.FormValue("commitmsg")
+	if commitMsg == "" {
+		commitMsg = "Imported by webhook"
+	}
+	err = com.ValidateCommitMessage(commitMsg)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Commit message needs to be 1024 characters or less")
+		return
+	}
+
+	// Create the job, then do the download (if needed) and storage in the background
+	job := com.UploadJob{
+		Branch:   hook.Branch,
+		DBName:   hook.DBName,
+		Folder:   hook.Folder,
+		ID:       com.RandomString(16),
+		Owner:    hook.Owner,
+		Started:  time.Now(),
+		Status:   com.UploadQueued,
+		Uploader: hook.CreatedBy,
+	}
+	err = com.SetUploadJobStatus(job)
+	if err != nil {
+		log.Printf("%s: Error when storing upload job status: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	queued = true
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	go func(tempDBName string, dbSize int64, shaSum []byte) {
+		if importURL != "" {
+			var err error
+			tempDBName, dbSize, shaSum, err = com.DownloadImportURL(ctx, importURL, importSHA)
+			if err != nil {
+				log.Printf("%s: Error downloading '%s': %v\n", pageName, importURL, err)
+				com.SetImportHookResult(hook.ID, fmt.Sprintf("Couldn't download the database: %v", err))
+				return
+			}
+		}
+
+		// The database is stored with the same settings as its latest version
+		var db com.SQLiteDBinfo
+		err := com.DBDetails(ctx, &db, hook.Owner, hook.Owner, hook.Folder, hook.DBName, 0)
+		if err != nil {
+			os.Remove(tempDBName)
+			com.SetImportHookResult(hook.ID, "Database query failed")
+			return
+		}
+		if !processUpload(ctx, job, hook.Folder, tempDBName, dbSize, shaSum, db.Info.Public, db.Info.Description,
+			db.Info.Readme, commitMsg) {
+			status, _, _ := com.UploadJobStatus(job.ID)
+			com.SetImportHookResult(hook.ID, "Import failed: "+status.Error)
+			return
+		}
+		status, _, _ := com.UploadJobStatus(job.ID)
+		com.SetImportHookResult(hook.ID, fmt.Sprintf("Imported as version %d", status.Version))
+	}(tempDBName, dbSize, shaSum)
+
+	// Return the job, so the caller has a record of it
+	jsonResponse, err := json.Marshal(job)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Adds or removes the import webhooks of a database, which external systems can push new versions of it to.
+func importHookHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Import webhooks need to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change the import webhooks of a database
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	if !com.FeatureEnabled(com.FeatureWebhooks, dbOwner) {
+		errorPage(w, r, http.StatusNotFound, "Webhooks aren't available")
+		return
+	}
+	switch r.PostFormValue("action") {
+	case "add":
+		branch := strings.TrimSpace(r.PostFormValue("branch"))
+		if branch != "" {
+			err = com.ValidateBranch(branch)
+			if err != nil {
+				errorPage(w, r, http.StatusBadRequest, "Invalid branch name")
+				return
+			}
+		}
+		err = com.AddImportHook(dbOwner, dbFolder, dbName, loggedInUser, branch)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when adding the import webhook")
+			return
+		}
+	case "remove":
+		hookID, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid import webhook ID")
+			return
+		}
+		err = com.RemoveImportHook(dbOwner, dbFolder, dbName, hookID)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Error when removing the import webhook")
+			return
+		}
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown import webhook action")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Sends an error to a client which expects JSON, using the same envelope for every endpoint.
+func jsonError(w http.ResponseWriter, r *http.Request, httpCode int, msg string) {
+	jsonResponse, err := json.Marshal(com.ErrorResponse{Code: httpCode, Message: msg, RequestID: requestID(r)})
+	if err != nil {
+		log.Printf("Error when serialising JSON error: %v\n", err)
+		return
+	}
+	com.NoteError(w, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpCode)
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Turns live mode on or off for a database.  Turning it off stores any changes not yet snapshotted as a new version.
+func liveDBHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Live mode needs to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	live, err := strconv.ParseBool(r.PostFormValue("live"))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid live value")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change live mode
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+
+	// Turning live mode off stores a new version, so neither way is allowed for archived databases
+	archived, err := com.DBArchived(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so its live mode can't be changed")
+		return
+	}
+	if live {
+		if !com.FeatureEnabled(com.FeatureLiveDBs, dbOwner) {
+			errorPage(w, r, http.StatusNotFound, "Live databases aren't available on this server")
+			return
+		}
+		var protected bool
+		protected, err = com.BranchProtected(dbOwner, dbFolder, dbName, com.DefaultBranch)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if protected {
+			errorPage(w, r, http.StatusConflict, "The main branch of that database is protected, so it can't be made live")
+			return
+		}
+		err = com.MakeDBLive(r.Context(), dbOwner, dbFolder, dbName)
+	} else {
+		err = com.StopDBLive(r.Context(), dbOwner, dbFolder, dbName)
+	}
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when changing the live status of the database")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?folder=%s", dbOwner, dbName, url.QueryEscape(dbFolder)),
+		http.StatusSeeOther)
+}
+
+// Checks the user making a request can change a live database, returning the user and the database.  Live databases
+// are changed by scripts and other programs, so the request needs to carry an access token with the write scope.
+// Session cookies aren't accepted, as browsers also send them with forms other sites post to us.  If the checks fail,
+// an error page is sent and ok is false.
+func liveWriteAccess(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) (loggedInUser string, db com.LiveDB, ok bool) {
+	loggedInUser, err := oauthUser(r, com.OAuthScopeWrite)
+	if err != nil {
+		errorPage(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "Live databases need to be changed using an access token")
+		return
+	}
+	if !writeAllowed(w, r, loggedInUser, dbOwner, dbFolder, dbName) {
+		return
+	}
+	db, live, err := com.DBLive(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !live {
+		errorPage(w, r, http.StatusBadRequest, "Only live databases can be changed this way")
+		return
+	}
+	protected, err := com.BranchProtected(dbOwner, dbFolder, dbName, com.DefaultBranch)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if protected {
+		errorPage(w, r, http.StatusConflict, "The main branch of that database is protected, so it can't be changed")
+		return
+	}
+	return loggedInUser, db, true
+}
+
+// loginCallbackHandler is called at the end of logging in through an external provider, whether successful or not.
+// The provider is given at the end of the path (eg /x/callback/github), with Auth0 using plain /x/callback.
+// If the login was successful:
+//   - if the user is already logged in, the provider account is linked to theirs as another way to log in.
+//   - if the provider account is linked to a user on our system then this function creates a login session for them.
+//   - if it isn't linked to anyone yet, they're bounced to the username selection page.
+//
+// If the login wasn't successful, an error message is displayed.
+func loginCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider := strings.Trim(strings.TrimPrefix(r.URL.Path, "/x/callback"), "/")
+	if provider == "" {
+		provider = com.LoginAuth0
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		}
+	}
+
+	// Logins started by loginHandler() include a random state value kept in the users' session, so other sites can't
+	// complete them on the users' behalf.  Auth0 logins can also be started by its Lock widget, which doesn't use
+	// ours, but linking a login to an existing account always needs it
+	stateOK := false
+	if sess != nil {
+		if state, ok := sess.Attr("LoginState").(string); ok && state != "" {
+			stateOK = state == r.FormValue("state")
+			sess.SetAttr("LoginState", nil)
+			session.Add(sess, w)
+		}
+	}
+	if !stateOK && (provider != com.LoginAuth0 || loggedInUser != "") {
+		errorPage(w, r, http.StatusForbidden, "Invalid login state.  Please try logging in again")
+		return
+	}
+	if r.FormValue("error") != "" {
+		errorPage(w, r, http.StatusUnauthorized, "Login was cancelled or refused")
+		return
+	}
+
+	// Retrieve the users' details from the provider
+	ident, err := com.LoginUser(r.Context(), provider, r.FormValue("code"))
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Login failed")
+		return
+	}
+
+	// If the user has an unverified email address, tell them to verify it before proceeding
+	if !ident.EmailVerified {
+		// TODO: Create a nicer notice page for this, as errorPage() doesn't look friendly
+		errorPage(w, r, http.StatusUnauthorized, "Please check your email.  You need to verify your "+
+			"email address before logging in will work.")
+		return
+	}
+
+	// Determine the DBHub.io username linked to the provider account
+	userName, err := com.UserNameFromIdentity(ident.Provider, ident.ProviderID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Logged in users are linking another login to their account
+	if loggedInUser != "" {
+		if userName != "" && userName != loggedInUser {
+			errorPage(w, r, http.StatusConflict, fmt.Sprintf("That %s account is already linked to a "+
+				"different user", com.LoginProviderName(provider)))
+			return
+		}
+		err = com.LinkIdentity(loggedInUser, ident)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		http.Redirect(w, r, "/pref", http.StatusSeeOther)
+		return
+	}
+
+	// If the user doesn't already exist, we need to create an account for them
+	if userName == "" {
+		if ident.Email != "" {
+			// Check if the email address is already in our system
+			exists, err := com.CheckEmailExists(ident.Email)
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, "Email check failed")
+				return
+			}
+			if exists {
+				errorPage(w, r, http.StatusConflict,
+					"Can't create new account: Your email address is already associated "+
+						"with a different account in our system.  Log in to that account and link this "+
+						"login from its preferences page instead.")
+				return
+			}
+		}
+		// Create a special session cookie, purely for the registration page
+		sess, err := com.NewSession(map[string]interface{}{
+			"registrationinprogress": true,
+			"provider":               ident.Provider,
+			"providerid":             ident.ProviderID,
+			"email":                  ident.Email,
+			"nickname":               ident.Nickname})
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Couldn't create a login session")
+			return
+		}
+		session.Add(sess, w)
+
+		// Bounce to a new page, for the user to select their preferred username
+		http.Redirect(w, r, "/selectusername", http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Don't let disabled users log in
+	disabled, err := com.UserDisabled(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if disabled {
+		errorPage(w, r, http.StatusForbidden, "Your account has been disabled")
+		return
+	}
+
+	// Create session cookie for the user
+	sess, err = com.NewSession(map[string]interface{}{"UserName": userName})
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't create a login session")
+		return
+	}
+	session.Add(sess, w)
+	com.SecurityLogin(userName, clientIP(r), r.UserAgent())
+
+	// Login completed, so bounce to the users' profile page
+	http.Redirect(w, r, "/"+userName, http.StatusTemporaryRedirect)
+}
+
+// Starts logging in through an external provider (eg /x/login/github), or linking one to the logged in users' account.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := com.RandomToken()
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't start the login")
+		return
+	}
+	loginURL, err := com.LoginURL(strings.TrimPrefix(r.URL.Path, "/x/login/"), state)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// The state value is checked by loginCallbackHandler() when the provider sends the user back
+	sess := session.Get(r)
+	if sess == nil {
+		var err error
+		sess, err = com.NewSession(map[string]interface{}{})
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Couldn't create a login session")
+			return
+		}
+	}
+	sess.SetAttr("LoginState", state)
+	session.Add(sess, w)
+	http.Redirect(w, r, loginURL, http.StatusSeeOther)
+}
+
+// Returns true when the login providers should be offered on the /login page, rather than through the Auth0 Lock
+// widget.  This is called by the page header template.
+func loginPageUsed() bool {
+	providers := com.LoginProviders()
+	return len(providers) != 1 || providers[0] != com.LoginAuth0
+}
+
+// Removes the logged in users session information.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	// Remove session info
+	sess := session.Get(r)
+	if sess != nil {
+		// Session data was present, so remove it
+		session.Remove(sess, w)
+	}
+
+	// Bounce to the front page
+	// TODO: This should probably reload the existing page instead
+	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+}
+
+// Returns the database page tab to show, which is either the one asked for in the request, or the database's default.
+func landingTab(r *http.Request, dbDefault string) string {
+	if tab := r.FormValue("tab"); tab != "" && com.ValidateLandingTab(tab) == nil {
+		return tab
+	}
+	if dbDefault == "" {
+		return com.LandingData
+	}
+	return dbDefault
+}
+
+// Wrapper function to log incoming https requests.
+func logReq(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Give the request an ID, so problems users report can be matched up with the logs
+		reqID := com.NewRequestID()
+		w.Header().Set(com.RequestIDHeader, reqID)
+		r = r.WithContext(com.WithRequestID(r.Context(), reqID))
+
+		// Check if user is logged in
+		var loggedInUser string
+		sess := session.Get(r)
+		if sess != nil {
+			u := sess.CAttr("UserName")
+			if u != nil {
+				loggedInUser = u.(string)
+			} else {
+				loggedInUser = "-"
+			}
+		} else {
+			loggedInUser = "-"
+		}
+
+		// Write request details to the request log
+		fmt.Fprintf(reqLog, "%v - %s [%s] \"%s %s %s\" \"-\" \"-\" \"%s\" \"%s\" \"%s\"\n", r.RemoteAddr,
+			loggedInUser, time.Now().Format(time.RFC3339Nano), r.Method, com.ScrubbedURL(r.URL), r.Proto,
+			r.Referer(), r.Header.Get("User-Agent"), reqID)
+
+		// Users need to accept the current terms of service before they can carry on using the site.  Acceptance is
+		// remembered in their session for a while, so the database isn't asked on every request
+		if loggedInUser != "-" && !termsExempt(r.URL.Path) {
+			checked, _ := sess.Attr("TermsChecked").(int64)
+			if time.Since(time.Unix(checked, 0)) > com.TermsCheckInterval {
+				accepted, err := com.TermsAccepted(loggedInUser)
+				if err != nil {
+					errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+					return
+				}
+				if !accepted {
+					// Only page requests are redirected to the terms, as the /x/ ones are form posts, downloads, and
+					// API calls which wouldn't know what to do with it
+					if r.Method != "GET" || strings.HasPrefix(r.URL.Path, "/x/") {
+						errorPage(w, r, http.StatusForbidden, "Please accept the updated terms of service first")
+						return
+					}
+					http.Redirect(w, r, "/terms?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+					return
+				}
+				sess.SetAttr("TermsChecked", time.Now().Unix())
+				session.Add(sess, w)
+			}
+		}
+
+		// Call the original function
+		fn(w, r)
+	}
+}
+
+func main() {
+	// Read server configuration
+	var err error
+	if err = com.ReadConfig(); err != nil {
+		log.Fatalf("Configuration file problem\n\n%v", err)
+	}
+
+	// Open the request log for writing.  When running several instances behind a load balancer, it's generally
+	// easier to send requests to stdout and let the log collector deal with them
+	if com.WebRequestLog() == "" || com.WebRequestLog() == "-" {
+		reqLog = os.Stdout
+		log.Printf("Logging requests to stdout\n")
+	} else {
+		reqLog, err = os.OpenFile(com.WebRequestLog(), os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0750)
+		if err != nil {
+			log.Fatalf("Error when opening request log: %s\n", err)
+		}
+		defer reqLog.Close()
+		log.Printf("Request log opened: %s\n", com.WebRequestLog())
+	}
+
+	// Parse our template files
+	tmpl = template.Must(template.New("templates").Delims("[[", "]]").Funcs(template.FuncMap{
+		"banners":      banners,
+		"loginPage":    loginPageUsed,
+		"providerName": com.LoginProviderName,
+	}).ParseGlob(
+		filepath.Join(com.WebBaseDir(), "webui", "templates", "*.html")))
+
+	// Connect to Minio server
+	err = com.ConnectMinio()
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	// Connect to PostgreSQL server
+	err = com.ConnectPostgreSQL()
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	// Connect to cache server
+	err = com.ConnectCache()
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	// Set up tracing
+	err = com.ConnectTracing("webui")
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+
+	// Setup session storage.  Sessions are kept in memcached, so they're available to all webui instances
+	session.Global.Close()
+	session.Global = session.NewCookieManagerOptions(com.NewCacheSessionStore(),
+		&session.CookieMngrOptions{AllowHTTP: false})
+
+	// Our pages
+	http.HandleFunc("/", logReq(mainHandler))
+	http.HandleFunc("/.well-known/oauth-authorization-server", logReq(oauthMetadataHandler))
+	http.HandleFunc("/.well-known/openid-configuration", logReq(oauthMetadataHandler))
+	http.HandleFunc("/about", logReq(aboutPage))
+	http.HandleFunc("/api/v1/commits/", logReq(apiCommitsHandler))
+	http.HandleFunc("/api/v1/contributors/", logReq(apiContributorsHandler))
+	http.HandleFunc("/api/v1/database/", logReq(apiDatabaseHandler))
+	http.HandleFunc("/api/v1/databases/", logReq(apiDatabasesHandler))
+	http.HandleFunc("/api/v1/schema/", logReq(apiSchemaHandler))
+	http.HandleFunc("/api/v1/statuses/", logReq(notOnMirror(apiStatusesHandler)))
+	http.HandleFunc("/api/v1/tables/", logReq(apiTablesHandler))
+	http.HandleFunc("/api/v1/versions/", logReq(apiVersionsHandler))
+	http.HandleFunc("/blame/", logReq(blameHandler))
+	http.HandleFunc("/certificates", logReq(certificatesPage))
+	http.HandleFunc("/commits/", logReq(commitsHandler))
+	http.HandleFunc("/contributors/", logReq(contributorsHandler))
+	http.HandleFunc("/diff/", logReq(diffHandler))
+	http.HandleFunc("/forks/", logReq(forksHandler))
+	http.HandleFunc("/history", logReq(historyHandler))
+	http.HandleFunc("/liveaudit/", logReq(liveAuditPage))
+	http.HandleFunc("/login", logReq(notOnMirror(loginPage)))
+	http.HandleFunc("/logout", logReq(logoutHandler))
+	http.HandleFunc("/mergerequests/", logReq(mergeRequestsHandler))
+	http.HandleFunc("/oauth/authorize", logReq(notOnMirror(oauthAuthorizeHandler)))
+	http.HandleFunc("/oauth/jwks", logReq(oauthKeySetHandler))
+	http.HandleFunc("/oauth/token", logReq(notOnMirror(oauthTokenHandler)))
+	http.HandleFunc("/oauth/userinfo", logReq(oauthUserInfoHandler))
+	http.HandleFunc("/pref", logReq(prefHandler))
+	http.HandleFunc("/register", logReq(notOnMirror(createUserHandler)))
+	http.HandleFunc("/robots.txt", logReq(robotsHandler))
+	http.HandleFunc("/selectusername", logReq(notOnMirror(selectUsernamePage)))
+	http.HandleFunc("/settings/", logReq(settingsPage))
+	http.HandleFunc("/sitemap.xml", logReq(sitemapHandler))
+	http.HandleFunc("/stars/", logReq(starsHandler))
+	http.HandleFunc("/stats", logReq(statsHandler))
+	http.HandleFunc("/takedown", logReq(notOnMirror(takedownHandler)))
+	http.HandleFunc("/terms", logReq(termsHandler))
+	http.HandleFunc("/upload/", logReq(notOnMirror(uploadFormHandler)))
+	http.HandleFunc("/x/acceptterms", logReq(acceptTermsHandler))
+	http.HandleFunc("/x/activity", logReq(activityHandler))
+	http.HandleFunc("/x/apitoken", logReq(notOnMirror(apiTokenHandler)))
+	http.HandleFunc("/x/appendcsv/", logReq(notOnMirror(appendCSVHandler)))
+	http.HandleFunc("/x/archivedb", logReq(archiveDBHandler))
+	http.HandleFunc("/x/attachment/", logReq(attachmentHandler))
+	http.HandleFunc("/x/avatar/", logReq(avatarHandler))
+	http.HandleFunc("/x/badge/", logReq(badgeHandler))
+	http.HandleFunc("/x/callback", logReq(notOnMirror(loginCallbackHandler)))
+	http.HandleFunc("/x/callback/", logReq(notOnMirror(loginCallbackHandler)))
+	http.HandleFunc("/x/checkname", logReq(checkNameHandler))
+	http.HandleFunc("/x/counternotice", logReq(notOnMirror(counterNoticeHandler)))
+	http.HandleFunc("/x/createorg", logReq(notOnMirror(createOrgHandler)))
+	http.HandleFunc("/x/dbwebhook", logReq(notOnMirror(dbWebhookHandler)))
+	http.HandleFunc("/x/deletedb/", logReq(notOnMirror(deleteDBHandler)))
+	http.HandleFunc("/x/deleteversion", logReq(notOnMirror(deleteVersionHandler)))
+	http.HandleFunc("/x/dismissbanner", logReq(dismissBannerHandler))
+	http.HandleFunc("/x/download/", logReq(downloadHandler))
+	http.HandleFunc("/x/downloadall/", logReq(downloadAllHandler))
+	http.HandleFunc("/x/downloadcert", logReq(downloadCertHandler))
+	http.HandleFunc("/x/downloadcsv/", logReq(downloadCSVHandler))
+	http.HandleFunc("/x/exec/", logReq(notOnMirror(execLiveHandler)))
+	http.HandleFunc("/x/follow/", logReq(followToggleHandler))
+	http.HandleFunc("/x/forkdb/", logReq(forkDBHandler))
+	http.HandleFunc("/x/gencert", logReq(generateCertHandler))
+	http.HandleFunc("/x/generatereadme", logReq(generateReadmeHandler))
+	http.HandleFunc("/x/geojson/", logReq(geoJSONHandler))
+	http.HandleFunc("/x/health/", logReq(healthHandler))
+	http.HandleFunc("/x/import/", logReq(notOnMirror(importHandler)))
+	http.HandleFunc("/x/importhook", logReq(notOnMirror(importHookHandler)))
+	http.HandleFunc("/x/livedb", logReq(notOnMirror(liveDBHandler)))
+	http.HandleFunc("/x/login/", logReq(notOnMirror(loginHandler)))
+	http.HandleFunc("/x/markdownpreview/", logReq(markdownPreview))
+	http.HandleFunc("/x/mergerequest", logReq(notOnMirror(mergeRequestHandler)))
+	http.HandleFunc("/x/mirrorlist", logReq(mirrorListHandler))
+	http.HandleFunc("/x/notifications", logReq(notificationsHandler))
+	http.HandleFunc("/x/notifications/read", logReq(notificationReadHandler))
+	http.HandleFunc("/x/notifications/readall", logReq(notificationReadHandler))
+	http.HandleFunc("/x/orgmember", logReq(notOnMirror(orgMemberHandler)))
+	http.HandleFunc("/x/protectbranch", logReq(notOnMirror(protectBranchHandler)))
+	http.HandleFunc("/x/publicdb/", logReq(publicDBHandler))
+	http.HandleFunc("/x/query/", logReq(queryHandler))
+	http.HandleFunc("/x/related/", logReq(relatedHandler))
+	http.HandleFunc("/x/remotefork", logReq(notOnMirror(remoteForkHandler)))
+	http.HandleFunc("/x/restoreversion", logReq(notOnMirror(restoreVersionHandler)))
+	http.HandleFunc("/x/requiredcheck", logReq(notOnMirror(requiredCheckHandler)))
+	http.HandleFunc("/x/reviewpolicy", logReq(notOnMirror(reviewPolicyHandler)))
+	http.HandleFunc("/x/revokeapitoken", logReq(revokeAPITokenHandler))
+	http.HandleFunc("/x/revokecert", logReq(revokeCertHandler))
+	http.HandleFunc("/x/revokesharelink", logReq(notOnMirror(revokeShareLinkHandler)))
+	http.HandleFunc("/x/revokeapp", logReq(revokeAppHandler))
+	http.HandleFunc("/x/savequery", logReq(saveQueryHandler))
+	http.HandleFunc("/x/savesettings", logReq(saveSettingsHandler))
+	http.HandleFunc("/x/sharedb", logReq(notOnMirror(shareDBHandler)))
+	http.HandleFunc("/x/sharelink", logReq(notOnMirror(shareLinkHandler)))
+	http.HandleFunc("/x/snapshotlive", logReq(notOnMirror(snapshotLiveHandler)))
+	http.HandleFunc("/x/star/", logReq(starToggleHandler))
+	http.HandleFunc("/x/table/", logReq(tableViewHandler))
+	http.HandleFunc("/x/unlinklogin", logReq(notOnMirror(unlinkLoginHandler)))
+	http.HandleFunc("/x/uploadattachment", logReq(notOnMirror(uploadAttachmentHandler)))
+	http.HandleFunc("/x/uploadavatar", logReq(notOnMirror(uploadAvatarHandler)))
+	http.HandleFunc("/x/uploadcheck", logReq(notOnMirror(uploadCheckHandler)))
+	http.HandleFunc("/x/uploaddata/", logReq(notOnMirror(uploadDataHandler)))
+	http.HandleFunc("/x/uploadprogress/", logReq(uploadProgressHandler))
+	http.HandleFunc("/x/uploadstatus/", logReq(uploadStatusHandler))
+	http.HandleFunc("/x/validationrule", logReq(notOnMirror(validationRuleHandler)))
+	http.HandleFunc("/x/verifylineage/", logReq(verifyLineageHandler))
+	http.HandleFunc("/x/watch/", logReq(watchToggleHandler))
+
+	// Static files
+	http.HandleFunc("/images/auth0.svg", logReq(serveStatic("images", "auth0.svg")))
+	http.HandleFunc("/images/rackspace.svg", logReq(serveStatic("images", "rackspace.svg")))
+	http.HandleFunc("/images/sqlitebrowser.svg", logReq(serveStatic("images", "sqlitebrowser.svg")))
+	http.HandleFunc("/favicon.ico", logReq(serveStatic("favicon.ico")))
+
+	// Start the client certificate login server, if enabled.  Read-only mirrors don't allow logins, and copy the
+	// public databases from their source instead
+	if com.MirrorSource() != "" {
+		log.Printf("Running as a read-only mirror of %s\n", com.MirrorSource())
+		go com.MirrorSyncLoop()
+	} else if com.WebCertLoginPort() != 0 {
+		go certLoginServer()
+	}
+
+	// Store the changes made to live databases back into their version history
+	if com.MirrorSource() == "" && com.LiveDataDir() != "" {
+		go com.LiveSnapshotLoop()
+	}
+
+	// Start server
+	log.Printf("DBHub server starting on https://%s\n", com.WebServer())
+	err = http.ListenAndServeTLS(com.WebBindAddress(), com.WebServerCert(), com.WebServerCertKey(),
+		com.ReportErrors("webui", com.SecurityHeaders(com.TraceHandler(http.DefaultServeMux))))
+
+	// Shut down nicely
+	com.DisconnectPostgreSQL()
+	com.DisconnectTracing()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func mainHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Main handler"
+
+	// Split the request URL into path components
+	pathStrings := strings.Split(r.URL.Path, "/")
+
+	// numPieces will be 2 if the request was for the root directory (https://server/), or if
+	// the request included only a single path component (https://server/someuser/)
+	numPieces := len(pathStrings)
+	if numPieces == 2 {
+		userName := pathStrings[1]
+		// Check if the request was for the root directory
+		if pathStrings[1] == "" {
+			// Yep, root directory request
+			frontPage(w, r)
+			return
+		}
+
+		// Atom feeds of user activity are at https://server/someuser.atom, unless that's a real user's name
+		if strings.HasSuffix(userName, ".atom") {
+			exists, err := com.CheckUserExists(userName)
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+				return
+			}
+			if !exists {
+				userName = strings.TrimSuffix(userName, ".atom")
+				err = com.ValidateUser(userName)
+				if err != nil {
+					errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+					return
+				}
+				userFeedHandler(w, r, userName)
+				return
+			}
+		}
+
+		// The request was for a user page
+		userPage(w, r, userName)
+		return
+	}
+
+	userName := pathStrings[1]
+	dbName := pathStrings[2]
+
+	// Validate the user supplied user and database name
+	err := com.ValidateUserDB(userName, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+		return
+	}
+
+	// This catches the case where a "/" is on the end of a user page URL
+	// TODO: Refactor this and the above identical code.  Doing it this way is non-optimal
+	if pathStrings[2] == "" {
+		// The request was for a user page
+		userPage(w, r, userName)
+		return
+	}
+
+	// Permalinks to a database version, using its SHA256.  eg https://server/someuser/somefolder/somedb/sha256/<sha>
+	if numPieces >= 5 && pathStrings[numPieces-2] == "sha256" {
+		dbFolder, err := com.NormaliseFolder(strings.Join(pathStrings[2:numPieces-3], "/"))
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		dbName = pathStrings[numPieces-3]
+		err = com.ValidateDB(dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+			return
+		}
+		permalinkHandler(w, r, userName, dbFolder, dbName, pathStrings[numPieces-1])
+		return
+	}
+
+	// Databases in a folder have the folder components between the user and database name,
+	// eg https://server/someuser/somefolder/somedb
+	dbFolder := "/"
+	if numPieces >= 4 && pathStrings[numPieces-1] != "" {
+		dbFolder, err = com.NormaliseFolder(strings.Join(pathStrings[2:numPieces-1], "/"))
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		dbName = pathStrings[numPieces-1]
+		err = com.ValidateDB(dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid user or database name")
+			return
+		}
+	}
+
+	// Atom feeds of database versions are at https://server/someuser/somedb.atom, unless that's a real database's
+	// name
+	if strings.HasSuffix(dbName, ".atom") {
+		// Looking up the versions as the owner tells us whether the database exists at all
+		versions, err := com.DBVersions(userName, userName, dbFolder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if len(versions) == 0 {
+			dbName = strings.TrimSuffix(dbName, ".atom")
+			err = com.ValidateDB(dbName)
+			if err != nil {
+				errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+				return
+			}
+			dbFeedHandler(w, r, userName, dbFolder, dbName)
+			return
+		}
+	}
+
+	// * A specific database was requested *
+
+	// Check if a version number was also requested
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+
+	// Scripts can ask for the database details as JSON, either with an Accept header or a .json suffix
+	w.Header().Add("Vary", "Accept")
+	if strings.HasSuffix(dbName, ".json") {
+		databaseJSON(w, r, userName, dbFolder, strings.TrimSuffix(dbName, ".json"), dbVersion)
+		return
+	}
+	if wantsJSON(r) {
+		databaseJSON(w, r, userName, dbFolder, dbName, dbVersion)
+		return
+	}
+
+	// Check if a table name was also requested
+	err = r.ParseForm()
+	if err != nil {
+		log.Printf("%s: Error with ParseForm() in main handler: %s\n", pageName, err)
+	}
+	dbTable := r.FormValue("table")
 
 	// If a table name was supplied, validate it
 	if dbTable != "" {
 		err = com.ValidatePGTable(dbTable)
 		if err != nil {
-			// Validation failed, so don't pass on the table name
-			log.Printf("%s: Validation failed for table name: %s", pageName, err)
-			dbTable = ""
+			// Validation failed, so don't pass on the table name
+			log.Printf("%s: Validation failed for table name: %s", pageName, err)
+			dbTable = ""
+		}
+	}
+
+	// Extract sort column, sort direction, and offset variables if present
+	sortCol := r.FormValue("sort")
+	sortDir := r.FormValue("dir")
+	sortType := r.FormValue("sorttype")
+	offsetStr := r.FormValue("offset")
+	var rowOffset int
+	if offsetStr == "" {
+		rowOffset = 0
+	} else {
+		rowOffset, err = strconv.Atoi(offsetStr)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Ensure the row offset isn't negative
+		if rowOffset < 0 {
+			rowOffset = 0
+		}
+	}
+
+	// Sanity check the sort column name
+	if sortCol != "" {
+		// Validate the sort column text, as we use it in string smashing SQL queries so need to be even more
+		// careful than usual
+		err = com.ValidateFieldName(sortCol)
+		if err != nil {
+			log.Printf("Validation failed on requested sort field name '%v': %v\n", sortCol,
+				err.Error())
+			errorPage(w, r, http.StatusBadRequest, "Validation failed on requested sort field name")
+			return
+		}
+	}
+
+	// If a sort direction was provided, validate it
+	if sortDir != "" {
+		if sortDir != "ASC" && sortDir != "DESC" {
+			errorPage(w, r, http.StatusBadRequest, "Invalid sort direction")
+			return
+		}
+	}
+
+	// If a sort type was provided, validate it
+	if sortType != com.SortDefault && sortType != com.SortDate && sortType != com.SortNumeric {
+		errorPage(w, r, http.StatusBadRequest, "Invalid sort type")
+		return
+	}
+
+	databasePage(w, r, userName, dbFolder, dbName, dbVersion, dbTable, sortCol, sortType, sortDir, rowOffset)
+}
+
+// Returns HTML rendered content from a given markdown string, for the settings page README preview tab.
+func markdownPreview(w http.ResponseWriter, r *http.Request) {
+	// Extract the markdown text form value
+	mkDown := r.PostFormValue("mkdown")
+
+	// Send the rendered version back to the caller
+	renderedText := com.LinkMentions(commonmark.Md2Html(mkDown, commonmark.CMARK_OPT_DEFAULT))
+	fmt.Fprint(w, renderedText)
+}
+
+// Merges an open merge request, once it meets everything the database needs first.  If it can't be merged, an error
+// page is sent and false is returned.
+func mergeMergeRequest(w http.ResponseWriter, r *http.Request, pageName string, loggedInUser string, dbOwner string,
+	dbFolder string, dbName string, mr com.MergeRequest) bool {
+	// Live databases are changed in place, so nothing can be merged into their main branch
+	if mr.TargetBranch == com.DefaultBranch {
+		_, live, err := com.DBLive(dbOwner, dbFolder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return false
+		}
+		if live {
+			errorPage(w, r, http.StatusConflict, "That's a live database, so nothing can be merged into its main "+
+				"branch")
+			return false
+		}
+	}
+
+	// Check the merge request is ready to be merged
+	head, found, err := com.BranchHead(dbOwner, dbFolder, dbName, mr.SourceBranch)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return false
+	}
+	if !found {
+		errorPage(w, r, http.StatusConflict, "The branch of that merge request doesn't exist any more")
+		return false
+	}
+	blockers, err := com.MergeBlockers(dbOwner, dbFolder, dbName, mr, head.CommitID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return false
+	}
+	if len(blockers) > 0 {
+		errorPage(w, r, http.StatusConflict, "That merge request can't be merged yet.  "+
+			strings.Join(blockers, ".  "))
+		return false
+	}
+
+	// Merge it
+	newVer, err := com.AcceptMergeRequest(dbOwner, dbFolder, dbName, mr, head, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when merging the merge request")
+		return false
+	}
+
+	// The merged version shows up in the activity feeds, webhooks, and watcher notifications the same as uploads do
+	err = com.RecordActivity(loggedInUser, com.FeedVersion, dbOwner, dbFolder, dbName, newVer, "")
+	if err != nil {
+		log.Printf("%s: Error recording activity for '%s%s%s': %v\n", pageName, dbOwner, dbFolder, dbName, err)
+	}
+	err = com.DBEvent(dbOwner, dbFolder, dbName, com.WebhookUpload, loggedInUser, map[string]interface{}{
+		"version":       newVer,
+		"merge_request": mr.ID,
+	})
+	if err != nil {
+		log.Printf("%s: Error queueing webhooks for '%s%s%s': %v\n", pageName, dbOwner, dbFolder, dbName, err)
+	}
+	err = com.NotifyWatchers(dbOwner, dbFolder, dbName, loggedInUser, fmt.Sprintf("Merge request #%d was merged "+
+		"into %s%s%s by %s, as version %d", mr.ID, dbOwner, dbFolder, dbName, loggedInUser, newVer))
+	if err != nil {
+		log.Printf("%s: Error notifying watchers of '%s%s%s': %v\n", pageName, dbOwner, dbFolder, dbName, err)
+	}
+	err = com.NotifyMergeRequestUsers(dbOwner, dbFolder, dbName, mr, loggedInUser, fmt.Sprintf("%s merged merge "+
+		"request #%d into %s%s%s, as version %d", loggedInUser, mr.ID, dbOwner, dbFolder, dbName, newVer))
+	if err != nil {
+		log.Printf("%s: Error sending merge request notifications for '%s%s%s': %v\n", pageName, dbOwner, dbFolder,
+			dbName, err)
+	}
+	return true
+}
+
+// Opens, approves, merges, or closes a merge request.  Everyone who can change a database can take part in its merge
+// requests, with the review policy of the database deciding when they can be merged.
+func mergeRequestHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Merge request handler"
+
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Merge requests need to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	dbOwner := strings.ToLower(r.PostFormValue("owner"))
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateUserDB(dbOwner, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database owner or name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Archived databases are read-only, which writeAccess() checks for, so their merge requests can't be changed
+	loggedInUser, ok := writeAccess(w, r, dbOwner, dbFolder, dbName)
+	if !ok {
+		return
+	}
+
+	// New merge requests are from one of the other branches into the main one
+	action := r.PostFormValue("action")
+	if action == "open" {
+		mr := com.MergeRequest{
+			CreatedBy:    loggedInUser,
+			Description:  strings.TrimSpace(r.PostFormValue("description")),
+			SourceBranch: strings.TrimSpace(r.PostFormValue("branch")),
+			TargetBranch: com.DefaultBranch,
+			Title:        strings.TrimSpace(r.PostFormValue("title")),
+		}
+		err = com.ValidateMergeRequest(mr)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if mr.SourceBranch == mr.TargetBranch {
+			errorPage(w, r, http.StatusBadRequest, "Merge requests need to be from a branch other than the main one")
+			return
+		}
+		_, found, err := com.BranchHead(dbOwner, dbFolder, dbName, mr.SourceBranch)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if !found {
+			errorPage(w, r, http.StatusBadRequest, "That branch doesn't exist")
+			return
+		}
+		mr.ID, err = com.AddMergeRequest(dbOwner, dbFolder, dbName, mr)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when opening the merge request")
+			return
+		}
+		err = com.NotifyMergeRequestUsers(dbOwner, dbFolder, dbName, mr, loggedInUser, fmt.Sprintf("%s opened "+
+			"merge request #%d on %s%s%s: %s", loggedInUser, mr.ID, dbOwner, dbFolder, dbName, mr.Title))
+		if err != nil {
+			log.Printf("%s: Error sending merge request notifications for '%s%s%s': %v\n", pageName, dbOwner,
+				dbFolder, dbName, err)
+		}
+		http.Redirect(w, r, fmt.Sprintf("/mergerequests/%s/%s?id=%d&folder=%s", dbOwner, dbName, mr.ID,
+			url.QueryEscape(dbFolder)), http.StatusSeeOther)
+		return
+	}
+
+	// The other actions are for an open merge request
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid merge request ID")
+		return
+	}
+	mr, found, err := com.MergeRequest(dbOwner, dbFolder, dbName, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !found {
+		errorPage(w, r, http.StatusNotFound, "That merge request doesn't exist")
+		return
+	}
+	if mr.State != com.MergeRequestOpen {
+		errorPage(w, r, http.StatusConflict, "That merge request isn't open")
+		return
+	}
+	var message string
+	switch action {
+	case "approve":
+		if mr.CreatedBy == loggedInUser {
+			errorPage(w, r, http.StatusBadRequest, "You can't approve your own merge request")
+			return
+		}
+		err = com.AddMergeRequestApproval(mr.ID, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when approving the merge request")
+			return
+		}
+		message = fmt.Sprintf("%s approved merge request #%d on %s%s%s", loggedInUser, mr.ID, dbOwner, dbFolder,
+			dbName)
+	case "close":
+		err = com.CloseMergeRequest(dbOwner, dbFolder, dbName, mr.ID, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when closing the merge request")
+			return
+		}
+		message = fmt.Sprintf("%s closed merge request #%d on %s%s%s", loggedInUser, mr.ID, dbOwner, dbFolder,
+			dbName)
+	case "merge":
+		if !mergeMergeRequest(w, r, pageName, loggedInUser, dbOwner, dbFolder, dbName, mr) {
+			return
+		}
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown merge request action")
+		return
+	}
+
+	// Merging sends its own notifications, as they include the new version number
+	if message != "" {
+		err = com.NotifyMergeRequestUsers(dbOwner, dbFolder, dbName, mr, loggedInUser, message)
+		if err != nil {
+			log.Printf("%s: Error sending merge request notifications for '%s%s%s': %v\n", pageName, dbOwner,
+				dbFolder, dbName, err)
+		}
+	}
+	http.Redirect(w, r, fmt.Sprintf("/mergerequests/%s/%s?id=%d&folder=%s", dbOwner, dbName, mr.ID,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Displays the merge requests of a database, or one merge request when its ID is given.
+func mergeRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user, folder, and database name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/mergerequests/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Render the requested page
+	if r.FormValue("id") == "" {
+		mergeRequestsPage(w, r, dbOwner, dbFolder, dbName)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid merge request ID")
+		return
+	}
+	mergeRequestPage(w, r, dbOwner, dbFolder, dbName, id)
+}
+
+// Lists the public databases and their versions as JSON, for read-only mirrors of this server to copy.
+func mirrorListHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := com.PublicDBList()
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when retrieving the database list")
+		return
+	}
+	if list == nil {
+		list = []com.MirrorDB{}
+	}
+	jsonResponse, err := json.Marshal(list)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Marks one notification, or all of them, as read for the logged in user.
+func notificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Notifications need to be marked read using POST")
+		return
+	}
+
+	// Mark everything as read if requested
+	if r.URL.Path == "/x/notifications/readall" {
+		err := com.MarkAllNotificationsRead(loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Couldn't mark the notifications as read")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid notification ID")
+		return
+	}
+	err = com.MarkNotificationRead(loggedInUser, id)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, "Unknown notification")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the notification inbox of the logged in user, as JSON.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	list, unread, err := com.Notifications(loggedInUser, com.NotificationListLength)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when retrieving notifications")
+		return
+	}
+	if list == nil {
+		list = []com.Notification{}
+	}
+	jsonResponse, err := json.Marshal(struct {
+		Notifications []com.Notification `json:"notifications"`
+		Unread        int                `json:"unread"`
+	}{list, unread})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Wraps the handlers for things a read-only mirror doesn't allow, like logging in and uploading.
+func notOnMirror(fn http.HandlerFunc) http.HandlerFunc {
+	if com.MirrorSource() == "" {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		errorPage(w, r, http.StatusForbidden, fmt.Sprintf("This server is a read-only mirror of %s, so "+
+			"logging in and making changes aren't possible here", com.MirrorSource()))
+	}
+}
+
+// Handles OAuth authorisation requests from third party applications.  The logged in user is asked whether to grant
+// the application access, and if they agree it's sent an authorisation code to exchange for an access token.
+func oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "OAuth authorisation handler"
+
+	// Validate the client application and where to send the user afterwards.  Errors with these aren't sent back to
+	// the application, as we can't be sure the redirect URI is theirs
+	client, err := com.OAuthClientDetails(r.FormValue("client_id"))
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if client.ClientID == "" {
+		errorPage(w, r, http.StatusBadRequest, "Unknown application")
+		return
+	}
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" {
+		redirectURI = client.RedirectURI
+	}
+	if redirectURI != client.RedirectURI {
+		log.Printf("%s: Redirect URI '%s' doesn't match the registered one for OAuth client '%s'\n", pageName,
+			redirectURI, client.ClientID)
+		errorPage(w, r, http.StatusBadRequest, "Redirect URI doesn't match the one registered for the application")
+		return
+	}
+
+	// Validate the rest of the request
+	state := r.FormValue("state")
+	if r.FormValue("response_type") != "code" {
+		oauthRedirect(w, r, redirectURI, url.Values{"error": {"unsupported_response_type"}, "state": {state}})
+		return
+	}
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = com.OAuthScopeProfile
+	}
+	scopes := strings.Fields(scope)
+	for _, s := range scopes {
+		if s == com.OAuthScopeOpenID && com.OIDCEnabled() {
+			continue
+		}
+		if s != com.OAuthScopeProfile && s != com.OAuthScopeRead && s != com.OAuthScopeWrite {
+			oauthRedirect(w, r, redirectURI, url.Values{"error": {"invalid_scope"}, "state": {state}})
+			return
+		}
+	}
+
+	// OpenID Connect applications can send a nonce, which is given back to them in the ID token
+	nonce := r.FormValue("nonce")
+	if len(nonce) > 255 {
+		oauthRedirect(w, r, redirectURI, url.Values{"error": {"invalid_request"}, "state": {state}})
+		return
+	}
+
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in to authorise applications")
+		return
+	}
+
+	// Ask the user if they want to grant access.  The consent form includes a random value stored in their session,
+	// so other sites can't submit it on the users' behalf
+	if r.Method != "POST" {
+		consentToken, err := com.RandomToken()
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Couldn't generate consent form")
+			return
+		}
+		sess.SetAttr("OAuthConsent", consentToken)
+		session.Add(sess, w)
+		oauthConsentPage(w, r, loggedInUser, client, scopes, redirectURI, state, nonce, consentToken)
+		return
+	}
+	if t, ok := sess.Attr("OAuthConsent").(string); !ok || t != r.PostFormValue("consent_token") {
+		errorPage(w, r, http.StatusForbidden, "Invalid consent form submission")
+		return
+	}
+	sess.SetAttr("OAuthConsent", nil)
+	session.Add(sess, w)
+
+	// The user declined
+	if r.PostFormValue("approve") == "" {
+		oauthRedirect(w, r, redirectURI, url.Values{"error": {"access_denied"}, "state": {state}})
+		return
+	}
+
+	// The user approved, so send the application an authorisation code
+	code, err := com.AddOAuthCode(client.ClientID, loggedInUser, strings.Join(scopes, " "), redirectURI, nonce)
+	if err != nil {
+		oauthRedirect(w, r, redirectURI, url.Values{"error": {"server_error"}, "state": {state}})
+		return
+	}
+	log.Printf("%s: User '%s' granted '%s' access to OAuth client '%s'\n", pageName, loggedInUser,
+		strings.Join(scopes, " "), client.ClientID)
+	oauthRedirect(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// Sends an OAuth error response to a client application, in the JSON format given by RFC 6749.
+func oauthError(w http.ResponseWriter, httpCode int, errCode string, description string) {
+	com.NoteError(w, description)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": errCode, "error_description": description})
+}
+
+// Returns the public key OpenID Connect ID tokens are signed with, so client applications can check them.
+func oauthKeySetHandler(w http.ResponseWriter, r *http.Request) {
+	if !com.OIDCEnabled() {
+		errorPage(w, r, http.StatusNotFound, "OpenID Connect isn't available on this server")
+		return
+	}
+	keySet, err := com.OIDCKeySet()
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't load the signing key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keySet)
+}
+
+// Describes our OAuth endpoints, so client applications can discover them (RFC 8414).  The same document is used for
+// OpenID Connect discovery, with the extra fields it needs when ID tokens can be issued.
+func oauthMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	base := "https://" + com.WebServer()
+	scopes := []string{com.OAuthScopeProfile, com.OAuthScopeRead, com.OAuthScopeWrite}
+	metadata := map[string]interface{}{
+		"issuer":                                base,
+		"authorization_endpoint":                base + "/oauth/authorize",
+		"token_endpoint":                        base + "/oauth/token",
+		"userinfo_endpoint":                     base + "/oauth/userinfo",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	}
+	if com.OIDCEnabled() {
+		scopes = append(scopes, com.OAuthScopeOpenID)
+		metadata["jwks_uri"] = base + "/oauth/jwks"
+		metadata["subject_types_supported"] = []string{"public"}
+		metadata["id_token_signing_alg_values_supported"] = []string{"RS256"}
+		metadata["claims_supported"] = []string{"aud", "email", "exp", "iat", "iss", "nonce", "preferred_username",
+			"sub"}
+	}
+	metadata["scopes_supported"] = scopes
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+// Sends the user back to a client application, with the given parameters added to its redirect URI.
+func oauthRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid redirect URI")
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v[0] != "" {
+			q.Set(k, v[0])
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Exchanges an OAuth authorisation code for an access token.
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		oauthError(w, http.StatusMethodNotAllowed, "invalid_request", "Token requests need to use POST")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+		return
+	}
+
+	// Authenticate the client application.  The credentials can be given using HTTP basic auth, or in the form
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+	valid, err := com.CheckOAuthClientSecret(clientID, secret)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "Database query failed")
+		return
+	}
+	if !valid {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "Unknown client or incorrect secret")
+		return
+	}
+
+	// Issue the access token
+	token, userName, scope, nonce, err := com.ExchangeOAuthCode(clientID, r.PostFormValue("code"),
+		r.PostFormValue("redirect_uri"))
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "Couldn't issue access token")
+		return
+	}
+	if token == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorisation code")
+		return
+	}
+	resp := map[string]interface{}{
+		"access_token": token,
+		"expires_in":   int(com.OAuthTokenLifetime.Seconds()),
+		"scope":        scope,
+		"token_type":   "Bearer",
+	}
+
+	// OpenID Connect applications are also given an ID token saying who the user is
+	if scopeIncludes(scope, com.OAuthScopeOpenID) {
+		now := time.Now()
+		claims := map[string]interface{}{
+			"aud": clientID,
+			"exp": now.Add(com.OAuthIDTokenLifetime).Unix(),
+			"iat": now.Unix(),
+			"iss": "https://" + com.WebServer(),
+			"sub": userName,
+		}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		if scopeIncludes(scope, com.OAuthScopeProfile) {
+			user, err := com.User(userName)
+			if err != nil {
+				oauthError(w, http.StatusInternalServerError, "server_error", "Database query failed")
+				return
+			}
+			claims["email"] = user.Email
+			claims["preferred_username"] = user.Username
+		}
+		resp["id_token"], err = com.SignIDToken(claims)
+		if err != nil {
+			oauthError(w, http.StatusInternalServerError, "server_error", "Couldn't issue ID token")
+			return
+		}
+	}
+
+	// Let the user know an application now has access to their account
+	client, err := com.OAuthClientDetails(clientID)
+	if err == nil {
+		com.SecurityNotice(userName, fmt.Sprintf("The application '%s' was given an access token for your "+
+			"account, with '%s' access.", client.Name, scope))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Returns the user an OAuth access token or personal API token sent with a request was issued for, if the token
+// includes the given scope.  If the request doesn't include a token, an empty user name is returned.
+func oauthUser(r *http.Request, scope string) (string, error) {
+	userName, tokenScope, err := oauthUserScope(r)
+	if err != nil || userName == "" {
+		return "", err
+	}
+	if !scopeIncludes(tokenScope, scope) {
+		return "", fmt.Errorf("Access token doesn't include the '%s' scope", scope)
+	}
+	return userName, nil
+}
+
+// Returns the user an OAuth access token or personal API token sent with a request was issued for, along with the
+// scopes it includes.  If the request doesn't include a token, an empty user name is returned.
+func oauthUserScope(r *http.Request) (userName string, tokenScope string, err error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", "", nil
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	personal := strings.HasPrefix(token, com.APITokenPrefix)
+	if personal {
+		userName, tokenScope, err = com.APITokenUser(token)
+	} else {
+		userName, tokenScope, err = com.OAuthTokenUser(token)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Couldn't verify access token")
+	}
+	if userName == "" {
+		return "", "", fmt.Errorf("Invalid or expired access token")
+	}
+	if personal {
+		com.RecordAPITokenUse(token, clientIP(r), r.Method+" "+r.URL.Path)
+	} else {
+		com.RecordTokenUse(token, clientIP(r), r.Method+" "+r.URL.Path)
+	}
+	return userName, tokenScope, nil
+}
+
+// Returns the details of the user an OAuth access token was issued for.  Tokens with only the openid scope just get
+// the user's ID, as OpenID Connect needs, while the profile scope adds their user name and email address.
+func oauthUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	userName, tokenScope, err := oauthUserScope(r)
+	if err == nil && userName == "" {
+		err = fmt.Errorf("No access token given")
+	}
+	profile := scopeIncludes(tokenScope, com.OAuthScopeProfile)
+	if err == nil && !profile && !scopeIncludes(tokenScope, com.OAuthScopeOpenID) {
+		err = fmt.Errorf("Access token doesn't include the '%s' scope", com.OAuthScopeProfile)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+	info := map[string]string{"sub": userName}
+	if profile {
+		user, err := com.User(userName)
+		if err != nil {
+			oauthError(w, http.StatusInternalServerError, "server_error", "Database query failed")
+			return
+		}
+		info["email"] = user.Email
+		info["preferred_username"] = user.Username
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// Adds a user to an organisation, changes their role in it, or removes them from it (when no role is given).  Only
+// owners of the organisation can change who's in it, though members can remove themselves.
+func orgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Organisation members need to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	orgName := r.PostFormValue("org")
+	err := com.ValidateUser(orgName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid organisation name")
+		return
+	}
+	userName := strings.ToLower(strings.TrimSpace(r.PostFormValue("username")))
+	err = com.ValidateUser(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+		return
+	}
+	role := r.PostFormValue("role")
+	switch role {
+	case "", com.OrgRoleOwner, com.OrgRoleAdmin, com.OrgRoleMember:
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown organisation role")
+		return
+	}
+
+	myRole, err := com.OrgRole(orgName, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if myRole != com.OrgRoleOwner && !(role == "" && userName == loggedInUser && myRole != "") {
+		errorPage(w, r, http.StatusForbidden, "Only owners of an organisation can change its members")
+		return
+	}
+
+	if role == "" {
+		err = com.RemoveOrgMember(orgName, userName)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		userExists, err := com.CheckUserExists(userName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if !userExists {
+			errorPage(w, r, http.StatusNotFound, "Unknown user")
+			return
+		}
+		err = com.SetOrgMember(orgName, userName, role)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	http.Redirect(w, r, "/"+orgName, http.StatusSeeOther)
+}
+
+// Sends the database version with the given SHA256.  These permalinks always refer to the same content, even if the
+// database is renamed or new versions are added later.
+func permalinkHandler(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string,
+	sha string) {
+	pageName := "Permalink handler"
+
+	// Validate the SHA256
+	sha = strings.ToLower(sha)
+	shaBytes, err := hex.DecodeString(sha)
+	if err != nil || len(shaBytes) != sha256.Size {
+		errorPage(w, r, http.StatusBadRequest, "Invalid SHA256")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Find the database version with that content
+	dbName, dbVersion, err := com.DBVersionBySHA256(loggedInUser, dbOwner, dbFolder, dbName, sha)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if dbVersion == 0 {
+		errorPage(w, r, http.StatusNotFound, "No database with that SHA256 was found")
+		return
+	}
+
+	// Databases which have been taken down can't be downloaded
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// The content behind a permalink never changes, so the SHA256 makes a good ETag
+	w.Header().Set("ETag", `"`+sha+`"`)
+	if r.Header.Get("If-None-Match") == `"`+sha+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	sendDatabase(w, r, pageName, loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
+}
+
+// Builds an archive of a user's public databases in the background and stores it in Minio, then lets the user who
+// asked for it know it's ready to download.
+func prepareArchive(ctx context.Context, job com.ArchiveJob, dbList []com.StoredDBVersion) {
+	pageName := "Prepare archive"
+
+	// Send the archive to Minio as it's generated
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeDBArchive(ctx, pw, dbList))
+	}()
+	_, err := com.StoreMinioObject(ctx, job.Bucket, job.MinioID, pr)
+	pr.CloseWithError(err)
+	if err == nil {
+		err = com.SetArchiveJob(job)
+	}
+	if err != nil {
+		log.Printf("%s: Error when preparing archive of '%s' databases: %v\n", pageName, job.Owner, err)
+		com.Notify([]string{job.Requester}, com.NotifyArchive,
+			fmt.Sprintf("The archive of %s's public databases couldn't be prepared", job.Owner), "")
+		return
+	}
+	com.Notify([]string{job.Requester}, com.NotifyArchive,
+		fmt.Sprintf("The archive of %s's public databases is ready to download", job.Owner),
+		fmt.Sprintf("/x/downloadall/%s?archive=%s", job.Owner, job.ID))
+}
+
+// This handles incoming requests for the preferences page by logged in users.
+func prefHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Preferences handler"
+
+	// Ensure user is logged in
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if validSession != true {
+		// Display an error message
+		// TODO: Show the login dialog (also for the settings page)
+		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
+		return
+	}
+
+	// Gather submitted form data (if any)
+	err := r.ParseForm()
+	if err != nil {
+		log.Printf("%s: Error when parsing preference data: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		return
+	}
+	maxRows := r.PostFormValue("maxrows")
+	digest := r.PostFormValue("digest")
+	notifyWebhook := strings.TrimSpace(r.PostFormValue("notifywebhook"))
+	beta := r.PostFormValue("beta") == "true"
+	profile := com.UserProfile{
+		Bio:         strings.TrimSpace(r.PostFormValue("bio")),
+		DisplayName: strings.TrimSpace(r.PostFormValue("displayname")),
+		Location:    strings.TrimSpace(r.PostFormValue("location")),
+		Website:     strings.TrimSpace(r.PostFormValue("website")),
+	}
+
+	// If no form data was submitted, display the preferences page form
+	if maxRows == "" {
+		prefPage(w, r, fmt.Sprintf("%s", loggedInUser))
+		return
+	}
+
+	// Validate submitted form data
+	err = com.Validate.Var(maxRows, fmt.Sprintf("required,numeric,min=1,max=%d", com.WebMaxDisplayRows()))
+	if err != nil {
+		log.Printf("%s: Preference data failed validation: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		return
+	}
+
+	maxRowsNum, err := strconv.Atoi(maxRows)
+	if err != nil {
+		log.Printf("%s: Error converting string '%v' to integer: %s\n", pageName, maxRows, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		return
+	}
+	if digest == "" {
+		digest = com.DigestNone
+	}
+	if digest != com.DigestNone && digest != com.DigestDaily && digest != com.DigestWeekly {
+		errorPage(w, r, http.StatusBadRequest, "Unknown email digest frequency")
+		return
+	}
+	// When webhooks aren't available to the user the form doesn't include them, so the existing settings are kept
+	webhooks := com.FeatureEnabled(com.FeatureWebhooks, loggedInUser)
+	existingPrefs, err := com.NotificationPrefs(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !webhooks {
+		notifyWebhook = com.PrefUserNotifyWebhook(loggedInUser)
+	} else if notifyWebhook != "" {
+		err = com.ValidateNotifyWebhook(notifyWebhook)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("The notification webhook can't be used: %v", err))
+			return
+		}
+	}
+
+	err = com.ValidateProfile(profile)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Each notification preference is a checkbox named after its kind and channel
+	notifyPrefs := make(map[string]map[string]bool)
+	for _, k := range com.NotificationKinds {
+		notifyPrefs[k.Kind] = make(map[string]bool)
+		for _, c := range com.NotificationChannels {
+			if c == com.ChannelWebhook && !webhooks {
+				notifyPrefs[k.Kind][c] = existingPrefs[k.Kind][c]
+				continue
+			}
+			notifyPrefs[k.Kind][c] = r.PostFormValue(fmt.Sprintf("notify_%s_%s", k.Kind, c)) == "true"
+		}
+	}
+
+	// Update the preference data in the database
+	err = com.SetPrefUserMaxRows(loggedInUser, maxRowsNum)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		return
+	}
+	err = com.SaveNotificationPrefs(loggedInUser, notifyPrefs, notifyWebhook)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		return
+	}
+	err = com.SetPrefUserDigest(loggedInUser, digest)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		return
+	}
+	err = com.SetPrefUserBeta(loggedInUser, beta)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		return
+	}
+	err = com.SetUserProfile(loggedInUser, profile)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		return
+	}
+
+	// Bounce to the user home page
+	http.Redirect(w, r, "/"+loggedInUser, http.StatusTemporaryRedirect)
+}
+
+// Sanity checks an uploaded database and stores it, updating the status of its upload job as it goes.  The temporary
+// file holding the upload is removed when done.  Returns true if the database was stored.
+func processUpload(ctx context.Context, job com.UploadJob, folder string, tempDBName string, dbSize int64,
+	shaSum []byte, public bool, descrip string, readme string, commitMsg string) (stored bool) {
+	pageName := "Process upload"
+	loggedInUser := job.Owner
+	dbName := job.DBName
+
+	// Updates the job status
+	setStatus := func(status string) {
+		job.Status = status
+		err := com.SetUploadJobStatus(job)
+		if err != nil {
+			log.Printf("%s: Error when storing upload job status: %v\n", pageName, err)
+		}
+	}
+
+	// Records a failure for the job, with a message suitable for displaying to the user
+	fail := func(msg string) {
+		job.Error = msg
+		setStatus(com.UploadFailed)
+	}
+
+	// This runs in the background, so a panic would otherwise take down the server and leave the job looking like
+	// it's still being processed
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("%s: Panic when processing upload of '%s' by '%s': %v\n%s", pageName, dbName, loggedInUser, p,
+				debug.Stack())
+			fail("Internal error")
+			stored = false
+		}
+	}()
+
+	// Delete the temporary file when this function finishes
+	defer os.Remove(tempDBName)
+
+	// Sanity check the uploaded database
+	setStatus(com.UploadChecking)
+	err := com.SanityCheck(tempDBName)
+	if err != nil {
+		fail(err.Error())
+		return false
+	}
+
+	// Check it with the virus scanner.  Content which has been scanned before uses the cached verdict
+	clean, _, err := com.ScanDatabase(ctx, tempDBName, hex.EncodeToString(shaSum))
+	if err != nil {
+		fail("Couldn't scan the database for viruses")
+		return false
+	}
+	if !clean {
+		log.Printf("%s: Virus scanner flagged upload of '%s' by '%s'\n", pageName, dbName, loggedInUser)
+		fail("The database was flagged by the virus scanner")
+		return false
+	}
+
+	// New versions of an existing database need to pass its validation rules
+	violations, err := com.CheckValidationRules(ctx, loggedInUser, folder, dbName, tempDBName)
+	if err != nil {
+		fail("Couldn't check the database's validation rules")
+		return false
+	}
+	if len(violations) > 0 {
+		fail(com.ViolationsError(violations).Error())
+		return false
+	}
+
+	// Make sure the user has enough storage quota left
+	exceeded, err := com.StorageQuotaExceeded(loggedInUser, dbSize)
+	if err != nil {
+		fail("Database query failure")
+		return false
+	}
+	if exceeded {
+		fail("Storing this database would exceed your storage quota")
+		return false
+	}
+
+	// Determine the version number for this new database
+	setStatus(com.UploadStoring)
+	highVer, err := com.HighestDBVersion(loggedInUser, dbName, folder, loggedInUser)
+	var newVer int
+	if highVer > 0 {
+		// The database already exists
+		newVer = highVer + 1
+	} else {
+		newVer = 1
+	}
+
+	// Retrieve the Minio bucket to store the database in
+	bucket, err := com.MinioUserBucket(loggedInUser)
+	if err != nil {
+		fail("Database query failure")
+		return false
+	}
+
+	// Generate filename to store the database as
+	var minioID string
+	for okID := false; okID == false; {
+		// Check if the randomly generated filename is available, just in caes
+		minioID = com.RandomString(8) + ".db"
+		okID, err = com.CheckMinioIDAvail(loggedInUser, minioID)
+		if err != nil {
+			fail("Database query failure")
+			return false
+		}
+	}
+
+	// Store the database file in Minio
+	dbFile, err := os.Open(tempDBName)
+	if err != nil {
+		log.Printf("%s: Error when opening temporary file '%s': %v\n", pageName, tempDBName, err)
+		fail("Internal error")
+		return false
+	}
+	defer dbFile.Close()
+	storedSize, err := com.StoreMinioObject(ctx, bucket, minioID, dbFile)
+	if err != nil {
+		fail("Storing database file failed")
+		return false
+	}
+
+	// New databases uploaded without a description get one worked out from their contents
+	if newVer == 1 && descrip == "" {
+		descrip = com.AutoDescription(tempDBName)
+	}
+
+	// Add the database file details to PostgreSQL
+	err = com.AddDatabase(loggedInUser, folder, dbName, newVer, shaSum, int(dbSize), storedSize, public, bucket,
+		minioID, descrip, readme, commitMsg, job.Uploader, job.Branch)
+	if err != nil {
+		fail("Adding database details to PostgreSQL failed")
+		return false
+	}
+
+	// Pick up the title, license, and column docs from the database's own metadata table, if it has one
+	err = com.ImportMetadataTable(tempDBName, loggedInUser, folder, dbName)
+	if err != nil {
+		log.Printf("%s: Error importing metadata table for '%s%s%s': %v\n", pageName, loggedInUser, folder,
+			dbName, err)
+	}
+
+	// Add the new version to the activity feeds, and let the database's webhooks know about it
+	err = com.RecordActivity(job.Uploader, com.FeedVersion, loggedInUser, folder, dbName, newVer, "")
+	if err != nil {
+		log.Printf("%s: Error recording activity for '%s%s%s': %v\n", pageName, loggedInUser, folder, dbName, err)
+	}
+	err = com.DBEvent(loggedInUser, folder, dbName, com.WebhookUpload, job.Uploader, map[string]interface{}{
+		"version":        newVer,
+		"commit_message": commitMsg,
+	})
+	if err != nil {
+		log.Printf("%s: Error queueing webhooks for '%s%s%s': %v\n", pageName, loggedInUser, folder, dbName, err)
+	}
+
+	// Let the users watching the database know too
+	err = com.NotifyWatchers(loggedInUser, folder, dbName, job.Uploader, fmt.Sprintf("Version %d of %s%s%s was "+
+		"uploaded by %s", newVer, loggedInUser, folder, dbName, job.Uploader))
+	if err != nil {
+		log.Printf("%s: Error notifying watchers of '%s%s%s': %v\n", pageName, loggedInUser, folder, dbName, err)
+	}
+
+	// Log the successful database upload
+	log.Printf("%s: Username: %v, database '%v' uploaded as '%v', bytes: %v, stored bytes: %v\n", pageName,
+		loggedInUser, dbName, minioID, dbSize, storedSize)
+
+	// Database upload succeeded
+	job.Version = newVer
+	setStatus(com.UploadComplete)
+	return true
+}
+
+// Protects or unprotects a branch of a database.  New versions can't be uploaded directly to protected branches.
+func protectBranchHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Branch protection needs to be changed using POST")
+		return
+	}
+
+	// Validate the form data.  The main branch is used when no branch name is given
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+	branch := strings.TrimSpace(r.PostFormValue("branch"))
+	if branch == "" {
+		branch = com.DefaultBranch
+	}
+	err = com.ValidateBranch(branch)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid branch name")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change which branches are protected
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	switch r.PostFormValue("action") {
+	case "add":
+		// Live databases write straight to the main branch, so it can't be protected while they're live
+		if branch == com.DefaultBranch {
+			_, live, err := com.DBLive(dbOwner, dbFolder, dbName)
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+				return
+			}
+			if live {
+				errorPage(w, r, http.StatusConflict, "The main branch of a live database can't be protected")
+				return
+			}
+		}
+		err = com.ProtectBranch(dbOwner, dbFolder, dbName, branch, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when protecting the branch")
+			return
+		}
+	case "remove":
+		err = com.UnprotectBranch(dbOwner, dbFolder, dbName, branch)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown branch protection action")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Returns the details of a public database and its versions as JSON.  Other DBHub instances use this when forking
+// the database.
+func publicDBHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the user and database name
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/publicdb/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	db, found, err := com.PublicDB(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !found {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+	jsonResponse, err := json.Marshal(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Runs a read-only SQL query against a database, returning the results in JSON format.  Queries run by logged in
+// users are recorded in their query history.
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Query handler"
+
+	// Retrieve user, database, and version
+	dbOwner, dbName, dbVersion, err := com.GetODV(2, r) // 2 = Ignore "/x/query/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Make sure a query was given
+	query := r.FormValue("sql")
+	if strings.TrimSpace(query) == "" {
+		errorPage(w, r, http.StatusBadRequest, "No query given")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Third party applications authorised through OAuth send an access token instead
+	if loggedInUser == "" {
+		loggedInUser, err = oauthUser(r, com.OAuthScopeRead)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Running queries can be switched off by the instance admins, or only rolled out to some users
+	if !com.FeatureEnabled(com.FeatureQueryAPI, loggedInUser) {
+		errorPage(w, r, http.StatusNotFound, "Running queries isn't available on this server")
+		return
+	}
+
+	// Databases which have been taken down can't be downloaded or queried
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// If no version number was given, use the highest one available to the user
+	if dbVersion == 0 {
+		dbVersion, err = com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+		if dbVersion == 0 {
+			errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+			return
+		}
+	}
+
+	// Check if the user has access to the requested database
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Determine the number of rows to return
+	maxRows, err := requestedRows(r, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Results for public databases are cached by version SHA256, so look for an existing entry
+	sha, public, err := com.DBVersionSHA256(dbOwner, dbFolder, dbName, dbVersion)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	var cacheKey string
+	var dataRows com.SQLiteRecordSet
+	cached := false
+	if public {
+		cacheKey = com.QueryCacheKey(sha, query, maxRows)
+		cached, err = com.GetCachedData(r.Context(), cacheKey, &dataRows)
+		if err != nil {
+			log.Printf("%s: Error retrieving query results from cache: %v\n", pageName, err)
+		}
+	}
+
+	startTime := time.Now()
+	if !cached {
+		// Open the Minio database
+		sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.ReleaseSQLiteHandle(sdb)
+
+		// Run the query
+		dataRows, err = com.RunSQLiteQuery(r.Context(), sdb, query, maxRows)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	duration := time.Since(startTime)
+
+	// Add the query to the user's history.  Results which came from the cache are flagged, so their near zero duration
+	// isn't mistaken for how long the query takes to run
+	if loggedInUser != "" {
+		err = com.AddQueryHistory(loggedInUser, dbOwner, dbFolder, dbName, dbVersion, query, duration,
+			dataRows.RowCount, cached)
+		if err != nil {
+			log.Printf("%s: Error when recording query history: %v\n", pageName, err)
+		}
+	}
+
+	// Format the output.  Use json.MarshalIndent() for nicer looking output
+	jsonResponse, err := json.MarshalIndent(dataRows, "", " ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Cache the results, as long as they're not too large
+	if public && !cached && len(jsonResponse) <= com.QueryCacheMaxSize {
+		err = com.CacheData(r.Context(), cacheKey, dataRows, com.CacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching query results: %v\n", pageName, err)
+		}
+	}
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Checks a user can see a database, and returns whether they can change it too.  If they can't see it, or it doesn't
+// exist, an error page is sent and ok is false.
+func readAccess(w http.ResponseWriter, r *http.Request, loggedInUser string, dbOwner string, dbFolder string,
+	dbName string) (canWrite bool, ok bool) {
+	highVer, err := com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return false, false
+	}
+	if highVer == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return false, false
+	}
+	if loggedInUser == "" {
+		return false, true
+	}
+	if loggedInUser == dbOwner {
+		return true, true
+	}
+	access, err := com.DBShareAccess(dbOwner, dbFolder, dbName, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return false, false
+	}
+	return access == com.ShareReadWrite, true
+}
+
+// Returns the list of public databases similar to a given one, in JSON format.
+func relatedHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the user and database name
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/related/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Make sure the database exists, and the user has access to it
+	ver, err := com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if ver == 0 {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+
+	list, err := com.RelatedDBs(dbOwner, dbFolder, dbName, com.RelatedDBsLength)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when retrieving related databases")
+		return
+	}
+	if list == nil {
+		list = []com.DBSummary{}
+	}
+	jsonResponse, err := json.Marshal(list)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Forks a public database from another DBHub instance, given its URL.  The database is downloaded and stored in the
+// background like an upload, and the URL it came from is recorded with it.
+func remoteForkHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Remote fork handler"
+
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Remote forks need to be POST requests")
+		return
+	}
+
+	// Work out the instance, owner, folder, and database name from the given URL.
+	// Eg https://dbhub.io/justinclift/Marine.db
+	remote, err := url.Parse(strings.TrimSpace(r.PostFormValue("url")))
+	if err != nil || remote.Scheme != "https" || remote.Host == "" {
+		errorPage(w, r, http.StatusBadRequest, "The database URL needs to be a https:// link to a database page")
+		return
+	}
+	if strings.EqualFold(remote.Host, com.WebServer()) {
+		errorPage(w, r, http.StatusBadRequest, "That database is on this server, so can be forked from its page")
+		return
+	}
+	pathStrings := strings.Split(strings.Trim(remote.Path, "/"), "/")
+	if len(pathStrings) < 2 {
+		errorPage(w, r, http.StatusBadRequest, "The database URL needs to be a https:// link to a database page")
+		return
+	}
+	srcOwner, srcName := pathStrings[0], pathStrings[len(pathStrings)-1]
+	err = com.ValidateUserDB(srcOwner, srcName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid owner or database name in the URL")
+		return
+	}
+	srcFolder, err := com.NormaliseFolder(strings.Join(pathStrings[1:len(pathStrings)-1], "/"))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid folder name in the URL")
+		return
+	}
+	if com.CheckPublicHost(remote.Hostname()) != nil {
+		errorPage(w, r, http.StatusBadRequest, "The database URL needs to be on a public server")
+		return
+	}
+	baseURL := "https://" + remote.Host
+
+	// Don't overwrite an existing database of the same name.  The fork goes in the same folder as the original
+	highVer, err := com.HighestDBVersion(loggedInUser, srcName, srcFolder, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if highVer > 0 {
+		errorPage(w, r, http.StatusConflict, "You already have a database with that name")
+		return
+	}
+
+	// Retrieve the details of the remote database.  The requested version is used if one was given, otherwise the
+	// latest
+	db, err := com.RemotePublicDB(r.Context(), baseURL, srcOwner, srcFolder, srcName)
+	if err != nil {
+		log.Printf("%s: Error retrieving details of '%s/%s%s%s': %v\n", pageName, baseURL, srcOwner, srcFolder,
+			srcName, err)
+		errorPage(w, r, http.StatusBadGateway, "Couldn't retrieve the database details from the remote server")
+		return
+	}
+	srcVer := db.Versions[len(db.Versions)-1]
+	if v := remote.Query().Get("version"); v != "" {
+		found := false
+		for _, ver := range db.Versions {
+			if strconv.Itoa(ver.Version) == v {
+				srcVer, found = ver, true
+			}
+		}
+		if !found {
+			errorPage(w, r, http.StatusBadRequest, "That version isn't available on the remote server")
+			return
+		}
+	}
+
+	// Create the job, then do the download and storage in the background
+	job := com.UploadJob{
+		DBName:  srcName,
+		Folder:  srcFolder,
+		ID:      com.RandomString(16),
+		Owner:   loggedInUser,
+		Started: time.Now(),
+		Status:  com.UploadQueued,
+	}
+	err = com.SetUploadJobStatus(job)
+	if err != nil {
+		log.Printf("%s: Error when storing upload job status: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	origin := fmt.Sprintf("%s/%s%s%s?version=%d", baseURL, url.PathEscape(srcOwner), srcFolder,
+		url.PathEscape(srcName), srcVer.Version)
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	go func() {
+		tempDBName, dbSize, shaSum, err := com.DownloadRemoteDB(ctx, baseURL, srcOwner, srcFolder, srcName, srcVer)
+		if err != nil {
+			log.Printf("%s: Error downloading '%s': %v\n", pageName, origin, err)
+			job.Error = "Couldn't download the database from the remote server"
+			job.Status = com.UploadFailed
+			com.SetUploadJobStatus(job)
+			return
+		}
+		if processUpload(ctx, job, srcFolder, tempDBName, dbSize, shaSum, true, db.Description, db.Readme,
+			"Imported from "+origin) {
+			com.SetDBRemoteOrigin(loggedInUser, srcFolder, srcName, origin)
+		}
+	}()
+
+	// Return the job ID, so the page can poll for progress
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse, err := json.Marshal(job)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// Returns the number of rows to send back for a table or query request.  Callers can ask for a specific number using
+// the "rows" parameter, up to the instance's API limit.  Otherwise the user's preference (or the instance default) is
+// used.
+func requestedRows(r *http.Request, loggedInUser string) (int, error) {
+	rows := r.FormValue("rows")
+	if rows == "" {
+		if loggedInUser != "" {
+			return com.PrefUserMaxRows(loggedInUser), nil
+		}
+		return com.WebDisplayRows(), nil
+	}
+	numRows, err := strconv.Atoi(rows)
+	if err != nil || numRows < 1 {
+		return 0, fmt.Errorf("Invalid number of rows requested")
+	}
+	if numRows > com.WebMaxAPIRows() {
+		return 0, fmt.Errorf("No more than %d rows can be requested at once", com.WebMaxAPIRows())
+	}
+	return numRows, nil
+}
+
+// Returns the ID logReq gave a request, for matching up error reports from users with the logs.
+func requestID(r *http.Request) string {
+	return com.RequestID(r.Context())
+}
+
+// Adds or removes a status check which needs to pass before merge requests to a database can be accepted.
+func requiredCheckHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Required status checks need to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+	checkContext := strings.TrimSpace(r.PostFormValue("context"))
+	err = com.Validate.Var(checkContext, "required,branchname,max=100")
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid status check context")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change which checks are required
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	switch r.PostFormValue("action") {
+	case "add":
+		err = com.AddRequiredStatusCheck(dbOwner, dbFolder, dbName, checkContext, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when adding the required status check")
+			return
+		}
+	case "remove":
+		err = com.RemoveRequiredStatusCheck(dbOwner, dbFolder, dbName, checkContext)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown required status check action")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Restores a deleted version of a database belonging to the logged in user.
+func restoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Database versions need to be restored using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil || dbVersion < 1 {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can restore versions of a database
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	archived, err := com.DBArchived(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so its versions can't be restored")
+		return
+	}
+	err = com.RestoreDBVersion(dbOwner, dbFolder, dbName, dbVersion)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Version %d of database '%s%s%s' restored by '%s'\n", dbVersion, dbOwner, dbFolder, dbName,
+		loggedInUser)
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Saves the review policy of a database, which merge requests to it need to meet before they can be accepted.
+func reviewPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Review policies need to be changed using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+	var p com.ReviewPolicy
+	p.MinApprovals, err = strconv.Atoi(r.PostFormValue("minapprovals"))
+	if err != nil || p.MinApprovals < 0 || p.MinApprovals > com.ReviewMaxApprovals {
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("The number of approvals needs to be between 0 and %d",
+			com.ReviewMaxApprovals))
+		return
+	}
+	p.OwnerApproval = r.PostFormValue("ownerapproval") == "true"
+
+	// Only the owner (or an admin of the owning organisation) can change the review policy
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	err = com.SetDBReviewPolicy(dbOwner, dbFolder, dbName, p)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when saving the review policy")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Revokes one of the logged in user's personal API tokens.
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "API tokens can only be revoked using POST")
+		return
+	}
+	tokenID, err := strconv.ParseInt(r.PostFormValue("token_id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	err = com.RevokeAPIToken(loggedInUser, tokenID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't revoke the API token")
+		return
+	}
+
+	// Bounce back to the preferences page
+	http.Redirect(w, r, "/pref", http.StatusSeeOther)
+}
+
+// Revokes the access a user has granted to a third party application.
+func revokeAppHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Applications can only be revoked using POST")
+		return
+	}
+
+	err := com.RevokeOAuthGrant(loggedInUser, r.PostFormValue("client_id"))
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't revoke access for the application")
+		return
+	}
+
+	// Bounce back to the preferences page
+	http.Redirect(w, r, "/pref", http.StatusSeeOther)
+}
+
+// Revokes one of the logged in user's client certificates, so it can't be used any more.
+func revokeCertHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Certificates can only be revoked using POST")
+		return
+	}
+	certID, err := strconv.ParseInt(r.PostFormValue("cert_id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid certificate ID")
+		return
+	}
+
+	err = com.RevokeClientCert(loggedInUser, certID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't revoke the certificate")
+		return
+	}
+
+	// Bounce back to the certificates page
+	http.Redirect(w, r, "/certificates", http.StatusSeeOther)
+}
+
+// Revokes a share link for a database, so it can't be used to view the database any more.
+func revokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Share links need to be revoked using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+	linkID, err := strconv.ParseInt(r.PostFormValue("link_id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid share link ID")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can revoke share links
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	err = com.RevokeShareLink(dbOwner, dbFolder, dbName, linkID)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Returns the robots.txt file, pointing search engines at the sitemap for this server.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\n\nSitemap: https://%s/sitemap.xml\n", com.WebServer())
+}
+
+// Promotes an entry from the logged in user's query history to a named saved query.
+func saveQueryHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Save query handler"
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Extract and validate the form data
+	err := r.ParseForm()
+	if err != nil {
+		log.Printf("%s: Error when parsing form data: %s\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Error when parsing form data")
+		return
+	}
+	queryID, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid query id")
+		return
+	}
+
+	// If requested, remove an existing saved query instead
+	if r.PostFormValue("action") == "delete" {
+		err = com.RemoveSavedQuery(loggedInUser, queryID)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Removing the saved query failed")
+			return
+		}
+		http.Redirect(w, r, "/history", http.StatusSeeOther)
+		return
+	}
+
+	// Validate the name for the saved query
+	queryName := r.PostFormValue("name")
+	err = com.Validate.Var(queryName, "required,max=80")
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "A name of 80 characters or less is needed for the query")
+		return
+	}
+
+	// Save the query
+	err = com.SaveQueryFromHistory(loggedInUser, queryID, queryName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Saving the query failed")
+		return
+	}
+
+	// Bounce back to the history page
+	http.Redirect(w, r, "/history", http.StatusSeeOther)
+}
+
+// Returns whether a space separated list of OAuth scopes includes the given one.
+func scopeIncludes(scopeList string, scope string) bool {
+	for _, s := range strings.Fields(scopeList) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a handler serving a static file from the webui directory.  Static files aren't versioned, so they're only
+// cached for a day.
+func serveStatic(pathParts ...string) http.HandlerFunc {
+	filePath := filepath.Join(append([]string{com.WebBaseDir(), "webui"}, pathParts...)...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeFile(w, r, filePath)
+	}
+}
+
+// Shares a database belonging to the logged in user with another user, changes the access they've been given, or
+// stops sharing it with them.
+func shareDBHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Databases need to be shared using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+	userName := strings.ToLower(strings.TrimSpace(r.PostFormValue("username")))
+	err = com.ValidateUser(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid user name")
+		return
+	}
+	access := r.PostFormValue("access")
+	switch access {
+	case "", com.ShareRead, com.ShareReadWrite:
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown access level")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can share a database
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	if userName == dbOwner {
+		errorPage(w, r, http.StatusBadRequest, "The owner already has access to their own databases")
+		return
+	}
+	if access == "" {
+		err = com.RemoveDBShare(dbOwner, dbFolder, dbName, userName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when removing the user's access")
+			return
+		}
+	} else {
+		userExists, err := com.CheckUserExists(userName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		if !userExists {
+			errorPage(w, r, http.StatusNotFound, "Unknown user")
+			return
+		}
+		err = com.SetDBShare(dbOwner, dbFolder, dbName, userName, access)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when sharing the database")
+			return
+		}
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
+
+// Creates a share link for a private database, returning it as JSON.  This is the only time the link itself is
+// available, as only the hash of its token is stored.
+func shareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Share link handler"
+
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Share links need to be created using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" || len(name) > 100 {
+		errorPage(w, r, http.StatusBadRequest, "Share links need a name of up to 100 characters")
+		return
+	}
+	days, err := strconv.Atoi(r.PostFormValue("expiry"))
+	if err != nil || days < 1 || days > com.ShareLinkMaxDays {
+		errorPage(w, r, http.StatusBadRequest, "Invalid expiry time")
+		return
+	}
+	expiry := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+
+	// Only the owner (or an admin of the owning organisation) can create share links
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	id, token, err := com.CreateShareLink(dbOwner, dbFolder, dbName, name, loggedInUser, expiry)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, pageName, map[string]interface{}{
+		"expiry": expiry,
+		"id":     id,
+		"name":   name,
+		"url": fmt.Sprintf("https://%s/%s%s%s?share=%s", com.WebServer(), dbOwner, dbFolder, url.PathEscape(dbName),
+			token),
+	})
+}
+
+// Returns the user to check access to a database as.  Visitors with a valid share link for the database get the same
+// read access to it as its owner, whether or not they're logged in.  The link's token is given in the "share"
+// parameter, then swapped for a cookie so the table data and download requests made from the database page work too.
+// So the token doesn't linger in the browser history or get passed on in Referer headers, the first request is
+// redirected to the same URL without it.  If the request gives a share link which isn't valid, or was redirected, ok
+// is false and the caller has nothing more to send.
+func shareLinkUser(w http.ResponseWriter, r *http.Request, loggedInUser string, dbOwner string, dbFolder string,
+	dbName string) (accessUser string, ok bool) {
+	token := r.FormValue("share")
+	fromCookie := false
+	if token == "" {
+		c, err := r.Cookie(shareLinkCookie)
+		if err != nil {
+			return loggedInUser, true
+		}
+		token, fromCookie = c.Value, true
+	}
+	expiry, valid, err := com.UseShareLink(dbOwner, dbFolder, dbName, token)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !valid {
+		// The cookie may be for a share link to a different database, so that's not an error
+		if fromCookie {
+			return loggedInUser, true
+		}
+		errorPage(w, r, http.StatusForbidden, "That share link has expired or been revoked")
+		return
+	}
+	if !fromCookie {
+		http.SetCookie(w, &http.Cookie{
+			Expires:  expiry,
+			HttpOnly: true,
+			Name:     shareLinkCookie,
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+			Secure:   true,
+			Value:    token,
+		})
+		if r.Method == "GET" {
+			u := *r.URL
+			q := u.Query()
+			q.Del("share")
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+			return
+		}
+	}
+	return dbOwner, true
+}
+
+// Returns an XML sitemap of the public databases, for search engines.  Databases whose owners have discouraged
+// search engines from indexing them aren't included.
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	type sitemapURL struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	}
+	type sitemapURLSet struct {
+		XMLName xml.Name     `xml:"urlset"`
+		XMLNS   string       `xml:"xmlns,attr"`
+		URLs    []sitemapURL `xml:"url"`
+	}
+
+	dbList, err := com.SitemapDBs()
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when retrieving the list of databases")
+		return
+	}
+	urlSet := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, db := range dbList {
+		urlSet.URLs = append(urlSet.URLs, sitemapURL{
+			Loc: fmt.Sprintf("https://%s/%s/%s", com.WebServer(), url.PathEscape(db.Owner),
+				url.PathEscape(db.DBName)),
+			LastMod: db.DateEntry.UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	err = enc.Encode(urlSet)
+	if err != nil {
+		log.Printf("Error when encoding sitemap: %v\n", err)
+	}
+}
+
+// Sends a database version to the user as a file download.  Callers need to check for takedowns (and signed links)
+// first, as only the user's access to the database is checked here.
+func sendDatabase(w http.ResponseWriter, r *http.Request, pageName string, loggedInUser string, dbOwner string,
+	dbFolder string, dbName string, dbVersion int) {
+	// Verify the given database exists and is ok to be downloaded (and get the Minio bucket + id while at it)
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Database versions never change, so they can be cached indefinitely.  Only public databases can be cached by
+	// shared caches (eg a CDN) though, and logged in users may be downloading a private database shared with them
+	if loggedInUser != "" {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	// Get a handle from Minio for the database object
+	userDB, err := com.MinioHandle(r.Context(), bucket, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Close the object handle when this function finishes
+	defer func() {
+		com.MinioHandleClose(userDB)
+	}()
+
+	// Send the database to the user
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(dbName)))
+	w.Header().Set("Content-Type", "application/x-sqlite3")
+	bytesWritten, err := io.Copy(w, userDB)
+	if err != nil {
+		log.Printf("%s: Error returning DB file: %v\n", pageName, err)
+		fmt.Fprintf(w, "%s: Error returning DB file: %v\n", pageName, err)
+		return
+	}
+
+	// Log the number of bytes written
+	log.Printf("%s: '%s/%s' downloaded. %d bytes", pageName, dbOwner, dbName, bytesWritten)
+
+	// Count the download for the usage statistics.  The database has already been sent, so a failure here is only
+	// logged
+	com.RecordDownload(dbOwner, dbFolder, dbName)
+}
+
+// Stores the current state of a live database as a new version, when its owner asks for one rather than waiting for
+// the next scheduled snapshot.
+func snapshotLiveHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Snapshots need to be requested using POST")
+		return
+	}
+
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	commitMsg := strings.TrimSpace(r.PostFormValue("message"))
+	err = com.ValidateCommitMessage(commitMsg)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid commit message")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can take snapshots
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	archived, err := com.DBArchived(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so snapshots can't be added to it")
+		return
+	}
+	db, live, err := com.DBLive(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !live {
+		errorPage(w, r, http.StatusBadRequest, "That isn't a live database")
+		return
+	}
+	protected, err := com.BranchProtected(dbOwner, dbFolder, dbName, com.DefaultBranch)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if protected {
+		errorPage(w, r, http.StatusConflict,
+			"The main branch of that database is protected, so snapshots can't be added to it")
+		return
+	}
+	ver, violations, err := com.SnapshotLiveDB(r.Context(), db, loggedInUser, commitMsg)
+	if len(violations) > 0 {
+		errorPage(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when taking a snapshot of the live database")
+		return
+	}
+
+	// Show the new version, or go back to the settings page if nothing had changed since the last one
+	if ver == 0 {
+		http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?folder=%s", dbOwner, dbName, url.QueryEscape(dbFolder)),
+			http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/%s/%s?folder=%s&version=%d", dbOwner, dbName, url.QueryEscape(dbFolder), ver),
+		http.StatusSeeOther)
+}
+
+// Handles JSON requests from the front end to toggle a database's star.
+func starToggleHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the user and database name
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/star/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in to star databases")
+		return
+	}
+
+	// Toggle on or off the starring of a database by a user
+	err = com.ToggleDBStar(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't update the database star")
+		return
+	}
+
+	// Add new stars to the activity feeds, and let the database's webhooks know about the change
+	starred, err := com.CheckDBStarred(loggedInUser, dbOwner, dbFolder, dbName)
+	if err == nil && starred {
+		err = com.RecordActivity(loggedInUser, com.FeedStar, dbOwner, dbFolder, dbName, 0, "")
+	}
+	if err == nil {
+		action := "unstarred"
+		if starred {
+			action = "starred"
+		}
+		err = com.DBEvent(dbOwner, dbFolder, dbName, com.WebhookStar, loggedInUser,
+			map[string]interface{}{"action": action})
+	}
+	if err != nil {
+		log.Printf("Error recording star of '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+	}
+
+	// Return the updated star count
+	newStarCount, err := com.DBStars(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve the database star count")
+		return
+	}
+	fmt.Fprint(w, newStarCount)
+}
+
+// Handler for the Database Settings page
+func saveSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// TODO: License
+
+	// Ensure user is logged in
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if validSession != true {
+		// Display an error message
+		// TODO: Show the login dialog (also for the preferences page)
+		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
+		return
+	}
+
+	// Extract the username, folder, and (current) database name form variables
+	u, dbFolder, dbName, err := com.GetFormUFD(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	userName := strings.ToLower(u)
+
+	// Default to the root folder if none was given
+	if dbFolder == "" {
+		dbFolder = "/"
+	}
+
+	// Make sure a username was given
+	if len(userName) == 0 || userName == "" {
+		// No username supplied
+		errorPage(w, r, http.StatusBadRequest, "No username supplied!")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change the settings of a database, even if it's
+	// been shared with others
+	allowed, err := com.CanManageDBs(userName, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !allowed {
+		errorPage(w, r, http.StatusForbidden, "You can only change the settings of your own databases")
+		return
+	}
+
+	// Archived databases are read-only, so their settings can't be changed
+	archived, err := com.DBArchived(userName, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so its settings can't be changed")
+		return
+	}
+
+	// Extract the version number
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "No database version supplied!")
+		return
+	}
+
+	// Extract the form variables
+	descrip := r.PostFormValue("descrip")
+	newName := r.PostFormValue("newname")
+	readme := r.PostFormValue("readme")
+	defTable := r.PostFormValue("defaulttable")
+	noIndex := r.PostFormValue("noindex") == "true"
+	landingTab := r.PostFormValue("landingtab")
+	if landingTab == "" {
+		landingTab = com.LandingData
+	}
+
+	// Grab and validate the supplied "public" form field
+	public, err := com.GetPub(r)
+	if err != nil {
+		log.Printf("Error when converting public value to boolean: %v\n", err)
+		errorPage(w, r, http.StatusBadRequest, "Public value incorrect")
+		return
+	}
+
+	// If set, validate the new database name
+	if newName != dbName {
+		err := com.ValidateDB(newName)
+		if err != nil {
+			log.Printf("Validation failed for new database name '%s': %s", newName, err)
+			errorPage(w, r, http.StatusBadRequest, "New database name failed validation")
+			return
+		}
+	}
+
+	// Ensure the description is 80 chars or less
+	if len(descrip) > 80 {
+		errorPage(w, r, http.StatusBadRequest, "Description line needs to be 80 characters or less")
+		return
+	}
+
+	// Validate the tab visitors land on
+	err = com.ValidateLandingTab(landingTab)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Validate the name of the default table
+	err = com.ValidatePGTable(defTable)
+	if err != nil {
+		// Validation failed
+		log.Printf("Validation failed for name of default table '%s': %s", defTable, err)
+		errorPage(w, r, http.StatusBadRequest, "Validation failed for name of default table")
+		return
+	}
+
+	// Get the Minio bucket and ID for the given database
+	bkt, id, err := com.MinioBucketID(userName, dbFolder, dbName, dbVersion, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError,
+			"Could not retrieve internal information for the requested database")
+		return
+	}
+
+	// Get a handle from Minio for the database object
+	sdb, err := com.OpenMinioObject(r.Context(), bkt, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Retrieve the list of tables in the database
+	tables, err := com.Tables(sdb, fmt.Sprintf("%s%s%s", userName, dbFolder, dbName))
+	defer com.ReleaseSQLiteHandle(sdb)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// If a specific table was requested, check that it's present
+	if defTable != "" {
+		// Check the requested table is present
+		tablePresent := false
+		for _, tbl := range tables {
+			if tbl == defTable {
+				tablePresent = true
+			}
+		}
+		if tablePresent == false {
+			// The requested table doesn't exist in the database
+			log.Printf("Requested table '%s' not present in database '%s%s%s' version %d\n",
+				defTable, userName, dbFolder, dbName, dbVersion)
+			errorPage(w, r, http.StatusBadRequest, "Requested table not present")
+			return
+		}
+	}
+
+	// If the database doesn't have a 1-liner description, don't save the placeholder text as one
+	if descrip == "No description" {
+		descrip = ""
+	}
+
+	// Same thing, but for the full length description
+	if readme == "No full description" {
+		readme = ""
+	}
+
+	// Save settings
+	err = com.SaveDBSettings(userName, dbFolder, dbName, descrip, readme, defTable, landingTab, public,
+		noIndex)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// If the new database name is different from the old one, perform the rename
+	// Note - RenameDatabase() invalidates the cached data under both the old and new names
+	// TODO: We'll probably need to add support for renaming folders somehow too
+	if newName != "" && newName != dbName {
+		err = com.RenameDatabase(userName, dbFolder, dbName, newName)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Add the rename to the activity feeds, and let the database's webhooks know about it
+		err = com.RecordActivity(loggedInUser, com.FeedRename, userName, dbFolder, newName, 0, dbName)
+		if err != nil {
+			log.Printf("Error recording activity for '%s%s%s': %v\n", userName, dbFolder, newName, err)
+		}
+		err = com.DBEvent(userName, dbFolder, newName, com.WebhookRename, loggedInUser,
+			map[string]interface{}{"old_name": dbName})
+		if err != nil {
+			log.Printf("Error queueing webhooks for '%s%s%s': %v\n", userName, dbFolder, newName, err)
+		}
+	}
+
+	// Settings saved, so bounce back to the database page
+	http.Redirect(w, r, fmt.Sprintf("/%s%s%s", userName, dbFolder, newName), http.StatusTemporaryRedirect)
+}
+
+// Present the stars page to the user
+func starsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve user and database name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/stars/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Render the stars page
+	starsPage(w, r, dbOwner, dbFolder, dbName)
+}
+
+// Handler for the public usage statistics page.  Scripts can ask for the numbers as JSON.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Stats handler"
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	stats, err := com.InstanceUsageStats()
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		jsonResponse, err := json.Marshal(stats)
+		if err != nil {
+			log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+			errorPage(w, r, http.StatusInternalServerError, "Internal error")
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", jsonResponse)
+		return
+	}
+	statsPage(w, r, loggedInUser, stats)
+}
+
+// This passes table row data back to the main UI in JSON format.
+func tableViewHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Table data handler"
+
+	// Retrieve user, database, and table name
+	dbOwner, dbName, requestedTable, dbVersion, err := com.GetODTV(2, r) // 1 = Ignore "/x/table/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	// Extract sort column, sort direction, and offset variables if present
 	sortCol := r.FormValue("sort")
 	sortDir := r.FormValue("dir")
+	sortType := r.FormValue("sorttype")
 	offsetStr := r.FormValue("offset")
 	var rowOffset int
 	if offsetStr == "" {
@@ -851,165 +6934,425 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		if rowOffset < 0 {
 			rowOffset = 0
 		}
-	}
+	}
+
+	// Very wide tables can be paged through a range of columns at a time.  A column count of 0 means all of them
+	var colOffset, maxCols int
+	if colStr := r.FormValue("colstart"); colStr != "" {
+		colOffset, err = strconv.Atoi(colStr)
+		if err != nil || colOffset < 0 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid column offset")
+			return
+		}
+	}
+	if colStr := r.FormValue("cols"); colStr != "" {
+		maxCols, err = strconv.Atoi(colStr)
+		if err != nil || maxCols < 0 {
+			errorPage(w, r, http.StatusBadRequest, "Invalid column count")
+			return
+		}
+	}
+
+	// Sanity check the sort column name
+	if sortCol != "" {
+		// Validate the sort column text, as we use it in string smashing SQL queries so need to be even more
+		// careful than usual
+		err = com.ValidateFieldName(sortCol)
+		if err != nil {
+			log.Printf("Validation failed on requested sort field name '%v': %v\n", sortCol,
+				err.Error())
+			errorPage(w, r, http.StatusBadRequest, "Validation failed on requested sort field name")
+			return
+		}
+	}
+
+	// If a sort direction was provided, validate it
+	if sortDir != "" {
+		if sortDir != "ASC" && sortDir != "DESC" {
+			errorPage(w, r, http.StatusBadRequest, "Invalid sort direction")
+			return
+		}
+	}
+
+	// If a sort type was provided, validate it
+	if sortType != com.SortDefault && sortType != com.SortDate && sortType != com.SortNumeric {
+		errorPage(w, r, http.StatusBadRequest, "Invalid sort type")
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Anonymous clients browsing lots of table data are slowed down, and pointed at the bulk download of the owner's
+	// databases instead
+	if loggedInUser == "" {
+		if delay := com.AnonBrowseDelay(clientIP(r)); delay > 0 {
+			w.Header().Set("Link", fmt.Sprintf(`</x/downloadall/%s>; rel="alternate"; type="application/zip"`,
+				url.PathEscape(dbOwner)))
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	// Databases which have been taken down can't be viewed
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return
+	}
+
+	// Check if the user has access to the requested database, either themselves or through a share link
+	accessUser, allowed := shareLinkUser(w, r, loggedInUser, dbOwner, dbFolder, dbName)
+	if !allowed {
+		return
+	}
+	bucket, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, accessUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Sanity check
+	if id == "" {
+		// The requested database wasn't found
+		log.Printf("%s: Requested database not found. Owner: '%s' Database: '%s'", pageName, dbOwner,
+			dbName)
+		return
+	}
+
+	// Determine the number of rows to display
+	maxRows, err := requestedRows(r, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// API consumers can ask for the values to keep their SQLite types, rather than being formatted for display
+	typed := r.FormValue("typed") == "1"
+	cachePrefix := "tablejson"
+	if typed {
+		cachePrefix = "tablejsontyped"
+	}
+
+	// If the data is available from memcached, use that instead of reading from the SQLite database itself
+	dataCacheKey := com.TableRowsCacheKey(fmt.Sprintf("%s/%s/%s/%s/%d/%d/%d", cachePrefix, sortCol, sortType, sortDir,
+		rowOffset, colOffset, maxCols),
+		accessUser, dbOwner, dbFolder, dbName, dbVersion, requestedTable, maxRows)
+
+	// If a cached version of the page data exists, use it
+	var dataRows com.SQLiteRecordSet
+	ok, err := com.GetCachedData(r.Context(), dataCacheKey, &dataRows)
+	if err != nil {
+		log.Printf("%s: Error retrieving table data from cache: %v\n", pageName, err)
+	}
+	if !ok {
+		// * Data wasn't in cache, so we gather it from the SQLite database *
+
+		// Open the Minio database
+		sdb, err := com.OpenMinioObject(r.Context(), bucket, id)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer com.ReleaseSQLiteHandle(sdb)
+
+		// Retrieve the list of tables in the database
+		tables, err := sdb.Tables("")
+		if err != nil {
+			log.Printf("Error retrieving table names: %s", err)
+			return
+		}
+		if len(tables) == 0 {
+			// No table names were returned, so abort
+			log.Printf("The database '%s' doesn't seem to have any tables. Aborting.", dbName)
+			return
+		}
+
+		// If a specific table was requested, check it exists
+		if requestedTable != "" {
+			tablePresent := false
+			for _, tableName := range tables {
+				if requestedTable == tableName {
+					tablePresent = true
+				}
+			}
+			if tablePresent == false {
+				// The requested table doesn't exist
+				errorPage(w, r, http.StatusBadRequest, "Requested table does not exist")
+				return
+			}
+		}
+
+		// If no specific table was requested, use the first one
+		if requestedTable == "" {
+			requestedTable = tables[0]
+		}
+
+		// Retrieve the column names for the table
+		colList, err := sdb.Columns("", requestedTable)
+		if err != nil {
+			log.Printf("Error when reading column names for table '%s': %v\n", requestedTable,
+				err.Error())
+			errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
+			return
+		}
+
+		// If a sort column was requested, verify it exists
+		if sortCol != "" {
+			colExists := false
+			for _, j := range colList {
+				if j.Name == sortCol {
+					colExists = true
+				}
+			}
+			if colExists == false {
+				// The requested sort column doesn't exist, so we fall back to no sorting
+				sortCol = ""
+			}
+		}
+
+		// Work out which columns to return
+		var cols []string
+		if colOffset > 0 || maxCols > 0 {
+			if colOffset >= len(colList) {
+				errorPage(w, r, http.StatusBadRequest, "Column offset is past the last column")
+				return
+			}
+			// Compared this way around so huge column counts can't overflow
+			end := len(colList)
+			if maxCols > 0 && maxCols < end-colOffset {
+				end = colOffset + maxCols
+			}
+			for _, c := range colList[colOffset:end] {
+				cols = append(cols, c.Name)
+			}
+		}
+
+		// Read the data from the database
+		dataRows, err = com.ReadSQLiteDBCols(sdb, requestedTable, cols, false, false, typed, maxRows, sortCol,
+			sortType, sortDir, rowOffset)
+		if err != nil {
+			// Some kind of error when reading the database data
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		dataRows.ColOffset = colOffset
+		dataRows.TotalCols = len(colList)
+
+		// Include the affinity and format of the returned columns, so the front end can display the values sensibly
+		sha, err := com.MinioObjectSHA(bucket, id)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+		formats, err := com.ColumnFormats(r.Context(), sdb, sha, requestedTable)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
+			return
+		}
+		for _, name := range dataRows.ColNames {
+			for _, f := range formats {
+				if f.Name == name {
+					dataRows.ColFormats = append(dataRows.ColFormats, f)
+					break
+				}
+			}
+		}
 
-	// Sanity check the sort column name
-	if sortCol != "" {
-		// Validate the sort column text, as we use it in string smashing SQL queries so need to be even more
-		// careful than usual
-		err = com.ValidateFieldName(sortCol)
+		// Count the total number of rows in the requested table
+		dataRows.TotalRows, err = com.GetSQLiteRowCount(sdb, requestedTable)
 		if err != nil {
-			log.Printf("Validation failed on requested sort field name '%v': %v\n", sortCol,
-				err.Error())
-			errorPage(w, r, http.StatusBadRequest, "Validation failed on requested sort field name")
+			errorPage(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
-	}
 
-	// If a sort direction was provided, validate it
-	if sortDir != "" {
-		if sortDir != "ASC" && sortDir != "DESC" {
-			errorPage(w, r, http.StatusBadRequest, "Invalid sort direction")
-			return
+		// Cache the data in memcache
+		err = com.CacheData(r.Context(), dataCacheKey, dataRows, com.CacheTime)
+		if err != nil {
+			log.Printf("%s: Error when caching table data: %v\n", pageName, err)
 		}
 	}
 
-	// TODO: Add support for folders and sub-folders in request paths
-	databasePage(w, r, userName, dbName, dbVersion, dbTable, sortCol, sortDir, rowOffset)
-}
-
-// Returns HTML rendered content from a given markdown string, for the settings page README preview tab.
-func markdownPreview(w http.ResponseWriter, r *http.Request) {
-	// Extract the markdown text form value
-	mkDown := r.PostFormValue("mkdown")
+	// Format the output.  Use json.MarshalIndent() for nicer looking output
+	jsonResponse, err := json.MarshalIndent(dataRows, "", " ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	// Send the rendered version back to the caller
-	renderedText := commonmark.Md2Html(mkDown, commonmark.CMARK_OPT_DEFAULT)
-	fmt.Fprint(w, renderedText)
+	//w.Header().Set("Access-Control-Allow-Origin", "*")
+	fmt.Fprintf(w, "%s", jsonResponse)
 }
 
-// This handles incoming requests for the preferences page by logged in users.
-func prefHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Preferences handler"
+// Displays the takedown request form, and records submitted requests for admin review.
+func takedownHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Takedown request handler"
 
-	// Ensure user is logged in
-	var loggedInUser string
-	validSession := false
-	sess := session.Get(r)
-	if sess != nil {
-		u := sess.CAttr("UserName")
-		if u != nil {
-			loggedInUser = u.(string)
-			validSession = true
-		} else {
-			session.Remove(sess, w)
-		}
+	// Extract the folder the database is in
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database folder")
+		return
 	}
-	if validSession != true {
-		// Display an error message
-		// TODO: Show the login dialog (also for the settings page)
-		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
+
+	// If no request was submitted, display the form
+	if r.Method != "POST" {
+		takedownPage(w, r, r.FormValue("owner"), dbFolder, r.FormValue("database"), r.FormValue("submitted") == "1")
 		return
 	}
 
-	// Gather submitted form data (if any)
-	err := r.ParseForm()
+	// Validate the submitted form data
+	t := com.Takedown{
+		ComplainantEmail: strings.TrimSpace(r.PostFormValue("email")),
+		ComplainantName:  strings.TrimSpace(r.PostFormValue("name")),
+		DBFolder:         dbFolder,
+		DBName:           r.PostFormValue("database"),
+		DBOwner:          strings.ToLower(r.PostFormValue("owner")),
+		Description:      strings.TrimSpace(r.PostFormValue("description")),
+	}
+	err = com.ValidateUser(t.DBOwner)
 	if err != nil {
-		log.Printf("%s: Error when parsing preference data: %s\n", pageName, err)
-		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		errorPage(w, r, http.StatusBadRequest, "Invalid database owner")
 		return
 	}
-	maxRows := r.PostFormValue("maxrows")
-
-	// If no form data was submitted, display the preferences page form
-	if maxRows == "" {
-		prefPage(w, r, fmt.Sprintf("%s", loggedInUser))
+	err = com.ValidateDB(t.DBName)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
 		return
 	}
-
-	// Validate submitted form data
-	err = com.Validate.Var(maxRows, "required,numeric,min=1,max=500")
+	err = com.ValidateEmail(t.ComplainantEmail)
 	if err != nil {
-		log.Printf("%s: Preference data failed validation: %s\n", pageName, err)
-		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		errorPage(w, r, http.StatusBadRequest, "Invalid email address")
+		return
+	}
+	if t.ComplainantName == "" || t.Description == "" {
+		errorPage(w, r, http.StatusBadRequest, "Please give your name, and a description of the complaint")
 		return
 	}
 
-	maxRowsNum, err := strconv.Atoi(maxRows)
+	// Make sure the database exists and is public.  Private databases can't be infringing anything publicly
+	ver, err := com.HighestDBVersion(t.DBOwner, t.DBName, t.DBFolder, "")
 	if err != nil {
-		log.Printf("%s: Error converting string '%v' to integer: %s\n", pageName, maxRows, err)
-		errorPage(w, r, http.StatusBadRequest, "Error when parsing preference data")
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if ver == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
 		return
 	}
 
-	// Update the preference data in the database
-	err = com.SetPrefUserMaxRows(loggedInUser, maxRowsNum)
+	// Record the request
+	id, err := com.AddTakedownRequest(t)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, "Error when updating preferences")
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't record the takedown request")
 		return
 	}
+	log.Printf("%s: Takedown request %d received for '%s%s%s'\n", pageName, id, t.DBOwner, t.DBFolder, t.DBName)
 
-	// Bounce to the user home page
-	http.Redirect(w, r, "/"+loggedInUser, http.StatusTemporaryRedirect)
+	http.Redirect(w, r, "/takedown?submitted=1", http.StatusSeeOther)
 }
 
-// Handles JSON requests from the front end to toggle a database's star.
-func starToggleHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the user and database name
-	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/star/" at the start of the URL
+// Checks whether a database has been taken down, sending an error page if so.
+func takenDown(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) bool {
+	t, err := com.ActiveTakedown(dbOwner, dbFolder, dbName)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
-		return
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return true
 	}
+	if t.ID != 0 {
+		errorPage(w, r, http.StatusUnavailableForLegalReasons, "This database has been taken down in "+
+			"response to a legal complaint")
+		return true
+	}
+	return false
+}
+
+// Returns true for paths which can be used without accepting the terms of service, such as the terms page itself.
+func termsExempt(urlPath string) bool {
+	switch urlPath {
+	case "/terms", "/x/acceptterms", "/login", "/logout", "/x/callback", "/favicon.ico", "/robots.txt",
+		"/sitemap.xml":
+		return true
+	}
+	return strings.HasPrefix(urlPath, "/images/") || strings.HasPrefix(urlPath, "/x/callback/") ||
+		strings.HasPrefix(urlPath, "/x/login/")
+}
 
+// Displays the current terms of service and privacy policy.  Logged in users who haven't accepted them yet are asked
+// to.
+func termsHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve session data (if any)
 	var loggedInUser string
-	validSession := false
 	sess := session.Get(r)
 	if sess != nil {
 		u := sess.CAttr("UserName")
 		if u != nil {
 			loggedInUser = u.(string)
-			validSession = true
 		} else {
 			session.Remove(sess, w)
 		}
 	}
 
-	// Ensure we have a valid logged in user
-	if validSession != true {
-		// No logged in username, so nothing to update
-		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed star count
-		return
+	// Determine whether the user still needs to accept the terms
+	needsAccept := false
+	if loggedInUser != "" {
+		accepted, err := com.TermsAccepted(loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+		needsAccept = !accepted
 	}
 
-	// Toggle on or off the starring of a database by a user
-	err = com.ToggleDBStar(loggedInUser, dbOwner, "/", dbName)
-	if err != nil {
-		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed star count
+	termsPage(w, r, loggedInUser, needsAccept, r.FormValue("next"))
+}
+
+// Removes one of the logins linked to the users' account.
+func unlinkLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
 		return
 	}
-
-	// Invalidate the old memcached entry for the database
-	err = com.InvalidateCacheEntry(loggedInUser, dbOwner, "/", dbName, 0) // 0 indicates "for all versions"
-	if err != nil {
-		// Something went wrong when invalidating memcached entries for the database
-		log.Printf("Error when invalidating memcache entries: %s\n", err.Error())
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Logins can only be unlinked using POST")
 		return
 	}
 
-	// Return the updated star count
-	newStarCount, err := com.DBStars(dbOwner, dbName)
+	err := com.UnlinkIdentity(loggedInUser, r.PostFormValue("provider"), r.PostFormValue("provider_id"))
 	if err != nil {
-		fmt.Fprint(w, "-1") // -1 tells the front end not to update the displayed star count
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	fmt.Fprint(w, newStarCount)
+
+	// Bounce back to the preferences page
+	http.Redirect(w, r, "/pref", http.StatusSeeOther)
 }
 
-// Handler for the Database Settings page
-func saveSettingsHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: License
+// Receives a file to attach to the README of one of the logged in user's databases, returning the markdown for
+// linking to it as JSON.
+func uploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Upload attachment handler"
 
 	// Ensure user is logged in
 	var loggedInUser string
@@ -1025,361 +7368,623 @@ func saveSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if validSession != true {
-		// Display an error message
-		// TODO: Show the login dialog (also for the preferences page)
 		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
 		return
 	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Attachments need to be uploaded using POST")
+		return
+	}
 
-	// Extract the username, folder, and (current) database name form variables
+	// Leave some room for the other form fields on top of the attachment itself
+	r.Body = http.MaxBytesReader(w, r.Body, com.AttachmentMaxSize+64*1024)
+	err := r.ParseMultipartForm(1024 * 1024)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("Attachments can be at most %d MB",
+			com.AttachmentMaxSize/1024/1024))
+		return
+	}
 	u, dbFolder, dbName, err := com.GetFormUFD(r)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	userName := strings.ToLower(u)
-
-	// Default to the root folder if none was given
 	if dbFolder == "" {
 		dbFolder = "/"
 	}
 
-	// Make sure a username was given
-	if len(userName) == 0 || userName == "" {
-		// No username supplied
-		errorPage(w, r, http.StatusBadRequest, "No username supplied!")
+	// Only the owner of a database (or an admin of the owning organisation) can add attachments to it
+	dbOwner := strings.ToLower(u)
+	allowed, err := com.CanManageDBs(dbOwner, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-
-	// Extract the version number
-	dbVersion, err := com.GetFormVersion(r)
-	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, "No database version supplied!")
+	if !allowed {
+		errorPage(w, r, http.StatusForbidden, "You can only add attachments to your own databases")
 		return
 	}
-
-	// Extract the form variables
-	descrip := r.PostFormValue("descrip")
-	newName := r.PostFormValue("newname")
-	readme := r.PostFormValue("readme")
-	defTable := r.PostFormValue("defaulttable")
-
-	// Grab and validate the supplied "public" form field
-	public, err := com.GetPub(r)
+	archived, err := com.DBArchived(dbOwner, dbFolder, dbName)
 	if err != nil {
-		log.Printf("Error when converting public value to boolean: %v\n", err)
-		errorPage(w, r, http.StatusBadRequest, "Public value incorrect")
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-
-	// If set, validate the new database name
-	if newName != dbName {
-		err := com.ValidateDB(newName)
-		if err != nil {
-			log.Printf("Validation failed for new database name '%s': %s", newName, err)
-			errorPage(w, r, http.StatusBadRequest, "New database name failed validation")
-			return
-		}
-	}
-
-	// Ensure the description is 80 chars or less
-	if len(descrip) > 80 {
-		errorPage(w, r, http.StatusBadRequest, "Description line needs to be 80 characters or less")
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so attachments can't be added")
 		return
 	}
-
-	// Validate the name of the default table
-	err = com.ValidatePGTable(defTable)
+	file, header, err := r.FormFile("attachment")
 	if err != nil {
-		// Validation failed
-		log.Printf("Validation failed for name of default table '%s': %s", defTable, err)
-		errorPage(w, r, http.StatusBadRequest, "Validation failed for name of default table")
+		errorPage(w, r, http.StatusBadRequest, "No attachment was supplied")
 		return
 	}
+	defer file.Close()
 
-	// Get the Minio bucket and ID for the given database
-	bkt, id, err := com.MinioBucketID(userName, dbName, dbVersion, loggedInUser)
+	a, err := com.StoreAttachment(r.Context(), dbOwner, dbFolder, dbName, loggedInUser, header.Filename, file)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError,
-			"Could not retrieve internal information for the requested database")
+		log.Printf("%s: Adding attachment to '%s%s%s' failed: %v\n", pageName, dbOwner, dbFolder, dbName, err)
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Get a handle from Minio for the database object
-	sdb, err := com.OpenMinioObject(bkt, id)
+	jsonResponse, err := json.Marshal(map[string]string{
+		"id":       a.ID,
+		"markdown": com.AttachmentMarkdown(a),
+		"url":      "/x/attachment/" + a.ID,
+	})
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
 
-	// Retrieve the list of tables in the database
-	tables, err := com.Tables(sdb, fmt.Sprintf("%s%s%s", userName, dbFolder, dbName))
-	defer sdb.Close()
-	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+// Uploads a new avatar image for the logged in user, or removes their existing one so their Gravatar is used again.
+func uploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Avatars need to be uploaded using POST")
 		return
 	}
 
-	// If a specific table was requested, check that it's present
-	if defTable != "" {
-		// Check the requested table is present
-		tablePresent := false
-		for _, tbl := range tables {
-			if tbl == defTable {
-				tablePresent = true
-			}
+	r.Body = http.MaxBytesReader(w, r.Body, com.AvatarMaxSize+1024*1024)
+	if r.FormValue("action") == "remove" {
+		err := com.SetUserAvatar(loggedInUser, "")
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when removing the avatar")
+			return
 		}
-		if tablePresent == false {
-			// The requested table doesn't exist in the database
-			log.Printf("Requested table '%s' not present in database '%s%s%s' version %d\n",
-				defTable, userName, dbFolder, dbName, dbVersion)
-			errorPage(w, r, http.StatusBadRequest, "Requested table not present")
+	} else {
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "No avatar image was uploaded")
+			return
+		}
+		defer file.Close()
+		err = com.StoreAvatar(r.Context(), loggedInUser, file)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
 			return
 		}
 	}
+	http.Redirect(w, r, "/pref", http.StatusSeeOther)
+}
+
+// Checks whether a database file could be uploaded, given its name and size, so the client can find out about
+// problems before sending the data.  The result is returned as JSON.
+func uploadCheckHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Upload check handler"
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
 
-	// If the database doesn't have a 1-liner description, don't save the placeholder text as one
-	if descrip == "No description" {
-		descrip = ""
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
 	}
 
-	// Same thing, but for the full length description
-	if readme == "No full description" {
-		readme = ""
+	// Retrieve the file name and size
+	dbName := r.FormValue("name")
+	dbSize, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || dbSize < 0 {
+		errorPage(w, r, http.StatusBadRequest, "The size needs to be a number of bytes")
+		return
 	}
 
-	// Save settings
-	err = com.SaveDBSettings(userName, dbFolder, dbName, descrip, readme, defTable, public)
+	// Retrieve the destination folder
+	folder, err := com.GetFolder(r)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// If the new database name is different from the old one, perform the rename
-	// Note - It's useful to do this *after* the SaveDBSettings() call, so the cache invalidation code at the
-	// end of that function gets run and we don't have to repeat it here
-	// TODO: We'll probably need to add support for renaming folders somehow too
-	if newName != "" && newName != dbName {
-		err = com.RenameDatabase(userName, dbFolder, dbName, newName)
+	// Uploads of new versions to databases shared with the user, and uploads to organisations, are checked against
+	// the owner's databases
+	dbOwner := loggedInUser
+	var orgRole string
+	if owner := r.FormValue("owner"); owner != "" {
+		dbOwner = strings.ToLower(owner)
+		err = com.ValidateUser(dbOwner)
 		if err != nil {
-			errorPage(w, r, http.StatusBadRequest, err.Error())
+			errorPage(w, r, http.StatusBadRequest, "Invalid database owner")
+			return
+		}
+		orgRole, err = com.OrgRole(dbOwner, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 			return
 		}
 	}
 
-	// Settings saved, so bounce back to the database page
-	http.Redirect(w, r, fmt.Sprintf("/%s%s%s", userName, dbFolder, newName), http.StatusTemporaryRedirect)
-}
-
-// Present the stars page to the user
-func starsHandler(w http.ResponseWriter, r *http.Request) {
-	// Retrieve user and database name
-	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/stars/" at the start of the URL
+	// Work through the same checks an upload goes through, stopping at the first problem
+	check := com.UploadCheck{DBName: dbName, QuotaRemaining: -1}
+	quota, used, err := com.StorageUsage(dbOwner)
 	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-
-	// Render the stars page
-	starsPage(w, r, dbOwner, dbName)
-}
-
-// This passes table row data back to the main UI in JSON format.
-func tableViewHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Table data handler"
-
-	// Retrieve user, database, and table name
-	dbOwner, dbName, requestedTable, dbVersion, err := com.GetODTV(2, r) // 1 = Ignore "/x/table/" at the start of the URL
-	if err != nil {
-		errorPage(w, r, http.StatusBadRequest, err.Error())
-		return
+	if quota > 0 {
+		check.QuotaRemaining = quota - used
+		if check.QuotaRemaining < 0 {
+			check.QuotaRemaining = 0
+		}
 	}
-
-	// Extract sort column, sort direction, and offset variables if present
-	sortCol := r.FormValue("sort")
-	sortDir := r.FormValue("dir")
-	offsetStr := r.FormValue("offset")
-	var rowOffset int
-	if offsetStr == "" {
-		rowOffset = 0
+	if err = com.ValidateDB(dbName); err != nil {
+		log.Printf("%s: Validation failed for database name: %s", pageName, err)
+		check.Error = "Invalid database name"
+	} else if dbSize == 0 {
+		check.Error = "Database file is 0 length?"
+	} else if quota > 0 && used+dbSize > quota {
+		check.Error = "Storing this database would exceed your storage quota"
 	} else {
-		rowOffset, err = strconv.Atoi(offsetStr)
-		if err != nil {
-			errorPage(w, r, http.StatusBadRequest, err.Error())
-			return
+		if dbOwner != loggedInUser && orgRole == "" {
+			access, err := com.DBShareAccess(dbOwner, folder, dbName, loggedInUser)
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+				return
+			}
+			if access != com.ShareReadWrite {
+				check.Error = "You don't have write access to that database"
+			}
 		}
 
-		// Ensure the row offset isn't negative
-		if rowOffset < 0 {
-			rowOffset = 0
+		// An upload with the same name as an existing database becomes a new version of it, unless it's archived
+		archived, err := com.DBArchived(dbOwner, folder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
 		}
-	}
-
-	// Sanity check the sort column name
-	if sortCol != "" {
-		// Validate the sort column text, as we use it in string smashing SQL queries so need to be even more
-		// careful than usual
-		err = com.ValidateFieldName(sortCol)
+		check.LatestVersion, err = com.HighestDBVersion(dbOwner, dbName, folder, dbOwner)
 		if err != nil {
-			log.Printf("Validation failed on requested sort field name '%v': %v\n", sortCol,
-				err.Error())
-			errorPage(w, r, http.StatusBadRequest, "Validation failed on requested sort field name")
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 			return
 		}
+		check.Exists = check.LatestVersion > 0
+		if archived && check.Error == "" {
+			check.Error = "That database is archived, so new versions can't be uploaded"
+		}
 	}
+	check.OK = check.Error == ""
 
-	// If a sort direction was provided, validate it
-	if sortDir != "" {
-		if sortDir != "ASC" && sortDir != "DESC" {
-			errorPage(w, r, http.StatusBadRequest, "Invalid sort direction")
-			return
+	// Return the results
+	jsonResponse, err := json.Marshal(check)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
+
+// This function presents the database upload form to logged in users.
+func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
 		}
 	}
 
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+
+	// Render the upload page
+	uploadPage(w, r, fmt.Sprintf("%s", loggedInUser))
+}
+
+// This function processes new database data submitted through the upload form.
+func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
+	pageName := "Upload DB handler"
+
 	// Retrieve session data (if any)
 	var loggedInUser string
+	validSession := false
 	sess := session.Get(r)
 	if sess != nil {
 		u := sess.CAttr("UserName")
 		if u != nil {
 			loggedInUser = u.(string)
+			validSession = true
 		} else {
 			session.Remove(sess, w)
 		}
 	}
 
-	// Check if the user has access to the requested database
-	bucket, id, err := com.MinioBucketID(dbOwner, dbName, dbVersion, loggedInUser)
-	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
 		return
 	}
 
-	// Sanity check
-	if id == "" {
-		// The requested database wasn't found
-		log.Printf("%s: Requested database not found. Owner: '%s' Database: '%s'", pageName, dbOwner,
-			dbName)
+	// The upload page can pass a token in the URL, which it then uses to poll how much of the upload has arrived
+	var progress *com.UploadProgressReader
+	if token := r.URL.Query().Get("progress"); token != "" {
+		if err := com.Validate.Var(token, "alphanum,min=16,max=64"); err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid upload progress token")
+			return
+		}
+		progress = com.NewUploadProgressReader(r.Body, token, loggedInUser, r.ContentLength)
+		r.Body = progress
+	}
+
+	// Read the form data as it arrives.  Each database file is streamed straight to a temporary file, with its SHA256
+	// calculated along the way, so it's never held in memory
+	mr, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("%s: Error when reading multipart form data: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Upload data missing or invalid")
 		return
 	}
+	type uploadedFile struct {
+		dbName   string
+		dbSize   int64
+		queued   bool
+		shaSum   []byte
+		tempName string
+	}
+	var files []*uploadedFile
+	var branch, commitMsg, descrip, folderVal, forceVal, nameVal, ownerVal, pubVal, readme string
+	defer func() {
+		// The temporary files of queued uploads are removed by processUpload() once they've been handed over to it
+		for _, f := range files {
+			if !f.queued {
+				os.Remove(f.tempName)
+			}
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("%s: Error when reading multipart form data: %v\n", pageName, err)
+			errorPage(w, r, http.StatusBadRequest, "Upload data missing or invalid")
+			return
+		}
 
-	// Determine the number of rows to display
-	var maxRows int
-	if loggedInUser != "" {
-		// Retrieve the user preference data
-		maxRows = com.PrefUserMaxRows(loggedInUser)
-	} else {
-		// Not logged in, so default to 10 rows
-		maxRows = com.DefaultNumDisplayRows
+		// Stream the database files to disk
+		if part.FormName() == "database" {
+			if len(files) >= com.UploadMaxFiles {
+				errorPage(w, r, http.StatusBadRequest, fmt.Sprintf("At most %d databases can be uploaded at a time",
+					com.UploadMaxFiles))
+				return
+			}
+			f := &uploadedFile{dbName: part.FileName()}
+			tempDB, err := ioutil.TempFile("", "dbhub-upload-")
+			if err != nil {
+				log.Printf("%s: Error creating temporary file. User: %s, Database: %s, Error: %v\n", pageName,
+					loggedInUser, f.dbName, err)
+				errorPage(w, r, http.StatusInternalServerError, "Internal error")
+				return
+			}
+			f.tempName = tempDB.Name()
+			files = append(files, f)
+			hash := sha256.New()
+			f.dbSize, err = io.Copy(io.MultiWriter(tempDB, hash), part)
+			tempDB.Close()
+			if err != nil {
+				log.Printf("%s: Error when writing the uploaded db to a temp file. User: %s, Database: %s "+
+					"Error: %v\n", pageName, loggedInUser, f.dbName, err)
+				errorPage(w, r, http.StatusInternalServerError, "Internal error")
+				return
+			}
+			f.shaSum = hash.Sum(nil)
+			continue
+		}
+
+		// The other form fields are small, so are just read into memory
+		val, err := ioutil.ReadAll(io.LimitReader(part, 1<<20))
+		if err != nil {
+			log.Printf("%s: Error when reading form field '%s': %v\n", pageName, part.FormName(), err)
+			errorPage(w, r, http.StatusBadRequest, "Upload data missing or invalid")
+			return
+		}
+		switch part.FormName() {
+		case "branch":
+			branch = string(val)
+		case "commitmsg":
+			commitMsg = string(val)
+		case "descrip":
+			descrip = string(val)
+		case "folder":
+			folderVal = string(val)
+		case "force":
+			forceVal = string(val)
+		case "name":
+			nameVal = string(val)
+		case "owner":
+			ownerVal = string(val)
+		case "public":
+			pubVal = string(val)
+		case "readme":
+			readme = string(val)
+		}
+	}
+	if progress != nil {
+		progress.Finish()
 	}
 
-	// If the data is available from memcached, use that instead of reading from the SQLite database itself
-	dataCacheKey := com.TableRowsCacheKey(fmt.Sprintf("tablejson/%s/%s/%d", sortCol, sortDir, rowOffset),
-		loggedInUser, dbOwner, "/", dbName, dbVersion, requestedTable, maxRows)
+	// Validate the supplied "public" form field
+	public, err := strconv.ParseBool(pubVal)
+	if err != nil {
+		log.Printf("%s: Error when converting public value to boolean: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Public value incorrect")
+		return
+	}
 
-	// If a cached version of the page data exists, use it
-	var dataRows com.SQLiteRecordSet
-	ok, err := com.GetCachedData(dataCacheKey, &dataRows)
+	// Ensure the description is 80 chars or less
+	if len(descrip) > 80 {
+		errorPage(w, r, http.StatusBadRequest, "Description line needs to be 80 characters or less")
+		return
+	}
+
+	// Validate the commit message
+	err = com.ValidateCommitMessage(commitMsg)
 	if err != nil {
-		log.Printf("%s: Error retrieving table data from cache: %v\n", pageName, err)
+		errorPage(w, r, http.StatusBadRequest, "Commit message needs to be 1024 characters or less")
+		return
 	}
-	if !ok {
-		// * Data wasn't in cache, so we gather it from the SQLite database *
 
-		// Open the Minio database
-		sdb, err := com.OpenMinioObject(bucket, id)
+	// Validate the branch.  Uploads without one go onto the main branch
+	if branch != "" {
+		err = com.ValidateBranch(branch)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid branch name")
+			return
+		}
+	}
 
-		// Retrieve the list of tables in the database
-		tables, err := sdb.Tables("")
+	// Validate the destination folder.  Uploads without one go into the root folder
+	folder, err := com.NormaliseFolder(folderVal)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid folder name")
+		return
+	}
+
+	// Users the database has been shared with can upload new versions of it, by giving the owner's name, and members
+	// of an organisation can upload to its databases.  Otherwise the upload goes to the logged in user's own databases
+	dbOwner := loggedInUser
+	var orgRole string
+	if ownerVal != "" {
+		dbOwner = strings.ToLower(ownerVal)
+		err = com.ValidateUser(dbOwner)
 		if err != nil {
-			log.Printf("Error retrieving table names: %s", err)
+			errorPage(w, r, http.StatusBadRequest, "Invalid database owner")
 			return
 		}
-		if len(tables) == 0 {
-			// No table names were returned, so abort
-			log.Printf("The database '%s' doesn't seem to have any tables. Aborting.", dbName)
+		orgRole, err = com.OrgRole(dbOwner, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 			return
 		}
+	}
 
-		// If a specific table was requested, check it exists
-		if requestedTable != "" {
-			tablePresent := false
-			for _, tableName := range tables {
-				if requestedTable == tableName {
-					tablePresent = true
-				}
-			}
-			if tablePresent == false {
-				// The requested table doesn't exist
-				errorPage(w, r, http.StatusBadRequest, "Requested table does not exist")
-				return
-			}
+	if len(files) == 0 {
+		log.Printf("%s: Uploading file failed, no database in the form data\n", pageName)
+		errorPage(w, r, http.StatusBadRequest, "Database file missing from upload data?")
+		return
+	}
+
+	// A single file can be stored under a different name than it was uploaded with
+	if nameVal != "" {
+		if len(files) > 1 {
+			errorPage(w, r, http.StatusBadRequest, "A database name can only be given when uploading a single file")
+			return
+		}
+		files[0].dbName = nameVal
+	}
+
+	// Check each file in turn.  A problem with one file doesn't stop the others, instead its failure is reported in
+	// the list of results sent back
+	force, _ := strconv.ParseBool(forceVal)
+	jobs := make([]com.UploadJob, len(files))
+	seen := make(map[string]bool)
+	for i, f := range files {
+		jobs[i] = com.UploadJob{
+			Branch:   branch,
+			DBName:   f.dbName,
+			Folder:   folder,
+			Owner:    dbOwner,
+			Started:  time.Now(),
+			Status:   com.UploadFailed,
+			Uploader: loggedInUser,
 		}
 
-		// If no specific table was requested, use the first one
-		if requestedTable == "" {
-			requestedTable = tables[0]
+		// Validate the database name
+		err = com.ValidateDB(f.dbName)
+		if err != nil {
+			log.Printf("%s: Validation failed for database name: %s", pageName, err)
+			jobs[i].Error = "Invalid database name"
+			continue
 		}
 
-		// If a sort column was requested, verify it exists
-		if sortCol != "" {
-			colList, err := sdb.Columns("", requestedTable)
+		// Two files with the same name would end up as versions of the same database, in no particular order
+		if seen[f.dbName] {
+			jobs[i].Error = "Another file in this upload has the same name"
+			continue
+		}
+		seen[f.dbName] = true
+
+		// Only the owner (or organisation members) can create databases, and only users with write access can add
+		// versions to other users ones
+		if dbOwner != loggedInUser && orgRole == "" {
+			access, err := com.DBShareAccess(dbOwner, folder, f.dbName, loggedInUser)
 			if err != nil {
-				log.Printf("Error when reading column names for table '%s': %v\n", requestedTable,
-					err.Error())
-				errorPage(w, r, http.StatusInternalServerError, "Error when reading from the database")
-				return
+				jobs[i].Error = "Database query failed"
+				continue
 			}
-			colExists := false
-			for _, j := range colList {
-				if j.Name == sortCol {
-					colExists = true
-				}
-			}
-			if colExists == false {
-				// The requested sort column doesn't exist, so we fall back to no sorting
-				sortCol = ""
+			if access != com.ShareReadWrite {
+				jobs[i].Error = "You don't have write access to that database"
+				continue
 			}
 		}
 
-		// Read the data from the database
-		dataRows, err = com.ReadSQLiteDB(sdb, requestedTable, maxRows, sortCol, sortDir, rowOffset)
+		// New versions can't be added to archived databases
+		archived, err := com.DBArchived(dbOwner, folder, f.dbName)
 		if err != nil {
-			// Some kind of error when reading the database data
-			errorPage(w, r, http.StatusBadRequest, err.Error())
-			return
+			jobs[i].Error = "Database query failed"
+			continue
+		}
+		if archived {
+			jobs[i].Error = "That database is archived, so new versions can't be uploaded"
+			continue
 		}
 
-		// Count the total number of rows in the requested table
-		dataRows.TotalRows, err = com.GetSQLiteRowCount(sdb, requestedTable)
+		// Live databases are changed with the write API instead, and their versions come from snapshots
+		_, live, err := com.DBLive(dbOwner, folder, f.dbName)
 		if err != nil {
-			errorPage(w, r, http.StatusInternalServerError, err.Error())
-			return
+			jobs[i].Error = "Database query failed"
+			continue
+		}
+		if live {
+			jobs[i].Error = "That's a live database, so new versions can't be uploaded"
+			continue
+		}
+
+		// Changes to protected branches need to come through a merge request, rather than being uploaded directly
+		protected, err := com.BranchProtected(dbOwner, folder, f.dbName, branch)
+		if err != nil {
+			jobs[i].Error = "Database query failed"
+			continue
+		}
+		if protected {
+			jobs[i].Error = "That branch is protected, so new versions can't be uploaded to it directly"
+			continue
+		}
+
+		// Other branches can only be added to existing databases, as new databases start on the main branch
+		if branch != "" && branch != com.DefaultBranch {
+			highVer, err := com.HighestDBVersion(dbOwner, f.dbName, folder, dbOwner)
+			if err != nil {
+				jobs[i].Error = "Database query failed"
+				continue
+			}
+			if highVer == 0 {
+				jobs[i].Error = "Uploads to a branch need to be for an existing database"
+				continue
+			}
+		}
+		if f.dbSize == 0 {
+			log.Printf("%s: Database seems to be 0 bytes in length. Username: %s, Database: %s\n", pageName,
+				loggedInUser, f.dbName)
+			jobs[i].Error = "Database file is 0 length?"
+			continue
+		}
+
+		// If the file is identical to an existing version of the database, say so rather than storing it again.  The
+		// user can still force the upload through
+		if !force {
+			name, ver, err := com.DBVersionBySHA256(dbOwner, dbOwner, folder, f.dbName,
+				hex.EncodeToString(f.shaSum))
+			if err != nil {
+				jobs[i].Error = "Database query failed"
+				continue
+			}
+			if ver != 0 && name == f.dbName {
+				jobs[i].Status = com.UploadUnchanged
+				jobs[i].Version = ver
+				continue
+			}
 		}
 
-		// Close the SQLite database
-		defer sdb.Close()
-
-		// Cache the data in memcache
-		err = com.CacheData(dataCacheKey, dataRows, com.CacheTime)
+		// Create the upload job
+		jobs[i].ID = com.RandomString(16)
+		jobs[i].Status = com.UploadQueued
+		err = com.SetUploadJobStatus(jobs[i])
 		if err != nil {
-			log.Printf("%s: Error when caching table data: %v\n", pageName, err)
+			log.Printf("%s: Error when storing upload job status: %v\n", pageName, err)
+			jobs[i].Error = "Internal error"
+			jobs[i].ID = ""
+			jobs[i].Status = com.UploadFailed
+			continue
 		}
+		f.queued = true
 	}
 
-	// Format the output.  Use json.MarshalIndent() for nicer looking output
-	jsonResponse, err := json.MarshalIndent(dataRows, "", " ")
+	// Process the queued uploads in the background, one after the other.  The background job outlives the request,
+	// so it gets a fresh context which continues the request's trace
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	go func() {
+		for i, f := range files {
+			if f.queued {
+				processUpload(ctx, jobs[i], folder, f.tempName, f.dbSize, f.shaSum, public, descrip, readme,
+					commitMsg)
+			}
+		}
+	}()
+
+	// Return the result for each file, in the order they were sent, so the upload page can poll for progress
+	jsonResponse, err := json.Marshal(jobs)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-
-	//w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	fmt.Fprintf(w, "%s", jsonResponse)
 }
 
-// This function presents the database upload form to logged in users.
-func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
+// Returns how much of a web form upload has arrived so far, as JSON.
+func uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve session data (if any)
 	var loggedInUser string
 	validSession := false
@@ -1400,14 +8005,35 @@ func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Render the upload page
-	uploadPage(w, r, fmt.Sprintf("%s", loggedInUser))
-}
+	// Extract the upload token from the URL
+	token := strings.TrimPrefix(r.URL.Path, "/x/uploadprogress/")
+	if err := com.Validate.Var(token, "alphanum,min=16,max=64"); err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid upload progress token")
+		return
+	}
 
-// This function processes new database data submitted through the upload form.
-func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
-	pageName := "Upload DB handler"
+	// Uploads can only be followed by the user sending them
+	progress, ok, err := com.UploadProgressStatus(token)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Error when retrieving upload progress")
+		return
+	}
+	if !ok || progress.Owner != loggedInUser {
+		errorPage(w, r, http.StatusNotFound, "Unknown upload")
+		return
+	}
+
+	jsonResponse, err := json.Marshal(progress)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
 
+// Returns the status of an upload job, as JSON.
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve session data (if any)
 	var loggedInUser string
 	validSession := false
@@ -1428,150 +8054,449 @@ func uploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare the form data
-	r.ParseMultipartForm(32 << 20) // 64MB of ram max
-	if err := r.ParseForm(); err != nil {
-		log.Printf("%s: ParseForm() error: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+	// Extract the job ID from the URL
+	jobID := strings.TrimPrefix(r.URL.Path, "/x/uploadstatus/")
+	if jobID == "" || strings.Contains(jobID, "/") {
+		errorPage(w, r, http.StatusBadRequest, "Invalid upload job ID")
 		return
 	}
 
-	// Grab and validate the supplied "public" form field
-	public, err := com.GetPub(r)
+	// Retrieve the job status.  Jobs can only be looked up by the user who started them
+	job, ok, err := com.UploadJobStatus(jobID)
 	if err != nil {
-		log.Printf("%s: Error when converting public value to boolean: %v\n", pageName, err)
-		errorPage(w, r, http.StatusBadRequest, "Public value incorrect")
+		errorPage(w, r, http.StatusInternalServerError, "Error when retrieving upload status")
+		return
+	}
+	startedBy := job.Uploader
+	if startedBy == "" {
+		startedBy = job.Owner
+	}
+	if !ok || startedBy != loggedInUser {
+		errorPage(w, r, http.StatusNotFound, "Unknown upload job")
 		return
 	}
 
-	// Extract the other form variables
-	descrip := r.PostFormValue("descrip")
-	readme := r.PostFormValue("readme")
+	jsonResponse, err := json.Marshal(job)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
 
-	// Ensure the description is 80 chars or less
-	if len(descrip) > 80 {
-		errorPage(w, r, http.StatusBadRequest, "Description line needs to be 80 characters or less")
+// Serves an Atom feed of a user's recent activity on public databases.
+func userFeedHandler(w http.ResponseWriter, r *http.Request, userName string) {
+	exists, err := com.CheckUserExists(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !exists {
+		errorPage(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	list, err := com.Activity(userName, 0, com.FeedLength)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
 
-	// TODO: Add support for folders and subfolders
-	folder := "/"
+	userURL := fmt.Sprintf("https://%s/%s", com.WebServer(), url.PathEscape(userName))
+	feed := atomFeed{
+		ID:      userURL,
+		Links:   []atomLink{{Href: userURL}, {Href: userURL + ".atom", Rel: "self"}},
+		Title:   userName,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(list) > 0 {
+		feed.Updated = list[0].Date.UTC().Format(time.RFC3339)
+	}
+	for _, e := range list {
+		dbURL := fmt.Sprintf("https://%s/%s%s%s", com.WebServer(), url.PathEscape(e.DBOwner), e.DBFolder,
+			url.PathEscape(e.DBName))
+		feed.Entries = append(feed.Entries, atomEntry{
+			Author:  atomAuthor{Name: e.User},
+			ID:      fmt.Sprintf("tag:%s,2017:activity/%d", com.WebServer(), e.ID),
+			Links:   []atomLink{{Href: dbURL}},
+			Title:   activityTitle(e),
+			Updated: e.Date.UTC().Format(time.RFC3339),
+		})
+	}
+	writeAtomFeed(w, feed)
+}
 
-	tempFile, handler, err := r.FormFile("database")
-	if err != nil {
-		log.Printf("%s: Uploading file failed: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Database file missing from upload data?")
+// Adds or removes a validation rule, which new versions of a database need to pass before they're accepted.
+func validationRuleHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure we have a valid logged in user
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if r.Method != "POST" {
+		errorPage(w, r, http.StatusMethodNotAllowed, "Validation rules need to be changed using POST")
 		return
 	}
-	dbName := handler.Filename
-	defer tempFile.Close()
 
-	// Validate the database name
-	err = com.ValidateDB(dbName)
+	// Validate the form data
+	dbName := r.PostFormValue("dbname")
+	err := com.ValidateDB(dbName)
 	if err != nil {
-		log.Printf("%s: Validation failed for database name: %s", pageName, err)
 		errorPage(w, r, http.StatusBadRequest, "Invalid database name")
 		return
 	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbVersion, err := com.GetFormVersion(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Invalid database version number")
+		return
+	}
+
+	// Only the owner (or an admin of the owning organisation) can change the validation rules
+	dbOwner, ok := formDBOwner(w, r, loggedInUser)
+	if !ok {
+		return
+	}
+	switch r.PostFormValue("action") {
+	case "add":
+		rule := com.ValidationRule{
+			Column:    strings.TrimSpace(r.PostFormValue("column")),
+			CreatedBy: loggedInUser,
+			Kind:      r.PostFormValue("kind"),
+			Name:      strings.TrimSpace(r.PostFormValue("name")),
+			Query:     strings.TrimSpace(r.PostFormValue("query")),
+			Table:     strings.TrimSpace(r.PostFormValue("table")),
+		}
+
+		// Range rules can leave out either end of the range
+		badRange := false
+		if rule.Kind == com.RuleRange {
+			if val := strings.TrimSpace(r.PostFormValue("min")); val != "" {
+				min, err := strconv.ParseFloat(val, 64)
+				badRange = badRange || err != nil
+				rule.Min = &min
+			}
+			if val := strings.TrimSpace(r.PostFormValue("max")); val != "" {
+				max, err := strconv.ParseFloat(val, 64)
+				badRange = badRange || err != nil
+				rule.Max = &max
+			}
+		}
+		if badRange {
+			errorPage(w, r, http.StatusBadRequest, "Range rules need numbers for the minimum and maximum values")
+			return
+		}
+
+		// Only keep the fields used by the kind of rule
+		if rule.Kind == com.RuleSQL {
+			rule.Table, rule.Column = "", ""
+		} else {
+			rule.Query = ""
+		}
+		err = com.ValidateValidationRule(rule)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = com.AddValidationRule(dbOwner, dbFolder, dbName, rule)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Error when adding the validation rule")
+			return
+		}
+	case "remove":
+		ruleID, err := strconv.ParseInt(r.PostFormValue("rule_id"), 10, 64)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Invalid validation rule ID")
+			return
+		}
+		err = com.RemoveValidationRule(dbOwner, dbFolder, dbName, ruleID)
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		errorPage(w, r, http.StatusBadRequest, "Unknown validation rule action")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/settings/%s/%s?version=%d&folder=%s", dbOwner, dbName, dbVersion,
+		url.QueryEscape(dbFolder)), http.StatusSeeOther)
+}
 
-	// Write the temporary file locally, so we can try opening it with SQLite to verify it's ok
-	var tempBuf bytes.Buffer
-	bytesWritten, err := io.Copy(&tempBuf, tempFile)
+// Verifies the lineage chain of a database's versions, returning the result as JSON.
+func verifyLineageHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the user and database name
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/verifylineage/" at the start of the URL
 	if err != nil {
-		log.Printf("%s: Error: %v\n", pageName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Third party applications authorised through OAuth send an access token instead
+	if loggedInUser == "" {
+		loggedInUser, err = oauthUser(r, com.OAuthScopeRead)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	// Make sure the database exists, and the user has access to it
+	ver, err := com.HighestDBVersion(dbOwner, dbName, dbFolder, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
-	if bytesWritten == 0 {
-		log.Printf("%s: Database seems to be 0 bytes in length. Username: %s, Database: %s\n", pageName,
-			loggedInUser, dbName)
-		errorPage(w, r, http.StatusBadRequest, "Database file is 0 length?")
+	if ver == 0 {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
 		return
 	}
-	tempDB, err := ioutil.TempFile("", "dbhub-upload-")
+
+	report, err := com.VerifyLineage(dbOwner, dbFolder, dbName)
 	if err != nil {
-		log.Printf("%s: Error creating temporary file. User: %s, Database: %s, Filename: %s, Error: %v\n",
-			pageName, loggedInUser, dbName, tempDB.Name(), err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		errorPage(w, r, http.StatusInternalServerError, "Error when verifying the database lineage")
 		return
 	}
-	_, err = tempDB.Write(tempBuf.Bytes())
+	jsonResponse, err := json.MarshalIndent(report, "", " ")
 	if err != nil {
-		log.Printf("%s: Error when writing the uploaded db to a temp file. User: %s, Database: %s"+
-			"Error: %v\n", pageName, loggedInUser, dbName, err)
-		errorPage(w, r, http.StatusInternalServerError, "Internal error")
+		log.Println(err)
 		return
 	}
-	tempDBName := tempDB.Name()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
+}
 
-	// Delete the temporary file when this function finishes
-	defer os.Remove(tempDBName)
+// Returns true if the client asked for JSON rather than HTML, the request was made from JavaScript, or the request
+// is to the API.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		r.Header.Get("X-Requested-With") == "XMLHttpRequest" || strings.HasPrefix(r.URL.Path, "/api/")
+}
 
-	// Sanity check the uploaded database
-	err = com.SanityCheck(tempDBName)
+// Toggles whether the logged in user is watching a database, returning its new watcher count.
+func watchToggleHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the user and database name
+	dbOwner, dbName, err := com.GetOD(2, r) // 2 = Ignore "/x/watch/" at the start of the URL
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, err.Error())
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Generate sha256 of the uploaded file
-	shaSum := sha256.Sum256(tempBuf.Bytes())
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
 
-	// Determine the version number for this new database
-	highVer, err := com.HighestDBVersion(loggedInUser, dbName, "/", loggedInUser)
-	var newVer int
-	if highVer > 0 {
-		// The database already exists
-		newVer = highVer + 1
-	} else {
-		newVer = 1
+	// Ensure we have a valid logged in user
+	if validSession != true {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in to watch databases")
+		return
 	}
 
-	// Retrieve the Minio bucket to store the database in
-	bucket, err := com.MinioUserBucket(loggedInUser)
+	// Toggle on or off the watching of a database by a user
+	_, watchers, err := com.ToggleDBWatch(loggedInUser, dbOwner, dbFolder, dbName)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't update the database watch")
 		return
 	}
+	fmt.Fprint(w, watchers)
+}
 
-	// Generate filename to store the database as
-	var minioID string
-	for okID := false; okID == false; {
-		// Check if the randomly generated filename is available, just in caes
-		minioID = com.RandomString(8) + ".db"
-		okID, err = com.CheckMinioIDAvail(loggedInUser, minioID)
+// The parts of an Atom feed we use, for the user and database feeds
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Author  atomAuthor `xml:"author"`
+	ID      string     `xml:"id"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary,omitempty"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+// Checks the user making a request can change a database, returning the user.  Users can be logged in, or send an
+// access token with the write scope.  Only the owner, and users the database is shared with for writing, can change
+// it.  If the checks fail, an error page is sent and ok is false.
+func writeAccess(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) (loggedInUser string, ok bool) {
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Third party applications authorised through OAuth send an access token instead
+	var err error
+	if loggedInUser == "" {
+		loggedInUser, err = oauthUser(r, com.OAuthScopeWrite)
 		if err != nil {
-			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			errorPage(w, r, http.StatusUnauthorized, err.Error())
 			return
 		}
 	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusUnauthorized, "You need to be logged in")
+		return
+	}
+	if !writeAllowed(w, r, loggedInUser, dbOwner, dbFolder, dbName) {
+		return
+	}
+	return loggedInUser, true
+}
 
-	// Store the database file in Minio
-	dbSize, err := com.StoreMinioObject(bucket, minioID, &tempBuf, handler.Header["Content-Type"][0])
+// Checks a user can change a database.  Only the owner, and users with write access to the database, can change it,
+// and only while it isn't archived.  If they can't, an error page is sent and false is returned.
+func writeAllowed(w http.ResponseWriter, r *http.Request, loggedInUser string, dbOwner string, dbFolder string, dbName string) bool {
+	if dbOwner != loggedInUser {
+		access, err := com.DBShareAccess(dbOwner, dbFolder, dbName, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return false
+		}
+		if access != com.ShareReadWrite {
+			errorPage(w, r, http.StatusForbidden, "You don't have write access to that database")
+			return false
+		}
+	}
+	if takenDown(w, r, dbOwner, dbFolder, dbName) {
+		return false
+	}
+	archived, err := com.DBArchived(dbOwner, dbFolder, dbName)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, "Storing database file failed")
-		return
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return false
 	}
+	if archived {
+		errorPage(w, r, http.StatusForbidden, "That database is archived, so it can't be changed")
+		return false
+	}
+	return true
+}
 
-	// Add the database file details to PostgreSQL
-	err = com.AddDatabase(loggedInUser, folder, dbName, newVer, shaSum[:], dbSize, public, bucket, minioID, descrip, readme)
+// Writes an Atom feed to the client.
+func writeAtomFeed(w http.ResponseWriter, feed atomFeed) {
+	feed.XMLNS = "http://www.w3.org/2005/Atom"
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	err := xml.NewEncoder(w).Encode(feed)
 	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, "Adding database details to PostgreSQL failed")
-		return
+		log.Printf("Error when encoding Atom feed: %v\n", err)
 	}
+}
 
-	// Log the successful database upload
-	log.Printf("%s: Username: %v, database '%v' uploaded as '%v', bytes: %v\n", pageName, loggedInUser, dbName,
-		minioID, dbSize)
+// Writes a two part SVG badge, with the label on a grey background and the value on a coloured one.  Text widths are
+// estimated, as the badge is drawn by the browser using whichever sans-serif font is available.
+func writeBadge(w http.ResponseWriter, status int, label string, value string, colour string) {
+	labelWidth := 7*len(label) + 10
+	valueWidth := 7*len(value) + 10
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="14">%[4]s</text><text x="%[8]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, labelWidth+valueWidth, labelWidth, valueWidth, template.HTMLEscapeString(label),
+		template.HTMLEscapeString(value), colour, labelWidth/2, labelWidth+valueWidth/2)
+}
+
+// Writes a zip archive of the given database versions.
+func writeDBArchive(ctx context.Context, w io.Writer, dbList []com.StoredDBVersion) error {
+	zw := zip.NewWriter(w)
+	for _, db := range dbList {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: db.DBName, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		userDB, err := com.MinioHandle(ctx, db.MinioBkt, db.MinioID)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, userDB)
+		com.MinioHandleClose(userDB)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
 
-	// Invalidate any memcached entries for the previous highest version # of the database
-	err = com.InvalidateCacheEntry(loggedInUser, loggedInUser, folder, dbName, 0) // 0 indicates "for all versions"
+// Sends a value as JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, pageName string, data interface{}) {
+	jsonResponse, err := json.MarshalIndent(data, "", " ")
 	if err != nil {
-		// Something went wrong when invalidating memcached entries for any previous database versions
-		log.Printf("Error when invalidating memcache entries: %s\n", err.Error())
+		log.Printf("%s: Error when serialising JSON: %v\n", pageName, err)
+		errorPage(w, r, http.StatusInternalServerError, "Internal error")
 		return
 	}
-
-	// Database upload succeeded.  Bounce the user to the page for their new database
-	http.Redirect(w, r, fmt.Sprintf("/%s%s%s", loggedInUser, "/", dbName), http.StatusTemporaryRedirect)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", jsonResponse)
 }
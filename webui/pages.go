@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/csv"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/icza/session"
 	"github.com/rhinoman/go-commonmark"
@@ -45,15 +50,222 @@ func aboutPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName string, dbVersion int, dbTable string, sortCol string, sortDir string, rowOffset int) {
+// Renders the page showing which version last changed each row of a table.
+func blamePage(w http.ResponseWriter, r *http.Request, loggedInUser string, dbOwner string, dbFolder string,
+	dbName string, commits []com.CommitJSON, key []string, maxRows int, blame com.TableBlame) {
+	var pageData struct {
+		Auth0   com.Auth0Set
+		Blame   com.TableBlame
+		Commits []com.CommitJSON
+		Key     []string
+		Meta    com.MetaInfo
+		Rows    int
+	}
+	pageData.Meta.Title = "Row history"
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+	pageData.Blame = blame
+	pageData.Commits = commits
+	pageData.Key = key
+	pageData.Rows = maxRows
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("blamePage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the page listing the DB4S client certificates issued to the logged in user, where new ones can be
+// generated and existing ones revoked.
+func certificatesPage(w http.ResponseWriter, r *http.Request) {
+	var pageData struct {
+		Auth0       com.Auth0Set
+		Certs       []com.ClientCertificate
+		DefaultDays int
+		MaxDays     int
+		Meta        com.MetaInfo
+	}
+	pageData.Meta.Title = "DB4S certificates"
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	validSession := false
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			pageData.Meta.LoggedInUser = loggedInUser
+			validSession = true
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if validSession != true {
+		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
+		return
+	}
+
+	var err error
+	pageData.Certs, err = com.ClientCerts(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.DefaultDays = com.SigningCertDefaultDays()
+	pageData.MaxDays = com.SigningCertMaxDays()
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("certificatesPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the commit history page for a database.
+func commitsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) {
+	var pageData struct {
+		Auth0   com.Auth0Set
+		Checks  map[string][]com.StatusCheck
+		Commits []com.CommitJSON
+		Meta    com.MetaInfo
+	}
+	pageData.Meta.Title = "Commits"
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			pageData.Meta.LoggedInUser = loggedInUser
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Retrieve the commit history of the database
+	var err error
+	pageData.Commits, err = com.DBCommits(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if len(pageData.Commits) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+
+	// Retrieve the status checks posted against the commits, grouped by commit
+	checks, err := com.StatusChecks(dbOwner, dbFolder, dbName, "")
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	pageData.Checks = make(map[string][]com.StatusCheck)
+	for _, c := range checks {
+		pageData.Checks[c.CommitID] = append(pageData.Checks[c.CommitID], c)
+	}
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("commitsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the contributors page for a database, showing how many versions each user added and how many rows they
+// changed.
+func contributorsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) {
+	var pageData struct {
+		Auth0        com.Auth0Set
+		Contributors []com.ContributorStats
+		Meta         com.MetaInfo
+	}
+	pageData.Meta.Title = "Contributors"
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			pageData.Meta.LoggedInUser = loggedInUser
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Retrieve the contributor statistics of the database
+	var err error
+	pageData.Contributors, err = com.DBContributors(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if len(pageData.Contributors) == 0 {
+		errorPage(w, r, http.StatusNotFound, "The requested database doesn't exist")
+		return
+	}
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("contributorsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string, dbVersion int, dbTable string, sortCol string, sortType string, sortDir string, rowOffset int) {
 	pageName := "Render database page"
 
 	var pageData struct {
-		Auth0  com.Auth0Set
-		Data   com.SQLiteRecordSet
-		DB     com.SQLiteDBinfo
-		Meta   com.MetaInfo
-		MyStar bool
+		Auth0       com.Auth0Set
+		CanManage   bool
+		ColumnDocs  map[string]map[string]string
+		Data        com.SQLiteRecordSet
+		DB          com.SQLiteDBinfo
+		DownloadURL string
+		Meta        com.MetaInfo
+		MyStar      bool
+		MyWatch     bool
+		Orgs        []string
+		Owner       com.UserProfile
+		Tab         string
 	}
 
 	// Retrieve session data (if any)
@@ -69,9 +281,21 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 		}
 	}
 
+	// Visitors with a share link for a private database can see it without having access themselves
+	accessUser, allowed := shareLinkUser(w, r, loggedInUser, dbOwner, dbFolder, dbName)
+	if !allowed {
+		return
+	}
+
+	// Links to a specific commit show the database version it's for
+	dbVersion, err := commitVersion(r, accessUser, dbOwner, dbFolder, dbName, dbVersion)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
 	// Check if the user has access to the requested database (and get it's details if available)
-	// TODO: Add proper folder support
-	err := com.DBDetails(&pageData.DB, loggedInUser, dbOwner, "/", dbName, dbVersion)
+	err = com.DBDetails(r.Context(), &pageData.DB, accessUser, dbOwner, dbFolder, dbName, dbVersion)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
@@ -79,13 +303,53 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 
 	// * Execution can only get here if the user has access to the requested database *
 
-	// Check if the database was starred by the logged in user
-	myStar, err := com.CheckDBStarred(loggedInUser, dbOwner, "/", dbName)
+	// If the database has been taken down, display the takedown notice instead of its contents
+	takedown, err := com.ActiveTakedown(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if takedown.ID != 0 {
+		takedownNoticePage(w, r, loggedInUser, pageData.DB.Info, takedown)
+		return
+	}
+
+	// Check if the database was starred or is being watched by the logged in user
+	myStar, err := com.CheckDBStarred(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve latest social stats")
+		return
+	}
+	myWatch, err := com.CheckDBWatched(loggedInUser, dbOwner, dbFolder, dbName)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, "Couldn't retrieve latest social stats")
 		return
 	}
 
+	// Check if the logged in user can change the settings of the database, as its owner or an organisation admin,
+	// and which organisations they could fork it into
+	canManage := false
+	var orgs []string
+	if loggedInUser != "" {
+		canManage, err = com.CanManageDBs(dbOwner, loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		orgs, err = com.UserOrgs(loggedInUser)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+
+	// The owner's profile isn't part of the cached page data, as it can change without the database changing
+	owner, err := com.UserProfileDetails(dbOwner)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
 	// If a specific table wasn't requested, use the user specified default (if present)
 	if dbTable == "" {
 		dbTable = pageData.DB.Info.DefaultTable
@@ -98,24 +362,24 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 		pageData.DB.MaxRows = tempMaxRows
 	} else {
 		// Not logged in, so use the default number of rows
-		tempMaxRows = com.DefaultNumDisplayRows
+		tempMaxRows = com.WebDisplayRows()
 		pageData.DB.MaxRows = tempMaxRows
 	}
 
 	// Generate predictable cache keys for the metadata and sqlite table rows
-	mdataCacheKey := com.MetadataCacheKey("dwndb-meta", loggedInUser, dbOwner, "/", dbName,
+	mdataCacheKey := com.MetadataCacheKey("dwndb-meta", accessUser, dbOwner, dbFolder, dbName,
 		dbVersion)
-	rowCacheKey := com.TableRowsCacheKey(fmt.Sprintf("tablejson/%s/%s/%d", sortCol, sortDir, rowOffset),
-		loggedInUser, dbOwner, "/", dbName, dbVersion, dbTable, pageData.DB.MaxRows)
+	rowCacheKey := com.TableRowsCacheKey(fmt.Sprintf("tablejson/%s/%s/%s/%d", sortCol, sortType, sortDir, rowOffset),
+		accessUser, dbOwner, dbFolder, dbName, dbVersion, dbTable, pageData.DB.MaxRows)
 
 	// If a cached version of the page data exists, use it
-	ok, err := com.GetCachedData(mdataCacheKey, &pageData)
+	ok, err := com.GetCachedData(r.Context(), mdataCacheKey, &pageData)
 	if err != nil {
 		log.Printf("%s: Error retrieving page data from cache: %v\n", pageName, err)
 	}
 	if ok {
 		// Grab the cached table data as well
-		ok, err := com.GetCachedData(rowCacheKey, &pageData.Data)
+		ok, err := com.GetCachedData(r.Context(), rowCacheKey, &pageData.Data)
 		if err != nil {
 			log.Printf("%s: Error retrieving page data from cache: %v\n", pageName, err)
 		}
@@ -125,9 +389,17 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 
 		// Restore the correct username
 		pageData.Meta.LoggedInUser = loggedInUser
+		pageData.CanManage = canManage
+		pageData.Orgs = orgs
+		pageData.Owner = owner
 
 		// Render the page (using the caches)
 		if ok {
+			// Signed download links expire, so always generate a fresh one
+			pageData.DownloadURL = com.DownloadURL(dbOwner, dbFolder, dbName, pageData.DB.Info.Version,
+				pageData.DB.Info.Public)
+			pageData.Tab = landingTab(r, pageData.DB.Info.LandingTab)
+
 			t := tmpl.Lookup("databasePage")
 			err = t.Execute(w, pageData)
 			if err != nil {
@@ -141,11 +413,12 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 	}
 
 	// Get a handle from Minio for the database object
-	sdb, err := com.OpenMinioObject(pageData.DB.MinioBkt, pageData.DB.MinioId)
+	sdb, err := com.OpenMinioObject(r.Context(), pageData.DB.MinioBkt, pageData.DB.MinioId)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer com.ReleaseSQLiteHandle(sdb)
 
 	// Retrieve the list of tables in the database
 	tables, err := com.Tables(sdb, dbName)
@@ -166,8 +439,8 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 		}
 		if tablePresent == false {
 			// The requested table doesn't exist in the database
-			log.Printf("%s: Requested table not present in database. DB: '%s/%s', Table: '%s'\n",
-				pageName, dbOwner, dbName, dbTable)
+			log.Printf("%s: Requested table not present in database. DB: '%s%s%s', Table: '%s'\n",
+				pageName, dbOwner, dbFolder, dbName, dbTable)
 			errorPage(w, r, http.StatusBadRequest, "Requested table not present")
 			return
 		}
@@ -215,12 +488,17 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 
 	// Fill out various metadata fields
 	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
 	pageData.Meta.Database = dbName
+	pageData.Meta.NoIndex = pageData.DB.Info.NoIndex
 	pageData.Meta.Server = com.WebServer()
 	pageData.Meta.Title = fmt.Sprintf("%s / %s", dbOwner, dbName)
+	if pageData.DB.Info.Public {
+		pageData.Meta.FeedURL = fmt.Sprintf("/%s%s%s.atom", dbOwner, dbFolder, dbName)
+	}
 
 	// Retrieve the "forked from" information
-	frkOwn, frkFol, frkDB, err := com.ForkedFrom(dbOwner, "/", dbName)
+	frkOwn, frkFol, frkDB, err := com.ForkedFrom(dbOwner, dbFolder, dbName)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
 		return
@@ -229,32 +507,42 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 	pageData.Meta.ForkFolder = frkFol
 	pageData.Meta.ForkDatabase = frkDB
 
+	// Retrieve the column docs imported from the database's metadata table
+	pageData.ColumnDocs, err = com.ColumnDocs(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+
 	// Add Auth0 info to the page data
 	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
 	pageData.Auth0.ClientID = com.Auth0ClientID()
 	pageData.Auth0.Domain = com.Auth0Domain()
 
-	// Update database star status for the logged in user
+	// Update database star and watch status for the logged in user
 	pageData.MyStar = myStar
+	pageData.MyWatch = myWatch
 
-	// Render the README as markdown / CommonMark
-	pageData.DB.Info.Readme = commonmark.Md2Html(pageData.DB.Info.Readme, commonmark.CMARK_OPT_DEFAULT)
+	// Render the README as markdown / CommonMark, linking any @mentions to the user pages
+	pageData.DB.Info.Readme = com.LinkMentions(commonmark.Md2Html(pageData.DB.Info.Readme,
+		commonmark.CMARK_OPT_DEFAULT))
 
 	// Cache the page metadata
-	err = com.CacheData(mdataCacheKey, pageData, com.CacheTime)
+	err = com.CacheData(r.Context(), mdataCacheKey, pageData, com.CacheTime)
 	if err != nil {
 		log.Printf("%s: Error when caching page data: %v\n", pageName, err)
 	}
 
 	// Grab the cached table data if it's available
-	ok, err = com.GetCachedData(rowCacheKey, &pageData.Data)
+	ok, err = com.GetCachedData(r.Context(), rowCacheKey, &pageData.Data)
 	if err != nil {
 		log.Printf("%s: Error retrieving page data from cache: %v\n", pageName, err)
 	}
 
 	// If the row data wasn't in cache, read it from the database
 	if !ok {
-		pageData.Data, err = com.ReadSQLiteDB(sdb, dbTable, pageData.DB.MaxRows, sortCol, sortDir, rowOffset)
+		pageData.Data, err = com.ReadSQLiteDB(sdb, dbTable, pageData.DB.MaxRows, sortCol, sortType, sortDir,
+			rowOffset)
 		if err != nil {
 			// Some kind of error when reading the database data
 			errorPage(w, r, http.StatusBadRequest, err.Error())
@@ -263,16 +551,19 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 		pageData.Data.Tablename = dbTable
 	}
 
-	// Close the SQLite database
-	defer sdb.Close()
-
 	// Cache the table row data
-	err = com.CacheData(rowCacheKey, pageData.Data, com.CacheTime)
+	err = com.CacheData(r.Context(), rowCacheKey, pageData.Data, com.CacheTime)
 	if err != nil {
 		log.Printf("%s: Error when caching page data: %v\n", pageName, err)
 	}
 
 	// Render the page
+	pageData.CanManage = canManage
+	pageData.Orgs = orgs
+	pageData.Owner = owner
+	pageData.DownloadURL = com.DownloadURL(dbOwner, dbFolder, dbName, pageData.DB.Info.Version,
+		pageData.DB.Info.Public)
+	pageData.Tab = landingTab(r, pageData.DB.Info.LandingTab)
 	t := tmpl.Lookup("databasePage")
 	err = t.Execute(w, pageData)
 	if err != nil {
@@ -280,14 +571,65 @@ func databasePage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName
 	}
 }
 
-// General error display page.
-func errorPage(w http.ResponseWriter, r *http.Request, httpcode int, msg string) {
+// Render the page showing the differences between two versions of a database
+func diffPage(w http.ResponseWriter, r *http.Request, loggedInUser string, dbOwner string, dbFolder string,
+	dbName string, commits []com.CommitJSON, fromVer int, toVer int, dbTable string, rowOffset int, maxRows int,
+	diff com.DBDiff) {
 	var pageData struct {
 		Auth0   com.Auth0Set
-		Message string
+		Commits []com.CommitJSON
+		Diff    com.DBDiff
+		From    int
 		Meta    com.MetaInfo
+		Offset  int
+		Rows    int
+		Table   string
+		To      int
+	}
+	pageData.Meta.Title = "Changes"
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+	pageData.Commits = commits
+	pageData.Diff = diff
+	pageData.From = fromVer
+	pageData.To = toVer
+	pageData.Table = dbTable
+	pageData.Offset = rowOffset
+	pageData.Rows = maxRows
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("diffPage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// General error display page.  Clients expecting JSON (eg AJAX requests) are sent a JSON error instead.
+func errorPage(w http.ResponseWriter, r *http.Request, httpcode int, msg string) {
+	if id := requestID(r); id != "" {
+		log.Printf("Request %s: Error %d sent for '%s': %s\n", id, httpcode, r.URL.Path, msg)
+	}
+	if wantsJSON(r) {
+		jsonError(w, r, httpcode, msg)
+		return
+	}
+
+	var pageData struct {
+		Auth0     com.Auth0Set
+		Message   string
+		Meta      com.MetaInfo
+		RequestID string
 	}
 	pageData.Message = msg
+	pageData.RequestID = requestID(r)
 
 	// Retrieve session data (if any)
 	var loggedInUser string
@@ -308,6 +650,7 @@ func errorPage(w http.ResponseWriter, r *http.Request, httpcode int, msg string)
 	pageData.Auth0.Domain = com.Auth0Domain()
 
 	// Render the page
+	com.NoteError(w, msg)
 	w.WriteHeader(httpcode)
 	t := tmpl.Lookup("errorPage")
 	err := t.Execute(w, pageData)
@@ -325,6 +668,7 @@ func forksPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder
 	}
 	pageData.Meta.Title = "Forks"
 	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
 	pageData.Meta.Database = dbName
 
 	// Retrieve session data (if any)
@@ -367,9 +711,13 @@ func forksPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder
 func frontPage(w http.ResponseWriter, r *http.Request) {
 	// Structure to hold page data
 	var pageData struct {
-		Auth0 com.Auth0Set
-		List  []com.UserInfo
-		Meta  com.MetaInfo
+		Activity []com.FeedEntry
+		Auth0    com.Auth0Set
+		Featured []com.DBSummary
+		Feed     []com.FeedEntry
+		Meta     com.MetaInfo
+		Popular  []com.DBSummary
+		Recent   []com.DBSummary
 	}
 
 	// Retrieve session data (if any)
@@ -385,13 +733,39 @@ func frontPage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Retrieve list of users with public databases
+	// Retrieve the lists of featured, popular, and recently updated databases
 	var err error
-	pageData.List, err = com.PublicUserDBs()
+	pageData.Featured, err = com.FeaturedDBs(com.WebFeaturedDBs())
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Popular, err = com.PopularDBs(com.FrontPageListLength)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Recent, err = com.RecentDBs(com.FrontPageListLength)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve what's been happening across the site recently
+	pageData.Activity, err = com.Activity("", 0, com.FeedLength)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
+
+	// Logged in users also get the recent activity of the people they follow
+	if loggedInUser != "" {
+		pageData.Feed, err = com.FollowFeed(loggedInUser, com.FeedLength)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
 	pageData.Meta.Title = `SQLite storage "in the cloud"`
 
 	// Add Auth0 info to the page data
@@ -407,18 +781,31 @@ func frontPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Renders the user Preferences page.
-func prefPage(w http.ResponseWriter, r *http.Request, loggedInUser string) {
+// Renders the query history page for the logged in user.
+func historyPage(w http.ResponseWriter, r *http.Request, loggedInUser string) {
 	var pageData struct {
 		Auth0   com.Auth0Set
-		MaxRows int
+		History []com.QueryHistoryEntry
 		Meta    com.MetaInfo
+		Saved   []com.SavedQuery
 	}
-	pageData.Meta.Title = "Preferences"
+	pageData.Meta.Title = "Query history"
 	pageData.Meta.LoggedInUser = loggedInUser
 
-	// Retrieve the user preference data
-	pageData.MaxRows = com.PrefUserMaxRows(loggedInUser)
+	// Retrieve the recent query history for the user
+	var err error
+	pageData.History, err = com.QueryHistory(loggedInUser, com.QueryHistoryLength)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the saved queries for the user
+	pageData.Saved, err = com.SavedQueries(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
 
 	// Add Auth0 info to the page data
 	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
@@ -426,30 +813,490 @@ func prefPage(w http.ResponseWriter, r *http.Request, loggedInUser string) {
 	pageData.Auth0.Domain = com.Auth0Domain()
 
 	// Render the page
-	t := tmpl.Lookup("prefPage")
-	err := t.Execute(w, pageData)
+	t := tmpl.Lookup("historyPage")
+	err = t.Execute(w, pageData)
 	if err != nil {
 		log.Printf("Error: %s", err)
 	}
 }
 
-func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
+// Renders the audit log of a live database, listing the write statements run against it, who by, and how many rows
+// they changed.  Only people who can manage the database can see it.  Adding format=csv downloads the whole log
+// instead, eg /liveaudit/justinclift/Marine%20Litter%20Survey.sqlite?format=csv
+func liveAuditPage(w http.ResponseWriter, r *http.Request) {
 	var pageData struct {
 		Auth0      com.Auth0Set
 		Meta       com.MetaInfo
-		PrivateDBs []com.DBInfo
-		PublicDBs  []com.DBInfo
-		Stars      []com.DBEntry
+		Older      int64
+		Statements []com.LiveStatement
 	}
-	pageData.Meta.Owner = userName
-	pageData.Meta.Title = userName
-	pageData.Meta.Server = com.WebServer()
-	pageData.Meta.LoggedInUser = userName
 
-	// Check if the desired user exists
-	userExists, err := com.CheckUserExists(userName)
-	if err != nil {
-		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+	// Ensure user is logged in
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			pageData.Meta.LoggedInUser = loggedInUser
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+	if loggedInUser == "" {
+		errorPage(w, r, http.StatusForbidden, "Error: Must be logged in to view that page.")
+		return
+	}
+
+	// Retrieve the database owner, folder, and database name
+	dbOwner, dbName, err := com.GetOD(1, r) // 1 = Ignore "/liveaudit/" at the start of the URL
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowed, err := com.CanManageDBs(dbOwner, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !allowed {
+		errorPage(w, r, http.StatusForbidden, "You can only view the audit log of your own databases")
+		return
+	}
+
+	// The log is kept after live mode is turned off, so it's shown for any database which has one
+	db, _, err := com.DBLive(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if db.ID == 0 {
+		errorPage(w, r, http.StatusNotFound, "Database not found")
+		return
+	}
+
+	// Send the whole log as CSV if asked
+	if r.FormValue("format") == "csv" {
+		list, err := com.LiveStatements(db.ID, 0, 0)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
+			url.QueryEscape(dbName+"-audit.csv")))
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c := csv.NewWriter(w)
+		c.Write([]string{"id", "date_executed", "username", "rows_affected", "statement"})
+		for _, j := range list {
+			c.Write([]string{strconv.FormatInt(j.ID, 10), j.DateExecuted.UTC().Format(time.RFC3339), j.UserName,
+				strconv.FormatInt(j.RowsAffected, 10), j.Statement})
+		}
+		c.Flush()
+		if err = c.Error(); err != nil {
+			log.Printf("Error sending audit log for '%s%s%s': %v\n", dbOwner, dbFolder, dbName, err)
+		}
+		return
+	}
+
+	// Retrieve a page of the log, continuing from an older entry if one was given
+	before, _ := strconv.ParseInt(r.FormValue("before"), 10, 64)
+	pageData.Statements, err = com.LiveStatements(db.ID, before, com.LiveAuditPageSize)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if len(pageData.Statements) == com.LiveAuditPageSize {
+		pageData.Older = pageData.Statements[len(pageData.Statements)-1].ID
+	}
+	pageData.Meta.Title = "Audit log"
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("liveAuditPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the page listing the ways users can log in or register.  This is used instead of the Auth0 Lock widget when
+// GitHub, GitLab, or Google logins are turned on.
+func loginPage(w http.ResponseWriter, r *http.Request) {
+	var pageData struct {
+		Auth0     com.Auth0Set
+		Meta      com.MetaInfo
+		Providers []string
+	}
+
+	// Logged in users link more logins from their preferences page instead
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			http.Redirect(w, r, "/pref", http.StatusTemporaryRedirect)
+			return
+		}
+	}
+	pageData.Meta.Title = "Login / Register"
+	pageData.Providers = com.LoginProviders()
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("loginPage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders a merge request, with its timeline and what's still needed before it can be merged.
+func mergeRequestPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string,
+	id int64) {
+	var pageData struct {
+		Auth0        com.Auth0Set
+		Blockers     []string
+		CanWrite     bool
+		Checks       []com.StatusCheck
+		Events       []com.MergeRequestEvent
+		Head         com.BranchHead
+		MergeRequest com.MergeRequest
+		Meta         com.MetaInfo
+		TargetHead   com.BranchHead
+	}
+	pageData.Meta.Title = "Merge request"
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			pageData.Meta.LoggedInUser = loggedInUser
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Merge requests can be seen by anyone who can see the database
+	var ok bool
+	pageData.CanWrite, ok = readAccess(w, r, loggedInUser, dbOwner, dbFolder, dbName)
+	if !ok {
+		return
+	}
+	var found bool
+	var err error
+	pageData.MergeRequest, found, err = com.MergeRequest(dbOwner, dbFolder, dbName, id)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	if !found {
+		errorPage(w, r, http.StatusNotFound, "That merge request doesn't exist")
+		return
+	}
+	mr := pageData.MergeRequest
+
+	// Put together the timeline, from the merge request itself and its approvals
+	pageData.Events = append(pageData.Events, com.MergeRequestEvent{Date: mr.DateCreated, Kind: com.MergeEventOpened,
+		UserName: mr.CreatedBy})
+	approvals, err := com.MergeRequestApprovals(mr.ID)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+	pageData.Events = append(pageData.Events, approvals...)
+	switch mr.State {
+	case com.MergeRequestClosed:
+		pageData.Events = append(pageData.Events, com.MergeRequestEvent{Date: mr.DateClosed,
+			Kind: com.MergeEventClosed, UserName: mr.ClosedBy})
+	case com.MergeRequestMerged:
+		pageData.Events = append(pageData.Events, com.MergeRequestEvent{Date: mr.DateClosed,
+			Kind: com.MergeEventMerged, UserName: mr.ClosedBy})
+	}
+
+	// For open merge requests, show what would be merged and anything still stopping it
+	if mr.State == com.MergeRequestOpen {
+		var headFound bool
+		pageData.Head, headFound, err = com.BranchHead(dbOwner, dbFolder, dbName, mr.SourceBranch)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+		if headFound && pageData.Head.CommitID != "" {
+			pageData.Checks, err = com.StatusChecks(dbOwner, dbFolder, dbName, pageData.Head.CommitID)
+			if err != nil {
+				errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+				return
+			}
+		}
+		pageData.TargetHead, _, err = com.BranchHead(dbOwner, dbFolder, dbName, mr.TargetBranch)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+		pageData.Blockers, err = com.MergeBlockers(dbOwner, dbFolder, dbName, mr, pageData.Head.CommitID)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+		if !headFound {
+			pageData.Blockers = append(pageData.Blockers, "The branch of this merge request doesn't exist any more")
+		}
+	}
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("mergeRequestPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the list of merge requests for a database.  Users who can change the database can open new ones from here.
+func mergeRequestsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) {
+	var pageData struct {
+		Auth0         com.Auth0Set
+		Branches      []com.BranchHead
+		CanWrite      bool
+		DefaultBranch string
+		MergeRequests []com.MergeRequest
+		Meta          com.MetaInfo
+	}
+	pageData.Meta.Title = "Merge requests"
+	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
+	pageData.Meta.Database = dbName
+	pageData.DefaultBranch = com.DefaultBranch
+
+	// Retrieve session data (if any)
+	var loggedInUser string
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			loggedInUser = u.(string)
+			pageData.Meta.LoggedInUser = loggedInUser
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Merge requests can be seen by anyone who can see the database
+	var ok bool
+	pageData.CanWrite, ok = readAccess(w, r, loggedInUser, dbOwner, dbFolder, dbName)
+	if !ok {
+		return
+	}
+	var err error
+	pageData.MergeRequests, err = com.MergeRequests(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+
+	// The branches are only needed for opening new merge requests
+	if pageData.CanWrite {
+		pageData.Branches, err = com.BranchHeads(dbOwner, dbFolder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+			return
+		}
+	}
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("mergeRequestsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Asks the user whether to grant a third party application access to their account.  The nonce is the OpenID Connect
+// one from the application, while the consent token ties the form to the user's session.
+func oauthConsentPage(w http.ResponseWriter, r *http.Request, loggedInUser string, client com.OAuthClient,
+	scopes []string, redirectURI string, state string, nonce string, consentToken string) {
+	var pageData struct {
+		Auth0         com.Auth0Set
+		Client        com.OAuthClient
+		ConsentToken  string
+		Meta          com.MetaInfo
+		Nonce         string
+		ProfileAccess bool
+		ReadAccess    bool
+		RedirectURI   string
+		Scope         string
+		State         string
+		WriteAccess   bool
+	}
+	pageData.Meta.Title = "Authorise application"
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.Client = client
+	pageData.ConsentToken = consentToken
+	pageData.Nonce = nonce
+	pageData.RedirectURI = redirectURI
+	pageData.Scope = strings.Join(scopes, " ")
+	pageData.State = state
+	for _, s := range scopes {
+		if s == com.OAuthScopeProfile {
+			pageData.ProfileAccess = true
+		}
+		if s == com.OAuthScopeRead {
+			pageData.ReadAccess = true
+		}
+		if s == com.OAuthScopeWrite {
+			pageData.WriteAccess = true
+		}
+	}
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("oauthConsentPage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the user Preferences page.
+func prefPage(w http.ResponseWriter, r *http.Request, loggedInUser string) {
+	var pageData struct {
+		APITokens      []com.APIToken
+		Apps           []com.OAuthGrant
+		Auth0          com.Auth0Set
+		Beta           bool
+		Digest         string
+		LoginProviders []string
+		Logins         []com.LoginIdentity
+		MaxRows        int
+		MaxRowsLimit   int
+		Meta           com.MetaInfo
+		NotifyChannels []string
+		NotifyKinds    []com.NotificationKind
+		NotifyPrefs    map[string]map[string]bool
+		NotifyWebhook  string
+		Profile        com.UserProfile
+		Webhooks       bool
+	}
+	pageData.Meta.Title = "Preferences"
+	pageData.Meta.LoggedInUser = loggedInUser
+
+	// Retrieve the user preference data
+	pageData.MaxRows = com.PrefUserMaxRows(loggedInUser)
+	pageData.MaxRowsLimit = com.WebMaxDisplayRows()
+	pageData.Digest = com.PrefUserDigest(loggedInUser)
+	pageData.Beta = com.PrefUserBeta(loggedInUser)
+	pageData.NotifyWebhook = com.PrefUserNotifyWebhook(loggedInUser)
+	pageData.NotifyKinds = com.NotificationKinds
+	pageData.Webhooks = com.FeatureEnabled(com.FeatureWebhooks, loggedInUser)
+	for _, c := range com.NotificationChannels {
+		if c == com.ChannelWebhook && !pageData.Webhooks {
+			continue
+		}
+		pageData.NotifyChannels = append(pageData.NotifyChannels, c)
+	}
+	var err error
+	pageData.NotifyPrefs, err = com.NotificationPrefs(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Profile, err = com.UserProfileDetails(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the list of applications the user has granted access to
+	pageData.Apps, err = com.OAuthGrants(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.APITokens, err = com.APITokens(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the logins linked to the users' account, and the providers they can link more from
+	pageData.Logins, err = com.UserIdentities(loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.LoginProviders = com.LoginProviders()
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("prefPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
+	var pageData struct {
+		ActiveCerts int
+		Auth0       com.Auth0Set
+		Followers   []com.Follow
+		Following   []com.Follow
+		Meta        com.MetaInfo
+		Orgs        []string
+		PrivateDBs  []com.DBInfo
+		Profile     com.UserProfile
+		PublicDBs   []com.DBInfo
+		Stars       []com.DBEntry
+		Watching    []com.DBEntry
+	}
+	pageData.Meta.FeedURL = fmt.Sprintf("/%s.atom", userName)
+	pageData.Meta.Owner = userName
+	pageData.Meta.Title = userName
+	pageData.Meta.Server = com.WebServer()
+	pageData.Meta.LoggedInUser = userName
+
+	// Check if the desired user exists
+	userExists, err := com.CheckUserExists(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
 	}
 
@@ -480,6 +1327,51 @@ func profilePage(w http.ResponseWriter, r *http.Request, userName string) {
 		return
 	}
 
+	// Retrieve the list of databases the user is watching
+	pageData.Watching, err = com.UserWatchedDBs(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the followers and followed users
+	pageData.Followers, err = com.Followers(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.Following, err = com.Following(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Count the user's client certificates which can still be used
+	certs, err := com.ClientCerts(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	for _, c := range certs {
+		if c.Revoked == nil && !c.Expired {
+			pageData.ActiveCerts++
+		}
+	}
+
+	// Retrieve the organisations the user is a member of
+	pageData.Orgs, err = com.UserOrgs(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the user's profile
+	pageData.Profile, err = com.UserProfileDetails(userName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
 	// Add Auth0 info to the page data
 	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
 	pageData.Auth0.ClientID = com.Auth0ClientID()
@@ -528,7 +1420,7 @@ func selectUsernamePage(w http.ResponseWriter, r *http.Request) {
 	pageData.Auth0.ClientID = com.Auth0ClientID()
 	pageData.Auth0.Domain = com.Auth0Domain()
 
-	// If the Auth0 profile included a nickname, we use that to prefill the input field
+	// If the login provider profile included a nickname, we use that to prefill the input field
 	ni := sess.CAttr("nickname")
 	if ni != nil {
 		pageData.Nick = ni.(string)
@@ -546,11 +1438,31 @@ func selectUsernamePage(w http.ResponseWriter, r *http.Request) {
 func settingsPage(w http.ResponseWriter, r *http.Request) {
 	// Structure to hold page data
 	var pageData struct {
-		Auth0 com.Auth0Set
-		DB    com.SQLiteDBinfo
-		Meta  com.MetaInfo
+		Auth0               com.Auth0Set
+		DB                  com.SQLiteDBinfo
+		DefaultBranch       string
+		DeletedVersionDays  int
+		DeletedVersions     []com.DeletedVersion
+		ImportHooks         []com.ImportHook
+		LiveAvailable       bool
+		LiveSnapshotMinutes int
+		Meta                com.MetaInfo
+		ProtectedBranches   []com.ProtectedBranch
+		RequiredChecks      []string
+		ReviewMaxApprovals  int
+		ReviewPolicy        com.ReviewPolicy
+		ShareLinkMaxDays    int
+		ShareLinks          []com.ShareLink
+		Shares              []com.DBShare
+		ValidationRules     []com.ValidationRule
+		Versions            []int
+		WebhookDeliveries   []com.WebhookDelivery
+		WebhookEvents       []string
+		Webhooks            []com.DBWebhook
+		WebhooksEnabled     bool
 	}
 	pageData.Meta.Title = "Database settings"
+	pageData.Meta.Server = com.WebServer()
 
 	// Retrieve session data (if any)
 	var loggedInUser string
@@ -573,13 +1485,17 @@ func settingsPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve the database owner, database name, and version
-	// TODO: Add folder support
+	// Retrieve the database owner, folder, database name, and version
 	dbOwner, dbName, dbVersion, err := com.GetODV(1, r) // 1 = Ignore "/settings/" at the start of the URL
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	dbFolder, err := com.GetFolder(r)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// Validate the supplied information
 	if dbOwner == "" || dbName == "" {
@@ -590,21 +1506,32 @@ func settingsPage(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, r, http.StatusBadRequest, "Missing database version number")
 		return
 	}
-	if dbOwner != loggedInUser {
+	allowed, err := com.CanManageDBs(dbOwner, loggedInUser)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	if !allowed {
 		errorPage(w, r, http.StatusBadRequest,
 			"You can only access the settings page for your own databases")
 		return
 	}
 
 	// Check if the user has access to the requested database (and get it's details if available)
-	err = com.DBDetails(&pageData.DB, loggedInUser, dbOwner, "/", dbName, dbVersion)
+	err = com.DBDetails(r.Context(), &pageData.DB, loggedInUser, dbOwner, dbFolder, dbName, dbVersion)
 	if err != nil {
 		errorPage(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	// Archived databases are read-only, so their settings can't be changed
+	if pageData.DB.Info.Archived {
+		errorPage(w, r, http.StatusForbidden, "This database is archived, so its settings can't be changed")
+		return
+	}
+
 	// Get the Minio bucket and ID for the given database
-	bkt, id, err := com.MinioBucketID(dbOwner, dbName, dbVersion, loggedInUser)
+	bkt, id, err := com.MinioBucketID(dbOwner, dbFolder, dbName, dbVersion, loggedInUser)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError,
 			"Could not retrieve internal information for the requested database")
@@ -612,15 +1539,15 @@ func settingsPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get a handle from Minio for the database object
-	sdb, err := com.OpenMinioObject(bkt, id)
+	sdb, err := com.OpenMinioObject(r.Context(), bkt, id)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// Retrieve the list of tables in the database
-	pageData.DB.Info.Tables, err = com.Tables(sdb, fmt.Sprintf("%s%s%s", dbOwner, "/", dbName))
-	defer sdb.Close()
+	pageData.DB.Info.Tables, err = com.Tables(sdb, fmt.Sprintf("%s%s%s", dbOwner, dbFolder, dbName))
+	defer com.ReleaseSQLiteHandle(sdb)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, err.Error())
 		return
@@ -628,6 +1555,7 @@ func settingsPage(w http.ResponseWriter, r *http.Request) {
 
 	// Fill out the metadata
 	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
 	pageData.Meta.Database = dbName
 
 	// If the default table is blank, use the first one from the table list
@@ -638,6 +1566,89 @@ func settingsPage(w http.ResponseWriter, r *http.Request) {
 	// TODO: Hook up the real license choices
 	pageData.DB.Info.License = com.OTHER
 
+	// Retrieve the versions which can be deleted, and the deleted ones which can still be restored
+	pageData.Versions, err = com.DBVersions(loggedInUser, dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.DeletedVersions, err = com.DeletedDBVersions(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+	pageData.DeletedVersionDays = com.WebDeletedVersionDays()
+
+	// Retrieve the users the database has been shared with
+	pageData.Shares, err = com.DBShares(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Live mode can always be turned off, but only turned on where it's available
+	pageData.LiveAvailable = com.LiveDataDir() != "" && com.FeatureEnabled(com.FeatureLiveDBs, dbOwner)
+	pageData.LiveSnapshotMinutes = com.LiveSnapshotInterval() / 60
+
+	// Retrieve the protected branches
+	pageData.DefaultBranch = com.DefaultBranch
+	pageData.ProtectedBranches, err = com.ProtectedBranches(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the share links for the database
+	pageData.ShareLinkMaxDays = com.ShareLinkMaxDays
+	pageData.ShareLinks, err = com.ShareLinks(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the status checks which need to pass before merge requests can be accepted
+	pageData.RequiredChecks, err = com.RequiredStatusChecks(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the validation rules new versions need to pass
+	pageData.ValidationRules, err = com.ValidationRules(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the review policy for merge requests
+	pageData.ReviewMaxApprovals = com.ReviewMaxApprovals
+	pageData.ReviewPolicy, err = com.DBReviewPolicy(dbOwner, dbFolder, dbName)
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+		return
+	}
+
+	// Retrieve the webhooks for the database, and their recent deliveries
+	pageData.WebhooksEnabled = com.FeatureEnabled(com.FeatureWebhooks, dbOwner)
+	if pageData.WebhooksEnabled {
+		pageData.WebhookEvents = com.DBWebhookEvents
+		pageData.Webhooks, err = com.DBWebhooks(dbOwner, dbFolder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.WebhookDeliveries, err = com.DBWebhookDeliveries(dbOwner, dbFolder, dbName, 20)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+		pageData.ImportHooks, err = com.ImportHooks(dbOwner, dbFolder, dbName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+
 	// Add Auth0 info to the page data
 	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
 	pageData.Auth0.ClientID = com.Auth0ClientID()
@@ -652,7 +1663,7 @@ func settingsPage(w http.ResponseWriter, r *http.Request) {
 }
 
 // Render the stars page.
-func starsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName string) {
+func starsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string) {
 	var pageData struct {
 		Auth0 com.Auth0Set
 		Meta  com.MetaInfo
@@ -660,6 +1671,7 @@ func starsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName st
 	}
 	pageData.Meta.Title = "Stars"
 	pageData.Meta.Owner = dbOwner
+	pageData.Meta.Folder = dbFolder
 	pageData.Meta.Database = dbName
 
 	// Retrieve session data (if any)
@@ -677,7 +1689,7 @@ func starsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName st
 
 	// Retrieve list of users who starred the database
 	var err error
-	pageData.Stars, err = com.UsersStarredDB(dbOwner, dbName)
+	pageData.Stars, err = com.UsersStarredDB(dbOwner, dbFolder, dbName)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
@@ -696,14 +1708,174 @@ func starsPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbName st
 	}
 }
 
+func statsPage(w http.ResponseWriter, r *http.Request, loggedInUser string, stats com.InstanceStats) {
+	var pageData struct {
+		Auth0 com.Auth0Set
+		Meta  com.MetaInfo
+		Stats com.InstanceStats
+	}
+	pageData.Meta.Title = "Statistics"
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.Stats = stats
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("statsPage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the takedown notice shown in place of a database which has been taken down.  The database details are still
+// shown, and the owner can see the complaint and respond to it with a counter notice.
+func takedownNoticePage(w http.ResponseWriter, r *http.Request, loggedInUser string, dbInfo com.DBInfo,
+	takedown com.Takedown) {
+	var pageData struct {
+		Auth0    com.Auth0Set
+		DB       com.DBInfo
+		IsOwner  bool
+		Meta     com.MetaInfo
+		Takedown com.Takedown
+	}
+	pageData.DB = dbInfo
+	pageData.IsOwner = loggedInUser == takedown.DBOwner
+	pageData.Meta.Database = takedown.DBName
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.Meta.NoIndex = true
+	pageData.Meta.Owner = takedown.DBOwner
+	pageData.Meta.Title = fmt.Sprintf("%s / %s", takedown.DBOwner, takedown.DBName)
+
+	// Only the database owner gets to see who complained
+	if !pageData.IsOwner {
+		takedown.ComplainantEmail = ""
+		takedown.ComplainantName = ""
+		takedown.Description = ""
+	}
+	pageData.Takedown = takedown
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	w.WriteHeader(http.StatusUnavailableForLegalReasons)
+	t := tmpl.Lookup("takedownNoticePage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the takedown request form.
+func takedownPage(w http.ResponseWriter, r *http.Request, dbOwner string, dbFolder string, dbName string,
+	submitted bool) {
+	var pageData struct {
+		Auth0     com.Auth0Set
+		DBFolder  string
+		DBName    string
+		DBOwner   string
+		Meta      com.MetaInfo
+		Submitted bool
+	}
+	pageData.Meta.Title = "Takedown request"
+	pageData.DBFolder = dbFolder
+	pageData.DBName = dbName
+	pageData.DBOwner = dbOwner
+	pageData.Submitted = submitted
+
+	// Retrieve session data (if any)
+	sess := session.Get(r)
+	if sess != nil {
+		u := sess.CAttr("UserName")
+		if u != nil {
+			pageData.Meta.LoggedInUser = u.(string)
+		} else {
+			session.Remove(sess, w)
+		}
+	}
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("takedownPage")
+	err := t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// Renders the terms of service and privacy policy page.
+func termsPage(w http.ResponseWriter, r *http.Request, loggedInUser string, needsAccept bool, next string) {
+	var pageData struct {
+		Auth0       com.Auth0Set
+		Meta        com.MetaInfo
+		NeedsAccept bool
+		Next        string
+		Privacy     string
+		Terms       string
+		Version     com.TermsVersion
+	}
+	pageData.Meta.Title = "Terms of service"
+	pageData.Meta.LoggedInUser = loggedInUser
+	pageData.NeedsAccept = needsAccept
+	pageData.Next = next
+
+	// Retrieve the current terms
+	var err error
+	pageData.Version, err = com.CurrentTerms()
+	if err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Database query failure")
+		return
+	}
+
+	// Render the terms as markdown / CommonMark
+	pageData.Terms = commonmark.Md2Html(pageData.Version.Terms, commonmark.CMARK_OPT_DEFAULT)
+	pageData.Privacy = commonmark.Md2Html(pageData.Version.Privacy, commonmark.CMARK_OPT_DEFAULT)
+
+	// Add Auth0 info to the page data
+	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
+	pageData.Auth0.ClientID = com.Auth0ClientID()
+	pageData.Auth0.Domain = com.Auth0Domain()
+
+	// Render the page
+	t := tmpl.Lookup("termsPage")
+	err = t.Execute(w, pageData)
+	if err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
 func uploadPage(w http.ResponseWriter, r *http.Request, userName string) {
 	var pageData struct {
 		Auth0 com.Auth0Set
+		IsOrg bool
 		Meta  com.MetaInfo
 	}
 	pageData.Meta.Title = "Upload database"
 	pageData.Meta.LoggedInUser = userName
 
+	// New versions of databases shared with the user, and databases for organisations, are uploaded on behalf of
+	// their owner
+	pageData.Meta.Owner = userName
+	if owner := strings.ToLower(r.FormValue("owner")); owner != "" && com.ValidateUser(owner) == nil {
+		pageData.Meta.Owner = owner
+		var err error
+		pageData.IsOrg, err = com.IsOrganisation(owner)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+
 	// Add Auth0 info to the page data
 	pageData.Auth0.CallbackURL = "https://" + com.WebServer() + "/x/callback"
 	pageData.Auth0.ClientID = com.Auth0ClientID()
@@ -720,10 +1892,20 @@ func uploadPage(w http.ResponseWriter, r *http.Request, userName string) {
 func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 	// Structure to hold page data
 	var pageData struct {
-		Auth0  com.Auth0Set
-		DBRows []com.DBInfo
-		Meta   com.MetaInfo
-	}
+		Activity    []com.FeedEntry
+		Auth0       com.Auth0Set
+		DBRows      []com.DBInfo
+		Followers   []com.Follow
+		Following   []com.Follow
+		IsFollowing bool
+		IsOrg       bool
+		Members     []com.OrgMember
+		Meta        com.MetaInfo
+		MyRole      string
+		PrivateDBs  []com.DBInfo
+		Profile     com.UserProfile
+	}
+	pageData.Meta.FeedURL = fmt.Sprintf("/%s.atom", userName)
 	pageData.Meta.Owner = userName
 	pageData.Meta.Title = userName
 	pageData.Meta.Server = com.WebServer()
@@ -746,8 +1928,8 @@ func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 		}
 	}
 
-	// Check if the desired user exists
-	userExists, err := com.CheckUserExists(userName)
+	// Retrieve the list of public databases for the user, and their followers and followed users
+	details, userExists, err := com.UserPage(userName)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return
@@ -758,9 +1940,36 @@ func userPage(w http.ResponseWriter, r *http.Request, userName string) {
 		errorPage(w, r, http.StatusNotFound, fmt.Sprintf("Unknown user: %s", userName))
 		return
 	}
+	pageData.DBRows = details.DBRows
+	pageData.Followers = details.Followers
+	pageData.Following = details.Following
+	pageData.IsOrg = details.IsOrg
+	pageData.Members = details.Members
+	pageData.Profile = details.Profile
+	if loggedInUser != "" {
+		pageData.IsFollowing, err = com.IsFollowing(loggedInUser, userName)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
 
-	// Retrieve list of public databases for the user
-	pageData.DBRows, err = com.UserDBs(userName, com.DB_PUBLIC)
+	// Members of an organisation can see its private databases too
+	for _, m := range pageData.Members {
+		if m.UserName == loggedInUser {
+			pageData.MyRole = m.Role
+		}
+	}
+	if pageData.MyRole != "" {
+		pageData.PrivateDBs, err = com.UserDBs(userName, com.DB_PRIVATE)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Database query failed")
+			return
+		}
+	}
+
+	// Retrieve what the user has been doing recently
+	pageData.Activity, err = com.Activity(userName, 0, com.FeedLength)
 	if err != nil {
 		errorPage(w, r, http.StatusInternalServerError, "Database query failed")
 		return